@@ -7,6 +7,7 @@
 package dtmcli
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
@@ -15,6 +16,18 @@ import (
 	"github.com/dtm-labs/dtm/dtmcli/logger"
 )
 
+// BarrierResult the result of a call with barrier. it is empty if the barrier fails before deciding whether to call busiCall
+type BarrierResult string
+
+const (
+	// BarrierExecuted busiCall is called, and the error returned is the error of busiCall
+	BarrierExecuted BarrierResult = "executed"
+	// BarrierDuplicateSkipped busiCall is skipped, because it is a repeated request, or a dangled request, such as a try after the cancel
+	BarrierDuplicateSkipped BarrierResult = "duplicate_skipped"
+	// BarrierNullCompensationSkipped busiCall is skipped, because it is a cancel/compensate whose try/action is not executed
+	BarrierNullCompensationSkipped BarrierResult = "null_compensation_skipped"
+)
+
 // BarrierBusiFunc type for busi func
 type BarrierBusiFunc func(tx *sql.Tx) error
 
@@ -68,13 +81,33 @@ func insertBarrier(tx DB, transType string, gid string, branchID string, op stri
 // Call 子事务屏障，详细介绍见 https://zhuanlan.zhihu.com/p/388444465
 // tx: 本地数据库的事务对象，允许子事务屏障进行事务操作
 // busiCall: 业务函数，仅在必要时被调用
-func (bb *BranchBarrier) Call(tx *sql.Tx, busiCall BarrierBusiFunc) (rerr error) {
-	bid := bb.newBarrierID()
+func (bb *BranchBarrier) Call(tx *sql.Tx, busiCall BarrierBusiFunc) error {
+	_, err := bb.CallWithResult(tx, busiCall)
+	return err
+}
+
+// CallWithResult the same as Call, and returns whether busiCall is executed, or skipped by the barrier
+func (bb *BranchBarrier) CallWithResult(tx *sql.Tx, busiCall BarrierBusiFunc) (result BarrierResult, rerr error) {
 	defer dtmimp.DeferDo(&rerr, func() error {
 		return tx.Commit()
 	}, func() error {
 		return tx.Rollback()
 	})
+	return bb.CallInTxWithResult(tx, func() error {
+		return busiCall(tx)
+	})
+}
+
+// CallInTx the same as Call, but the transaction is committed or rolled back by the caller.
+// tx should execute the sqls in the transaction. it is used by the adapters of other db libraries, such as dtmgorm
+func (bb *BranchBarrier) CallInTx(tx DB, busiCall func() error) error {
+	_, err := bb.CallInTxWithResult(tx, busiCall)
+	return err
+}
+
+// CallInTxWithResult the same as CallInTx, and returns whether busiCall is executed, or skipped by the barrier
+func (bb *BranchBarrier) CallInTxWithResult(tx DB, busiCall func() error) (result BarrierResult, rerr error) {
+	bid := bb.newBarrierID()
 	originOp := map[string]string{
 		BranchCancel:     BranchTry,
 		BranchCompensate: BranchAction,
@@ -85,26 +118,32 @@ func (bb *BranchBarrier) Call(tx *sql.Tx, busiCall BarrierBusiFunc) (rerr error)
 	logger.Debugf("originAffected: %d currentAffected: %d", originAffected, currentAffected)
 
 	if rerr == nil && bb.Op == opMsg && currentAffected == 0 { // for msg's DoAndSubmit, repeated insert should be rejected.
-		return ErrDuplicated
+		return BarrierDuplicateSkipped, ErrDuplicated
 	}
 
 	if rerr == nil {
 		rerr = oerr
 	}
-
-	if (bb.Op == BranchCancel || bb.Op == BranchCompensate) && originAffected > 0 || // null compensate
-		currentAffected == 0 { // repeated request or dangled request
+	if rerr != nil {
 		return
 	}
-	if rerr == nil {
-		rerr = busiCall(tx)
+	if (bb.Op == BranchCancel || bb.Op == BranchCompensate) && originAffected > 0 { // null compensate
+		return BarrierNullCompensationSkipped, nil
 	}
-	return
+	if currentAffected == 0 { // repeated request or dangled request
+		return BarrierDuplicateSkipped, nil
+	}
+	return BarrierExecuted, busiCall()
 }
 
 // CallWithDB the same as Call, but with *sql.DB
 func (bb *BranchBarrier) CallWithDB(db *sql.DB, busiCall BarrierBusiFunc) error {
-	tx, err := db.Begin()
+	return bb.CallWithDBCtx(context.Background(), db, busiCall)
+}
+
+// CallWithDBCtx the same as CallWithDB, but the local transaction is bound to ctx
+func (bb *BranchBarrier) CallWithDBCtx(ctx context.Context, db *sql.DB, busiCall BarrierBusiFunc) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err == nil {
 		err = bb.Call(tx, busiCall)
 	}
@@ -113,14 +152,34 @@ func (bb *BranchBarrier) CallWithDB(db *sql.DB, busiCall BarrierBusiFunc) error
 
 // QueryPrepared queries prepared data
 func (bb *BranchBarrier) QueryPrepared(db *sql.DB) error {
-	_, err := insertBarrier(db, bb.TransType, bb.Gid, "00", "msg", "01", "rollback")
+	return bb.QueryPreparedCtx(context.Background(), db)
+}
+
+// QueryPreparedCtx the same as QueryPrepared, but the queries are bound to ctx
+func (bb *BranchBarrier) QueryPreparedCtx(ctx context.Context, db *sql.DB) error {
+	cdb := ctxDB{ctx: ctx, db: db}
+	_, err := insertBarrier(cdb, bb.TransType, bb.Gid, "00", "msg", "01", "rollback")
 	var reason string
 	if err == nil {
 		sql := fmt.Sprintf("select reason from %s where gid=? and branch_id=? and op=? and barrier_id=?", dtmimp.BarrierTableName)
-		err = db.QueryRow(sql, bb.Gid, "00", "msg", "01").Scan(&reason)
+		err = cdb.QueryRow(sql, bb.Gid, "00", "msg", "01").Scan(&reason)
 	}
 	if reason == "rollback" {
 		return ErrFailure
 	}
 	return err
 }
+
+// ctxDB binds the queries of a *sql.DB to ctx
+type ctxDB struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (c ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c ctxDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+)
+
+// MinBarrierRetention the min retention of the barrier records accepted by BarrierGC.
+// a barrier record prevents the repeated, dangled and null compensation requests of a branch. dtm server retries
+// a branch until the global trans is finished, and a compensation returning errors is retried without limit, so
+// if the record is deleted before that, a retried request will be executed again. the retention is not derived from
+// the lifetime of the global trans, which is unbounded. it should be longer than the time a global trans may stay
+// unfinished in your system, and the global trans unfinished for longer should be finished manually before their records
+// are deleted
+const MinBarrierRetention = 24 * time.Hour
+
+// BarrierGC deletes the barrier records created before olderThan, in batches of batchSize, and returns the deleted count
+func BarrierGC(db *sql.DB, olderThan time.Duration, batchSize int) (int64, error) {
+	if err := checkBarrierGC(olderThan, batchSize); err != nil {
+		return 0, err
+	}
+	sql := dtmimp.GetDBSpecial().GetDeleteLimitSQL(dtmimp.BarrierTableName, "create_time < ?", batchSize)
+	before := time.Now().Add(-olderThan)
+	total := int64(0)
+	for {
+		affected, err := dtmimp.DBExec(db, sql, before)
+		total += affected
+		if err != nil || affected < int64(batchSize) {
+			return total, err
+		}
+	}
+}
+
+// StartBarrierGC starts to call BarrierGC every interval, until ctx is done. onSweep, if not nil, is called with the result
+// of every sweep
+func StartBarrierGC(ctx context.Context, db *sql.DB, olderThan time.Duration, batchSize int, interval time.Duration, onSweep func(deleted int64, err error)) error {
+	if err := checkBarrierGC(olderThan, batchSize); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("bad barrier gc interval %v. %w", interval, ErrFailure)
+	}
+	go func() {
+		for {
+			deleted, err := BarrierGC(db, olderThan, batchSize)
+			if err != nil {
+				logger.Errorf("barrier gc error: %v", err)
+			} else {
+				logger.Infof("barrier gc deleted %d records", deleted)
+			}
+			if onSweep != nil {
+				onSweep(deleted, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return nil
+}
+
+func checkBarrierGC(olderThan time.Duration, batchSize int) error {
+	if olderThan < MinBarrierRetention {
+		return fmt.Errorf("barrier retention %v is shorter than %v. %w", olderThan, MinBarrierRetention, ErrFailure)
+	}
+	if batchSize <= 0 {
+		return fmt.Errorf("bad barrier gc batch size %d. %w", batchSize, ErrFailure)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBarrierGCOptions(t *testing.T) {
+	_, err := BarrierGC(nil, time.Hour, 100) // a fresh barrier record should never be deleted
+	assert.True(t, errors.Is(err, ErrFailure))
+	_, err = BarrierGC(nil, MinBarrierRetention, 0)
+	assert.True(t, errors.Is(err, ErrFailure))
+	err = StartBarrierGC(context.Background(), nil, MinBarrierRetention, 100, 0, nil)
+	assert.True(t, errors.Is(err, ErrFailure))
+}
+
+type unreachableDriver struct{}
+
+func (unreachableDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not connectable")
+}
+
+func TestBarrierGCStop(t *testing.T) {
+	sql.Register("barrier-gc-unreachable", unreachableDriver{})
+	db, err := sql.Open("barrier-gc-unreachable", "")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	sweeps := make(chan error, 100)
+	err = StartBarrierGC(ctx, db, MinBarrierRetention, 100, 10*time.Millisecond, func(deleted int64, err error) {
+		sweeps <- err
+	})
+	assert.Nil(t, err)
+	assert.Error(t, <-sweeps)
+	cancel()
+	time.Sleep(50 * time.Millisecond) // a sweep may be running when canceled
+	for len(sweeps) > 0 {
+		<-sweeps
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, len(sweeps))
+}
@@ -8,47 +8,75 @@ import (
 	"github.com/dtm-labs/dtm/dtmcli/logger"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // MongoCall sub-trans barrier for mongo. see http://dtm.pub/practice/barrier
 // experimental
 func (bb *BranchBarrier) MongoCall(mc *mongo.Client, busiCall func(mongo.SessionContext) error) (rerr error) {
+	return mc.UseSession(context.Background(), func(sc mongo.SessionContext) error {
+		return bb.MongoCallWithSession(sc, busiCall)
+	})
+}
+
+// MongoCallWithSession the same as MongoCall, but in the session of the caller.
+// a transaction is started in the session, and it is committed if busiCall succeeds, or aborted otherwise
+// the barrier collection should have been created by MongoCreateBarrierIndex, because a collection can not be created in a transaction
+func (bb *BranchBarrier) MongoCallWithSession(sc mongo.SessionContext, busiCall func(mongo.SessionContext) error) (rerr error) {
 	bid := bb.newBarrierID()
-	return mc.UseSession(context.Background(), func(sc mongo.SessionContext) (rerr error) {
-		rerr = sc.StartTransaction()
-		if rerr != nil {
-			return nil
-		}
-		defer dtmimp.DeferDo(&rerr, func() error {
-			return sc.CommitTransaction(sc)
-		}, func() error {
-			return sc.AbortTransaction(sc)
-		})
-		originOp := map[string]string{
-			BranchCancel:     BranchTry,
-			BranchCompensate: BranchAction,
-		}[bb.Op]
+	rerr = sc.StartTransaction()
+	if rerr != nil {
+		return
+	}
+	defer dtmimp.DeferDo(&rerr, func() error {
+		return sc.CommitTransaction(sc)
+	}, func() error {
+		return sc.AbortTransaction(sc)
+	})
+	mc := sc.Client()
+	originOp := map[string]string{
+		BranchCancel:     BranchTry,
+		BranchCompensate: BranchAction,
+	}[bb.Op]
 
-		originAffected, oerr := mongoInsertBarrier(sc, mc, bb.TransType, bb.Gid, bb.BranchID, originOp, bid, bb.Op)
-		currentAffected, rerr := mongoInsertBarrier(sc, mc, bb.TransType, bb.Gid, bb.BranchID, bb.Op, bid, bb.Op)
-		logger.Debugf("originAffected: %d currentAffected: %d", originAffected, currentAffected)
+	originAffected, oerr := mongoInsertBarrier(sc, mc, bb.TransType, bb.Gid, bb.BranchID, originOp, bid, bb.Op)
+	currentAffected, rerr := mongoInsertBarrier(sc, mc, bb.TransType, bb.Gid, bb.BranchID, bb.Op, bid, bb.Op)
+	logger.Debugf("originAffected: %d currentAffected: %d", originAffected, currentAffected)
 
-		if rerr == nil && bb.Op == opMsg && currentAffected == 0 { // for msg's DoAndSubmit, repeated insert should be rejected.
-			return ErrDuplicated
-		}
+	if rerr == nil && bb.Op == opMsg && currentAffected == 0 { // for msg's DoAndSubmit, repeated insert should be rejected.
+		return ErrDuplicated
+	}
 
-		if rerr == nil {
-			rerr = oerr
-		}
-		if (bb.Op == BranchCancel || bb.Op == BranchCompensate) && originAffected > 0 || // null compensate
-			currentAffected == 0 { // repeated request or dangled request
-			return
-		}
-		if rerr == nil {
-			rerr = busiCall(sc)
-		}
+	if rerr == nil {
+		rerr = oerr
+	}
+	if (bb.Op == BranchCancel || bb.Op == BranchCompensate) && originAffected > 0 || // null compensate
+		currentAffected == 0 { // repeated request or dangled request
 		return
+	}
+	if rerr == nil {
+		rerr = busiCall(sc)
+	}
+	return
+}
+
+// MongoCreateBarrierIndex creates the barrier collection and its unique index, if not exists
+func MongoCreateBarrierIndex(mc *mongo.Client) error {
+	_, err := mongoBarrierCollection(mc).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "gid", Value: 1},
+			{Key: "branch_id", Value: 1},
+			{Key: "op", Value: 1},
+			{Key: "barrier_id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
 	})
+	return err
+}
+
+func mongoBarrierCollection(mc *mongo.Client) *mongo.Collection {
+	fs := strings.Split(dtmimp.BarrierTableName, ".")
+	return mc.Database(fs[0]).Collection(fs[1])
 }
 
 // MongoQueryPrepared query prepared for redis
@@ -57,9 +85,7 @@ func (bb *BranchBarrier) MongoQueryPrepared(mc *mongo.Client) error {
 	_, err := mongoInsertBarrier(context.Background(), mc, bb.TransType, bb.Gid, "00", "msg", "01", "rollback")
 	var result bson.M
 	if err == nil {
-		fs := strings.Split(dtmimp.BarrierTableName, ".")
-		barrier := mc.Database(fs[0]).Collection(fs[1])
-		err = barrier.FindOne(context.Background(), bson.D{
+		err = mongoBarrierCollection(mc).FindOne(context.Background(), bson.D{
 			{Key: "gid", Value: bb.Gid},
 			{Key: "branch_id", Value: "00"},
 			{Key: "op", Value: "msg"},
@@ -80,8 +106,7 @@ func mongoInsertBarrier(sc context.Context, mc *mongo.Client, transType string,
 	if op == "" {
 		return 0, nil
 	}
-	fs := strings.Split(dtmimp.BarrierTableName, ".")
-	barrier := mc.Database(fs[0]).Collection(fs[1])
+	barrier := mongoBarrierCollection(mc)
 	r := barrier.FindOne(sc, bson.D{
 		{Key: "gid", Value: gid},
 		{Key: "branch_id", Value: branchID},
@@ -99,7 +124,15 @@ func mongoInsertBarrier(sc context.Context, mc *mongo.Client, transType string,
 				{Key: "barrier_id", Value: barrierID},
 				{Key: "reason", Value: reason},
 			})
-		return 1, err
+		if mongo.IsDuplicateKeyError(err) {
+			// inserted concurrently by another request, the same as insert ignore of sql.
+			// in a transaction, the transaction is aborted by mongo, so the commit fails, and the request is retried
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
 	}
 	return 0, err
 }
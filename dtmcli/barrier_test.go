@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memDB a DB which runs the insert ignore of the barrier in memory
+type memDB map[string]bool
+
+func (m memDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	key := fmt.Sprint(args[1:5]...) // gid, branch_id, op, barrier_id
+	if m[key] {
+		return driverResult(0), nil
+	}
+	m[key] = true
+	return driverResult(1), nil
+}
+
+func (m memDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+type driverResult int64
+
+func (r driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (r driverResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func TestBarrierResult(t *testing.T) {
+	db := memDB{}
+	called := 0
+	busiCall := func() error {
+		called++
+		return nil
+	}
+	call := func(op string) (BarrierResult, error) {
+		bb, err := BarrierFrom("tcc", "TestBarrierResult", "01", op)
+		assert.Nil(t, err)
+		return bb.CallInTxWithResult(db, busiCall)
+	}
+
+	r, err := call(BranchCancel)
+	assert.Nil(t, err)
+	assert.Equal(t, BarrierNullCompensationSkipped, r)
+	r, err = call(BranchTry) // dangled try
+	assert.Nil(t, err)
+	assert.Equal(t, BarrierDuplicateSkipped, r)
+	assert.Equal(t, 0, called)
+
+	bb, _ := BarrierFrom("tcc", "TestBarrierResult", "02", BranchTry)
+	r, err = bb.CallInTxWithResult(db, func() error { return ErrFailure })
+	assert.True(t, errors.Is(err, ErrFailure))
+	assert.Equal(t, BarrierExecuted, r)
+
+	r, err = call("msg")
+	assert.Nil(t, err)
+	assert.Equal(t, BarrierExecuted, r)
+	r, err = call("msg")
+	assert.True(t, errors.Is(err, ErrDuplicated))
+	assert.Equal(t, BarrierDuplicateSkipped, r)
+	assert.Equal(t, 1, called)
+}
@@ -21,6 +21,8 @@ const (
 	StatusFailed = "failed"
 	// StatusAborting status for global trans status.
 	StatusAborting = "aborting"
+	// StatusQuarantined status for global trans status. the trans is not processed, because processing it panics repeatedly
+	StatusQuarantined = "quarantined"
 
 	// BranchTry branch type for TCC
 	BranchTry = "try"
@@ -48,6 +50,11 @@ const (
 	DBTypeMysql = dtmimp.DBTypeMysql
 	// DBTypePostgres const for driver postgres
 	DBTypePostgres = dtmimp.DBTypePostgres
+
+	// PriorityMin the min priority of a trans. 0 is the normal priority
+	PriorityMin = dtmimp.PriorityMin
+	// PriorityMax the max priority of a trans
+	PriorityMax = dtmimp.PriorityMax
 )
 
 // MapSuccess HTTP result of SUCCESS
@@ -65,3 +72,18 @@ var ErrOngoing = dtmimp.ErrOngoing
 // ErrDuplicated error of DUPLICATED for only msg
 // if QueryPrepared executed before call. then DoAndSubmit return this error
 var ErrDuplicated = dtmimp.ErrDuplicated
+
+// ErrInvalidArgument error for a request not valid, such as a gid not valid
+var ErrInvalidArgument = dtmimp.ErrInvalidArgument
+
+// ErrNotFound error for a trans not found, returned by the v2 api
+var ErrNotFound = dtmimp.ErrNotFound
+
+// ErrReadOnly error for a request changing trans refused by a read-only dtm server
+var ErrReadOnly = dtmimp.ErrReadOnly
+
+// ErrBusy error for a new trans refused by a dtm server whose backlog is too large. see BusyError
+var ErrBusy = dtmimp.ErrBusy
+
+// ErrGidNotOwned error for a request refused by dtm server because the gid is not under the prefixes claimed by the caller
+var ErrGidNotOwned = dtmimp.ErrGidNotOwned
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineHeader is the header of the http branch requests from dtm server, which is the deadline of the request in
+// unix milliseconds. dtm server gives up waiting for the response after the deadline
+const DeadlineHeader = "dtm-deadline"
+
+// DeadlineMinLeft is the minimal time left for a branch request. a deadline earlier than now plus it, such as a deadline
+// slightly in the past because of clock skew, is treated as now plus it
+var DeadlineMinLeft = 100 * time.Millisecond
+
+// ParseDeadline parses the value of DeadlineHeader
+func ParseDeadline(value string) (time.Time, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	deadline := time.Unix(0, ms*int64(time.Millisecond))
+	if min := time.Now().Add(DeadlineMinLeft); deadline.Before(min) {
+		deadline = min
+	}
+	return deadline, nil
+}
+
+// BranchContext returns a context done when dtm server gives up waiting for the response of the branch request, so
+// that the RM can stop working. for grpc branches, the deadline is already in ctx and header can be nil. for http
+// branches, the deadline is parsed from DeadlineHeader, such as BranchContext(r.Context(), r.Header)
+func BranchContext(ctx context.Context, header http.Header) (context.Context, context.CancelFunc) {
+	if v := header.Get(DeadlineHeader); v != "" {
+		if deadline, err := ParseDeadline(v); err == nil {
+			return context.WithDeadline(ctx, deadline) // the earlier one applies if ctx has a deadline
+		}
+	}
+	return context.WithCancel(ctx)
+}
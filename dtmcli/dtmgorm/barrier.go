@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+// Package dtmgorm adapts the branch barrier to gorm. it is a separate package, so that dtmcli does not depend on gorm
+package dtmgorm
+
+import (
+	"database/sql"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"gorm.io/gorm"
+)
+
+// CallWithGormDB the same as BranchBarrier.Call, but with *gorm.DB.
+// if db is in a transaction, such as the tx of db.Transaction, the barrier joins it in a savepoint,
+// otherwise a new transaction is started. busiCall is called with the db of the transaction
+func CallWithGormDB(bb *dtmcli.BranchBarrier, db *gorm.DB, busiCall func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return bb.CallInTx(gormDB{tx}, func() error {
+			return busiCall(tx)
+		})
+	})
+}
+
+// gormDB executes the sqls of the barrier in the connection of the gorm transaction
+type gormDB struct {
+	tx *gorm.DB
+}
+
+func (g gormDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return g.tx.Statement.ConnPool.ExecContext(g.tx.Statement.Context, query, args...)
+}
+
+func (g gormDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return g.tx.Statement.ConnPool.QueryRowContext(g.tx.Statement.Context, query, args...)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// the codes of the v2 api of dtm server
+const (
+	CodeOK              = "OK"
+	CodeFailure         = "FAILURE"
+	CodeOngoing         = "ONGOING"
+	CodeDuplicated      = "DUPLICATED"
+	CodeInvalidArgument = "INVALID_ARGUMENT"
+	CodeNotFound        = "NOT_FOUND"
+	CodeReadOnly        = "READ_ONLY"
+	CodeBusy            = "BUSY"
+	CodeGidNotOwned     = "GID_NOT_OWNED"
+	CodeInternal        = "INTERNAL"
+)
+
+// APIResponse is the envelope of the responses of the v2 api of dtm server
+type APIResponse struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// APIError is an error returned by the v2 api of dtm server. errors.Is matches it with the error of its code,
+// such as ErrNotFound for NOT_FOUND. DUPLICATED also matches ErrFailure, the error of v1 for a duplicated gid
+type APIError struct {
+	Status  int // the http status
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is matches the error of the code
+func (e *APIError) Is(target error) bool {
+	code, _ := ErrorCode(target)
+	return code == e.Code || e.Code == CodeDuplicated && target == ErrFailure
+}
+
+// BusyError is returned by a dtm server refusing new trans when its backlog is too large, such as prepare and submit,
+// while the requests of the existing trans work as usual. errors.Is matches it with ErrBusy, and with ErrOngoing if
+// Ongoing. the request is worth a retry after RetryAfter, or the caller can shed or buffer the load
+type BusyError struct {
+	RetryAfter time.Duration
+	Ongoing    bool // responded as ONGOING instead of BUSY, as configured by dtm server
+	Message    string
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %v", CodeBusy, e.Message, e.RetryAfter)
+}
+
+// Is matches ErrBusy, and ErrOngoing if Ongoing
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy || e.Ongoing && target == ErrOngoing
+}
+
+// RespAsBusyError returns a *BusyError if the response of dtm server is of status 429, or of status 425 with the
+// header Retry-After. nil otherwise
+func RespAsBusyError(resp *resty.Response) error {
+	retryAfter := resp.Header().Get("Retry-After")
+	if resp.StatusCode() != http.StatusTooManyRequests && (resp.StatusCode() != http.StatusTooEarly || retryAfter == "") {
+		return nil
+	}
+	e := BusyError{Ongoing: resp.StatusCode() == http.StatusTooEarly, Message: resp.String()}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	r := map[string]interface{}{}
+	if json.Unmarshal(resp.Body(), &r) == nil && r["message"] != nil {
+		e.Message = fmt.Sprint(r["message"])
+	}
+	return &e
+}
+
+// ErrorCode returns the code and the http status of the v2 api for err
+func ErrorCode(err error) (code string, status int) {
+	switch {
+	case err == nil:
+		return CodeOK, http.StatusOK
+	case errors.Is(err, ErrDuplicated):
+		return CodeDuplicated, http.StatusConflict
+	case errors.Is(err, ErrFailure):
+		return CodeFailure, http.StatusConflict
+	case errors.Is(err, ErrOngoing):
+		return CodeOngoing, http.StatusTooEarly
+	case errors.Is(err, ErrInvalidArgument):
+		return CodeInvalidArgument, http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return CodeNotFound, http.StatusNotFound
+	case errors.Is(err, ErrReadOnly):
+		return CodeReadOnly, http.StatusServiceUnavailable
+	case errors.Is(err, ErrBusy):
+		return CodeBusy, http.StatusTooManyRequests
+	case errors.Is(err, ErrGidNotOwned):
+		return CodeGidNotOwned, http.StatusForbidden
+	}
+	return CodeInternal, http.StatusInternalServerError
+}
+
+// IsAPIV2 returns whether the url of dtm server is of the v2 api, like http://localhost:36789/api/dtmsvr/v2
+func IsAPIV2(server string) bool {
+	return strings.HasSuffix(strings.TrimRight(server, "/"), "/v2")
+}
+
+// ParseDtmResp translates the response of dtm server at url to error, and unmarshals the data to result if result is
+// not nil. the response of the v2 api is parsed as APIResponse, and the error is an *APIError
+func ParseDtmResp(url string, resp *resty.Response, result interface{}) error {
+	if err := RespAsBusyError(resp); err != nil {
+		return err
+	}
+	if !IsAPIV2(url) {
+		if resp.StatusCode() == http.StatusForbidden && strings.Contains(resp.String(), CodeGidNotOwned) {
+			return fmt.Errorf("%s. %w", resp.String(), ErrGidNotOwned)
+		}
+		if err := RespAsErrorCompatible(resp); err != nil || result == nil {
+			return err
+		}
+		return json.Unmarshal(resp.Body(), result)
+	}
+	r := APIResponse{}
+	if err := json.Unmarshal(resp.Body(), &r); err != nil || r.Code == "" {
+		return fmt.Errorf("bad response of dtm server: %d %s", resp.StatusCode(), resp.String())
+	}
+	if r.Code != CodeOK {
+		return &APIError{Status: resp.StatusCode(), Code: r.Code, Message: r.Message}
+	}
+	if result == nil || len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, result)
+}
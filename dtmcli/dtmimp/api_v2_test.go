@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDtmRespV2(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/dtmsvr/v2/newGid":
+			w.Write([]byte(`{"code":"OK","data":{"gid":"gid1"}}`))
+		case "/api/dtmsvr/v2/submit":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"code":"DUPLICATED","message":"gid gid1 exists with different branches"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"NOT_FOUND","message":"trans gid2 not found"}`))
+		}
+	}))
+	defer svr.Close()
+	server := svr.URL + "/api/dtmsvr/v2"
+	assert.True(t, IsAPIV2(server))
+	assert.False(t, IsAPIV2(svr.URL+"/api/dtmsvr"))
+
+	resp, err := RestyClient.R().Get(server + "/newGid")
+	assert.Nil(t, err)
+	res := map[string]string{}
+	assert.Nil(t, ParseDtmResp(server, resp, &res))
+	assert.Equal(t, "gid1", res["gid"])
+
+	tb := NewTransBase("gid1", "saga", server, "")
+	err = TransCallDtm(tb, tb, "submit")
+	var apiErr *APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusConflict, apiErr.Status)
+	assert.True(t, errors.Is(err, ErrDuplicated))
+	assert.True(t, errors.Is(err, ErrFailure))
+	assert.False(t, errors.Is(err, ErrOngoing))
+
+	resp, err = RestyClient.R().Get(server + "/query")
+	assert.Nil(t, err)
+	err = ParseDtmResp(server, resp, &res)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, "NOT_FOUND: trans gid2 not found", err.Error())
+}
+
+func TestErrorCodeReadOnly(t *testing.T) {
+	code, status := ErrorCode(ErrReadOnly)
+	assert.Equal(t, CodeReadOnly, code)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.True(t, errors.Is(&APIError{Code: CodeReadOnly}, ErrReadOnly))
+}
+
+func TestParseDtmRespBusy(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/dtmsvr/submit":
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":"BUSY","message":"backlog too large"}`))
+		case "/api/dtmsvr/prepare":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooEarly)
+			w.Write([]byte(`{"dtm_result":"ONGOING","message":"backlog too large"}`))
+		default:
+			w.WriteHeader(http.StatusTooEarly)
+			w.Write([]byte(`{"dtm_result":"ONGOING"}`))
+		}
+	}))
+	defer svr.Close()
+	tb := NewTransBase("gid1", "saga", svr.URL+"/api/dtmsvr", "")
+	err := TransCallDtm(tb, tb, "submit")
+	var busy *BusyError
+	assert.True(t, errors.As(err, &busy))
+	assert.Equal(t, &BusyError{RetryAfter: 7 * time.Second, Message: "backlog too large"}, busy)
+	assert.True(t, errors.Is(err, ErrBusy))
+	assert.False(t, errors.Is(err, ErrOngoing))
+
+	err = TransCallDtm(tb, tb, "prepare")
+	assert.True(t, errors.As(err, &busy))
+	assert.Equal(t, 3*time.Second, busy.RetryAfter)
+	assert.True(t, errors.Is(err, ErrOngoing))
+
+	err = TransCallDtm(tb, tb, "abort") // ONGOING without Retry-After is not busy
+	assert.True(t, errors.Is(err, ErrOngoing))
+	assert.False(t, errors.Is(err, ErrBusy))
+
+	err = JrpcErrorAsError(map[string]interface{}{"code": float64(JrpcCodeBusy), "message": "busy", "data": map[string]interface{}{"retry_after": float64(5)}})
+	assert.Equal(t, &BusyError{RetryAfter: 5 * time.Second, Message: "busy"}, err)
+	code, status := ErrorCode(err)
+	assert.Equal(t, CodeBusy, code)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+}
+
+func TestParseDtmRespGidNotOwned(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(CallerTokenHeader) == "token1" {
+			w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"code":"GID_NOT_OWNED","message":"gid orders-1 is claimed by orders"}`))
+	}))
+	defer svr.Close()
+	tb := NewTransBase("orders-1", "saga", svr.URL+"/api/dtmsvr", "")
+	err := TransCallDtm(tb, tb, "submit")
+	assert.True(t, errors.Is(err, ErrGidNotOwned))
+	assert.False(t, errors.Is(err, ErrFailure))
+	tb.CallerToken = "token1"
+	assert.Nil(t, TransCallDtm(tb, tb, "submit"))
+
+	code, status := ErrorCode(err)
+	assert.Equal(t, CodeGidNotOwned, code)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.True(t, errors.Is(&APIError{Code: CodeGidNotOwned}, ErrGidNotOwned))
+}
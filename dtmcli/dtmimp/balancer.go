@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/go-resty/resty/v2"
+)
+
+// FailedServerCooldown is the time a dtm server is skipped after a connect error, if other dtm servers are listed
+var FailedServerCooldown = 10 * time.Second
+
+// serverList rotates across the base urls of the dtm servers, skipping the ones failed recently
+type serverList struct {
+	urls        []string
+	next        uint32
+	failedUntil []int64 // unix nano
+}
+
+var serverLists sync.Map
+
+func getServerList(server string) *serverList {
+	if l, ok := serverLists.Load(server); ok {
+		return l.(*serverList)
+	}
+	urls := []string{}
+	for _, u := range strings.Split(server, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	l, _ := serverLists.LoadOrStore(server, &serverList{urls: urls, failedUntil: make([]int64, len(urls))})
+	return l.(*serverList)
+}
+
+// pick returns the index of the next url not failed recently, or the next url if all failed
+func (l *serverList) pick() int {
+	start := int(atomic.AddUint32(&l.next, 1) - 1)
+	now := time.Now().UnixNano()
+	for i := 0; i < len(l.urls); i++ {
+		idx := (start + i) % len(l.urls)
+		if atomic.LoadInt64(&l.failedUntil[idx]) <= now {
+			return idx
+		}
+	}
+	return start % len(l.urls)
+}
+
+func (l *serverList) markFailed(idx int) {
+	atomic.StoreInt64(&l.failedUntil[idx], time.Now().Add(FailedServerCooldown).UnixNano())
+}
+
+// CallDtmServer sends the request to dtm server with DtmRetryPolicy. server may be a comma separated list of the base urls
+// of dtm servers, then each attempt is sent to the next server not failed recently, and a request not sent because of a
+// connect error is retried on the other servers even if the policy does not retry
+func CallDtmServer(ctx context.Context, server string, idempotent bool, request func(url string) (*resty.Response, error)) (*resty.Response, error) {
+	return callDtmServer(ctx, DtmRetryPolicy, server, idempotent, request)
+}
+
+func callDtmServer(ctx context.Context, policy RetryPolicy, server string, idempotent bool, request func(url string) (*resty.Response, error)) (*resty.Response, error) {
+	if !strings.Contains(server, ",") {
+		return policy.Execute(ctx, idempotent, func() (*resty.Response, error) {
+			return request(server)
+		})
+	}
+	l := getServerList(server)
+	if policy.MaxAttempts < len(l.urls) {
+		policy.MaxAttempts = len(l.urls)
+	}
+	return policy.Execute(ctx, idempotent, func() (*resty.Response, error) {
+		idx := l.pick()
+		resp, err := request(l.urls[idx])
+		if err != nil && isRetryable(resp, err, false) {
+			logger.Warnf("dtm server %s is unavailable, skipped for %v: %v", l.urls[idx], FailedServerCooldown, err)
+			l.markFailed(idx)
+		}
+		return resp, err
+	})
+}
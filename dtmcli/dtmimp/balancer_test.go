@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallDtmServerFailover(t *testing.T) {
+	var requested [2]int32
+	newServer := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requested[i], 1)
+			w.Write([]byte(`{"gid":"gid1"}`))
+		}))
+	}
+	svr0, svr1 := newServer(0), newServer(1)
+	defer svr1.Close()
+	server := svr0.URL + "," + svr1.URL
+	call := func() error {
+		resp, err := CallDtmServer(context.Background(), server, true, func(url string) (*resty.Response, error) {
+			return RestyClient.R().Get(url + "/newGid")
+		})
+		if err == nil {
+			err = RespAsErrorCompatible(resp)
+		}
+		return err
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, call())
+	}
+	assert.Equal(t, [2]int32{2, 2}, requested) // rotated
+
+	svr0.Close()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, call())
+	}
+	assert.Equal(t, [2]int32{2, 6}, requested) // failed over to svr1, and svr0 is skipped after the first failure
+	assert.True(t, atomic.LoadInt64(&getServerList(server).failedUntil[0]) > 0)
+}
@@ -26,4 +26,27 @@ const (
 
 	// JrpcCodeOngoing const for json-rpc ongoing
 	JrpcCodeOngoing = -32902
+
+	// JrpcCodeReadOnly const for json-rpc read-only
+	JrpcCodeReadOnly = -32903
+
+	// JrpcCodeBusy const for json-rpc busy
+	JrpcCodeBusy = -32904
+
+	// JrpcCodeGidNotOwned const for json-rpc gid not owned
+	JrpcCodeGidNotOwned = -32905
+
+	// CallerTokenHeader const for the http header or grpc metadata of the token of the caller claiming gid prefixes
+	CallerTokenHeader = "dtm-caller-token"
+
+	// MsgTopicPrefix const for the url of msg topic
+	MsgTopicPrefix = "topic://"
+
+	// GrpcURLPrefix const for the url of a grpc target in a trans of http, such as grpc://localhost:58081/busi.Busi/QueryPrepared
+	GrpcURLPrefix = "grpc://"
+
+	// PriorityMin the min priority of a trans
+	PriorityMin = -9
+	// PriorityMax the max priority of a trans
+	PriorityMax = 9
 )
@@ -16,6 +16,7 @@ type DBSpecial interface {
 	GetPlaceHoldSQL(sql string) string
 	GetInsertIgnoreTemplate(tableAndValues string, pgConstraint string) string
 	GetXaSQL(command string, xid string) string
+	GetDeleteLimitSQL(table string, where string, limit int) string
 }
 
 var dbSpecials = map[string]DBSpecial{}
@@ -35,6 +36,10 @@ func (*mysqlDBSpecial) GetInsertIgnoreTemplate(tableAndValues string, pgConstrai
 	return fmt.Sprintf("insert ignore into %s", tableAndValues)
 }
 
+func (*mysqlDBSpecial) GetDeleteLimitSQL(table string, where string, limit int) string {
+	return fmt.Sprintf("delete from %s where %s limit %d", table, where, limit)
+}
+
 func init() {
 	dbSpecials[DBTypeMysql] = &mysqlDBSpecial{}
 }
@@ -70,6 +75,11 @@ func (*postgresDBSpecial) GetPlaceHoldSQL(sql string) string {
 func (*postgresDBSpecial) GetInsertIgnoreTemplate(tableAndValues string, pgConstraint string) string {
 	return fmt.Sprintf("insert into %s on conflict ON CONSTRAINT %s do nothing", tableAndValues, pgConstraint)
 }
+
+func (*postgresDBSpecial) GetDeleteLimitSQL(table string, where string, limit int) string {
+	return fmt.Sprintf("delete from %s where id in (select id from %s where %s limit %d)", table, table, where, limit)
+}
+
 func init() {
 	dbSpecials[DBTypePostgres] = &postgresDBSpecial{}
 }
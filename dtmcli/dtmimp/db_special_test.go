@@ -23,10 +23,12 @@ func TestDBSpecial(t *testing.T) {
 	assert.Equal(t, "? ?", sp.GetPlaceHoldSQL("? ?"))
 	assert.Equal(t, "xa start 'xa1'", sp.GetXaSQL("start", "xa1"))
 	assert.Equal(t, "insert ignore into a(f) values(?)", sp.GetInsertIgnoreTemplate("a(f) values(?)", "c"))
+	assert.Equal(t, "delete from a where f<? limit 10", sp.GetDeleteLimitSQL("a", "f<?", 10))
 	SetCurrentDBType(DBTypePostgres)
 	sp = GetDBSpecial()
 	assert.Equal(t, "$1 $2", sp.GetPlaceHoldSQL("? ?"))
 	assert.Equal(t, "begin", sp.GetXaSQL("start", "xa1"))
 	assert.Equal(t, "insert into a(f) values(?) on conflict ON CONSTRAINT c do nothing", sp.GetInsertIgnoreTemplate("a(f) values(?)", "c"))
+	assert.Equal(t, "delete from a where id in (select id from a where f<? limit 10)", sp.GetDeleteLimitSQL("a", "f<?", 10))
 	SetCurrentDBType(old)
 }
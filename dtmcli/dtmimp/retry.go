@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/go-resty/resty/v2"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// RetryPolicy the policy to retry the http requests to dtm server, when dtm server is briefly unavailable.
+// a request is retried on connect errors, which mean the request is not sent to dtm server,
+// and on 502/503, which are returned by the proxy before dtm server when it is down or restarting
+type RetryPolicy struct {
+	MaxAttempts int           // max attempts of a request, including the first one. 0 or 1 means no retry
+	Backoff     time.Duration // wait before the first retry, doubled for each following retry
+	MaxBackoff  time.Duration // upper bound of the wait. 0 means no bound
+}
+
+// DtmRetryPolicy the retry policy of the http requests to dtm server
+var DtmRetryPolicy = RetryPolicy{}
+
+// Execute executes the request until it succeeds or is not retryable.
+// if idempotent is false, the request is only retried on connect errors, because a 502/503 or a broken connection may
+// happen after dtm server has handled the request
+func (p *RetryPolicy) Execute(ctx context.Context, idempotent bool, request func() (*resty.Response, error)) (*resty.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := request()
+		if attempt >= p.MaxAttempts || !isRetryable(resp, err, idempotent) {
+			return resp, err
+		}
+		logger.Infof("dtm server unavailable, retry after %v. attempt: %d err: %v resp: %v", p.backoff(attempt), attempt, err, resp)
+		if !p.Wait(ctx, attempt) {
+			return resp, err
+		}
+	}
+}
+
+// Wait waits the backoff before retrying the attempt. false is returned if the attempts are exhausted or ctx is done
+func (p *RetryPolicy) Wait(ctx context.Context, attempt int) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(p.backoff(attempt)):
+		return true
+	}
+}
+
+// backoff returns the wait after the attempt, which is doubled for each attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || backoff < p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+func isRetryable(resp *resty.Response, err error, idempotent bool) bool {
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		var netErr net.Error // such as a timeout or a reset connection, after which the request may be handled
+		return idempotent && (errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF))
+	}
+	return idempotent && (resp.StatusCode() == http.StatusBadGateway || resp.StatusCode() == http.StatusServiceUnavailable)
+}
+
+// BranchRegisterError is returned if a branch is not registered to dtm server. if Unknown, the result is unknown after
+// the retries, such as on timeouts, and the branch may be registered. the try of the branch is not called either way,
+// so the caller can choose to abort the global trans
+type BranchRegisterError struct {
+	BranchID string
+	Unknown  bool
+	Err      error
+}
+
+func (e *BranchRegisterError) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("registering branch %s gave up with unknown result: %v", e.BranchID, e.Err)
+	}
+	return fmt.Sprintf("registering branch %s failed: %v", e.BranchID, e.Err)
+}
+
+func (e *BranchRegisterError) Unwrap() error {
+	return e.Err
+}
+
+// LocalGidNode if not empty, gids are generated locally, prefixed by the node, instead of calling newGid of dtm server
+var LocalGidNode = ""
+
+// NewLocalGid generates a gid locally. the node should be unique among the apps, so that gids are unique.
+// the node is sanitized like the prefix of GidFromKey, so the gid passes the gid check of dtm server
+func NewLocalGid() string {
+	return gidPrefix(LocalGidNode) + "-" + shortuuid.New()
+}
+
+const gidKeyPrefixLen = 32
+
+// GidFromKey derives a gid from a business key, such as an order id, so that a retried business request maps to the same trans.
+// the gid is a readable prefix of the key, with the chars other than [0-9a-zA-Z_] replaced by _, followed by a hash of the key.
+// it is at most 65 chars, and is safe for all the stores
+func GidFromKey(businessKey string) string {
+	sum := sha256.Sum256([]byte(businessKey))
+	return gidPrefix(businessKey) + "-" + hex.EncodeToString(sum[:16])
+}
+
+// gidPrefix returns the first 32 bytes of s, with the chars other than [0-9a-zA-Z_] replaced by _
+func gidPrefix(s string) string {
+	prefix := []byte(s)
+	if len(prefix) > gidKeyPrefixLen {
+		prefix = prefix[:gidKeyPrefixLen]
+	}
+	for i, c := range prefix {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_') {
+			prefix[i] = '_'
+		}
+	}
+	return string(prefix)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var requested int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requested, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+	defer svr.Close()
+
+	old := DtmRetryPolicy
+	defer func() { DtmRetryPolicy = old }()
+	DtmRetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	tb := NewTransBase("TestRetryPolicy", "tcc", svr.URL, "")
+	assert.Nil(t, TransCallDtm(tb, tb, "prepare"))
+	assert.Equal(t, int32(3), requested)
+
+	atomic.StoreInt32(&requested, 0)
+	assert.Nil(t, TransCallDtm(tb, tb, "registerBranch")) // registerBranch is idempotent too
+	assert.Equal(t, int32(3), requested)
+}
+
+func TestRegisterRetry(t *testing.T) {
+	var requested int32
+	status := http.StatusOK
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requested, 1) == 1 {
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close() // a broken connection, after which the registration is unknown
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+	defer svr.Close()
+
+	tb := NewTransBase("TestRegisterRetry", "tcc", svr.URL, "")
+	err := TransRegisterBranch(tb, map[string]string{"branch_id": "01"}, "registerBranch")
+	var rerr *BranchRegisterError
+	assert.True(t, errors.As(err, &rerr)) // not retried by the default policy
+	assert.True(t, rerr.Unknown)
+	assert.Equal(t, "01", rerr.BranchID)
+
+	atomic.StoreInt32(&requested, 0)
+	tb.RegisterRetry = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	assert.Nil(t, TransRegisterBranch(tb, map[string]string{"branch_id": "01"}, "registerBranch"))
+	assert.Equal(t, int32(2), requested)
+
+	status = http.StatusConflict // definitely failed, not retried
+	atomic.StoreInt32(&requested, 1)
+	err = TransRegisterBranch(tb, map[string]string{"branch_id": "02"}, "registerBranch")
+	assert.True(t, errors.As(err, &rerr))
+	assert.False(t, rerr.Unknown)
+	assert.ErrorIs(t, err, ErrFailure)
+	assert.Equal(t, int32(2), requested)
+}
+
+func TestRetryConnectError(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	url := "http://" + lis.Addr().String()
+	lis.Close()
+
+	p := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	attempts := 0
+	_, err = p.Execute(context.Background(), false, func() (*resty.Response, error) {
+		attempts++
+		return RestyClient.R().Post(url)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	p.Backoff = time.Hour
+	_, err = p.Execute(ctx, false, func() (*resty.Response, error) {
+		attempts++
+		return RestyClient.R().Post(url)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestNewLocalGid(t *testing.T) {
+	LocalGidNode = "node1"
+	defer func() { LocalGidNode = "" }()
+	gid1, gid2 := NewLocalGid(), NewLocalGid()
+	assert.Regexp(t, "^node1-", gid1)
+	assert.NotEqual(t, gid1, gid2)
+
+	LocalGidNode = "pod/1 a"
+	assert.Regexp(t, "^pod_1_a-[0-9a-zA-Z]+$", NewLocalGid())
+}
+
+func TestGidFromKey(t *testing.T) {
+	gid := GidFromKey("order:10001")
+	assert.Equal(t, gid, GidFromKey("order:10001"))
+	assert.Regexp(t, "^order_10001-[0-9a-f]{32}$", gid)
+	assert.NotEqual(t, gid, GidFromKey("order_10001"))
+	assert.Equal(t, 65, len(GidFromKey(strings.Repeat("订单", 20))))
+}
@@ -7,14 +7,16 @@
 package dtmimp
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"google.golang.org/protobuf/proto"
 )
 
 // BranchIDGen used to generate a sub branch id
@@ -42,13 +44,28 @@ func (g *BranchIDGen) CurrentSubBranchID() string {
 
 // TransOptions transaction options
 type TransOptions struct {
-	WaitResult         bool              `json:"wait_result,omitempty" gorm:"-"`
-	TimeoutToFail      int64             `json:"timeout_to_fail,omitempty" gorm:"-"` // for trans type: xa, tcc
-	RequestTimeout     int64             `json:"requestTimeout" gorm:"-"`            // for global trans resets request timeout
-	RetryInterval      int64             `json:"retry_interval,omitempty" gorm:"-"`  // for trans type: msg saga xa tcc
-	PassthroughHeaders []string          `json:"passthrough_headers,omitempty" gorm:"-"`
-	BranchHeaders      map[string]string `json:"branch_headers,omitempty" gorm:"-"`
-	Concurrent         bool              `json:"concurrent" gorm:"-"` // for trans type: saga msg
+	WaitResult          bool                      `json:"wait_result,omitempty" gorm:"-"`
+	TimeoutToFail       int64                     `json:"timeout_to_fail,omitempty" gorm:"-"` // for trans type: xa, tcc
+	TryTimeout          int64                     `json:"try_timeout,omitempty" gorm:"-"`     // for trans type: tcc. a tcc not submitted in this time after prepare is aborted
+	RequestTimeout      int64                     `json:"requestTimeout" gorm:"-"`            // for global trans resets request timeout
+	RetryInterval       int64                     `json:"retry_interval,omitempty" gorm:"-"`  // for trans type: msg saga xa tcc
+	PassthroughHeaders  []string                  `json:"passthrough_headers,omitempty" gorm:"-"`
+	BranchHeaders       map[string]string         `json:"branch_headers,omitempty" gorm:"-"`
+	Concurrent          bool                      `json:"concurrent" gorm:"-"`                      // for trans type: saga msg
+	HTTPProfile         string                    `json:"http_profile,omitempty" gorm:"-"`          // default http client profile of branches
+	Tenant              string                    `json:"tenant,omitempty"`                         // the tenant owning the trans. stored in its own column, and used to filter the trans
+	RegisterRetry       RetryPolicy               `json:"-" gorm:"-"`                               // the retry policy of registering branches in xa/tcc. DtmRetryPolicy is used if MaxAttempts is 0
+	QueryPreparedURLs   []string                  `json:"query_prepared_urls,omitempty" gorm:"-"`   // for trans type: msg. the back-check targets, instead of QueryPrepared
+	QueryPreparedQuorum int                       `json:"query_prepared_quorum,omitempty" gorm:"-"` // how many of QueryPreparedURLs should agree. 0 means all
+	Priority            int                       `json:"priority,omitempty"`                       // the expired trans of higher priorities are processed first. in [PriorityMin, PriorityMax], stored in its own column
+	GrpcCodeResults     map[string]GrpcCodeResult `json:"grpc_code_results,omitempty" gorm:"-"`     // for the grpc branches. the results of the codes, overriding the ones of dtm server
+}
+
+// GrpcCodeResult is the result of a grpc branch returning a status code, configured by the name of the code, such as
+// FailedPrecondition. the codes not configured are interpreted as dtmgrpc.GrpcError2DtmError
+type GrpcCodeResult struct {
+	Result string `json:"result" yaml:"Result"`         // ResultSuccess, ResultFailure or ResultOngoing
+	Delay  int64  `json:"delay,omitempty" yaml:"Delay"` // for ResultOngoing, the suggested seconds before the branch is retried
 }
 
 // TransBase base for all trans
@@ -67,6 +84,10 @@ type TransBase struct {
 
 	QueryPrepared string `json:"query_prepared,omitempty"` // used in MSG
 	Protocol      string `json:"protocol"`
+
+	Context context.Context `json:"-"` // context of the requests to dtm server and branches. nil means context.Background()
+
+	CallerToken string `json:"-"` // sent to dtm server in the header CallerTokenHeader, if the gids are claimed by GidClaims of dtm server
 }
 
 // NewTransBase new a TransBase
@@ -85,6 +106,48 @@ func (t *TransBase) WithGlobalTransRequestTimeout(timeout int64) {
 	t.RequestTimeout = timeout
 }
 
+// MergeCustomData sets the keys of CustomData, which is a json object, keeping the other keys
+func (t *TransBase) MergeCustomData(kvs map[string]interface{}) {
+	custom := map[string]interface{}{}
+	if t.CustomData != "" {
+		MustUnmarshalString(t.CustomData, &custom)
+	}
+	for k, v := range kvs {
+		custom[k] = v
+	}
+	t.CustomData = MustMarshalString(custom)
+}
+
+// GetContext returns the context of the requests
+func (t *TransBase) GetContext() context.Context {
+	if t.Context == nil {
+		return context.Background()
+	}
+	return t.Context
+}
+
+// DetachContext makes the following requests not canceled by the current context, but the values are kept.
+// it is used to notify dtm server after the context is canceled, such as aborting a tcc
+func (t *TransBase) DetachContext() {
+	t.Context = detachedContext{t.GetContext()}
+}
+
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// callerHeaders returns the header of CallerToken, empty if not specified
+func (t *TransBase) callerHeaders() map[string]string {
+	if t.CallerToken == "" {
+		return map[string]string{}
+	}
+	return map[string]string{CallerTokenHeader: t.CallerToken}
+}
+
 // TransBaseFromQuery construct transaction info from request
 func TransBaseFromQuery(qs url.Values) *TransBase {
 	return NewTransBase(qs.Get("gid"), qs.Get("trans_type"), qs.Get("dtm"), qs.Get("branch_id"))
@@ -92,40 +155,61 @@ func TransBaseFromQuery(qs url.Values) *TransBase {
 
 // TransCallDtm TransBase call dtm
 func TransCallDtm(tb *TransBase, body interface{}, operation string) error {
+	_, err := transCallDtm(tb, body, operation)
+	return err
+}
+
+// transCallDtm calls dtm server, and returns the response, which is nil if no response is received
+func transCallDtm(tb *TransBase, body interface{}, operation string) (*resty.Response, error) {
 	if tb.RequestTimeout != 0 {
 		RestyClient.SetTimeout(time.Duration(tb.RequestTimeout) * time.Second)
 	}
+	// prepare/submit/abort are idempotent in dtm server, and a duplicated one gets the same result.
+	// registerBranch is idempotent too, the same branch registered again is accepted
+	policy := DtmRetryPolicy
+	if operation == "registerBranch" && tb.RegisterRetry.MaxAttempts > 0 {
+		policy = tb.RegisterRetry
+	}
 	if tb.Protocol == Jrpc {
 		var result map[string]interface{}
-		resp, err := RestyClient.R().
-			SetBody(map[string]interface{}{
-				"jsonrpc": "2.0",
-				"id":      "no-use",
-				"method":  operation,
-				"params":  body,
-			}).
-			SetResult(&result).
-			Post(tb.Dtm)
+		resp, err := callDtmServer(tb.GetContext(), policy, tb.Dtm, true, func(url string) (*resty.Response, error) {
+			return RestyClient.R().
+				SetContext(tb.GetContext()).
+				SetHeaders(tb.callerHeaders()).
+				SetBody(map[string]interface{}{
+					"jsonrpc": "2.0",
+					"id":      "no-use",
+					"method":  operation,
+					"params":  body,
+				}).
+				SetResult(&result).
+				Post(url)
+		})
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if jerr, ok := result["error"].(map[string]interface{}); ok {
+			return resp, JrpcErrorAsError(jerr)
 		}
 		if resp.StatusCode() != http.StatusOK || result["error"] != nil {
-			return errors.New(resp.String())
+			return resp, errors.New(resp.String())
 		}
-		return nil
+		return resp, nil
 	}
-	resp, err := RestyClient.R().
-		SetBody(body).Post(fmt.Sprintf("%s/%s", tb.Dtm, operation))
+	resp, err := callDtmServer(tb.GetContext(), policy, tb.Dtm, true, func(url string) (*resty.Response, error) {
+		return RestyClient.R().
+			SetContext(tb.GetContext()).
+			SetHeaders(tb.callerHeaders()).
+			SetBody(body).Post(fmt.Sprintf("%s/%s", url, operation))
+	})
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode() != http.StatusOK || strings.Contains(resp.String(), ResultFailure) {
-		return errors.New(resp.String())
+		return nil, err
 	}
-	return nil
+	return resp, ParseDtmResp(tb.Dtm, resp, nil)
 }
 
-// TransRegisterBranch TransBase register a branch to dtm
+// TransRegisterBranch TransBase register a branch to dtm. the registration is retried by TransOptions.RegisterRetry, and
+// *BranchRegisterError is returned if it fails
 func TransRegisterBranch(tb *TransBase, added map[string]string, operation string) error {
 	m := map[string]string{
 		"gid":        tb.Gid,
@@ -134,15 +218,33 @@ func TransRegisterBranch(tb *TransBase, added map[string]string, operation strin
 	for k, v := range added {
 		m[k] = v
 	}
-	return TransCallDtm(tb, m, operation)
+	resp, err := transCallDtm(tb, m, operation)
+	if err != nil {
+		return &BranchRegisterError{BranchID: m["branch_id"], Unknown: resp == nil || resp.StatusCode() >= http.StatusInternalServerError, Err: err}
+	}
+	return nil
 }
 
 // TransRequestBranch TransBase request branch result
 func TransRequestBranch(t *TransBase, method string, body interface{}, branchID string, op string, url string) (*resty.Response, error) {
+	return transRequestBranch(t, method, body, "", branchID, op, url)
+}
+
+// TransRequestBranchBin the same as TransRequestBranch, but the body is sent as is, with the content type
+func TransRequestBranchBin(t *TransBase, method string, body []byte, contentType string, branchID string, op string, url string) (*resty.Response, error) {
+	return transRequestBranch(t, method, body, contentType, branchID, op, url)
+}
+
+func transRequestBranch(t *TransBase, method string, body interface{}, contentType string, branchID string, op string, url string) (*resty.Response, error) {
 	if url == "" {
 		return nil, nil
 	}
-	resp, err := RestyClient.R().
+	r := RestyClient.R()
+	if contentType != "" {
+		r.SetHeader("Content-Type", contentType)
+	}
+	resp, err := r.
+		SetContext(t.GetContext()).
 		SetBody(body).
 		SetQueryParams(map[string]string{
 			"dtm":        t.Dtm,
@@ -158,3 +260,36 @@ func TransRequestBranch(t *TransBase, method string, body interface{}, branchID
 	}
 	return resp, err
 }
+
+// a payload of a binary content type, such as protobuf, is sent to dtm server in base64, and then sent to the branch as is.
+// a payload of the default content type, json, is sent as a json string
+
+// MustMarshalBin marshals a payload of a binary content type. payload should be []byte or proto.Message
+func MustMarshalBin(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case []byte:
+		return p
+	case proto.Message:
+		b, err := proto.Marshal(p)
+		E2P(err)
+		return b
+	}
+	panic(fmt.Errorf("binary payload should be []byte or proto.Message, but got %T", payload))
+}
+
+// EncodeBinPayload encodes a binary payload to be sent to dtm server
+func EncodeBinPayload(payload []byte) string {
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// DecodeBinPayload decodes the payload received by dtm server. contentType empty means json, which is not encoded
+func DecodeBinPayload(payload string, contentType string) ([]byte, error) {
+	if contentType == "" {
+		return []byte(payload), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload of content type %s should be base64 encoded: %v. %w", contentType, err, ErrFailure)
+	}
+	return b, nil
+}
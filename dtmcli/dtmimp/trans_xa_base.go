@@ -8,7 +8,9 @@ package dtmimp
 
 import (
 	"database/sql"
+	"fmt"
 	"strings"
+	"time"
 )
 
 // XaClientBase XaClient/XaGrpcClient base. shared by http and grpc
@@ -16,46 +18,157 @@ type XaClientBase struct {
 	Server    string
 	Conf      DBConf
 	NotifyURL string
+	// ConnPoolSize is the max connections kept for reuse. 0 means a new connection is opened for each call
+	ConnPoolSize int
+	// ConnIdleTimeout is the time after which an idle connection is closed. 0 means never
+	ConnIdleTimeout time.Duration
+	// RecoverEnable enables the periodic recovery of orphaned prepared xa transactions. see StartRecover
+	RecoverEnable bool
+	// RecoverInterval is the interval of the recovery. default 60s
+	RecoverInterval time.Duration
+	// XidFormatter builds the xids of the branches, and parses them back in recovery. nil means DefaultXidFormatter
+	XidFormatter XidFormatter
+}
+
+func (xc *XaClientBase) xidFormatter() XidFormatter {
+	if xc.XidFormatter == nil {
+		return DefaultXidFormatter{}
+	}
+	return xc.XidFormatter
+}
+
+// xid returns the xid of the branch, which is rejected if exceeding the limits of the db
+func (xc *XaClientBase) xid(gid string, branchID string) (Xid, error) {
+	xid := xc.xidFormatter().FormatXid(gid, branchID)
+	return xid, xid.Validate(xc.Conf.Driver)
+}
+
+// getConn returns a connection. the connection should be released by the returned func, with whether it is reusable
+// and the xid it prepared
+func (xc *XaClientBase) getConn() (*sql.DB, func(reusable bool, preparedXid string), error) {
+	if xc.ConnPoolSize <= 0 {
+		db, err := StandaloneDB(xc.Conf)
+		return db, func(bool, string) {
+			if db != nil {
+				_ = db.Close()
+			}
+		}, err
+	}
+	pool := getXaConnPool(xc.Conf, xc.ConnPoolSize, xc.ConnIdleTimeout)
+	c, err := pool.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.db, func(reusable bool, preparedXid string) {
+		if !reusable {
+			pool.discard(c)
+		} else if preparedXid != "" {
+			pool.hold(preparedXid, c)
+		} else {
+			pool.put(c)
+		}
+	}, nil
 }
 
 // HandleCallback Handle the callback of commit/rollback
 func (xc *XaClientBase) HandleCallback(gid string, branchID string, action string) error {
-	db, err := StandaloneDB(xc.Conf)
+	xid, err := xc.xid(gid, branchID)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = db.Close()
-	}()
-	xaID := gid + "-" + branchID
-	_, err = DBExec(db, GetDBSpecial().GetXaSQL(action, xaID))
-	if err != nil &&
-		(strings.Contains(err.Error(), "XAER_NOTA") || strings.Contains(err.Error(), "does not exist")) { // Repeat commit/rollback with the same id, report this error, ignore
-		err = nil
+	var db *sql.DB
+	var release func(bool, string)
+	if c := xc.takeHeldConn(xid.String()); c != nil { // execute in the session which prepared the xid
+		db, release = c.db, func(reusable bool, _ string) {
+			pool := getXaConnPool(xc.Conf, xc.ConnPoolSize, xc.ConnIdleTimeout)
+			if reusable {
+				pool.put(c)
+			} else {
+				pool.discard(c)
+			}
+		}
+	} else {
+		db, release, err = xc.getConn()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = DBExec(db, xid.sql(action))
+	if isXaNotFound(err) {
+		release(true, "")
+		return xc.callbackByRecover(xid, action)
 	}
+	release(err == nil, "")
 	return err
 }
 
+// isXaNotFound checks the error is caused by a xid unknown to the session
+func isXaNotFound(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "XAER_NOTA") || strings.Contains(err.Error(), "does not exist"))
+}
+
+// callbackByRecover handles the callback of a xid unknown to the session. the xid is finished, such as a repeated
+// commit/rollback, only if it is not listed by xa recover. otherwise it is prepared by another session, such as the
+// connection held by another process of the RM, and the commit/rollback is executed from a fresh connection. in mysql,
+// it fails until that session is closed, and the error is returned, so that the callback is retried.
+// in mysql 8, XA_RECOVER_ADMIN is required to list the xids prepared by other users
+func (xc *XaClientBase) callbackByRecover(xid Xid, action string) error {
+	db, err := StandaloneDB(xc.Conf)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+	xids, err := xaRecover(db, xc.Conf.Driver)
+	if err != nil {
+		return err
+	}
+	for _, prepared := range xids {
+		if prepared.String() == xid.String() {
+			if _, err := DBExec(db, xid.sql(action)); err != nil {
+				return fmt.Errorf("xa %s is prepared by another session, %s error: %w", xid, action, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (xc *XaClientBase) takeHeldConn(xid string) *xaConn {
+	if xc.ConnPoolSize <= 0 {
+		return nil
+	}
+	return getXaConnPool(xc.Conf, xc.ConnPoolSize, xc.ConnIdleTimeout).take(xid)
+}
+
 // HandleLocalTrans public handler of LocalTransaction via http/grpc
 func (xc *XaClientBase) HandleLocalTrans(xa *TransBase, cb func(*sql.DB) error) (rerr error) {
-	xaBranch := xa.Gid + "-" + xa.BranchID
-	db, rerr := StandaloneDB(xc.Conf)
+	xid, rerr := xc.xid(xa.Gid, xa.BranchID)
 	if rerr != nil {
 		return
 	}
-	defer func() { _ = db.Close() }()
+	db, release, rerr := xc.getConn()
+	if rerr != nil {
+		return
+	}
+	defer func() { // a connection with an unprepared xa transaction is not reusable
+		x := recover()
+		release(rerr == nil && x == nil, xid.String())
+		if x != nil {
+			panic(x)
+		}
+	}()
 	defer DeferDo(&rerr, func() error {
-		_, err := DBExec(db, GetDBSpecial().GetXaSQL("prepare", xaBranch))
+		_, err := DBExec(db, xid.sql("prepare"))
 		return err
 	}, func() error {
 		return nil
 	})
-	_, rerr = DBExec(db, GetDBSpecial().GetXaSQL("start", xaBranch))
+	_, rerr = DBExec(db, xid.sql("start"))
 	if rerr != nil {
 		return
 	}
 	defer func() {
-		_, _ = DBExec(db, GetDBSpecial().GetXaSQL("end", xaBranch))
+		_, _ = DBExec(db, xid.sql("end"))
 	}()
 	rerr = cb(db)
 	return
@@ -71,6 +184,7 @@ func (xc *XaClientBase) HandleGlobalTrans(xa *TransBase, callDtm func(string) er
 	defer DeferDo(&rerr, func() error {
 		return callDtm("submit")
 	}, func() error {
+		xa.DetachContext() // dtm server should be notified even if the context is canceled
 		return callDtm("abort")
 	})
 	rerr = callBusi()
@@ -208,13 +208,21 @@ func GetDsn(conf DBConf) string {
 }
 
 // RespAsErrorCompatible translate a resty response to error
-// compatible with version < v1.10
+// compatible with version < v1.10, which returns the result in the body of status 200, see respDtmResult
 func RespAsErrorCompatible(resp *resty.Response) error {
-	code := resp.StatusCode()
-	str := resp.String()
-	if code == http.StatusTooEarly || strings.Contains(str, ResultOngoing) {
+	return BodyAsErrorCompatible(resp.StatusCode(), resp.Header(), resp.String(), false)
+}
+
+// BodyAsErrorCompatible translate the status code, header and body of a response to error, like RespAsErrorCompatible.
+// if the body is truncated, the result is only decided by the status code and the dtm-result header
+func BodyAsErrorCompatible(code int, header http.Header, str string, truncated bool) error {
+	result := header.Get("dtm-result") // for the response not in json, such as protobuf
+	if result == "" && !truncated {
+		result = respDtmResult(str, code == http.StatusOK)
+	}
+	if code == http.StatusTooEarly || result == ResultOngoing {
 		return fmt.Errorf("%s. %w", str, ErrOngoing)
-	} else if code == http.StatusConflict || strings.Contains(str, ResultFailure) {
+	} else if code == http.StatusConflict || result == ResultFailure {
 		return fmt.Errorf("%s. %w", str, ErrFailure)
 	} else if code != http.StatusOK {
 		return errors.New(str)
@@ -222,6 +230,54 @@ func RespAsErrorCompatible(resp *resty.Response) error {
 	return nil
 }
 
+// respDtmResult returns the dtm_result of a response body like {"dtm_result":"FAILURE"}. if there is no dtm_result, and
+// legacy is true for a body of status 200, ONGOING or FAILURE contained in the body is returned, as the versions < v1.10
+// check, such as "FAILURE" in json or FAILURE: insufficient balance. a warning is logged for this deprecated result
+func respDtmResult(body string, legacy bool) string {
+	var v interface{}
+	if json.Unmarshal([]byte(body), &v) == nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			if s, ok := m["dtm_result"].(string); ok {
+				return s
+			}
+		} else if s, ok := v.(string); ok {
+			body = s
+		}
+	}
+	if !legacy {
+		return ""
+	}
+	for _, result := range []string{ResultOngoing, ResultFailure} {
+		if strings.Contains(body, result) {
+			logger.Warnf("%s is found in a response body of status 200, which is deprecated. return it by status %d or dtm_result instead",
+				result, If(result == ResultOngoing, http.StatusTooEarly, http.StatusConflict).(int))
+			return result
+		}
+	}
+	return ""
+}
+
+// JrpcErrorAsError translate the error of a json-rpc response to error
+func JrpcErrorAsError(jerr map[string]interface{}) error {
+	code, _ := jerr["code"].(float64) // a number in json is unmarshaled to float64
+	msg := MustMarshalString(jerr)
+	if int(code) == JrpcCodeFailure {
+		return fmt.Errorf("%s. %w", msg, ErrFailure)
+	} else if int(code) == JrpcCodeOngoing {
+		return fmt.Errorf("%s. %w", msg, ErrOngoing)
+	} else if int(code) == JrpcCodeBusy {
+		e := BusyError{Message: fmt.Sprint(jerr["message"])}
+		if data, ok := jerr["data"].(map[string]interface{}); ok {
+			seconds, _ := data["retry_after"].(float64)
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return &e
+	} else if int(code) == JrpcCodeGidNotOwned {
+		return fmt.Errorf("%s. %w", msg, ErrGidNotOwned)
+	}
+	return errors.New(msg)
+}
+
 // DeferDo a common defer do used in dtmcli/dtmgrpc
 func DeferDo(rerr *error, success func() error, fail func() error) {
 	defer func() {
@@ -235,3 +291,27 @@ func DeferDo(rerr *error, success func() error, fail func() error) {
 		}
 	}()
 }
+
+// IsHTTPURL checks whether the url is of http or https
+func IsHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// CheckQueryPrepared checks the targets to query the prepared msg. a target is an http(s) url, or a grpc url of
+// server/method prefixed by GrpcURLPrefix. isGrpc tells the msg is of grpc, whose grpc urls need no prefix, and can
+// be of the schemes of the micro service drivers
+func CheckQueryPrepared(isGrpc bool, targets ...string) error {
+	for _, target := range targets {
+		if target == "" || IsHTTPURL(target) {
+			continue
+		}
+		rest := strings.TrimPrefix(target, GrpcURLPrefix)
+		if rest == target && !isGrpc {
+			return fmt.Errorf("query prepared %s should be an http(s) url or a grpc url prefixed by %s. %w", target, GrpcURLPrefix, ErrInvalidArgument)
+		}
+		if i := strings.Index(rest, "/"); i <= 0 || i == len(rest)-1 {
+			return fmt.Errorf("query prepared %s should be a grpc url of server/method. %w", target, ErrInvalidArgument)
+		}
+	}
+	return nil
+}
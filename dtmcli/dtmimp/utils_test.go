@@ -7,12 +7,16 @@
 package dtmimp
 
 import (
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestEP(t *testing.T) {
@@ -79,3 +83,80 @@ func TestSome(t *testing.T) {
 	s2 := MayReplaceLocalhost("http://localhost")
 	assert.Equal(t, "http://localhost", s2)
 }
+
+func TestRespAsErrorCompatible(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := MustAtoi(r.URL.Query().Get("code"))
+		if result := r.URL.Query().Get("result"); result != "" {
+			w.Header().Set("dtm-result", result)
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer svr.Close()
+	respError := func(code string, body string) error {
+		resp, err := RestyClient.R().SetQueryParams(map[string]string{"code": code, "body": body}).Get(svr.URL)
+		assert.Nil(t, err)
+		return RespAsErrorCompatible(resp)
+	}
+	assert.Nil(t, respError("200", `{"dtm_result":"SUCCESS"}`))
+	assert.True(t, errors.Is(respError("409", `{"message":"insufficient balance"}`), ErrFailure))
+	assert.True(t, errors.Is(respError("425", ""), ErrOngoing))
+	assert.True(t, errors.Is(respError("200", `{"dtm_result":"FAILURE"}`), ErrFailure)) // version < v1.10
+	assert.True(t, errors.Is(respError("200", "ONGOING"), ErrOngoing))
+	assert.True(t, errors.Is(respError("200", `"FAILURE"`), ErrFailure)) // the legacy results contained in the body
+	assert.True(t, errors.Is(respError("200", "FAILURE: insufficient balance"), ErrFailure))
+	assert.True(t, errors.Is(respError("200", `{"result":"FAILURE"}`), ErrFailure))
+	assert.True(t, errors.Is(respError("200", `"ONGOING"`), ErrOngoing))
+	assert.Nil(t, respError("200", `{"dtm_result":"SUCCESS","message":"no FAILURE"}`)) // dtm_result decides
+	assert.Nil(t, respError("200", `"SUCCESS"`))
+	err := respError("500", `{"message":"FAILURE of db connection"}`) // the result is not decided by the message
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrFailure))
+
+	resp, err := RestyClient.R().SetQueryParams(map[string]string{"code": "200", "body": "\x08\x01", "result": ResultFailure}).Get(svr.URL)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(RespAsErrorCompatible(resp), ErrFailure)) // a protobuf response
+
+	// a truncated body is not parsed for the result
+	assert.Nil(t, BodyAsErrorCompatible(200, http.Header{}, "FAILURE", true))
+	assert.True(t, errors.Is(BodyAsErrorCompatible(200, http.Header{"Dtm-Result": {ResultFailure}}, "<html>", true), ErrFailure))
+}
+
+func TestJrpcErrorAsError(t *testing.T) {
+	jrpcError := func(code int) map[string]interface{} {
+		var jerr map[string]interface{}
+		err := json.Unmarshal([]byte(MustMarshalString(map[string]interface{}{"code": code, "message": "msg"})), &jerr)
+		assert.Nil(t, err)
+		return jerr
+	}
+	assert.True(t, errors.Is(JrpcErrorAsError(jrpcError(JrpcCodeFailure)), ErrFailure))
+	assert.True(t, errors.Is(JrpcErrorAsError(jrpcError(JrpcCodeOngoing)), ErrOngoing))
+	err := JrpcErrorAsError(jrpcError(-32603))
+	assert.False(t, errors.Is(err, ErrFailure) || errors.Is(err, ErrOngoing))
+}
+
+func TestBinPayload(t *testing.T) {
+	msg := wrapperspb.String("hello")
+	b := MustMarshalBin(msg)
+	assert.Equal(t, []byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}, b)
+	assert.Equal(t, b, MustMarshalBin(b))
+	assert.Error(t, CatchP(func() { MustMarshalBin("a string") }))
+
+	decoded, err := DecodeBinPayload(EncodeBinPayload(b), "application/x-protobuf")
+	assert.Nil(t, err)
+	assert.Equal(t, b, decoded)
+	decoded, err = DecodeBinPayload(`{"a":1}`, "")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a":1}`, string(decoded))
+	_, err = DecodeBinPayload(`{"a":1}`, "application/x-protobuf")
+	assert.True(t, errors.Is(err, ErrFailure))
+}
+
+func TestCheckQueryPrepared(t *testing.T) {
+	assert.Nil(t, CheckQueryPrepared(false, "", "http://localhost:8081/api/busi/QueryPrepared", "grpc://localhost:58081/busi.Busi/QueryPrepared"))
+	assert.Nil(t, CheckQueryPrepared(true, "https://localhost/QueryPrepared", "localhost:58081/busi.Busi/QueryPrepared", "discovery://busi/busi.Busi/QueryPrepared"))
+	assert.True(t, errors.Is(CheckQueryPrepared(false, "localhost:58081/busi.Busi/QueryPrepared"), ErrInvalidArgument))
+	assert.True(t, errors.Is(CheckQueryPrepared(false, "grpc://localhost:58081"), ErrInvalidArgument))
+	assert.True(t, errors.Is(CheckQueryPrepared(true, "localhost:58081/"), ErrInvalidArgument))
+}
@@ -23,6 +23,22 @@ var ErrOngoing = errors.New("ONGOING")
 // if QueryPrepared executed before call. then DoAndSubmit return this error
 var ErrDuplicated = errors.New("DUPLICATED")
 
+// ErrInvalidArgument error of INVALID_ARGUMENT, such as a gid not valid, returned by dtm server
+var ErrInvalidArgument = errors.New("INVALID_ARGUMENT")
+
+// ErrNotFound error of NOT_FOUND, such as a trans not found, returned by the v2 api of dtm server
+var ErrNotFound = errors.New("NOT_FOUND")
+
+// ErrReadOnly error of READ_ONLY, returned by a dtm server in read-only mode for the requests changing trans
+var ErrReadOnly = errors.New("READ_ONLY")
+
+// ErrBusy error of BUSY, returned by a dtm server refusing new trans when its backlog is too large. see BusyError
+var ErrBusy = errors.New("BUSY")
+
+// ErrGidNotOwned error of GID_NOT_OWNED, returned by dtm server for a request creating or changing a trans whose gid is
+// not under the gid prefixes claimed by the caller
+var ErrGidNotOwned = errors.New("GID_NOT_OWNED")
+
 // XaSQLTimeoutMs milliseconds for Xa sql to timeout
 var XaSQLTimeoutMs = 15000
 
@@ -42,14 +58,19 @@ var PassthroughHeaders = []string{}
 var BarrierTableName = "dtm_barrier.barrier"
 
 func init() {
-	RestyClient.OnBeforeRequest(func(c *resty.Client, r *resty.Request) error {
+	AddRestyMiddlewares(RestyClient)
+}
+
+// AddRestyMiddlewares adds the middlewares of dtm to a resty client
+func AddRestyMiddlewares(client *resty.Client) {
+	client.OnBeforeRequest(func(c *resty.Client, r *resty.Request) error {
 		r.URL = MayReplaceLocalhost(r.URL)
-		logger.Debugf("requesting: %s %s %s", r.Method, r.URL, MustMarshalString(r.Body))
+		logger.Ctx(r.Context()).Debugf("requesting: %s %s %s", r.Method, r.URL, MustMarshalString(r.Body))
 		return nil
 	})
-	RestyClient.OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
+	client.OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
 		r := resp.Request
-		logger.Debugf("requested: %s %s %s", r.Method, r.URL, resp.String())
+		logger.Ctx(r.Context()).Debugf("requested: %s %s %s", r.Method, r.URL, resp.String())
 		return nil
 	})
 }
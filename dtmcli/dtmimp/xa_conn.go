@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+)
+
+// xaConn is a connection used by xa. it is a sql.DB limited to 1 open connection,
+// so that xa start/end/prepare of a branch are executed in the same session
+type xaConn struct {
+	db       *sql.DB
+	pooled   bool // a connection opened when the pool is full is not pooled, and is closed after used
+	lastUsed time.Time
+}
+
+// xaConnPool is a bounded pool of xa connections of a dsn
+// in mysql, a prepared xa transaction is attached to the session which prepared it, and can not be committed/rolled back
+// in other sessions until that session is closed. so the connection is held after prepare, and the commit/rollback
+// is executed in the same connection. a callback arriving at another process of the RM is retried until the held
+// connection is released, such as by the idle timeout, see callbackByRecover. in postgres, a prepared transaction is
+// detached from the session, so the connection is reused at once
+type xaConnPool struct {
+	mu          sync.Mutex
+	open        func() (*sql.DB, error)
+	affinity    bool
+	size        int
+	idleTimeout time.Duration
+	total       int // pooled connections, including idle, in use and held
+	idle        []*xaConn
+	held        map[string]*xaConn // xid => the connection which prepared the xid
+}
+
+var xaConnPools sync.Map
+
+// getXaConnPool returns the pool of the dsn. the size and idleTimeout of the first call is used
+func getXaConnPool(conf DBConf, size int, idleTimeout time.Duration) *xaConnPool {
+	dsn := GetDsn(conf)
+	if p, ok := xaConnPools.Load(dsn); ok {
+		return p.(*xaConnPool)
+	}
+	p, _ := xaConnPools.LoadOrStore(dsn, newXaConnPool(func() (*sql.DB, error) {
+		return StandaloneDB(conf)
+	}, conf.Driver == DBTypeMysql, size, idleTimeout))
+	return p.(*xaConnPool)
+}
+
+func newXaConnPool(open func() (*sql.DB, error), affinity bool, size int, idleTimeout time.Duration) *xaConnPool {
+	return &xaConnPool{open: open, affinity: affinity, size: size, idleTimeout: idleTimeout, held: map[string]*xaConn{}}
+}
+
+// get returns an idle connection, or opens a new one
+func (p *xaConnPool) get() (*xaConn, error) {
+	p.mu.Lock()
+	p.evictExpired()
+	var c *xaConn
+	if len(p.idle) > 0 {
+		c = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+	} else if p.total < p.size {
+		c = &xaConn{pooled: true}
+		p.total++
+	} else {
+		c = &xaConn{pooled: false}
+	}
+	p.mu.Unlock()
+	if c.db != nil {
+		return c, nil
+	}
+	db, err := p.open()
+	if err != nil {
+		p.discard(c)
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	c.db = db
+	return c, nil
+}
+
+// put returns the connection to the pool
+func (p *xaConnPool) put(c *xaConn) {
+	if !c.pooled {
+		p.discard(c)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.lastUsed = time.Now()
+	p.idle = append(p.idle, c)
+}
+
+// discard closes the connection, such as a connection in an unknown state
+func (p *xaConnPool) discard(c *xaConn) {
+	if c.db != nil {
+		_ = c.db.Close()
+	}
+	if c.pooled {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.total--
+	}
+}
+
+// hold keeps the connection which prepared the xid, if the db requires the affinity
+func (p *xaConnPool) hold(xid string, c *xaConn) {
+	if !p.affinity || !c.pooled {
+		p.put(c)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.lastUsed = time.Now()
+	p.held[xid] = c
+}
+
+// take returns the connection which prepared the xid, nil if not held
+func (p *xaConnPool) take(xid string) *xaConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.held[xid]
+	delete(p.held, xid)
+	return c
+}
+
+// evictExpired closes the connections idle for idleTimeout. a held connection is closed too,
+// so that the xid prepared by it can be committed/rolled back in other sessions
+func (p *xaConnPool) evictExpired() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	expired := []*xaConn{}
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.lastUsed) > p.idleTimeout {
+			expired = append(expired, c)
+		} else {
+			idle = append(idle, c)
+		}
+	}
+	p.idle = idle
+	for xid, c := range p.held {
+		if time.Since(c.lastUsed) > p.idleTimeout {
+			logger.Infof("release the connection holding xa %s for idle timeout", xid)
+			expired = append(expired, c)
+			delete(p.held, xid)
+		}
+	}
+	for _, c := range expired {
+		_ = c.db.Close()
+		p.total--
+	}
+}
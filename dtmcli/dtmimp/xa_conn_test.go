@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not connectable")
+}
+
+func init() {
+	sql.Register("xafake", fakeDriver{})
+}
+
+func newFakeXaConnPool(affinity bool, size int, idleTimeout time.Duration) *xaConnPool {
+	return newXaConnPool(func() (*sql.DB, error) {
+		return sql.Open("xafake", "")
+	}, affinity, size, idleTimeout)
+}
+
+func TestXaConnPool(t *testing.T) {
+	p := newFakeXaConnPool(true, 2, 0)
+	c1, err := p.get()
+	assert.Nil(t, err)
+	c2, _ := p.get()
+	c3, _ := p.get() // the pool is full, so c3 is not pooled
+	assert.True(t, c1.pooled && c2.pooled)
+	assert.False(t, c3.pooled)
+	p.put(c3)
+	assert.Equal(t, 2, p.total)
+
+	p.hold("xid1", c1) // mysql requires commit in the same session
+	p.put(c2)
+	c4, _ := p.get()
+	assert.Equal(t, c2, c4)
+	assert.Equal(t, c1, p.take("xid1"))
+	assert.Nil(t, p.take("xid1"))
+
+	p.discard(c1)
+	assert.Equal(t, 1, p.total)
+
+	p2 := newFakeXaConnPool(false, 2, 0) // postgres
+	c5, _ := p2.get()
+	p2.hold("xid2", c5)
+	assert.Nil(t, p2.take("xid2"))
+	assert.Equal(t, 1, len(p2.idle))
+}
+
+func TestXaConnPoolIdleTimeout(t *testing.T) {
+	p := newFakeXaConnPool(true, 2, 10*time.Millisecond)
+	c1, _ := p.get()
+	c2, _ := p.get()
+	p.put(c1)
+	p.hold("xid1", c2)
+	time.Sleep(20 * time.Millisecond)
+	c3, _ := p.get()
+	assert.NotEqual(t, c1, c3)
+	assert.Nil(t, p.take("xid1")) // released, so that the xid can be committed in other sessions
+	assert.Equal(t, 1, p.total)
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/go-resty/resty/v2"
+)
+
+// the xid of a xa branch is gid-branchID, and branchID is made of 2 digits for each level
+var xidRegexp = regexp.MustCompile(`^(.+)-((?:[0-9]{2})+)$`)
+
+// xaRecoverActions maps the status of global transaction to the action of the orphaned prepared xa transaction
+var xaRecoverActions = map[string]string{
+	"submitted": "commit",
+	"succeed":   "commit",
+	"aborting":  "rollback",
+	"failed":    "rollback",
+}
+
+func parseXid(xid string) (gid string, branchID string) {
+	m := xidRegexp.FindStringSubmatch(xid)
+	if m == nil {
+		return "", ""
+	}
+	return m[1], m[2]
+}
+
+func xaRecover(db *sql.DB, driver string) ([]Xid, error) {
+	query := map[string]string{
+		DBTypeMysql:    "xa recover",
+		DBTypePostgres: "select gid from pg_prepared_xacts where database = current_database()",
+	}[driver]
+	if query == "" {
+		return nil, fmt.Errorf("xa recover is not supported for driver: %s", driver)
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xids := []Xid{}
+	for rows.Next() {
+		var xid Xid
+		if driver == DBTypeMysql { // formatID, gtrid_length, bqual_length, data
+			var formatID, gtridLength, bqualLength int64
+			var data []byte
+			err = rows.Scan(&formatID, &gtridLength, &bqualLength, &data)
+			xid = mysqlXid(formatID, gtridLength, bqualLength, data)
+		} else {
+			err = rows.Scan(&xid.Gtrid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		xids = append(xids, xid)
+	}
+	return xids, rows.Err()
+}
+
+// QueryTransStatus queries the status of global transaction from dtm server via http. "" is returned if not found
+func QueryTransStatus(server string, gid string) (string, error) {
+	var result struct {
+		Transaction *struct {
+			Status string `json:"status"`
+		} `json:"transaction"`
+	}
+	resp, err := CallDtmServer(context.Background(), server, true, func(url string) (*resty.Response, error) {
+		return RestyClient.R().SetQueryParam("gid", gid).Get(url + "/query")
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := ParseDtmResp(server, resp, &result); errors.Is(err, ErrNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if result.Transaction == nil {
+		return "", nil
+	}
+	return result.Transaction.Status, nil
+}
+
+// RecoverOrphans commits or rolls back the prepared xa transactions left by crashed RMs, according to the status of
+// the global transaction returned by queryStatus. the unknown or unfinished global transactions are left alone.
+// the xids are parsed by the XidFormatter, and a xid not formatted back to itself is left alone too
+func (xc *XaClientBase) RecoverOrphans(queryStatus func(gid string) (string, error)) error {
+	db, err := StandaloneDB(xc.Conf)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+	xids, err := xaRecover(db, xc.Conf.Driver)
+	if err != nil {
+		return err
+	}
+	var rerr error
+	formatter := xc.xidFormatter()
+	for _, xid := range xids {
+		gid, branchID, ok := formatter.ParseXid(xid)
+		if !ok { // not created by dtm
+			continue
+		}
+		if formatted := formatter.FormatXid(gid, branchID); formatted.String() != xid.String() {
+			logger.Errorf("xa %s is parsed to %s %s, but formatted to another xa %s. skipped", xid, gid, branchID, formatted)
+			continue
+		}
+		status, err := queryStatus(gid)
+		if err != nil {
+			logger.Errorf("query status of %s for xa recover error: %v", gid, err)
+			rerr = err
+			continue
+		}
+		action := xaRecoverActions[status]
+		if action == "" {
+			continue
+		}
+		logger.Infof("recovering prepared xa %s by %s, status of global trans is %s", xid, action, status)
+		if err := xc.HandleCallback(gid, branchID, action); err != nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+// StartRecover starts to recover orphaned prepared xa transactions every RecoverInterval, if RecoverEnable
+func (xc *XaClientBase) StartRecover(queryStatus func(gid string) (string, error)) {
+	if !xc.RecoverEnable {
+		return
+	}
+	interval := xc.RecoverInterval
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := xc.RecoverOrphans(queryStatus); err != nil {
+				logger.Errorf("xa recover error: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseXid(t *testing.T) {
+	gid, branchID := parseXid("a-b-c-0102")
+	assert.Equal(t, "a-b-c", gid)
+	assert.Equal(t, "0102", branchID)
+	for _, xid := range []string{"abc", "abc-1", "-01", "abc-0x"} {
+		gid, _ = parseXid(xid)
+		assert.Equal(t, "", gid, xid)
+	}
+}
+
+func TestQueryTransStatus(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("gid") == "gid1" {
+			w.Write([]byte(`{"transaction":{"gid":"gid1","status":"failed"},"branches":[]}`))
+		} else {
+			w.Write([]byte(`{"transaction":null,"branches":[]}`))
+		}
+	}))
+	defer svr.Close()
+	status, err := QueryTransStatus(svr.URL, "gid1")
+	assert.Nil(t, err)
+	assert.Equal(t, "failed", status)
+	status, err = QueryTransStatus(svr.URL, "gid2")
+	assert.Nil(t, err)
+	assert.Equal(t, "", status)
+}
+
+func TestIsXaNotFound(t *testing.T) {
+	assert.True(t, isXaNotFound(errors.New("Error 1397: XAER_NOTA: Unknown XID")))
+	assert.True(t, isXaNotFound(errors.New(`pq: prepared transaction with identifier "g-01" does not exist`)))
+	assert.False(t, isXaNotFound(errors.New("Error 1399: XAER_RMFAIL")))
+	assert.False(t, isXaNotFound(nil))
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"fmt"
+)
+
+// the max lengths of xids, longer xids are rejected instead of being truncated by the db
+const (
+	MysqlMaxGtridLength  = 64
+	MysqlMaxBqualLength  = 64
+	PostgresMaxXidLength = 199 // GIDSIZE of postgres is 200, including the terminating zero
+)
+
+// Xid is the identifier of a xa branch in the db. Bqual and FormatID are only supported by mysql
+type Xid struct {
+	Gtrid    string
+	Bqual    string
+	FormatID int64 // 0 means the default format id 1 of mysql
+}
+
+func (x Xid) formatID() int64 {
+	if x.FormatID == 0 {
+		return 1
+	}
+	return x.FormatID
+}
+
+// isSimple returns whether the xid is made of the gtrid only, which is supported by all dbs
+func (x Xid) isSimple() bool {
+	return x.Bqual == "" && x.formatID() == 1
+}
+
+// String returns the gtrid of a simple xid, or all the parts of the xid
+func (x Xid) String() string {
+	if x.isSimple() {
+		return x.Gtrid
+	}
+	return fmt.Sprintf("%q,%q,%d", x.Gtrid, x.Bqual, x.formatID())
+}
+
+// Validate checks the xid against the limits of the db driver
+func (x Xid) Validate(driver string) error {
+	if x.Gtrid == "" {
+		return fmt.Errorf("empty gtrid of xid. %w", ErrInvalidArgument)
+	}
+	switch driver {
+	case DBTypeMysql:
+		if len(x.Gtrid) > MysqlMaxGtridLength || len(x.Bqual) > MysqlMaxBqualLength {
+			return fmt.Errorf("xid %s exceeds the max length of mysql, gtrid %d bytes, bqual %d bytes. %w", x, MysqlMaxGtridLength, MysqlMaxBqualLength, ErrInvalidArgument)
+		}
+	case DBTypePostgres:
+		if !x.isSimple() {
+			return fmt.Errorf("xid %s has bqual or format id, which is not supported by postgres. %w", x, ErrInvalidArgument)
+		}
+		if len(x.Gtrid) > PostgresMaxXidLength {
+			return fmt.Errorf("xid %s exceeds the max length %d of postgres. %w", x, PostgresMaxXidLength, ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+// sql returns the sql of the xa command. a xid which is not simple is written in hex, and is only valid in mysql
+func (x Xid) sql(command string) string {
+	if x.isSimple() {
+		return GetDBSpecial().GetXaSQL(command, x.Gtrid)
+	}
+	return fmt.Sprintf("xa %s X'%x',X'%x',%d", command, x.Gtrid, x.Bqual, x.formatID())
+}
+
+// mysqlXid builds the xid from a row of mysql xa recover
+func mysqlXid(formatID int64, gtridLength int64, bqualLength int64, data []byte) Xid {
+	if gtridLength < 0 || bqualLength < 0 || gtridLength+bqualLength > int64(len(data)) {
+		return Xid{Gtrid: string(data), FormatID: formatID}
+	}
+	return Xid{
+		Gtrid:    string(data[:gtridLength]),
+		Bqual:    string(data[gtridLength : gtridLength+bqualLength]),
+		FormatID: formatID,
+	}
+}
+
+// XidFormatter builds the xid of a xa branch from the gid and branch id, and parses it back in xa recover.
+// ParseXid returns false for the xids not built by the formatter, and for a xid built by FormatXid, it should return
+// the gid and branch id building it
+type XidFormatter interface {
+	FormatXid(gid string, branchID string) Xid
+	ParseXid(xid Xid) (gid string, branchID string, ok bool)
+}
+
+// DefaultXidFormatter builds the xid gid-branchID
+type DefaultXidFormatter struct{}
+
+// FormatXid builds the xid gid-branchID
+func (DefaultXidFormatter) FormatXid(gid string, branchID string) Xid {
+	return Xid{Gtrid: gid + "-" + branchID}
+}
+
+// ParseXid parses the xid gid-branchID
+func (DefaultXidFormatter) ParseXid(xid Xid) (string, string, bool) {
+	if !xid.isSimple() {
+		return "", "", false
+	}
+	gid, branchID := parseXid(xid.Gtrid)
+	return gid, branchID, gid != ""
+}
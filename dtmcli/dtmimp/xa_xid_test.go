@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmimp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyXidFormatter builds mysql xids of the max length: a gtrid of the gid padded to 64 digits,
+// and a bqual of the site prefix and the branch id padded to 64 bytes
+type legacyXidFormatter struct {
+	site string
+}
+
+func (f legacyXidFormatter) FormatXid(gid string, branchID string) Xid {
+	return Xid{
+		Gtrid:    fmt.Sprintf("%064s", gid),
+		Bqual:    fmt.Sprintf("%s%0*s", f.site, MysqlMaxBqualLength-len(f.site), branchID),
+		FormatID: 4660,
+	}
+}
+
+func (f legacyXidFormatter) ParseXid(xid Xid) (string, string, bool) {
+	if xid.FormatID != 4660 || !strings.HasPrefix(xid.Bqual, f.site) {
+		return "", "", false
+	}
+	id, err := strconv.ParseInt(xid.Gtrid, 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	return strconv.FormatInt(id, 10), strings.TrimLeft(xid.Bqual[len(f.site):], "0"), true
+}
+
+func TestDefaultXidFormatter(t *testing.T) {
+	f := DefaultXidFormatter{}
+	xid := f.FormatXid("gid1", "0102")
+	assert.Equal(t, "gid1-0102", xid.String())
+	assert.Equal(t, "xa start 'gid1-0102'", xid.sql("start"))
+	gid, branchID, ok := f.ParseXid(mysqlXid(1, 9, 0, []byte("gid1-0102")))
+	assert.True(t, ok)
+	assert.Equal(t, "gid1", gid)
+	assert.Equal(t, "0102", branchID)
+	_, _, ok = f.ParseXid(Xid{Gtrid: "gid1-0102", Bqual: "x"})
+	assert.False(t, ok)
+}
+
+func TestMaxLengthXid(t *testing.T) {
+	f := legacyXidFormatter{site: "SH01"}
+	xid := f.FormatXid("12345", "1001")
+	assert.Equal(t, MysqlMaxGtridLength, len(xid.Gtrid))
+	assert.Equal(t, MysqlMaxBqualLength, len(xid.Bqual))
+	assert.Nil(t, xid.Validate(DBTypeMysql))
+	assert.True(t, errors.Is(xid.Validate(DBTypePostgres), ErrInvalidArgument))
+	assert.Equal(t, fmt.Sprintf("xa prepare X'%x',X'%x',4660", xid.Gtrid, xid.Bqual), xid.sql("prepare"))
+
+	// xa recover returns the gtrid and bqual concatenated in data, which must be split without losing a byte
+	recovered := mysqlXid(4660, MysqlMaxGtridLength, MysqlMaxBqualLength, []byte(xid.Gtrid+xid.Bqual))
+	assert.Equal(t, xid, recovered)
+	gid, branchID, ok := f.ParseXid(recovered)
+	assert.True(t, ok)
+	assert.Equal(t, "12345", gid)
+	assert.Equal(t, "1001", branchID)
+	assert.Equal(t, xid, f.FormatXid(gid, branchID))
+
+	long := Xid{Gtrid: xid.Gtrid + "0", Bqual: xid.Bqual, FormatID: 4660}
+	assert.True(t, errors.Is(long.Validate(DBTypeMysql), ErrInvalidArgument))
+	long = Xid{Gtrid: xid.Gtrid, Bqual: xid.Bqual + "0", FormatID: 4660}
+	assert.True(t, errors.Is(long.Validate(DBTypeMysql), ErrInvalidArgument))
+}
+
+func TestXaClientXid(t *testing.T) {
+	xc := &XaClientBase{Conf: DBConf{Driver: DBTypeMysql}}
+	xid, err := xc.xid("gid1", "01")
+	assert.Nil(t, err)
+	assert.Equal(t, "gid1-01", xid.String())
+
+	xc.XidFormatter = legacyXidFormatter{site: "SH01"}
+	_, err = xc.xid("12345", "01")
+	assert.Nil(t, err)
+	_, err = xc.xid(strings.Repeat("1", 65), "01")
+	assert.True(t, errors.Is(err, ErrInvalidArgument))
+	assert.True(t, errors.Is(xc.HandleCallback(strings.Repeat("1", 65), "01", "commit"), ErrInvalidArgument))
+}
@@ -0,0 +1,21 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+// Package dtmsqlx adapts the branch barrier to sqlx. it is a separate package, so that dtmcli does not depend on sqlx
+package dtmsqlx
+
+import (
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/jmoiron/sqlx"
+)
+
+// CallWithSqlxTx the same as BranchBarrier.Call, but with *sqlx.Tx.
+// the barrier joins the transaction of the caller, and the caller should commit tx if nil is returned, or roll it back otherwise
+func CallWithSqlxTx(bb *dtmcli.BranchBarrier, tx *sqlx.Tx, busiCall func(tx *sqlx.Tx) error) error {
+	return bb.CallInTx(tx, func() error {
+		return busiCall(tx)
+	})
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -131,3 +132,83 @@ func FatalfIf(cond bool, fmt string, args ...interface{}) {
 func FatalIfError(err error) {
 	FatalfIf(err != nil, "fatal error: %v", err)
 }
+
+type gidKey struct{}
+
+// WithGid returns a context carrying the gid, so that the logs of Ctx(ctx) carry it
+func WithGid(ctx context.Context, gid string) context.Context {
+	return context.WithValue(ctx, gidKey{}, gid)
+}
+
+// GidFromContext returns the gid of WithGid, or "" if none
+func GidFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	gid, _ := ctx.Value(gidKey{}).(string)
+	return gid
+}
+
+// Ctx returns the logger for the context, whose logs carry the gid of the context if any
+func Ctx(ctx context.Context) Logger {
+	return Gid(GidFromContext(ctx))
+}
+
+// Gid returns the logger whose logs carry the gid in the field gid, or prefixed by "gid=<gid> " if the logger is
+// replaced by WithLogger, so that the logs of a trans can be found by its gid
+func Gid(gid string) Logger {
+	if gid == "" {
+		return &withLogger{logger}
+	}
+	if sugar, ok := logger.(*zap.SugaredLogger); ok {
+		return &withLogger{sugar.With("gid", gid)}
+	}
+	return &withLogger{&prefixLogger{logger, "gid=" + gid + " "}}
+}
+
+// withLogger delegates to l, with the same depth of calls as the funcs of this package, for the caller skip of zap
+type withLogger struct {
+	l Logger
+}
+
+func (w *withLogger) Debugf(format string, args ...interface{}) {
+	w.l.Debugf(format, args...)
+}
+
+func (w *withLogger) Infof(format string, args ...interface{}) {
+	w.l.Infof(format, args...)
+}
+
+func (w *withLogger) Warnf(format string, args ...interface{}) {
+	w.l.Warnf(format, args...)
+}
+
+func (w *withLogger) Errorf(format string, args ...interface{}) {
+	w.l.Errorf(format, args...)
+}
+
+// prefixLogger prefixes the logs of l
+type prefixLogger struct {
+	l      Logger
+	prefix string
+}
+
+func (p *prefixLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{p.prefix}, args...)
+}
+
+func (p *prefixLogger) Debugf(format string, args ...interface{}) {
+	p.l.Debugf("%s"+format, p.args(args)...)
+}
+
+func (p *prefixLogger) Infof(format string, args ...interface{}) {
+	p.l.Infof("%s"+format, p.args(args)...)
+}
+
+func (p *prefixLogger) Warnf(format string, args ...interface{}) {
+	p.l.Warnf("%s"+format, p.args(args)...)
+}
+
+func (p *prefixLogger) Errorf(format string, args ...interface{}) {
+	p.l.Errorf("%s"+format, p.args(args)...)
+}
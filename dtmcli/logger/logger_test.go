@@ -1,10 +1,14 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestInitLog(t *testing.T) {
@@ -37,3 +41,40 @@ func TestWithLogger(t *testing.T) {
 	FatalfIf(false, "nothing")
 	FatalIfError(nil)
 }
+
+type recordLogger struct {
+	logs []string
+}
+
+func (r *recordLogger) Debugf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+func (r *recordLogger) Infof(format string, args ...interface{}) {
+	r.Debugf(format, args...)
+}
+
+func (r *recordLogger) Warnf(format string, args ...interface{}) {
+	r.Debugf(format, args...)
+}
+
+func (r *recordLogger) Errorf(format string, args ...interface{}) {
+	r.Debugf(format, args...)
+}
+
+func TestGid(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	WithLogger(zap.New(core).Sugar())
+	ctx := WithGid(context.Background(), "gid1")
+	assert.Equal(t, "gid1", GidFromContext(ctx))
+	Ctx(ctx).Infof("a info msg")
+	Ctx(context.Background()).Infof("a msg without gid")
+	assert.Equal(t, "gid1", logs.All()[0].ContextMap()["gid"])
+	assert.Empty(t, logs.All()[1].ContextMap())
+
+	r := &recordLogger{}
+	WithLogger(r)
+	Gid("gid2").Errorf("a %s msg", "error")
+	Gid("").Warnf("100%% done")
+	assert.Equal(t, []string{"gid=gid2 a error msg", "100% done"}, r.logs)
+}
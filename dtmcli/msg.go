@@ -7,10 +7,14 @@
 package dtmcli
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strconv"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/go-resty/resty/v2"
 )
 
 // Msg reliable msg type
@@ -31,24 +35,113 @@ func (s *Msg) Add(action string, postData interface{}) *Msg {
 	return s
 }
 
+// AddBin add a new step, whose payload is sent to the branch as is, with the content type. see Saga.AddBin
+func (s *Msg) AddBin(action string, payload interface{}, contentType string) *Msg {
+	s.Steps = append(s.Steps, map[string]string{"action": action, "content_type": contentType})
+	s.Payloads = append(s.Payloads, dtmimp.EncodeBinPayload(dtmimp.MustMarshalBin(payload)))
+	return s
+}
+
+// AddTopic add a new step, the msg will be delivered to all the subscribers of the topic
+func (s *Msg) AddTopic(topic string, postData interface{}) *Msg {
+	return s.Add(dtmimp.MsgTopicPrefix+topic, postData)
+}
+
+// SetBranchHTTPProfile specify the http client profile configured in dtm server to call the branch
+func (s *Msg) SetBranchHTTPProfile(branch int, profile string) *Msg {
+	s.Steps[branch]["http_profile"] = profile
+	return s
+}
+
+// SetBranchRequestTimeout specify the request timeout in seconds to call the branch
+func (s *Msg) SetBranchRequestTimeout(branch int, timeout int64) *Msg {
+	s.Steps[branch]["request_timeout"] = strconv.FormatInt(timeout, 10)
+	return s
+}
+
+// SetBranchRetryInterval specify the retry interval in seconds of the branch, instead of RetryInterval of the trans.
+// the branch is backed off by itself on errors
+func (s *Msg) SetBranchRetryInterval(branch int, interval int64) *Msg {
+	s.Steps[branch]["retry_interval"] = strconv.FormatInt(interval, 10)
+	return s
+}
+
+// SetBranchHeaders specify the headers sent to the branch. see Saga.SetBranchHeaders
+func (s *Msg) SetBranchHeaders(branch int, headers map[string]string) *Msg {
+	s.Steps[branch]["headers"] = dtmimp.MustMarshalString(headers)
+	return s
+}
+
+// SetBranchPayloadInQuery specify the payload of the branch is sent as query parameters. see Saga.SetBranchPayloadInQuery
+func (s *Msg) SetBranchPayloadInQuery(branch int) *Msg {
+	s.Steps[branch]["payload_in_query"] = "1"
+	return s
+}
+
+// SetBranchDelay delay call the branch, unit second. other branches are not affected
+func (s *Msg) SetBranchDelay(branch int, delay uint64) *Msg {
+	s.Steps[branch]["delay"] = strconv.FormatUint(delay, 10)
+	return s
+}
+
+// SetQueryPreparedTargets specify several urls to query the prepared msg. the msg is rolled back only if quorum of
+// them say failure, and committed only if quorum of them say success. other results, including disagreement, are
+// queried again later. quorum 0 means all the targets
+func (s *Msg) SetQueryPreparedTargets(quorum int, targets ...string) *Msg {
+	s.QueryPreparedURLs, s.QueryPreparedQuorum = targets, quorum
+	if len(targets) > 0 {
+		s.QueryPrepared = targets[0]
+	}
+	return s
+}
+
 // SetDelay delay call branch, unit second
 func (s *Msg) SetDelay(delay uint64) *Msg {
 	s.delay = delay
 	return s
 }
 
-// Prepare prepare the msg, msg will later be submitted
+// Prepare prepare the msg, msg will later be submitted. queryPrepared is an http(s) url, or a grpc url prefixed by
+// grpc://, such as grpc://localhost:58081/busi.Busi/QueryPrepared, which is queried by dtm server
 func (s *Msg) Prepare(queryPrepared string) error {
 	s.QueryPrepared = dtmimp.OrString(queryPrepared, s.QueryPrepared)
+	if err := dtmimp.CheckQueryPrepared(false, append([]string{s.QueryPrepared}, s.QueryPreparedURLs...)...); err != nil {
+		return err
+	}
 	return dtmimp.TransCallDtm(&s.TransBase, s, "prepare")
 }
 
+// PrepareCtx the same as Prepare, but the requests are bound to ctx
+func (s *Msg) PrepareCtx(ctx context.Context, queryPrepared string) error {
+	s.Context = ctx
+	return s.Prepare(queryPrepared)
+}
+
 // Submit submit the msg
 func (s *Msg) Submit() error {
 	s.BuildCustomOptions()
 	return dtmimp.TransCallDtm(&s.TransBase, s, "submit")
 }
 
+// SubmitCtx the same as Submit, but the requests are bound to ctx
+func (s *Msg) SubmitCtx(ctx context.Context) error {
+	s.Context = ctx
+	return s.Submit()
+}
+
+// DoAndSubmitDBCtx the same as DoAndSubmitDB, but the requests and the local transaction are bound to ctx
+func (s *Msg) DoAndSubmitDBCtx(ctx context.Context, queryPrepared string, db *sql.DB, busiCall BarrierBusiFunc) error {
+	return s.DoAndSubmitCtx(ctx, queryPrepared, func(bb *BranchBarrier) error {
+		return bb.CallWithDBCtx(ctx, db, busiCall)
+	})
+}
+
+// DoAndSubmitCtx the same as DoAndSubmit, but the requests are bound to ctx
+func (s *Msg) DoAndSubmitCtx(ctx context.Context, queryPrepared string, busiCall func(bb *BranchBarrier) error) error {
+	s.Context = ctx
+	return s.DoAndSubmit(queryPrepared, busiCall)
+}
+
 // DoAndSubmitDB short method for Do on db type. please see DoAndSubmit
 func (s *Msg) DoAndSubmitDB(queryPrepared string, db *sql.DB, busiCall BarrierBusiFunc) error {
 	return s.DoAndSubmit(queryPrepared, func(bb *BranchBarrier) error {
@@ -59,7 +152,8 @@ func (s *Msg) DoAndSubmitDB(queryPrepared string, db *sql.DB, busiCall BarrierBu
 // DoAndSubmit one method for the entire prepare->busi->submit
 // the error returned by busiCall will be returned
 // if busiCall return ErrFailure, then abort is called directly
-// if busiCall return not nil error other than ErrFailure, then DoAndSubmit will call queryPrepared to get the result
+// if busiCall return not nil error other than ErrFailure, then DoAndSubmit will call queryPrepared to get the result.
+// a grpc queryPrepared is not called here, the msg is left prepared and queried by dtm server later
 func (s *Msg) DoAndSubmit(queryPrepared string, busiCall func(bb *BranchBarrier) error) error {
 	bb, err := BarrierFrom(s.TransType, s.Gid, "00", "msg") // a special barrier for msg QueryPrepared
 	if err == nil {
@@ -67,11 +161,15 @@ func (s *Msg) DoAndSubmit(queryPrepared string, busiCall func(bb *BranchBarrier)
 	}
 	if err == nil {
 		errb := busiCall(bb)
+		if errb != nil && !errors.Is(errb, ErrFailure) && !dtmimp.IsHTTPURL(s.QueryPrepared) {
+			return errb
+		}
 		if errb != nil && !errors.Is(errb, ErrFailure) {
 			// if busicall return an error other than failure, we will query the result
-			_, err = dtmimp.TransRequestBranch(&s.TransBase, "GET", nil, bb.BranchID, bb.Op, queryPrepared)
+			_, err = dtmimp.TransRequestBranch(&s.TransBase, "GET", nil, bb.BranchID, bb.Op, s.QueryPrepared)
 		}
 		if errors.Is(errb, ErrFailure) || errors.Is(err, ErrFailure) {
+			s.DetachContext()
 			_ = dtmimp.TransCallDtm(&s.TransBase, s, "abort")
 		} else if err == nil {
 			err = s.Submit()
@@ -89,3 +187,61 @@ func (s *Msg) BuildCustomOptions() {
 		s.CustomData = dtmimp.MustMarshalString(map[string]interface{}{"delay": s.delay})
 	}
 }
+
+// ResultError is the result of a msg in SubmitBatch, which is not submitted because of an error worth a retry, such as a store error
+const ResultError = "ERROR"
+
+// MsgBatchResult is the result of a msg submitted by SubmitBatch
+type MsgBatchResult struct {
+	Gid        string `json:"gid"`
+	Result     string `json:"dtm_result"`           // ResultSuccess, ResultFailure if the msg is rejected, or ResultError
+	Message    string `json:"message,omitempty"`    // the reason if not succeeded
+	Duplicated bool   `json:"duplicated,omitempty"` // the gid exists with the same branches, so the msg is not submitted again
+	Status     string `json:"status,omitempty"`     // the status of the existing trans if duplicated
+}
+
+// Err returns the result as an error. nil means succeeded, and ErrFailure is wrapped if the msg is rejected
+func (r *MsgBatchResult) Err() error {
+	switch r.Result {
+	case ResultSuccess:
+		return nil
+	case ResultFailure:
+		return fmt.Errorf("%s. %w", r.Message, ErrFailure)
+	}
+	return errors.New(r.Message)
+}
+
+// SubmitBatch submits many independent msgs in one request. see SubmitBatchCtx
+func SubmitBatch(msgs []*Msg) ([]MsgBatchResult, error) {
+	return SubmitBatchCtx(context.Background(), msgs)
+}
+
+// SubmitBatchCtx submits many independent msgs of the same dtm server in one request, which is bound to ctx.
+// an error is returned if the request fails, otherwise the results of msgs are returned in order,
+// and a msg whose result is ResultError can be submitted again
+func SubmitBatchCtx(ctx context.Context, msgs []*Msg) ([]MsgBatchResult, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	server := msgs[0].Dtm
+	for _, m := range msgs {
+		if m.Dtm != server {
+			return nil, fmt.Errorf("msgs of different dtm servers %s and %s. %w", server, m.Dtm, ErrInvalidArgument)
+		}
+		m.BuildCustomOptions()
+	}
+	res := struct {
+		Results []MsgBatchResult `json:"results"`
+	}{}
+	// submit_batch is idempotent, a resubmitted msg is reported as duplicated
+	resp, err := dtmimp.CallDtmServer(ctx, server, true, func(url string) (*resty.Response, error) {
+		return dtmimp.RestyClient.R().SetContext(ctx).SetBody(map[string]interface{}{"trans": msgs}).Post(url + "/submit_batch")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := dtmimp.ParseDtmResp(server, resp, &res); err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
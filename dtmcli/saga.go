@@ -7,18 +7,25 @@
 package dtmcli
 
 import (
+	"context"
+	"strconv"
+
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 )
 
 // Saga struct of saga
 type Saga struct {
 	dtmimp.TransBase
-	orders map[int][]int
+	orders               map[int][]int
+	compensatePriorities map[int]int
+	maxParallel          int
+	groupOrders          map[int][]string // the groups each branch should be after
 }
 
 // NewSaga create a saga
 func NewSaga(server string, gid string) *Saga {
-	return &Saga{TransBase: *dtmimp.NewTransBase(gid, "saga", server, ""), orders: map[int][]int{}}
+	return &Saga{TransBase: *dtmimp.NewTransBase(gid, "saga", server, ""), orders: map[int][]int{}, compensatePriorities: map[int]int{},
+		groupOrders: map[int][]string{}}
 }
 
 // Add add a saga step
@@ -28,12 +35,98 @@ func (s *Saga) Add(action string, compensate string, postData interface{}) *Saga
 	return s
 }
 
+// AddBin add a saga step, whose payload is sent to the branches as is, with the content type, such as application/x-protobuf.
+// payload should be []byte or proto.Message
+func (s *Saga) AddBin(action string, compensate string, payload interface{}, contentType string) *Saga {
+	s.Steps = append(s.Steps, map[string]string{"action": action, "compensate": compensate, "content_type": contentType})
+	s.Payloads = append(s.Payloads, dtmimp.EncodeBinPayload(dtmimp.MustMarshalBin(payload)))
+	return s
+}
+
+// AddWithDeps add a saga step, which is executed after all the steps in deps (indices of steps) succeeded.
+// the saga is executed concurrently, so steps without deps, including those added by Add, are executed at once
+func (s *Saga) AddWithDeps(action string, compensate string, postData interface{}, deps []int) *Saga {
+	s.Add(action, compensate, postData)
+	return s.AddBranchOrder(len(s.Steps)-1, deps).SetConcurrent()
+}
+
 // AddBranchOrder specify that branch should be after preBranches. branch should is larger than all the element in preBranches
 func (s *Saga) AddBranchOrder(branch int, preBranches []int) *Saga {
 	s.orders[branch] = preBranches
 	return s
 }
 
+// AddInGroup add a saga step to the group, see SetBranchGroup
+func (s *Saga) AddInGroup(group string, action string, compensate string, postData interface{}) *Saga {
+	s.Add(action, compensate, postData)
+	return s.SetBranchGroup(len(s.Steps)-1, group)
+}
+
+// SetBranchGroup put the branch into the group. the branches of a group are executed concurrently, and succeed or fail
+// as one unit: once the action of any branch in the group fails, all the branches of the group are compensated first,
+// then the others are compensated as the normal rollback. a branch of a group may be after other branches, but not after
+// another branch of its group, and the later branches should be after the whole group by AddBranchGroupOrder.
+// the branches of a group are limited by SetMaxParallel as others, and a branch waiting for its own retry interval keeps
+// the group pending, until it succeeds or fails
+func (s *Saga) SetBranchGroup(branch int, group string) *Saga {
+	s.Steps[branch]["group"] = group
+	return s.SetConcurrent()
+}
+
+// AddBranchGroupOrder specify that branch should be after all the branches of the groups
+func (s *Saga) AddBranchGroupOrder(branch int, groups []string) *Saga {
+	s.groupOrders[branch] = append(s.groupOrders[branch], groups...)
+	return s.SetConcurrent()
+}
+
+// SetBranchHTTPProfile specify the http client profile configured in dtm server to call the branch
+func (s *Saga) SetBranchHTTPProfile(branch int, profile string) *Saga {
+	s.Steps[branch]["http_profile"] = profile
+	return s
+}
+
+// SetBranchRequestTimeout specify the request timeout in seconds to call the branch
+func (s *Saga) SetBranchRequestTimeout(branch int, timeout int64) *Saga {
+	s.Steps[branch]["request_timeout"] = strconv.FormatInt(timeout, 10)
+	return s
+}
+
+// SetBranchRetryInterval specify the retry interval in seconds of the branch, instead of RetryInterval of the trans.
+// the branch is backed off by itself on errors
+func (s *Saga) SetBranchRetryInterval(branch int, interval int64) *Saga {
+	s.Steps[branch]["retry_interval"] = strconv.FormatInt(interval, 10)
+	return s
+}
+
+// SetBranchHeaders specify the headers sent to the action and the compensation of the branch, overriding the
+// BranchHeaders of the trans. the headers are not sent to other branches
+func (s *Saga) SetBranchHeaders(branch int, headers map[string]string) *Saga {
+	s.Steps[branch]["headers"] = dtmimp.MustMarshalString(headers)
+	return s
+}
+
+// SetBranchPayloadInQuery specify the payload of the branch is sent to the action and the compensation as query
+// parameters of a GET request, instead of the request body. the payload should be a flat json object, and the values
+// of an array are sent as repeated keys
+func (s *Saga) SetBranchPayloadInQuery(branch int) *Saga {
+	s.Steps[branch]["payload_in_query"] = "1"
+	return s
+}
+
+// SetCompensatePriority specify the compensation priority of branch. once any priority is specified,
+// compensations are executed from the highest priority to the lowest instead of the reverse order of actions,
+// compensations of the same priority are executed concurrently. the default priority is 0
+func (s *Saga) SetCompensatePriority(branch int, priority int) *Saga {
+	s.compensatePriorities[branch] = priority
+	return s
+}
+
+// SetMaxParallel limit the number of branches executed at the same time by dtm server. 0 means unlimited
+func (s *Saga) SetMaxParallel(n int) *Saga {
+	s.maxParallel = n
+	return s
+}
+
 // SetConcurrent enable the concurrent exec of sub trans
 func (s *Saga) SetConcurrent() *Saga {
 	s.Concurrent = true
@@ -46,9 +139,47 @@ func (s *Saga) Submit() error {
 	return dtmimp.TransCallDtm(&s.TransBase, s, "submit")
 }
 
+// SubmitCtx the same as Submit, but the request is bound to ctx
+func (s *Saga) SubmitCtx(ctx context.Context) error {
+	s.Context = ctx
+	return s.Submit()
+}
+
 // BuildCustomOptions add custom options to the request context
 func (s *Saga) BuildCustomOptions() {
+	custom := map[string]interface{}{}
 	if s.Concurrent {
-		s.CustomData = dtmimp.MustMarshalString(map[string]interface{}{"orders": s.orders, "concurrent": s.Concurrent})
+		custom["orders"] = s.buildOrders()
+		custom["concurrent"] = s.Concurrent
+	}
+	if len(s.compensatePriorities) > 0 {
+		custom["compensate_priorities"] = s.compensatePriorities
+	}
+	if s.maxParallel > 0 {
+		custom["max_parallel"] = s.maxParallel
+	}
+	if len(custom) > 0 {
+		s.CustomData = dtmimp.MustMarshalString(custom)
+	}
+}
+
+// buildOrders returns the orders of the branches, where the groups in groupOrders are expanded to their branches
+func (s *Saga) buildOrders() map[int][]int {
+	if len(s.groupOrders) == 0 {
+		return s.orders
+	}
+	orders := map[int][]int{}
+	for branch, pres := range s.orders {
+		orders[branch] = append([]int{}, pres...)
+	}
+	for branch, groups := range s.groupOrders {
+		for _, group := range groups {
+			for i, step := range s.Steps {
+				if step["group"] == group && group != "" {
+					orders[branch] = append(orders[branch], i)
+				}
+			}
+		}
 	}
+	return orders
 }
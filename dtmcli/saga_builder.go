@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DefaultSagaMaxSteps is the default max number of steps of a saga built by SagaBuilder
+	DefaultSagaMaxSteps = 10000
+	// DefaultSagaMaxPayloadSize is the default max size of the marshaled payload of a step built by SagaBuilder
+	DefaultSagaMaxPayloadSize = 4 * 1024 * 1024
+)
+
+// SagaBuildError is the error of SagaBuilder.Build, which holds all the problems found in the saga
+type SagaBuildError struct {
+	Errors []error
+}
+
+func (e *SagaBuildError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid saga: %s", strings.Join(msgs, "; "))
+}
+
+// Is makes errors.Is(err, ErrInvalidArgument) true
+func (e *SagaBuildError) Is(target error) bool {
+	return target == ErrInvalidArgument
+}
+
+type sagaBuilderStep struct {
+	action       string
+	compensate   string
+	payload      []byte
+	deps         []int
+	noCompensate bool
+}
+
+// SagaBuilder builds a saga step by step, and validates it locally when built, so that the mistakes are found before
+// submitted. the errors are collected and returned by Build all together
+type SagaBuilder struct {
+	server         string
+	gid            string
+	steps          []sagaBuilderStep
+	priorities     map[int]int
+	headers        map[int]map[string]string
+	retryInterval  int64
+	timeoutToFail  int64
+	requestTimeout int64
+	concurrent     bool
+	maxParallel    int
+	maxSteps       int
+	maxPayloadSize int
+	errs           []error
+}
+
+// NewSagaBuilder create a builder of saga
+func NewSagaBuilder(server string, gid string) *SagaBuilder {
+	return &SagaBuilder{server: server, gid: gid, priorities: map[int]int{}, headers: map[int]map[string]string{},
+		maxSteps: DefaultSagaMaxSteps, maxPayloadSize: DefaultSagaMaxPayloadSize}
+}
+
+func (b *SagaBuilder) errorf(format string, args ...interface{}) *SagaBuilder {
+	b.errs = append(b.errs, fmt.Errorf(format, args...))
+	return b
+}
+
+func (b *SagaBuilder) addStep(action string, compensate string, payload interface{}, deps []int, noCompensate bool) *SagaBuilder {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		b.errorf("step %d: payload can not be marshaled: %v", len(b.steps), err)
+	}
+	b.steps = append(b.steps, sagaBuilderStep{action: action, compensate: compensate, payload: data, deps: deps, noCompensate: noCompensate})
+	return b
+}
+
+// Step add a step, whose compensate is required
+func (b *SagaBuilder) Step(action string, compensate string, payload interface{}) *SagaBuilder {
+	return b.addStep(action, compensate, payload, nil, false)
+}
+
+// StepWithoutCompensate add a step which needs no compensation, such as a step that never fails or can not be undone
+func (b *SagaBuilder) StepWithoutCompensate(action string, payload interface{}) *SagaBuilder {
+	return b.addStep(action, "", payload, nil, true)
+}
+
+// StepWithDeps add a step executed after the steps in deps (indices of previous steps). the saga becomes concurrent
+func (b *SagaBuilder) StepWithDeps(action string, compensate string, payload interface{}, deps []int) *SagaBuilder {
+	b.concurrent = true
+	return b.addStep(action, compensate, payload, deps, false)
+}
+
+// WithRetryInterval specify the retry interval in seconds of the saga
+func (b *SagaBuilder) WithRetryInterval(seconds int64) *SagaBuilder {
+	if seconds <= 0 {
+		return b.errorf("retry interval should be positive, got %d", seconds)
+	}
+	b.retryInterval = seconds
+	return b
+}
+
+// WithTimeoutToFail specify the timeout in seconds, after which the saga is rolled back
+func (b *SagaBuilder) WithTimeoutToFail(seconds int64) *SagaBuilder {
+	if seconds <= 0 {
+		return b.errorf("timeout to fail should be positive, got %d", seconds)
+	}
+	b.timeoutToFail = seconds
+	return b
+}
+
+// WithRequestTimeout specify the request timeout in seconds to call the branches
+func (b *SagaBuilder) WithRequestTimeout(seconds int64) *SagaBuilder {
+	if seconds <= 0 {
+		return b.errorf("request timeout should be positive, got %d", seconds)
+	}
+	b.requestTimeout = seconds
+	return b
+}
+
+// WithConcurrency make the saga concurrent, with at most n branches executed at the same time. 0 means unlimited
+func (b *SagaBuilder) WithConcurrency(n int) *SagaBuilder {
+	if n < 0 {
+		return b.errorf("concurrency should not be negative, got %d", n)
+	}
+	b.concurrent, b.maxParallel = true, n
+	return b
+}
+
+// WithCompensatePriority specify the compensation priority of the step, see Saga.SetCompensatePriority
+func (b *SagaBuilder) WithCompensatePriority(step int, priority int) *SagaBuilder {
+	b.priorities[step] = priority
+	return b
+}
+
+// WithStepHeaders specify the headers of the step, see Saga.SetBranchHeaders
+func (b *SagaBuilder) WithStepHeaders(step int, headers map[string]string) *SagaBuilder {
+	b.headers[step] = headers
+	return b
+}
+
+// WithLimits specify the max number of steps and the max payload size of a step. 0 means no limit
+func (b *SagaBuilder) WithLimits(maxSteps int, maxPayloadSize int) *SagaBuilder {
+	b.maxSteps, b.maxPayloadSize = maxSteps, maxPayloadSize
+	return b
+}
+
+// Build validates the saga and returns it. the error is a *SagaBuildError with all the problems found
+func (b *SagaBuilder) Build() (*Saga, error) {
+	errs := append([]error{}, b.errs...)
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if err := checkBranchURL(b.server); err != nil {
+		add("server: %v", err)
+	}
+	if b.gid == "" {
+		add("gid should not be empty")
+	}
+	if len(b.steps) == 0 {
+		add("saga should have at least one step")
+	}
+	if b.maxSteps > 0 && len(b.steps) > b.maxSteps {
+		add("saga has %d steps, more than the limit %d", len(b.steps), b.maxSteps)
+	}
+	for i, s := range b.steps {
+		if err := checkBranchURL(s.action); err != nil {
+			add("step %d: action: %v", i, err)
+		}
+		if !s.noCompensate {
+			if s.compensate == "" {
+				add("step %d: compensate is empty, use StepWithoutCompensate for a step needing no compensation", i)
+			} else if err := checkBranchURL(s.compensate); err != nil {
+				add("step %d: compensate: %v", i, err)
+			}
+		}
+		if b.maxPayloadSize > 0 && len(s.payload) > b.maxPayloadSize {
+			add("step %d: payload size %d is larger than the limit %d", i, len(s.payload), b.maxPayloadSize)
+		}
+		for _, d := range s.deps {
+			if d < 0 || d >= i {
+				add("step %d: dependency %d should be a previous step", i, d)
+			}
+		}
+	}
+	for step := range b.priorities {
+		if step < 0 || step >= len(b.steps) {
+			add("compensate priority: step %d does not exist", step)
+		} else if b.steps[step].noCompensate {
+			add("compensate priority: step %d has no compensation", step)
+		}
+	}
+	for step := range b.headers {
+		if step < 0 || step >= len(b.steps) {
+			add("headers: step %d does not exist", step)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &SagaBuildError{Errors: errs}
+	}
+
+	saga := NewSaga(b.server, b.gid)
+	for i, s := range b.steps {
+		saga.Add(s.action, s.compensate, json.RawMessage(s.payload))
+		if len(s.deps) > 0 {
+			saga.AddBranchOrder(i, s.deps)
+		}
+	}
+	for step, priority := range b.priorities {
+		saga.SetCompensatePriority(step, priority)
+	}
+	for step, headers := range b.headers {
+		saga.SetBranchHeaders(step, headers)
+	}
+	if b.concurrent {
+		saga.SetConcurrent().SetMaxParallel(b.maxParallel)
+	}
+	saga.RetryInterval, saga.TimeoutToFail = b.retryInterval, b.timeoutToFail
+	if b.requestTimeout > 0 {
+		saga.WithGlobalTransRequestTimeout(b.requestTimeout)
+	}
+	return saga, nil
+}
+
+// checkBranchURL checks the url is absolute, such as http://localhost:8081/api/busi/TransIn
+func checkBranchURL(uri string) error {
+	if uri == "" {
+		return fmt.Errorf("url should not be empty")
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("url %s should be absolute with scheme and host", uri)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const builderBusi = "http://localhost:8081/api/busi"
+
+func TestSagaBuilder(t *testing.T) {
+	saga, err := NewSagaBuilder("http://localhost:36789/api/dtmsvr", "TestSagaBuilder").
+		Step(builderBusi+"/TransOut", builderBusi+"/TransOutRevert", map[string]int{"amount": 30}).
+		StepWithDeps(builderBusi+"/TransIn", builderBusi+"/TransInRevert", map[string]int{"amount": 30}, []int{0}).
+		StepWithoutCompensate(builderBusi+"/Notify", nil).
+		WithCompensatePriority(1, 2).
+		WithStepHeaders(0, map[string]string{"x-api-key": "a"}).
+		WithConcurrency(2).
+		WithRetryInterval(5).
+		WithRequestTimeout(3).
+		Build()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(saga.Steps))
+	assert.Equal(t, `{"amount":30}`, saga.Payloads[0])
+	assert.Equal(t, "null", saga.Payloads[2])
+	assert.Equal(t, "", saga.Steps[2]["compensate"])
+	assert.True(t, saga.Concurrent)
+	assert.Equal(t, int64(5), saga.RetryInterval)
+	assert.Equal(t, int64(3), saga.RequestTimeout)
+
+	saga.BuildCustomOptions()
+	expected := NewSaga("http://localhost:36789/api/dtmsvr", "TestSagaBuilder").
+		Add(builderBusi+"/TransOut", builderBusi+"/TransOutRevert", map[string]int{"amount": 30}).
+		AddWithDeps(builderBusi+"/TransIn", builderBusi+"/TransInRevert", map[string]int{"amount": 30}, []int{0}).
+		Add(builderBusi+"/Notify", "", nil).
+		SetCompensatePriority(1, 2).
+		SetBranchHeaders(0, map[string]string{"x-api-key": "a"}).
+		SetMaxParallel(2)
+	expected.BuildCustomOptions()
+	assert.Equal(t, expected.CustomData, saga.CustomData)
+	assert.Equal(t, expected.Steps, saga.Steps)
+}
+
+func TestSagaBuilderErrors(t *testing.T) {
+	_, err := NewSagaBuilder("localhost:36789", "").
+		Step("/api/busi/TransOut", "", 1).
+		Step(builderBusi+"/TransIn", "http://%zz", make(chan int)).
+		StepWithDeps(builderBusi+"/TransIn2", builderBusi+"/TransIn2Revert", 1, []int{2, 5}).
+		StepWithoutCompensate(builderBusi+"/Notify", 1).
+		WithCompensatePriority(3, 1).
+		WithCompensatePriority(9, 1).
+		WithStepHeaders(7, nil).
+		WithConcurrency(-1).
+		WithRetryInterval(0).
+		Build()
+	assert.True(t, errors.Is(err, ErrInvalidArgument))
+	var be *SagaBuildError
+	assert.True(t, errors.As(err, &be))
+	msg := err.Error()
+	for _, expected := range []string{
+		"server: url localhost:36789 should be absolute",
+		"gid should not be empty",
+		"step 0: action: url /api/busi/TransOut should be absolute",
+		"step 0: compensate is empty",
+		"step 1: compensate:",
+		"step 1: payload can not be marshaled",
+		"step 2: dependency 2 should be a previous step",
+		"step 2: dependency 5 should be a previous step",
+		"step 3 has no compensation",
+		"step 9 does not exist",
+		"headers: step 7 does not exist",
+		"concurrency should not be negative",
+		"retry interval should be positive",
+	} {
+		assert.Contains(t, msg, expected)
+	}
+	assert.Equal(t, 13, len(be.Errors))
+
+	_, err = NewSagaBuilder("http://localhost:36789/api/dtmsvr", "TestSagaBuilderLimits").
+		Step(builderBusi+"/TransOut", builderBusi+"/TransOutRevert", strings.Repeat("a", 20)).
+		Step(builderBusi+"/TransIn", builderBusi+"/TransInRevert", 1).
+		WithLimits(1, 10).
+		Build()
+	assert.Contains(t, err.Error(), "saga has 2 steps, more than the limit 1")
+	assert.Contains(t, err.Error(), "step 0: payload size 22 is larger than the limit 10")
+
+	_, err = NewSagaBuilder("http://localhost:36789/api/dtmsvr", "TestSagaBuilderEmpty").Build()
+	assert.Contains(t, err.Error(), "saga should have at least one step")
+}
+
+func TestSagaBranchGroups(t *testing.T) {
+	saga := NewSaga("http://localhost:36789/api/dtmsvr", "TestSagaBranchGroups").
+		AddInGroup("trip", builderBusi+"/TransOut", builderBusi+"/TransOutRevert", 1).
+		Add(builderBusi+"/TransIn", builderBusi+"/TransInRevert", 1).
+		AddInGroup("trip", builderBusi+"/TransOut", builderBusi+"/TransOutRevert", 1).
+		Add(builderBusi+"/Notify", "", nil).
+		AddBranchOrder(3, []int{1}).
+		AddBranchGroupOrder(3, []string{"trip"})
+	assert.True(t, saga.Concurrent)
+	assert.Equal(t, "trip", saga.Steps[2]["group"])
+	saga.BuildCustomOptions()
+	assert.Equal(t, `{"concurrent":true,"orders":{"3":[1,0,2]}}`, saga.CustomData)
+	saga.BuildCustomOptions() // built again without duplicated orders
+	assert.Equal(t, `{"concurrent":true,"orders":{"3":[1,0,2]}}`, saga.CustomData)
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Target builds the url of a branch or a back-check with query parameters, which are escaped properly.
+// the query parameters are appended to the query string of the base url
+type Target struct {
+	base  string
+	query url.Values
+}
+
+// NewTarget creates a target of the base url
+func NewTarget(base string) *Target {
+	return &Target{base: base, query: url.Values{}}
+}
+
+// Add adds the values of the key. the values are formatted by fmt.Sprint, and every value is a repeated key
+func (t *Target) Add(key string, values ...interface{}) *Target {
+	for _, v := range values {
+		t.query.Add(key, fmt.Sprint(v))
+	}
+	return t
+}
+
+// Set sets the value of the key, replacing the values added before
+func (t *Target) Set(key string, value interface{}) *Target {
+	t.query.Set(key, fmt.Sprint(value))
+	return t
+}
+
+// String returns the url of the target
+func (t *Target) String() string {
+	if len(t.query) == 0 {
+		return t.base
+	}
+	base, fragment := t.base, ""
+	if i := strings.Index(base, "#"); i >= 0 {
+		base, fragment = base[:i], base[i:]
+	}
+	sep := "?"
+	if strings.HasSuffix(base, "?") || strings.HasSuffix(base, "&") {
+		sep = ""
+	} else if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + t.query.Encode() + fragment
+}
@@ -0,0 +1,30 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarget(t *testing.T) {
+	assert.Equal(t, "http://svc/query", NewTarget("http://svc/query").String())
+
+	target := NewTarget("http://svc/query").Add("q", "a&b=c?d#e f+g/h").Add("name", "中文 ü").Add("id", 1, 2).Set("ok", true)
+	u, err := url.Parse(target.String())
+	assert.Nil(t, err)
+	assert.Equal(t, "/query", u.Path)
+	assert.Equal(t, "", u.Fragment)
+	assert.Equal(t, url.Values{"q": {"a&b=c?d#e f+g/h"}, "name": {"中文 ü"}, "id": {"1", "2"}, "ok": {"true"}}, u.Query())
+	assert.Equal(t, "http://svc/query?id=1&id=2&name=%E4%B8%AD%E6%96%87+%C3%BC&ok=true&q=a%26b%3Dc%3Fd%23e+f%2Bg%2Fh", target.String())
+
+	assert.Equal(t, "http://svc/query?a=1&b=2#top", NewTarget("http://svc/query?a=1#top").Add("b", 2).String())
+	assert.Equal(t, "http://svc/query?b=2", NewTarget("http://svc/query?").Add("b", 2).String())
+	assert.Equal(t, "http://svc/query?b=x", NewTarget("http://svc/query").Add("b", "y").Set("b", "x").String())
+}
@@ -7,6 +7,7 @@
 package dtmcli
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -32,7 +33,14 @@ func TccGlobalTransaction(dtm string, gid string, tccFunc TccGlobalFunc) (rerr e
 
 // TccGlobalTransaction2 new version of TccGlobalTransaction, add custom param
 func TccGlobalTransaction2(dtm string, gid string, custom func(*Tcc), tccFunc TccGlobalFunc) (rerr error) {
+	return TccGlobalTransactionCtx(context.Background(), dtm, gid, custom, tccFunc)
+}
+
+// TccGlobalTransactionCtx the same as TccGlobalTransaction2, but the requests to dtm server and branches are bound to ctx.
+// if ctx is canceled, the tcc is aborted, and dtm server is still notified
+func TccGlobalTransactionCtx(ctx context.Context, dtm string, gid string, custom func(*Tcc), tccFunc TccGlobalFunc) (rerr error) {
 	tcc := &Tcc{TransBase: *dtmimp.NewTransBase(gid, "tcc", dtm, "")}
+	tcc.Context = ctx
 	custom(tcc)
 	rerr = dtmimp.TransCallDtm(&tcc.TransBase, tcc, "prepare")
 	if rerr != nil {
@@ -42,12 +50,27 @@ func TccGlobalTransaction2(dtm string, gid string, custom func(*Tcc), tccFunc Tc
 	defer dtmimp.DeferDo(&rerr, func() error {
 		return dtmimp.TransCallDtm(&tcc.TransBase, tcc, "submit")
 	}, func() error {
+		tcc.DetachContext()
 		return dtmimp.TransCallDtm(&tcc.TransBase, tcc, "abort")
 	})
 	_, rerr = tccFunc(tcc)
 	return
 }
 
+// SetConcurrent let dtm server execute the confirm/cancel of branches concurrently, at most maxParallel at the same time.
+// 0 means unlimited. it should be called in the custom func of TccGlobalTransaction2
+func (t *Tcc) SetConcurrent(maxParallel int) *Tcc {
+	t.MergeCustomData(map[string]interface{}{"concurrent": true, "max_parallel": maxParallel})
+	return t
+}
+
+// SetTryTimeout let dtm server abort the tcc, if it is not submitted in seconds after prepare, such as the AP crashes
+// in the try phase. it should be called in the custom func of TccGlobalTransaction2
+func (t *Tcc) SetTryTimeout(seconds int64) *Tcc {
+	t.TryTimeout = seconds
+	return t
+}
+
 // TccFromQuery tcc from request info
 func TccFromQuery(qs url.Values) (*Tcc, error) {
 	tcc := &Tcc{TransBase: *dtmimp.TransBaseFromQuery(qs)}
@@ -61,13 +84,32 @@ func TccFromQuery(qs url.Values) (*Tcc, error) {
 func (t *Tcc) CallBranch(body interface{}, tryURL string, confirmURL string, cancelURL string) (*resty.Response, error) {
 	branchID := t.NewSubBranchID()
 	err := dtmimp.TransRegisterBranch(&t.TransBase, map[string]string{
-		"data":        dtmimp.MustMarshalString(body),
-		"branch_id":   branchID,
-		BranchConfirm: confirmURL,
-		BranchCancel:  cancelURL,
+		"data":          dtmimp.MustMarshalString(body),
+		"branch_id":     branchID,
+		"parent_branch": t.BranchID, // not empty for a nested tcc, which is created from the query of the parent try
+		BranchConfirm:   confirmURL,
+		BranchCancel:    cancelURL,
 	}, "registerBranch")
 	if err != nil {
 		return nil, err
 	}
 	return dtmimp.TransRequestBranch(&t.TransBase, "POST", body, branchID, BranchTry, tryURL)
 }
+
+// CallBranchBin the same as CallBranch, but the payload is sent to the branches as is, with the content type. see Saga.AddBin
+func (t *Tcc) CallBranchBin(payload interface{}, contentType string, tryURL string, confirmURL string, cancelURL string) (*resty.Response, error) {
+	branchID := t.NewSubBranchID()
+	body := dtmimp.MustMarshalBin(payload)
+	err := dtmimp.TransRegisterBranch(&t.TransBase, map[string]string{
+		"data":          dtmimp.EncodeBinPayload(body),
+		"content_type":  contentType,
+		"branch_id":     branchID,
+		"parent_branch": t.BranchID,
+		BranchConfirm:   confirmURL,
+		BranchCancel:    cancelURL,
+	}, "registerBranch")
+	if err != nil {
+		return nil, err
+	}
+	return dtmimp.TransRequestBranchBin(&t.TransBase, "POST", body, contentType, branchID, BranchTry, tryURL)
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmcli
+
+import (
+	"context"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+)
+
+// TemplateTrans is a trans expanded by dtm server from a template registered by POST /api/dtmsvr/admin/templates,
+// so only the gid and the payloads of the steps are submitted. the trans type, branches and options are the ones of
+// the current version of the template
+type TemplateTrans struct {
+	Gid      string   `json:"gid"`
+	Template string   `json:"template"`
+	Payloads []string `json:"payloads"`
+	tb       dtmimp.TransBase
+}
+
+// NewTemplateTrans create a trans of the template
+func NewTemplateTrans(server string, gid string, template string) *TemplateTrans {
+	return &TemplateTrans{Gid: gid, Template: template, tb: *dtmimp.NewTransBase(gid, "", server, "")}
+}
+
+// Add add the payload of the next step of the template
+func (t *TemplateTrans) Add(postData interface{}) *TemplateTrans {
+	t.Payloads = append(t.Payloads, dtmimp.MustMarshalString(postData))
+	return t
+}
+
+// AddBin add the payload of the next step of the template, whose content_type is specified in the template.
+// payload should be []byte or proto.Message
+func (t *TemplateTrans) AddBin(payload interface{}) *TemplateTrans {
+	t.Payloads = append(t.Payloads, dtmimp.EncodeBinPayload(dtmimp.MustMarshalBin(payload)))
+	return t
+}
+
+// Submit submit the trans
+func (t *TemplateTrans) Submit() error {
+	return dtmimp.TransCallDtm(&t.tb, t, "submit_template")
+}
+
+// SubmitCtx the same as Submit, but the request is bound to ctx
+func (t *TemplateTrans) SubmitCtx(ctx context.Context) error {
+	t.tb.Context = ctx
+	return t.Submit()
+}
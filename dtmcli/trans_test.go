@@ -7,9 +7,15 @@
 package dtmcli
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,3 +34,25 @@ func TestXa(t *testing.T) {
 	_, err := NewXaClient("http://localhost:36789", DBConf{}, ":::::", nil)
 	assert.Error(t, err)
 }
+
+func TestTccCanceled(t *testing.T) {
+	var mu sync.Mutex
+	ops := []string{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ops = append(ops, strings.TrimPrefix(r.URL.Path, "/api/dtmsvr/"))
+		mu.Unlock()
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+	defer svr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := TccGlobalTransactionCtx(ctx, svr.URL+"/api/dtmsvr", "TestTccCanceled", func(tcc *Tcc) {}, func(tcc *Tcc) (*resty.Response, error) {
+		cancel()
+		return tcc.CallBranch(nil, svr.URL+"/api/busi/try", svr.URL+"/api/busi/confirm", svr.URL+"/api/busi/cancel")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"prepare", "abort"}, ops) // the canceled registerBranch is not sent, but abort is
+}
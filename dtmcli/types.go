@@ -7,6 +7,7 @@
 package dtmcli
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
@@ -15,12 +16,42 @@ import (
 
 // MustGenGid generate a new gid
 func MustGenGid(server string) string {
+	return MustGenGidCtx(context.Background(), server)
+}
+
+// MustGenGidCtx the same as MustGenGid, but the request is bound to ctx
+func MustGenGidCtx(ctx context.Context, server string) string {
+	gid, err := GenGidCtx(ctx, server)
+	dtmimp.E2P(err)
+	return gid
+}
+
+// GenGidCtx generate a new gid from dtm server, or locally if SetLocalGidNode is called.
+// unlike MustGenGid, it returns the error instead of panic, and gives up when ctx is done
+func GenGidCtx(ctx context.Context, server string) (string, error) {
+	if dtmimp.LocalGidNode != "" {
+		return dtmimp.NewLocalGid(), nil
+	}
 	res := map[string]string{}
-	resp, err := dtmimp.RestyClient.R().SetResult(&res).Get(server + "/newGid")
-	if err != nil || res["gid"] == "" {
-		panic(fmt.Errorf("newGid error: %v, resp: %s", err, resp))
+	resp, err := dtmimp.CallDtmServer(ctx, server, true, func(url string) (*resty.Response, error) {
+		return dtmimp.RestyClient.R().SetContext(ctx).Get(url + "/newGid")
+	})
+	if err == nil {
+		err = dtmimp.ParseDtmResp(server, resp, &res)
 	}
-	return res["gid"]
+	if err != nil {
+		return "", fmt.Errorf("newGid error: %w", err)
+	}
+	if res["gid"] == "" {
+		return "", fmt.Errorf("newGid error: no gid in resp: %s", resp)
+	}
+	return res["gid"], nil
+}
+
+// GenGidFromKey generates a gid from a business key, such as an order id. the same key always generates the same gid,
+// so that a retried business request submits the same trans, which is idempotent in dtm server
+func GenGidFromKey(businessKey string) string {
+	return dtmimp.GidFromKey(businessKey)
 }
 
 // DB interface
@@ -29,6 +60,9 @@ type DB = dtmimp.DB
 // TransOptions transaction option
 type TransOptions = dtmimp.TransOptions
 
+// GrpcCodeResult is the result of a grpc branch returning a status code. see TransOptions.GrpcCodeResults
+type GrpcCodeResult = dtmimp.GrpcCodeResult
+
 // DBConf declares db configuration
 type DBConf = dtmimp.DBConf
 
@@ -62,6 +96,26 @@ func GetXaSQLTimeoutMs() int {
 	return dtmimp.XaSQLTimeoutMs
 }
 
+// RetryPolicy the policy to retry the requests to dtm server
+type RetryPolicy = dtmimp.RetryPolicy
+
+// BranchRegisterError the error of registering a branch. see dtmimp.BranchRegisterError
+type BranchRegisterError = dtmimp.BranchRegisterError
+
+// BusyError the error of a new trans refused by a busy dtm server, which can be retried after RetryAfter. see dtmimp.BusyError
+type BusyError = dtmimp.BusyError
+
+// SetDtmRetryPolicy sets the retry policy of the requests to dtm server, for all the http trans
+func SetDtmRetryPolicy(policy RetryPolicy) {
+	dtmimp.DtmRetryPolicy = policy
+}
+
+// SetLocalGidNode let MustGenGid generate gids locally, prefixed by node, so that gid generation does not depend on
+// the availability of dtm server. node should be unique among the apps. "" means calling newGid of dtm server
+func SetLocalGidNode(node string) {
+	dtmimp.LocalGidNode = node
+}
+
 // SetBarrierTableName sets barrier table name
 func SetBarrierTableName(tablename string) {
 	dtmimp.BarrierTableName = tablename
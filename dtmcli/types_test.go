@@ -7,8 +7,14 @@
 package dtmcli
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/stretchr/testify/assert"
@@ -23,6 +29,29 @@ func TestTypes(t *testing.T) {
 	_, err = BarrierFromQuery(url.Values{})
 	assert.Error(t, err)
 
+	SetLocalGidNode("node1")
+	defer SetLocalGidNode("")
+	assert.Regexp(t, "^node1-", MustGenGid("http://localhost:36789/api/no"))
+}
+
+func TestGenGidCtx(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done() // never answers
+	}))
+	defer svr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := GenGidCtx(ctx, svr.URL)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	_, err = GenGidCtx(context.Background(), "http://localhost:36789/api/no")
+	assert.Error(t, err)
+
+	SetLocalGidNode("node1")
+	defer SetLocalGidNode("")
+	gid, err := GenGidCtx(ctx, svr.URL)
+	assert.Nil(t, err)
+	assert.Regexp(t, "^node1-", gid)
 }
 
 func TestXaSqlTimeout(t *testing.T) {
@@ -30,3 +59,33 @@ func TestXaSqlTimeout(t *testing.T) {
 	SetXaSQLTimeoutMs(old)
 	SetBarrierTableName(dtmimp.BarrierTableName) // just cover this func
 }
+
+func TestBranchContext(t *testing.T) {
+	now := time.Now()
+	header := http.Header{}
+	header.Set(DeadlineHeader, fmt.Sprintf("%d", now.Add(2*time.Second).UnixNano()/int64(time.Millisecond)))
+	ctx, cancel := BranchContext(context.Background(), header)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, now.Add(2*time.Second), deadline, 10*time.Millisecond)
+
+	header.Set(DeadlineHeader, fmt.Sprintf("%d", now.Add(-time.Second).UnixNano()/int64(time.Millisecond))) // clock skew
+	ctx, cancel = BranchContext(context.Background(), header)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	assert.False(t, deadline.Before(now.Add(DeadlineMinLeft)))
+
+	grpcCtx, grpcCancel := context.WithTimeout(context.Background(), time.Second) // the deadline of a grpc request
+	defer grpcCancel()
+	ctx, cancel = BranchContext(grpcCtx, nil)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	assert.WithinDuration(t, now.Add(time.Second), deadline, 10*time.Millisecond)
+
+	header.Set(DeadlineHeader, "bad")
+	ctx, cancel = BranchContext(context.Background(), header)
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
@@ -7,6 +7,7 @@
 package dtmcli
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
@@ -24,6 +25,15 @@ type XaLocalFunc func(db *sql.DB, xa *Xa) error
 // XaRegisterCallback type of xa register callback handler
 type XaRegisterCallback func(path string, xa *XaClient)
 
+// Xid the identifier of a xa branch in the db
+type Xid = dtmimp.Xid
+
+// XidFormatter builds the xids of xa branches, and parses them back in recovery. set it to XaClient.XidFormatter
+type XidFormatter = dtmimp.XidFormatter
+
+// DefaultXidFormatter builds the xid gid-branchID
+type DefaultXidFormatter = dtmimp.DefaultXidFormatter
+
 // XaClient xa client
 type XaClient struct {
 	dtmimp.XaClientBase
@@ -63,6 +73,14 @@ func (xc *XaClient) HandleCallback(gid string, branchID string, action string) i
 	return xc.XaClientBase.HandleCallback(gid, branchID, action)
 }
 
+// StartRecover starts to recover orphaned prepared xa transactions periodically if RecoverEnable,
+// according to the status of global transactions queried from dtm server
+func (xc *XaClient) StartRecover() {
+	xc.XaClientBase.StartRecover(func(gid string) (string, error) {
+		return dtmimp.QueryTransStatus(xc.Server, gid)
+	})
+}
+
 // XaLocalTransaction start a xa local transaction
 func (xc *XaClient) XaLocalTransaction(qs url.Values, xaFunc XaLocalFunc) error {
 	xa, err := XaFromQuery(qs)
@@ -88,7 +106,13 @@ func (xc *XaClient) XaGlobalTransaction(gid string, xaFunc XaGlobalFunc) (rerr e
 
 // XaGlobalTransaction2 start a xa global transaction
 func (xc *XaClient) XaGlobalTransaction2(gid string, custom func(*Xa), xaFunc XaGlobalFunc) (rerr error) {
+	return xc.XaGlobalTransactionCtx(context.Background(), gid, custom, xaFunc)
+}
+
+// XaGlobalTransactionCtx the same as XaGlobalTransaction2, but the requests to dtm server and branches are bound to ctx
+func (xc *XaClient) XaGlobalTransactionCtx(ctx context.Context, gid string, custom func(*Xa), xaFunc XaGlobalFunc) (rerr error) {
 	xa := &Xa{TransBase: *dtmimp.NewTransBase(gid, "xa", xc.XaClientBase.Server, "")}
+	xa.Context = ctx
 	custom(xa)
 	return xc.HandleGlobalTrans(&xa.TransBase, func(action string) error {
 		return dtmimp.TransCallDtm(&xa.TransBase, xa, action)
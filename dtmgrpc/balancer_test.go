@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmgrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+type gidServer struct {
+	dtmgpb.UnimplementedDtmServer
+	name string
+}
+
+func (s *gidServer) NewGid(ctx context.Context, in *emptypb.Empty) (*dtmgpb.DtmGidReply, error) {
+	return &dtmgpb.DtmGidReply{Gid: s.name}, nil
+}
+
+func startGidServer(t *testing.T, name string) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	dtmgpb.RegisterDtmServer(s, &gidServer{name: name})
+	go s.Serve(lis)
+	return s, lis.Addr().String()
+}
+
+func TestBalancedFailover(t *testing.T) {
+	s1, addr1 := startGidServer(t, "s1")
+	s2, addr2 := startGidServer(t, "s2")
+	defer s2.Stop()
+	server := fmt.Sprintf("%s,%s", addr1, addr2)
+
+	served := map[string]int{}
+	for i := 0; i < 20 && len(served) < 2; i++ {
+		gid, err := GenGidCtx(context.Background(), server)
+		assert.Nil(t, err)
+		served[gid]++
+		time.Sleep(10 * time.Millisecond) // both subconns get ready
+	}
+	assert.Len(t, served, 2) // round robin
+
+	s1.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for { // the requests during the failover may fail
+		gid, err := GenGidCtx(context.Background(), server)
+		if err == nil && gid == "s2" || time.Now().After(deadline) {
+			break
+		}
+	}
+	for i := 0; i < 10; i++ {
+		gid, err := GenGidCtx(context.Background(), server)
+		assert.Nil(t, err)
+		assert.Equal(t, "s2", gid)
+	}
+}
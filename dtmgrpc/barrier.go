@@ -8,9 +8,12 @@ package dtmgrpc
 
 import (
 	"context"
+	"database/sql"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
+	grpc "google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 // BarrierFromGrpc generate a Barrier from grpc context
@@ -18,3 +21,44 @@ func BarrierFromGrpc(ctx context.Context) (*dtmcli.BranchBarrier, error) {
 	tb := dtmgimp.TransBaseFromGrpc(ctx)
 	return dtmcli.BarrierFrom(tb.TransType, tb.Gid, tb.BranchID, tb.Op)
 }
+
+type barrierTxKey struct{}
+
+// BarrierTxFromGrpc returns the local transaction opened by BarrierInterceptor. nil if the handler is not called in the barrier
+func BarrierTxFromGrpc(ctx context.Context) *sql.Tx {
+	tx, _ := ctx.Value(barrierTxKey{}).(*sql.Tx)
+	return tx
+}
+
+// BarrierInterceptor returns a grpc unary server interceptor, which calls the handlers of the branches in the branch barrier.
+// getDB returns the db of the barrier table. methods are the full methods of the branches, such as /busi.Busi/TransIn.
+// the requests of other methods, and the requests without dtm metadata, are passed through.
+// the handler should do the business in the transaction returned by BarrierTxFromGrpc, which is committed if the handler succeeds.
+// if the handler is skipped by the barrier, an empty reply is returned, which is decoded as the zero value of any reply
+func BarrierInterceptor(getDB func(ctx context.Context) *sql.DB, methods ...string) grpc.UnaryServerInterceptor {
+	branches := map[string]bool{}
+	for _, method := range methods {
+		branches[method] = true
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !branches[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		bb, err := BarrierFromGrpc(ctx)
+		if err != nil { // not called by dtm
+			return handler(ctx, req)
+		}
+		var reply interface{} = &emptypb.Empty{}
+		err = bb.CallWithDBCtx(ctx, getDB(ctx), func(tx *sql.Tx) error {
+			r, err := handler(context.WithValue(ctx, barrierTxKey{}, tx), req)
+			if err == nil {
+				reply = r
+			}
+			return err
+		})
+		if err != nil {
+			return nil, DtmError2GrpcError(err)
+		}
+		return reply, nil
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmgimp
+
+import (
+	"strings"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+)
+
+// listScheme is the scheme of the targets of comma separated addresses, like dtm-list:///host1:36790,host2:36790
+const listScheme = "dtm-list"
+
+func init() {
+	resolver.Register(&listBuilder{})
+}
+
+// listBuilder resolves a comma separated list of addresses
+type listBuilder struct{}
+
+func (b *listBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	addrs := []resolver.Address{}
+	for _, addr := range strings.Split(target.Endpoint, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, resolver.Address{Addr: addr})
+		}
+	}
+	err := cc.UpdateState(resolver.State{Addresses: addrs})
+	return &listResolver{}, err
+}
+
+func (b *listBuilder) Scheme() string { return listScheme }
+
+type listResolver struct{}
+
+func (r *listResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *listResolver) Close() {}
+
+// BalancedDialOptions are used to connect to the grpc servers of a list or a dns:/// target, which are balanced by round robin.
+// the keepalive detects a dead server during a request, and the backoff reconnects to a restarted server in 10s
+var BalancedDialOptions = []grpc.DialOption{
+	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+	grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 20 * time.Second, Timeout: 10 * time.Second}),
+	grpc.WithConnectParams(grpc.ConnectParams{
+		Backoff:           backoff.Config{BaseDelay: time.Second, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 10 * time.Second},
+		MinConnectTimeout: 5 * time.Second,
+	}),
+}
+
+// balancedTarget returns the target to dial and whether it is balanced. a comma separated list is converted to a
+// dtm-list target
+func balancedTarget(grpcServer string) (string, bool) {
+	if strings.Contains(grpcServer, ",") {
+		return listScheme + ":///" + grpcServer, true
+	}
+	return grpcServer, strings.HasPrefix(grpcServer, "dns:///") || strings.HasPrefix(grpcServer, listScheme+":///")
+}
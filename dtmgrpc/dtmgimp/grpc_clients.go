@@ -37,12 +37,16 @@ var normalClients, rawClients sync.Map
 // ClientInterceptors declares grpc.UnaryClientInterceptors slice
 var ClientInterceptors = []grpc.UnaryClientInterceptor{}
 
+// DialOptions declares extra grpc.DialOption slice used when connecting to grpc servers
+var DialOptions = []grpc.DialOption{}
+
 // MustGetDtmClient 1
 func MustGetDtmClient(grpcServer string) dtmgpb.DtmClient {
 	return dtmgpb.NewDtmClient(MustGetGrpcConn(grpcServer, false))
 }
 
-// GetGrpcConn 1
+// GetGrpcConn returns the cached conn of the grpc server. grpcServer may be a comma separated list of addresses or a
+// dns:/// target, then the requests are balanced across the servers by round robin
 func GetGrpcConn(grpcServer string, isRaw bool) (conn *grpc.ClientConn, rerr error) {
 	clients := &normalClients
 	if isRaw {
@@ -58,7 +62,13 @@ func GetGrpcConn(grpcServer string, isRaw bool) (conn *grpc.ClientConn, rerr err
 		logger.Debugf("grpc client connecting %s", grpcServer)
 		interceptors := append(ClientInterceptors, GrpcClientLog)
 		inOpt := grpc.WithChainUnaryInterceptor(interceptors...)
-		conn, rerr := grpc.Dial(grpcServer, inOpt, grpc.WithInsecure(), opts)
+		dialOpts := []grpc.DialOption{inOpt, grpc.WithInsecure(), opts}
+		target, balanced := balancedTarget(grpcServer)
+		if balanced {
+			dialOpts = append(dialOpts, BalancedDialOptions...)
+		}
+		dialOpts = append(dialOpts, DialOptions...)
+		conn, rerr := grpc.Dial(target, dialOpts...)
 		if rerr == nil {
 			clients.Store(grpcServer, conn)
 			v = conn
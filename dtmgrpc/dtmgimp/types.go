@@ -37,15 +37,15 @@ func GrpcServerLog(ctx context.Context, req interface{}, info *grpc.UnaryServerI
 
 // GrpcClientLog 打印grpc调用的日志
 func GrpcClientLog(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-	logger.Debugf("grpc client calling: %s%s %v", cc.Target(), method, dtmimp.MustMarshalString(req))
+	logger.Ctx(ctx).Debugf("grpc client calling: %s%s %v", cc.Target(), method, dtmimp.MustMarshalString(req))
 	LogDtmCtx(ctx)
 	err := invoker(ctx, method, req, reply, cc, opts...)
 	res := fmt.Sprintf("grpc client called: %s%s %s result: %s err: %v",
 		cc.Target(), method, dtmimp.MustMarshalString(req), dtmimp.MustMarshalString(reply), err)
 	if err != nil {
-		logger.Errorf("%s", res)
+		logger.Ctx(ctx).Errorf("%s", res)
 	} else {
-		logger.Debugf("%s", res)
+		logger.Ctx(ctx).Debugf("%s", res)
 	}
 	return err
 }
@@ -56,7 +56,14 @@ func InvokeBranch(t *dtmimp.TransBase, isRaw bool, msg proto.Message, url string
 	if err != nil {
 		return err
 	}
-	ctx := TransInfo2Ctx(t.Gid, t.TransType, branchID, op, t.Dtm)
+	// the outgoing metadata of the context is propagated, and the trans info overrides the same keys
+	md, _ := metadata.FromOutgoingContext(t.GetContext())
+	md = md.Copy()
+	tmd, _ := metadata.FromOutgoingContext(TransInfo2Ctx(t.Gid, t.TransType, branchID, op, t.Dtm))
+	for k, v := range tmd {
+		md[k] = v
+	}
+	ctx := metadata.NewOutgoingContext(t.GetContext(), md)
 	ctx = metadata.AppendToOutgoingContext(ctx, Map2Kvs(t.BranchHeaders)...)
 	return MustGetGrpcConn(server, isRaw).Invoke(ctx, method, msg, reply)
 }
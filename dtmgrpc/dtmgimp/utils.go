@@ -8,11 +8,15 @@ package dtmgimp
 
 import (
 	context "context"
+	"strconv"
+	"strings"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgpb"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
@@ -27,7 +31,24 @@ func MustProtoMarshal(msg proto.Message) []byte {
 // DtmGrpcCall make a convenient call to dtm
 func DtmGrpcCall(s *dtmimp.TransBase, operation string) error {
 	reply := emptypb.Empty{}
-	return MustGetGrpcConn(s.Dtm, false).Invoke(context.Background(), "/dtmgimp.Dtm/"+operation, &dtmgpb.DtmRequest{
+	ctx := callerContext(s)
+	if s.Tenant != "" { // DtmTransOptions has no tenant, so it is sent in metadata
+		ctx = metadata.AppendToOutgoingContext(ctx, dtmpre+"tenant", s.Tenant)
+	}
+	if s.TryTimeout > 0 { // neither has DtmTransOptions a try timeout
+		ctx = metadata.AppendToOutgoingContext(ctx, dtmpre+"try_timeout", strconv.FormatInt(s.TryTimeout, 10))
+	}
+	if s.Priority != 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, dtmpre+"priority", strconv.Itoa(s.Priority))
+	}
+	if len(s.GrpcCodeResults) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, dtmpre+"grpc_code_results", dtmimp.MustMarshalString(s.GrpcCodeResults))
+	}
+	if len(s.QueryPreparedURLs) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, dtmpre+"query_prepared_urls", strings.Join(s.QueryPreparedURLs, ","),
+			dtmpre+"query_prepared_quorum", strconv.Itoa(s.QueryPreparedQuorum))
+	}
+	return MustGetGrpcConn(s.Dtm, false).Invoke(ctx, "/dtmgimp.Dtm/"+operation, &dtmgpb.DtmRequest{
 		Gid:       s.Gid,
 		TransType: s.TransType,
 		TransOptions: &dtmgpb.DtmTransOptions{
@@ -45,8 +66,38 @@ func DtmGrpcCall(s *dtmimp.TransBase, operation string) error {
 	}, &reply)
 }
 
+// RegisterBranch registers the branch to dtm server. it is retried by TransOptions.RegisterRetry if dtm server is unavailable,
+// because the same branch registered again is accepted. *dtmimp.BranchRegisterError is returned if it fails
+func RegisterBranch(s *dtmimp.TransBase, req *dtmgpb.DtmBranchRequest) error {
+	ctx := callerContext(s)
+	for attempt := 1; ; attempt++ {
+		_, err := MustGetDtmClient(s.Dtm).RegisterBranch(ctx, req)
+		if err == nil {
+			return nil
+		}
+		code := status.Code(err)
+		unknown := code == codes.Unavailable || code == codes.DeadlineExceeded || code == codes.Canceled ||
+			code == codes.Unknown || code == codes.Internal
+		if (code == codes.Unavailable || code == codes.DeadlineExceeded) && ctx.Err() == nil && attempt < s.RegisterRetry.MaxAttempts {
+			logger.Infof("register branch %s of %s failed, will retry. attempt: %d err: %v", req.BranchID, req.Gid, attempt, err)
+			if s.RegisterRetry.Wait(ctx, attempt) {
+				continue
+			}
+		}
+		return &dtmimp.BranchRegisterError{BranchID: req.BranchID, Unknown: unknown, Err: err}
+	}
+}
+
 const dtmpre string = "dtm-"
 
+// callerContext returns the context of the requests to dtm server, with the metadata of CallerToken if specified
+func callerContext(s *dtmimp.TransBase) context.Context {
+	if s.CallerToken == "" {
+		return s.GetContext()
+	}
+	return metadata.AppendToOutgoingContext(s.GetContext(), dtmimp.CallerTokenHeader, s.CallerToken)
+}
+
 // TransInfo2Ctx add trans info to grpc context
 func TransInfo2Ctx(gid, transType, branchID, op, dtm string) context.Context {
 	md := metadata.Pairs(
@@ -7,8 +7,10 @@
 package dtmgrpc
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
@@ -33,24 +35,88 @@ func (s *MsgGrpc) Add(action string, msg proto.Message) *MsgGrpc {
 	return s
 }
 
+// AddTopic add a new step, the msg will be delivered to all the subscribers of the topic
+func (s *MsgGrpc) AddTopic(topic string, msg proto.Message) *MsgGrpc {
+	return s.Add(dtmimp.MsgTopicPrefix+topic, msg)
+}
+
+// SetBranchRequestTimeout specify the request timeout in seconds to call the branch
+func (s *MsgGrpc) SetBranchRequestTimeout(branch int, timeout int64) *MsgGrpc {
+	s.Msg.SetBranchRequestTimeout(branch, timeout)
+	return s
+}
+
+// SetBranchRetryInterval specify the retry interval in seconds of the branch. see dtmcli.Saga.SetBranchRetryInterval
+func (s *MsgGrpc) SetBranchRetryInterval(branch int, interval int64) *MsgGrpc {
+	s.Msg.SetBranchRetryInterval(branch, interval)
+	return s
+}
+
+// SetBranchHeaders specify the metadata sent to the branch. see dtmcli.Saga.SetBranchHeaders
+func (s *MsgGrpc) SetBranchHeaders(branch int, headers map[string]string) *MsgGrpc {
+	s.Msg.SetBranchHeaders(branch, headers)
+	return s
+}
+
+// SetBranchDelay delay call the branch, unit second. other branches are not affected
+func (s *MsgGrpc) SetBranchDelay(branch int, delay uint64) *MsgGrpc {
+	s.Msg.SetBranchDelay(branch, delay)
+	return s
+}
+
+// SetQueryPreparedTargets specify several urls to query the prepared msg. see dtmcli.Msg.SetQueryPreparedTargets
+func (s *MsgGrpc) SetQueryPreparedTargets(quorum int, targets ...string) *MsgGrpc {
+	s.Msg.SetQueryPreparedTargets(quorum, targets...)
+	return s
+}
+
 // SetDelay delay call branch, unit second
 func (s *MsgGrpc) SetDelay(delay uint64) *MsgGrpc {
 	s.Msg.SetDelay(delay)
 	return s
 }
 
-// Prepare prepare the msg, msg will later be submitted
+// Prepare prepare the msg, msg will later be submitted. queryPrepared is a grpc url, or an http(s) url, such as
+// http://localhost:8081/api/busi/QueryPrepared
 func (s *MsgGrpc) Prepare(queryPrepared string) error {
 	s.QueryPrepared = dtmimp.OrString(queryPrepared, s.QueryPrepared)
+	if err := dtmimp.CheckQueryPrepared(true, append([]string{s.QueryPrepared}, s.QueryPreparedURLs...)...); err != nil {
+		return err
+	}
 	return dtmgimp.DtmGrpcCall(&s.TransBase, "Prepare")
 }
 
+// PrepareCtx the same as Prepare, but the request is bound to ctx
+func (s *MsgGrpc) PrepareCtx(ctx context.Context, queryPrepared string) error {
+	s.Context = ctx
+	return s.Prepare(queryPrepared)
+}
+
 // Submit submit the msg
 func (s *MsgGrpc) Submit() error {
 	s.Msg.BuildCustomOptions()
 	return dtmgimp.DtmGrpcCall(&s.TransBase, "Submit")
 }
 
+// SubmitCtx the same as Submit, but the request is bound to ctx
+func (s *MsgGrpc) SubmitCtx(ctx context.Context) error {
+	s.Context = ctx
+	return s.Submit()
+}
+
+// DoAndSubmitDBCtx the same as DoAndSubmitDB, but the requests and the local transaction are bound to ctx
+func (s *MsgGrpc) DoAndSubmitDBCtx(ctx context.Context, queryPrepared string, db *sql.DB, busiCall dtmcli.BarrierBusiFunc) error {
+	return s.DoAndSubmitCtx(ctx, queryPrepared, func(bb *dtmcli.BranchBarrier) error {
+		return bb.CallWithDBCtx(ctx, db, busiCall)
+	})
+}
+
+// DoAndSubmitCtx the same as DoAndSubmit, but the requests are bound to ctx
+func (s *MsgGrpc) DoAndSubmitCtx(ctx context.Context, queryPrepared string, busiCall func(bb *dtmcli.BranchBarrier) error) error {
+	s.Context = ctx
+	return s.DoAndSubmit(queryPrepared, busiCall)
+}
+
 // DoAndSubmitDB short method for Do on db type. please see DoAndSubmit
 func (s *MsgGrpc) DoAndSubmitDB(queryPrepared string, db *sql.DB, busiCall dtmcli.BarrierBusiFunc) error {
 	return s.DoAndSubmit(queryPrepared, func(bb *dtmcli.BranchBarrier) error {
@@ -69,11 +135,15 @@ func (s *MsgGrpc) DoAndSubmit(queryPrepared string, busiCall func(bb *dtmcli.Bra
 	}
 	if err == nil {
 		errb := busiCall(bb)
-		if errb != nil && !errors.Is(errb, dtmcli.ErrFailure) {
-			err = dtmgimp.InvokeBranch(&s.TransBase, true, nil, queryPrepared, &[]byte{}, bb.BranchID, bb.Op)
-			err = GrpcError2DtmError(err)
+		if errb != nil && !errors.Is(errb, dtmcli.ErrFailure) && dtmimp.IsHTTPURL(s.QueryPrepared) {
+			_, err = dtmimp.TransRequestBranch(&s.TransBase, "GET", nil, bb.BranchID, bb.Op, s.QueryPrepared)
+		} else if errb != nil && !errors.Is(errb, dtmcli.ErrFailure) {
+			url := strings.TrimPrefix(s.QueryPrepared, dtmimp.GrpcURLPrefix)
+			err = dtmgimp.InvokeBranch(&s.TransBase, true, nil, url, &[]byte{}, bb.BranchID, bb.Op)
+			err = GrpcError2DtmErrorWith(err, s.GrpcCodeResults)
 		}
 		if errors.Is(errb, dtmcli.ErrFailure) || errors.Is(err, dtmcli.ErrFailure) {
+			s.DetachContext()
 			_ = dtmgimp.DtmGrpcCall(&s.TransBase, "Abort")
 		} else if err == nil {
 			err = s.Submit()
@@ -7,6 +7,8 @@
 package dtmgrpc
 
 import (
+	"context"
+
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
 	"google.golang.org/protobuf/proto"
@@ -29,12 +31,68 @@ func (s *SagaGrpc) Add(action string, compensate string, payload proto.Message)
 	return s
 }
 
+// AddWithDeps add a saga step, which is executed after all the steps in deps succeeded. see dtmcli.Saga.AddWithDeps
+func (s *SagaGrpc) AddWithDeps(action string, compensate string, payload proto.Message, deps []int) *SagaGrpc {
+	s.Add(action, compensate, payload)
+	s.Saga.AddBranchOrder(len(s.Steps)-1, deps).SetConcurrent()
+	return s
+}
+
 // AddBranchOrder specify that branch should be after preBranches. branch should is larger than all the element in preBranches
 func (s *SagaGrpc) AddBranchOrder(branch int, preBranches []int) *SagaGrpc {
 	s.Saga.AddBranchOrder(branch, preBranches)
 	return s
 }
 
+// AddInGroup add a saga step to the group. see dtmcli.Saga.SetBranchGroup
+func (s *SagaGrpc) AddInGroup(group string, action string, compensate string, payload proto.Message) *SagaGrpc {
+	s.Add(action, compensate, payload)
+	s.Saga.SetBranchGroup(len(s.Steps)-1, group)
+	return s
+}
+
+// SetBranchGroup put the branch into the group. see dtmcli.Saga.SetBranchGroup
+func (s *SagaGrpc) SetBranchGroup(branch int, group string) *SagaGrpc {
+	s.Saga.SetBranchGroup(branch, group)
+	return s
+}
+
+// AddBranchGroupOrder specify that branch should be after all the branches of the groups
+func (s *SagaGrpc) AddBranchGroupOrder(branch int, groups []string) *SagaGrpc {
+	s.Saga.AddBranchGroupOrder(branch, groups)
+	return s
+}
+
+// SetBranchRequestTimeout specify the request timeout in seconds to call the branch
+func (s *SagaGrpc) SetBranchRequestTimeout(branch int, timeout int64) *SagaGrpc {
+	s.Saga.SetBranchRequestTimeout(branch, timeout)
+	return s
+}
+
+// SetBranchRetryInterval specify the retry interval in seconds of the branch. see dtmcli.Saga.SetBranchRetryInterval
+func (s *SagaGrpc) SetBranchRetryInterval(branch int, interval int64) *SagaGrpc {
+	s.Saga.SetBranchRetryInterval(branch, interval)
+	return s
+}
+
+// SetBranchHeaders specify the metadata sent to the action and the compensation of the branch. see dtmcli.Saga.SetBranchHeaders
+func (s *SagaGrpc) SetBranchHeaders(branch int, headers map[string]string) *SagaGrpc {
+	s.Saga.SetBranchHeaders(branch, headers)
+	return s
+}
+
+// SetCompensatePriority specify the compensation priority of branch. see dtmcli.Saga.SetCompensatePriority
+func (s *SagaGrpc) SetCompensatePriority(branch int, priority int) *SagaGrpc {
+	s.Saga.SetCompensatePriority(branch, priority)
+	return s
+}
+
+// SetMaxParallel limit the number of branches executed at the same time by dtm server. 0 means unlimited
+func (s *SagaGrpc) SetMaxParallel(n int) *SagaGrpc {
+	s.Saga.SetMaxParallel(n)
+	return s
+}
+
 // EnableConcurrent enable the concurrent exec of sub trans
 func (s *SagaGrpc) EnableConcurrent() *SagaGrpc {
 	s.Saga.SetConcurrent()
@@ -46,3 +104,9 @@ func (s *SagaGrpc) Submit() error {
 	s.Saga.BuildCustomOptions()
 	return dtmgimp.DtmGrpcCall(&s.Saga.TransBase, "Submit")
 }
+
+// SubmitCtx the same as Submit, but the request is bound to ctx
+func (s *SagaGrpc) SubmitCtx(ctx context.Context) error {
+	s.Context = ctx
+	return s.Submit()
+}
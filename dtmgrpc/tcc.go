@@ -34,7 +34,14 @@ func TccGlobalTransaction(dtm string, gid string, tccFunc TccGlobalFunc) (rerr e
 
 // TccGlobalTransaction2 new version of TccGlobalTransaction
 func TccGlobalTransaction2(dtm string, gid string, custom func(*TccGrpc), tccFunc TccGlobalFunc) (rerr error) {
+	return TccGlobalTransactionCtx(context.Background(), dtm, gid, custom, tccFunc)
+}
+
+// TccGlobalTransactionCtx the same as TccGlobalTransaction2, but the requests to dtm server and branches are bound to ctx,
+// and the outgoing metadata of ctx is propagated to the branches. if ctx is canceled, dtm server is still notified to abort
+func TccGlobalTransactionCtx(ctx context.Context, dtm string, gid string, custom func(*TccGrpc), tccFunc TccGlobalFunc) (rerr error) {
 	tcc := &TccGrpc{TransBase: *dtmimp.NewTransBase(gid, "tcc", dtm, "")}
+	tcc.Context = ctx
 	custom(tcc)
 	rerr = dtmgimp.DtmGrpcCall(&tcc.TransBase, "Prepare")
 	if rerr != nil {
@@ -44,6 +51,7 @@ func TccGlobalTransaction2(dtm string, gid string, custom func(*TccGrpc), tccFun
 	defer dtmimp.DeferDo(&rerr, func() error {
 		return dtmgimp.DtmGrpcCall(&tcc.TransBase, "Submit")
 	}, func() error {
+		tcc.DetachContext()
 		return dtmgimp.DtmGrpcCall(&tcc.TransBase, "Abort")
 	})
 	return tccFunc(tcc)
@@ -60,17 +68,29 @@ func TccFromGrpc(ctx context.Context) (*TccGrpc, error) {
 	return tcc, nil
 }
 
+// SetConcurrent let dtm server execute the confirm/cancel of branches concurrently. see dtmcli.Tcc.SetConcurrent
+func (t *TccGrpc) SetConcurrent(maxParallel int) *TccGrpc {
+	t.MergeCustomData(map[string]interface{}{"concurrent": true, "max_parallel": maxParallel})
+	return t
+}
+
+// SetTryTimeout let dtm server abort the tcc if it is not submitted in time. see dtmcli.Tcc.SetTryTimeout
+func (t *TccGrpc) SetTryTimeout(seconds int64) *TccGrpc {
+	t.TryTimeout = seconds
+	return t
+}
+
 // CallBranch call a tcc branch
 func (t *TccGrpc) CallBranch(busiMsg proto.Message, tryURL string, confirmURL string, cancelURL string, reply interface{}) error {
 	branchID := t.NewSubBranchID()
 	bd, err := proto.Marshal(busiMsg)
 	if err == nil {
-		_, err = dtmgimp.MustGetDtmClient(t.Dtm).RegisterBranch(context.Background(), &dtmgpb.DtmBranchRequest{
+		err = dtmgimp.RegisterBranch(&t.TransBase, &dtmgpb.DtmBranchRequest{
 			Gid:         t.Gid,
 			TransType:   t.TransType,
 			BranchID:    branchID,
 			BusiPayload: bd,
-			Data:        map[string]string{"confirm": confirmURL, "cancel": cancelURL},
+			Data:        map[string]string{"confirm": confirmURL, "cancel": cancelURL, "parent_branch": t.BranchID},
 		})
 	}
 	if err != nil {
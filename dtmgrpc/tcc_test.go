@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmgrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// flakyServer fails the registrations with the errors in order, and then succeeds
+type flakyServer struct {
+	dtmgpb.UnimplementedDtmServer
+	errs      []error
+	requested int32
+}
+
+func (s *flakyServer) RegisterBranch(ctx context.Context, in *dtmgpb.DtmBranchRequest) (*emptypb.Empty, error) {
+	if n := int(atomic.AddInt32(&s.requested, 1)); n <= len(s.errs) {
+		return nil, s.errs[n-1]
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func TestRegisterBranchRetry(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	fs := &flakyServer{errs: []error{status.Error(codes.Unavailable, "restarting")}}
+	s := grpc.NewServer()
+	dtmgpb.RegisterDtmServer(s, fs)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	tcc := &TccGrpc{TransBase: *dtmimp.NewTransBase("TestRegisterBranchRetry", "tcc", lis.Addr().String(), "")}
+	req := &dtmgpb.DtmBranchRequest{Gid: tcc.Gid, TransType: "tcc", BranchID: "01"}
+	err = dtmgimp.RegisterBranch(&tcc.TransBase, req)
+	var rerr *dtmcli.BranchRegisterError
+	assert.True(t, errors.As(err, &rerr)) // not retried by default
+	assert.True(t, rerr.Unknown)
+
+	atomic.StoreInt32(&fs.requested, 0)
+	tcc.RegisterRetry = dtmcli.RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	assert.Nil(t, dtmgimp.RegisterBranch(&tcc.TransBase, req))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fs.requested))
+
+	atomic.StoreInt32(&fs.requested, 0)
+	fs.errs = []error{status.Error(codes.Aborted, "FAILURE")} // definitely failed, not retried
+	err = dtmgimp.RegisterBranch(&tcc.TransBase, req)
+	assert.True(t, errors.As(err, &rerr))
+	assert.False(t, rerr.Unknown)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fs.requested))
+}
@@ -8,10 +8,13 @@ package dtmgrpc
 
 import (
 	context "context"
+	"errors"
+	"fmt"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgpb"
 	"github.com/dtm-labs/dtmdriver"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -22,35 +25,152 @@ import (
 // DtmError2GrpcError translate dtm error to grpc error
 func DtmError2GrpcError(res interface{}) error {
 	e, ok := res.(error)
-	if ok && e == dtmimp.ErrFailure {
-		return status.New(codes.Aborted, dtmcli.ResultFailure).Err()
-	} else if ok && e == dtmimp.ErrOngoing {
-		return status.New(codes.FailedPrecondition, dtmcli.ResultOngoing).Err()
+	if ok && errors.Is(e, dtmimp.ErrFailure) {
+		return status.New(codes.Aborted, e.Error()).Err()
+	} else if ok && errors.Is(e, dtmimp.ErrOngoing) {
+		return status.New(codes.FailedPrecondition, e.Error()).Err()
+	} else if ok && errors.Is(e, dtmimp.ErrInvalidArgument) {
+		return status.New(codes.InvalidArgument, e.Error()).Err()
+	} else if ok && errors.Is(e, dtmimp.ErrReadOnly) {
+		return status.New(codes.Unavailable, e.Error()).Err()
+	} else if ok && errors.Is(e, dtmimp.ErrBusy) {
+		return status.New(codes.ResourceExhausted, e.Error()).Err()
+	} else if ok && errors.Is(e, dtmimp.ErrGidNotOwned) {
+		return status.New(codes.PermissionDenied, e.Error()).Err()
 	}
 	return e
 }
 
-// GrpcError2DtmError translate grpc error to dtm error
+// GrpcError2DtmError translate grpc error to dtm error. the status error can be wrapped
 func GrpcError2DtmError(err error) error {
-	st, ok := status.FromError(err)
+	st, ok := grpcStatus(err)
 	if ok && st.Code() == codes.Aborted {
 		// version lower then v1.10, will specify Ongoing in code Aborted
 		if st.Message() == dtmcli.ResultOngoing {
 			return dtmcli.ErrOngoing
 		}
-		return dtmcli.ErrFailure
+		return grpcStatusError(st.Message(), dtmcli.ErrFailure)
 	} else if ok && st.Code() == codes.FailedPrecondition {
-		return dtmcli.ErrOngoing
+		return grpcStatusError(st.Message(), dtmcli.ErrOngoing)
+	} else if ok && st.Code() == codes.InvalidArgument {
+		return grpcStatusError(st.Message(), dtmcli.ErrInvalidArgument)
 	}
 	return err
 }
 
+// GrpcError2DtmErrorWith the same as GrpcError2DtmError, but the codes in results are interpreted as configured.
+// results is keyed by the names of the codes, such as FailedPrecondition
+func GrpcError2DtmErrorWith(err error, results map[string]dtmcli.GrpcCodeResult) error {
+	st, ok := grpcStatus(err)
+	if err == nil || !ok {
+		return err
+	}
+	r, found := results[st.Code().String()]
+	if !found {
+		return GrpcError2DtmError(err)
+	}
+	switch r.Result {
+	case dtmcli.ResultSuccess:
+		return nil
+	case dtmcli.ResultFailure:
+		return grpcStatusError(st.Message(), dtmcli.ErrFailure)
+	case dtmcli.ResultOngoing:
+		if r.Delay > 0 {
+			return &OngoingDelayError{Message: st.Message(), Delay: r.Delay}
+		}
+		return grpcStatusError(st.Message(), dtmcli.ErrOngoing)
+	}
+	return err
+}
+
+// CheckGrpcCodeResults checks the names of the codes and the results
+func CheckGrpcCodeResults(results map[string]dtmcli.GrpcCodeResult) error {
+	for name, r := range results {
+		if _, ok := grpcCodes[name]; !ok {
+			return fmt.Errorf("unknown grpc code %s. %w", name, dtmcli.ErrInvalidArgument)
+		}
+		if r.Result != dtmcli.ResultSuccess && r.Result != dtmcli.ResultFailure && r.Result != dtmcli.ResultOngoing {
+			return fmt.Errorf("result %s of grpc code %s should be SUCCESS, FAILURE or ONGOING. %w", r.Result, name, dtmcli.ErrInvalidArgument)
+		}
+		if r.Delay < 0 || r.Delay > 0 && r.Result != dtmcli.ResultOngoing {
+			return fmt.Errorf("delay %d of grpc code %s should be positive and only for ONGOING. %w", r.Delay, name, dtmcli.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+var grpcCodes = func() map[string]codes.Code {
+	m := map[string]codes.Code{}
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		m[c.String()] = c
+	}
+	return m
+}()
+
+// OngoingDelayError is a dtmcli.ErrOngoing with the suggested delay before the branch is retried, for a grpc code
+// interpreted as ONGOING with a delay
+type OngoingDelayError struct {
+	Message string
+	Delay   int64 // in seconds
+}
+
+func (e *OngoingDelayError) Error() string {
+	return fmt.Sprintf("%s, retry after %ds. %s", e.Message, e.Delay, dtmcli.ErrOngoing)
+}
+
+// Unwrap makes errors.Is(err, dtmcli.ErrOngoing) true
+func (e *OngoingDelayError) Unwrap() error {
+	return dtmcli.ErrOngoing
+}
+
+// grpcStatus returns the status of the error, which can be wrapped, such as by fmt.Errorf with %w
+func grpcStatus(err error) (*status.Status, bool) {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus(), true
+	}
+	return status.FromError(err)
+}
+
+// grpcStatusError keeps the message of the error returned by the grpc server
+func grpcStatusError(msg string, sentinel error) error {
+	if msg == sentinel.Error() {
+		return sentinel
+	}
+	return fmt.Errorf("%s. %w", msg, sentinel)
+}
+
 // MustGenGid must gen a gid from grpcServer
 func MustGenGid(grpcServer string) string {
-	dc := dtmgimp.MustGetDtmClient(grpcServer)
-	r, err := dc.NewGid(context.Background(), &emptypb.Empty{})
+	return MustGenGidCtx(context.Background(), grpcServer)
+}
+
+// MustGenGidCtx the same as MustGenGid, but the request is bound to ctx
+func MustGenGidCtx(ctx context.Context, grpcServer string) string {
+	gid, err := GenGidCtx(ctx, grpcServer)
 	dtmimp.E2P(err)
-	return r.Gid
+	return gid
+}
+
+// GenGidCtx generate a new gid from grpcServer, or locally if dtmcli.SetLocalGidNode is called. see dtmcli.GenGidCtx
+func GenGidCtx(ctx context.Context, grpcServer string) (string, error) {
+	if dtmimp.LocalGidNode != "" {
+		return dtmimp.NewLocalGid(), nil
+	}
+	conn, err := dtmgimp.GetGrpcConn(grpcServer, false)
+	if err != nil {
+		return "", err
+	}
+	r, err := dtmgpb.NewDtmClient(conn).NewGid(ctx, &emptypb.Empty{})
+	if err != nil {
+		return "", err
+	}
+	return r.Gid, nil
+}
+
+// GenGidFromKey generates a gid from a business key. see dtmcli.GenGidFromKey
+func GenGidFromKey(businessKey string) string {
+	return dtmimp.GidFromKey(businessKey)
 }
 
 // UseDriver use the specified driver to handle grpc urls
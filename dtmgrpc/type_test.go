@@ -8,9 +8,22 @@ package dtmgrpc
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 func TestType(t *testing.T) {
@@ -22,4 +35,132 @@ func TestType(t *testing.T) {
 
 	err = UseDriver("default")
 	assert.Nil(t, err)
+
+	wrapped := fmt.Errorf("transfer: %w", fmt.Errorf("account 1: %w", fmt.Errorf("insufficient balance. %w", dtmcli.ErrFailure)))
+	err = GrpcError2DtmError(DtmError2GrpcError(wrapped))
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+	assert.Contains(t, err.Error(), "insufficient balance")
+	wrapped = fmt.Errorf("transfer: %w", fmt.Errorf("account 1: %w", fmt.Errorf("locked. %w", dtmcli.ErrOngoing)))
+	err = GrpcError2DtmError(DtmError2GrpcError(wrapped))
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	assert.Equal(t, dtmcli.ErrFailure, GrpcError2DtmError(DtmError2GrpcError(dtmcli.ErrFailure)))
+	assert.Equal(t, codes.Unavailable, status.Code(DtmError2GrpcError(fmt.Errorf("read-only. %w", dtmcli.ErrReadOnly))))
+}
+
+func TestInvokeBranchMetadata(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	mds := make(chan metadata.MD, 1)
+	s := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		mds <- md
+		return nil
+	}))
+	go s.Serve(lis)
+	defer s.Stop()
+
+	tb := dtmimp.NewTransBase("TestInvokeBranchMetadata", "tcc", "localhost:36790", "")
+	tb.Context = metadata.AppendToOutgoingContext(context.Background(), "authorization", "token1", "dtm-gid", "fake")
+	tb.BranchHeaders = map[string]string{"x-branch": "b1"}
+	_ = dtmgimp.InvokeBranch(tb, true, nil, lis.Addr().String()+"/busi.Busi/TransIn", &[]byte{}, "01", "try")
+	md := <-mds
+	assert.Equal(t, []string{"token1"}, md.Get("authorization"))
+	assert.Equal(t, []string{"TestInvokeBranchMetadata"}, md.Get("dtm-gid"))
+	assert.Equal(t, []string{"b1"}, md.Get("x-branch"))
+}
+
+func TestGenGidCtx(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		<-stream.Context().Done() // never answers
+		return nil
+	}))
+	go s.Serve(lis)
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = GenGidCtx(ctx, lis.Addr().String())
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	dtmcli.SetLocalGidNode("node1")
+	defer dtmcli.SetLocalGidNode("")
+	gid, err := GenGidCtx(ctx, lis.Addr().String())
+	assert.Nil(t, err)
+	assert.Regexp(t, "^node1-", gid)
+}
+
+func TestBarrierInterceptorPassThrough(t *testing.T) {
+	interceptor := BarrierInterceptor(func(ctx context.Context) *sql.DB {
+		panic("getDB should not be called")
+	}, "/busi.Busi/TransIn")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Nil(t, BarrierTxFromGrpc(ctx))
+		return "reply", nil
+	}
+	reply, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/busi.Busi/TransIn"}, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, "reply", reply)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("dtm-gid", "gid1", "dtm-trans_type", "saga", "dtm-branch_id", "01", "dtm-op", "action"))
+	reply, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/busi.Busi/TransOut"}, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, "reply", reply)
+}
+
+func TestGrpcError2DtmErrorWith(t *testing.T) {
+	results := map[string]dtmcli.GrpcCodeResult{
+		"FailedPrecondition": {Result: dtmcli.ResultFailure},
+		"ResourceExhausted":  {Result: dtmcli.ResultOngoing, Delay: 30},
+		"Unavailable":        {Result: dtmcli.ResultOngoing},
+		"AlreadyExists":      {Result: dtmcli.ResultSuccess},
+	}
+	withDetails, _ := status.New(codes.ResourceExhausted, "quota").WithDetails(&emptypb.Empty{})
+	raw := errors.New("conn refused")
+	cases := []struct {
+		err     error
+		results map[string]dtmcli.GrpcCodeResult
+		expect  error // nil, the sentinel wrapped by the result, or raw
+		delay   int64
+	}{
+		// the default interpretation
+		{status.Errorf(codes.Aborted, "rejected"), nil, dtmcli.ErrFailure, 0},
+		{status.Errorf(codes.Aborted, dtmcli.ResultOngoing), nil, dtmcli.ErrOngoing, 0},
+		{status.Errorf(codes.FailedPrecondition, "locked"), nil, dtmcli.ErrOngoing, 0},
+		{status.Errorf(codes.InvalidArgument, "bad"), nil, dtmcli.ErrInvalidArgument, 0},
+		{status.Errorf(codes.ResourceExhausted, "quota"), nil, raw, 0},
+		{raw, results, raw, 0},
+		{nil, results, nil, 0},
+		// the configured interpretation
+		{status.Errorf(codes.FailedPrecondition, "rejected"), results, dtmcli.ErrFailure, 0},
+		{status.Errorf(codes.ResourceExhausted, "quota"), results, dtmcli.ErrOngoing, 30},
+		{withDetails.Err(), results, dtmcli.ErrOngoing, 30},
+		{fmt.Errorf("call busi: %w", status.Errorf(codes.ResourceExhausted, "quota")), results, dtmcli.ErrOngoing, 30},
+		{status.Errorf(codes.Unavailable, "restarting"), results, dtmcli.ErrOngoing, 0},
+		{status.Errorf(codes.AlreadyExists, "done"), results, nil, 0},
+		{status.Errorf(codes.Aborted, "rejected"), results, dtmcli.ErrFailure, 0}, // not configured
+	}
+	for i, c := range cases {
+		err := GrpcError2DtmErrorWith(c.err, c.results)
+		if c.expect == nil {
+			assert.Nil(t, err, i)
+		} else if c.expect == raw {
+			assert.Equal(t, c.err, err, i)
+		} else {
+			assert.True(t, errors.Is(err, c.expect), i)
+		}
+		var delayed *OngoingDelayError
+		assert.Equal(t, c.delay > 0, errors.As(err, &delayed), i)
+		if c.delay > 0 {
+			assert.Equal(t, c.delay, delayed.Delay, i)
+		}
+	}
+}
+
+func TestCheckGrpcCodeResults(t *testing.T) {
+	assert.Nil(t, CheckGrpcCodeResults(map[string]dtmcli.GrpcCodeResult{"ResourceExhausted": {Result: dtmcli.ResultOngoing, Delay: 30}}))
+	assert.Error(t, CheckGrpcCodeResults(map[string]dtmcli.GrpcCodeResult{"RESOURCE_EXHAUSTED": {Result: dtmcli.ResultOngoing}}))
+	assert.Error(t, CheckGrpcCodeResults(map[string]dtmcli.GrpcCodeResult{"Aborted": {Result: "ERROR"}}))
+	assert.Error(t, CheckGrpcCodeResults(map[string]dtmcli.GrpcCodeResult{"Aborted": {Result: dtmcli.ResultFailure, Delay: 30}}))
 }
@@ -63,6 +63,14 @@ func (xc *XaGrpcClient) HandleCallback(ctx context.Context) (*emptypb.Empty, err
 	return &emptypb.Empty{}, xc.XaClientBase.HandleCallback(tb.Gid, tb.BranchID, tb.Op)
 }
 
+// StartRecover starts to recover orphaned prepared xa transactions periodically if RecoverEnable.
+// the status of global transactions is queried from the http server of dtm
+func (xc *XaGrpcClient) StartRecover(dtmHTTPServer string) {
+	xc.XaClientBase.StartRecover(func(gid string) (string, error) {
+		return dtmimp.QueryTransStatus(dtmHTTPServer, gid)
+	})
+}
+
 // XaLocalTransaction start a xa local transaction
 func (xc *XaGrpcClient) XaLocalTransaction(ctx context.Context, msg proto.Message, xaFunc XaGrpcLocalFunc) error {
 	xa, err := XaGrpcFromRequest(ctx)
@@ -78,14 +86,13 @@ func (xc *XaGrpcClient) XaLocalTransaction(ctx context.Context, msg proto.Messag
 		if err != nil {
 			return err
 		}
-		_, err = dtmgimp.MustGetDtmClient(xa.Dtm).RegisterBranch(context.Background(), &dtmgpb.DtmBranchRequest{
+		return dtmgimp.RegisterBranch(&xa.TransBase, &dtmgpb.DtmBranchRequest{
 			Gid:         xa.Gid,
 			BranchID:    xa.BranchID,
 			TransType:   xa.TransType,
 			BusiPayload: data,
 			Data:        map[string]string{"url": xc.NotifyURL},
 		})
-		return err
 	})
 }
 
@@ -96,7 +103,13 @@ func (xc *XaGrpcClient) XaGlobalTransaction(gid string, xaFunc XaGrpcGlobalFunc)
 
 // XaGlobalTransaction2 new version of XaGlobalTransaction. support custom
 func (xc *XaGrpcClient) XaGlobalTransaction2(gid string, custom func(*XaGrpc), xaFunc XaGrpcGlobalFunc) error {
+	return xc.XaGlobalTransactionCtx(context.Background(), gid, custom, xaFunc)
+}
+
+// XaGlobalTransactionCtx the same as XaGlobalTransaction2, but the requests to dtm server and branches are bound to ctx
+func (xc *XaGrpcClient) XaGlobalTransactionCtx(ctx context.Context, gid string, custom func(*XaGrpc), xaFunc XaGrpcGlobalFunc) error {
 	xa := &XaGrpc{TransBase: *dtmimp.NewTransBase(gid, "xa", xc.Server, "")}
+	xa.Context = ctx
 	custom(xa)
 	dc := dtmgimp.MustGetDtmClient(xa.Dtm)
 	req := &dtmgpb.DtmRequest{
@@ -109,7 +122,7 @@ func (xc *XaGrpcClient) XaGlobalTransaction2(gid string, custom func(*XaGrpc), x
 			"submit":  dc.Submit,
 			"abort":   dc.Abort,
 		}[action]
-		_, err := f(context.Background(), req)
+		_, err := f(xa.GetContext(), req)
 		return err
 	}, func() error {
 		return xaFunc(xa)
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+)
+
+// accessLogRates are the sample rates of the access logs of apis, parsed from conf.Log.AccessLogSampling
+var accessLogRates = map[string]float64{}
+
+// accessLogSampled returns whether the request of the api is logged. failed requests are always logged
+func accessLogSampled(api string, failed bool) bool {
+	rate, ok := accessLogRates[api]
+	return failed || !ok || rate > 0 && rand.Float64() < rate
+}
+
+// requestGidAPI returns the gid of a http request from the query or the json body, and the api, which is the method
+// of a json-rpc request, or the last segment of the path
+func requestGidAPI(r *http.Request, body []byte) (string, string) {
+	api := extractFromPath(r.URL.Path)
+	gid := r.URL.Query().Get("gid")
+	if len(body) == 0 || body[0] != '{' {
+		return gid, api
+	}
+	req := struct {
+		Gid    string          `json:"gid"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}{}
+	if json.Unmarshal(body, &req) != nil {
+		return gid, api
+	}
+	if req.Method != "" && req.Params != nil { // json-rpc
+		api = strings.ToLower(req.Method)
+		_ = json.Unmarshal(req.Params, &req)
+	}
+	return dtmimp.OrString(gid, req.Gid), api
+}
+
+// httpAccessLog logs every http request with the gid, and puts the gid in the context of the request, so that the
+// logs of the handling carry it
+func httpAccessLog(app *gin.Engine) *gin.Engine {
+	app.Use(func(c *gin.Context) {
+		began := time.Now()
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = ioutil.ReadAll(c.Request.Body)
+			c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		}
+		gid, api := requestGidAPI(c.Request, body)
+		if gid != "" {
+			c.Request = c.Request.WithContext(logger.WithGid(c.Request.Context(), gid))
+		}
+		c.Set(dtmutil.AccessLogged, true)
+		c.Next()
+		status := c.Writer.Status()
+		failed := status >= http.StatusBadRequest && status != http.StatusTooEarly
+		if !accessLogSampled(api, failed) {
+			return
+		}
+		l := logger.Gid(gid)
+		logf := dtmimp.If(failed, l.Errorf, l.Infof).(func(string, ...interface{}))
+		logf("access http %s %s %d %dms", c.Request.Method, c.Request.URL.Path, status, time.Since(began).Milliseconds())
+	})
+	return app
+}
+
+// grpcAccessLog logs every grpc request with the gid, like httpAccessLog
+func grpcAccessLog(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	began := time.Now()
+	gid := ""
+	if r, ok := req.(interface{ GetGid() string }); ok {
+		gid = r.GetGid()
+	}
+	if gid != "" {
+		ctx = logger.WithGid(ctx, gid)
+	}
+	l := logger.Gid(gid)
+	l.Debugf("grpc server handling: %s %s", info.FullMethod, dtmimp.MustMarshalString(req))
+	dtmgimp.LogDtmCtx(ctx)
+	m, err := handler(ctx, req)
+	if accessLogSampled(extractFromPath(info.FullMethod), err != nil) {
+		logf := dtmimp.If(err != nil, l.Errorf, l.Infof).(func(string, ...interface{}))
+		logf("access grpc %s %v %dms", info.FullMethod, err, time.Since(began).Milliseconds())
+	}
+	return m, err
+}
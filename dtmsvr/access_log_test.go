@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgpb"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestAccessLogSampled(t *testing.T) {
+	defer func() { accessLogRates = map[string]float64{} }()
+	accessLogRates = map[string]float64{"newgid": 0, "query": 1}
+	assert.False(t, accessLogSampled("newgid", false))
+	assert.True(t, accessLogSampled("newgid", true))
+	assert.True(t, accessLogSampled("query", false))
+	assert.True(t, accessLogSampled("submit", false))
+}
+
+func TestRequestGidAPI(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/dtmsvr/query?gid=g1", nil)
+	gid, api := requestGidAPI(r, nil)
+	assert.Equal(t, "g1", gid)
+	assert.Equal(t, "query", api)
+
+	r = httptest.NewRequest("POST", "/api/dtmsvr/submit", nil)
+	gid, api = requestGidAPI(r, []byte(`{"gid":"g2","trans_type":"saga"}`))
+	assert.Equal(t, "g2", gid)
+	assert.Equal(t, "submit", api)
+
+	r = httptest.NewRequest("POST", "/api/json-rpc", nil)
+	gid, api = requestGidAPI(r, []byte(`{"jsonrpc":"2.0","method":"abort","params":{"gid":"g3"},"id":"1"}`))
+	assert.Equal(t, "g3", gid)
+	assert.Equal(t, "abort", api)
+
+	gid, _ = requestGidAPI(r, []byte(`not json`))
+	assert.Equal(t, "", gid)
+}
+
+func TestHTTPAccessLog(t *testing.T) {
+	app := httpAccessLog(dtmutil.GetGinApp())
+	gids := []string{}
+	app.POST("/api/dtmsvr/submit", func(c *gin.Context) {
+		gids = append(gids, logger.GidFromContext(c.Request.Context()))
+		assert.True(t, c.GetBool(dtmutil.AccessLogged))
+		c.JSON(http.StatusOK, map[string]interface{}{})
+	})
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("POST", "/api/dtmsvr/submit", strings.NewReader(`{"gid":"g1"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"g1"}, gids)
+}
+
+func TestGrpcAccessLog(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/dtmgimp.Dtm/Submit"}
+	_, err := grpcAccessLog(context.Background(), &dtmgpb.DtmRequest{Gid: "g1"}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Equal(t, "g1", logger.GidFromContext(ctx))
+		return nil, nil
+	})
+	assert.Nil(t, err)
+}
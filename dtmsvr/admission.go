@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+)
+
+// admissionClosed is 1 if the new trans are refused, because the overdue trans probed by probeSchedulingLag reach
+// AdmissionBacklog. it is opened again when the overdue trans drop to 80% of AdmissionBacklog, so that it does not flap
+var admissionClosed int32
+
+func isAdmissionClosed() bool {
+	return atomic.LoadInt32(&admissionClosed) == 1
+}
+
+// updateAdmission closes or opens the admission by the number of the overdue trans
+func updateAdmission(overdue int64) {
+	backlog := conf.AdmissionBacklog
+	if backlog > 0 && overdue >= backlog && atomic.CompareAndSwapInt32(&admissionClosed, 0, 1) {
+		logger.Warnf("admission control active: %d trans overdue, reaching AdmissionBacklog %d. new trans are refused", overdue, backlog)
+	} else if (backlog <= 0 || overdue*5 <= backlog*4) && atomic.CompareAndSwapInt32(&admissionClosed, 1, 0) {
+		logger.Infof("admission control inactive: %d trans overdue. new trans are accepted", overdue)
+	}
+	admissionGauge.Set(float64(atomic.LoadInt32(&admissionClosed)))
+}
+
+// checkAdmission returns a *dtmimp.BusyError if the admission is closed and the trans of gid does not exist. the
+// requests of the existing trans, such as the submit of a prepared tcc, are accepted, since refusing them does not
+// lower the backlog
+func checkAdmission(gid string) error {
+	if !isAdmissionClosed() || gid != "" && GetStore().FindTransGlobalStore(gid) != nil {
+		return nil
+	}
+	return &dtmimp.BusyError{
+		RetryAfter: time.Duration(conf.AdmissionRetryAfter) * time.Second,
+		Ongoing:    conf.AdmissionOngoing == 1,
+		Message:    fmt.Sprintf("the backlog of dtm server reaches %d, new trans are refused", conf.AdmissionBacklog),
+	}
+}
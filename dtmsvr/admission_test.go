@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmission(t *testing.T) {
+	conf.AdmissionBacklog, conf.AdmissionRetryAfter = 100, 10
+	defer func() {
+		conf.AdmissionBacklog = 0
+		updateAdmission(0)
+	}()
+	for _, c := range []struct {
+		overdue int64
+		closed  bool
+	}{{50, false}, {99, false}, {100, true}, {90, true}, {81, true}, {80, false}, {99, false}, {150, true}} {
+		updateAdmission(c.overdue)
+		assert.Equal(t, c.closed, isAdmissionClosed(), c.overdue)
+	}
+
+	err := checkAdmission("")
+	var busy *dtmcli.BusyError
+	assert.True(t, errors.As(err, &busy))
+	assert.Equal(t, 10*time.Second, busy.RetryAfter)
+	assert.False(t, errors.Is(err, dtmcli.ErrOngoing))
+	conf.AdmissionOngoing = 1
+	defer func() { conf.AdmissionOngoing = 0 }()
+	assert.True(t, errors.Is(checkAdmission(""), dtmcli.ErrOngoing))
+
+	conf.AdmissionBacklog = 0 // disabled at runtime
+	updateAdmission(150)
+	assert.Nil(t, checkAdmission(""))
+}
@@ -7,7 +7,11 @@
 package dtmsvr
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
@@ -16,26 +20,150 @@ import (
 )
 
 func svcSubmit(t *TransGlobal) interface{} {
+	if err := checkGid(t.Gid); err != nil {
+		return err
+	}
+	if err := checkClaim(t.caller, t.Gid); err != nil {
+		return err
+	}
+	if err := checkAdmission(t.Gid); err != nil {
+		return err
+	}
 	t.Status = dtmcli.StatusSubmitted
 	branches, err := t.saveNew()
 
-	if err == storage.ErrUniqueConflict {
+	if err != nil && !errors.Is(err, storage.ErrUniqueConflict) {
+		return err
+	} else if err != nil {
+		if err := checkDuplicateTrans(t.Gid, err, branches); err != nil {
+			return err
+		}
 		dbt := GetTransGlobal(t.Gid)
 		if dbt.Status == dtmcli.StatusPrepared {
-			dbt.changeStatus(t.Status)
+			// the trans may be aborted concurrently, such as a tcc timeout, then the submit fails
+			err := dtmimp.CatchP(func() { dbt.changeStatus(t.Status) })
+			var conflict *storage.StatusConflictError
+			if errors.As(err, &conflict) {
+				return fmt.Errorf("current status '%s', cannot submit. %w", conflict.Actual, dtmcli.ErrFailure)
+			} else if err != nil {
+				return err
+			}
 			branches = GetStore().FindBranches(t.Gid)
+		} else if dbt.Status != dtmcli.StatusSubmitted && len(branches) > 0 {
+			// a resubmit with the same branches, such as a retried business request, is idempotent
+			if t.WaitResult && dbt.Status != dtmcli.StatusSucceed {
+				return fmt.Errorf("wait result not return success, current status '%s'. %w", dbt.Status, dtmcli.ErrFailure)
+			}
+			return resubmittedResult(dbt)
 		} else if dbt.Status != dtmcli.StatusSubmitted {
-			return fmt.Errorf("current status '%s', cannot sumbmit. %w", dbt.Status, dtmcli.ErrFailure)
+			return fmt.Errorf("current status '%s', cannot submit. %w", dbt.Status, dtmcli.ErrFailure)
 		}
+		t.Ext.EventSeq = dbt.Ext.EventSeq
 	}
 	return t.Process(branches)
 }
 
+// svcSubmitBatch submits independent msgs, which are saved by one store call. the result of each msg is returned in
+// order, and a rejected msg does not affect the others
+func svcSubmitBatch(ts []*TransGlobal) interface{} {
+	if len(ts) == 0 {
+		return fmt.Errorf("no trans to submit. %w", dtmcli.ErrInvalidArgument)
+	}
+	if limit := int(conf.SubmitBatchLimit); limit > 0 && len(ts) > limit {
+		return fmt.Errorf("%d trans to submit, exceeding the limit %d. %w", len(ts), limit, dtmcli.ErrInvalidArgument)
+	}
+	if err := checkAdmission(""); err != nil {
+		return err
+	}
+	results := make([]dtmcli.MsgBatchResult, len(ts))
+	branches := make([][]TransBranch, len(ts))
+	toSave := []storage.NewTrans{}
+	saving := []int{}
+	for i, t := range ts {
+		results[i].Gid = t.Gid
+		err := checkGid(t.Gid)
+		if err == nil {
+			err = checkClaim(t.caller, t.Gid)
+		}
+		if err == nil && (t.TransType != "msg" || t.WaitResult) {
+			err = fmt.Errorf("only msgs without wait_result can be submitted in batch. %w", dtmcli.ErrInvalidArgument)
+		}
+		if err == nil {
+			t.Status = dtmcli.StatusSubmitted
+			branches[i], err = t.prepareNew()
+		}
+		if err != nil {
+			setBatchResult(&results[i], err)
+			continue
+		}
+		toSave = append(toSave, storage.NewTrans{Global: &t.TransGlobalStore, Branches: branches[i]})
+		saving = append(saving, i)
+	}
+	errs := GetStore().MaySaveNewTransBatch(toSave)
+	for j, i := range saving {
+		t, err := ts[i], errs[j]
+		t.afterSaveNew(branches[i], err)
+		if errors.Is(err, storage.ErrUniqueConflict) {
+			err = submitDuplicated(t, err, branches[i], &results[i])
+		} else if err == nil {
+			err = t.Process(branches[i])
+		}
+		setBatchResult(&results[i], err)
+	}
+	return map[string]interface{}{"dtm_result": dtmcli.ResultSuccess, "results": results}
+}
+
+// submitDuplicated handles a msg in submit_batch whose gid exists, like svcSubmit
+func submitDuplicated(t *TransGlobal, err error, branches []TransBranch, result *dtmcli.MsgBatchResult) (rerr error) {
+	defer dtmimp.P2E(&rerr) // the other msgs of the batch are not affected
+	if err := checkDuplicateTrans(t.Gid, err, branches); err != nil {
+		return err
+	}
+	dbt := GetTransGlobal(t.Gid)
+	result.Duplicated, result.Status = true, dbt.Status
+	if dbt.Status == dtmcli.StatusPrepared { // a prepared msg is submitted
+		dbt.changeStatus(dtmcli.StatusSubmitted)
+		result.Status = dbt.Status
+		return dbt.Process(GetStore().FindBranches(t.Gid))
+	}
+	return nil
+}
+
+func setBatchResult(result *dtmcli.MsgBatchResult, err error) {
+	switch {
+	case err == nil:
+		result.Result = dtmcli.ResultSuccess
+	case errors.Is(err, dtmcli.ErrFailure) || errors.Is(err, dtmcli.ErrInvalidArgument) || errors.Is(err, dtmcli.ErrGidNotOwned):
+		result.Result, result.Message = dtmcli.ResultFailure, err.Error()
+	default:
+		result.Result, result.Message = dtmcli.ResultError, err.Error()
+	}
+}
+
 func svcPrepare(t *TransGlobal) interface{} {
+	if err := checkGid(t.Gid); err != nil {
+		return err
+	}
+	if err := checkClaim(t.caller, t.Gid); err != nil {
+		return err
+	}
+	if err := checkAdmission(t.Gid); err != nil {
+		return err
+	}
+	if t.TryTimeout < 0 || t.TryTimeout > 0 && t.TransType != "tcc" {
+		return fmt.Errorf("try_timeout %d is only for tcc. %w", t.TryTimeout, dtmcli.ErrInvalidArgument)
+	}
+	if err := t.checkQueryPreparedTargets(); err != nil {
+		return err
+	}
 	t.Status = dtmcli.StatusPrepared
-	_, err := t.saveNew()
-	if err == storage.ErrUniqueConflict {
+	branches, err := t.saveNew()
+	if errors.Is(err, storage.ErrUniqueConflict) {
+		if err := checkDuplicateTrans(t.Gid, err, branches); err != nil {
+			return err
+		}
 		dbt := GetTransGlobal(t.Gid)
+		// a prepare after submit is still rejected, because the local transaction following the prepare should not be executed again
 		if dbt.Status != dtmcli.StatusPrepared {
 			return fmt.Errorf("current status '%s', cannot prepare. %w", dbt.Status, dtmcli.ErrFailure)
 		}
@@ -44,8 +172,73 @@ func svcPrepare(t *TransGlobal) interface{} {
 	return err
 }
 
+// checkDuplicateTrans checks that a resubmitted trans is the same as the saved one, by the result of MaySaveNewTrans
+func checkDuplicateTrans(gid string, err error, branches []TransBranch) error {
+	var dup *storage.DuplicateTransError
+	if !errors.As(err, &dup) || dup.Unhashed { // saved by old versions, so compare the branches
+		return checkSameBranches(gid, branches)
+	}
+	if len(dup.Mismatches) > 0 {
+		return errDuplicated("gid %s exists with different %s", gid, strings.Join(dup.Mismatches, ", "))
+	}
+	return nil
+}
+
+// duplicatedError is the error of a gid existing with a different trans. it is FAILURE for v1, and DUPLICATED for v2
+type duplicatedError struct {
+	msg string
+}
+
+func (e *duplicatedError) Error() string {
+	return e.msg
+}
+
+func (e *duplicatedError) Is(target error) bool {
+	return target == dtmcli.ErrFailure || target == dtmcli.ErrDuplicated
+}
+
+func errDuplicated(format string, args ...interface{}) error {
+	return &duplicatedError{fmt.Sprintf(format, args...) + ". " + dtmcli.ErrFailure.Error()}
+}
+
+// checkSameBranches checks that the branches of a resubmitted trans are the same as the saved ones.
+// a trans without branches in the request, such as tcc and xa, is not checked
+func checkSameBranches(gid string, branches []TransBranch) error {
+	if len(branches) == 0 {
+		return nil
+	}
+	saved := map[string]*TransBranch{}
+	savedBranches := GetStore().FindBranches(gid)
+	for i := range savedBranches {
+		saved[savedBranches[i].BranchID+"-"+savedBranches[i].Op] = &savedBranches[i]
+	}
+	if len(saved) != len(branches) {
+		return errDuplicated("gid %s exists with %d branches, but %d branches are submitted", gid, len(saved), len(branches))
+	}
+	for _, b := range branches {
+		s := saved[b.BranchID+"-"+b.Op]
+		if s == nil {
+			return errDuplicated("gid %s exists without branch %s %s", gid, b.BranchID, b.Op)
+		} else if s.URL != b.URL {
+			return errDuplicated("gid %s exists with a different url of branch %s %s: %s", gid, b.BranchID, b.Op, s.URL)
+		} else if !bytes.Equal(s.BinData, b.BinData) {
+			return errDuplicated("gid %s exists with a different payload of branch %s %s", gid, b.BranchID, b.Op)
+		}
+	}
+	return nil
+}
+
+// resubmittedResult returns the current status of a trans resubmitted with the same branches
+func resubmittedResult(dbt *TransGlobal) interface{} {
+	return map[string]interface{}{"dtm_result": dtmcli.ResultSuccess, "status": dbt.Status}
+}
+
 func svcAbort(t *TransGlobal) interface{} {
+	if err := checkClaim(t.caller, t.Gid); err != nil {
+		return err
+	}
 	dbt := GetTransGlobal(t.Gid)
+	dbt.RollbackReason = "aborted by client"
 	if dbt.TransType == "msg" && dbt.Status == dtmcli.StatusPrepared {
 		dbt.changeStatus(dtmcli.StatusFailed)
 		return nil
@@ -58,9 +251,74 @@ func svcAbort(t *TransGlobal) interface{} {
 	return dbt.Process(branches)
 }
 
-func svcRegisterBranch(transType string, branch *TransBranch, data map[string]string) error {
+// svcUpdateCustomData updates the custom data of an unfinished trans. the last update wins
+func svcUpdateCustomData(gid string, data string) error {
+	if limit := int(conf.CustomDataLimit); limit > 0 && len(data) > limit {
+		return fmt.Errorf("custom data is %d bytes, exceeding the limit %d bytes. %w", len(data), limit, dtmcli.ErrInvalidArgument)
+	}
+	var err error
+	var vconflict *storage.VersionConflictError
+	for i := 0; i == 0 || errors.As(err, &vconflict) && i <= versionConflictRetries; i++ { // re-read if changed by others
+		global := GetStore().FindTransGlobalStore(gid)
+		if global == nil {
+			return fmt.Errorf("trans %s not found. %w", gid, dtmcli.ErrInvalidArgument)
+		}
+		if err := checkCustomOptions(global.TransType, global.CustomData, data); err != nil {
+			return err
+		}
+		err = GetStore().UpdateGlobalCustomData(global, data)
+	}
+	var conflict *storage.StatusConflictError
+	if errors.As(err, &conflict) {
+		return fmt.Errorf("trans %s is %s, the custom data can not be updated. %w", gid, conflict.Actual, dtmcli.ErrFailure)
+	} else if err != nil {
+		return err
+	}
+	logger.Gid(gid).Infof("UpdateGlobalCustomData ok: gid: %s", gid)
+	notifyWatchers(gid, changeCustomData)
+	return nil
+}
+
+// checkCustomOptions checks that the options of saga, tcc and msg parsed from the custom data are not changed by the update,
+// because they are parsed again in each process
+func checkCustomOptions(transType string, old string, data string) error {
+	var newOptions func() interface{}
+	switch transType {
+	case "saga":
+		newOptions = func() interface{} { return &cSagaCustom{} }
+	case "tcc":
+		newOptions = func() interface{} { return &cTccCustom{} }
+	case "msg":
+		newOptions = func() interface{} { return &cMsgCustom{} }
+	default:
+		return nil
+	}
+	parse := func(d string) string {
+		options := newOptions()
+		if d != "" {
+			dtmimp.MustUnmarshalString(d, options)
+		}
+		return dtmimp.MustMarshalString(options)
+	}
+	oldOptions, updated := parse(old), ""
+	if err := dtmimp.CatchP(func() { updated = parse(data) }); err != nil {
+		return fmt.Errorf("custom data of %s should be a json object: %v. %w", transType, err, dtmcli.ErrInvalidArgument)
+	}
+	if updated != oldOptions {
+		return fmt.Errorf("the options of %s in custom data can not be changed, expected %s. %w", transType, oldOptions, dtmcli.ErrInvalidArgument)
+	}
+	return nil
+}
+
+func svcRegisterBranch(protocol string, transType string, branch *TransBranch, data map[string]string) error {
+	if err := checkGid(branch.Gid); err != nil {
+		return err
+	}
 	branches := []TransBranch{*branch, *branch}
 	if transType == "tcc" {
+		if parent := data["parent_branch"]; parent != "" && (!strings.HasPrefix(branch.BranchID, parent) || branch.BranchID == parent) {
+			return fmt.Errorf("branch id %s should be prefixed by its parent branch %s. %w", branch.BranchID, parent, dtmcli.ErrFailure)
+		}
 		for i, b := range []string{dtmcli.BranchCancel, dtmcli.BranchConfirm} {
 			branches[i].Op = b
 			branches[i].URL = data[b]
@@ -73,16 +331,128 @@ func svcRegisterBranch(transType string, branch *TransBranch, data map[string]st
 	} else {
 		return fmt.Errorf("unknow trans type: %s", transType)
 	}
+	if err := checkBranchHeaders(data); err != nil {
+		return err
+	}
+	ext, err := branchExtFromMap(data)
+	if err != nil {
+		return err
+	}
+	for i := range branches {
+		branches[i].Ext = ext
+	}
+	if _, err := getHTTPClient(ext.HTTPProfile); err != nil {
+		return err
+	}
+	if err := checkBrokerURLs(transType, branches); err != nil {
+		return err
+	}
+	if err := checkBranchProtocols(protocol, branches); err != nil {
+		return err
+	}
+	if err := checkPayloadsInQuery(branches); err != nil {
+		return err
+	}
+	marshalBranchesExt(branches)
+	cacheKey := branchResultKey(&branches[1], dtmcli.StatusPrepared, dtmimp.MustMarshal(branches))
+	if branchResults.seen(cacheKey) {
+		branchResultDedupedTotal.WithLabelValues(transType, "registerBranch").Inc()
+		logger.Gid(branch.Gid).Infof("branch %s of %s is registered recently, the registration is acknowledged by the cache", branch.BranchID, branch.Gid)
+		return nil
+	}
 
-	err := dtmimp.CatchP(func() {
-		GetStore().LockGlobalSaveBranches(branch.Gid, dtmcli.StatusPrepared, branches, -1)
+	err = dtmimp.CatchP(func() {
+		if registered, err := isBranchRegistered(branches[1]); err != nil || registered {
+			dtmimp.E2P(err)
+			return
+		}
+		saved := GetStore().LockGlobalSaveBranches(branch.Gid, dtmcli.StatusPrepared, branches, -1)
+		for i, ok := range saved {
+			if !ok { // registered by a concurrent retry of the registration after the check
+				_, err := isBranchRegistered(branches[i])
+				dtmimp.E2P(err)
+			}
+		}
 	})
 	if err == storage.ErrNotFound {
 		msg := fmt.Sprintf("no trans with gid: %s status: %s found", branch.Gid, dtmcli.StatusPrepared)
-		logger.Errorf(msg)
+		logger.Gid(branch.Gid).Errorf("%s", msg)
 		return fmt.Errorf("message: %s %w", msg, dtmcli.ErrFailure)
 	}
-	logger.Infof("LockGlobalSaveBranches result: %v: gid: %s old status: %s branches: %s",
-		err, branch.Gid, dtmcli.StatusPrepared, dtmimp.MustMarshalString(branches))
+	logger.Gid(branch.Gid).Infof("LockGlobalSaveBranches result: %v: gid: %s old status: %s branches: %s",
+		err, branch.Gid, dtmcli.StatusPrepared, dtmimp.MustMarshalString(storage.MaskBranches(branches)))
+	if err == nil {
+		branchResults.add(cacheKey)
+	}
 	return err
 }
+
+// isBranchRegistered checks whether the branch is registered by a previous request, so that a client can retry the
+// registration safely. a different branch of the same branch id is rejected
+func isBranchRegistered(branch TransBranch) (bool, error) {
+	registered := GetStore().FindBranch(branch.Gid, branch.BranchID, branch.Op)
+	if registered == nil {
+		return false, nil
+	}
+	if registered.URL != branch.URL || !bytes.Equal(registered.BinData, branch.BinData) {
+		return false, fmt.Errorf("branch %s of %s is registered with a different url or payload. %w", branch.BranchID, branch.Gid, dtmcli.ErrFailure)
+	}
+	if global := GetStore().FindTransGlobalStore(branch.Gid); global == nil || global.Status != dtmcli.StatusPrepared {
+		return false, storage.ErrNotFound
+	}
+	logger.Gid(branch.Gid).Infof("branch %s of %s is registered already, the registration is accepted again", branch.BranchID, branch.Gid)
+	return true, nil
+}
+
+// the max number of the buckets of a stats request
+const statsMaxBuckets = 1000
+
+// svcStats returns the stats of the trans created in the range, and the current backlog
+func svcStats(cond storage.StatsCondition) interface{} {
+	if cond.Bucket <= 0 || !cond.From.Before(cond.To) {
+		return fmt.Errorf("bucket should be positive and from should be before to. %w", dtmcli.ErrInvalidArgument)
+	}
+	if n := cond.To.Sub(cond.From) / cond.Bucket; n >= statsMaxBuckets {
+		return fmt.Errorf("%d buckets in the range, exceeding the limit %d. %w", n, statsMaxBuckets, dtmcli.ErrInvalidArgument)
+	}
+	stats := GetStore().Stats(cond)
+	now := storage.Now()
+	return map[string]interface{}{
+		"from":        cond.From.Unix(),
+		"to":          cond.To.Unix(),
+		"bucket":      int64(cond.Bucket / time.Second),
+		"counts":      stats.Counts,
+		"durations":   stats.Durations,
+		"approximate": stats.Approximate,
+		"backlog": map[string]int64{ // all the unfinished trans have a next cron time
+			"unfinished": GetStore().CountCronTimeBefore(now.AddDate(100, 0, 0)),
+			"overdue":    GetStore().CountCronTimeBefore(now),
+		},
+	}
+}
+
+// svcResetCron counts the trans to reset if dry run, or resets them in batches until no one remains or MaxBatches is reached
+func svcResetCron(req *ResetCronRequest) interface{} {
+	if req.Timeout < 0 || req.Limit < 0 || req.MaxBatches < 0 {
+		return fmt.Errorf("timeout, limit and max_batches should not be negative. %w", dtmcli.ErrInvalidArgument)
+	}
+	req.Timeout = dtmimp.If(req.Timeout == 0, 3*conf.TimeoutToFail, req.Timeout).(int64)
+	req.Limit = dtmimp.If(req.Limit == 0, int64(100), req.Limit).(int64)
+	req.MaxBatches = dtmimp.If(req.MaxBatches == 0, 100, req.MaxBatches).(int)
+	timeout := time.Duration(req.Timeout) * time.Second
+	if req.DryRun {
+		return map[string]interface{}{"dry_run": true, "count": GetStore().CountCronTimeAfter(storage.Now().Add(timeout))}
+	}
+	total, batches, hasRemaining := int64(0), 0, true
+	for ; hasRemaining && batches < req.MaxBatches; batches++ {
+		count, remaining, err := GetStore().ResetCronTime(timeout, req.Limit)
+		total += count
+		if err != nil {
+			logger.Errorf("admin reset-cron failed after %d reset: %v", total, err)
+			return err
+		}
+		hasRemaining = remaining
+	}
+	logger.Infof("admin reset-cron done: %d reset in %d batches, has remaining: %t", total, batches, hasRemaining)
+	return map[string]interface{}{"dry_run": false, "succeed_count": total, "batches": batches, "has_remaining": hasRemaining}
+}
@@ -40,7 +40,10 @@ func (s *dtmServer) Abort(ctx context.Context, in *pb.DtmRequest) (*emptypb.Empt
 }
 
 func (s *dtmServer) RegisterBranch(ctx context.Context, in *pb.DtmBranchRequest) (*emptypb.Empty, error) {
-	r := svcRegisterBranch(in.TransType, &TransBranch{
+	if err := checkClaim(grpcCallerToken(ctx), in.Gid); err != nil {
+		return &emptypb.Empty{}, dtmgrpc.DtmError2GrpcError(err)
+	}
+	r := svcRegisterBranch("grpc", in.TransType, &TransBranch{
 		Gid:      in.Gid,
 		BranchID: in.BranchID,
 		Status:   dtmcli.StatusPrepared,
@@ -7,12 +7,20 @@
 package dtmsvr
 
 import (
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmsvr/storage/sql"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -20,15 +28,45 @@ import (
 
 func addRoute(engine *gin.Engine) {
 	engine.GET("/api/dtmsvr/newGid", dtmutil.WrapHandler2(newGid))
-	engine.POST("/api/dtmsvr/prepare", dtmutil.WrapHandler2(prepare))
-	engine.POST("/api/dtmsvr/submit", dtmutil.WrapHandler2(submit))
-	engine.POST("/api/dtmsvr/abort", dtmutil.WrapHandler2(abort))
-	engine.POST("/api/dtmsvr/registerBranch", dtmutil.WrapHandler2(registerBranch))
-	engine.POST("/api/dtmsvr/registerXaBranch", dtmutil.WrapHandler2(registerBranch))  // compatible for old sdk
-	engine.POST("/api/dtmsvr/registerTccBranch", dtmutil.WrapHandler2(registerBranch)) // compatible for old sdk
-	engine.GET("/api/dtmsvr/query", dtmutil.WrapHandler2(query))
-	engine.GET("/api/dtmsvr/all", dtmutil.WrapHandler2(all))
-	engine.GET("/api/dtmsvr/resetCronTime", dtmutil.WrapHandler2(resetCronTime))
+	engine.POST("/api/dtmsvr/prepare", readOnlyGuard, dtmutil.WrapHandler2(prepare))
+	engine.POST("/api/dtmsvr/submit", readOnlyGuard, dtmutil.WrapHandler2(submit))
+	engine.POST("/api/dtmsvr/submit_batch", readOnlyGuard, dtmutil.WrapHandler2(submitBatch))
+	engine.POST("/api/dtmsvr/submit_template", readOnlyGuard, dtmutil.WrapHandler2(submitTemplate))
+	engine.POST("/api/dtmsvr/abort", readOnlyGuard, dtmutil.WrapHandler2(abort))
+	engine.POST("/api/dtmsvr/registerBranch", readOnlyGuard, dtmutil.WrapHandler2(registerBranch))
+	engine.POST("/api/dtmsvr/registerXaBranch", readOnlyGuard, dtmutil.WrapHandler2(registerBranch))  // compatible for old sdk
+	engine.POST("/api/dtmsvr/registerTccBranch", readOnlyGuard, dtmutil.WrapHandler2(registerBranch)) // compatible for old sdk
+	engine.GET("/api/dtmsvr/query", dtmutil.WrapHandler2(withTimeFormat(query)))
+	engine.GET("/api/dtmsvr/all", dtmutil.WrapHandler2(withTimeFormat(all)))
+	engine.GET("/api/dtmsvr/watch", watch)
+	engine.GET("/api/dtmsvr/resetCronTime", readOnlyGuard, dtmutil.WrapHandler2(resetCronTime))
+	engine.POST("/api/dtmsvr/subscribe", readOnlyGuard, dtmutil.WrapHandler2(subscribe))
+	engine.POST("/api/dtmsvr/unsubscribe", readOnlyGuard, dtmutil.WrapHandler2(unsubscribe))
+	engine.GET("/api/dtmsvr/topics", dtmutil.WrapHandler2(topics))
+	engine.GET("/api/dtmsvr/health", dtmutil.WrapHandler2(health))
+	engine.POST("/api/dtmsvr/admin/dry-run", adminAuth, dtmutil.WrapHandler2(dryRun))
+	engine.POST("/api/dtmsvr/trans/custom_data", adminAuth, readOnlyGuard, dtmutil.WrapHandler2(updateCustomData))
+	engine.GET("/api/dtmsvr/admin/stats", adminAuth, dtmutil.WrapHandler2(stats))
+	engine.POST("/api/dtmsvr/admin/reset-cron", adminAuth, readOnlyGuard, dtmutil.WrapHandler2(adminResetCron))
+	engine.POST("/api/dtmsvr/admin/unquarantine", adminAuth, readOnlyGuard, dtmutil.WrapHandler2(unquarantine))
+	engine.POST("/api/dtmsvr/admin/read-only", adminAuth, dtmutil.WrapHandler2(adminReadOnly))
+	engine.POST("/api/dtmsvr/admin/templates", adminAuth, readOnlyGuard, dtmutil.WrapHandler2(registerTemplate))
+	engine.GET("/api/dtmsvr/admin/templates", adminAuth, dtmutil.WrapHandler2(templates))
+	engine.GET("/api/dtmsvr/admin/export", adminAuth, adminExport)
+	engine.POST("/api/dtmsvr/admin/import", adminAuth, readOnlyGuard, dtmutil.WrapHandler2(adminImport))
+	engine.GET("/api/dtmsvr/admin/target-rewrites", adminAuth, dtmutil.WrapHandler2(adminTargetRewrites))
+	engine.POST("/api/dtmsvr/admin/target-rewrites", adminAuth, dtmutil.WrapHandler2(adminSetTargetRewrites))
+	engine.GET("/api/dtmsvr/admin/events", adminAuth, dtmutil.WrapHandler2(adminEvents))
+	engine.POST("/api/dtmsvr/admin/events/replay", adminAuth, dtmutil.WrapHandler2(adminReplayEvents))
+	engine.POST("/api/dtmsvr/admin/events/ack", adminAuth, readOnlyGuard, dtmutil.WrapHandler2(adminAckEvents))
+	for _, r := range apiV2Routes {
+		handlers := []gin.HandlerFunc{dtmutil.WrapHandlerV2(v2(r.handler))}
+		if r.method == http.MethodPost { // all the v2 apis changing trans are of POST
+			handlers = append([]gin.HandlerFunc{readOnlyGuard}, handlers...)
+		}
+		engine.Handle(r.method, "/api/dtmsvr/v2/"+r.path, handlers...)
+	}
+	engine.GET("/api/dtmsvr/v2/openapi.json", func(c *gin.Context) { c.JSON(http.StatusOK, openAPIV2()) })
 
 	// add prometheus exporter
 	h := promhttp.Handler()
@@ -49,6 +87,24 @@ func submit(c *gin.Context) interface{} {
 	return svcSubmit(TransFromContext(c))
 }
 
+func submitBatch(c *gin.Context) interface{} {
+	return svcSubmitBatch(TransBatchFromContext(c))
+}
+
+// submitTemplate submits the trans expanded from a template registered by admin/templates
+func submitTemplate(c *gin.Context) interface{} {
+	b, err := c.GetRawData()
+	e2p(err)
+	req := TemplateSubmit{}
+	dtmimp.MustUnmarshal(b, &req)
+	t, err := expandTemplate(&req)
+	if err != nil {
+		return err
+	}
+	setupHTTPTrans(c, t)
+	return svcSubmit(t)
+}
+
 func abort(c *gin.Context) interface{} {
 	return svcAbort(TransFromContext(c))
 }
@@ -57,13 +113,18 @@ func registerBranch(c *gin.Context) interface{} {
 	data := map[string]string{}
 	err := c.BindJSON(&data)
 	e2p(err)
+	if err := checkClaim(callerToken(c), data["gid"]); err != nil {
+		return err
+	}
+	payload, err := dtmimp.DecodeBinPayload(data["data"], data["content_type"])
+	e2p(err)
 	branch := TransBranch{
 		Gid:      data["gid"],
 		BranchID: data["branch_id"],
 		Status:   dtmcli.StatusPrepared,
-		BinData:  []byte(data["data"]),
+		BinData:  payload,
 	}
-	return svcRegisterBranch(data["trans_type"], &branch, data)
+	return svcRegisterBranch("http", data["trans_type"], &branch, data)
 }
 
 func query(c *gin.Context) interface{} {
@@ -71,15 +132,75 @@ func query(c *gin.Context) interface{} {
 	if gid == "" {
 		return errors.New("no gid specified")
 	}
+	if err := checkQueryClaim(callerToken(c), gid); err != nil {
+		return err
+	}
+	limit := dtmimp.MustAtoi(dtmimp.OrString(c.Query("branch_limit"), "0"))
+	result := queryTransPage(gid, c.Query("branch_position"), limit)
+	if trans, _ := result["transaction"].(*storage.TransGlobalStore); trans != nil && c.Query("payloads") == "decoded" {
+		result["branch_details"] = getBranchDetails(trans, result["branches"].([]TransBranch))
+	}
+	for _, include := range strings.Split(c.Query("include"), ",") {
+		if include == "attempts" {
+			result["attempts"] = storage.MaskAttempts(GetStore().FindAttempts(gid))
+		}
+	}
+	return result
+}
+
+// queryTrans returns the trans and its branches, for query and watch
+func queryTrans(gid string) map[string]interface{} {
+	return queryTransPage(gid, "", 0)
+}
+
+// queryTransPage returns the trans and a page of its branches after the branch id position, and the position of the
+// next page. all the branches are returned if limit is 0
+func queryTransPage(gid string, position string, limit int) map[string]interface{} {
 	trans := GetStore().FindTransGlobalStore(gid)
-	branches := GetStore().FindBranches(gid)
-	return map[string]interface{}{"transaction": trans, "branches": branches}
+	if trans != nil { // fill the options, so that the effective request timeout is visible
+		if trans.Options != "" {
+			dtmimp.MustUnmarshalString(trans.Options, &trans.TransOptions)
+		}
+		if trans.RequestTimeout == 0 {
+			trans.RequestTimeout = conf.RequestTimeout
+		}
+	}
+	var branches []TransBranch
+	if limit > 0 {
+		branches = GetStore().FindBranchesPage(gid, position, limit)
+	} else {
+		branches = GetStore().FindBranches(gid)
+	}
+	result := map[string]interface{}{"transaction": trans, "branches": storage.MaskBranches(branches)}
+	if limit > 0 {
+		result["next_branch_position"] = ""
+		if len(branches) >= limit {
+			result["next_branch_position"] = branches[len(branches)-1].BranchID
+		}
+	}
+	if trans != nil {
+		result["transaction"] = trans.Masked()
+		result["retry_intervals"] = getBranchRetryIntervals(trans, branches)
+	}
+	if trans != nil && limit == 0 { // the dependencies and hierarchy need all the branches
+		if deps := getBranchDependencies(trans, branches); deps != nil {
+			result["dependencies"] = deps
+		}
+		if hierarchy := getBranchHierarchy(trans, branches); hierarchy != nil {
+			result["hierarchy"] = hierarchy
+		}
+	}
+	return result
 }
 
 func all(c *gin.Context) interface{} {
 	position := c.Query("position")
 	sLimit := dtmimp.OrString(c.Query("limit"), "100")
-	globals := GetStore().ScanTransGlobalStores(&position, int64(dtmimp.MustAtoi(sLimit)))
+	condition := storage.TransGlobalScanCondition{Tenant: c.Query("tenant")}
+	globals := GetStore().ScanTransGlobalStores(&position, int64(dtmimp.MustAtoi(sLimit)), condition)
+	for i := range globals {
+		globals[i] = *globals[i].Masked()
+	}
 	return map[string]interface{}{"transactions": globals, "next_position": position}
 }
 
@@ -96,3 +217,322 @@ func resetCronTime(c *gin.Context) interface{} {
 	}
 	return map[string]interface{}{"has_remaining": hasRemaining, "succeed_count": succeedCount}
 }
+
+func subscribe(c *gin.Context) interface{} {
+	data := map[string]string{}
+	err := c.BindJSON(&data)
+	e2p(err)
+	return svcSubscribe(data["topic"], data["url"], data["remark"])
+}
+
+func unsubscribe(c *gin.Context) interface{} {
+	data := map[string]string{}
+	err := c.BindJSON(&data)
+	e2p(err)
+	return svcUnsubscribe(data["topic"], data["url"])
+}
+
+// topics lists the topics and their subscribers. only the specified topic is listed if topic is not empty
+func topics(c *gin.Context) interface{} {
+	return map[string]interface{}{"topics": listTopics(c.Query("topic"))}
+}
+
+// health pings the store, and returns the statistics of the db pools for diagnosis
+func health(c *gin.Context) interface{} {
+	if err := GetStore().Ping(); err != nil {
+		return err
+	}
+	return map[string]interface{}{"status": "ok", "read_only": isReadOnly(), "db_pools": sql.PoolStats()}
+}
+
+// adminAuth checks the admin token for admin apis. admin apis are open like other apis if AdminToken is empty
+func adminAuth(c *gin.Context) {
+	if conf.AdminToken == "" {
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]interface{}{"message": "admin token required"})
+	}
+}
+
+// updateCustomData updates the custom data of an unfinished trans, such as a reference learned from a branch
+func updateCustomData(c *gin.Context) interface{} {
+	data := map[string]string{}
+	err := c.BindJSON(&data)
+	e2p(err)
+	if data["gid"] == "" {
+		return fmt.Errorf("no gid specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	return svcUpdateCustomData(data["gid"], data["custom_data"])
+}
+
+// registerTemplate registers a template, or a new version of it
+func registerTemplate(c *gin.Context) interface{} {
+	tpl := TransTemplate{}
+	if err := c.ShouldBindJSON(&tpl); err != nil {
+		return fmt.Errorf("bad request: %s. %w", err.Error(), dtmcli.ErrInvalidArgument)
+	}
+	logger.Infof("admin register template from %s: %s", c.ClientIP(), tpl.Name)
+	return svcRegisterTemplate(&tpl)
+}
+
+// templates lists the templates. only the specified template is listed if name is not empty
+func templates(c *gin.Context) interface{} {
+	return map[string]interface{}{"templates": listTemplates(c.Query("name"))}
+}
+
+// unquarantine restores a quarantined trans, after the cause of its panics is fixed
+func unquarantine(c *gin.Context) interface{} {
+	data := map[string]string{}
+	err := c.BindJSON(&data)
+	e2p(err)
+	if data["gid"] == "" {
+		return fmt.Errorf("no gid specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	logger.Infof("admin unquarantine from %s: %s", c.ClientIP(), data["gid"])
+	return svcUnquarantine(data["gid"])
+}
+
+// stats returns the stats of the trans created in [from, to), in unix seconds, by the buckets of bucket seconds.
+// the default is the last 24 hours by hour
+func stats(c *gin.Context) interface{} {
+	now := time.Now()
+	params := map[string]int64{"to": now.Unix(), "from": now.Unix() - 86400, "bucket": 3600}
+	for name := range params {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if t, terr := time.Parse(time.RFC3339, v); err != nil && terr == nil && name != "bucket" { // from and to in RFC3339
+				n, err = t.Unix(), nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s. %w", name, v, dtmcli.ErrInvalidArgument)
+			}
+			params[name] = n
+		}
+	}
+	if c.Query("to") != "" && c.Query("from") == "" {
+		params["from"] = params["to"] - 86400
+	}
+	return svcStats(storage.StatsCondition{
+		From:   time.Unix(params["from"], 0),
+		To:     time.Unix(params["to"], 0),
+		Bucket: time.Duration(params["bucket"]) * time.Second,
+	})
+}
+
+// dryRun returns what the cron processor would do next for the trans, without calling any branch or changing the trans
+func dryRun(c *gin.Context) interface{} {
+	data := map[string]string{}
+	err := c.BindJSON(&data)
+	e2p(err)
+	if data["gid"] == "" {
+		return fmt.Errorf("no gid specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	global := GetStore().FindTransGlobalStore(data["gid"])
+	if global == nil {
+		return fmt.Errorf("trans %s not found. %w", data["gid"], dtmcli.ErrInvalidArgument)
+	}
+	t := &TransGlobal{TransGlobalStore: *global}
+	branches := GetStore().FindBranches(t.Gid)
+	t.loadProcessExt(branches)
+	return planTrans(t, branches)
+}
+
+// adminExport streams the unfinished trans and their branches as ndjson of storage.SnapshotRecord, for a migration to
+// another store by admin/import. the servers should be read-only when exporting, so the trans are not changed
+func adminExport(c *gin.Context) {
+	logger.Infof("admin export from %s, read-only: %t", c.ClientIP(), isReadOnly())
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	count, err := storage.ExportSnapshot(GetStore(), c.Writer)
+	if err != nil {
+		logger.Errorf("admin export error after %d trans: %v", count, err)
+		return
+	}
+	logger.Infof("admin export done: %d trans", count)
+}
+
+// adminImport saves the trans in the ndjson body exported by admin/export, and returns the storage.ImportSummary
+func adminImport(c *gin.Context) interface{} {
+	summary, err := storage.ImportSnapshot(GetStore(), c.Request.Body)
+	if err != nil {
+		return err
+	}
+	logger.Infof("admin import from %s: %d imported, %d skipped, %d failed", c.ClientIP(), summary.Imported, len(summary.Skipped), len(summary.Failed))
+	return summary
+}
+
+// ResetCronRequest is the request of admin/reset-cron
+type ResetCronRequest struct {
+	Timeout    int64 `json:"timeout"`     // in seconds. the trans whose next cron time is later than now + timeout are reset. default 3 * TimeoutToFail
+	Limit      int64 `json:"limit"`       // the number of the trans reset in a batch. default 100
+	MaxBatches int   `json:"max_batches"` // the max number of batches. default 100
+	DryRun     bool  `json:"dry_run"`     // only count the trans to reset
+}
+
+// adminResetCron resets the next cron time of the backed-off trans in batches, such as after an outage of the RMs
+func adminResetCron(c *gin.Context) interface{} {
+	req := ResetCronRequest{}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return fmt.Errorf("bad request: %s. %w", err.Error(), dtmcli.ErrInvalidArgument)
+		}
+	}
+	logger.Infof("admin reset-cron from %s: %s", c.ClientIP(), dtmimp.MustMarshalString(req))
+	return svcResetCron(&req)
+}
+
+// adminTargetRewrites returns the rules rewriting the urls of the branches of this server
+func adminTargetRewrites(c *gin.Context) interface{} {
+	return map[string]interface{}{"rules": getTargetRewrites()}
+}
+
+// adminSetTargetRewrites replaces the rules rewriting the urls of the branches of this server by {"rules": [...]}.
+// the rules are not saved, so they should be set to every server, and to TargetRewrites of the config for the restarts
+func adminSetTargetRewrites(c *gin.Context) interface{} {
+	data := map[string][]config.TargetRewrite{}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		return fmt.Errorf("bad request: %s. %w", err.Error(), dtmcli.ErrInvalidArgument)
+	}
+	rules, ok := data["rules"]
+	if !ok {
+		return fmt.Errorf("no rules specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	logger.Infof("admin target-rewrites from %s: %s", c.ClientIP(), dtmimp.MustMarshalString(rules))
+	if err := setTargetRewrites(rules); err != nil {
+		return err
+	}
+	return map[string]interface{}{"rules": getTargetRewrites()}
+}
+
+// adminEvents returns the events in the event log after after_seq, limit 100 by default, for the consumers catching up
+func adminEvents(c *gin.Context) interface{} {
+	afterSeq, err := strconv.ParseInt(dtmimp.OrString(c.Query("after_seq"), "0"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid after_seq: %s. %w", c.Query("after_seq"), dtmcli.ErrInvalidArgument)
+	}
+	limit, err := strconv.Atoi(dtmimp.OrString(c.Query("limit"), "100"))
+	if err != nil {
+		return fmt.Errorf("invalid limit: %s. %w", c.Query("limit"), dtmcli.ErrInvalidArgument)
+	}
+	return svcEvents(afterSeq, limit)
+}
+
+// adminReplayEvents republishes the events in the event log to the sink of EventPublisher
+func adminReplayEvents(c *gin.Context) interface{} {
+	req := ReplayEventsRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return fmt.Errorf("bad request: %s. %w", err.Error(), dtmcli.ErrInvalidArgument)
+	}
+	logger.Infof("admin replay events from %s: %s", c.ClientIP(), dtmimp.MustMarshalString(req))
+	return svcReplayEvents(&req)
+}
+
+// adminAckEvents saves the offset of a consumer of the event log, which guards the events not consumed from the purge
+func adminAckEvents(c *gin.Context) interface{} {
+	req := AckEventsRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return fmt.Errorf("bad request: %s. %w", err.Error(), dtmcli.ErrInvalidArgument)
+	}
+	return svcAckEvents(&req)
+}
+
+// apiV2Route is a route of the v2 api, which is also described in the openapi of v2
+type apiV2Route struct {
+	method  string
+	path    string
+	summary string
+	handler func(*gin.Context) interface{}
+}
+
+var apiV2Routes = []apiV2Route{
+	{http.MethodGet, "newGid", "generate a new gid", newGid},
+	{http.MethodPost, "prepare", "prepare a trans", prepare},
+	{http.MethodPost, "submit", "submit a trans", submit},
+	{http.MethodPost, "submit_batch", "submit msgs in batch", submitBatch},
+	{http.MethodPost, "abort", "abort a tcc or xa trans", abort},
+	{http.MethodPost, "registerBranch", "register a branch of a tcc or xa trans", registerBranch},
+	{http.MethodGet, "query", "query a trans and its branches by gid", withTimeFormat(queryV2)},
+	{http.MethodGet, "all", "list the trans by pages", withTimeFormat(all)},
+}
+
+// v2 adapts a handler of v1 to the v2 api. dtm_result is removed from the result, because the code of the envelope
+// replaces it, and ErrNotFound of the store is returned as NOT_FOUND
+func v2(fn func(*gin.Context) interface{}) func(*gin.Context) interface{} {
+	return func(c *gin.Context) interface{} {
+		var err error
+		r := func() interface{} {
+			defer dtmimp.P2E(&err)
+			return fn(c)
+		}()
+		if e, ok := r.(error); ok {
+			err = e
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("%s. %w", err.Error(), dtmcli.ErrNotFound)
+		} else if err != nil {
+			return err
+		}
+		if m, ok := r.(map[string]interface{}); ok {
+			delete(m, "dtm_result")
+		}
+		return r
+	}
+}
+
+// queryV2 is query with NOT_FOUND for a trans not found
+func queryV2(c *gin.Context) interface{} {
+	gid := c.Query("gid")
+	if gid == "" {
+		return fmt.Errorf("no gid specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	r := query(c)
+	if m, ok := r.(map[string]interface{}); ok {
+		if trans, _ := m["transaction"].(*storage.TransGlobalStore); trans == nil {
+			return fmt.Errorf("trans %s not found. %w", gid, dtmcli.ErrNotFound)
+		}
+	}
+	return r
+}
+
+// openAPIV2 describes the routes of the v2 api in openapi 3
+func openAPIV2() map[string]interface{} {
+	envelope := map[string]interface{}{"$ref": "#/components/schemas/APIResponse"}
+	responses := map[string]interface{}{}
+	for code, status := range map[string]int{
+		dtmimp.CodeOK: http.StatusOK, dtmimp.CodeInvalidArgument: http.StatusBadRequest, dtmimp.CodeNotFound: http.StatusNotFound,
+		dtmimp.CodeFailure + " or " + dtmimp.CodeDuplicated: http.StatusConflict, dtmimp.CodeOngoing: http.StatusTooEarly,
+		dtmimp.CodeInternal: http.StatusInternalServerError,
+	} {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": code,
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": envelope}},
+		}
+	}
+	paths := map[string]interface{}{}
+	for _, r := range apiV2Routes {
+		op := map[string]interface{}{"summary": r.summary, "operationId": r.path, "responses": responses}
+		if r.method == http.MethodPost {
+			op["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}},
+			}
+		}
+		paths["/api/dtmsvr/v2/"+r.path] = map[string]interface{}{strings.ToLower(r.method): op}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "dtm server api", "version": "v2"},
+		"paths":   paths,
+		"components": map[string]interface{}{"schemas": map[string]interface{}{"APIResponse": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"code"},
+			"properties": map[string]interface{}{
+				"code": map[string]interface{}{"type": "string", "enum": []string{dtmimp.CodeOK, dtmimp.CodeFailure, dtmimp.CodeOngoing,
+					dtmimp.CodeDuplicated, dtmimp.CodeInvalidArgument, dtmimp.CodeNotFound, dtmimp.CodeInternal}},
+				"message": map[string]interface{}{"type": "string"},
+				"data":    map[string]interface{}{"description": "the result of the api"},
+			},
+		}}},
+	}
+}
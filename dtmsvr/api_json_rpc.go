@@ -8,7 +8,7 @@ import (
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
-	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/gin-gonic/gin"
 )
 
@@ -52,6 +52,9 @@ func addJrpcRouter(engine *gin.Engine) {
 					"message": fmt.Sprintf("Method not found: %s", req.Method),
 				}
 			} else if handlers[req.Method] != nil {
+				if req.Method != "newGid" {
+					e2p(checkWritable())
+				}
 				return handlers[req.Method](req.Params)
 			}
 			return nil
@@ -74,6 +77,30 @@ func addJrpcRouter(engine *gin.Engine) {
 				// 		"code":    jrpcCodeOngoing,
 				// 		"message": err.Error(),
 				// 	}
+			} else if errors.Is(err, dtmcli.ErrInvalidArgument) {
+				jerr = map[string]interface{}{
+					"code":    -32602,
+					"message": err.Error(),
+				}
+			} else if errors.Is(err, dtmcli.ErrReadOnly) {
+				jerr = map[string]interface{}{
+					"code":    dtmimp.JrpcCodeReadOnly,
+					"message": err.Error(),
+				}
+			} else if errors.Is(err, dtmcli.ErrBusy) {
+				jerr = map[string]interface{}{
+					"code":    dtmimp.JrpcCodeBusy,
+					"message": err.Error(),
+				}
+				var busy *dtmimp.BusyError
+				if errors.As(err, &busy) {
+					jerr["data"] = map[string]interface{}{"retry_after": int64(busy.RetryAfter / time.Second)}
+				}
+			} else if errors.Is(err, dtmcli.ErrGidNotOwned) {
+				jerr = map[string]interface{}{
+					"code":    dtmimp.JrpcCodeGidNotOwned,
+					"message": err.Error(),
+				}
 			} else if jerr == nil {
 				jerr = map[string]interface{}{
 					"code":    -32603,
@@ -90,11 +117,8 @@ func addJrpcRouter(engine *gin.Engine) {
 		}
 		b, _ := json.Marshal(result)
 		cont := string(b)
-		if jerr == nil || jerr["code"] == dtmimp.JrpcCodeOngoing {
-			logger.Infof("%2dms %d %s %s %s", time.Since(began).Milliseconds(), 200, c.Request.Method, c.Request.RequestURI, cont)
-		} else {
-			logger.Errorf("%2dms %d %s %s %s", time.Since(began).Milliseconds(), 200, c.Request.Method, c.Request.RequestURI, cont)
-		}
+		dtmutil.HandlerLogf(c, jerr != nil && jerr["code"] != dtmimp.JrpcCodeOngoing)("%2dms %d %s %s %s",
+			time.Since(began).Milliseconds(), 200, c.Request.Method, c.Request.RequestURI, cont)
 		c.JSON(200, result)
 	})
 }
@@ -126,11 +150,14 @@ func jrpcAbort(params interface{}) interface{} {
 func jrpcRegisterBranch(params interface{}) interface{} {
 	data := map[string]string{}
 	dtmimp.MustRemarshal(params, &data)
+	if err := checkClaim("", data["gid"]); err != nil { // json-rpc callers have no token
+		return err
+	}
 	branch := TransBranch{
 		Gid:      data["gid"],
 		BranchID: data["branch_id"],
 		Status:   dtmcli.StatusPrepared,
 		BinData:  []byte(data["data"]),
 	}
-	return svcRegisterBranch(data["trans_type"], &branch, data)
+	return svcRegisterBranch("json-rpc", data["trans_type"], &branch, data)
 }
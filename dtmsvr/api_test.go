@@ -0,0 +1,25 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCustomOptions(t *testing.T) {
+	saga := `{"orders":{"1":[0]},"concurrent":true}`
+	assert.Nil(t, checkCustomOptions("saga", saga, `{"orders":{"1":[0]},"concurrent":true,"ref":"R1"}`))
+	assert.True(t, errors.Is(checkCustomOptions("saga", saga, `{"ref":"R1"}`), dtmcli.ErrInvalidArgument))
+	assert.Nil(t, checkCustomOptions("msg", "", `{"ref":"R1"}`))
+	assert.True(t, errors.Is(checkCustomOptions("msg", "", `{"delay":10}`), dtmcli.ErrInvalidArgument))
+	assert.True(t, errors.Is(checkCustomOptions("tcc", "", `not json`), dtmcli.ErrInvalidArgument))
+	assert.Nil(t, checkCustomOptions("xa", "", `not json`))
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/gin-gonic/gin"
+)
+
+// the formats of the times in the responses of the http api
+const (
+	timeFormatRFC3339 = "rfc3339" // RFC3339 in UTC, as marshaled by the storage DTOs
+	timeFormatUnixMs  = "unix_ms" // unix milliseconds
+)
+
+// withTimeFormat returns the times in the result of fn in unix milliseconds, if the query parameter time_format or the
+// config TimeFormat is unix_ms. the times are the fields named *_time in RFC3339
+func withTimeFormat(fn func(*gin.Context) interface{}) func(*gin.Context) interface{} {
+	return func(c *gin.Context) interface{} {
+		r := fn(c)
+		if _, ok := r.(error); ok || dtmimp.OrString(c.Query("time_format"), conf.TimeFormat) != timeFormatUnixMs {
+			return r
+		}
+		decoder := json.NewDecoder(bytes.NewReader(dtmimp.MustMarshal(r)))
+		decoder.UseNumber()
+		var v interface{}
+		dtmimp.E2P(decoder.Decode(&v))
+		return timesToUnixMs(v)
+	}
+}
+
+func timesToUnixMs(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if s, ok := e.(string); ok && strings.HasSuffix(k, "_time") {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					v[k] = t.UnixNano() / int64(time.Millisecond)
+				}
+			} else {
+				v[k] = timesToUnixMs(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = timesToUnixMs(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeFormat(t *testing.T) {
+	create := time.Unix(1600000000, 0).In(time.FixedZone("UTC+8", 8*3600))
+	global := &storage.TransGlobalStore{Gid: "gid1"}
+	global.CreateTime = &create
+	result := func(c *gin.Context) interface{} {
+		return map[string]interface{}{"transaction": global, "branches": []TransBranch{{BranchID: "01", FinishTime: &create}},
+			"reason_time": "not a time"}
+	}
+	get := func(query string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest(http.MethodGet, "/query?"+query, nil)
+		return dtmimp.MustMarshalString(withTimeFormat(result)(c))
+	}
+	s := get("")
+	assert.Contains(t, s, `"create_time":"2020-09-13T12:26:40Z"`)
+	s = get("time_format=unix_ms")
+	assert.Contains(t, s, `"create_time":1600000000000`)
+	assert.Contains(t, s, `"finish_time":1600000000000`)
+	assert.Contains(t, s, `"update_time":null`)
+	assert.Contains(t, s, `"reason_time":"not a time"`)
+	assert.Contains(t, s, `"gid":"gid1"`)
+
+	conf.TimeFormat = "unix_ms"
+	defer func() { conf.TimeFormat = "rfc3339" }()
+	assert.Contains(t, get(""), `"create_time":1600000000000`)
+	assert.Contains(t, get("time_format=rfc3339"), `"create_time":"2020-09-13T12:26:40Z"`)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// keepAttemptResponse keeps the response body of the branch for its attempt record, if the attempts are recorded
+func keepAttemptResponse(branch *TransBranch, body []byte) {
+	if conf.BranchAttempts.Enabled == 1 {
+		branch.Response = string(body)
+	}
+}
+
+// attemptResult classifies the result of calling a branch
+func attemptResult(err error) string {
+	if err == nil {
+		return storage.AttemptSucceed
+	} else if errors.Is(err, dtmcli.ErrFailure) {
+		return storage.AttemptFailure
+	} else if errors.Is(err, dtmcli.ErrOngoing) {
+		return storage.AttemptOngoing
+	}
+	return storage.AttemptError
+}
+
+// newAttempt builds the attempt record of calling the branch, which began at the time and returned err
+func (t *TransGlobal) newAttempt(branch *TransBranch, began time.Time, err error) *storage.BranchAttempt {
+	response := branch.Response
+	if response == "" && err != nil {
+		response = err.Error()
+	}
+	if limit := int(conf.BranchAttempts.ResponseLimit); limit > 0 && len(response) > limit {
+		response = response[:limit] + "...(truncated)"
+	}
+	return &storage.BranchAttempt{
+		Gid:       t.Gid,
+		BranchID:  branch.BranchID,
+		Op:        branch.Op,
+		Target:    dtmimp.OrString(branch.ResolvedURL, branch.URL),
+		StartTime: &began,
+		Duration:  time.Since(began).Milliseconds(),
+		Result:    attemptResult(err),
+		Response:  response,
+	}
+}
+
+// recordAttempt saves the attempt of calling the branch, if enabled. a failure of saving is only logged, so that the
+// processing of the trans is not affected
+func (t *TransGlobal) recordAttempt(branch *TransBranch, began time.Time, err error) {
+	if conf.BranchAttempts.Enabled != 1 {
+		return
+	}
+	attempt := t.newAttempt(branch, began, err)
+	branch.Response = ""
+	serr := dtmimp.CatchP(func() { dtmimp.E2P(t.persister().SaveAttempt(attempt)) })
+	if serr != nil {
+		logger.Gid(t.Gid).Errorf("saving attempt of branch %s %s failed: %v", branch.BranchID, branch.Op, serr)
+	}
+}
+
+// cronPurgeAttempts purges the attempts older than the retention periodically
+func cronPurgeAttempts() {
+	for conf.BranchAttempts.Enabled == 1 && conf.BranchAttempts.Retention > 0 && conf.BranchAttempts.PurgeInterval > 0 {
+		var purged int64
+		err := dtmimp.CatchP(func() {
+			if isReadOnly() {
+				return
+			}
+			var err error
+			purged, err = GetStore().PurgeAttempts(time.Now().Add(-time.Duration(conf.BranchAttempts.Retention) * time.Second))
+			dtmimp.E2P(err)
+		})
+		if err != nil {
+			logger.Errorf("purge branch attempts error: %v", err)
+		} else if purged > 0 {
+			logger.Infof("%d branch attempts purged", purged)
+		}
+		time.Sleep(time.Duration(conf.BranchAttempts.PurgeInterval) * time.Second)
+	}
+}
+
+// cronPurgePayloads purges the deduplicated payloads no longer referenced by the branches periodically
+func cronPurgePayloads() {
+	for conf.Store.IsDB() && conf.Store.DedupPayloadSize > 0 && conf.Store.PayloadPurgeInterval > 0 {
+		interval := time.Duration(conf.Store.PayloadPurgeInterval) * time.Second
+		var purged int64
+		err := dtmimp.CatchP(func() {
+			if isReadOnly() {
+				return
+			}
+			var err error
+			purged, err = GetStore().PurgePayloads(time.Now().Add(-interval))
+			dtmimp.E2P(err)
+		})
+		if err != nil {
+			logger.Errorf("purge payloads error: %v", err)
+		} else if purged > 0 {
+			logger.Infof("%d payloads purged", purged)
+		}
+		time.Sleep(interval)
+	}
+}
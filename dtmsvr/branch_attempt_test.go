@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttemptResult(t *testing.T) {
+	assert.Equal(t, storage.AttemptSucceed, attemptResult(nil))
+	assert.Equal(t, storage.AttemptFailure, attemptResult(fmt.Errorf("bad %w", dtmcli.ErrFailure)))
+	assert.Equal(t, storage.AttemptOngoing, attemptResult(dtmcli.ErrOngoing))
+	assert.Equal(t, storage.AttemptError, attemptResult(errors.New("connection refused")))
+}
+
+func TestNewAttempt(t *testing.T) {
+	old := conf.BranchAttempts
+	defer func() { conf.BranchAttempts = old }()
+	conf.BranchAttempts.Enabled = 1
+	conf.BranchAttempts.ResponseLimit = 8
+
+	trans := &TransGlobal{TransGlobalStore: storage.TransGlobalStore{Gid: "gid1"}}
+	branch := &TransBranch{BranchID: "01", Op: "action", URL: "http://localhost/action"}
+	keepAttemptResponse(branch, []byte(`{"dtm_result":"SUCCESS"}`))
+	a := trans.newAttempt(branch, time.Now().Add(-time.Second), nil)
+	assert.Equal(t, storage.AttemptSucceed, a.Result)
+	assert.Equal(t, `{"dtm_re...(truncated)`, a.Response)
+	assert.True(t, a.Duration >= 1000)
+
+	branch.Response = ""
+	a = trans.newAttempt(branch, time.Now(), errors.New("refused"))
+	assert.Equal(t, storage.AttemptError, a.Result)
+	assert.Equal(t, "refused", a.Response)
+
+	conf.BranchAttempts.ResponseLimit = 0
+	keepAttemptResponse(branch, []byte(strings.Repeat("x", 1000)))
+	assert.Equal(t, 1000, len(trans.newAttempt(branch, time.Now(), nil).Response))
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// branchDetail is a branch with the decoded payload and the effective options, for debugging by query
+type branchDetail struct {
+	BranchID       string            `json:"branch_id"`
+	Op             string            `json:"op"`
+	ContentType    string            `json:"content_type"`
+	Payload        json.RawMessage   `json:"payload,omitempty"`        // the json payload, inlined
+	PayloadBase64  string            `json:"payload_base64,omitempty"` // the payload not in json
+	PayloadSize    int               `json:"payload_size"`
+	Truncated      bool              `json:"truncated,omitempty"` // the payload is larger than QueryPayloadLimit, and is truncated
+	Headers        map[string]string `json:"headers,omitempty"`
+	RequestTimeout int64             `json:"request_timeout"`
+}
+
+// getBranchDetails decodes the payloads of the branches. trans and branches should be masked, so that the sensitive headers are not shown
+func getBranchDetails(trans *storage.TransGlobalStore, branches []TransBranch) []branchDetail {
+	headers := map[string]string{}
+	if trans.ExtData != "" {
+		ext := storage.TransGlobalExt{}
+		dtmimp.MustUnmarshalString(trans.ExtData, &ext)
+		for k, v := range ext.Headers {
+			headers[k] = v
+		}
+	}
+	for k, v := range trans.BranchHeaders {
+		headers[k] = v
+	}
+	details := []branchDetail{}
+	for _, b := range branches {
+		ext := storage.TransBranchExt{}
+		if b.ExtData != "" {
+			dtmimp.MustUnmarshalString(b.ExtData, &ext)
+		}
+		if len(ext.Headers) > 0 { // the headers of the branch override the ones of the trans
+			merged := map[string]string{}
+			for k, v := range headers {
+				merged[k] = v
+			}
+			for k, v := range ext.Headers {
+				merged[k] = v
+			}
+			ext.Headers = merged
+		} else {
+			ext.Headers = headers
+		}
+		d := branchDetail{
+			BranchID:       b.BranchID,
+			Op:             b.Op,
+			PayloadSize:    len(b.BinData),
+			Headers:        ext.Headers,
+			RequestTimeout: dtmimp.If(ext.RequestTimeout != 0, ext.RequestTimeout, trans.RequestTimeout).(int64),
+		}
+		payload := b.BinData
+		if limit := int(conf.QueryPayloadLimit); limit > 0 && len(payload) > limit {
+			payload, d.Truncated = payload[:limit], true
+		}
+		if ext.ContentType == "" && !d.Truncated && len(payload) > 0 && utf8.Valid(payload) && json.Valid(payload) {
+			d.ContentType, d.Payload = "application/json", payload
+		} else {
+			d.ContentType = dtmimp.OrString(ext.ContentType, http.DetectContentType(payload))
+			d.PayloadBase64 = base64.StdEncoding.EncodeToString(payload)
+		}
+		details = append(details, d)
+	}
+	return details
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBranchDetails(t *testing.T) {
+	old := conf.QueryPayloadLimit
+	conf.QueryPayloadLimit = 16
+	defer func() { conf.QueryPayloadLimit = old }()
+
+	trans := &storage.TransGlobalStore{}
+	trans.RequestTimeout = 3
+	trans.ExtData = dtmimp.MustMarshalString(storage.TransGlobalExt{Headers: map[string]string{"x-request-id": "r1"}})
+	trans.BranchHeaders = map[string]string{"x-tenant": "t1"}
+	branches := []TransBranch{
+		{BranchID: "01", Op: "action", BinData: []byte(`{"amount":30}`)},
+		{BranchID: "02", Op: "action", BinData: []byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}, ExtData: `{"content_type":"application/x-protobuf","request_timeout":5}`},
+		{BranchID: "03", Op: "action", BinData: []byte(`{"amount":30,"remark":"a long remark"}`)},
+	}
+	details := getBranchDetails(trans, branches)
+	assert.Equal(t, `{"amount":30}`, string(details[0].Payload))
+	assert.Equal(t, "application/json", details[0].ContentType)
+	assert.Equal(t, map[string]string{"x-request-id": "r1", "x-tenant": "t1"}, details[0].Headers)
+	assert.Equal(t, int64(3), details[0].RequestTimeout)
+
+	assert.Equal(t, "application/x-protobuf", details[1].ContentType)
+	assert.Equal(t, "CgVoZWxsbw==", details[1].PayloadBase64)
+	assert.Equal(t, int64(5), details[1].RequestTimeout)
+
+	assert.True(t, details[2].Truncated)
+	assert.Equal(t, 38, details[2].PayloadSize)
+	assert.Nil(t, details[2].Payload)
+	truncated, err := dtmimp.DecodeBinPayload(details[2].PayloadBase64, details[2].ContentType)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"amount":30,"re`, string(truncated))
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"github.com/dtm-labs/dtm/dtmcli"
+)
+
+// the branches of a trans with more than BranchPageThreshold branches are read by pages in cron. if the trans runs its
+// actions one after another, such as a sequential saga or a msg, only the pages from the first pending action are
+// loaded, and the trans is continued by the next process after they are done
+
+// loadBranches loads the branches to process for the cron
+func (t *TransGlobal) loadBranches() []TransBranch {
+	t.branchOffset, t.partialBranches = 0, false
+	if !t.canPageBranches() {
+		return GetStore().FindBranches(t.Gid)
+	}
+	limit := int(conf.BranchPageSize)
+	after := ""
+	var branches []TransBranch
+	for { // stream the pages until the first pending action, and the window from it is returned
+		branches = GetStore().FindBranchesPage(t.Gid, after, limit)
+		if len(branches) == 0 { // all the actions are done
+			return branches
+		}
+		if start := firstPendingGroup(branches); start >= 0 {
+			t.branchOffset += start
+			branches = branches[start:]
+			break
+		}
+		t.branchOffset += len(branches)
+		after = branches[len(branches)-1].BranchID
+	}
+	for _, b := range branches {
+		if t.hasResultRefs(&b) { // the results referred may be in the previous pages
+			t.branchOffset = 0
+			return GetStore().FindBranches(t.Gid)
+		}
+	}
+	t.partialBranches = t.branchOffset+len(branches) < t.BranchCount
+	return branches
+}
+
+// canPageBranches returns whether only part of the branches are needed to process the trans
+func (t *TransGlobal) canPageBranches() bool {
+	if conf.BranchPageThreshold <= 0 || conf.BranchPageSize <= 0 || t.BranchCount <= int(conf.BranchPageThreshold) ||
+		t.Status != dtmcli.StatusSubmitted {
+		return false
+	}
+	// a saga timeout is compensated with all the branches
+	return t.TransType == "msg" || t.TransType == "saga" && !parseSagaCustom(t.CustomData).Concurrent && !t.isTimeout()
+}
+
+// firstPendingGroup returns the position of the first branch whose branch id has a prepared action, -1 if not found
+func firstPendingGroup(branches []TransBranch) int {
+	for i, b := range branches {
+		if b.Op == dtmcli.BranchAction && b.Status == dtmcli.StatusPrepared {
+			for i > 0 && branches[i-1].BranchID == b.BranchID {
+				i--
+			}
+			return i
+		}
+	}
+	return -1
+}
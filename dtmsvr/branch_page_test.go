@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirstPendingGroup(t *testing.T) {
+	p, s := dtmcli.StatusPrepared, dtmcli.StatusSucceed
+	assert.Equal(t, 2, firstPendingGroup(sagaBranches(p, s, p, p, p, p)))
+	assert.Equal(t, -1, firstPendingGroup(sagaBranches(p, s, p, s)))
+	assert.Equal(t, 1, firstPendingGroup([]TransBranch{
+		{BranchID: "01", Op: dtmcli.BranchAction, Status: s},
+		{BranchID: "02-01", Op: dtmcli.BranchAction, Status: p},
+	}))
+}
+
+func TestCanPageBranches(t *testing.T) {
+	conf.BranchPageThreshold, conf.BranchPageSize = 10, 5
+	defer func() { conf.BranchPageThreshold, conf.BranchPageSize = 0, 0 }()
+	now := time.Now()
+	tg := &TransGlobal{}
+	tg.TransType, tg.Status, tg.CreateTime, tg.BranchCount = "saga", dtmcli.StatusSubmitted, &now, 20
+	assert.True(t, tg.canPageBranches())
+	tg.CustomData = `{"concurrent":true}`
+	assert.False(t, tg.canPageBranches())
+	tg.TransType = "msg"
+	assert.True(t, tg.canPageBranches())
+	tg.BranchCount = 10
+	assert.False(t, tg.canPageBranches())
+	tg.BranchCount, tg.Status = 20, dtmcli.StatusAborting
+	assert.False(t, tg.canPageBranches())
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+)
+
+// payloadQuery form-encodes the payload of a branch, which should be a flat json object. the values of an array are
+// encoded as repeated keys, and the null values are omitted
+func payloadQuery(payload []byte) (url.Values, error) {
+	query := url.Values{}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return query, nil
+	}
+	var obj map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("payload sent in query should be a json object: %v. %w", err, dtmcli.ErrInvalidArgument)
+	}
+	for k, v := range obj {
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+		for _, value := range values {
+			s, ok := queryValue(value)
+			if !ok {
+				return nil, fmt.Errorf("value of %q in the payload sent in query should not be nested. %w", k, dtmcli.ErrInvalidArgument)
+			}
+			if value != nil {
+				query.Add(k, s)
+			}
+		}
+	}
+	return query, nil
+}
+
+func queryValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// checkPayloadsInQuery checks the payloads of the branches sent in query can be form-encoded
+func checkPayloadsInQuery(branches []TransBranch) error {
+	for _, b := range branches {
+		if b.Ext.PayloadInQuery {
+			if _, err := payloadQuery(b.BinData); err != nil {
+				return fmt.Errorf("branch %s %s: %w", b.BranchID, b.Op, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadQuery(t *testing.T) {
+	query, err := payloadQuery([]byte(`{"q":"a&b=c?d#e f+g/h","name":"中文 ü","ids":[1,2],"amount":12345678901234567890,"ok":true,"none":null}`))
+	assert.Nil(t, err)
+	assert.Equal(t, url.Values{"q": {"a&b=c?d#e f+g/h"}, "name": {"中文 ü"}, "ids": {"1", "2"}, "amount": {"12345678901234567890"}, "ok": {"true"}}, query)
+	assert.Equal(t, "amount=12345678901234567890&ids=1&ids=2&name=%E4%B8%AD%E6%96%87+%C3%BC&ok=true&q=a%26b%3Dc%3Fd%23e+f%2Bg%2Fh", query.Encode())
+
+	query, err = payloadQuery(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, url.Values{}, query)
+
+	for _, payload := range []string{`{"a":{"b":1}}`, `{"a":[[1]]}`, `{"a":[{"b":1}]}`, `[1]`, `"a"`} {
+		_, err = payloadQuery([]byte(payload))
+		assert.ErrorIs(t, err, dtmcli.ErrInvalidArgument, payload)
+	}
+	branches := []TransBranch{{BranchID: "01", Op: dtmcli.BranchAction, BinData: []byte(`{"a":{"b":1}}`)}}
+	assert.Nil(t, checkPayloadsInQuery(branches))
+	branches[0].Ext.PayloadInQuery = true
+	assert.ErrorIs(t, checkPayloadsInQuery(branches), dtmcli.ErrInvalidArgument)
+}
+
+func TestBranchPayloadInQuery(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer svr.Close()
+	tg := TransGlobal{}
+	tg.Gid = "gid1"
+	tg.TransType = "saga"
+	ext, err := branchExtFromMap(map[string]string{"payload_in_query": "1"})
+	assert.Nil(t, err)
+	branch := TransBranch{BranchID: "01", Op: dtmcli.BranchAction, URL: svr.URL + "/query?fixed=1",
+		BinData: []byte(`{"name":"中文&ü","tag":["a b","c"],"gid":"overridden"}`), Ext: ext}
+	assert.Nil(t, tg.getURLResult(&branch))
+	assert.Equal(t, "GET", received.Method)
+	assert.Empty(t, body)
+	query := received.URL.Query()
+	assert.Equal(t, "中文&ü", query.Get("name"))
+	assert.Equal(t, []string{"a b", "c"}, query["tag"])
+	assert.Equal(t, "1", query.Get("fixed"))
+	assert.Equal(t, []string{"gid1"}, query["gid"])
+	assert.Equal(t, "01", query.Get("branch_id"))
+}
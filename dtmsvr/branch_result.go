@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+)
+
+// a branch payload may refer to the result of a previous saga action, like {{result:branch-01.order_no}}
+// the path after the branch id is a dot separated json path of the result. array elements are referred by index
+const (
+	resultRefPrefix  = "{{result:"
+	resultRefPattern = `\{\{result:branch-([0-9]+)((?:\.[^.{}"]+)*)\}\}`
+)
+
+var (
+	quotedResultRefRegexp = regexp.MustCompile(`"` + resultRefPattern + `"`)
+	resultRefRegexp       = regexp.MustCompile(resultRefPattern)
+)
+
+// hasResultRefs returns whether the payload of the branch should be resolved before calling
+func (t *TransGlobal) hasResultRefs(branch *TransBranch) bool {
+	return t.TransType == "saga" && t.Protocol != "grpc" && branch.Ext.ContentType == "" && bytes.Contains(branch.BinData, []byte(resultRefPrefix))
+}
+
+// checkResultRefs checks the result references in the payloads, and flags the referred actions to keep their results.
+// an action can only refer to the previous actions, and a compensation can also refer to its own action
+func (t *TransGlobal) checkResultRefs(branches []TransBranch) error {
+	actions := map[string]*TransBranch{}
+	for i := range branches {
+		if branches[i].Op == dtmcli.BranchAction {
+			actions[branches[i].BranchID] = &branches[i]
+		}
+	}
+	for _, b := range branches {
+		if !t.hasResultRefs(&b) {
+			continue
+		}
+		if bytes.Count(b.BinData, []byte(resultRefPrefix)) != len(resultRefRegexp.FindAll(b.BinData, -1)) {
+			return fmt.Errorf("branch %s %s has bad result reference. %w", b.BranchID, b.Op, dtmcli.ErrFailure)
+		}
+		for _, m := range resultRefRegexp.FindAllSubmatch(b.BinData, -1) {
+			ref := string(m[1])
+			action := actions[ref]
+			refPos, pos := dtmimp.MustAtoi(ref), dtmimp.MustAtoi(b.BranchID)
+			if action == nil || refPos > pos || refPos == pos && b.Op == dtmcli.BranchAction {
+				return fmt.Errorf("branch %s %s can not refer to the result of branch %s. %w", b.BranchID, b.Op, ref, dtmcli.ErrFailure)
+			}
+			action.Ext.KeepResult = true
+		}
+	}
+	return nil
+}
+
+// resolveResultRefs replaces the result references in the payload with the stored results.
+// results contains the results of the succeeded actions, keyed by branch id
+func resolveResultRefs(payload []byte, results map[string]string) ([]byte, error) {
+	var rerr error
+	resolve := func(ref []byte, quoted bool) []byte {
+		if rerr != nil {
+			return ref
+		}
+		m := resultRefRegexp.FindSubmatch(ref)
+		var v interface{}
+		v, rerr = lookupResult(results, string(m[1]), string(m[2]))
+		if rerr != nil {
+			return ref
+		}
+		if quoted { // the whole json string is replaced, so the value keeps its json type
+			return dtmimp.MustMarshal(v)
+		}
+		s, ok := v.(string)
+		if !ok {
+			s = dtmimp.MustMarshalString(v)
+		}
+		escaped := dtmimp.MustMarshalString(s)
+		return []byte(escaped[1 : len(escaped)-1])
+	}
+	payload = quotedResultRefRegexp.ReplaceAllFunc(payload, func(ref []byte) []byte {
+		return resolve(ref, true)
+	})
+	payload = resultRefRegexp.ReplaceAllFunc(payload, func(ref []byte) []byte {
+		return resolve(ref, false)
+	})
+	return payload, rerr
+}
+
+func lookupResult(results map[string]string, branchID string, path string) (interface{}, error) {
+	result, ok := results[branchID]
+	if !ok {
+		return nil, fmt.Errorf("result of branch %s not found", branchID)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(result), &v); err != nil {
+		if path == "" { // a plain text result can be referred as a whole
+			return result, nil
+		}
+		return nil, fmt.Errorf("result of branch %s is not json: %v", branchID, err)
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		if key == "" {
+			continue
+		}
+		switch cur := v.(type) {
+		case nil: // null result or null field, the value referred is null
+			return nil, nil
+		case map[string]interface{}:
+			if v, ok = cur[key]; !ok {
+				return nil, fmt.Errorf("%s not found in result of branch %s", path, branchID)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil, fmt.Errorf("%s not found in result of branch %s", path, branchID)
+			}
+			v = cur[i]
+		default:
+			return nil, fmt.Errorf("%s not found in result of branch %s", path, branchID)
+		}
+	}
+	return v, nil
+}
+
+// markManual records that the trans needs manual attention. the trans is still retried by cron
+func (t *TransGlobal) markManual(reason string) {
+	logger.Gid(t.Gid).Errorf("trans %s needs manual attention: %s", t.Gid, reason)
+	if t.Ext.ManualReason == reason {
+		return
+	}
+	err := t.saveGlobal(t.Status, []string{"ext_data", "update_time"}, func() {
+		t.Ext.ManualReason = reason
+		t.ExtData = dtmimp.MustMarshalString(t.Ext)
+		now := time.Now()
+		t.UpdateTime = &now
+	})
+	dtmimp.E2P(err)
+}
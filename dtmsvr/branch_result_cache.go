@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// branchResultCache is a bounded lru of the branch results written by this instance recently, so that an identical
+// result reported again by a RM is acknowledged without writing the store. it only reduces writes: a result missing
+// in the cache is written as usual, and a different result of the same branch never hits the cache
+type branchResultCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+type branchResultEntry struct {
+	key    string
+	expire time.Time
+}
+
+// branchResults is disabled until it is created from the conf in StartSvr
+var branchResults = newBranchResultCache(0, 0)
+
+func newBranchResultCache(size int, ttl time.Duration) *branchResultCache {
+	return &branchResultCache{size: size, ttl: ttl, items: map[string]*list.Element{}, lru: list.New()}
+}
+
+// branchResultKey returns the key of the result of the branch. the content, such as the urls and the payload, is
+// hashed into the key, so that a different content is not acknowledged by the cache
+func branchResultKey(branch *TransBranch, status string, content []byte) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%x", branch.Gid, branch.BranchID, branch.Op, status, sha256.Sum256(content))
+}
+
+func (c *branchResultCache) disabled() bool {
+	return c.size <= 0 || c.ttl <= 0
+}
+
+// seen returns whether the result of the key is written in ttl
+func (c *branchResultCache) seen(key string) bool {
+	if c.disabled() {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.items[key]
+	if e == nil {
+		return false
+	}
+	if time.Now().After(e.Value.(*branchResultEntry).expire) {
+		c.lru.Remove(e)
+		delete(c.items, key)
+		return false
+	}
+	c.lru.MoveToFront(e)
+	return true
+}
+
+// add remembers the result of the key is written, and evicts the least recently used results beyond the size
+func (c *branchResultCache) add(key string) {
+	if c.disabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expire := time.Now().Add(c.ttl)
+	if e := c.items[key]; e != nil {
+		e.Value.(*branchResultEntry).expire = expire
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&branchResultEntry{key: key, expire: expire})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*branchResultEntry).key)
+	}
+}
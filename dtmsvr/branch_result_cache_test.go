@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBranchResultCache(t *testing.T) {
+	c := newBranchResultCache(2, time.Minute)
+	b := &TransBranch{Gid: "gid1", BranchID: "01", Op: dtmcli.BranchConfirm}
+	k1 := branchResultKey(b, dtmcli.StatusPrepared, []byte("payload1"))
+	assert.False(t, c.seen(k1))
+	c.add(k1)
+	assert.True(t, c.seen(k1))
+	assert.False(t, c.seen(branchResultKey(b, dtmcli.StatusPrepared, []byte("payload2"))))
+	assert.False(t, c.seen(branchResultKey(b, dtmcli.StatusSucceed, []byte("payload1"))))
+
+	b2 := &TransBranch{Gid: "gid1", BranchID: "02", Op: dtmcli.BranchConfirm}
+	b3 := &TransBranch{Gid: "gid1", BranchID: "03", Op: dtmcli.BranchConfirm}
+	c.add(branchResultKey(b2, dtmcli.StatusPrepared, nil))
+	c.seen(k1) // k1 is used recently, so b2 is evicted
+	c.add(branchResultKey(b3, dtmcli.StatusPrepared, nil))
+	assert.True(t, c.seen(k1))
+	assert.False(t, c.seen(branchResultKey(b2, dtmcli.StatusPrepared, nil)))
+	assert.True(t, c.seen(branchResultKey(b3, dtmcli.StatusPrepared, nil)))
+
+	c = newBranchResultCache(2, time.Millisecond)
+	c.add(k1)
+	time.Sleep(5 * time.Millisecond)
+	assert.False(t, c.seen(k1))
+	assert.Equal(t, 0, c.lru.Len())
+
+	c = newBranchResultCache(0, time.Minute) // disabled
+	c.add(k1)
+	assert.False(t, c.seen(k1))
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveResultRefs(t *testing.T) {
+	results := map[string]string{
+		"01": `{"order_no":"A\"01","items":[{"id":3}]}`,
+		"02": `plain text`,
+	}
+	payload, err := resolveResultRefs([]byte(`{"order":"{{result:branch-01.order_no}}","id":"{{result:branch-01.items.0.id}}","desc":"id {{result:branch-01.items.0.id}} of {{result:branch-02}}"}`), results)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"order":"A\"01","id":3,"desc":"id 3 of plain text"}`, string(payload))
+
+	payload, err = resolveResultRefs([]byte(`{"items":"{{result:branch-01.items}}","null":"{{result:branch-03.a.b}}"}`), map[string]string{"01": results["01"], "03": "null"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"items":[{"id":3}],"null":null}`, string(payload))
+
+	for _, ref := range []string{"branch-01.none", "branch-01.items.1", "branch-01.order_no.a", "branch-02.a", "branch-04"} {
+		_, err = resolveResultRefs([]byte(`{"a":"{{result:`+ref+`}}"}`), results)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestCheckResultRefs(t *testing.T) {
+	tg := TransGlobal{}
+	tg.TransType = "saga"
+	tg.Protocol = "http"
+	genBranches := func(compensate string, action string) []TransBranch {
+		return []TransBranch{
+			{BranchID: "01", Op: dtmcli.BranchCompensate},
+			{BranchID: "01", Op: dtmcli.BranchAction},
+			{BranchID: "02", Op: dtmcli.BranchCompensate, BinData: []byte(compensate)},
+			{BranchID: "02", Op: dtmcli.BranchAction, BinData: []byte(action)},
+		}
+	}
+	branches := genBranches(`{"a":"{{result:branch-02.a}}"}`, `{"a":"{{result:branch-01.a}}"}`)
+	assert.Nil(t, tg.checkResultRefs(branches))
+	assert.True(t, branches[1].Ext.KeepResult)
+	assert.True(t, branches[3].Ext.KeepResult)
+
+	for _, action := range []string{`{"a":"{{result:branch-02.a}}"}`, `{"a":"{{result:branch-03}}"}`, `{"a":"{{result:order}}"}`} {
+		err := tg.checkResultRefs(genBranches("", action))
+		assert.True(t, errors.Is(err, dtmcli.ErrFailure), action)
+	}
+
+	tg.Protocol = "grpc"
+	assert.Nil(t, tg.checkResultRefs(genBranches("", `{"a":"{{result:order}}"}`)))
+}
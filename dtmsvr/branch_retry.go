@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// a branch with its own retry interval is retried and backed off by itself, instead of by the cron interval of the trans.
+// the trans is scheduled at the earliest time among its pending branches
+
+// backoffBranch schedules the next retry of a branch with its own retry interval, after it returned ONGOING or an error
+func (t *TransGlobal) backoffBranch(branch *TransBranch, branchPos int, err error) {
+	interval := dtmimp.If(branch.Ext.NextInterval > 0, branch.Ext.NextInterval, branch.Ext.RetryInterval).(int64)
+	if !errors.Is(err, dtmcli.ErrOngoing) && branch.Ext.NextRetryTime != nil { // backoff since the second error
+		interval *= 2
+	}
+	next := storage.Now().Add(time.Duration(interval) * time.Second) // in the clock of the store, like the next cron time
+	branch.Ext.NextInterval = interval
+	branch.Ext.NextRetryTime = &next
+	branch.ExtData = dtmimp.MustMarshalString(branch.Ext)
+	err = dtmimp.CatchP(func() {
+		t.persister().LockGlobalSaveBranches(t.Gid, t.Status, []TransBranch{*branch}, branchPos)
+	})
+	if err != nil { // the branch is retried by the cron of the trans
+		logger.Gid(t.Gid).Errorf("saving the retry time of branch %s %s of %s failed: %v", branch.BranchID, branch.Op, t.Gid, err)
+	}
+	t.scheduleBranchRetry(next)
+}
+
+// scheduleBranchRetry schedules the trans to retry a branch at the time, unless the trans is scheduled earlier in this process
+func (t *TransGlobal) scheduleBranchRetry(retryTime time.Time) {
+	if t.branchRetryTime == nil || retryTime.Before(*t.branchRetryTime) {
+		t.branchRetryTime = &retryTime
+	}
+	if t.touchedCronTime != nil && t.touchedCronTime.Before(retryTime) {
+		return
+	}
+	delay := uint64(1)
+	if d := retryTime.Sub(storage.Now()); d > 0 {
+		delay = uint64(d/time.Second) + 1
+	}
+	t.touchCronTime(cronKeep, delay)
+}
+
+type branchRetryInterval struct {
+	BranchID      string     `json:"branch_id"`
+	Op            string     `json:"op"`
+	RetryInterval int64      `json:"retry_interval"`            // the effective retry interval of the branch
+	NextRetryTime *time.Time `json:"next_retry_time,omitempty"` // for a branch with its own retry interval
+}
+
+// getBranchRetryIntervals returns the effective retry intervals of the branches, for query
+func getBranchRetryIntervals(trans *storage.TransGlobalStore, branches []TransBranch) []branchRetryInterval {
+	transInterval := dtmimp.If(trans.RetryInterval > 0, trans.RetryInterval, conf.RetryInterval).(int64)
+	intervals := []branchRetryInterval{}
+	for _, b := range branches {
+		ext := storage.TransBranchExt{}
+		if b.ExtData != "" {
+			dtmimp.MustUnmarshalString(b.ExtData, &ext)
+		}
+		interval := branchRetryInterval{BranchID: b.BranchID, Op: b.Op, RetryInterval: transInterval, NextRetryTime: ext.NextRetryTime}
+		if ext.NextInterval > 0 {
+			interval.RetryInterval = ext.NextInterval
+		} else if ext.RetryInterval > 0 {
+			interval.RetryInterval = ext.RetryInterval
+		}
+		intervals = append(intervals, interval)
+	}
+	return intervals
+}
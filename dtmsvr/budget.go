@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// transBudget is the declared options of a trans deciding how soon it can finish. the values not declared by the trans
+// or its branches, such as the retry interval of the config, are 0, so that they do not reject a trans
+type transBudget struct {
+	TransType      string
+	TimeoutToFail  int64 // the effective TimeoutToFail. 0 means the trans never times out
+	RetryInterval  int64 // declared by the trans, for the branches not declaring one
+	RequestTimeout int64 // declared by the trans, for the branches not declaring one
+	Branches       []branchBudget
+}
+
+type branchBudget struct {
+	BranchID       string
+	Delay          int64 // the branch is not called before this seconds after the trans is created
+	RetryInterval  int64
+	RequestTimeout int64
+}
+
+// BudgetError tells a branch of a trans cannot finish within the TimeoutToFail of the trans
+type BudgetError struct {
+	BranchID       string `json:"branch_id"`
+	Delay          int64  `json:"delay"`
+	RequestTimeout int64  `json:"request_timeout"`
+	RetryInterval  int64  `json:"retry_interval"`
+	Bound          int64  `json:"bound"` // the least seconds the branch needs
+	TimeoutToFail  int64  `json:"timeout_to_fail"`
+}
+
+func (e *BudgetError) Error() string {
+	if e.RetryInterval == 0 {
+		return fmt.Sprintf("delay %d of branch %s should not exceed TimeoutToFail %d", e.Delay, e.BranchID, e.TimeoutToFail)
+	}
+	return fmt.Sprintf("branch %s needs at least %ds to be retried once: delay %d + request timeout %d + retry interval %d, exceeding TimeoutToFail %d",
+		e.BranchID, e.Bound, e.Delay, e.RequestTimeout, e.RetryInterval, e.TimeoutToFail)
+}
+
+// Unwrap makes errors.Is(err, dtmcli.ErrFailure) true, so the trans is rejected
+func (e *BudgetError) Unwrap() error {
+	return dtmcli.ErrFailure
+}
+
+// checkBudget returns the first branch which cannot finish within TimeoutToFail, nil if none.
+// the bound of a branch is its delay. for a saga, which is rolled back on timeout, the branch declaring a retry
+// interval is expected to be retried, so its bound is the time of its first retry: the delay, plus the request timeout
+// of the first call, plus the retry interval. the msg is not rolled back once submitted, so only its delays are checked
+func checkBudget(b *transBudget) *BudgetError {
+	if b.TimeoutToFail <= 0 {
+		return nil
+	}
+	for _, br := range b.Branches {
+		e := BudgetError{BranchID: br.BranchID, Delay: br.Delay, TimeoutToFail: b.TimeoutToFail}
+		if b.TransType == "saga" {
+			e.RetryInterval = br.RetryInterval
+			if e.RetryInterval == 0 {
+				e.RetryInterval = b.RetryInterval
+			}
+		}
+		if e.RetryInterval > 0 {
+			e.RequestTimeout = br.RequestTimeout
+			if e.RequestTimeout == 0 {
+				e.RequestTimeout = b.RequestTimeout
+			}
+		}
+		e.Bound = e.Delay + e.RequestTimeout + e.RetryInterval
+		if e.Bound > b.TimeoutToFail {
+			return &e
+		}
+	}
+	return nil
+}
+
+// budget returns the declared options of the trans and its branches for checkBudget
+func (t *TransGlobal) budget(branches []TransBranch) *transBudget {
+	b := &transBudget{TransType: t.TransType, TimeoutToFail: t.TimeoutToFail, RetryInterval: t.RetryInterval, RequestTimeout: t.RequestTimeout}
+	if b.TimeoutToFail == 0 && t.TransType != "saga" { // the same as isTimeout
+		b.TimeoutToFail = conf.TimeoutToFail
+	}
+	for _, br := range branches {
+		if br.Op == dtmcli.BranchCompensate || br.Op == dtmcli.BranchCancel || br.Op == dtmcli.BranchRollback {
+			continue // the rollbacks are called after the timeout
+		}
+		bb := branchBudget{BranchID: br.BranchID, RetryInterval: br.Ext.RetryInterval, RequestTimeout: br.Ext.RequestTimeout}
+		if br.Ext.NotBefore != nil {
+			bb.Delay = int64((br.Ext.NotBefore.Sub(t.CreateTime.Add(storage.ClockSkew())) + time.Second - 1) / time.Second) // NotBefore is in the clock of the store
+		}
+		b.Branches = append(b.Branches, bb)
+	}
+	return b
+}
+
+// checkDurationBudget rejects the trans whose branches cannot finish within TimeoutToFail, or warns if
+// WarnDurationBudget is set
+func (t *TransGlobal) checkDurationBudget(branches []TransBranch) error {
+	e := checkBudget(t.budget(branches))
+	if e == nil {
+		return nil
+	} else if conf.WarnDurationBudget == 1 {
+		logger.Gid(t.Gid).Warnf("trans %s may time out: %s", t.Gid, e.Error())
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBudget(t *testing.T) {
+	cases := []struct {
+		name   string
+		budget transBudget
+		expect *BudgetError
+	}{
+		{"no timeout", transBudget{TransType: "saga", Branches: []branchBudget{{BranchID: "01", RetryInterval: 600}}}, nil},
+		{"no declared retry", transBudget{TransType: "saga", TimeoutToFail: 5, Branches: []branchBudget{{BranchID: "01", RequestTimeout: 10}}}, nil},
+		{"within", transBudget{TransType: "saga", TimeoutToFail: 60, RequestTimeout: 10, Branches: []branchBudget{{BranchID: "01", RetryInterval: 50}}}, nil},
+		{"branch retry", transBudget{TransType: "saga", TimeoutToFail: 60, RequestTimeout: 10, Branches: []branchBudget{{BranchID: "01"}, {BranchID: "02", RetryInterval: 51}}},
+			&BudgetError{BranchID: "02", RequestTimeout: 10, RetryInterval: 51, Bound: 61, TimeoutToFail: 60}},
+		{"trans retry", transBudget{TransType: "saga", TimeoutToFail: 60, RetryInterval: 30, Branches: []branchBudget{{BranchID: "01", RequestTimeout: 40}}},
+			&BudgetError{BranchID: "01", RequestTimeout: 40, RetryInterval: 30, Bound: 70, TimeoutToFail: 60}},
+		{"branch overrides trans", transBudget{TransType: "saga", TimeoutToFail: 60, RetryInterval: 90, Branches: []branchBudget{{BranchID: "01", RetryInterval: 20}}}, nil},
+		{"msg delay", transBudget{TransType: "msg", TimeoutToFail: 35, Branches: []branchBudget{{BranchID: "01", Delay: 30}, {BranchID: "02", Delay: 40}}},
+			&BudgetError{BranchID: "02", Delay: 40, Bound: 40, TimeoutToFail: 35}},
+		{"msg retry not checked", transBudget{TransType: "msg", TimeoutToFail: 35, RetryInterval: 60, Branches: []branchBudget{{BranchID: "01", Delay: 30}}}, nil},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expect, checkBudget(&c.budget), c.name)
+	}
+	e := checkBudget(&cases[3].budget)
+	assert.True(t, errors.Is(e, dtmcli.ErrFailure))
+	assert.Equal(t, "branch 02 needs at least 61s to be retried once: delay 0 + request timeout 10 + retry interval 51, exceeding TimeoutToFail 60", e.Error())
+}
+
+func TestCheckDurationBudget(t *testing.T) {
+	now := time.Now()
+	tg := TransGlobal{}
+	tg.Gid, tg.TransType, tg.CreateTime = "TestCheckDurationBudget", "saga", &now
+	tg.TimeoutToFail = 30
+	branches := []TransBranch{
+		{BranchID: "01", Op: dtmcli.BranchCompensate, Ext: storage.TransBranchExt{RetryInterval: 60}},
+		{BranchID: "01", Op: dtmcli.BranchAction, Ext: storage.TransBranchExt{RetryInterval: 20, RequestTimeout: 5}},
+	}
+	assert.Nil(t, tg.checkDurationBudget(branches))
+	branches[1].Ext.RetryInterval = 30
+	var e *BudgetError
+	assert.True(t, errors.As(tg.checkDurationBudget(branches), &e))
+	assert.Equal(t, int64(35), e.Bound)
+
+	conf.WarnDurationBudget = 1
+	defer func() { conf.WarnDurationBudget = 0 }()
+	assert.Nil(t, tg.checkDurationBudget(branches))
+}
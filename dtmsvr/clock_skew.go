@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// probeClockSkew measures the skew of the clock of the store to the local clock, which is used by the times of
+// scheduling computed by this server. a skew beyond ClockSkewWarn is logged, because the clocks should be synchronized
+func probeClockSkew() error {
+	skew, err := storage.MeasureSkew(GetStore().Now)
+	if err != nil {
+		return err
+	}
+	storage.SetClockSkew(skew)
+	clockSkewGauge.Set(skew.Seconds())
+	if abs := dtmimp.If(skew < 0, -skew, skew).(time.Duration); conf.ClockSkewWarn > 0 && abs > time.Duration(conf.ClockSkewWarn)*time.Second {
+		logger.Warnf("the clock of the store minus the clock of this server is %v, beyond ClockSkewWarn %ds. the next cron times are computed in the clock of the store, but the clocks should be synchronized",
+			skew.Round(time.Millisecond), conf.ClockSkewWarn)
+	}
+	return nil
+}
+
+// mayProbeClockSkew probes the clock skew, and logs the error. the skew probed last is kept if failed
+func mayProbeClockSkew() {
+	if err := dtmimp.CatchP(func() { dtmimp.E2P(probeClockSkew()) }); err != nil {
+		logger.Errorf("probe clock skew error: %v", err)
+	}
+}
+
+// cronProbeClockSkew probes the clock skew every ClockSkewInterval seconds, after the probe at startup
+func cronProbeClockSkew() {
+	for conf.ClockSkewInterval > 0 {
+		time.Sleep(time.Duration(conf.ClockSkewInterval) * time.Second)
+		mayProbeClockSkew()
+	}
+}
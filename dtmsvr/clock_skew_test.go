@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronTimeInStoreClock(t *testing.T) {
+	storage.SetClockSkew(30 * time.Second) // the store is 30s ahead of this server
+	defer storage.SetClockSkew(0)
+	tg := &TransGlobal{batchTouch: true}
+	tg.Gid, tg.Status, tg.RetryInterval = "clock-skew", "submitted", 10
+	tg.touchCronTime(cronReset, 0)
+	assert.WithinDuration(t, time.Now().Add(40*time.Second), *tg.NextCronTime, time.Second)
+	tg.touchCronTime(cronKeep, 5)
+	assert.WithinDuration(t, time.Now().Add(35*time.Second), *tg.NextCronTime, time.Second)
+	cronTouches.take(true)
+
+	tg.touchedCronTime = nil
+	tg.scheduleBranchRetry(storage.Now().Add(3 * time.Second)) // a branch retry time in the clock of the store
+	assert.WithinDuration(t, time.Now().Add(33*time.Second), *tg.NextCronTime, time.Second)
+	cronTouches.take(true)
+}
+
+func TestProbeClockSkew(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+	storage.SetClockSkew(time.Hour)
+	defer storage.SetClockSkew(0)
+	assert.Nil(t, probeClockSkew())
+	assert.InDelta(t, 0, storage.ClockSkew().Seconds(), 0.1) // the memory store is of the local clock
+}
+
+func TestMsgDelayInStoreClock(t *testing.T) {
+	storage.SetClockSkew(30 * time.Second) // the store is 30s ahead of this server
+	defer storage.SetClockSkew(0)
+	now := time.Now()
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.TimeoutToFail = "clock-skew-msg", "msg", 20
+	tg.CreateTime = &now
+	tg.Steps = []map[string]string{{dtmcli.BranchAction: "http://localhost/action", "delay": "10"}}
+	tg.BinPayloads = [][]byte{[]byte("{}")}
+	branches, err := tg.getProcessor().GenBranches()
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(40*time.Second), *branches[0].Ext.NotBefore)
+	assert.Nil(t, tg.checkDurationBudget(branches)) // the delay is 10s, not including the skew
+
+	toRun, notBefore := msgBranchesToRun(branches)
+	assert.Empty(t, toRun)
+	assert.Equal(t, branches[0].Ext.NotBefore, notBefore)
+	passed := now.Add(10 * time.Second) // passed in the clock of the store, not in the local clock
+	branches[0].Ext.NotBefore = &passed
+	toRun, _ = msgBranchesToRun(branches)
+	assert.Equal(t, []int{0}, toRun)
+}
+
+func TestUnquarantineInStoreClock(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+	storage.SetClockSkew(30 * time.Second)
+	defer storage.SetClockSkew(0)
+
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.Protocol = "clock-skew-unquarantine", "saga", "http"
+	tg.Status = dtmcli.StatusSubmitted
+	tg.Steps = []map[string]string{{dtmcli.BranchAction: "http://localhost/action", dtmcli.BranchCompensate: "http://localhost/compensate"}}
+	tg.BinPayloads = [][]byte{[]byte("{}")}
+	_, err := tg.saveNew()
+	assert.Nil(t, err)
+	assert.Nil(t, GetStore().ChangeGlobalStatus(&tg.TransGlobalStore, dtmcli.StatusQuarantined, []string{"status"}, false))
+	assert.Nil(t, svcUnquarantine(tg.Gid))
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), *GetStore().FindTransGlobalStore(tg.Gid).NextCronTime, time.Second)
+}
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"strconv"
+	"strings"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
@@ -18,8 +23,16 @@ const (
 	Redis = "redis"
 	// BoltDb is boltdb driver
 	BoltDb = "boltdb"
+	// Memory is the in-memory driver, which is not durable
+	Memory = "memory"
 	// Postgres is postgres driver
 	Postgres = "postgres"
+	// Kafka is kafka event publisher driver
+	Kafka = "kafka"
+	// OverflowDrop drops the event when the event buffer is full
+	OverflowDrop = "drop"
+	// OverflowBlock blocks the caller when the event buffer is full
+	OverflowBlock = "block"
 )
 
 // MicroService config type for micro service
@@ -34,22 +47,58 @@ type Log struct {
 	Outputs            string `yaml:"Outputs" default:"stderr"`
 	RotationEnable     int64  `yaml:"RotationEnable" default:"0"`
 	RotationConfigJSON string `yaml:"RotationConfigJSON" default:"{}"`
+	AccessLogSampling  string `yaml:"AccessLogSampling"` // sample rates of the access logs of apis, like "newGid:0,query:0.1". failed requests are always logged
+}
+
+// GetAccessLogSampling parses AccessLogSampling into the sample rates of apis, which are the last segments of the
+// http paths or grpc methods in lower case
+func (l *Log) GetAccessLogSampling() (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, s := range strings.Split(l.AccessLogSampling, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("AccessLogSampling should be like api:rate")
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("sample rate of %s should be between 0 and 1", parts[0])
+		}
+		rates[strings.ToLower(parts[0])] = rate
+	}
+	return rates, nil
 }
 
 // Store defines storage relevant info
 type Store struct {
-	Driver             string `yaml:"Driver" default:"boltdb"`
-	Host               string `yaml:"Host"`
-	Port               int64  `yaml:"Port"`
-	User               string `yaml:"User"`
-	Password           string `yaml:"Password"`
-	MaxOpenConns       int64  `yaml:"MaxOpenConns" default:"500"`
-	MaxIdleConns       int64  `yaml:"MaxIdleConns" default:"500"`
-	ConnMaxLifeTime    int64  `yaml:"ConnMaxLifeTime" default:"5"`
-	DataExpire         int64  `yaml:"DataExpire" default:"604800"` // Trans data will expire in 7 days. only for redis/boltdb.
-	RedisPrefix        string `yaml:"RedisPrefix" default:"{a}"`   // Redis storage prefix. store data to only one slot in cluster
-	TransGlobalTable   string `yaml:"TransGlobalTable" default:"dtm.trans_global"`
-	TransBranchOpTable string `yaml:"TransBranchOpTable" default:"dtm.trans_branch_op"`
+	Driver                  string `yaml:"Driver" default:"boltdb"`
+	Host                    string `yaml:"Host"`
+	Port                    int64  `yaml:"Port"`
+	User                    string `yaml:"User"`
+	Password                string `yaml:"Password"`
+	MaxOpenConns            int64  `yaml:"MaxOpenConns" default:"500"`
+	MaxIdleConns            int64  `yaml:"MaxIdleConns" default:"500"`
+	ConnMaxLifeTime         int64  `yaml:"ConnMaxLifeTime" default:"5"`
+	PoolStatsInterval       int64  `yaml:"PoolStatsInterval" default:"10"`   // interval in seconds to export the statistics of db pools. 0 means not exported
+	PoolWaitThreshold       int64  `yaml:"PoolWaitThreshold" default:"1000"` // warn if the time in ms waiting for db connections grows more than this in an interval. 0 means no warning
+	StatementRetries        int64  `yaml:"StatementRetries" default:"2"`     // times to retry a statement out of transactions failed with a transient error, such as a deadlock. only for mysql/postgres
+	DataExpire              int64  `yaml:"DataExpire" default:"604800"`      // Trans data will expire in 7 days. only for redis/boltdb/memory.
+	RedisPrefix             string `yaml:"RedisPrefix" default:"{a}"`        // Redis storage prefix. store data to only one slot in cluster
+	BoltBatchDelay          int64  `yaml:"BoltBatchDelay" default:"0"`       // delay in ms to batch the concurrent writes of boltdb into one commit. 0 means not batched
+	TransGlobalTable        string `yaml:"TransGlobalTable" default:"dtm.trans_global"`
+	TransBranchOpTable      string `yaml:"TransBranchOpTable" default:"dtm.trans_branch_op"`
+	KVTable                 string `yaml:"KVTable" default:"dtm.kv"`
+	TransBranchAttemptTable string `yaml:"TransBranchAttemptTable" default:"dtm.trans_branch_attempt"`
+	TransEventTable         string `yaml:"TransEventTable" default:"dtm.trans_event"`
+	TransEventCounterTable  string `yaml:"TransEventCounterTable" default:"dtm.trans_event_counter"` // the row allocating the seqs of TransEventTable in the order of the commits
+	SchemaVersionTable      string `yaml:"SchemaVersionTable" default:"dtm.schema_version"`
+	TransPayloadTable       string `yaml:"TransPayloadTable" default:"dtm.trans_payload"`
+	DedupPayloadSize        int64  `yaml:"DedupPayloadSize"`                    // the identical payloads of a trans not smaller than this in bytes are saved once in TransPayloadTable. 0 means disabled. only for mysql/postgres, and not effective with EncryptionKeys
+	PayloadPurgeInterval    int64  `yaml:"PayloadPurgeInterval" default:"3600"` // the interval in seconds to purge the deduplicated payloads no longer referenced, which are kept for an interval at least
+	AutoMigrate             bool   `yaml:"AutoMigrate"`                         // apply the pending migrations of the schema at startup. if false, dtm refuses to start with pending migrations
+	EncryptionKeys          string `yaml:"EncryptionKeys"`                      // keys to encrypt payloads and custom data at rest, like "k2:base64key,k1:base64key". empty means disabled
 }
 
 // IsDB checks config driver is mysql or postgres
@@ -68,20 +117,176 @@ func (s *Store) GetDBConf() dtmcli.DBConf {
 	}
 }
 
+// EncryptionKey is a key to encrypt the data at rest
+type EncryptionKey struct {
+	ID  string
+	Key []byte // 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+}
+
+// GetEncryptionKeys parses EncryptionKeys. the first key is used to encrypt, and all the keys are used to decrypt,
+// so a key is rotated by putting the new key at the front
+func (s *Store) GetEncryptionKeys() ([]EncryptionKey, error) {
+	keys := []EncryptionKey{}
+	for _, k := range strings.Split(s.EncryptionKeys, ",") {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("EncryptionKeys should be like id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %s should be 16, 24 or 32 bytes in base64", parts[0])
+		}
+		keys = append(keys, EncryptionKey{ID: parts[0], Key: key})
+	}
+	return keys, nil
+}
+
+// HTTPClientProfile defines a named http client used to call branches
+type HTTPClientProfile struct {
+	Proxy              string `yaml:"Proxy"`              // proxy url, such as http://proxy.corp:3128
+	CAFile             string `yaml:"CAFile"`             // pem file of the private CA
+	InsecureSkipVerify int64  `yaml:"InsecureSkipVerify"` // skip tls verify if set to 1
+	Timeout            int64  `yaml:"Timeout"`            // request timeout in seconds. default to RequestTimeout
+	MaxIdleConns       int64  `yaml:"MaxIdleConns"`
+}
+
+// EventPublisher defines the publisher of trans lifecycle events
+type EventPublisher struct {
+	Driver         string `yaml:"Driver"`  // publisher driver, such as kafka. empty means disabled
+	Brokers        string `yaml:"Brokers"` // kafka brokers, separated by comma
+	Topic          string `yaml:"Topic" default:"dtm_trans_events"`
+	BufferSize     int64  `yaml:"BufferSize" default:"10000"`    // size of the in-memory event buffer
+	OverflowPolicy string `yaml:"OverflowPolicy" default:"drop"` // drop or block when the event buffer is full
+}
+
+// EventLog defines the log of the lifecycle events in the store, from which the consumers missing events catch up
+type EventLog struct {
+	Enabled       int64 `yaml:"Enabled"`                      // keep the events published by EventPublisher in the store if set to 1
+	Retention     int64 `yaml:"Retention" default:"604800"`   // events older than this in seconds are purged, unless not acknowledged by a consumer. 0 means kept forever
+	PurgeInterval int64 `yaml:"PurgeInterval" default:"3600"` // the interval in seconds to purge the events
+}
+
+// BranchAttempts defines the audit trail of the attempts of calling branches
+type BranchAttempts struct {
+	Enabled       int64 `yaml:"Enabled"`                      // record every attempt of calling a branch in the store if set to 1
+	ResponseLimit int64 `yaml:"ResponseLimit" default:"256"`  // the response or the error of an attempt is truncated to this size
+	Retention     int64 `yaml:"Retention" default:"604800"`   // attempts older than this in seconds are purged. 0 means kept forever
+	PurgeInterval int64 `yaml:"PurgeInterval" default:"3600"` // the interval in seconds to purge the attempts
+}
+
+// MsgBroker defines a message broker cluster, which can be the target of msg branches
+type MsgBroker struct {
+	Driver  string `yaml:"Driver"`  // broker driver, such as kafka
+	Brokers string `yaml:"Brokers"` // broker addresses, separated by comma
+}
+
+// PayloadTransform applies a transformer to the requests of the matched branches before they are sent
+type PayloadTransform struct {
+	URLPattern  string `yaml:"URLPattern"`  // regexp matching the urls of the branches. empty matches all
+	Header      string `yaml:"Header"`      // if not empty, the branches should have this header
+	HeaderValue string `yaml:"HeaderValue"` // if not empty, the header should be of this value
+	Transformer string `yaml:"Transformer"` // name of the transformer, such as hmac or envelope
+	Secret      string `yaml:"Secret"`      // secret of the signature
+	ProducerID  string `yaml:"ProducerID"`  // producer id in the envelope
+}
+
+// MarshalJSON masks the secret, so that it is not in the logs
+func (p PayloadTransform) MarshalJSON() ([]byte, error) {
+	type plain PayloadTransform
+	if p.Secret != "" {
+		p.Secret = "***"
+	}
+	return json.Marshal(plain(p))
+}
+
+// TargetRewrite rewrites the urls of the branches when they are called, such as after the RMs moved to other hosts.
+// the urls saved in the store are not changed
+type TargetRewrite struct {
+	Host   string `yaml:"Host" json:"host,omitempty"`     // the exact host of the urls to rewrite, with the port if any
+	Prefix string `yaml:"Prefix" json:"prefix,omitempty"` // the prefix of the urls to rewrite, if Host is empty
+	To     string `yaml:"To" json:"to"`                   // the host replacing Host, or the prefix replacing Prefix
+}
+
+// GidClaim claims gid prefixes for a caller, so that the other callers can not create or change the trans of them
+type GidClaim struct {
+	Token    string `yaml:"Token" json:"-"` // the token sent by the caller in the http header or grpc metadata dtm-caller-token
+	Prefixes string `yaml:"Prefixes"`       // the claimed gid prefixes, split by ","
+}
+
+// GetPrefixes returns the claimed prefixes
+func (g *GidClaim) GetPrefixes() []string {
+	prefixes := []string{}
+	for _, p := range strings.Split(g.Prefixes, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// GrpcCodeResult is the result of a grpc code in GrpcCodeResults
+type GrpcCodeResult = dtmcli.GrpcCodeResult
+
 type configType struct {
-	Store                         Store        `yaml:"Store"`
-	TransCronInterval             int64        `yaml:"TransCronInterval" default:"3"`
-	TimeoutToFail                 int64        `yaml:"TimeoutToFail" default:"35"`
-	RetryInterval                 int64        `yaml:"RetryInterval" default:"10"`
-	RequestTimeout                int64        `yaml:"RequestTimeout" default:"3"`
-	HTTPPort                      int64        `yaml:"HttpPort" default:"36789"`
-	GrpcPort                      int64        `yaml:"GrpcPort" default:"36790"`
-	JSONRPCPort                   int64        `yaml:"JsonRpcPort" default:"36791"`
-	MicroService                  MicroService `yaml:"MicroService"`
-	UpdateBranchSync              int64        `yaml:"UpdateBranchSync"`
-	UpdateBranchAsyncGoroutineNum int64        `yaml:"UpdateBranchAsyncGoroutineNum" default:"1"`
-	LogLevel                      string       `yaml:"LogLevel" default:"info"`
-	Log                           Log          `yaml:"Log"`
+	Store                         Store                        `yaml:"Store"`
+	TransCronInterval             int64                        `yaml:"TransCronInterval" default:"3"`
+	TimeoutToFail                 int64                        `yaml:"TimeoutToFail" default:"35"`
+	RetryInterval                 int64                        `yaml:"RetryInterval" default:"10"`
+	RequestTimeout                int64                        `yaml:"RequestTimeout" default:"3"`
+	HTTPPort                      int64                        `yaml:"HttpPort" default:"36789"`
+	GrpcPort                      int64                        `yaml:"GrpcPort" default:"36790"`
+	JSONRPCPort                   int64                        `yaml:"JsonRpcPort" default:"36791"`
+	MicroService                  MicroService                 `yaml:"MicroService"`
+	UpdateBranchSync              int64                        `yaml:"UpdateBranchSync"`
+	UpdateBranchAsyncGoroutineNum int64                        `yaml:"UpdateBranchAsyncGoroutineNum" default:"1"`
+	LogLevel                      string                       `yaml:"LogLevel" default:"info"`
+	Log                           Log                          `yaml:"Log"`
+	HTTPClientProfiles            map[string]HTTPClientProfile `yaml:"HttpClientProfiles"`
+	EventPublisher                EventPublisher               `yaml:"EventPublisher"`
+	BranchAttempts                BranchAttempts               `yaml:"BranchAttempts"`
+	EventLog                      EventLog                     `yaml:"EventLog"`
+	MsgBrokers                    map[string]MsgBroker         `yaml:"MsgBrokers"`
+	PayloadTransforms             []PayloadTransform           `yaml:"PayloadTransforms"`
+	TargetRewrites                []TargetRewrite              `yaml:"TargetRewrites"`                                  // the rules rewriting the urls of the branches when they are called. the first matched rule applies
+	GrpcCodeResults               map[string]GrpcCodeResult    `yaml:"GrpcCodeResults"`                                 // the results of the grpc codes returned by branches, such as FailedPrecondition. the trans can override them
+	TimeFormat                    string                       `yaml:"TimeFormat" default:"rfc3339"`                    // the format of the times in the responses of query apis: rfc3339 in UTC, or unix_ms. overridden by the query parameter time_format
+	GidClaims                     map[string]GidClaim          `yaml:"GidClaims"`                                       // the gid prefixes claimed by the callers, keyed by the names of the callers
+	GidClaimQuery                 int64                        `yaml:"GidClaimQuery"`                                   // the query api checks the claims too if set to 1
+	PassthroughHeaders            string                       `yaml:"PassthroughHeaders"`                              // headers passed from the requests creating trans to branches, split by ","
+	SensitiveHeaders              string                       `yaml:"SensitiveHeaders" default:"authorization,cookie"` // values of these headers are masked in logs and query, split by ","
+	ShowSensitiveHeaders          int64                        `yaml:"ShowSensitiveHeaders"`                            // show the values of sensitive headers if set to 1. for debug
+	QueryPayloadLimit             int64                        `yaml:"QueryPayloadLimit" default:"65536"`               // payloads larger than this size are truncated in query with payloads=decoded
+	GidMaxLength                  int64                        `yaml:"GidMaxLength" default:"128"`                      // max length of gids
+	GidPattern                    string                       `yaml:"GidPattern"`                                      // if not empty, gids should match this regexp instead of the default charset
+	DisableGidCheck               int64                        `yaml:"DisableGidCheck"`                                 // do not validate gids if set to 1. for legacy callers
+	ShowDecryptedData             int64                        `yaml:"ShowDecryptedData"`                               // show the payloads and custom data in query api if set to 1, when the store is encrypted
+	RollbackReasonLimit           int64                        `yaml:"RollbackReasonLimit" default:"4096"`              // the response of a failed branch longer than this size is truncated in rollback reason
+	ResponseBodyLimit             int64                        `yaml:"ResponseBodyLimit" default:"65536"`               // at most this size of a branch response body is read. 0 means no limit
+	AdminToken                    string                       `yaml:"AdminToken" json:"-"`                             // if not empty, admin apis require the header Authorization: Bearer <AdminToken>
+	CustomDataLimit               int64                        `yaml:"CustomDataLimit" default:"256"`                   // custom data updated by api longer than this size is rejected. 0 means no limit
+	SchedulingLagInterval         int64                        `yaml:"SchedulingLagInterval" default:"10"`              // the interval in seconds to probe the scheduling lag metrics. 0 means disabled
+	BranchPageThreshold           int64                        `yaml:"BranchPageThreshold" default:"1000"`              // the cron reads the branches of trans with more branches by pages. 0 means disabled
+	BranchPageSize                int64                        `yaml:"BranchPageSize" default:"200"`                    // the number of branches in a page
+	SubmitBatchLimit              int64                        `yaml:"SubmitBatchLimit" default:"1000"`                 // max number of msgs in a submit_batch request. 0 means no limit
+	BranchHeadersLimit            int64                        `yaml:"BranchHeadersLimit" default:"4096"`               // max total size of the headers of a branch. 0 means no limit
+	BranchResultCacheSize         int64                        `yaml:"BranchResultCacheSize" default:"10000"`           // max number of branch results cached to absorb duplicated reports. 0 means disabled
+	BranchResultCacheTTL          int64                        `yaml:"BranchResultCacheTTL" default:"5"`                // seconds a branch result is cached
+	PriorityAging                 int64                        `yaml:"PriorityAging" default:"60"`                      // a trans overdue for more than this seconds is processed as the max priority. 0 means never
+	CronTouchBatchSize            int64                        `yaml:"CronTouchBatchSize"`                              // the cron writes the next cron times of the processed trans in batches of this size. 0 means disabled
+	PoisonThreshold               int64                        `yaml:"PoisonThreshold" default:"5"`                     // a trans whose processing panics this many times in a row is quarantined. 0 means never
+	WarnDurationBudget            int64                        `yaml:"WarnDurationBudget"`                              // log a warning instead of rejecting the trans whose branches cannot finish within TimeoutToFail if set to 1
+	AdmissionBacklog              int64                        `yaml:"AdmissionBacklog"`                                // refuse new trans when this many trans are overdue, until 80% of it. 0 means disabled
+	AdmissionRetryAfter           int64                        `yaml:"AdmissionRetryAfter" default:"10"`                // the seconds in the header Retry-After of the refused requests
+	AdmissionOngoing              int64                        `yaml:"AdmissionOngoing"`                                // refuse new trans as ONGOING with 425 instead of BUSY with 429 if set to 1
+	HostConcurrency               map[string]int64             `yaml:"HostConcurrency"`                                 // max in-flight requests to the branches of each host, such as "legacy.corp:8080"
+	HostConcurrencyDefault        int64                        `yaml:"HostConcurrencyDefault"`                          // max in-flight requests to the branches of a host not in HostConcurrency. 0 means no limit
+	HostConcurrencyWait           int64                        `yaml:"HostConcurrencyWait" default:"100"`               // the ms waiting for a request slot of a host, after which the branch is ONGOING and retried later
+	ClockSkewInterval             int64                        `yaml:"ClockSkewInterval" default:"60"`                  // the interval in seconds to probe the skew of the clock of the store. 0 means probing only at startup
+	ClockSkewWarn                 int64                        `yaml:"ClockSkewWarn" default:"5"`                       // log a warning if the skew of the clock of the store is more than this seconds
+	ReadOnly                      bool                         `yaml:"ReadOnly"`                                        // refuse the requests changing trans, and do not process trans or run maintenance jobs. the queries work as usual
 }
 
 // Config 配置
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"os"
 	"testing"
@@ -15,6 +16,17 @@ func TestLoadFromEnv(t *testing.T) {
 	os.Setenv("T_DRIVER", "d1")
 	loadFromEnv("T", &ms)
 	assert.Equal(t, "d1", ms.Driver)
+
+	c := configType{}
+	os.Setenv("T_HTTP_CLIENT_PROFILES", `{"corp": {"Proxy": "http://proxy:3128", "Timeout": 5}}`)
+	loadFromEnv("T", &c)
+	assert.Equal(t, "http://proxy:3128", c.HTTPClientProfiles["corp"].Proxy)
+	assert.Equal(t, int64(5), c.HTTPClientProfiles["corp"].Timeout)
+
+	os.Setenv("T_STORE_AUTO_MIGRATE", "true")
+	loadFromEnv("T", &c)
+	assert.True(t, c.Store.AutoMigrate)
+	assert.Equal(t, "dtm.schema_version", c.Store.SchemaVersionTable)
 }
 
 func TestLoadConfig(t *testing.T) {
@@ -37,6 +49,27 @@ func TestCheckConfig(t *testing.T) {
 	driverErr := checkConfig(&conf)
 	assert.Equal(t, driverErr, nil)
 
+	conf.EventPublisher = EventPublisher{OverflowPolicy: "unknown"}
+	assert.Equal(t, errors.New("EventPublisher OverflowPolicy should be drop or block"), checkConfig(&conf))
+
+	conf.EventPublisher = EventPublisher{OverflowPolicy: OverflowDrop}
+	conf.EventLog.Enabled = 1
+	assert.Equal(t, errors.New("EventLog needs EventPublisher to publish the events"), checkConfig(&conf))
+
+	conf.EventPublisher = EventPublisher{Driver: Kafka, OverflowPolicy: OverflowDrop, Topic: "t"}
+	assert.Equal(t, errors.New("Kafka brokers or topic not valid"), checkConfig(&conf))
+	conf.EventPublisher.Brokers = "localhost:9092"
+	assert.Nil(t, checkConfig(&conf))
+	conf.EventLog.Enabled = 0
+
+	conf.TargetRewrites = []TargetRewrite{{Host: "old:8080", To: "new:8080"}, {Prefix: "http://old/", To: "rm://inventory/"}}
+	assert.Nil(t, checkConfig(&conf))
+	conf.TargetRewrites = []TargetRewrite{{Host: "old:8080", Prefix: "http://old/", To: "new:8080"}}
+	assert.Equal(t, errors.New("TargetRewrites 0 should have To, and one of Host and Prefix"), checkConfig(&conf))
+	conf.TargetRewrites = []TargetRewrite{{Host: "old:8080", To: "http://new:8080"}}
+	assert.Error(t, checkConfig(&conf))
+	conf.TargetRewrites = nil
+
 	conf.Store = Store{Driver: Mysql}
 	hostErr := checkConfig(&conf)
 	hostExpect := errors.New("Db host not valid ")
@@ -58,6 +91,77 @@ func TestCheckConfig(t *testing.T) {
 	conf.Store = Store{Driver: Redis, Host: "127.0.0.1", Port: 0}
 	assert.Equal(t, errors.New("Redis port not valid"), checkConfig(&conf))
 
+	conf.GidMaxLength = 256
+	conf.Store = Store{Driver: Redis, Host: "127.0.0.1", Port: 6379}
+	assert.Nil(t, checkConfig(&conf))
+	conf.Store = Store{Driver: BoltDb}
+	assert.Nil(t, checkConfig(&conf))
+	conf.Store = Store{Driver: Memory}
+	assert.Nil(t, checkConfig(&conf))
+	conf.Store = Store{Driver: Postgres, Host: "127.0.0.1", Port: 5432, User: "postgres"}
+	assert.Equal(t, errors.New("GidMaxLength should not be more than 128 for Db store"), checkConfig(&conf))
+	conf.GidMaxLength = 128
+	assert.Nil(t, checkConfig(&conf))
+
+	conf.GidPattern = "[a-z"
+	assert.Equal(t, errors.New("GidPattern not valid"), checkConfig(&conf))
+	conf.GidPattern = ""
+
+	conf.PayloadTransforms = []PayloadTransform{{URLPattern: "[a-z"}}
+	assert.Equal(t, errors.New("URLPattern [a-z of PayloadTransforms not valid"), checkConfig(&conf))
+	conf.PayloadTransforms = []PayloadTransform{{URLPattern: "/busi/"}}
+	assert.Equal(t, errors.New("Transformer of PayloadTransforms should not be empty"), checkConfig(&conf))
+	conf.PayloadTransforms = []PayloadTransform{{URLPattern: "/busi/", Transformer: "hmac", Secret: "secret"}}
+	assert.Nil(t, checkConfig(&conf))
+	cont, _ := json.Marshal(conf.PayloadTransforms)
+	assert.NotContains(t, string(cont), "secret")
+	conf.PayloadTransforms = nil
+
+	conf.GrpcCodeResults = map[string]GrpcCodeResult{"FAILED_PRECONDITION": {Result: "FAILURE"}}
+	assert.Contains(t, checkConfig(&conf).Error(), "GrpcCodeResults not valid")
+	conf.GrpcCodeResults = map[string]GrpcCodeResult{"FailedPrecondition": {Result: "FAILURE"}, "ResourceExhausted": {Result: "ONGOING", Delay: 30}}
+	assert.Nil(t, checkConfig(&conf))
+	conf.GrpcCodeResults = nil
+
+	conf.AdmissionBacklog, conf.SchedulingLagInterval = 1000, 0
+	assert.Equal(t, errors.New("AdmissionBacklog needs SchedulingLagInterval to probe the backlog"), checkConfig(&conf))
+	conf.SchedulingLagInterval = 10
+	assert.Nil(t, checkConfig(&conf))
+	conf.AdmissionBacklog = 0
+
+	conf.TimeFormat = "unix"
+	assert.Equal(t, errors.New("TimeFormat should be rfc3339 or unix_ms"), checkConfig(&conf))
+	conf.TimeFormat = "unix_ms"
+	assert.Nil(t, checkConfig(&conf))
+
+	conf.GidClaims = map[string]GidClaim{"order": {Token: "t1", Prefixes: " ,"}}
+	assert.Equal(t, errors.New("GidClaims of order should have Token and Prefixes"), checkConfig(&conf))
+	conf.GidClaims["order"] = GidClaim{Token: "t1", Prefixes: "order-, ord_"}
+	assert.Nil(t, checkConfig(&conf))
+	conf.GidClaims["payment"] = GidClaim{Token: "t1", Prefixes: "pay-"}
+	assert.Contains(t, checkConfig(&conf).Error(), "have the same Token")
+	conf.GidClaims["payment"] = GidClaim{Token: "t2", Prefixes: "pay-,ord_"}
+	assert.Contains(t, checkConfig(&conf).Error(), "gid prefix ord_ is claimed by both")
+	conf.GidClaims["payment"] = GidClaim{Token: "t2", Prefixes: "pay-,order"} // a shorter prefix is allowed
+	assert.Nil(t, checkConfig(&conf))
+	conf.GidClaims = nil
+
+	conf.HostConcurrency = map[string]int64{"legacy.corp:8080": -1}
+	assert.Equal(t, errors.New("HostConcurrency of legacy.corp:8080 should not be negative"), checkConfig(&conf))
+	conf.HostConcurrency["legacy.corp:8080"] = 8
+	conf.HostConcurrencyWait = -1
+	assert.Equal(t, errors.New("HostConcurrencyDefault and HostConcurrencyWait should not be negative"), checkConfig(&conf))
+	conf.HostConcurrencyWait = 100
+	assert.Nil(t, checkConfig(&conf))
+
+	conf.Log.AccessLogSampling = "newGid"
+	assert.Equal(t, errors.New("AccessLogSampling should be like api:rate"), checkConfig(&conf))
+	conf.Log.AccessLogSampling = "newGid:2"
+	assert.Equal(t, errors.New("sample rate of newGid should be between 0 and 1"), checkConfig(&conf))
+	conf.Log.AccessLogSampling = "newGid:0, query:0.1"
+	assert.Nil(t, checkConfig(&conf))
+	rates, _ := conf.Log.GetAccessLogSampling()
+	assert.Equal(t, map[string]float64{"newgid": 0, "query": 0.1}, rates)
 }
 
 func TestConfig(t *testing.T) {
@@ -6,9 +6,11 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmgrpc"
 )
 
 func loadFromEnv(prefix string, conf interface{}) {
@@ -42,6 +44,27 @@ func loadFromEnvInner(prefix string, conf reflect.Value, defaultValue string) {
 			str = "0"
 		}
 		conf.Set(reflect.ValueOf(int64(dtmimp.MustAtoi(str))))
+	case reflect.Bool:
+		str := os.Getenv(toUnderscoreUpper(prefix))
+		if str == "" {
+			str = defaultValue
+		}
+		if str == "" {
+			str = "false"
+		}
+		b, err := strconv.ParseBool(str)
+		dtmimp.E2P(err)
+		conf.SetBool(b)
+	case reflect.Map, reflect.Slice: // complex values are specified as json in env
+		str := os.Getenv(toUnderscoreUpper(prefix))
+		if str == "" {
+			str = defaultValue
+		}
+		if str != "" {
+			v := reflect.New(conf.Type())
+			dtmimp.MustUnmarshalString(str, v.Interface())
+			conf.Set(v.Elem())
+		}
 	default:
 		panic(fmt.Errorf("unsupported type: %s", conf.Type().Name()))
 	}
@@ -65,10 +88,62 @@ func checkConfig(conf *configType) error {
 	if conf.TimeoutToFail < conf.RetryInterval {
 		return errors.New("TimeoutToFail should not be less than RetryInterval")
 	}
+	if conf.EventPublisher.OverflowPolicy != OverflowDrop && conf.EventPublisher.OverflowPolicy != OverflowBlock {
+		return errors.New("EventPublisher OverflowPolicy should be drop or block")
+	}
+	if conf.EventPublisher.Driver == Kafka && (conf.EventPublisher.Brokers == "" || conf.EventPublisher.Topic == "") {
+		return errors.New("Kafka brokers or topic not valid")
+	}
+	if conf.EventLog.Enabled == 1 && conf.EventPublisher.Driver == "" {
+		return errors.New("EventLog needs EventPublisher to publish the events")
+	}
+	if _, err := regexp.Compile(conf.GidPattern); err != nil {
+		return errors.New("GidPattern not valid")
+	}
+	for _, pt := range conf.PayloadTransforms {
+		if _, err := regexp.Compile(pt.URLPattern); err != nil {
+			return fmt.Errorf("URLPattern %s of PayloadTransforms not valid", pt.URLPattern)
+		}
+		if pt.Transformer == "" {
+			return errors.New("Transformer of PayloadTransforms should not be empty")
+		}
+	}
+	if err := CheckTargetRewrites(conf.TargetRewrites); err != nil {
+		return err
+	}
+	if err := dtmgrpc.CheckGrpcCodeResults(conf.GrpcCodeResults); err != nil {
+		return fmt.Errorf("GrpcCodeResults not valid: %v", err)
+	}
+	if conf.AdmissionBacklog > 0 && conf.SchedulingLagInterval <= 0 {
+		return errors.New("AdmissionBacklog needs SchedulingLagInterval to probe the backlog")
+	}
+	if conf.TimeFormat != "rfc3339" && conf.TimeFormat != "unix_ms" {
+		return errors.New("TimeFormat should be rfc3339 or unix_ms")
+	}
+	if err := checkGidClaims(conf.GidClaims); err != nil {
+		return err
+	}
+	for host, n := range conf.HostConcurrency {
+		if n < 0 {
+			return fmt.Errorf("HostConcurrency of %s should not be negative", host)
+		}
+	}
+	if conf.HostConcurrencyDefault < 0 || conf.HostConcurrencyWait < 0 {
+		return errors.New("HostConcurrencyDefault and HostConcurrencyWait should not be negative")
+	}
+	if _, err := conf.Store.GetEncryptionKeys(); err != nil {
+		return err
+	}
+	if _, err := conf.Log.GetAccessLogSampling(); err != nil {
+		return err
+	}
 	switch conf.Store.Driver {
-	case BoltDb:
+	case BoltDb, Memory:
 		return nil
 	case Mysql, Postgres:
+		if conf.GidMaxLength > 128 {
+			return errors.New("GidMaxLength should not be more than 128 for Db store")
+		}
 		if conf.Store.Host == "" {
 			return errors.New("Db host not valid ")
 		}
@@ -88,3 +163,38 @@ func checkConfig(conf *configType) error {
 	}
 	return nil
 }
+
+// checkGidClaims checks the tokens and the prefixes of the callers are not empty, and not claimed by two callers
+func checkGidClaims(claims map[string]GidClaim) error {
+	tokens := map[string]string{}
+	prefixes := map[string]string{}
+	for name, claim := range claims {
+		if claim.Token == "" || len(claim.GetPrefixes()) == 0 {
+			return fmt.Errorf("GidClaims of %s should have Token and Prefixes", name)
+		}
+		if tokens[claim.Token] != "" {
+			return fmt.Errorf("GidClaims of %s and %s have the same Token", tokens[claim.Token], name)
+		}
+		tokens[claim.Token] = name
+		for _, p := range claim.GetPrefixes() {
+			if prefixes[p] != "" && prefixes[p] != name {
+				return fmt.Errorf("gid prefix %s is claimed by both %s and %s", p, prefixes[p], name)
+			}
+			prefixes[p] = name
+		}
+	}
+	return nil
+}
+
+// CheckTargetRewrites checks every rule of TargetRewrites has one of Host and Prefix, and To
+func CheckTargetRewrites(rules []TargetRewrite) error {
+	for i, r := range rules {
+		if (r.Host == "") == (r.Prefix == "") || r.To == "" {
+			return fmt.Errorf("TargetRewrites %d should have To, and one of Host and Prefix", i)
+		}
+		if r.Host != "" && strings.ContainsAny(r.Host+r.To, "/?#") {
+			return fmt.Errorf("Host and To of TargetRewrites %d should be hosts, like legacy.corp:8080", i)
+		}
+	}
+	return nil
+}
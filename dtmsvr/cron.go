@@ -8,7 +8,6 @@ package dtmsvr
 
 import (
 	"errors"
-	"fmt"
 	"math/rand"
 	"runtime/debug"
 	"time"
@@ -16,6 +15,7 @@ import (
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 )
 
 // NowForwardDuration will be set in test, trans may be timeout
@@ -27,14 +27,19 @@ var CronForwardDuration = time.Duration(0)
 // CronTransOnce cron expired trans. use expireIn as expire time
 func CronTransOnce() (gid string) {
 	defer handlePanic(nil)
+	defer func() { cronTouches.mayFlush(gid == "") }() // all the touches are written when no trans is expired
+	// a read-only server claims no trans, while the trans being processed are finished
+	if isReadOnly() {
+		return
+	}
 	trans := lockOneTrans(CronForwardDuration)
 	if trans == nil {
 		return
 	}
 	gid = trans.Gid
 	trans.WaitResult = true
-	branches := GetStore().FindBranches(gid)
-	err := trans.Process(branches)
+	trans.batchTouch = conf.CronTouchBatchSize > 0
+	err := trans.processCron()
 	dtmimp.PanicIf(err != nil && !errors.Is(err, dtmcli.ErrFailure), err)
 	return
 }
@@ -54,15 +59,22 @@ func lockOneTrans(expireIn time.Duration) *TransGlobal {
 	if global == nil {
 		return nil
 	}
-	logger.Infof("cron job return a trans: %s", global.String())
+	logger.Gid(global.Gid).Infof("cron job return a trans: %s", global.String())
 	return &TransGlobal{TransGlobalStore: *global}
 }
 
 func handlePanic(perr *error) {
 	if err := recover(); err != nil {
-		logger.Errorf("----recovered panic %v\n%s", err, string(debug.Stack()))
+		var conflict *storage.StatusConflictError
+		var vconflict *storage.VersionConflictError
+		if e, ok := err.(error); ok && (errors.As(e, &conflict) || errors.As(e, &vconflict)) { // the trans is handled by others, such as another dtm server
+			logger.Debugf("skip processing: %v", e)
+			return
+		}
+		stack := string(debug.Stack())
+		logger.Errorf("----recovered panic %v\n%s", err, stack)
 		if perr != nil {
-			*perr = fmt.Errorf("dtm panic: %v", err)
+			*perr = &panicError{value: err, stack: stack}
 		}
 	}
 }
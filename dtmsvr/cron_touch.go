@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// the max delay of writing a touch collected by the cron
+const cronTouchMaxDelay = time.Second
+
+// cronTouchBatch collects the cron time touches of the trans processed by the cron, so that they are written in
+// batches. delaying the touches is safe, because the trans locked by the cron have been pushed to the next retry
+type cronTouchBatch struct {
+	mu      sync.Mutex
+	updates []storage.CronTimeUpdate
+	index   map[string]int // gid => position in updates
+	first   time.Time      // the time of the first touch in the batch
+}
+
+var cronTouches = &cronTouchBatch{}
+
+// add adds a touch of the trans. a later touch of the same trans replaces the earlier one
+func (b *cronTouchBatch) add(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	snapshot := *global
+	u := storage.CronTimeUpdate{Global: &snapshot, NextCronInterval: nextCronInterval, NextCronTime: nextCronTime}
+	if i, ok := b.index[global.Gid]; ok {
+		b.updates[i] = u
+		return
+	}
+	if len(b.updates) == 0 {
+		b.index = map[string]int{}
+		b.first = time.Now()
+	}
+	b.index[global.Gid] = len(b.updates)
+	b.updates = append(b.updates, u)
+}
+
+// take takes out the touches to write, if forced, or the batch is full or has been delayed for long
+func (b *cronTouchBatch) take(force bool) []storage.CronTimeUpdate {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.updates) == 0 || !force && int64(len(b.updates)) < conf.CronTouchBatchSize && time.Since(b.first) < cronTouchMaxDelay {
+		return nil
+	}
+	updates := b.updates
+	b.updates = nil
+	b.index = nil
+	return updates
+}
+
+// mayFlush writes the touches taken. a failure is only logged, the trans will be processed after the retry interval
+func (b *cronTouchBatch) mayFlush(force bool) {
+	updates := b.take(force)
+	if len(updates) == 0 {
+		return
+	}
+	err := dtmimp.CatchP(func() { GetStore().TouchCronTimes(updates) })
+	if err != nil {
+		logger.Errorf("TouchCronTimes of %d trans failed: %v", len(updates), err)
+	} else {
+		logger.Debugf("TouchCronTimes of %d trans", len(updates))
+	}
+}
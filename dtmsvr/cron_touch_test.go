@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronTouchBatch(t *testing.T) {
+	old := conf.CronTouchBatchSize
+	defer func() { conf.CronTouchBatchSize = old }()
+	conf.CronTouchBatchSize = 2
+	b := &cronTouchBatch{}
+	next := time.Now().Add(10 * time.Second)
+	global := &storage.TransGlobalStore{Gid: "g1", Status: "prepared"}
+	b.add(global, 10, &next)
+	global.Status = "submitted" // the snapshot is not changed
+	later := next.Add(time.Second)
+	b.add(global, 20, &later)
+	assert.Nil(t, b.take(false))
+
+	b.add(&storage.TransGlobalStore{Gid: "g2"}, 10, &next)
+	updates := b.take(false)
+	assert.Equal(t, 2, len(updates))
+	assert.Equal(t, int64(20), updates[0].NextCronInterval)
+	assert.Equal(t, "submitted", updates[0].Global.Status)
+	assert.Equal(t, "g2", updates[1].Global.Gid)
+	assert.Nil(t, b.take(true))
+
+	b.add(global, 10, &next)
+	assert.Equal(t, 1, len(b.take(true)))
+	b.add(global, 10, &next)
+	b.first = time.Now().Add(-cronTouchMaxDelay)
+	assert.Equal(t, 1, len(b.take(false)))
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+// Package engine processes the trans by the processors of dtm server, without running dtm server. the branches are
+// called by a BranchInvoker, and every write of the processing goes to a ChangePersister, so the processing can be
+// driven by fake invokers and an in-memory persister, such as in tests
+package engine
+
+import (
+	"github.com/dtm-labs/dtm/dtmsvr"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// BranchInvoker calls a branch, and returns its result. see dtmsvr.BranchInvoker
+type BranchInvoker = dtmsvr.BranchInvoker
+
+// ChangePersister persists the writes of processing a trans. storage.Store is a ChangePersister
+type ChangePersister = dtmsvr.ChangePersister
+
+// Engine processes the trans with the branches invoked by Invoker, and the writes persisted by Persister. a nil Invoker
+// calls the branches by their protocols, and a nil Persister is the store of dtm
+type Engine struct {
+	Invoker   BranchInvoker
+	Persister ChangePersister
+}
+
+// New creates an engine
+func New(invoker BranchInvoker, persister ChangePersister) *Engine {
+	return &Engine{Invoker: invoker, Persister: persister}
+}
+
+// Process processes the trans once with its branches, and waits for the result. the status of the trans and the
+// branches are updated in place, as they are persisted
+func (e *Engine) Process(global *storage.TransGlobalStore, branches []storage.TransBranchStore) error {
+	return dtmsvr.ProcessWith(global, branches, e.Invoker, e.Persister)
+}
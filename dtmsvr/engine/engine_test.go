@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// memPersister is an in-memory ChangePersister of a trans
+type memPersister struct {
+	sync.Mutex
+	global   storage.TransGlobalStore
+	branches []storage.TransBranchStore
+	statuses []string
+	attempts []storage.BranchAttempt
+}
+
+func (m *memPersister) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := storage.GlobalConflict(global, global.Status, &m.global); err != nil {
+		return err
+	}
+	global.Version++
+	m.global.Status, m.global.Version = newStatus, global.Version
+	m.statuses = append(m.statuses, newStatus)
+	return nil
+}
+
+func (m *memPersister) FindTransGlobalStore(gid string) *storage.TransGlobalStore {
+	m.Lock()
+	defer m.Unlock()
+	g := m.global
+	return &g
+}
+
+func (m *memPersister) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) []bool {
+	m.Lock()
+	defer m.Unlock()
+	saved := make([]bool, len(branches))
+	for i, b := range branches {
+		if !storage.IsBranchDowngrade(&m.branches[branchStart+i], &b) {
+			m.branches[branchStart+i], saved[i] = b, true
+		}
+	}
+	return saved
+}
+
+func (m *memPersister) TouchCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
+}
+
+func (m *memPersister) FindBranch(gid string, branchID string, op string) *storage.TransBranchStore {
+	m.Lock()
+	defer m.Unlock()
+	for _, b := range m.branches {
+		if b.BranchID == branchID && b.Op == op {
+			return &b
+		}
+	}
+	return nil
+}
+
+func (m *memPersister) SaveAttempt(attempt *storage.BranchAttempt) error {
+	m.Lock()
+	defer m.Unlock()
+	m.attempts = append(m.attempts, *attempt)
+	return nil
+}
+
+func (m *memPersister) SaveEvent(event *storage.EventRecord) error {
+	return nil
+}
+
+func (m *memPersister) Ping() error {
+	return nil
+}
+
+// newEngineSaga returns a saga of the steps, with the branches generated as dtm server does
+func newEngineSaga(steps int) (*storage.TransGlobalStore, []storage.TransBranchStore, *memPersister) {
+	global := &storage.TransGlobalStore{Gid: "engine", TransType: "saga", Status: dtmcli.StatusSubmitted, Protocol: "http"}
+	branches := []storage.TransBranchStore{}
+	for i := 0; i < steps; i++ {
+		global.Steps = append(global.Steps, map[string]string{dtmcli.BranchAction: "action", dtmcli.BranchCompensate: "compensate"})
+		global.BinPayloads = append(global.BinPayloads, []byte("{}"))
+		for _, op := range []string{dtmcli.BranchCompensate, dtmcli.BranchAction} {
+			branches = append(branches, storage.TransBranchStore{Gid: global.Gid, BranchID: fmt.Sprintf("%02d", i+1),
+				BinData: []byte("{}"), URL: op, Op: op, Status: dtmcli.StatusPrepared})
+		}
+	}
+	return global, branches, &memPersister{global: *global, branches: append([]storage.TransBranchStore{}, branches...)}
+}
+
+func TestEngineSagaSucceed(t *testing.T) {
+	global, branches, persister := newEngineSaga(2)
+	calls := []string{}
+	e := New(func(ctx context.Context, b *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		calls = append(calls, b.BranchID+b.Op)
+		return dtmcli.ResultSuccess, "", nil
+	}, persister)
+	assert.Nil(t, e.Process(global, branches))
+	assert.Equal(t, []string{"01action", "02action"}, calls)
+	assert.Equal(t, dtmcli.StatusSucceed, global.Status)
+	assert.Equal(t, []string{dtmcli.StatusSucceed}, persister.statuses)
+	assert.Equal(t, dtmcli.StatusSucceed, persister.branches[1].Status)
+}
+
+func TestEngineSagaRollback(t *testing.T) {
+	global, branches, persister := newEngineSaga(2)
+	calls := []string{}
+	e := New(func(ctx context.Context, b *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		calls = append(calls, b.BranchID+b.Op)
+		if b.BranchID == "02" && b.Op == dtmcli.BranchAction {
+			return dtmcli.ResultFailure, "insufficient balance", nil
+		}
+		return dtmcli.ResultSuccess, "", nil
+	}, persister)
+	assert.Nil(t, e.Process(global, branches))
+	assert.Equal(t, []string{"01action", "02action", "02compensate", "01compensate"}, calls)
+	assert.Equal(t, dtmcli.StatusFailed, global.Status)
+	assert.Equal(t, []string{dtmcli.StatusAborting, dtmcli.StatusFailed}, persister.statuses)
+}
+
+func TestEngineStaleFailure(t *testing.T) {
+	global, branches, persister := newEngineSaga(1)
+	// the branch is compensated by another process, after the branches of this process are read
+	persister.branches[0].Status = dtmcli.StatusSucceed
+	persister.global.Status = dtmcli.StatusFailed
+	global.Status = dtmcli.StatusAborting
+	calls := 0
+	e := New(func(ctx context.Context, b *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		calls++
+		return dtmcli.ResultFailure, "", nil
+	}, persister)
+	assert.Nil(t, e.Process(global, branches))
+	assert.Equal(t, 0, calls) // the compensated branch is not called again
+	assert.Empty(t, persister.statuses)
+	assert.Equal(t, dtmcli.StatusSucceed, persister.branches[0].Status)
+}
+
+func TestEngineOngoing(t *testing.T) {
+	global, branches, persister := newEngineSaga(1)
+	e := New(func(ctx context.Context, b *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		return dtmcli.ResultOngoing, "", nil
+	}, persister)
+	assert.Nil(t, e.Process(global, branches)) // the ongoing branch is retried by the cron
+
+	assert.Equal(t, dtmcli.StatusSubmitted, global.Status)
+	assert.Equal(t, dtmcli.StatusPrepared, persister.branches[1].Status)
+}
+
+func TestEngineVersionConflict(t *testing.T) {
+	global, branches, persister := newEngineSaga(1)
+	persister.global.Version, persister.global.CustomData = 1, "changed" // changed by others after read
+	e := New(func(ctx context.Context, b *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		return dtmcli.ResultSuccess, "", nil
+	}, persister)
+	assert.Nil(t, e.Process(global, branches)) // re-read and saved again
+
+	assert.Equal(t, dtmcli.StatusSucceed, global.Status)
+	assert.Equal(t, int64(2), global.Version)
+	assert.Equal(t, "changed", global.CustomData)
+	assert.Equal(t, []string{dtmcli.StatusSucceed}, persister.statuses)
+}
+
+func TestEngineAttempts(t *testing.T) {
+	old := config.Config.BranchAttempts.Enabled
+	defer func() { config.Config.BranchAttempts.Enabled = old }()
+	config.Config.BranchAttempts.Enabled = 1
+
+	global, branches, persister := newEngineSaga(2)
+	e := New(func(ctx context.Context, b *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		return dtmcli.ResultSuccess, "", nil
+	}, persister)
+	assert.Nil(t, e.Process(global, branches))
+	assert.Equal(t, 2, len(persister.attempts)) // saved by the persister, not the store of dtm
+	assert.Equal(t, "01", persister.attempts[0].BranchID)
+	assert.Equal(t, storage.AttemptSucceed, persister.attempts[1].Result)
+}
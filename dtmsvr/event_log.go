@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/eventpub"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// maxEventsLimit is the max number of the events returned by admin/events, and republished in a batch by admin/events/replay
+const maxEventsLimit = 1000
+
+// svcEvents returns the events after the seq, the seq to read the next page after, and the offsets of the consumers
+func svcEvents(afterSeq int64, limit int) interface{} {
+	if limit <= 0 || limit > maxEventsLimit {
+		return fmt.Errorf("limit should be in [1, %d]. %w", maxEventsLimit, dtmcli.ErrInvalidArgument)
+	}
+	events := GetStore().FindEvents(afterSeq, limit)
+	next := afterSeq
+	if len(events) > 0 {
+		next = events[len(events)-1].Seq
+	}
+	return map[string]interface{}{"events": events, "next_seq": next, "offsets": eventOffsets()}
+}
+
+// ReplayEventsRequest is the request of admin/events/replay
+type ReplayEventsRequest struct {
+	AfterSeq int64  `json:"after_seq"` // the events after the seq are republished
+	ToSeq    int64  `json:"to_seq"`    // the events up to the seq are republished. 0 means up to the last event
+	Gid      string `json:"gid"`       // only the events of the gid are republished if not empty
+}
+
+// svcReplayEvents republishes the events in the range to the sink of EventPublisher, marked as replay. the events are
+// published in batches, and the replay stops at the first error, returned with the seq of the last event republished
+func svcReplayEvents(req *ReplayEventsRequest) interface{} {
+	if !eventpub.Enabled() {
+		return fmt.Errorf("EventPublisher is not configured. %w", dtmcli.ErrFailure)
+	}
+	if req.ToSeq != 0 && req.ToSeq <= req.AfterSeq {
+		return fmt.Errorf("to_seq should be greater than after_seq. %w", dtmcli.ErrInvalidArgument)
+	}
+	replayed, last := 0, req.AfterSeq
+	for {
+		records := GetStore().FindEvents(last, maxEventsLimit)
+		events := []*eventpub.Event{}
+		batchLast := last
+		for i := range records {
+			if req.ToSeq != 0 && records[i].Seq > req.ToSeq {
+				break
+			}
+			batchLast = records[i].Seq
+			if req.Gid == "" || records[i].Gid == req.Gid {
+				events = append(events, eventOfRecord(&records[i]))
+			}
+		}
+		if len(events) > 0 {
+			if err := eventpub.Republish(events); err != nil {
+				return fmt.Errorf("%d events republished up to seq %d, then error: %v. %w", replayed, last, err, dtmcli.ErrFailure)
+			}
+			replayed += len(events)
+		}
+		if len(records) < maxEventsLimit || batchLast != records[len(records)-1].Seq {
+			logger.Infof("%d events republished in (%d, %d]", replayed, req.AfterSeq, batchLast)
+			return map[string]interface{}{"dtm_result": dtmcli.ResultSuccess, "replayed": replayed, "last_seq": batchLast}
+		}
+		last = batchLast
+	}
+}
+
+// eventOffsets returns the offsets acknowledged by the consumers of the event log
+func eventOffsets() map[string]int64 {
+	offsets := map[string]int64{}
+	for _, kv := range GetStore().FindKV(storage.EventOffsetCat, "") {
+		offsets[kv.K], _ = strconv.ParseInt(kv.V, 10, 64)
+	}
+	return offsets
+}
+
+// AckEventsRequest is the request of admin/events/ack
+type AckEventsRequest struct {
+	Consumer string `json:"consumer"`
+	Seq      int64  `json:"seq"`    // the events up to the seq are consumed
+	Remove   bool   `json:"remove"` // stop tracking the offset of the consumer, so its events are purged by the retention
+}
+
+// svcAckEvents saves the offset of a consumer. the events after the lowest offset of the consumers are not purged
+func svcAckEvents(req *AckEventsRequest) error {
+	if req.Consumer == "" {
+		return fmt.Errorf("no consumer specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	if req.Remove {
+		if err := GetStore().DeleteKV(storage.EventOffsetCat, req.Consumer); err != storage.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	value := strconv.FormatInt(req.Seq, 10)
+	for { // retry if the offset is acknowledged concurrently
+		kvs := GetStore().FindKV(storage.EventOffsetCat, req.Consumer)
+		var err error
+		if len(kvs) == 0 {
+			err = GetStore().CreateKV(storage.EventOffsetCat, req.Consumer, value)
+		} else {
+			kvs[0].V = value
+			err = GetStore().UpdateKV(&kvs[0])
+		}
+		if err != storage.ErrUniqueConflict && err != storage.ErrNotFound {
+			return err
+		}
+	}
+}
+
+// purgeEventsMaxSeq returns the max seq of the events to purge, which is the lowest offset of the consumers
+func purgeEventsMaxSeq() int64 {
+	maxSeq := int64(math.MaxInt64)
+	for _, offset := range eventOffsets() {
+		if offset < maxSeq {
+			maxSeq = offset
+		}
+	}
+	return maxSeq
+}
+
+// cronPurgeEvents purges the events older than the retention, and consumed by all the consumers, periodically
+func cronPurgeEvents() {
+	for conf.EventLog.Enabled == 1 && conf.EventLog.Retention > 0 && conf.EventLog.PurgeInterval > 0 {
+		var purged int64
+		err := dtmimp.CatchP(func() {
+			if isReadOnly() {
+				return
+			}
+			var err error
+			purged, err = GetStore().PurgeEvents(time.Now().Add(-time.Duration(conf.EventLog.Retention)*time.Second), purgeEventsMaxSeq())
+			dtmimp.E2P(err)
+		})
+		if err != nil {
+			logger.Errorf("purge event log error: %v", err)
+		} else if purged > 0 {
+			logger.Infof("%d events purged from the event log", purged)
+		}
+		time.Sleep(time.Duration(conf.EventLog.PurgeInterval) * time.Second)
+	}
+}
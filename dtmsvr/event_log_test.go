@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLog(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+	oldLog := conf.EventLog
+	defer func() { conf.EventLog = oldLog }()
+
+	trans := &TransGlobal{TransGlobalStore: storage.TransGlobalStore{Gid: "event-log", TransType: "saga", Status: dtmcli.StatusSubmitted}}
+	assert.Equal(t, int64(0), trans.logEvent("", time.Now()))
+	conf.EventLog.Enabled = 1
+	seq := trans.logEvent("", time.Now())
+	assert.True(t, seq > 0)
+	trans.Status = dtmcli.StatusSucceed
+	assert.Equal(t, seq+1, trans.logEvent(dtmcli.StatusSubmitted, time.Now()))
+
+	r := svcEvents(seq-1, 10).(map[string]interface{})
+	events := r["events"].([]storage.EventRecord)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, dtmcli.StatusSubmitted, events[1].OldStatus)
+	assert.Equal(t, seq+1, r["next_seq"])
+	e := eventOfRecord(&events[1])
+	assert.True(t, e.Replay)
+	assert.Equal(t, seq+1, e.LogSeq)
+	assert.True(t, errors.Is(svcEvents(0, 0).(error), dtmcli.ErrInvalidArgument))
+	assert.True(t, errors.Is(svcReplayEvents(&ReplayEventsRequest{}).(error), dtmcli.ErrFailure)) // no EventPublisher
+
+	assert.Equal(t, int64(math.MaxInt64), purgeEventsMaxSeq())
+	assert.Nil(t, svcAckEvents(&AckEventsRequest{Consumer: "c1", Seq: seq + 1}))
+	assert.Nil(t, svcAckEvents(&AckEventsRequest{Consumer: "c2", Seq: seq}))
+	assert.Nil(t, svcAckEvents(&AckEventsRequest{Consumer: "c2", Seq: seq - 1}))
+	assert.Equal(t, map[string]int64{"c1": seq + 1, "c2": seq - 1}, eventOffsets())
+	assert.Equal(t, seq-1, purgeEventsMaxSeq())
+	assert.Nil(t, svcAckEvents(&AckEventsRequest{Consumer: "c2", Remove: true}))
+	assert.Nil(t, svcAckEvents(&AckEventsRequest{Consumer: "c2", Remove: true}))
+	assert.Equal(t, seq+1, purgeEventsMaxSeq())
+	assert.True(t, errors.Is(svcAckEvents(&AckEventsRequest{}), dtmcli.ErrInvalidArgument))
+	assert.Nil(t, svcAckEvents(&AckEventsRequest{Consumer: "c1", Remove: true}))
+}
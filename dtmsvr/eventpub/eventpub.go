@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package eventpub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Event is a lifecycle event of a global transaction
+type Event struct {
+	Gid            string     `json:"gid"`
+	TransType      string     `json:"trans_type"`
+	Seq            int64      `json:"seq"` // increase by 1 for each event of the same gid, so that consumers can detect gaps
+	OldStatus      string     `json:"old_status,omitempty"`
+	NewStatus      string     `json:"new_status"`
+	CreateTime     *time.Time `json:"create_time,omitempty"`
+	FinishTime     *time.Time `json:"finish_time,omitempty"`
+	RollbackTime   *time.Time `json:"rollback_time,omitempty"`
+	RollbackReason string     `json:"rollback_reason,omitempty"`
+	CustomData     string     `json:"custom_data,omitempty"` // masked if the store is encrypted
+	EventTime      time.Time  `json:"event_time"`
+	LogSeq         int64      `json:"log_seq,omitempty"` // the seq in the event log of the store, if EventLog is enabled
+	Replay         bool       `json:"replay,omitempty"`  // true if republished from the event log, which has no times but the event_time
+}
+
+// Publisher publishes events to a sink, such as kafka
+type Publisher interface {
+	Publish(events []*Event) error
+}
+
+// Creator creates a Publisher from the config
+type Creator func(conf *config.EventPublisher) (Publisher, error)
+
+var creators = map[string]Creator{}
+
+// Register registers the creator of a publisher driver
+func Register(driver string, creator Creator) {
+	creators[driver] = creator
+}
+
+var droppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dtm_event_dropped_total",
+	Help: "Lifecycle events dropped because the event buffer is full",
+})
+
+var (
+	publisher Publisher
+	eventChan chan *Event
+	block     bool
+)
+
+// maxBatch is the max number of events published in one batch
+const maxBatch = 100
+
+// Enabled returns whether the event publisher is started
+func Enabled() bool {
+	return eventChan != nil
+}
+
+// Start starts the event publisher configured. it does nothing if no driver is configured
+func Start(conf *config.EventPublisher) error {
+	if conf.Driver == "" {
+		return nil
+	}
+	creator := creators[conf.Driver]
+	if creator == nil {
+		return fmt.Errorf("unknown event publisher driver: %s", conf.Driver)
+	}
+	p, err := creator(conf)
+	if err != nil {
+		return err
+	}
+	publisher = p
+	block = conf.OverflowPolicy == config.OverflowBlock
+	eventChan = make(chan *Event, conf.BufferSize)
+	go publishLoop()
+	logger.Infof("event publisher %s started", conf.Driver)
+	return nil
+}
+
+// Emit emits the event asynchronously. when the buffer is full, the event is dropped or the caller is blocked, according to the overflow policy
+func Emit(e *Event) {
+	if eventChan == nil {
+		return
+	}
+	if block {
+		eventChan <- e
+		return
+	}
+	select {
+	case eventChan <- e:
+	default:
+		droppedTotal.Inc()
+		logger.Errorf("event buffer is full, event dropped: gid: %s seq: %d status: %s", e.Gid, e.Seq, e.NewStatus)
+	}
+}
+
+// Republish publishes the events synchronously, bypassing the buffer, so that the caller knows the result
+func Republish(events []*Event) error {
+	if publisher == nil {
+		return fmt.Errorf("event publisher is not started")
+	}
+	return publisher.Publish(events)
+}
+
+func publishLoop() {
+	for {
+		events := []*Event{<-eventChan}
+		for len(events) < maxBatch && len(eventChan) > 0 {
+			events = append(events, <-eventChan)
+		}
+		// keep retrying, events after this batch are buffered in eventChan
+		for err := publisher.Publish(events); err != nil; err = publisher.Publish(events) {
+			logger.Errorf("publish %d events error: %v", len(events), err)
+			time.Sleep(time.Second)
+		}
+	}
+}
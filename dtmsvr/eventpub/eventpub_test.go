@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package eventpub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type chanPublisher struct {
+	published chan []*Event
+	release   chan bool
+}
+
+func (c *chanPublisher) Publish(events []*Event) error {
+	c.published <- events
+	<-c.release
+	return nil
+}
+
+func TestEventPublisher(t *testing.T) {
+	assert.Nil(t, Start(&config.EventPublisher{}))
+	assert.False(t, Enabled())
+	Emit(&Event{Gid: "not-started"})
+	assert.Error(t, Republish([]*Event{{Gid: "not-started"}}))
+
+	assert.Error(t, Start(&config.EventPublisher{Driver: "unknown"}))
+
+	p := &chanPublisher{published: make(chan []*Event), release: make(chan bool, 2)}
+	Register("chan", func(conf *config.EventPublisher) (Publisher, error) {
+		return p, nil
+	})
+	err := Start(&config.EventPublisher{Driver: "chan", BufferSize: 1, OverflowPolicy: config.OverflowDrop})
+	assert.Nil(t, err)
+	assert.True(t, Enabled())
+
+	Emit(&Event{Gid: "g1", Seq: 1})
+	events := <-p.published // publishLoop is blocked in Publish now
+	assert.Equal(t, int64(1), events[0].Seq)
+
+	dropped := testutil.ToFloat64(droppedTotal)
+	Emit(&Event{Gid: "g1", Seq: 2}) // buffered
+	Emit(&Event{Gid: "g1", Seq: 3}) // dropped
+	assert.Equal(t, dropped+1, testutil.ToFloat64(droppedTotal))
+	p.release <- true
+	p.release <- true
+
+	select {
+	case events = <-p.published:
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, int64(2), events[0].Seq)
+	case <-time.After(time.Second):
+		assert.Fail(t, "event not published")
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	p, err := newKafkaPublisher(&config.EventPublisher{Brokers: "localhost:9092,localhost:9093", Topic: "dtm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "dtm", p.(*kafkaPublisher).writer.Topic)
+}
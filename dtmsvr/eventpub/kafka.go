@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package eventpub
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/segmentio/kafka-go"
+)
+
+func init() {
+	Register(config.Kafka, newKafkaPublisher)
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(conf *config.EventPublisher) (Publisher, error) {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(conf.Brokers, ",")...),
+		Topic:        conf.Topic,
+		Balancer:     &kafka.Hash{}, // events of the same gid go to the same partition, so they are ordered
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+	}}, nil
+}
+
+func (k *kafkaPublisher) Publish(events []*Event) error {
+	msgs := make([]kafka.Message, len(events))
+	for i, e := range events {
+		msgs[i] = kafka.Message{Key: []byte(e.Gid), Value: dtmimp.MustMarshal(e)}
+	}
+	return k.writer.WriteMessages(context.Background(), msgs...)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/gin-gonic/gin"
+)
+
+// ClaimChecker checks the caller can create or change the trans of a gid. token is the one sent by the caller in the
+// http header or grpc metadata dtm-caller-token, empty if not sent. an error wrapping dtmcli.ErrGidNotOwned should be
+// returned if the gid is not owned by the caller
+type ClaimChecker interface {
+	CheckClaim(token string, gid string) error
+}
+
+// StaticClaimChecker is the ClaimChecker of the claims in config. a gid is owned by the caller claiming the longest
+// prefix of it, so "orders-1" is owned by the claim of "orders-" instead of "order". the callers with a token can only
+// use their own gids, and the callers without a token can only use the gids not claimed
+type StaticClaimChecker struct {
+	Claims map[string]config.GidClaim
+}
+
+// CheckClaim implements ClaimChecker
+func (s *StaticClaimChecker) CheckClaim(token string, gid string) error {
+	caller, owner, longest := "", "", ""
+	for name, claim := range s.Claims {
+		if token != "" && claim.Token == token {
+			caller = name
+		}
+		for _, p := range claim.GetPrefixes() {
+			if strings.HasPrefix(gid, p) && len(p) > len(longest) {
+				owner, longest = name, p
+			}
+		}
+	}
+	if token != "" && caller == "" {
+		return fmt.Errorf("caller token not recognized. %w", dtmcli.ErrGidNotOwned)
+	} else if caller != owner && owner == "" {
+		return fmt.Errorf("gid %s is not under the prefixes claimed by %s. %w", gid, caller, dtmcli.ErrGidNotOwned)
+	} else if caller != owner {
+		return fmt.Errorf("gid %s is claimed by %s with prefix %s. %w", gid, owner, longest, dtmcli.ErrGidNotOwned)
+	}
+	return nil
+}
+
+var claimChecker ClaimChecker
+
+// SetClaimChecker replaces the StaticClaimChecker of GidClaims, such as a checker of a dynamic registry. it should be
+// called before the server starts. nil means the StaticClaimChecker
+func SetClaimChecker(c ClaimChecker) {
+	claimChecker = c
+}
+
+// checkClaim checks the caller of token can create or change the trans of gid
+func checkClaim(token string, gid string) error {
+	if claimChecker != nil {
+		return claimChecker.CheckClaim(token, gid)
+	}
+	if len(conf.GidClaims) == 0 {
+		return nil
+	}
+	return (&StaticClaimChecker{Claims: conf.GidClaims}).CheckClaim(token, gid)
+}
+
+// checkQueryClaim checks the claim of the queried gid, if GidClaimQuery is set
+func checkQueryClaim(token string, gid string) error {
+	if conf.GidClaimQuery != 1 {
+		return nil
+	}
+	return checkClaim(token, gid)
+}
+
+func callerToken(c *gin.Context) string {
+	return c.GetHeader(dtmimp.CallerTokenHeader)
+}
+
+func grpcCallerToken(ctx context.Context) string {
+	return dtmgimp.GetMetaFromContext(ctx, dtmimp.CallerTokenHeader)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticClaimChecker(t *testing.T) {
+	checker := &StaticClaimChecker{Claims: map[string]config.GidClaim{
+		"order":   {Token: "t-order", Prefixes: "order"},
+		"orders":  {Token: "t-orders", Prefixes: "orders-, ord_"},
+		"payment": {Token: "t-payment", Prefixes: "pay-"},
+	}}
+	for _, c := range []struct {
+		token string
+		gid   string
+		owned bool
+	}{
+		{"t-order", "order-1", true},
+		{"t-order", "orders1", true}, // only "order" is a prefix of it
+		{"t-order", "orders-1", false},
+		{"t-orders", "orders-1", true},
+		{"t-orders", "ord_1", true},
+		{"t-orders", "order-1", false},
+		{"t-orders", "orders", false}, // "orders-" is not a prefix of it
+		{"t-order", "orders", true},
+		{"t-payment", "pay-1", true},
+		{"t-payment", "pay1", false}, // not claimed by anyone, so only for the callers without a token
+		{"", "pay1", true},
+		{"", "pay-1", false},
+		{"t-unknown", "pay1", false},
+	} {
+		err := checker.CheckClaim(c.token, c.gid)
+		assert.Equal(t, c.owned, err == nil, "%s %s", c.token, c.gid)
+		if err != nil {
+			assert.True(t, errors.Is(err, dtmcli.ErrGidNotOwned))
+		}
+	}
+}
+
+type claimCheckerFunc func(token string, gid string) error
+
+func (f claimCheckerFunc) CheckClaim(token string, gid string) error {
+	return f(token, gid)
+}
+
+func TestCheckClaim(t *testing.T) {
+	assert.Nil(t, checkClaim("", "gid1")) // no claims
+	conf.GidClaims = map[string]config.GidClaim{"order": {Token: "t-order", Prefixes: "order-"}}
+	defer func() { conf.GidClaims = nil }()
+	assert.True(t, errors.Is(checkClaim("", "order-1"), dtmcli.ErrGidNotOwned))
+	assert.Nil(t, checkQueryClaim("", "order-1"))
+	conf.GidClaimQuery = 1
+	defer func() { conf.GidClaimQuery = 0 }()
+	assert.True(t, errors.Is(checkQueryClaim("", "order-1"), dtmcli.ErrGidNotOwned))
+	assert.Nil(t, checkQueryClaim("t-order", "order-1"))
+	r := svcSubmit(&TransGlobal{TransGlobalStore: storage.TransGlobalStore{Gid: "order-1", TransType: "saga"}})
+	assert.True(t, errors.Is(r.(error), dtmcli.ErrGidNotOwned))
+
+	SetClaimChecker(claimCheckerFunc(func(token string, gid string) error { return nil }))
+	defer SetClaimChecker(nil)
+	assert.Nil(t, checkClaim("", "order-1"))
+}
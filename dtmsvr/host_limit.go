@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+)
+
+// hostLimiter is the semaphore of the in-flight requests to a host
+type hostLimiter struct {
+	limit int64
+	slots chan bool
+}
+
+// hostLimiters are the limiters of the hosts, shared by the cron workers and the requests processing trans, so that
+// a slow host is not flooded by a large retry pass
+var hostLimiters sync.Map // host -> *hostLimiter
+
+// branchHost returns the host of the branch url, with the port if any, such as localhost:36790 of the grpc url
+// localhost:36790/busi.Busi/TransIn
+func branchHost(uri string) string {
+	if i := strings.Index(uri, "://"); i > 0 {
+		uri = uri[i+3:]
+	}
+	if i := strings.IndexAny(uri, "/?"); i >= 0 {
+		uri = uri[:i]
+	}
+	return uri
+}
+
+func getHostLimiter(host string) *hostLimiter {
+	limit, ok := conf.HostConcurrency[host]
+	if !ok {
+		limit = conf.HostConcurrencyDefault
+	}
+	if limit <= 0 {
+		return nil
+	}
+	v, ok := hostLimiters.Load(host)
+	if !ok {
+		v, _ = hostLimiters.LoadOrStore(host, &hostLimiter{limit: limit, slots: make(chan bool, limit)})
+	}
+	if l := v.(*hostLimiter); l.limit == limit {
+		return l
+	}
+	// the config changed, only in tests. the requests in flight release the slots of the old limiter
+	l := &hostLimiter{limit: limit, slots: make(chan bool, limit)}
+	hostLimiters.Store(host, l)
+	return l
+}
+
+// acquireHost acquires a request slot of the host of uri, waiting at most HostConcurrencyWait. release should be
+// called after the request. if no slot is available, an error wrapping dtmcli.ErrOngoing is returned, so the branch
+// is retried later instead of queueing without bound
+func acquireHost(uri string) (release func(), err error) {
+	host := branchHost(uri)
+	l := getHostLimiter(host)
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- true:
+	default:
+		timer := time.NewTimer(time.Duration(conf.HostConcurrencyWait) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case l.slots <- true:
+		case <-timer.C:
+			return nil, fmt.Errorf("%d requests to %s in flight, reaching the concurrency limit. %w", l.limit, host, dtmcli.ErrOngoing)
+		}
+	}
+	hostInFlight.WithLabelValues(host).Inc()
+	return func() {
+		hostInFlight.WithLabelValues(host).Dec()
+		<-l.slots
+	}, nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBranchHost(t *testing.T) {
+	assert.Equal(t, "legacy.corp:8080", branchHost("http://legacy.corp:8080/api/busi/TransIn?x=1"))
+	assert.Equal(t, "localhost:36790", branchHost("localhost:36790/busi.Busi/TransIn"))
+	assert.Equal(t, "busi", branchHost("discovery://busi/busi.Busi/TransIn"))
+	assert.Equal(t, "legacy.corp", branchHost("https://legacy.corp"))
+}
+
+func TestAcquireHost(t *testing.T) {
+	conf.HostConcurrency = map[string]int64{"legacy.corp:8080": 2}
+	conf.HostConcurrencyWait = 10
+	defer func() { conf.HostConcurrency = nil }()
+
+	r1, err := acquireHost("http://legacy.corp:8080/a")
+	assert.Nil(t, err)
+	r2, err := acquireHost("http://legacy.corp:8080/b")
+	assert.Nil(t, err)
+	_, err = acquireHost("http://legacy.corp:8080/c")
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	for i := 0; i < 5; i++ { // hosts not limited
+		_, err = acquireHost("http://other.corp/a")
+		assert.Nil(t, err)
+	}
+	r1()
+	r3, err := acquireHost("http://legacy.corp:8080/c")
+	assert.Nil(t, err)
+	r2()
+	r3()
+
+	conf.HostConcurrencyDefault = 1
+	defer func() { conf.HostConcurrencyDefault = 0 }()
+	r4, err := acquireHost("http://other.corp/a")
+	assert.Nil(t, err)
+	_, err = acquireHost("http://other.corp/b")
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	r4()
+}
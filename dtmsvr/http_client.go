@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/go-resty/resty/v2"
+)
+
+var httpClients sync.Map
+
+// getHTTPClient get the resty client of the profile. empty profile is the default client
+func getHTTPClient(profile string) (*resty.Client, error) {
+	if profile == "" {
+		return dtmimp.RestyClient, nil
+	}
+	if v, ok := httpClients.Load(profile); ok {
+		return v.(*resty.Client), nil
+	}
+	p, ok := conf.HTTPClientProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("http client profile '%s' not found. %w", profile, dtmcli.ErrFailure)
+	}
+	client, err := newHTTPClient(&p)
+	if err != nil {
+		return nil, fmt.Errorf("http client profile '%s' load error: %v. %w", profile, err, dtmcli.ErrFailure)
+	}
+	v, _ := httpClients.LoadOrStore(profile, client)
+	return v.(*resty.Client), nil
+}
+
+func newHTTPClient(p *config.HTTPClientProfile) (*resty.Client, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: p.InsecureSkipVerify != 0} // #nosec G402 specified by config
+	if p.CAFile != "" {
+		pem, err := ioutil.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", p.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConf,
+	}
+	if p.Proxy != "" {
+		u, err := url.Parse(p.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if p.MaxIdleConns > 0 {
+		transport.MaxIdleConns = int(p.MaxIdleConns)
+		transport.MaxIdleConnsPerHost = int(p.MaxIdleConns)
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = conf.RequestTimeout
+	}
+	client := resty.New().SetTransport(transport).SetTimeout(time.Duration(timeout) * time.Second)
+	dtmimp.AddRestyMiddlewares(client)
+	return client, nil
+}
+
+// readResponseBody reads the body of a branch response requested with SetDoNotParseResponse, at most ResponseBodyLimit bytes.
+// the rest of an oversized body is not read, so that a misbehaving RM can not exhaust the memory of dtm server
+func readResponseBody(resp *resty.Response, t *TransGlobal, branch *TransBranch) ([]byte, bool, error) {
+	raw := resp.RawBody()
+	defer raw.Close()
+	limit := conf.ResponseBodyLimit
+	if limit <= 0 {
+		body, err := ioutil.ReadAll(raw)
+		return body, false, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(raw, limit+1))
+	if err != nil || int64(len(body)) <= limit {
+		return body, false, err
+	}
+	logger.Gid(t.Gid).Warnf("response of %s for %s branch %s %s exceeds %d bytes, truncated", branch.URL, t.Gid, branch.BranchID, branch.Op, limit)
+	responseTruncatedTotal.WithLabelValues(t.TransType, branch.Op, branch.URL).Inc()
+	return body[:limit], true, nil
+}
+
+// checkHTTPProfiles checks all the http client profiles referenced by the trans can be loaded
+func (t *TransGlobal) checkHTTPProfiles(branches []TransBranch) error {
+	_, err := getHTTPClient(t.HTTPProfile)
+	for i := 0; i < len(branches) && err == nil; i++ {
+		_, err = getHTTPClient(branches[i].Ext.HTTPProfile)
+	}
+	return err
+}
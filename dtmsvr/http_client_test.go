@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPClientProfile(t *testing.T) {
+	conf.HTTPClientProfiles = map[string]config.HTTPClientProfile{
+		"proxy": {Proxy: "http://localhost:3128", Timeout: 5, MaxIdleConns: 10},
+		"badca": {CAFile: "/not/exists.pem"},
+	}
+	c, err := getHTTPClient("")
+	assert.Nil(t, err)
+	assert.Equal(t, dtmimp.RestyClient, c)
+
+	c, err = getHTTPClient("proxy")
+	assert.Nil(t, err)
+	assert.NotEqual(t, dtmimp.RestyClient, c)
+	c2, _ := getHTTPClient("proxy")
+	assert.Equal(t, c, c2)
+
+	_, err = getHTTPClient("badca")
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+	_, err = getHTTPClient("not-exists")
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+
+	tg := TransGlobal{}
+	assert.Nil(t, tg.checkHTTPProfiles([]TransBranch{{}}))
+	b := TransBranch{}
+	b.Ext.HTTPProfile = "not-exists"
+	assert.Error(t, tg.checkHTTPProfiles([]TransBranch{b}))
+}
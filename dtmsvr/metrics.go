@@ -8,9 +8,13 @@ package dtmsvr
 
 import (
 	"context"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -40,19 +44,81 @@ var (
 		Name: "dtm_transaction_process_total",
 		Help: "All transactions processed by dtm",
 	},
-		[]string{"model", "gid", "status"})
+		[]string{"model", "gid", "status", "tenant"})
+
+	transQuarantinedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtm_transaction_quarantined_total",
+		Help: "The transactions quarantined because processing them panics repeatedly",
+	},
+		[]string{"model"})
 
 	transactionHandledTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "dtm_transaction_handled_duration",
 		Help: "Histogram of handling latency of the transaction that handled by the server.",
 	},
-		[]string{"model", "gid"})
+		[]string{"model", "gid", "tenant"})
 
 	branchTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dtm_branch_process_total",
 		Help: "All branches processed by dtm",
 	},
-		[]string{"model", "gid", "branchid", "branchtype", "status"})
+		[]string{"model", "gid", "branchid", "branchtype", "status", "tenant"})
+
+	responseTruncatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtm_branch_response_truncated_total",
+		Help: "All branch responses truncated by ResponseBodyLimit",
+	},
+		[]string{"model", "branchtype", "url"})
+
+	branchSkippedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtm_branch_skipped_total",
+		Help: "All branch calls skipped because the branches are already succeeded in the store",
+	},
+		[]string{"model", "branchtype"})
+
+	branchResultDedupedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtm_branch_result_deduplicated_total",
+		Help: "All branch results reported again by RMs, which are acknowledged by the cache without writing the store",
+	},
+		[]string{"model", "api"})
+
+	schedulingLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dtm_scheduling_lag_seconds",
+		Help: "Now minus the earliest next cron time of the unfinished transactions. 0 if none is overdue",
+	})
+
+	overdueTransactions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_overdue_transactions",
+		Help: "The number of the unfinished transactions overdue by more than late_seconds",
+	},
+		[]string{"late_seconds"})
+
+	readOnlyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dtm_server_read_only",
+		Help: "1 if this dtm server is read-only, refusing the requests changing transactions",
+	})
+
+	admissionGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dtm_admission_control_active",
+		Help: "1 if this dtm server refuses new transactions, because the overdue transactions reach AdmissionBacklog",
+	})
+
+	overdueByPriority = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_overdue_transactions_by_priority",
+		Help: "The number of the unfinished transactions overdue of each priority, which shows the starvation of low priorities",
+	},
+		[]string{"priority"})
+
+	hostInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_host_in_flight",
+		Help: "The in-flight requests to the branches of each host limited by HostConcurrency or HostConcurrencyDefault",
+	},
+		[]string{"host"})
+
+	clockSkewGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dtm_clock_skew_seconds",
+		Help: "The now of the store minus the now of this dtm server, probed every ClockSkewInterval seconds",
+	})
 )
 
 func setServerInfoMetrics() {
@@ -94,18 +160,18 @@ func grpcMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInf
 
 func transactionMetrics(global *TransGlobal, status bool) {
 	if status {
-		transactionTotal.WithLabelValues(global.TransType, global.Gid, "ok").Inc()
+		transactionTotal.WithLabelValues(global.TransType, global.Gid, "ok", global.Tenant).Inc()
 	} else {
-		transactionTotal.WithLabelValues(global.TransType, global.Gid, "fail").Inc()
+		transactionTotal.WithLabelValues(global.TransType, global.Gid, "fail", global.Tenant).Inc()
 	}
-	transactionHandledTime.WithLabelValues(global.TransType, global.Gid).Observe(time.Since(*global.CreateTime).Seconds())
+	transactionHandledTime.WithLabelValues(global.TransType, global.Gid, global.Tenant).Observe(time.Since(*global.CreateTime).Seconds())
 }
 
 func branchMetrics(global *TransGlobal, branch *TransBranch, status bool) {
 	if status {
-		branchTotal.WithLabelValues(global.TransType, global.Gid, branch.BranchID, branch.Op, "ok").Inc()
+		branchTotal.WithLabelValues(global.TransType, global.Gid, branch.BranchID, branch.Op, "ok", global.Tenant).Inc()
 	} else {
-		branchTotal.WithLabelValues(global.TransType, global.Gid, branch.BranchID, branch.Op, "fail").Inc()
+		branchTotal.WithLabelValues(global.TransType, global.Gid, branch.BranchID, branch.Op, "fail", global.Tenant).Inc()
 	}
 }
 
@@ -113,3 +179,38 @@ func extractFromPath(val string) string {
 	strs := strings.Split(val, "/")
 	return strings.ToLower(strs[len(strs)-1])
 }
+
+// overdueBuckets are the late_seconds of dtm_overdue_transactions
+var overdueBuckets = []int64{0, 10, 60, 300, 3600}
+
+// cronSchedulingLag probes the scheduling lag every SchedulingLagInterval seconds. there is no leader election among
+// dtm servers, so every server probes the shared store and exports the same values
+func cronSchedulingLag() {
+	for conf.SchedulingLagInterval > 0 {
+		if err := dtmimp.CatchP(func() { probeSchedulingLag(storage.Now()) }); err != nil {
+			logger.Errorf("probe scheduling lag error: %v", err)
+		}
+		time.Sleep(time.Duration(conf.SchedulingLagInterval) * time.Second)
+	}
+}
+
+// probeSchedulingLag exports the scheduling lag and the number of overdue trans in total and by priority, which grow when
+// the cron falls behind. the admission of new trans is updated by the number of overdue trans
+func probeSchedulingLag(now time.Time) {
+	lag := 0.0
+	if oldest := GetStore().FindOldestCronTime(); oldest != nil && oldest.Before(now) {
+		lag = now.Sub(*oldest).Seconds()
+	}
+	schedulingLag.Set(lag)
+	for _, late := range overdueBuckets {
+		count := GetStore().CountCronTimeBefore(now.Add(-time.Duration(late) * time.Second))
+		overdueTransactions.WithLabelValues(strconv.FormatInt(late, 10)).Set(float64(count))
+		if late == 0 {
+			updateAdmission(count)
+		}
+	}
+	overdueByPriority.Reset() // the priorities without overdue trans are not exported
+	for priority, count := range GetStore().CountOverdueByPriority(now) {
+		overdueByPriority.WithLabelValues(strconv.Itoa(priority)).Set(float64(count))
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package msgbroker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/segmentio/kafka-go"
+)
+
+func init() {
+	Register(config.Kafka, newKafkaProducer)
+}
+
+type kafkaProducer struct {
+	writer *kafka.Writer
+}
+
+func newKafkaProducer(conf *config.MsgBroker) (Producer, error) {
+	return &kafkaProducer{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(conf.Brokers, ",")...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+	}}, nil
+}
+
+func (p *kafkaProducer) Send(msg *Message) error {
+	m := kafka.Message{Topic: msg.Topic, Key: []byte(msg.Key), Value: msg.Value}
+	for k, v := range msg.Headers {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return p.writer.WriteMessages(context.Background(), m)
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package msgbroker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+)
+
+// Message is the message sent to a broker topic
+type Message struct {
+	Topic   string
+	Key     string
+	Value   []byte
+	Headers map[string]string
+}
+
+// Producer sends messages to a broker cluster
+type Producer interface {
+	// Send returns nil only if the message is acknowledged by the broker
+	Send(msg *Message) error
+}
+
+// Creator creates a Producer from the config of a broker cluster
+type Creator func(conf *config.MsgBroker) (Producer, error)
+
+var creators = map[string]Creator{}
+
+// Register registers the creator of a broker driver. the driver is also the scheme of the branch url, such as kafka://cluster/topic
+func Register(driver string, creator Creator) {
+	creators[driver] = creator
+}
+
+var producers sync.Map
+
+// IsBrokerURL checks whether the url targets a registered broker
+func IsBrokerURL(uri string) bool {
+	i := strings.Index(uri, "://")
+	return i > 0 && creators[uri[:i]] != nil
+}
+
+// parseURL parse url like kafka://cluster/topic
+func parseURL(uri string) (driver string, cluster string, topic string, err error) {
+	u, err := url.Parse(uri)
+	if err == nil {
+		driver, cluster, topic = u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/")
+	}
+	if err == nil && (cluster == "" || topic == "") {
+		err = fmt.Errorf("bad broker url: %s. should be like %s://cluster/topic", uri, driver)
+	}
+	return
+}
+
+// CheckURL checks the url targets a configured broker cluster
+func CheckURL(uri string) error {
+	_, _, err := getProducer(uri)
+	return err
+}
+
+func getProducer(uri string) (Producer, string, error) {
+	driver, cluster, topic, err := parseURL(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	conf, ok := config.Config.MsgBrokers[cluster]
+	if !ok || conf.Driver != driver {
+		return nil, "", fmt.Errorf("%s broker cluster '%s' not configured", driver, cluster)
+	}
+	if v, ok := producers.Load(cluster); ok {
+		return v.(Producer), topic, nil
+	}
+	p, err := creators[driver](&conf)
+	if err != nil {
+		return nil, "", err
+	}
+	v, _ := producers.LoadOrStore(cluster, p)
+	return v.(Producer), topic, nil
+}
+
+// Send sends the message to the topic specified by url
+func Send(uri string, msg *Message) error {
+	p, topic, err := getProducer(uri)
+	if err != nil {
+		return err
+	}
+	msg.Topic = topic
+	return p.Send(msg)
+}
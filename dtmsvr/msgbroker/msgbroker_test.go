@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package msgbroker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockProducer struct {
+	sent []*Message
+	err  error
+}
+
+func (m *mockProducer) Send(msg *Message) error {
+	m.sent = append(m.sent, msg)
+	return m.err
+}
+
+func TestMsgBroker(t *testing.T) {
+	p := &mockProducer{}
+	Register("mock", func(conf *config.MsgBroker) (Producer, error) {
+		return p, nil
+	})
+	config.Config.MsgBrokers = map[string]config.MsgBroker{
+		"orders": {Driver: "mock"},
+		"other":  {Driver: config.Kafka, Brokers: "localhost:9092"},
+	}
+	assert.True(t, IsBrokerURL("mock://orders/topic1"))
+	assert.False(t, IsBrokerURL("http://localhost/api"))
+	assert.False(t, IsBrokerURL("localhost:36790/busi.Busi/TransIn"))
+
+	assert.Nil(t, CheckURL("mock://orders/topic1"))
+	assert.Error(t, CheckURL("mock://orders"))
+	assert.Error(t, CheckURL("mock://not-exists/topic1"))
+	assert.Error(t, CheckURL("mock://other/topic1"))
+	assert.Nil(t, CheckURL("kafka://other/topic1"))
+
+	err := Send("mock://orders/topic1", &Message{Key: "gid1", Value: []byte("{}")})
+	assert.Nil(t, err)
+	assert.Equal(t, "topic1", p.sent[0].Topic)
+	assert.Equal(t, "gid1", p.sent[0].Key)
+
+	p.err = errors.New("broker down")
+	assert.Error(t, Send("mock://orders/topic1", &Message{Key: "gid1"}))
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// the decisions of processing a trans, which branch to call, how the results are interpreted and when the status is
+// changed, are made by the processors of the trans types. the calls of the branches and the writes of the processing go
+// through the invoker and the persister of the trans, so the processing can be driven without dtm server by the
+// package engine, such as in tests
+
+// ChangePersister persists the writes of processing a trans. storage.Store is a ChangePersister
+type ChangePersister interface {
+	ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) error
+	LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) []bool
+	TouchCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time)
+	FindBranch(gid string, branchID string, op string) *storage.TransBranchStore
+	FindTransGlobalStore(gid string) *storage.TransGlobalStore // re-reads the trans after a version conflict
+	SaveAttempt(attempt *storage.BranchAttempt) error          // if BranchAttempts is enabled
+	SaveEvent(event *storage.EventRecord) error                // if EventLog is enabled
+	Ping() error                                               // checked before counting a panic of processing
+}
+
+// ProcessWith processes the trans once with its branches, and waits for the result. the branches are called by invoker,
+// or by their protocols if nil, and the writes go to persister, or to the store if nil. the status of the trans and the
+// branches are updated in place, as they are persisted. it is the processing of package engine
+func ProcessWith(global *storage.TransGlobalStore, branches []storage.TransBranchStore, invoker BranchInvoker, persister ChangePersister) error {
+	t := &TransGlobal{TransGlobalStore: *global, invoker: invoker, store: persister, updateBranchSync: true}
+	if t.CreateTime == nil {
+		now := time.Now()
+		t.CreateTime = &now
+	}
+	t.loadProcessExt(branches)
+	err := t.processInner(branches)
+	*global = t.TransGlobalStore
+	return err
+}
+
+// invokeBranch calls the branch by the invoker of the trans, or by its protocol
+func (t *TransGlobal) invokeBranch(branch *TransBranch) error {
+	if t.invoker != nil {
+		return wrapInvoker("engine", t.invoker)(t, branch)
+	}
+	return t.getURLResult(branch)
+}
+
+// persister returns the persister of the trans, or the store
+func (t *TransGlobal) persister() ChangePersister {
+	if t.store != nil {
+		return t.store
+	}
+	return GetStore()
+}
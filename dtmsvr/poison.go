@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmutil"
+)
+
+// panicError is the error of a panic recovered by handlePanic
+type panicError struct {
+	value interface{}
+	stack string
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("dtm panic: %v", e.value)
+}
+
+// processCron processes the trans locked by the cron. the consecutive panics of processing the trans are counted,
+// and the trans is quarantined if the panics reach PoisonThreshold, so that a malformed trans is not retried forever
+func (t *TransGlobal) processCron() (rerr error) {
+	defer func() {
+		var perr *panicError
+		if errors.As(rerr, &perr) {
+			t.recordPanic(perr)
+		} else if t.Ext.Panics > 0 {
+			t.resetPanics()
+		}
+	}()
+	defer handlePanic(&rerr)
+	branches := t.loadBranches()
+	return t.Process(branches)
+}
+
+// recordPanic counts the panic of processing the trans. the panics when the store is unavailable are not counted,
+// because they are not caused by the trans
+func (t *TransGlobal) recordPanic(perr *panicError) {
+	if conf.PoisonThreshold <= 0 {
+		return
+	}
+	err := dtmimp.CatchP(func() {
+		if err := t.persister().Ping(); err != nil {
+			logger.Gid(t.Gid).Warnf("the panic of processing %s is not counted, the store is unavailable: %v", t.Gid, err)
+			return
+		}
+		global := t.persister().FindTransGlobalStore(t.Gid)
+		if global == nil || global.Status == dtmcli.StatusSucceed || global.Status == dtmcli.StatusFailed {
+			return
+		}
+		ext := storage.TransGlobalExt{}
+		if global.ExtData != "" {
+			dtmimp.MustUnmarshalString(global.ExtData, &ext)
+		}
+		ext.Panics++
+		status, updates := global.Status, []string{"ext_data", "update_time"}
+		quarantined := int64(ext.Panics) >= conf.PoisonThreshold
+		if quarantined {
+			ext.Quarantine = &storage.Quarantine{Status: global.Status, Reason: perr.Error(), Time: dtmutil.GetNextTime(0)}
+			status, updates = dtmcli.StatusQuarantined, append(updates, "status")
+		}
+		global.ExtData = dtmimp.MustMarshalString(ext)
+		global.UpdateTime = dtmutil.GetNextTime(0)
+		dtmimp.E2P(t.persister().ChangeGlobalStatus(global, status, updates, quarantined))
+		if quarantined {
+			transQuarantinedTotal.WithLabelValues(global.TransType).Inc()
+			logger.Gid(t.Gid).Errorf("trans %s is quarantined after %d consecutive panics, it is not processed until unquarantined. the last panic: %v\n%s",
+				t.Gid, ext.Panics, perr.value, perr.stack)
+		}
+	})
+	if err != nil {
+		logger.Gid(t.Gid).Errorf("recording the panic of processing %s failed: %v", t.Gid, err)
+	}
+}
+
+// resetPanics resets the panics of the trans processed without a panic
+func (t *TransGlobal) resetPanics() {
+	t.Ext.Panics = 0
+	t.ExtData = dtmimp.MustMarshalString(t.Ext)
+	t.UpdateTime = dtmutil.GetNextTime(0)
+	err := dtmimp.CatchP(func() {
+		dtmimp.E2P(t.persister().ChangeGlobalStatus(&t.TransGlobalStore, t.Status, []string{"ext_data", "update_time"}, false))
+	})
+	if err != nil {
+		logger.Gid(t.Gid).Debugf("resetting the panics of %s failed: %v", t.Gid, err)
+	}
+}
+
+// svcUnquarantine restores the status of a quarantined trans, and schedules it to be processed at once
+func svcUnquarantine(gid string) error {
+	global := GetStore().FindTransGlobalStore(gid)
+	if global == nil {
+		return fmt.Errorf("trans %s not found. %w", gid, dtmcli.ErrInvalidArgument)
+	}
+	if global.Status != dtmcli.StatusQuarantined {
+		return fmt.Errorf("trans %s is %s, not quarantined. %w", gid, global.Status, dtmcli.ErrFailure)
+	}
+	ext := storage.TransGlobalExt{}
+	if global.ExtData != "" {
+		dtmimp.MustUnmarshalString(global.ExtData, &ext)
+	}
+	status := dtmcli.StatusSubmitted
+	if ext.Quarantine != nil && ext.Quarantine.Status != "" {
+		status = ext.Quarantine.Status
+	}
+	ext.Panics, ext.Quarantine = 0, nil
+	global.ExtData = dtmimp.MustMarshalString(ext)
+	global.UpdateTime = dtmutil.GetNextTime(0)
+	if err := GetStore().ChangeGlobalStatus(global, status, []string{"status", "ext_data", "update_time"}, false); err != nil {
+		return err
+	}
+	GetStore().TouchCronTime(global, global.NextCronInterval, storage.NextTime(0))
+	logger.Gid(gid).Infof("trans %s is unquarantined to %s", gid, status)
+	return nil
+}
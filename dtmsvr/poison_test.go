@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPanicError(t *testing.T) {
+	err := func() (rerr error) {
+		defer handlePanic(&rerr)
+		var m map[string]int
+		m["panic"] = 1
+		return nil
+	}()
+	var perr *panicError
+	assert.True(t, errors.As(err, &perr))
+	assert.Contains(t, err.Error(), "dtm panic: assignment to entry in nil map")
+	assert.Contains(t, perr.stack, "TestPanicError")
+
+	err = func() (rerr error) {
+		defer handlePanic(&rerr)
+		panic(storage.ErrNotFound)
+	}()
+	assert.False(t, errors.Is(err, storage.ErrNotFound)) // the panic is not unwrapped, so it is not taken as a result
+}
+
+func TestRecordPanicDisabled(t *testing.T) {
+	old := conf.PoisonThreshold
+	defer func() { conf.PoisonThreshold = old }()
+	conf.PoisonThreshold = 0
+	tg := &TransGlobal{}
+	tg.recordPanic(&panicError{value: "bad"}) // the store is not touched
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/msgbroker"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// BranchInvoker calls a branch by a transport. It returns the result of the branch: dtmcli.ResultSuccess,
+// dtmcli.ResultFailure or dtmcli.ResultOngoing, with an optional detail, such as the response kept for the branch or
+// the reason of the failure. An error means the call failed, and the branch is retried later.
+// ctx is done when the request timeout of the branch is reached
+type BranchInvoker func(ctx context.Context, branch *storage.TransBranchStore, trans *storage.TransGlobalStore) (result string, detail string, err error)
+
+// protocolInvoker is the invoker used by the processor, whose error is nil, or wraps dtmcli.ErrFailure or dtmcli.ErrOngoing
+type protocolInvoker func(t *TransGlobal, branch *TransBranch) error
+
+var protocols sync.Map // scheme -> protocolInvoker
+
+func init() {
+	protocols.Store("http", protocolInvoker((*TransGlobal).getHTTPResult))
+	protocols.Store("https", protocolInvoker((*TransGlobal).getHTTPResult))
+	protocols.Store("grpc", protocolInvoker((*TransGlobal).getGrpcResult)) // grpc urls in the trans of http
+}
+
+// RegisterProtocol registers the invoker of the branches whose urls are of the scheme, such as thrift for
+// thrift://host:port/Service/Method. It should be called before the server starts. The built-in http, https and grpc
+// can be replaced. The urls without any registered scheme are called by grpc, if the protocol of the trans is grpc
+func RegisterProtocol(scheme string, invoker BranchInvoker) {
+	protocols.Store(scheme, wrapInvoker(scheme, invoker))
+}
+
+// wrapInvoker wraps the BranchInvoker to the invoker used by the processor. name tells the invoker in the errors
+func wrapInvoker(name string, invoker BranchInvoker) protocolInvoker {
+	return func(t *TransGlobal, branch *TransBranch) error {
+		timeout := t.getRequestTimeout(branch)
+		if timeout == 0 {
+			timeout = conf.RequestTimeout
+		}
+		ctx, cancel := context.WithTimeout(logger.WithGid(context.Background(), t.Gid), time.Duration(timeout)*time.Second)
+		defer cancel()
+		result, detail, err := invoker(ctx, branch, &t.TransGlobalStore)
+		if err != nil {
+			return err
+		}
+		switch result {
+		case dtmcli.ResultSuccess:
+			if branch.Ext.KeepResult {
+				branch.Ext.Result = detail
+			}
+			return nil
+		case dtmcli.ResultFailure:
+			return fmt.Errorf("%s. %w", detail, dtmcli.ErrFailure)
+		case dtmcli.ResultOngoing:
+			return fmt.Errorf("%s. %w", detail, dtmcli.ErrOngoing)
+		}
+		return fmt.Errorf("unknown result %s of %s %s", result, name, branch.URL)
+	}
+}
+
+// urlScheme returns the scheme of the url, empty if it has none, such as the grpc url localhost:36790/busi.Busi/TransIn
+func urlScheme(uri string) string {
+	if i := strings.Index(uri, "://"); i > 0 {
+		return uri[:i]
+	}
+	return ""
+}
+
+func getProtocol(uri string) protocolInvoker {
+	if v, ok := protocols.Load(urlScheme(uri)); ok {
+		return v.(protocolInvoker)
+	}
+	return nil
+}
+
+// checkBranchProtocols checks the branches of a trans not of grpc can be called by a registered protocol, a broker, or
+// the protocol of the url resolved by a TargetResolver. the urls of grpc may have schemes of the micro service
+// drivers, so they are not checked
+func checkBranchProtocols(protocol string, branches []TransBranch) error {
+	if protocol == "grpc" {
+		return nil
+	}
+	for _, b := range branches {
+		if b.URL != "" && getProtocol(b.URL) == nil && !msgbroker.IsBrokerURL(b.URL) && getTargetResolver(b.URL) == nil {
+			return fmt.Errorf("no protocol registered for url %s of branch %s %s. %w", b.URL, b.BranchID, b.Op, dtmcli.ErrFailure)
+		}
+	}
+	return nil
+}
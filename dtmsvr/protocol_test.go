@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProtocol(t *testing.T) {
+	RegisterProtocol("fake", func(ctx context.Context, branch *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		if string(branch.BinData) == "error" {
+			return "", "", errors.New("conn refused")
+		}
+		return string(branch.BinData), "detail of " + trans.Gid, nil
+	})
+	defer protocols.Delete("fake")
+
+	tg := &TransGlobal{}
+	tg.Gid, tg.Protocol = "TestRegisterProtocol", "http"
+	call := func(result string) (*TransBranch, error) {
+		b := &TransBranch{URL: "fake://busi/TransIn", BinData: []byte(result)}
+		b.Ext.KeepResult = true
+		return b, tg.getURLResult(b)
+	}
+	b, err := call(dtmcli.ResultSuccess)
+	assert.Nil(t, err)
+	assert.Equal(t, "detail of TestRegisterProtocol", b.Ext.Result)
+	_, err = call(dtmcli.ResultFailure)
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+	_, err = call(dtmcli.ResultOngoing)
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	_, err = call("error")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, dtmcli.ErrFailure))
+	_, err = call("unknown")
+	assert.Error(t, err)
+}
+
+func TestCheckBranchProtocols(t *testing.T) {
+	assert.Equal(t, "thrift", urlScheme("thrift://busi/TransIn"))
+	assert.Equal(t, "", urlScheme("localhost:36790/busi.Busi/TransIn"))
+
+	branches := []TransBranch{{URL: "http://busi/TransIn"}, {URL: "https://busi/TransOut"}, {URL: ""}}
+	assert.Nil(t, checkBranchProtocols("http", branches))
+	branches = append(branches, TransBranch{URL: "thrift://busi/TransIn", BranchID: "01", Op: dtmcli.BranchAction})
+	err := checkBranchProtocols("http", branches)
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+	assert.Nil(t, checkBranchProtocols("grpc", branches))
+
+	RegisterProtocol("thrift", func(ctx context.Context, branch *storage.TransBranchStore, trans *storage.TransGlobalStore) (string, string, error) {
+		return dtmcli.ResultSuccess, "", nil
+	})
+	defer protocols.Delete("thrift")
+	assert.Nil(t, checkBranchProtocols("http", branches))
+}
+
+func TestCheckQueryPreparedTargets(t *testing.T) {
+	tg := &TransGlobal{}
+	tg.TransType, tg.Protocol = "msg", "http"
+	tg.QueryPrepared = "grpc://localhost:58081/busi.Busi/QueryPrepared"
+	assert.Nil(t, tg.checkQueryPreparedTargets())
+	tg.QueryPrepared = "localhost:58081/busi.Busi/QueryPrepared"
+	assert.True(t, errors.Is(tg.checkQueryPreparedTargets(), dtmcli.ErrInvalidArgument))
+	tg.QueryPreparedURLs = []string{"http://busi/QueryPrepared", "thrift://busi/QueryPrepared"}
+	assert.True(t, errors.Is(tg.checkQueryPreparedTargets(), dtmcli.ErrInvalidArgument))
+
+	tg.Protocol = "grpc" // the http targets and the urls of the drivers are both valid
+	tg.QueryPreparedURLs = []string{"http://busi/QueryPrepared", "discovery://busi/busi.Busi/QueryPrepared"}
+	assert.Nil(t, tg.checkQueryPreparedTargets())
+	tg.QueryPreparedURLs = []string{"grpc://localhost:58081"}
+	assert.True(t, errors.Is(tg.checkQueryPreparedTargets(), dtmcli.ErrInvalidArgument))
+}
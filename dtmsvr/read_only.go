@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmgrpc"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+)
+
+// readOnly is 1 if the server is read-only, initialized by conf.ReadOnly and switched by the admin api at runtime.
+// a read-only server refuses the requests changing trans, and does not claim trans to process or run the maintenance
+// jobs. the trans being processed are finished, and the queries, stats, metrics and health work as usual
+var readOnly int32
+
+func isReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+// setReadOnly switches the read-only mode of the server
+func setReadOnly(on bool) {
+	v := dtmimp.If(on, int32(1), int32(0)).(int32)
+	if atomic.SwapInt32(&readOnly, v) != v {
+		logger.Infof("dtm server read-only: %t", on)
+	}
+	readOnlyGauge.Set(float64(v))
+}
+
+// checkWritable returns ErrReadOnly if the server is read-only
+func checkWritable() error {
+	if isReadOnly() {
+		return fmt.Errorf("dtm server is read-only, the trans can not be changed. %w", dtmcli.ErrReadOnly)
+	}
+	return nil
+}
+
+// readOnlyGuard refuses the http requests changing trans if the server is read-only. the body is like the errors of
+// both v1 and v2 api, with the code READ_ONLY
+func readOnlyGuard(c *gin.Context) {
+	if err := checkWritable(); err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, map[string]interface{}{"code": dtmimp.CodeReadOnly, "message": err.Error()})
+	}
+}
+
+// grpcReadOnly refuses the grpc requests changing trans if the server is read-only. all the methods except NewGid
+// change trans
+func grpcReadOnly(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasSuffix(info.FullMethod, "/NewGid") {
+		if err := checkWritable(); err != nil {
+			return nil, dtmgrpc.DtmError2GrpcError(err)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// adminReadOnly switches the read-only mode by {"read_only": true}, and returns the mode
+func adminReadOnly(c *gin.Context) interface{} {
+	data := map[string]bool{}
+	err := c.BindJSON(&data)
+	e2p(err)
+	on, ok := data["read_only"]
+	if !ok {
+		return fmt.Errorf("no read_only specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	logger.Infof("admin read-only from %s: %t", c.ClientIP(), on)
+	setReadOnly(on)
+	return map[string]interface{}{"read_only": isReadOnly()}
+}
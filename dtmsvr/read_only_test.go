@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnly(t *testing.T) {
+	defer setReadOnly(false)
+	assert.Nil(t, checkWritable())
+	setReadOnly(true)
+	assert.True(t, errors.Is(checkWritable(), dtmcli.ErrReadOnly))
+
+	app := gin.New()
+	app.POST("/submit", readOnlyGuard, func(c *gin.Context) { c.JSON(http.StatusOK, nil) })
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/submit", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"READ_ONLY"`)
+
+	handled := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handled++
+		return nil, nil
+	}
+	_, err := grpcReadOnly(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/dtmgimp.Dtm/Submit"}, handler)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = grpcReadOnly(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/dtmgimp.Dtm/NewGid"}, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, handled)
+
+	setReadOnly(false)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/submit", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmutil"
+)
+
+// the results of branch attempts
+const (
+	AttemptSucceed = "succeed" // the branch succeeded
+	AttemptFailure = "failure" // the branch returned FAILURE
+	AttemptOngoing = "ongoing" // the branch returned ONGOING, or timed out
+	AttemptError   = "error"   // the branch can not be called, or returned an unexpected result
+)
+
+// BranchAttempt is a record of calling a branch. the attempts make up the audit trail of the processing of a trans
+type BranchAttempt struct {
+	dtmutil.ModelBase
+	Gid       string     `json:"gid"`
+	BranchID  string     `json:"branch_id"`
+	Op        string     `json:"op"`
+	Attempt   int        `json:"attempt"` // 1 for the first call of the branch id and op. filled by SaveAttempt
+	Target    string     `json:"target"`  // the url called, which is rewritten or resolved from the url of the branch if any
+	StartTime *time.Time `json:"start_time"`
+	Duration  int64      `json:"duration"`           // in milliseconds
+	Result    string     `json:"result"`             // one of AttemptSucceed, AttemptFailure, AttemptOngoing and AttemptError
+	Response  string     `json:"response,omitempty"` // the response or the error, truncated
+}
+
+// TableName TableName
+func (a *BranchAttempt) TableName() string {
+	return config.Config.Store.TransBranchAttemptTable
+}
+
+// NextAttempt returns the attempt number of the next call of the branch, for the stores saving attempts
+func NextAttempt(attempts []BranchAttempt, branchID string, op string) int {
+	next := 1
+	for _, a := range attempts {
+		if a.BranchID == branchID && a.Op == op && a.Attempt >= next {
+			next = a.Attempt + 1
+		}
+	}
+	return next
+}
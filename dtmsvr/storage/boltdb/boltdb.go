@@ -7,6 +7,7 @@
 package boltdb
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"time"
@@ -24,6 +25,8 @@ type Store struct {
 
 	dataExpire    int64
 	retryInterval int64
+	batch         bool
+	priorityAging time.Duration
 }
 
 // NewStore will return the boltdb implement
@@ -54,6 +57,31 @@ func NewStore(dataExpire int64, retryInterval int64) *Store {
 	return s
 }
 
+// SetBatchDelay enables the batched commits of the writes of trans, if delay is positive. the concurrent writes in the
+// delay are committed in one bolt transaction, so they share one fsync. every write still returns after its commit
+func (s *Store) SetBatchDelay(delay time.Duration) {
+	s.batch = delay > 0
+	if s.batch {
+		s.boltDb.MaxBatchDelay = delay
+	}
+}
+
+// SetPriorityAging sets the time after which an overdue trans is locked as the max priority. 0 means never
+func (s *Store) SetPriorityAging(aging time.Duration) {
+	s.priorityAging = aging
+}
+
+// update runs fn in a bolt transaction, or in a batch if enabled. in a batch, fn may be called more than once: if any fn
+// of the batch fails, the batch is rolled back, and every fn is rerun. so fn must be idempotent: it only writes the tx
+// and the locals of the caller, which are set again by every run, and never the arguments of the caller, which are
+// changed by the caller after update returns nil. if fn returns an error, it is rerun alone, and the error is returned
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	if s.batch {
+		return s.boltDb.Batch(fn)
+	}
+	return s.boltDb.Update(fn)
+}
+
 func initializeBuckets(db *bolt.DB) error {
 	return db.Update(func(t *bolt.Tx) error {
 		for _, bucket := range allBuckets {
@@ -99,6 +127,7 @@ func cleanupExpiredData(expiredSeconds time.Duration, db *bolt.DB) error {
 		cleanupGlobalWithGids(t, expiredGids)
 		cleanupBranchWithGids(t, expiredGids)
 		cleanupIndexWithGids(t, expiredGids)
+		cleanupAttemptWithGids(t, expiredGids)
 		return nil
 	})
 }
@@ -171,13 +200,40 @@ func cleanupIndexWithGids(t *bolt.Tx, gids map[string]struct{}) {
 	}
 }
 
+func cleanupAttemptWithGids(t *bolt.Tx, gids map[string]struct{}) {
+	bucket := t.Bucket(bucketAttempt)
+	if bucket == nil {
+		return
+	}
+
+	attemptKeys := [][]byte{}
+	for gid := range gids {
+		cursor := bucket.Cursor()
+		prefix := attemptPrefix(gid)
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			attemptKeys = append(attemptKeys, append([]byte{}, k...))
+		}
+	}
+
+	logger.Debugf("Start to cleanup %d attempts", len(attemptKeys))
+	for _, key := range attemptKeys {
+		dtmimp.E2P(bucket.Delete(key))
+	}
+}
+
 var bucketGlobal = []byte("global")
 var bucketBranches = []byte("branches")
 var bucketIndex = []byte("index")
+var bucketKV = []byte("kv")
+var bucketAttempt = []byte("attempt")
+var bucketEvent = []byte("event")
 var allBuckets = [][]byte{
+	bucketAttempt,
 	bucketBranches,
+	bucketEvent,
 	bucketGlobal,
 	bucketIndex,
+	bucketKV,
 }
 
 func tGetGlobal(t *bolt.Tx, gid string) *storage.TransGlobalStore {
@@ -203,12 +259,44 @@ func tGetBranches(t *bolt.Tx, gid string) []storage.TransBranchStore {
 	}
 	return branches
 }
+
+// tGetBranchesPage reads the branches by the cursor, and stops once the page is full
+func tGetBranchesPage(t *bolt.Tx, gid string, afterBranchID string, limit int) []storage.TransBranchStore {
+	branches := []storage.TransBranchStore{}
+	found := afterBranchID == ""
+	cursor := t.Bucket(bucketBranches).Cursor()
+	for k, v := cursor.Seek([]byte(gid)); k != nil; k, v = cursor.Next() {
+		b := storage.TransBranchStore{}
+		dtmimp.MustUnmarshal(v, &b)
+		if b.Gid != gid {
+			break
+		}
+		if b.BranchID == afterBranchID {
+			found = true
+			continue
+		} else if !found {
+			continue
+		}
+		if len(branches) >= limit && b.BranchID != branches[len(branches)-1].BranchID {
+			break
+		}
+		branches = append(branches, b)
+	}
+	return branches
+}
 func tPutGlobal(t *bolt.Tx, global *storage.TransGlobalStore) {
 	bs := dtmimp.MustMarshal(global)
 	err := t.Bucket(bucketGlobal).Put([]byte(global.Gid), bs)
 	dtmimp.E2P(err)
 }
 
+// tPutGlobalKeepCustomData puts the global with the custom data of the saved one, which may be updated by UpdateGlobalCustomData
+func tPutGlobalKeepCustomData(t *bolt.Tx, global *storage.TransGlobalStore, saved *storage.TransGlobalStore) {
+	g := *global
+	g.CustomData = saved.CustomData
+	tPutGlobal(t, &g)
+}
+
 func tPutBranches(t *bolt.Tx, branches []storage.TransBranchStore, start int64) {
 	if start == -1 {
 		bs := tGetBranches(t, branches[0].Gid)
@@ -239,6 +327,11 @@ func (s *Store) Ping() error {
 	return nil
 }
 
+// Now returns the local now, because boltdb is a local file
+func (s *Store) Now() (time.Time, error) {
+	return time.Now(), nil
+}
+
 // PopulateData populates data to boltdb
 func (s *Store) PopulateData(skipDrop bool) {
 	if !skipDrop {
@@ -246,12 +339,21 @@ func (s *Store) PopulateData(skipDrop bool) {
 			dtmimp.E2P(t.DeleteBucket(bucketIndex))
 			dtmimp.E2P(t.DeleteBucket(bucketBranches))
 			dtmimp.E2P(t.DeleteBucket(bucketGlobal))
+			dtmimp.E2P(t.DeleteBucket(bucketKV))
+			dtmimp.E2P(t.DeleteBucket(bucketAttempt))
+			dtmimp.E2P(t.DeleteBucket(bucketEvent))
 			_, err := t.CreateBucket(bucketIndex)
 			dtmimp.E2P(err)
 			_, err = t.CreateBucket(bucketBranches)
 			dtmimp.E2P(err)
 			_, err = t.CreateBucket(bucketGlobal)
 			dtmimp.E2P(err)
+			_, err = t.CreateBucket(bucketKV)
+			dtmimp.E2P(err)
+			_, err = t.CreateBucket(bucketAttempt)
+			dtmimp.E2P(err)
+			_, err = t.CreateBucket(bucketEvent)
+			dtmimp.E2P(err)
 
 			return nil
 		})
@@ -271,7 +373,7 @@ func (s *Store) FindTransGlobalStore(gid string) (trans *storage.TransGlobalStor
 }
 
 // ScanTransGlobalStores lists GlobalTrans data
-func (s *Store) ScanTransGlobalStores(position *string, limit int64) []storage.TransGlobalStore {
+func (s *Store) ScanTransGlobalStores(position *string, limit int64, condition storage.TransGlobalScanCondition) []storage.TransGlobalStore {
 	globals := []storage.TransGlobalStore{}
 	err := s.boltDb.View(func(t *bolt.Tx) error {
 		cursor := t.Bucket(bucketGlobal).Cursor()
@@ -281,6 +383,9 @@ func (s *Store) ScanTransGlobalStores(position *string, limit int64) []storage.T
 			}
 			g := storage.TransGlobalStore{}
 			dtmimp.MustUnmarshal(v, &g)
+			if !condition.Match(&g) {
+				continue
+			}
 			globals = append(globals, g)
 			if len(globals) == int(limit) {
 				break
@@ -308,14 +413,32 @@ func (s *Store) FindBranches(gid string) []storage.TransBranchStore {
 	return branches
 }
 
+// FindBranchesPage finds a page of Branch data by gid
+func (s *Store) FindBranchesPage(gid string, afterBranchID string, limit int) []storage.TransBranchStore {
+	var branches []storage.TransBranchStore
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		branches = tGetBranchesPage(t, gid, afterBranchID, limit)
+		return nil
+	})
+	dtmimp.E2P(err)
+	return branches
+}
+
+// FindBranch finds a branch by gid, branch id and op
+func (s *Store) FindBranch(gid string, branchID string, op string) *storage.TransBranchStore {
+	return storage.FindBranch(s.FindBranches(gid), branchID, op)
+}
+
 // UpdateBranches update branches info
 func (s *Store) UpdateBranches(branches []storage.TransBranchStore, updates []string) (int, error) {
 	return 0, nil // not implemented
 }
 
-// LockGlobalSaveBranches creates branches
-func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) {
-	err := s.boltDb.Update(func(t *bolt.Tx) error {
+// LockGlobalSaveBranches saves branches
+func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) []bool {
+	var saved []bool
+	err := s.update(func(t *bolt.Tx) error {
+		saved = make([]bool, len(branches))
 		g := tGetGlobal(t, gid)
 		if g == nil {
 			return storage.ErrNotFound
@@ -323,18 +446,36 @@ func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []sto
 		if g.Status != status {
 			return storage.ErrNotFound
 		}
-		tPutBranches(t, branches, int64(branchStart))
+		bs := tGetBranches(t, gid)
+		for i, b := range branches {
+			pos := branchStart + i
+			if branchStart == -1 {
+				if storage.FindBranch(bs, b.BranchID, b.Op) != nil {
+					continue
+				}
+				pos = len(bs)
+				bs = append(bs, b)
+			} else if pos < len(bs) {
+				if storage.IsBranchDowngrade(&bs[pos], &b) {
+					continue
+				}
+				b.CreateTime = bs[pos].CreateTime
+			}
+			tPutBranches(t, []storage.TransBranchStore{b}, int64(pos))
+			saved[i] = true
+		}
 		return nil
 	})
 	dtmimp.E2P(err)
+	return saved
 }
 
 // MaySaveNewTrans creates a new trans
 func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []storage.TransBranchStore) error {
-	return s.boltDb.Update(func(t *bolt.Tx) error {
+	return s.update(func(t *bolt.Tx) error {
 		g := tGetGlobal(t, global.Gid)
 		if g != nil {
-			return storage.ErrUniqueConflict
+			return storage.DuplicateTrans(global, g)
 		}
 		tPutGlobal(t, global)
 		tPutIndex(t, global.NextCronTime.Unix(), global.Gid)
@@ -343,67 +484,246 @@ func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []sto
 	})
 }
 
-// ChangeGlobalStatus changes global trans status
-func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) {
-	old := global.Status
-	global.Status = newStatus
+// MaySaveNewTransBatch creates the new trans in one db transaction
+func (s *Store) MaySaveNewTransBatch(trans []storage.NewTrans) []error {
+	errs := make([]error, len(trans))
 	err := s.boltDb.Update(func(t *bolt.Tx) error {
+		for i, nt := range trans {
+			if g := tGetGlobal(t, nt.Global.Gid); g != nil {
+				errs[i] = storage.DuplicateTrans(nt.Global, g)
+				continue
+			}
+			tPutGlobal(t, nt.Global)
+			tPutIndex(t, nt.Global.NextCronTime.Unix(), nt.Global.Gid)
+			tPutBranches(t, nt.Branches, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// ChangeGlobalStatus changes global trans status
+func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) error {
+	err := s.update(func(t *bolt.Tx) error {
 		g := tGetGlobal(t, global.Gid)
-		if g == nil || g.Status != old {
-			return storage.ErrNotFound
+		if err := storage.GlobalConflict(global, global.Status, g); err != nil {
+			return err
 		}
+		changed := *global
+		changed.Status, changed.Version = newStatus, global.Version+1
 		if finished {
 			tDelIndex(t, g.NextCronTime.Unix(), g.Gid)
 		}
-		tPutGlobal(t, global)
+		tPutGlobalKeepCustomData(t, &changed, g)
 		return nil
 	})
-	dtmimp.E2P(err)
+	if err == nil {
+		global.Status, global.Version = newStatus, global.Version+1
+	}
+	return err
+}
+
+// UpdateGlobalCustomData updates the custom data of an unfinished trans
+func (s *Store) UpdateGlobalCustomData(global *storage.TransGlobalStore, data string) error {
+	var version int64
+	err := s.update(func(t *bolt.Tx) error {
+		g := tGetGlobal(t, global.Gid)
+		if err := storage.GlobalConflict(global, storage.StatusUnfinished, g); err != nil {
+			return err
+		}
+		g.CustomData = data
+		g.UpdateTime = dtmutil.GetNextTime(0)
+		g.Version++
+		version = g.Version
+		tPutGlobal(t, g)
+		return nil
+	})
+	if err == nil {
+		global.CustomData, global.Version = data, version
+	}
+	return err
 }
 
 // TouchCronTime updates cronTime
 func (s *Store) TouchCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
-	oldUnix := global.NextCronTime.Unix()
+	setCronTime(global, nextCronInterval, nextCronTime)
+	touched := false
+	err := s.update(func(t *bolt.Tx) error {
+		touched = tTouchCronTime(t, global)
+		return nil
+	})
+	dtmimp.E2P(err)
+	if touched {
+		global.Version++
+	}
+}
+
+// TouchCronTimes touches the cron times in one transaction
+func (s *Store) TouchCronTimes(updates []storage.CronTimeUpdate) {
+	for _, u := range updates {
+		setCronTime(u.Global, u.NextCronInterval, u.NextCronTime)
+	}
+	touched := make([]bool, len(updates))
+	err := s.update(func(t *bolt.Tx) error {
+		for i, u := range updates {
+			touched[i] = tTouchCronTime(t, u.Global)
+		}
+		return nil
+	})
+	dtmimp.E2P(err)
+	for i, u := range updates {
+		if touched[i] {
+			u.Global.Version++
+		}
+	}
+}
+
+func setCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
 	global.UpdateTime = dtmutil.GetNextTime(0)
 	global.NextCronTime = nextCronTime
 	global.NextCronInterval = nextCronInterval
-	err := s.boltDb.Update(func(t *bolt.Tx) error {
-		g := tGetGlobal(t, global.Gid)
-		if g == nil || g.Gid != global.Gid {
-			return storage.ErrNotFound
+}
+
+// tTouchCronTime saves the cron time of global with the next version, skipped if its status or version is changed.
+// global is not changed, so the version is increased by the caller after the commit
+func tTouchCronTime(t *bolt.Tx, global *storage.TransGlobalStore) bool {
+	g := tGetGlobal(t, global.Gid)
+	if storage.GlobalConflict(global, global.Status, g) != nil {
+		return false
+	}
+	next := *global
+	next.Version++
+	tDelIndex(t, g.NextCronTime.Unix(), global.Gid)
+	tPutGlobalKeepCustomData(t, &next, g)
+	tPutIndex(t, next.NextCronTime.Unix(), global.Gid)
+	return true
+}
+
+// FindOldestCronTime finds the earliest next_cron_time of the unfinished trans, by the first key of the index
+func (s *Store) FindOldestCronTime() *time.Time {
+	var oldest *time.Time
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		if k, _ := t.Bucket(bucketIndex).Cursor().First(); k != nil {
+			next := time.Unix(int64(dtmimp.MustAtoi(strings.SplitN(string(k), "-", 2)[0])), 0)
+			oldest = &next
+		}
+		return nil
+	})
+	dtmimp.E2P(err)
+	return oldest
+}
+
+// CountCronTimeBefore counts the unfinished trans whose next_cron_time is before the time, by iterating the index
+func (s *Store) CountCronTimeBefore(before time.Time) int64 {
+	var count int64
+	max := fmt.Sprintf("%d", before.Unix())
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		cursor := t.Bucket(bucketIndex).Cursor()
+		for k, _ := cursor.First(); k != nil && string(k) < max; k, _ = cursor.Next() {
+			count++
+		}
+		return nil
+	})
+	dtmimp.E2P(err)
+	return count
+}
+
+// CountOverdueByPriority counts the unfinished trans whose next_cron_time is before the time by priority
+func (s *Store) CountOverdueByPriority(before time.Time) map[int]int64 {
+	counts := map[int]int64{}
+	max := fmt.Sprintf("%d", before.Unix())
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		cursor := t.Bucket(bucketIndex).Cursor()
+		for k, v := cursor.First(); k != nil && string(k) < max; k, v = cursor.Next() {
+			if g := tGetGlobal(t, string(v)); g != nil {
+				counts[g.Priority]++
+			}
+		}
+		return nil
+	})
+	dtmimp.E2P(err)
+	return counts
+}
+
+// CountCronTimeAfter counts the unfinished trans whose next_cron_time is not before the time, the same as ResetCronTime
+func (s *Store) CountCronTimeAfter(after time.Time) int64 {
+	var count int64
+	min := fmt.Sprintf("%d", after.Unix())
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		cursor := t.Bucket(bucketIndex).Cursor()
+		for k, _ := cursor.Seek([]byte(min)); k != nil; k, _ = cursor.Next() {
+			count++
 		}
-		tDelIndex(t, oldUnix, global.Gid)
-		tPutGlobal(t, global)
-		tPutIndex(t, global.NextCronTime.Unix(), global.Gid)
 		return nil
 	})
 	dtmimp.E2P(err)
+	return count
 }
 
-// LockOneGlobalTrans finds GlobalTrans
+// Stats computes the stats from all the trans
+func (s *Store) Stats(cond storage.StatsCondition) *storage.TransStats {
+	c := storage.NewStatsCollector(cond)
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		return t.Bucket(bucketGlobal).ForEach(func(k, v []byte) error {
+			g := storage.TransGlobalStore{}
+			dtmimp.MustUnmarshal(v, &g)
+			c.Add(&g)
+			return nil
+		})
+	})
+	dtmimp.E2P(err)
+	return c.Result(false)
+}
+
+// the max number of the expired trans compared by priority in LockOneGlobalTrans
+const lockScanLimit = 1000
+
+// LockOneGlobalTrans finds GlobalTrans of the highest priority among the earliest lockScanLimit expired ones. the trans
+// overdue for more than priorityAging is taken as the max priority
 func (s *Store) LockOneGlobalTrans(expireIn time.Duration) *storage.TransGlobalStore {
 	var trans *storage.TransGlobalStore
 	min := fmt.Sprintf("%d", time.Now().Add(expireIn).Unix())
 	next := time.Now().Add(time.Duration(s.retryInterval) * time.Second)
+	aged := ""
+	if s.priorityAging > 0 {
+		aged = fmt.Sprintf("%d", time.Now().Add(-s.priorityAging).Unix())
+	}
 	err := s.boltDb.Update(func(t *bolt.Tx) error {
-		cursor := t.Bucket(bucketIndex).Cursor()
-		for trans == nil {
-			k, v := cursor.First()
-			if k == nil || string(k) > min {
-				return storage.ErrNotFound
+		bucket := t.Bucket(bucketIndex)
+		cursor := bucket.Cursor()
+		var key []byte
+		stales := [][]byte{}
+		priority := 0
+		scanned := 0
+		for k, v := cursor.First(); k != nil && string(k) <= min && scanned < lockScanLimit; k, v = cursor.Next() {
+			g := tGetGlobal(t, string(v))
+			if g == nil {
+				stales = append(stales, append([]byte{}, k...))
+				continue
+			}
+			scanned++
+			p := dtmimp.If(string(k) < aged, dtmimp.PriorityMax, g.Priority).(int)
+			if trans == nil || p > priority { // the index is ordered by time, so the earliest is kept for the same priority
+				key, trans, priority = append([]byte{}, k...), g, p
 			}
-			trans = tGetGlobal(t, string(v))
-			err := t.Bucket(bucketIndex).Delete(k)
-			dtmimp.E2P(err)
 		}
+		for _, k := range stales {
+			dtmimp.E2P(bucket.Delete(k))
+		}
+		if trans == nil {
+			return nil
+		}
+		dtmimp.E2P(bucket.Delete(key))
 		trans.NextCronTime = &next
 		tPutGlobal(t, trans)
 		tPutIndex(t, next.Unix(), trans.Gid)
 		return nil
 	})
-	if err == storage.ErrNotFound {
-		return nil
-	}
 	dtmimp.E2P(err)
 	return trans
 }
@@ -436,3 +756,216 @@ func (s *Store) ResetCronTime(timeout time.Duration, limit int64) (succeedCount
 	})
 	return
 }
+
+func kvKey(cat, key string) []byte {
+	return []byte(fmt.Sprintf("%s-%s", cat, key))
+}
+
+// FindKV finds key-value pairs
+func (s *Store) FindKV(cat, key string) []storage.KVStore {
+	kvs := []storage.KVStore{}
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		cursor := t.Bucket(bucketKV).Cursor()
+		prefix := kvKey(cat, key)
+		for k, v := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cursor.Next() {
+			kv := storage.KVStore{}
+			dtmimp.MustUnmarshal(v, &kv)
+			if kv.Cat == cat && (key == "" || kv.K == key) {
+				kvs = append(kvs, kv)
+			}
+		}
+		return nil
+	})
+	dtmimp.E2P(err)
+	return kvs
+}
+
+// UpdateKV updates key-value pair with the version as optimistic lock
+func (s *Store) UpdateKV(kv *storage.KVStore) error {
+	oldVersion := kv.Version
+	kv.Version = oldVersion + 1
+	kv.UpdateTime = dtmutil.GetNextTime(0)
+	return s.boltDb.Update(func(t *bolt.Tx) error {
+		bs := t.Bucket(bucketKV).Get(kvKey(kv.Cat, kv.K))
+		old := storage.KVStore{}
+		if bs != nil {
+			dtmimp.MustUnmarshal(bs, &old)
+		}
+		if bs == nil || old.Version != oldVersion {
+			return storage.ErrNotFound
+		}
+		return t.Bucket(bucketKV).Put(kvKey(kv.Cat, kv.K), dtmimp.MustMarshal(kv))
+	})
+}
+
+// DeleteKV deletes key-value pair
+func (s *Store) DeleteKV(cat, key string) error {
+	return s.boltDb.Update(func(t *bolt.Tx) error {
+		if t.Bucket(bucketKV).Get(kvKey(cat, key)) == nil {
+			return storage.ErrNotFound
+		}
+		return t.Bucket(bucketKV).Delete(kvKey(cat, key))
+	})
+}
+
+// CreateKV creates key-value pair
+func (s *Store) CreateKV(cat, key, value string) error {
+	now := time.Now()
+	kv := &storage.KVStore{Cat: cat, K: key, V: value, Version: 1}
+	kv.CreateTime = &now
+	kv.UpdateTime = &now
+	return s.boltDb.Update(func(t *bolt.Tx) error {
+		if t.Bucket(bucketKV).Get(kvKey(cat, key)) != nil {
+			return storage.ErrUniqueConflict
+		}
+		return t.Bucket(bucketKV).Put(kvKey(cat, key), dtmimp.MustMarshal(kv))
+	})
+}
+
+// attemptPrefix is the prefix of the keys of the attempts of the trans. the attempts of a trans are keyed by the gid and
+// the sequence of the bucket, so that they are read in the order saved
+func attemptPrefix(gid string) []byte {
+	return []byte(gid + "\x00")
+}
+
+func tGetAttempts(t *bolt.Tx, gid string) []storage.BranchAttempt {
+	attempts := []storage.BranchAttempt{}
+	cursor := t.Bucket(bucketAttempt).Cursor()
+	prefix := attemptPrefix(gid)
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		a := storage.BranchAttempt{}
+		dtmimp.MustUnmarshal(v, &a)
+		attempts = append(attempts, a)
+	}
+	return attempts
+}
+
+// SaveAttempt saves an attempt of calling a branch
+func (s *Store) SaveAttempt(attempt *storage.BranchAttempt) error {
+	now := time.Now()
+	attempt.CreateTime = &now
+	attempt.UpdateTime = &now
+	var saved storage.BranchAttempt
+	err := s.update(func(t *bolt.Tx) error {
+		bucket := t.Bucket(bucketAttempt)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		saved = *attempt
+		saved.ID = seq
+		saved.Attempt = storage.NextAttempt(tGetAttempts(t, attempt.Gid), attempt.BranchID, attempt.Op)
+		return bucket.Put([]byte(fmt.Sprintf("%s%020d", attemptPrefix(attempt.Gid), seq)), dtmimp.MustMarshal(&saved))
+	})
+	if err == nil {
+		attempt.ID, attempt.Attempt = saved.ID, saved.Attempt
+	}
+	return err
+}
+
+// FindAttempts finds the attempts of calling the branches of the trans
+func (s *Store) FindAttempts(gid string) []storage.BranchAttempt {
+	var attempts []storage.BranchAttempt
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		attempts = tGetAttempts(t, gid)
+		return nil
+	})
+	dtmimp.E2P(err)
+	return attempts
+}
+
+// PurgeAttempts deletes the attempts saved before the time
+func (s *Store) PurgeAttempts(before time.Time) (int64, error) {
+	var purged int64
+	err := s.boltDb.Update(func(t *bolt.Tx) error {
+		bucket := t.Bucket(bucketAttempt)
+		keys := [][]byte{}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			a := storage.BranchAttempt{}
+			dtmimp.MustUnmarshal(v, &a)
+			if a.CreateTime.Before(before) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = int64(len(keys))
+		return nil
+	})
+	return purged, err
+}
+
+// eventKey returns the key of the event of the seq, which is ordered as the seq
+func eventKey(seq int64) []byte {
+	return []byte(fmt.Sprintf("%020d", seq))
+}
+
+// SaveEvent saves an event to the event log. the seq is the sequence of the bucket, which is persisted in the file
+func (s *Store) SaveEvent(event *storage.EventRecord) error {
+	var seq uint64
+	err := s.update(func(t *bolt.Tx) error {
+		bucket := t.Bucket(bucketEvent)
+		var err error
+		if seq, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		saved := *event
+		saved.Seq = int64(seq)
+		return bucket.Put(eventKey(saved.Seq), dtmimp.MustMarshal(&saved))
+	})
+	if err == nil {
+		event.Seq = int64(seq)
+	}
+	return err
+}
+
+// FindEvents finds the events after the seq in the order of seq
+func (s *Store) FindEvents(afterSeq int64, limit int) []storage.EventRecord {
+	events := []storage.EventRecord{}
+	err := s.boltDb.View(func(t *bolt.Tx) error {
+		cursor := t.Bucket(bucketEvent).Cursor()
+		for k, v := cursor.Seek(eventKey(afterSeq + 1)); k != nil && len(events) < limit; k, v = cursor.Next() {
+			e := storage.EventRecord{}
+			dtmimp.MustUnmarshal(v, &e)
+			events = append(events, e)
+		}
+		return nil
+	})
+	dtmimp.E2P(err)
+	return events
+}
+
+// PurgeEvents deletes the events saved before the time, and not after maxSeq
+func (s *Store) PurgeEvents(before time.Time, maxSeq int64) (int64, error) {
+	var purged int64
+	err := s.boltDb.Update(func(t *bolt.Tx) error {
+		bucket := t.Bucket(bucketEvent)
+		keys := [][]byte{}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			e := storage.EventRecord{}
+			dtmimp.MustUnmarshal(v, &e)
+			if storage.PurgeableEvents([]storage.EventRecord{e}, before, maxSeq) == 0 {
+				break
+			}
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = int64(len(keys))
+		return nil
+	})
+	return purged, err
+}
+
+// PurgePayloads does nothing, because the payloads are not deduplicated
+func (s *Store) PurgePayloads(before time.Time) (int64, error) {
+	return 0, nil
+}
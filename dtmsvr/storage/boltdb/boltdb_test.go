@@ -7,7 +7,14 @@
 package boltdb
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,7 +22,10 @@ import (
 	bolt "go.etcd.io/bbolt"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
 	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmsvr/storage/memory"
+	"github.com/dtm-labs/dtm/dtmutil"
 )
 
 func TestInitializeBuckets(t *testing.T) {
@@ -336,3 +346,674 @@ func TestCleanupIndexWithGids(t *testing.T) {
 		g.Expect(actualKeys).To(Equal([]string{"3-gid2", "a", "z"}))
 	})
 }
+
+func TestKV(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	g.Expect(s.CreateKV("topics", "t1", "v1")).ToNot(HaveOccurred())
+	g.Expect(s.CreateKV("topics", "t1", "v1")).To(Equal(storage.ErrUniqueConflict))
+	g.Expect(s.CreateKV("topics", "t11", "v11")).ToNot(HaveOccurred())
+	g.Expect(s.CreateKV("others", "t1", "o1")).ToNot(HaveOccurred())
+	g.Expect(s.FindKV("topics", "")).To(HaveLen(2))
+
+	kvs := s.FindKV("topics", "t1")
+	g.Expect(kvs).To(HaveLen(1))
+	g.Expect(kvs[0].V).To(Equal("v1"))
+	kv2 := kvs[0]
+	kvs[0].V = "v2"
+	g.Expect(s.UpdateKV(&kvs[0])).ToNot(HaveOccurred())
+	g.Expect(s.UpdateKV(&kv2)).To(Equal(storage.ErrNotFound)) // version changed
+	g.Expect(s.FindKV("topics", "t1")[0].Version).To(Equal(uint64(2)))
+
+	g.Expect(s.DeleteKV("topics", "t1")).ToNot(HaveOccurred())
+	g.Expect(s.DeleteKV("topics", "t1")).To(Equal(storage.ErrNotFound))
+	g.Expect(s.FindKV("topics", "t1")).To(HaveLen(0))
+}
+
+func TestScanTenant(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	for _, tenant := range []string{"t1", "", "t2", "t1"} {
+		global := &storage.TransGlobalStore{Gid: dtmimp.GidFromKey(tenant + time.Now().String()), NextCronTime: &time.Time{}}
+		global.Tenant = tenant
+		g.Expect(s.MaySaveNewTrans(global, nil)).ToNot(HaveOccurred())
+	}
+
+	position := ""
+	g.Expect(s.ScanTransGlobalStores(&position, 100, storage.TransGlobalScanCondition{})).To(HaveLen(4))
+	globals := s.ScanTransGlobalStores(&position, 100, storage.TransGlobalScanCondition{Tenant: "t1"})
+	g.Expect(globals).To(HaveLen(2))
+	g.Expect(globals[0].Tenant).To(Equal("t1"))
+	g.Expect(s.FindTransGlobalStore(globals[1].Gid).Tenant).To(Equal("t1"))
+	g.Expect(s.ScanTransGlobalStores(&position, 100, storage.TransGlobalScanCondition{Tenant: "t3"})).To(HaveLen(0))
+}
+
+func TestEncryptedStore(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	raw := &Store{boltDb: db}
+	config.Config.Store.EncryptionKeys = "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+	defer func() { config.Config.Store.EncryptionKeys = "" }()
+	s := storage.NewEncryptedStore(raw)
+
+	global := &storage.TransGlobalStore{Gid: "gid1", Status: "prepared", CustomData: `{"concurrent":true}`, NextCronTime: &time.Time{}}
+	branches := []storage.TransBranchStore{{Gid: "gid1", BranchID: "01", Op: "action", BinData: []byte(`{"amount":30}`)}}
+	g.Expect(s.MaySaveNewTrans(global, branches)).ToNot(HaveOccurred())
+	g.Expect(global.CustomData).To(Equal(`{"concurrent":true}`)) // restored after saved
+	g.Expect(branches[0].BinData).To(Equal([]byte(`{"amount":30}`)))
+
+	g.Expect(raw.FindTransGlobalStore("gid1").CustomData).To(HavePrefix("dtme:k1:"))
+	g.Expect(string(raw.FindBranches("gid1")[0].BinData)).To(HavePrefix("dtme:k1:"))
+	g.Expect(s.FindTransGlobalStore("gid1").CustomData).To(Equal(`{"concurrent":true}`))
+	g.Expect(s.FindBranches("gid1")[0].BinData).To(Equal([]byte(`{"amount":30}`)))
+
+	g.Expect(s.ChangeGlobalStatus(global, "submitted", []string{"status"}, false)).ToNot(HaveOccurred())
+	g.Expect(raw.FindTransGlobalStore("gid1").CustomData).To(HavePrefix("dtme:k1:"))
+	g.Expect(s.FindTransGlobalStore("gid1").Status).To(Equal("submitted"))
+}
+
+func TestChangeGlobalStatusConflict(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	global := &storage.TransGlobalStore{Gid: "gid1", Status: "submitted", NextCronTime: &time.Time{}}
+	g.Expect(s.MaySaveNewTrans(global, nil)).ToNot(HaveOccurred())
+	other := *global // another instance finishes the trans
+	g.Expect(s.ChangeGlobalStatus(&other, "succeed", []string{"status"}, true)).ToNot(HaveOccurred())
+
+	err = s.ChangeGlobalStatus(global, "aborting", []string{"status"}, false)
+	g.Expect(err).To(Equal(&storage.StatusConflictError{Gid: "gid1", Expected: "submitted", Actual: "succeed"}))
+	g.Expect(global.Status).To(Equal("submitted"))
+
+	err = s.ChangeGlobalStatus(&storage.TransGlobalStore{Gid: "gid2", Status: "submitted"}, "aborting", []string{"status"}, false)
+	g.Expect(err).To(Equal(storage.ErrNotFound))
+}
+
+func TestDuplicateTrans(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	branches := []storage.TransBranchStore{{Gid: "gid1", BranchID: "01", Op: "action", BinData: []byte(`{"amount":30}`)}}
+	newGlobal := func() *storage.TransGlobalStore {
+		return &storage.TransGlobalStore{Gid: "gid1", TransType: "saga", Status: "submitted", NextCronTime: &time.Time{},
+			PayloadsHash: storage.PayloadsHash(branches), BranchCount: 1}
+	}
+	g.Expect(s.MaySaveNewTrans(newGlobal(), branches)).ToNot(HaveOccurred())
+	err = s.MaySaveNewTrans(newGlobal(), branches)
+	g.Expect(errors.Is(err, storage.ErrUniqueConflict)).To(BeTrue())
+	g.Expect(err).To(Equal(&storage.DuplicateTransError{Gid: "gid1", Mismatches: []string{}}))
+
+	global := newGlobal()
+	global.BranchCount = 2
+	g.Expect(s.MaySaveNewTrans(global, branches)).To(Equal(&storage.DuplicateTransError{Gid: "gid1", Mismatches: []string{"branch_count"}}))
+	global = newGlobal()
+	global.PayloadsHash = storage.PayloadsHash([]storage.TransBranchStore{{BranchID: "01", Op: "action", BinData: []byte(`{"amount":40}`)}})
+	g.Expect(s.MaySaveNewTrans(global, branches)).To(Equal(&storage.DuplicateTransError{Gid: "gid1", Mismatches: []string{"payloads"}}))
+}
+
+func TestMaySaveNewTransBatch(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	newTrans := func(gid string, branchCount int) storage.NewTrans {
+		return storage.NewTrans{Global: &storage.TransGlobalStore{Gid: gid, TransType: "msg", Status: "submitted", NextCronTime: &time.Time{},
+			BranchCount: branchCount, PayloadsHash: "h1"}, Branches: newBranches(gid, 1)}
+	}
+	g.Expect(s.MaySaveNewTrans(newTrans("gid1", 2).Global, nil)).ToNot(HaveOccurred())
+	errs := s.MaySaveNewTransBatch([]storage.NewTrans{newTrans("gid1", 2), newTrans("gid2", 2), newTrans("gid1", 3), newTrans("gid2", 2)})
+	g.Expect(errs).To(Equal([]error{
+		&storage.DuplicateTransError{Gid: "gid1", Mismatches: []string{}},
+		nil,
+		&storage.DuplicateTransError{Gid: "gid1", Mismatches: []string{"branch_count"}},
+		&storage.DuplicateTransError{Gid: "gid2", Mismatches: []string{}}, // a gid repeated in the batch
+	}))
+	g.Expect(s.FindTransGlobalStore("gid2").Status).To(Equal("submitted"))
+	g.Expect(s.FindBranches("gid2")).To(HaveLen(2))
+	g.Expect(s.FindBranches("gid1")).To(BeEmpty())
+}
+
+func TestStats(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	from := time.Unix(1600000000, 0)
+	create, finish := from.Add(time.Minute), from.Add(time.Minute+3*time.Second)
+	global := &storage.TransGlobalStore{Gid: "gid1", TransType: "msg", Status: "succeed", NextCronTime: &time.Time{}, FinishTime: &finish}
+	global.CreateTime = &create
+	g.Expect(s.MaySaveNewTrans(global, nil)).ToNot(HaveOccurred())
+	g.Expect(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid2", NextCronTime: &time.Time{}}, nil)).ToNot(HaveOccurred())
+
+	stats := s.Stats(storage.StatsCondition{From: from, To: from.Add(time.Hour), Bucket: time.Hour})
+	g.Expect(stats.Counts).To(HaveLen(1))
+	g.Expect(stats.Counts[0].Bucket.Equal(from)).To(BeTrue())
+	g.Expect(stats.Counts[0].Count).To(Equal(int64(1)))
+	g.Expect(stats.Durations).To(Equal([]storage.TransDurationStats{{TransType: "msg", Count: 1, Avg: 3, P50: 3, P95: 3}}))
+	g.Expect(stats.Approximate).To(BeFalse())
+}
+
+func newBranches(gid string, n int) []storage.TransBranchStore {
+	branches := []storage.TransBranchStore{}
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("%02d", i)
+		branches = append(branches,
+			storage.TransBranchStore{Gid: gid, BranchID: id, Op: "compensate", Status: "prepared", BinData: []byte(`{"amount":30}`)},
+			storage.TransBranchStore{Gid: gid, BranchID: id, Op: "action", Status: "prepared", BinData: []byte(`{"amount":30}`)})
+	}
+	return branches
+}
+
+func TestFindBranchesPage(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	global := &storage.TransGlobalStore{Gid: "gid1", Status: "submitted", NextCronTime: &time.Time{}}
+	g.Expect(s.MaySaveNewTrans(global, newBranches("gid1", 3))).ToNot(HaveOccurred())
+	g.Expect(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid2", NextCronTime: &time.Time{}}, newBranches("gid2", 1))).ToNot(HaveOccurred())
+
+	page := s.FindBranchesPage("gid1", "", 3) // the branches of 02 are not split
+	g.Expect(len(page)).To(Equal(4))
+	g.Expect(page[3].BranchID).To(Equal("02"))
+	page = s.FindBranchesPage("gid1", "02", 3)
+	g.Expect(len(page)).To(Equal(2))
+	g.Expect(page[0].BranchID).To(Equal("03"))
+	g.Expect(s.FindBranchesPage("gid1", "03", 3)).To(BeEmpty())
+	g.Expect(s.FindBranchesPage("gid1", "", 10)).To(Equal(s.FindBranches("gid1")))
+}
+
+func TestFindBranch(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	branches := newBranches("gid1", 2)
+	g.Expect(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid1", Status: "submitted", NextCronTime: &time.Time{}}, branches)).ToNot(HaveOccurred())
+	branches[3].Status = "succeed"
+	s.LockGlobalSaveBranches("gid1", "submitted", branches[3:], 3)
+
+	g.Expect(s.FindBranch("gid1", "02", "action").Status).To(Equal("succeed"))
+	g.Expect(s.FindBranch("gid1", "02", "compensate").Status).To(Equal("prepared"))
+	g.Expect(s.FindBranch("gid1", "03", "action")).To(BeNil())
+	g.Expect(s.FindBranch("gid2", "01", "action")).To(BeNil())
+}
+
+// BenchmarkFindBranchesPage shows the allocations of reading the first page instead of all the branches of a large trans
+func BenchmarkFindBranchesPage(b *testing.B) {
+	db, err := bolt.Open(path.Join(b.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	dtmimp.E2P(err)
+	defer db.Close()
+	dtmimp.E2P(initializeBuckets(db))
+	s := &Store{boltDb: db}
+	dtmimp.E2P(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid1", NextCronTime: &time.Time{}}, newBranches("gid1", 2500)))
+
+	b.Run("all", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.FindBranches("gid1")
+		}
+	})
+	b.Run("page", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.FindBranchesPage("gid1", "", 200)
+		}
+	})
+}
+
+func TestBatchCommits(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+	s.SetBatchDelay(5 * time.Millisecond)
+
+	errs := make([]error, 20)
+	wg := sync.WaitGroup{}
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			gid := fmt.Sprintf("gid%d", i%10) // every gid is saved twice
+			errs[i] = s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &time.Time{}}, newBranches(gid, 2))
+		}(i)
+	}
+	wg.Wait()
+	duplicated := 0
+	for _, err := range errs {
+		if err != nil {
+			g.Expect(errors.Is(err, storage.ErrUniqueConflict)).To(BeTrue())
+			duplicated++
+		}
+	}
+	g.Expect(duplicated).To(Equal(10))
+	for i := 0; i < 10; i++ {
+		g.Expect(s.FindBranches(fmt.Sprintf("gid%d", i))).To(HaveLen(4))
+	}
+
+	global := s.FindTransGlobalStore("gid0")
+	g.Expect(s.ChangeGlobalStatus(global, "succeed", []string{"status"}, true)).ToNot(HaveOccurred())
+	global.Status = "submitted"
+	g.Expect(s.ChangeGlobalStatus(global, "failed", []string{"status"}, true)).To(HaveOccurred())
+	g.Expect(s.FindTransGlobalStore("gid0").Status).To(Equal("succeed"))
+}
+
+// TestBatchRerun runs the writes in one batch with a failing call, so the batch is rolled back and the writes are rerun
+func TestBatchRerun(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+	for _, gid := range []string{"changed", "touched", "conflicted", "registered"} {
+		g.Expect(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: gid, Status: "prepared", NextCronTime: &time.Time{}}, nil)).ToNot(HaveOccurred())
+	}
+	s.SetBatchDelay(100 * time.Millisecond)
+
+	changed := s.FindTransGlobalStore("changed")
+	touched := s.FindTransGlobalStore("touched")
+	conflicted := s.FindTransGlobalStore("conflicted")
+	conflicted.Version = 5 // the version is changed, so the call fails
+	event := &storage.EventRecord{Gid: "changed", NewStatus: "submitted", EventTime: &time.Time{}}
+	attempt := &storage.BranchAttempt{Gid: "changed", BranchID: "01", Op: "action", Result: storage.AttemptSucceed}
+	var saved []bool
+	var changeErr, conflictErr, eventErr, attemptErr, failErr error
+	var runs int64
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for _, call := range []func(){
+		func() { changeErr = s.ChangeGlobalStatus(changed, "submitted", []string{"status"}, false) },
+		func() { s.TouchCronTime(touched, 20, &time.Time{}) },
+		func() { conflictErr = s.ChangeGlobalStatus(conflicted, "submitted", []string{"status"}, false) },
+		func() { eventErr = s.SaveEvent(event) },
+		func() { attemptErr = s.SaveAttempt(attempt) },
+		func() {
+			saved = s.LockGlobalSaveBranches("registered", "prepared", newBranches("registered", 2), -1)
+		},
+		func() {
+			failErr = s.update(func(t *bolt.Tx) error {
+				atomic.AddInt64(&runs, 1)
+				return errors.New("deliberately failed")
+			})
+		},
+	} {
+		wg.Add(1)
+		go func(call func()) {
+			defer wg.Done()
+			<-start
+			call()
+		}(call)
+	}
+	close(start)
+	wg.Wait()
+
+	g.Expect(failErr).To(MatchError("deliberately failed"))
+	g.Expect(atomic.LoadInt64(&runs)).To(Equal(int64(2))) // the run in the batch, and the run alone
+	g.Expect(changeErr).ToNot(HaveOccurred())
+	g.Expect(changed.Status).To(Equal("submitted"))
+	g.Expect(changed.Version).To(Equal(int64(1)))
+	g.Expect(s.FindTransGlobalStore("changed").Version).To(Equal(changed.Version))
+	g.Expect(touched.Version).To(Equal(int64(1)))
+	g.Expect(s.FindTransGlobalStore("touched").Version).To(Equal(touched.Version))
+	g.Expect(s.FindTransGlobalStore("touched").NextCronInterval).To(Equal(int64(20)))
+
+	var conflict *storage.VersionConflictError
+	g.Expect(errors.As(conflictErr, &conflict)).To(BeTrue())
+	g.Expect(conflicted.Status).To(Equal("prepared"))
+	g.Expect(conflicted.Version).To(Equal(int64(5)))
+	g.Expect(s.FindTransGlobalStore("conflicted").Version).To(Equal(int64(0)))
+
+	g.Expect(eventErr).ToNot(HaveOccurred())
+	g.Expect(s.FindEvents(0, 10)).To(HaveLen(1))
+	g.Expect(event.Seq).To(Equal(s.FindEvents(0, 10)[0].Seq))
+	g.Expect(attemptErr).ToNot(HaveOccurred())
+	g.Expect(s.FindAttempts("changed")).To(HaveLen(1))
+	g.Expect(attempt.ID).To(Equal(s.FindAttempts("changed")[0].ID))
+	g.Expect(attempt.Attempt).To(Equal(1))
+	g.Expect(saved).To(Equal([]bool{true, true, true, true}))
+	g.Expect(s.FindBranches("registered")).To(HaveLen(4))
+}
+
+// BenchmarkMaySaveNewTrans shows the throughput of the concurrent submits, with and without the batched commits
+func BenchmarkMaySaveNewTrans(b *testing.B) {
+	for _, delay := range []time.Duration{0, 2 * time.Millisecond} {
+		b.Run(fmt.Sprintf("delay-%v", delay), func(b *testing.B) {
+			db, err := bolt.Open(path.Join(b.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+			dtmimp.E2P(err)
+			defer db.Close()
+			dtmimp.E2P(initializeBuckets(db))
+			s := &Store{boltDb: db}
+			s.SetBatchDelay(delay)
+			var seq int64
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					gid := fmt.Sprintf("gid%d", atomic.AddInt64(&seq, 1))
+					dtmimp.E2P(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: gid, NextCronTime: &time.Time{}}, newBranches(gid, 2)))
+				}
+			})
+		})
+	}
+}
+
+func TestUpdateGlobalCustomData(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	global := &storage.TransGlobalStore{Gid: "gid1", Status: "submitted", NextCronTime: &time.Time{}, CustomData: `{"ref":"R1"}`}
+	g.Expect(s.MaySaveNewTrans(global, nil)).ToNot(HaveOccurred())
+	g.Expect(s.UpdateGlobalCustomData(s.FindTransGlobalStore("gid1"), `{"ref":"R2"}`)).ToNot(HaveOccurred())
+	s.TouchCronTime(global, 10, &time.Time{}) // the processing trans does not overwrite the updated custom data
+	err = s.ChangeGlobalStatus(global, "succeed", []string{"status"}, true)
+	g.Expect(err).To(Equal(&storage.VersionConflictError{Gid: "gid1", Expected: 0, Actual: 1}))
+	global = s.FindTransGlobalStore("gid1") // re-read
+	s.TouchCronTime(global, 10, &time.Time{})
+	g.Expect(s.ChangeGlobalStatus(global, "succeed", []string{"status"}, true)).ToNot(HaveOccurred())
+	g.Expect(global.Version).To(Equal(int64(3)))
+	g.Expect(s.FindTransGlobalStore("gid1").CustomData).To(Equal(`{"ref":"R2"}`))
+
+	err = s.UpdateGlobalCustomData(global, `{"ref":"R3"}`)
+	g.Expect(err).To(Equal(&storage.StatusConflictError{Gid: "gid1", Expected: storage.StatusUnfinished, Actual: "succeed"}))
+	g.Expect(s.UpdateGlobalCustomData(&storage.TransGlobalStore{Gid: "gid2"}, "")).To(Equal(storage.ErrNotFound))
+}
+
+func TestCronTimeLag(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+	g.Expect(s.FindOldestCronTime()).To(BeNil())
+
+	now := time.Unix(time.Now().Unix(), 0)
+	for i, late := range []time.Duration{time.Minute, 10 * time.Second, -time.Minute} {
+		next := now.Add(-late)
+		gid := fmt.Sprintf("gid%d", i)
+		g.Expect(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &next}, nil)).ToNot(HaveOccurred())
+	}
+	g.Expect(*s.FindOldestCronTime()).To(Equal(now.Add(-time.Minute)))
+	g.Expect(s.CountCronTimeBefore(now)).To(Equal(int64(2)))
+	g.Expect(s.CountCronTimeBefore(now.Add(-10 * time.Second))).To(Equal(int64(1)))
+	g.Expect(s.CountCronTimeBefore(now.Add(-time.Minute))).To(Equal(int64(0)))
+	g.Expect(s.CountCronTimeAfter(now)).To(Equal(int64(1)))
+	g.Expect(s.CountCronTimeAfter(now.Add(-10 * time.Second))).To(Equal(int64(2)))
+	g.Expect(s.CountCronTimeAfter(now.Add(time.Minute + time.Second))).To(Equal(int64(0)))
+}
+
+func TestAttempts(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	for _, a := range []storage.BranchAttempt{
+		{Gid: "gid1", BranchID: "01", Op: "action", Result: storage.AttemptOngoing},
+		{Gid: "gid1", BranchID: "01", Op: "action", Result: storage.AttemptSucceed},
+		{Gid: "gid1", BranchID: "01", Op: "compensate", Result: storage.AttemptSucceed},
+		{Gid: "gid10", BranchID: "01", Op: "action", Result: storage.AttemptError},
+	} {
+		a := a
+		g.Expect(s.SaveAttempt(&a)).ToNot(HaveOccurred())
+	}
+	attempts := s.FindAttempts("gid1")
+	g.Expect(len(attempts)).To(Equal(3))
+	g.Expect(attempts[1].Attempt).To(Equal(2))
+	g.Expect(attempts[1].Result).To(Equal(storage.AttemptSucceed))
+	g.Expect(attempts[2].Attempt).To(Equal(1))
+	g.Expect(len(s.FindAttempts("gid10"))).To(Equal(1))
+
+	purged, err := s.PurgeAttempts(time.Now().Add(-time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(purged).To(Equal(int64(0)))
+	purged, err = s.PurgeAttempts(time.Now().Add(time.Second))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(purged).To(Equal(int64(4)))
+	g.Expect(s.FindAttempts("gid1")).To(BeEmpty())
+}
+
+func TestEvents(t *testing.T) {
+	g := NewWithT(t)
+	file := path.Join(t.TempDir(), "./test.bolt")
+	db, err := bolt.Open(file, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	old := time.Now().Add(-time.Hour)
+	for _, gid := range []string{"gid1", "gid2", "gid3"} {
+		g.Expect(s.SaveEvent(&storage.EventRecord{Gid: gid, NewStatus: "submitted", EventTime: &old})).ToNot(HaveOccurred())
+	}
+	events := s.FindEvents(1, 10)
+	g.Expect(len(events)).To(Equal(2))
+	g.Expect(events[0].Seq).To(Equal(int64(2)))
+	g.Expect(events[1].Gid).To(Equal("gid3"))
+	g.Expect(len(s.FindEvents(0, 2))).To(Equal(2))
+
+	purged, err := s.PurgeEvents(time.Now(), 2) // the events after the offset 2 are kept
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(purged).To(Equal(int64(2)))
+	g.Expect(s.FindEvents(0, 10)[0].Seq).To(Equal(int64(3)))
+
+	// the seq survives restarts
+	g.Expect(db.Close()).ToNot(HaveOccurred())
+	db, err = bolt.Open(file, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	s = &Store{boltDb: db}
+	e := &storage.EventRecord{Gid: "gid4", NewStatus: "submitted", EventTime: &old}
+	g.Expect(s.SaveEvent(e)).ToNot(HaveOccurred())
+	g.Expect(e.Seq).To(Equal(int64(4)))
+}
+
+func TestLockOneGlobalTransPriority(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db, retryInterval: 60}
+	s.SetPriorityAging(time.Minute)
+
+	save := func(gid string, priority int, next time.Time) {
+		global := &storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &next}
+		global.Priority = priority
+		g.Expect(s.MaySaveNewTrans(global, newBranches(gid, 1))).ToNot(HaveOccurred())
+	}
+	save("low", -1, time.Now().Add(-time.Second))
+	save("high", 5, time.Now())
+	save("aged", -1, time.Now().Add(-2*time.Minute))
+	save("later", 9, time.Now().Add(time.Hour))
+	g.Expect(s.CountOverdueByPriority(time.Now().Add(time.Second))).To(Equal(map[int]int64{-1: 2, 5: 1}))
+
+	for _, gid := range []string{"aged", "high", "low"} {
+		g.Expect(s.LockOneGlobalTrans(5 * time.Second).Gid).To(Equal(gid))
+	}
+	g.Expect(s.LockOneGlobalTrans(5 * time.Second)).To(BeNil())
+}
+
+func TestTouchCronTimes(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db, retryInterval: 60}
+
+	now := time.Now()
+	updates := []storage.CronTimeUpdate{}
+	for _, gid := range []string{"g1", "g2", "g3"} {
+		global := &storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &now}
+		g.Expect(s.MaySaveNewTrans(global, newBranches(gid, 1))).ToNot(HaveOccurred())
+		snapshot := *global
+		next := now.Add(time.Hour)
+		updates = append(updates, storage.CronTimeUpdate{Global: &snapshot, NextCronInterval: 20, NextCronTime: &next})
+	}
+	updates[1].Global.Status = "prepared" // the status is changed, skipped
+	updates = append(updates, storage.CronTimeUpdate{Global: &storage.TransGlobalStore{Gid: "missing", Status: "submitted"}, NextCronTime: &now})
+	s.TouchCronTimes(updates)
+
+	g.Expect(s.FindTransGlobalStore("g1").NextCronInterval).To(Equal(int64(20)))
+	g.Expect(s.FindTransGlobalStore("g3").NextCronTime.Unix()).To(Equal(now.Add(time.Hour).Unix()))
+	g.Expect(s.FindTransGlobalStore("g2").NextCronInterval).To(Equal(int64(0)))
+	g.Expect(updates[0].Global.Version).To(Equal(s.FindTransGlobalStore("g1").Version))
+	g.Expect(updates[0].Global.Version).To(Equal(int64(1)))
+	g.Expect(updates[1].Global.Version).To(Equal(int64(0)))
+	g.Expect(s.FindTransGlobalStore("missing")).To(BeNil())
+	g.Expect(s.LockOneGlobalTrans(5 * time.Second).Gid).To(Equal("g2"))
+	g.Expect(s.LockOneGlobalTrans(5 * time.Second)).To(BeNil())
+}
+
+func TestLockGlobalSaveBranchesIdempotent(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	s := &Store{boltDb: db}
+
+	g.Expect(s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid1", Status: "prepared", NextCronTime: &time.Time{}}, nil)).ToNot(HaveOccurred())
+	created := time.Now().Add(-time.Minute).Round(time.Second)
+	register := func() []storage.TransBranchStore {
+		return []storage.TransBranchStore{
+			{ModelBase: dtmutil.ModelBase{CreateTime: &created}, Gid: "gid1", BranchID: "01", Op: "cancel", Status: "prepared"},
+			{ModelBase: dtmutil.ModelBase{CreateTime: &created}, Gid: "gid1", BranchID: "01", Op: "confirm", Status: "prepared"},
+		}
+	}
+	g.Expect(s.LockGlobalSaveBranches("gid1", "prepared", register(), -1)).To(Equal([]bool{true, true}))
+
+	confirm := register()[1]
+	confirm.Status = "succeed"
+	confirm.CreateTime = nil
+	g.Expect(s.LockGlobalSaveBranches("gid1", "prepared", []storage.TransBranchStore{confirm}, 1)).To(Equal([]bool{true}))
+
+	// the registration retried after a timeout arrives late
+	g.Expect(s.LockGlobalSaveBranches("gid1", "prepared", register(), -1)).To(Equal([]bool{false, false}))
+	confirm.Status = "prepared"
+	g.Expect(s.LockGlobalSaveBranches("gid1", "prepared", []storage.TransBranchStore{confirm}, 1)).To(Equal([]bool{false}))
+
+	branches := s.FindBranches("gid1")
+	g.Expect(len(branches)).To(Equal(2))
+	g.Expect(branches[1].Status).To(Equal("succeed"))
+	g.Expect(branches[1].CreateTime.Equal(created)).To(BeTrue())
+}
+
+func TestSnapshot(t *testing.T) {
+	g := NewWithT(t)
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+	from, to := memory.NewStore(0, 10), &Store{boltDb: db} // exported from memory, imported to boltdb
+
+	next := time.Unix(1600000000, 0)
+	branches := newBranches("gid1", 2)
+	branches[1].Status = "succeed"
+	g.Expect(from.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid1", TransType: "saga", Status: "submitted", NextCronTime: &next,
+		BranchCount: 2, Owner: "owner1"}, branches)).ToNot(HaveOccurred())
+	g.Expect(from.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid2", TransType: "msg", Status: "prepared", NextCronTime: &next}, nil)).ToNot(HaveOccurred())
+	g.Expect(from.MaySaveNewTrans(&storage.TransGlobalStore{Gid: "gid3", TransType: "msg", Status: "succeed", NextCronTime: &next}, nil)).ToNot(HaveOccurred())
+
+	buf := bytes.Buffer{}
+	count, err := storage.ExportSnapshot(from, &buf)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(count).To(Equal(2))
+	snapshot := buf.String()
+
+	summary, err := storage.ImportSnapshot(to, strings.NewReader(snapshot))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(summary.Imported).To(Equal(2))
+	g.Expect(summary.Failed).To(BeEmpty())
+	global := to.FindTransGlobalStore("gid1")
+	g.Expect(global.Status).To(Equal("submitted"))
+	g.Expect(global.Owner).To(BeEmpty())
+	g.Expect(global.NextCronTime.Unix()).To(Equal(next.Unix()))
+	imported := to.FindBranches("gid1")
+	g.Expect(imported).To(HaveLen(4))
+	g.Expect(imported[1].Status).To(Equal("succeed"))
+	g.Expect(imported[1].BinData).To(Equal(branches[1].BinData))
+	g.Expect(to.FindTransGlobalStore("gid2").Status).To(Equal("prepared"))
+	g.Expect(to.FindTransGlobalStore("gid3")).To(BeNil())
+
+	summary, err = storage.ImportSnapshot(to, strings.NewReader(snapshot+
+		`{"schema_version":2,"global":{"gid":"gid4"}}`+"\n"+
+		`{"schema_version":1,"global":{"gid":"gid5","trans_type":"msg","status":"succeed"}}`+"\n"+
+		"not json\n"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(summary.Imported).To(Equal(0))
+	g.Expect(summary.Skipped).To(HaveLen(2))
+	g.Expect(summary.Failed).To(HaveLen(3))
+	g.Expect(summary.Failed[0].Line).To(Equal(3))
+	g.Expect(summary.Failed[1].Gid).To(Equal("gid5"))
+	g.Expect(to.FindTransGlobalStore("gid5")).To(BeNil())
+}
+
+func TestJSONTimesAcrossStores(t *testing.T) {
+	g := NewWithT(t)
+	local := time.Local
+	time.Local = time.FixedZone("UTC+8", 8*3600) // a dtm server not in UTC
+	defer func() { time.Local = local }()
+	db, err := bolt.Open(path.Join(t.TempDir(), "./test.bolt"), 0666, &bolt.Options{Timeout: 1 * time.Second})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(initializeBuckets(db)).ToNot(HaveOccurred())
+
+	rendered := []string{}
+	for _, s := range []storage.Store{memory.NewStore(0, 10), &Store{boltDb: db}} {
+		create, next := time.Unix(1600000000, 0), time.Unix(1600000010, 0)
+		global := &storage.TransGlobalStore{Gid: "gid1", TransType: "msg", Status: "submitted", NextCronTime: &next}
+		global.CreateTime, global.UpdateTime = &create, &create
+		branches := newBranches("gid1", 1)
+		branches[1].CreateTime, branches[1].FinishTime = &create, &next
+		g.Expect(s.MaySaveNewTrans(global, branches)).ToNot(HaveOccurred())
+		rendered = append(rendered, dtmimp.MustMarshalString(map[string]interface{}{
+			"transaction": s.FindTransGlobalStore("gid1"), "branches": s.FindBranches("gid1")}))
+	}
+	g.Expect(rendered[0]).To(ContainSubstring(`"create_time":"2020-09-13T12:26:40Z"`))
+	g.Expect(rendered[0]).To(ContainSubstring(`"next_cron_time":"2020-09-13T12:26:50Z"`))
+	g.Expect(rendered[0]).To(ContainSubstring(`"finish_time":"2020-09-13T12:26:50Z"`))
+	g.Expect(rendered[1]).To(Equal(rendered[0]))
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// the next_cron_time of the trans are compared against the clock of the store, such as now() of the db in
+// LockOneGlobalTrans, so the times of scheduling computed by dtm server are in the clock of the store too. the clock of
+// the store is estimated by the local clock and the skew probed, see Store.Now
+
+var clockSkew int64 // in nanoseconds
+
+// localNow is the local clock, replaced by the tests faking a skew
+var localNow = time.Now
+
+// SetClockSkew sets the skew of the clock of the store, which is the now of the store minus the local now
+func SetClockSkew(skew time.Duration) {
+	atomic.StoreInt64(&clockSkew, int64(skew))
+}
+
+// ClockSkew returns the skew set by SetClockSkew
+func ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&clockSkew))
+}
+
+// Now returns the now in the clock of the store
+func Now() time.Time {
+	return localNow().Add(ClockSkew())
+}
+
+// NextTime returns the time after seconds in the clock of the store, like dtmutil.GetNextTime in the local clock
+func NextTime(second int64) *time.Time {
+	next := Now().Add(time.Duration(second) * time.Second)
+	return &next
+}
+
+// MeasureSkew measures the skew of the clock of the store by storeNow, which is compared with the local now at the
+// middle of the call, so half of the round trip is not taken as the skew
+func MeasureSkew(storeNow func() (time.Time, error)) (time.Duration, error) {
+	before := localNow()
+	now, err := storeNow()
+	if err != nil {
+		return 0, err
+	}
+	after := localNow()
+	return now.Sub(before.Add(after.Sub(before) / 2)), nil
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockSkew(t *testing.T) {
+	local := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	localNow = func() time.Time {
+		local = local.Add(10 * time.Millisecond) // every read of the local clock takes 10ms
+		return local
+	}
+	defer func() { localNow = time.Now }()
+	defer SetClockSkew(0)
+
+	skew, err := MeasureSkew(func() (time.Time, error) {
+		return local.Add(35*time.Second + 5*time.Millisecond), nil // the store is 35s ahead, read in the middle of the call
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 35*time.Second, skew)
+	_, err = MeasureSkew(func() (time.Time, error) { return time.Time{}, errors.New("down") })
+	assert.Error(t, err)
+
+	SetClockSkew(-30 * time.Second)
+	assert.Equal(t, -30*time.Second, ClockSkew())
+	assert.Equal(t, local.Add(10*time.Millisecond-30*time.Second), Now())
+	assert.Equal(t, local.Add(10*time.Millisecond-20*time.Second), *NextTime(10))
+}
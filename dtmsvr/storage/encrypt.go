@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+)
+
+// KeyProvider provides the keys to encrypt the payloads and custom data at rest
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt and its id. nil key means the encryption is disabled
+	CurrentKey() (id string, key []byte)
+	// Key returns the key of the id to decrypt. nil if not found
+	Key(id string) []byte
+}
+
+// configKeyProvider provides the keys of Store.EncryptionKeys
+type configKeyProvider struct {
+	keys []config.EncryptionKey
+}
+
+func (p *configKeyProvider) CurrentKey() (string, []byte) {
+	if len(p.keys) == 0 {
+		return "", nil
+	}
+	return p.keys[0].ID, p.keys[0].Key
+}
+
+func (p *configKeyProvider) Key(id string) []byte {
+	for _, k := range p.keys {
+		if k.ID == id {
+			return k.Key
+		}
+	}
+	return nil
+}
+
+var keyProvider KeyProvider
+
+var configKeyProviders sync.Map
+
+// SetKeyProvider sets the provider of the keys, such as a KMS client, instead of Store.EncryptionKeys
+func SetKeyProvider(p KeyProvider) {
+	keyProvider = p
+}
+
+func getKeyProvider() KeyProvider {
+	if keyProvider != nil {
+		return keyProvider
+	}
+	s := config.Config.Store.EncryptionKeys
+	if p, ok := configKeyProviders.Load(s); ok {
+		return p.(KeyProvider)
+	}
+	keys, err := config.Config.Store.GetEncryptionKeys()
+	dtmimp.E2P(err)
+	p, _ := configKeyProviders.LoadOrStore(s, &configKeyProvider{keys: keys})
+	return p.(KeyProvider)
+}
+
+// EncryptionEnabled returns whether the payloads and custom data are encrypted at rest
+func EncryptionEnabled() bool {
+	_, key := getKeyProvider().CurrentKey()
+	return key != nil
+}
+
+// an encrypted value is like dtme:<key id>:<base64 of nonce and sealed data>. the value without the prefix is plain,
+// such as the data saved before the encryption is enabled
+var encryptedPrefix = []byte("dtme:")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptData encrypts the data with the current key. the gid is authenticated, so the data can not be moved to other trans
+func encryptData(data []byte, gid string) []byte {
+	id, key := getKeyProvider().CurrentKey()
+	if key == nil || len(data) == 0 {
+		return data
+	}
+	gcm, err := newGCM(key)
+	dtmimp.E2P(err)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	dtmimp.E2P(err)
+	sealed := gcm.Seal(nonce, nonce, data, []byte(gid))
+	return []byte(string(encryptedPrefix) + id + ":" + base64.StdEncoding.EncodeToString(sealed))
+}
+
+// decryptData decrypts the data with the key of its key id
+func decryptData(data []byte, gid string) []byte {
+	if !bytes.HasPrefix(data, encryptedPrefix) {
+		return data
+	}
+	parts := bytes.SplitN(data[len(encryptedPrefix):], []byte(":"), 2)
+	dtmimp.PanicIf(len(parts) != 2, fmt.Errorf("bad encrypted data of trans %s", gid))
+	key := getKeyProvider().Key(string(parts[0]))
+	dtmimp.PanicIf(key == nil, fmt.Errorf("encryption key %s of trans %s not found", parts[0], gid))
+	sealed, err := base64.StdEncoding.DecodeString(string(parts[1]))
+	dtmimp.E2P(err)
+	gcm, err := newGCM(key)
+	dtmimp.E2P(err)
+	dtmimp.PanicIf(len(sealed) < gcm.NonceSize(), fmt.Errorf("bad encrypted data of trans %s", gid))
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(gid))
+	dtmimp.E2P(err)
+	return plain
+}
+
+// NewEncryptedStore returns a store which encrypts the payloads of branches and the custom data of trans before they
+// are written to s, and decrypts them after read from s
+func NewEncryptedStore(s Store) Store {
+	return &encryptedStore{Store: s}
+}
+
+type encryptedStore struct {
+	Store
+}
+
+// encryptGlobal encrypts the custom data in place, and returns a func to restore it
+func encryptGlobal(global *TransGlobalStore) func() {
+	plain := global.CustomData
+	global.CustomData = string(encryptData([]byte(plain), global.Gid))
+	return func() { global.CustomData = plain }
+}
+
+func decryptGlobal(global *TransGlobalStore) {
+	if global != nil {
+		global.CustomData = string(decryptData([]byte(global.CustomData), global.Gid))
+	}
+}
+
+// encryptBranches encrypts the payloads in place, and returns a func to restore them
+func encryptBranches(branches []TransBranchStore) func() {
+	plains := make([][]byte, len(branches))
+	for i := range branches {
+		plains[i] = branches[i].BinData
+		branches[i].BinData = encryptData(plains[i], branches[i].Gid)
+	}
+	return func() {
+		for i := range branches {
+			branches[i].BinData = plains[i]
+		}
+	}
+}
+
+func (s *encryptedStore) FindTransGlobalStore(gid string) *TransGlobalStore {
+	global := s.Store.FindTransGlobalStore(gid)
+	decryptGlobal(global)
+	return global
+}
+
+func (s *encryptedStore) ScanTransGlobalStores(position *string, limit int64, condition TransGlobalScanCondition) []TransGlobalStore {
+	globals := s.Store.ScanTransGlobalStores(position, limit, condition)
+	for i := range globals {
+		decryptGlobal(&globals[i])
+	}
+	return globals
+}
+
+func (s *encryptedStore) FindBranches(gid string) []TransBranchStore {
+	branches := s.Store.FindBranches(gid)
+	for i := range branches {
+		branches[i].BinData = decryptData(branches[i].BinData, branches[i].Gid)
+	}
+	return branches
+}
+
+func (s *encryptedStore) FindBranchesPage(gid string, afterBranchID string, limit int) []TransBranchStore {
+	branches := s.Store.FindBranchesPage(gid, afterBranchID, limit)
+	for i := range branches {
+		branches[i].BinData = decryptData(branches[i].BinData, branches[i].Gid)
+	}
+	return branches
+}
+
+func (s *encryptedStore) FindBranch(gid string, branchID string, op string) *TransBranchStore {
+	branch := s.Store.FindBranch(gid, branchID, op)
+	if branch != nil {
+		branch.BinData = decryptData(branch.BinData, branch.Gid)
+	}
+	return branch
+}
+
+func (s *encryptedStore) UpdateBranches(branches []TransBranchStore, updates []string) (int, error) {
+	defer encryptBranches(branches)()
+	return s.Store.UpdateBranches(branches, updates)
+}
+
+func (s *encryptedStore) LockGlobalSaveBranches(gid string, status string, branches []TransBranchStore, branchStart int) []bool {
+	defer encryptBranches(branches)()
+	return s.Store.LockGlobalSaveBranches(gid, status, branches, branchStart)
+}
+
+func (s *encryptedStore) MaySaveNewTrans(global *TransGlobalStore, branches []TransBranchStore) error {
+	defer encryptGlobal(global)()
+	defer encryptBranches(branches)()
+	return s.Store.MaySaveNewTrans(global, branches)
+}
+
+func (s *encryptedStore) MaySaveNewTransBatch(trans []NewTrans) []error {
+	for _, t := range trans {
+		defer encryptGlobal(t.Global)()
+		defer encryptBranches(t.Branches)()
+	}
+	return s.Store.MaySaveNewTransBatch(trans)
+}
+
+func (s *encryptedStore) ChangeGlobalStatus(global *TransGlobalStore, newStatus string, updates []string, finished bool) error {
+	defer encryptGlobal(global)()
+	return s.Store.ChangeGlobalStatus(global, newStatus, updates, finished)
+}
+
+func (s *encryptedStore) UpdateGlobalCustomData(global *TransGlobalStore, data string) error {
+	err := s.Store.UpdateGlobalCustomData(global, string(encryptData([]byte(data), global.Gid)))
+	if err == nil {
+		global.CustomData = data
+	}
+	return err
+}
+
+func (s *encryptedStore) TouchCronTime(global *TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
+	defer encryptGlobal(global)()
+	s.Store.TouchCronTime(global, nextCronInterval, nextCronTime)
+}
+
+func (s *encryptedStore) TouchCronTimes(updates []CronTimeUpdate) {
+	for _, u := range updates {
+		defer encryptGlobal(u.Global)()
+	}
+	s.Store.TouchCronTimes(updates)
+}
+
+func (s *encryptedStore) SaveAttempt(attempt *BranchAttempt) error {
+	plain := attempt.Response
+	defer func() { attempt.Response = plain }()
+	attempt.Response = string(encryptData([]byte(plain), attempt.Gid))
+	return s.Store.SaveAttempt(attempt)
+}
+
+func (s *encryptedStore) FindAttempts(gid string) []BranchAttempt {
+	attempts := s.Store.FindAttempts(gid)
+	for i := range attempts {
+		attempts[i].Response = string(decryptData([]byte(attempts[i].Response), gid))
+	}
+	return attempts
+}
+
+func (s *encryptedStore) LockOneGlobalTrans(expireIn time.Duration) *TransGlobalStore {
+	global := s.Store.LockOneGlobalTrans(expireIn)
+	decryptGlobal(global)
+	return global
+}
+
+// MaskBranches returns a copy of branches, with the payloads removed if the store is encrypted, and the values of
+// the sensitive headers of branches masked. for logs and query
+func MaskBranches(branches []TransBranchStore) []TransBranchStore {
+	hidePayload := config.Config.ShowDecryptedData != 1 && EncryptionEnabled()
+	if !hidePayload && config.Config.ShowSensitiveHeaders == 1 {
+		return branches
+	}
+	masked := make([]TransBranchStore, len(branches))
+	for i, b := range branches {
+		if hidePayload {
+			b.BinData = nil
+		}
+		if config.Config.ShowSensitiveHeaders != 1 && strings.Contains(b.ExtData, `"headers"`) {
+			ext := TransBranchExt{}
+			dtmimp.MustUnmarshalString(b.ExtData, &ext)
+			ext.Headers = maskHeaders(ext.Headers)
+			b.ExtData = dtmimp.MustMarshalString(ext)
+		}
+		masked[i] = b
+	}
+	return masked
+}
+
+// MaskAttempts returns a copy of attempts, with the responses removed if the store is encrypted. for query
+func MaskAttempts(attempts []BranchAttempt) []BranchAttempt {
+	if config.Config.ShowDecryptedData == 1 || !EncryptionEnabled() {
+		return attempts
+	}
+	masked := make([]BranchAttempt, len(attempts))
+	for i, a := range attempts {
+		a.Response = ""
+		masked[i] = a
+	}
+	return masked
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(c byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{c}, 32))
+}
+
+func TestEncryptData(t *testing.T) {
+	defer func() { config.Config.Store.EncryptionKeys = "" }()
+	assert.False(t, EncryptionEnabled())
+	assert.Equal(t, []byte("plain"), encryptData([]byte("plain"), "gid1"))
+
+	config.Config.Store.EncryptionKeys = "k1:" + testKey(1)
+	assert.True(t, EncryptionEnabled())
+	encrypted := encryptData([]byte(`{"amount":30}`), "gid1")
+	assert.Regexp(t, "^dtme:k1:", string(encrypted))
+	assert.Equal(t, []byte(`{"amount":30}`), decryptData(encrypted, "gid1"))
+	assert.Equal(t, []byte("saved before encryption"), decryptData([]byte("saved before encryption"), "gid1"))
+	assert.Error(t, dtmimp.CatchP(func() { decryptData(encrypted, "gid2") })) // moved to other trans
+
+	config.Config.Store.EncryptionKeys = "k2:" + testKey(2) + ",k1:" + testKey(1) // rotated
+	assert.Equal(t, []byte(`{"amount":30}`), decryptData(encrypted, "gid1"))
+	assert.Regexp(t, "^dtme:k2:", string(encryptData([]byte("new"), "gid1")))
+
+	config.Config.Store.EncryptionKeys = "k2:" + testKey(2)
+	assert.Error(t, dtmimp.CatchP(func() { decryptData(encrypted, "gid1") }))
+
+	g := TransGlobalStore{Gid: "gid1", CustomData: `{"orders":{}}`}
+	assert.Equal(t, "******", g.Masked().CustomData)
+	assert.Nil(t, MaskBranches([]TransBranchStore{{BinData: []byte("data")}})[0].BinData)
+}
+
+func TestMaskBranchHeaders(t *testing.T) {
+	config.Config.SensitiveHeaders = "x-api-key"
+	defer func() { config.Config.SensitiveHeaders = "" }()
+	b := TransBranchStore{ExtData: `{"headers":{"x-api-key":"secret","x-vendor":"a"}}`}
+	assert.Equal(t, `{"headers":{"x-api-key":"******","x-vendor":"a"}}`, MaskBranches([]TransBranchStore{b})[0].ExtData)
+	assert.NotContains(t, b.String(), "secret")
+
+	g := TransGlobalStore{Steps: []map[string]string{{"action": "a"}, {"action": "b", "headers": `{"x-api-key":"secret"}`}}}
+	assert.Equal(t, `{"x-api-key":"******"}`, g.Masked().Steps[1]["headers"])
+	assert.Equal(t, `{"x-api-key":"secret"}`, g.Steps[1]["headers"])
+}
+
+func TestGetEncryptionKeys(t *testing.T) {
+	s := config.Store{EncryptionKeys: "k2:" + testKey(2) + ", k1:" + testKey(1)}
+	keys, err := s.GetEncryptionKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, "k2", keys[0].ID)
+	assert.Equal(t, 2, len(keys))
+	for _, bad := range []string{"k1", ":" + testKey(1), "k1:not-base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		s.EncryptionKeys = bad
+		_, err = s.GetEncryptionKeys()
+		assert.Error(t, err, bad)
+	}
+}
+
+func BenchmarkEncryptData(b *testing.B) {
+	defer func() { config.Config.Store.EncryptionKeys = "" }()
+	config.Config.Store.EncryptionKeys = "k1:" + testKey(1)
+	for _, size := range []int{256, 4096, 65536} {
+		data := bytes.Repeat([]byte("a"), size)
+		b.Run(fmt.Sprintf("encrypt-%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				encryptData(data, "gid1")
+			}
+		})
+		encrypted := encryptData(data, "gid1")
+		b.Run(fmt.Sprintf("decrypt-%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				decryptData(encrypted, "gid1")
+			}
+		})
+	}
+}
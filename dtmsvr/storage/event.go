@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+)
+
+// EventRecord is a lifecycle event kept in the event log of the store, so that the consumers missing the published
+// events, such as during an outage of the sink, can catch up by the seq. the seq is assigned by SaveEvent, and survives
+// restarts. every store makes an event visible only after the events of smaller seqs, so a consumer reading after its
+// offset never skips an event:
+//   - sql: global among the dtm servers sharing the db. the seq is allocated by the row of TransEventCounterTable, locked
+//     until the commit, so the seqs are visible in the order of the commits
+//   - redis: global among the dtm servers sharing the redis. the seq is allocated and the event is saved by one lua script
+//   - boltdb and memory: local to the dtm server. the seq is allocated in the write transaction, which is serialized
+type EventRecord struct {
+	Seq       int64      `json:"seq" gorm:"column:id;primaryKey"`
+	Gid       string     `json:"gid"`
+	TransType string     `json:"trans_type"`
+	EventSeq  int64      `json:"event_seq"` // the seq of the event among the events of the gid
+	OldStatus string     `json:"old_status,omitempty"`
+	NewStatus string     `json:"new_status"`
+	EventTime *time.Time `json:"event_time"`
+}
+
+// TableName TableName
+func (e *EventRecord) TableName() string {
+	return config.Config.Store.TransEventTable
+}
+
+// EventOffsetCat is the cat of the kv of the offsets acknowledged by the consumers of the event log. the key is the
+// name of the consumer, and the value is the seq consumed
+const EventOffsetCat = "event_offset"
+
+// PurgeableEvents returns the events to delete by PurgeEvents from events in the order of seq, which are the leading
+// ones saved before the time and not after maxSeq, for the stores purging by scanning
+func PurgeableEvents(events []EventRecord, before time.Time, maxSeq int64) int {
+	n := 0
+	for n < len(events) && events[n].Seq <= maxSeq && events[n].EventTime != nil && events[n].EventTime.Before(before) {
+		n++
+	}
+	return n
+}
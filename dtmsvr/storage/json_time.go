@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// jsonTime is a time in json. it is marshaled in RFC3339 in UTC, whatever the store or the time zone of dtm server,
+// and unmarshaled from RFC3339 with any offset, or from unix milliseconds as a number
+type jsonTime time.Time
+
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+	return time.Time(t).UTC().MarshalJSON()
+}
+
+func (t *jsonTime) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '"' {
+		ms, err := strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("time should be in RFC3339 or unix milliseconds: %s", b)
+		}
+		*t = jsonTime(time.Unix(0, ms*int64(time.Millisecond)))
+		return nil
+	}
+	return (*time.Time)(t).UnmarshalJSON(b)
+}
+
+func toJSONTime(t *time.Time) *jsonTime {
+	if t == nil {
+		return nil
+	}
+	j := jsonTime(*t)
+	return &j
+}
+
+func fromJSONTime(j *jsonTime) *time.Time {
+	if j == nil {
+		return nil
+	}
+	t := time.Time(*j)
+	return &t
+}
+
+// globalJSON is TransGlobalStore in json. the times are at the top level, so they replace the ones of plain
+type globalJSON struct {
+	*plainGlobal
+	CreateTime   *jsonTime `json:"create_time"`
+	UpdateTime   *jsonTime `json:"update_time"`
+	FinishTime   *jsonTime `json:"finish_time,omitempty"`
+	RollbackTime *jsonTime `json:"rollback_time,omitempty"`
+	NextCronTime *jsonTime `json:"next_cron_time,omitempty"`
+}
+
+type plainGlobal TransGlobalStore
+
+func newGlobalJSON(g *TransGlobalStore) *globalJSON {
+	return &globalJSON{(*plainGlobal)(g), toJSONTime(g.CreateTime), toJSONTime(g.UpdateTime), toJSONTime(g.FinishTime),
+		toJSONTime(g.RollbackTime), toJSONTime(g.NextCronTime)}
+}
+
+// MarshalJSON marshals the times in RFC3339 in UTC. the other fields are marshaled as usual
+func (g TransGlobalStore) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newGlobalJSON(&g))
+}
+
+// UnmarshalJSON accepts the times in RFC3339 or unix milliseconds
+func (g *TransGlobalStore) UnmarshalJSON(b []byte) error {
+	v := newGlobalJSON(g)
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	g.CreateTime, g.UpdateTime, g.FinishTime = fromJSONTime(v.CreateTime), fromJSONTime(v.UpdateTime), fromJSONTime(v.FinishTime)
+	g.RollbackTime, g.NextCronTime = fromJSONTime(v.RollbackTime), fromJSONTime(v.NextCronTime)
+	return nil
+}
+
+// branchJSON is TransBranchStore in json, like globalJSON
+type branchJSON struct {
+	*plainBranch
+	CreateTime   *jsonTime `json:"create_time"`
+	UpdateTime   *jsonTime `json:"update_time"`
+	FinishTime   *jsonTime `json:"finish_time,omitempty"`
+	RollbackTime *jsonTime `json:"rollback_time,omitempty"`
+}
+
+type plainBranch TransBranchStore
+
+func newBranchJSON(b *TransBranchStore) *branchJSON {
+	return &branchJSON{(*plainBranch)(b), toJSONTime(b.CreateTime), toJSONTime(b.UpdateTime), toJSONTime(b.FinishTime), toJSONTime(b.RollbackTime)}
+}
+
+// MarshalJSON marshals the times in RFC3339 in UTC. the other fields are marshaled as usual
+func (b TransBranchStore) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newBranchJSON(&b))
+}
+
+// UnmarshalJSON accepts the times in RFC3339 or unix milliseconds
+func (b *TransBranchStore) UnmarshalJSON(data []byte) error {
+	v := newBranchJSON(b)
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	b.CreateTime, b.UpdateTime = fromJSONTime(v.CreateTime), fromJSONTime(v.UpdateTime)
+	b.FinishTime, b.RollbackTime = fromJSONTime(v.FinishTime), fromJSONTime(v.RollbackTime)
+	return nil
+}
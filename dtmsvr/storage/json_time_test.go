@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransJSONTimes(t *testing.T) {
+	create := time.Unix(1600000000, 0).In(time.FixedZone("UTC+8", 8*3600))
+	next := create.Add(10 * time.Second)
+	g := TransGlobalStore{Gid: "gid1", Status: "submitted", NextCronTime: &next}
+	g.CreateTime = &create
+	s := dtmimp.MustMarshalString(&g)
+	assert.Contains(t, s, `"create_time":"2020-09-13T12:26:40Z"`)
+	assert.Contains(t, s, `"next_cron_time":"2020-09-13T12:26:50Z"`)
+	assert.Contains(t, s, `"update_time":null`)
+	assert.NotContains(t, s, "finish_time")
+	assert.Equal(t, s, dtmimp.MustMarshalString(g)) // marshaled the same as a value
+
+	g2 := TransGlobalStore{}
+	dtmimp.MustUnmarshalString(s, &g2)
+	assert.True(t, g2.CreateTime.Equal(create))
+	assert.True(t, g2.NextCronTime.Equal(next))
+	assert.Nil(t, g2.UpdateTime)
+	assert.Equal(t, "gid1", g2.Gid)
+
+	g3 := TransGlobalStore{}
+	dtmimp.MustUnmarshalString(`{"gid":"gid1","create_time":1600000000000,"next_cron_time":"2020-09-13T20:26:50+08:00"}`, &g3)
+	assert.True(t, g3.CreateTime.Equal(create))
+	assert.True(t, g3.NextCronTime.Equal(next))
+	assert.Error(t, json.Unmarshal([]byte(`{"create_time":true}`), &g3))
+
+	b := TransBranchStore{Gid: "gid1", BranchID: "01", FinishTime: &next}
+	b.CreateTime = &create
+	s = dtmimp.MustMarshalString(&b)
+	assert.Contains(t, s, `"create_time":"2020-09-13T12:26:40Z"`)
+	assert.Contains(t, s, `"finish_time":"2020-09-13T12:26:50Z"`)
+	b2 := TransBranchStore{}
+	dtmimp.MustUnmarshalString(`{"branch_id":"01","finish_time":1600000010000}`, &b2)
+	assert.True(t, b2.FinishTime.Equal(next))
+	assert.Equal(t, "01", b2.BranchID)
+}
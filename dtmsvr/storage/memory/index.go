@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package memory
+
+import (
+	"sort"
+	"time"
+)
+
+type cronEntry struct {
+	time time.Time
+	gid  string
+}
+
+func (e cronEntry) before(o cronEntry) bool {
+	return e.time.Before(o.time) || e.time.Equal(o.time) && e.gid < o.gid
+}
+
+// cronIndex is the index of the unfinished trans sorted by next_cron_time, then by gid
+type cronIndex struct {
+	entries []cronEntry
+	times   map[string]time.Time // the next_cron_time indexed of the gid
+}
+
+// search returns the position of the first entry not before the time
+func (x *cronIndex) search(t time.Time) int {
+	return sort.Search(len(x.entries), func(i int) bool { return !x.entries[i].time.Before(t) })
+}
+
+func (x *cronIndex) has(gid string) bool {
+	_, ok := x.times[gid]
+	return ok
+}
+
+func (x *cronIndex) add(gid string, t time.Time) {
+	e := cronEntry{time: t, gid: gid}
+	i := sort.Search(len(x.entries), func(i int) bool { return !x.entries[i].before(e) })
+	x.entries = append(x.entries, cronEntry{})
+	copy(x.entries[i+1:], x.entries[i:])
+	x.entries[i] = e
+	x.times[gid] = t
+}
+
+func (x *cronIndex) remove(gid string) {
+	t, ok := x.times[gid]
+	if !ok {
+		return
+	}
+	e := cronEntry{time: t, gid: gid}
+	i := sort.Search(len(x.entries), func(i int) bool { return !x.entries[i].before(e) })
+	x.entries = append(x.entries[:i], x.entries[i+1:]...)
+	delete(x.times, gid)
+}
@@ -0,0 +1,558 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmutil"
+)
+
+// Store implements storage.Store in memory. NOTE: the data is NOT durable, it is lost when the process exits, so the
+// unfinished trans are never retried after a restart. it is for the tests, and for embedding dtm server in a process
+// whose business is idempotent and can resubmit the lost trans
+type Store struct {
+	mu       sync.RWMutex
+	globals  map[string]*storage.TransGlobalStore
+	branches map[string][]storage.TransBranchStore
+	index    cronIndex
+	kvs      map[kvID]*storage.KVStore
+	attempts map[string][]storage.BranchAttempt
+	seq      uint64 // the id of the last attempt
+	events   []storage.EventRecord
+	eventSeq int64 // the seq of the last event, which is not reset, like the sequences of the other stores
+
+	dataExpire    int64
+	retryInterval int64
+	priorityAging time.Duration
+	lastCleanup   time.Time
+}
+
+type kvID struct {
+	cat string
+	key string
+}
+
+// NewStore returns the memory store. the finished trans are cleaned up after dataExpire seconds
+func NewStore(dataExpire int64, retryInterval int64) *Store {
+	s := &Store{dataExpire: dataExpire, retryInterval: retryInterval, lastCleanup: time.Now()}
+	s.reset()
+	return s
+}
+
+// SetPriorityAging sets the time after which an overdue trans is locked as the max priority. 0 means never
+func (s *Store) SetPriorityAging(aging time.Duration) {
+	s.priorityAging = aging
+}
+
+func (s *Store) reset() {
+	s.globals = map[string]*storage.TransGlobalStore{}
+	s.branches = map[string][]storage.TransBranchStore{}
+	s.index = cronIndex{times: map[string]time.Time{}}
+	s.kvs = map[kvID]*storage.KVStore{}
+	s.attempts = map[string][]storage.BranchAttempt{}
+	s.events = nil
+}
+
+// the data is copied in and out by json, the same as the other stores, so the callers never share the data with the store
+
+func copyGlobal(global *storage.TransGlobalStore) *storage.TransGlobalStore {
+	g := storage.TransGlobalStore{}
+	dtmimp.MustUnmarshal(dtmimp.MustMarshal(global), &g)
+	return &g
+}
+
+func copyBranches(branches []storage.TransBranchStore) []storage.TransBranchStore {
+	bs := []storage.TransBranchStore{}
+	if len(branches) > 0 {
+		dtmimp.MustUnmarshal(dtmimp.MustMarshal(branches), &bs)
+	}
+	return bs
+}
+
+// putGlobal saves the global with the custom data of the saved one, which may be updated by UpdateGlobalCustomData.
+// the global is indexed by its next_cron_time if indexed is true, or removed from the index
+func (s *Store) putGlobal(global *storage.TransGlobalStore, indexed bool) {
+	g := copyGlobal(global)
+	if saved := s.globals[g.Gid]; saved != nil {
+		g.CustomData = saved.CustomData
+	}
+	s.globals[g.Gid] = g
+	s.index.remove(g.Gid)
+	if indexed {
+		s.index.add(g.Gid, *g.NextCronTime)
+	}
+}
+
+// Ping does nothing, the memory is always up
+func (s *Store) Ping() error {
+	return nil
+}
+
+// Now returns the local now, because the store is in the memory of this process
+func (s *Store) Now() (time.Time, error) {
+	return time.Now(), nil
+}
+
+// PopulateData drops all the data unless skipDrop
+func (s *Store) PopulateData(skipDrop bool) {
+	if !skipDrop {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reset()
+		logger.Infof("Reset all data for memory")
+	}
+}
+
+// FindTransGlobalStore finds GlobalTrans data by gid
+func (s *Store) FindTransGlobalStore(gid string) *storage.TransGlobalStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if g := s.globals[gid]; g != nil {
+		return copyGlobal(g)
+	}
+	return nil
+}
+
+// ScanTransGlobalStores lists GlobalTrans data in the order of gid
+func (s *Store) ScanTransGlobalStores(position *string, limit int64, condition storage.TransGlobalScanCondition) []storage.TransGlobalStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gids := make([]string, 0, len(s.globals))
+	for gid := range s.globals {
+		if gid > *position {
+			gids = append(gids, gid)
+		}
+	}
+	sort.Strings(gids)
+	globals := []storage.TransGlobalStore{}
+	for _, gid := range gids {
+		if !condition.Match(s.globals[gid]) {
+			continue
+		}
+		globals = append(globals, *copyGlobal(s.globals[gid]))
+		if len(globals) == int(limit) {
+			break
+		}
+	}
+	if len(globals) < int(limit) {
+		*position = ""
+	} else {
+		*position = globals[len(globals)-1].Gid
+	}
+	return globals
+}
+
+// FindBranches finds Branch data by gid
+func (s *Store) FindBranches(gid string) []storage.TransBranchStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyBranches(s.branches[gid])
+}
+
+// FindBranchesPage finds a page of Branch data by gid
+func (s *Store) FindBranchesPage(gid string, afterBranchID string, limit int) []storage.TransBranchStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyBranches(storage.PageBranches(s.branches[gid], afterBranchID, limit))
+}
+
+// FindBranch finds a branch by gid, branch id and op
+func (s *Store) FindBranch(gid string, branchID string, op string) *storage.TransBranchStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if b := storage.FindBranch(s.branches[gid], branchID, op); b != nil {
+		return &copyBranches([]storage.TransBranchStore{*b})[0]
+	}
+	return nil
+}
+
+// UpdateBranches update branches info
+func (s *Store) UpdateBranches(branches []storage.TransBranchStore, updates []string) (int, error) {
+	return 0, nil // not implemented, the branches are saved by LockGlobalSaveBranches
+}
+
+// LockGlobalSaveBranches saves branches
+func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.globals[gid]
+	if g == nil || g.Status != status {
+		panic(storage.ErrNotFound)
+	}
+	saved := make([]bool, len(branches))
+	bs := s.branches[gid]
+	for i, b := range copyBranches(branches) {
+		pos := branchStart + i
+		if branchStart == -1 {
+			if storage.FindBranch(bs, b.BranchID, b.Op) != nil {
+				continue
+			}
+			bs = append(bs, b)
+		} else if pos < len(bs) {
+			if storage.IsBranchDowngrade(&bs[pos], &b) {
+				continue
+			}
+			b.CreateTime = bs[pos].CreateTime
+			bs[pos] = b
+		} else {
+			bs = append(bs, b)
+		}
+		saved[i] = true
+	}
+	s.branches[gid] = bs
+	return saved
+}
+
+// saveNew saves the new trans, or returns the error of the duplicate
+func (s *Store) saveNew(global *storage.TransGlobalStore, branches []storage.TransBranchStore) error {
+	if g := s.globals[global.Gid]; g != nil {
+		return storage.DuplicateTrans(global, g)
+	}
+	s.putGlobal(global, true)
+	s.branches[global.Gid] = copyBranches(branches)
+	return nil
+}
+
+// MaySaveNewTrans creates a new trans
+func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []storage.TransBranchStore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveNew(global, branches)
+}
+
+// MaySaveNewTransBatch creates the new trans under one lock
+func (s *Store) MaySaveNewTransBatch(trans []storage.NewTrans) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(trans))
+	for i, nt := range trans {
+		errs[i] = s.saveNew(nt.Global, nt.Branches)
+	}
+	return errs
+}
+
+// ChangeGlobalStatus changes global trans status
+func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := storage.GlobalConflict(global, global.Status, s.globals[global.Gid]); err != nil {
+		return err
+	}
+	global.Status = newStatus
+	global.Version++
+	s.putGlobal(global, !finished && s.index.has(global.Gid))
+	return nil
+}
+
+// UpdateGlobalCustomData updates the custom data of an unfinished trans
+func (s *Store) UpdateGlobalCustomData(global *storage.TransGlobalStore, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.globals[global.Gid]
+	if err := storage.GlobalConflict(global, storage.StatusUnfinished, g); err != nil {
+		return err
+	}
+	g.CustomData = data
+	g.UpdateTime = dtmutil.GetNextTime(0)
+	g.Version++
+	global.CustomData = data
+	global.Version = g.Version
+	return nil
+}
+
+// TouchCronTime updates cronTime
+func (s *Store) TouchCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.touchCronTime(global, nextCronInterval, nextCronTime)
+}
+
+// TouchCronTimes touches the cron times under one lock
+func (s *Store) TouchCronTimes(updates []storage.CronTimeUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range updates {
+		s.touchCronTime(u.Global, u.NextCronInterval, u.NextCronTime)
+	}
+}
+
+// touchCronTime touches the cron time of global, skipped if its status or version is changed
+func (s *Store) touchCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
+	global.UpdateTime = dtmutil.GetNextTime(0)
+	global.NextCronTime = nextCronTime
+	global.NextCronInterval = nextCronInterval
+	if storage.GlobalConflict(global, global.Status, s.globals[global.Gid]) != nil {
+		return
+	}
+	global.Version++
+	s.putGlobal(global, true)
+}
+
+// FindOldestCronTime finds the earliest next_cron_time of the unfinished trans, by the first entry of the index
+func (s *Store) FindOldestCronTime() *time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.index.entries) == 0 {
+		return nil
+	}
+	oldest := s.index.entries[0].time
+	return &oldest
+}
+
+// CountCronTimeBefore counts the unfinished trans whose next_cron_time is before the time
+func (s *Store) CountCronTimeBefore(before time.Time) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(s.index.search(before))
+}
+
+// CountOverdueByPriority counts the unfinished trans whose next_cron_time is before the time by priority
+func (s *Store) CountOverdueByPriority(before time.Time) map[int]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := map[int]int64{}
+	for _, e := range s.index.entries[:s.index.search(before)] {
+		counts[s.globals[e.gid].Priority]++
+	}
+	return counts
+}
+
+// CountCronTimeAfter counts the unfinished trans whose next_cron_time is not before the time, the same as ResetCronTime
+func (s *Store) CountCronTimeAfter(after time.Time) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.index.entries) - s.index.search(after))
+}
+
+// Stats computes the stats from all the trans
+func (s *Store) Stats(cond storage.StatsCondition) *storage.TransStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := storage.NewStatsCollector(cond)
+	for _, g := range s.globals {
+		c.Add(g)
+	}
+	return c.Result(false)
+}
+
+// the max number of the expired trans compared by priority in LockOneGlobalTrans
+const lockScanLimit = 1000
+
+// LockOneGlobalTrans finds GlobalTrans of the highest priority among the earliest lockScanLimit expired ones. the trans
+// overdue for more than priorityAging is taken as the max priority
+func (s *Store) LockOneGlobalTrans(expireIn time.Duration) *storage.TransGlobalStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mayCleanup()
+	now := time.Now()
+	expired := s.index.search(now.Add(expireIn).Add(time.Nanosecond)) // next_cron_time <= now + expireIn
+	if expired > lockScanLimit {
+		expired = lockScanLimit
+	}
+	var trans *storage.TransGlobalStore
+	priority := 0
+	for _, e := range s.index.entries[:expired] {
+		g := s.globals[e.gid]
+		p := dtmimp.If(s.priorityAging > 0 && e.time.Before(now.Add(-s.priorityAging)), dtmimp.PriorityMax, g.Priority).(int)
+		if trans == nil || p > priority { // the index is ordered by time, so the earliest is kept for the same priority
+			trans, priority = g, p
+		}
+	}
+	if trans == nil {
+		return nil
+	}
+	next := now.Add(time.Duration(s.retryInterval) * time.Second)
+	trans.NextCronTime = &next
+	s.index.remove(trans.Gid)
+	s.index.add(trans.Gid, next)
+	return copyGlobal(trans)
+}
+
+// ResetCronTime rest nextCronTime
+// Prevent multiple backoff from causing NextCronTime to be too long
+func (s *Store) ResetCronTime(timeout time.Duration, limit int64) (succeedCount int64, hasRemaining bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := time.Now()
+	start := s.index.search(next.Add(timeout))
+	gids := []string{}
+	for _, e := range s.index.entries[start:] {
+		if int64(len(gids)) == limit {
+			hasRemaining = true
+			break
+		}
+		gids = append(gids, e.gid)
+	}
+	for _, gid := range gids {
+		s.globals[gid].NextCronTime = &next
+		s.index.remove(gid)
+		s.index.add(gid, next)
+	}
+	return int64(len(gids)), hasRemaining, nil
+}
+
+// mayCleanup deletes the trans finished dataExpire ago, at most once a minute
+func (s *Store) mayCleanup() {
+	if s.dataExpire <= 0 || time.Since(s.lastCleanup) < time.Minute {
+		return
+	}
+	s.lastCleanup = time.Now()
+	lastKeepTime := time.Now().Add(-time.Duration(s.dataExpire) * time.Second)
+	for gid, g := range s.globals {
+		doneTime := g.FinishTime
+		if doneTime == nil {
+			doneTime = g.RollbackTime
+		}
+		if doneTime != nil && lastKeepTime.After(*doneTime) {
+			delete(s.globals, gid)
+			delete(s.branches, gid)
+			delete(s.attempts, gid)
+			s.index.remove(gid)
+		}
+	}
+}
+
+// FindKV finds key-value pairs in the order of key
+func (s *Store) FindKV(cat, key string) []storage.KVStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	kvs := []storage.KVStore{}
+	for id, kv := range s.kvs {
+		if id.cat == cat && (key == "" || id.key == key) {
+			kvs = append(kvs, *kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].K < kvs[j].K })
+	return kvs
+}
+
+// UpdateKV updates key-value pair with the version as optimistic lock
+func (s *Store) UpdateKV(kv *storage.KVStore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.kvs[kvID{kv.Cat, kv.K}]
+	if old == nil || old.Version != kv.Version {
+		return storage.ErrNotFound
+	}
+	kv.Version++
+	kv.UpdateTime = dtmutil.GetNextTime(0)
+	saved := *kv
+	s.kvs[kvID{kv.Cat, kv.K}] = &saved
+	return nil
+}
+
+// DeleteKV deletes key-value pair
+func (s *Store) DeleteKV(cat, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kvs[kvID{cat, key}] == nil {
+		return storage.ErrNotFound
+	}
+	delete(s.kvs, kvID{cat, key})
+	return nil
+}
+
+// CreateKV creates key-value pair
+func (s *Store) CreateKV(cat, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kvs[kvID{cat, key}] != nil {
+		return storage.ErrUniqueConflict
+	}
+	now := time.Now()
+	kv := &storage.KVStore{Cat: cat, K: key, V: value, Version: 1}
+	kv.CreateTime = &now
+	kv.UpdateTime = &now
+	s.kvs[kvID{cat, key}] = kv
+	return nil
+}
+
+// SaveAttempt saves an attempt of calling a branch
+func (s *Store) SaveAttempt(attempt *storage.BranchAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	attempt.CreateTime = &now
+	attempt.UpdateTime = &now
+	s.seq++
+	attempt.ID = s.seq
+	attempt.Attempt = storage.NextAttempt(s.attempts[attempt.Gid], attempt.BranchID, attempt.Op)
+	s.attempts[attempt.Gid] = append(s.attempts[attempt.Gid], *attempt)
+	return nil
+}
+
+// FindAttempts finds the attempts of calling the branches of the trans
+func (s *Store) FindAttempts(gid string) []storage.BranchAttempt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]storage.BranchAttempt{}, s.attempts[gid]...)
+}
+
+// PurgeAttempts deletes the attempts saved before the time
+func (s *Store) PurgeAttempts(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged int64
+	for gid, attempts := range s.attempts {
+		kept := []storage.BranchAttempt{}
+		for _, a := range attempts {
+			if a.CreateTime.Before(before) {
+				purged++
+			} else {
+				kept = append(kept, a)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.attempts, gid)
+		} else {
+			s.attempts[gid] = kept
+		}
+	}
+	return purged, nil
+}
+
+// SaveEvent saves an event to the event log
+func (s *Store) SaveEvent(event *storage.EventRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventSeq++
+	event.Seq = s.eventSeq
+	s.events = append(s.events, *event)
+	return nil
+}
+
+// FindEvents finds the events after the seq in the order of seq
+func (s *Store) FindEvents(afterSeq int64, limit int) []storage.EventRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.events), func(i int) bool { return s.events[i].Seq > afterSeq })
+	j := i + limit
+	if j > len(s.events) {
+		j = len(s.events)
+	}
+	return append([]storage.EventRecord{}, s.events[i:j]...)
+}
+
+// PurgeEvents deletes the events saved before the time, and not after maxSeq
+func (s *Store) PurgeEvents(before time.Time, maxSeq int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := storage.PurgeableEvents(s.events, before, maxSeq)
+	s.events = append([]storage.EventRecord{}, s.events[n:]...)
+	return int64(n), nil
+}
+
+// PurgePayloads does nothing, because the payloads are not deduplicated
+func (s *Store) PurgePayloads(before time.Time) (int64, error) {
+	return 0, nil
+}
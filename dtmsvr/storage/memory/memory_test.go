@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGlobal(gid string, next time.Time) *storage.TransGlobalStore {
+	now := time.Now()
+	g := &storage.TransGlobalStore{Gid: gid, TransType: "saga", Status: dtmcli.StatusSubmitted, NextCronTime: &next}
+	g.CreateTime = &now
+	return g
+}
+
+func newBranches(gid string, n int) []storage.TransBranchStore {
+	branches := []storage.TransBranchStore{}
+	for i := 1; i <= n; i++ {
+		branches = append(branches, storage.TransBranchStore{Gid: gid, BranchID: fmt.Sprintf("%02d", i), Op: dtmcli.BranchAction, Status: dtmcli.StatusPrepared})
+	}
+	return branches
+}
+
+func TestMemorySaveNewTrans(t *testing.T) {
+	s := NewStore(0, 10)
+	g := newGlobal("gid1", time.Now())
+	assert.Nil(t, s.MaySaveNewTrans(g, newBranches("gid1", 2)))
+	err := s.MaySaveNewTrans(newGlobal("gid1", time.Now()), nil)
+	assert.True(t, errors.Is(err, storage.ErrUniqueConflict))
+
+	found := s.FindTransGlobalStore("gid1")
+	found.Status = dtmcli.StatusFailed // the store is not changed by the callers
+	assert.Equal(t, dtmcli.StatusSubmitted, s.FindTransGlobalStore("gid1").Status)
+	assert.Nil(t, s.FindTransGlobalStore("gid2"))
+	assert.Len(t, s.FindBranches("gid1"), 2)
+	assert.NotNil(t, s.FindBranches("gid2"))
+	assert.Equal(t, "02", s.FindBranch("gid1", "02", dtmcli.BranchAction).BranchID)
+
+	errs := s.MaySaveNewTransBatch([]storage.NewTrans{{Global: newGlobal("gid1", time.Now())}, {Global: newGlobal("gid2", time.Now())}})
+	assert.True(t, errors.Is(errs[0], storage.ErrUniqueConflict))
+	assert.Nil(t, errs[1])
+}
+
+func TestMemoryChangeGlobalStatus(t *testing.T) {
+	s := NewStore(0, 10)
+	g := newGlobal("gid1", time.Now())
+	assert.Nil(t, s.MaySaveNewTrans(g, nil))
+	assert.Nil(t, s.UpdateGlobalCustomData(g, "custom"))
+
+	stale := *g
+	assert.Nil(t, s.ChangeGlobalStatus(g, dtmcli.StatusSucceed, []string{"status"}, true))
+	err := s.ChangeGlobalStatus(&stale, dtmcli.StatusAborting, []string{"status"}, false)
+	var conflict *storage.StatusConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, dtmcli.StatusSucceed, conflict.Actual)
+	assert.Equal(t, dtmcli.StatusSubmitted, stale.Status)
+
+	saved := s.FindTransGlobalStore("gid1")
+	assert.Equal(t, "custom", saved.CustomData)
+	assert.Equal(t, int64(0), s.CountCronTimeBefore(time.Now().Add(time.Hour))) // finished, not indexed
+	assert.Error(t, s.UpdateGlobalCustomData(saved, "again"))
+	assert.Equal(t, storage.ErrNotFound, s.ChangeGlobalStatus(newGlobal("gid2", time.Now()), dtmcli.StatusSucceed, nil, true))
+}
+
+func TestMemoryGlobalVersion(t *testing.T) {
+	s := NewStore(0, 10)
+	g := newGlobal("gid1", time.Now())
+	assert.Nil(t, s.MaySaveNewTrans(g, nil))
+	other := s.FindTransGlobalStore("gid1") // read by another writer
+	assert.Nil(t, s.UpdateGlobalCustomData(other, "custom"))
+	assert.Equal(t, int64(1), other.Version)
+
+	next := time.Now().Add(time.Hour)
+	s.TouchCronTime(g, 10, &next) // skipped, the trans is changed after g is read
+	assert.Equal(t, int64(0), g.Version)
+	err := s.ChangeGlobalStatus(g, dtmcli.StatusSucceed, []string{"status"}, true)
+	assert.Equal(t, &storage.VersionConflictError{Gid: "gid1", Expected: 0, Actual: 1}, err)
+	assert.Equal(t, dtmcli.StatusSubmitted, g.Status)
+
+	g = s.FindTransGlobalStore("gid1") // re-read
+	s.TouchCronTime(g, 10, &next)
+	assert.Nil(t, s.ChangeGlobalStatus(g, dtmcli.StatusSucceed, []string{"status"}, true))
+	assert.Equal(t, int64(3), s.FindTransGlobalStore("gid1").Version)
+	assert.Equal(t, "custom", s.FindTransGlobalStore("gid1").CustomData)
+}
+
+func TestMemoryLockGlobalSaveBranches(t *testing.T) {
+	s := NewStore(0, 10)
+	assert.Nil(t, s.MaySaveNewTrans(newGlobal("gid1", time.Now()), newBranches("gid1", 1)))
+	saved := s.LockGlobalSaveBranches("gid1", dtmcli.StatusSubmitted, newBranches("gid1", 2), -1)
+	assert.Equal(t, []bool{false, true}, saved)
+
+	b := newBranches("gid1", 1)[0]
+	b.Status = dtmcli.StatusSucceed
+	assert.Equal(t, []bool{true}, s.LockGlobalSaveBranches("gid1", dtmcli.StatusSubmitted, []storage.TransBranchStore{b}, 0))
+	b.Status = dtmcli.StatusFailed // a finished branch is not downgraded
+	assert.Equal(t, []bool{false}, s.LockGlobalSaveBranches("gid1", dtmcli.StatusSubmitted, []storage.TransBranchStore{b}, 0))
+	assert.Equal(t, dtmcli.StatusSucceed, s.FindBranches("gid1")[0].Status)
+
+	err := dtmimp.CatchP(func() { s.LockGlobalSaveBranches("gid1", dtmcli.StatusAborting, []storage.TransBranchStore{b}, 0) })
+	assert.Equal(t, storage.ErrNotFound, err)
+	assert.Len(t, s.FindBranchesPage("gid1", "01", 1), 1)
+}
+
+func TestMemoryLockOneGlobalTrans(t *testing.T) {
+	s := NewStore(0, 10)
+	now := time.Now()
+	g1 := newGlobal("gid1", now.Add(-2*time.Second))
+	g2 := newGlobal("gid2", now.Add(-time.Second))
+	g2.Priority = 5
+	g3 := newGlobal("gid3", now.Add(time.Hour))
+	for _, g := range []*storage.TransGlobalStore{g1, g2, g3} {
+		assert.Nil(t, s.MaySaveNewTrans(g, nil))
+	}
+	assert.Equal(t, now.Add(-2*time.Second).Unix(), s.FindOldestCronTime().Unix())
+	assert.Equal(t, int64(2), s.CountCronTimeBefore(now))
+	assert.Equal(t, map[int]int64{0: 1, 5: 1}, s.CountOverdueByPriority(now))
+
+	assert.Equal(t, "gid2", s.LockOneGlobalTrans(0).Gid) // the higher priority first
+	assert.Equal(t, "gid1", s.LockOneGlobalTrans(0).Gid)
+	assert.Nil(t, s.LockOneGlobalTrans(0))
+	assert.True(t, s.FindTransGlobalStore("gid1").NextCronTime.After(now.Add(9*time.Second)))
+
+	s.SetPriorityAging(time.Second) // the overdue for long is locked first
+	overdue := now.Add(-2 * time.Second)
+	s.TouchCronTime(g2, 10, &now)
+	s.TouchCronTime(g1, 10, &overdue)
+	assert.Equal(t, "gid1", s.LockOneGlobalTrans(0).Gid)
+}
+
+func TestMemoryResetCronTime(t *testing.T) {
+	s := NewStore(0, 10)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, s.MaySaveNewTrans(newGlobal(fmt.Sprintf("gid%d", i), time.Now().Add(time.Hour)), nil))
+	}
+	assert.Equal(t, int64(3), s.CountCronTimeAfter(time.Now().Add(time.Minute)))
+	count, remaining, err := s.ResetCronTime(time.Minute, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.True(t, remaining)
+	count, remaining, _ = s.ResetCronTime(time.Minute, 2)
+	assert.Equal(t, int64(1), count)
+	assert.False(t, remaining)
+	assert.Equal(t, int64(3), s.CountCronTimeBefore(time.Now().Add(time.Second)))
+}
+
+func TestMemoryConcurrentLock(t *testing.T) {
+	s := NewStore(0, 60)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, s.MaySaveNewTrans(newGlobal(fmt.Sprintf("gid%03d", i), time.Now()), newBranches("", 1)))
+	}
+	var mu sync.Mutex
+	locked := map[string]int{}
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := s.LockOneGlobalTrans(0); g != nil; g = s.LockOneGlobalTrans(0) {
+				s.FindBranches(g.Gid)
+				mu.Lock()
+				locked[g.Gid]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, locked, 100)
+	for gid, n := range locked {
+		assert.Equal(t, 1, n, gid) // every trans is locked by one worker
+	}
+}
+
+func TestMemoryKV(t *testing.T) {
+	s := NewStore(0, 10)
+	assert.Nil(t, s.CreateKV("cat", "k2", "v2"))
+	assert.Nil(t, s.CreateKV("cat", "k1", "v1"))
+	assert.Equal(t, storage.ErrUniqueConflict, s.CreateKV("cat", "k1", "v1"))
+	kvs := s.FindKV("cat", "")
+	assert.Equal(t, []string{"k1", "k2"}, []string{kvs[0].K, kvs[1].K})
+
+	kv := kvs[0]
+	stale := kv
+	kv.V = "updated"
+	assert.Nil(t, s.UpdateKV(&kv))
+	assert.Equal(t, storage.ErrNotFound, s.UpdateKV(&stale))
+	assert.Equal(t, "updated", s.FindKV("cat", "k1")[0].V)
+	assert.Nil(t, s.DeleteKV("cat", "k1"))
+	assert.Equal(t, storage.ErrNotFound, s.DeleteKV("cat", "k1"))
+}
+
+func TestMemoryAttempts(t *testing.T) {
+	s := NewStore(0, 10)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, s.SaveAttempt(&storage.BranchAttempt{Gid: "gid1", BranchID: "01", Op: dtmcli.BranchAction}))
+	}
+	attempts := s.FindAttempts("gid1")
+	assert.Equal(t, []int{1, 2}, []int{attempts[0].Attempt, attempts[1].Attempt})
+	purged, err := s.PurgeAttempts(time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), purged)
+	assert.Empty(t, s.FindAttempts("gid1"))
+}
+
+func TestMemoryEvents(t *testing.T) {
+	s := NewStore(0, 10)
+	old := time.Now().Add(-time.Hour)
+	for _, status := range []string{dtmcli.StatusSubmitted, dtmcli.StatusSucceed} {
+		assert.Nil(t, s.SaveEvent(&storage.EventRecord{Gid: "gid1", NewStatus: status, EventTime: &old}))
+	}
+	now := time.Now()
+	assert.Nil(t, s.SaveEvent(&storage.EventRecord{Gid: "gid2", NewStatus: dtmcli.StatusSubmitted, EventTime: &now}))
+	events := s.FindEvents(1, 10)
+	assert.Equal(t, []int64{2, 3}, []int64{events[0].Seq, events[1].Seq})
+	assert.Equal(t, 1, len(s.FindEvents(0, 1)))
+
+	purged, err := s.PurgeEvents(time.Now().Add(-time.Minute), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), purged)
+	purged, err = s.PurgeEvents(time.Now().Add(-time.Minute), math.MaxInt64)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), purged)
+	events = s.FindEvents(0, 10)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "gid2", events[0].Gid)
+}
+
+func TestMemoryCleanup(t *testing.T) {
+	s := NewStore(1, 10)
+	g := newGlobal("gid1", time.Now().Add(time.Hour))
+	assert.Nil(t, s.MaySaveNewTrans(g, newBranches("gid1", 1)))
+	finished := time.Now().Add(-2 * time.Second)
+	g.FinishTime = &finished
+	assert.Nil(t, s.ChangeGlobalStatus(g, dtmcli.StatusSucceed, []string{"status", "finish_time"}, true))
+	s.lastCleanup = time.Now().Add(-time.Hour)
+	assert.Nil(t, s.LockOneGlobalTrans(0))
+	assert.Nil(t, s.FindTransGlobalStore("gid1"))
+	assert.Empty(t, s.FindBranches("gid1"))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -32,6 +33,11 @@ func (s *Store) Ping() error {
 	return err
 }
 
+// Now returns the now of redis by TIME
+func (s *Store) Now() (time.Time, error) {
+	return redisGet().Time(ctx).Result()
+}
+
 // PopulateData populates data to redis
 func (s *Store) PopulateData(skipDrop bool) {
 	if !skipDrop {
@@ -55,7 +61,8 @@ func (s *Store) FindTransGlobalStore(gid string) *storage.TransGlobalStore {
 }
 
 // ScanTransGlobalStores lists GlobalTrans data
-func (s *Store) ScanTransGlobalStores(position *string, limit int64) []storage.TransGlobalStore {
+// the trans are filtered after scanned, so a page may contain less than limit trans even if there are remaining ones
+func (s *Store) ScanTransGlobalStores(position *string, limit int64, condition storage.TransGlobalScanCondition) []storage.TransGlobalStore {
 	logger.Debugf("calling ScanTransGlobalStores: %s %d", *position, limit)
 	lid := uint64(0)
 	if *position != "" {
@@ -70,7 +77,9 @@ func (s *Store) ScanTransGlobalStores(position *string, limit int64) []storage.T
 		for _, v := range values {
 			global := storage.TransGlobalStore{}
 			dtmimp.MustUnmarshalString(v.(string), &global)
-			globals = append(globals, global)
+			if condition.Match(&global) {
+				globals = append(globals, global)
+			}
 		}
 	}
 	if cursor > 0 {
@@ -93,6 +102,16 @@ func (s *Store) FindBranches(gid string) []storage.TransBranchStore {
 	return branches
 }
 
+// FindBranchesPage finds a page of Branch data by gid. the list of branches is not indexed by branch id, so it is read entirely
+func (s *Store) FindBranchesPage(gid string, afterBranchID string, limit int) []storage.TransBranchStore {
+	return storage.PageBranches(s.FindBranches(gid), afterBranchID, limit)
+}
+
+// FindBranch finds a branch. the list of branches is not indexed, so it is read entirely
+func (s *Store) FindBranch(gid string, branchID string, op string) *storage.TransBranchStore {
+	return storage.FindBranch(s.FindBranches(gid), branchID, op)
+}
+
 // UpdateBranches updates branches info
 func (s *Store) UpdateBranches(branches []storage.TransBranchStore, updates []string) (int, error) {
 	return 0, nil // not implemented
@@ -111,11 +130,35 @@ func newArgList() *argList {
 func (a *argList) AppendGid(gid string) *argList {
 	a.Keys = append(a.Keys, conf.Store.RedisPrefix+"_g_"+gid)
 	a.Keys = append(a.Keys, conf.Store.RedisPrefix+"_b_"+gid)
-	a.Keys = append(a.Keys, conf.Store.RedisPrefix+"_u")
+	a.Keys = append(a.Keys, cronIndexKey(0))
 	a.Keys = append(a.Keys, conf.Store.RedisPrefix+"_s_"+gid)
 	return a
 }
 
+// AppendGlobal appends the keys of the global like AppendGid, with the cron index of its priority
+func (a *argList) AppendGlobal(global *storage.TransGlobalStore) *argList {
+	a.AppendGid(global.Gid)
+	a.Keys[len(a.Keys)-2] = cronIndexKey(global.Priority)
+	return a
+}
+
+// cronIndexKey returns the key of the sorted set indexing the next cron time of the unfinished trans of the priority
+func cronIndexKey(priority int) string {
+	if priority == 0 { // the index of the trans saved before priorities are supported
+		return conf.Store.RedisPrefix + "_u"
+	}
+	return fmt.Sprintf("%s_u_p%d", conf.Store.RedisPrefix, priority)
+}
+
+// allCronIndexKeys returns the keys of the cron indexes of all priorities, from the highest to the lowest
+func allCronIndexKeys() []string {
+	keys := []string{}
+	for p := dtmimp.PriorityMax; p >= dtmimp.PriorityMin; p-- {
+		keys = append(keys, cronIndexKey(p))
+	}
+	return keys
+}
+
 func (a *argList) AppendRaw(v interface{}) *argList {
 	a.List = append(a.List, v)
 	return a
@@ -145,16 +188,58 @@ func handleRedisResult(ret interface{}, err error) (string, error) {
 	return s, err
 }
 
+var scripts sync.Map
+
+// getScript returns the cached script of the lua, so the sha of the lua is computed once
+func getScript(lua string) *redis.Script {
+	if sc, ok := scripts.Load(lua); ok {
+		return sc.(*redis.Script)
+	}
+	sc, _ := scripts.LoadOrStore(lua, redis.NewScript(lua))
+	return sc.(*redis.Script)
+}
+
+// callLua calls the lua by EVALSHA, which sends only the sha of the lua, and falls back to EVAL if the script is not
+// loaded, such as after the redis restarts. the script is cached in redis by the EVAL
 func callLua(a *argList, lua string) (string, error) {
 	logger.Debugf("calling lua. args: %v\nlua:%s", a, lua)
-	ret, err := redisGet().Eval(ctx, lua, a.Keys, a.List...).Result()
+	ret, err := getScript(lua).Run(ctx, redisGet(), a.Keys, a.List...).Result()
 	return handleRedisResult(ret, err)
 }
 
 // MaySaveNewTrans creates a new trans
 func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []storage.TransBranchStore) error {
+	a := newTransArgs(global, branches)
+	_, err := callLua(a, luaMaySaveNewTrans)
+	if err == storage.ErrUniqueConflict {
+		return storage.DuplicateTrans(global, s.FindTransGlobalStore(global.Gid))
+	}
+	return err
+}
+
+// MaySaveNewTransBatch creates the new trans by the lua of MaySaveNewTrans, sent in one pipeline
+func (s *Store) MaySaveNewTransBatch(trans []storage.NewTrans) []error {
+	cmds := make([]*redis.Cmd, len(trans))
+	_, _ = redisGet().Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, t := range trans {
+			a := newTransArgs(t.Global, t.Branches)
+			cmds[i] = p.Eval(ctx, luaMaySaveNewTrans, a.Keys, a.List...)
+		}
+		return nil
+	})
+	errs := make([]error, len(trans))
+	for i, t := range trans {
+		_, errs[i] = handleRedisResult(cmds[i].Result())
+		if errs[i] == storage.ErrUniqueConflict {
+			errs[i] = storage.DuplicateTrans(t.Global, s.FindTransGlobalStore(t.Global.Gid))
+		}
+	}
+	return errs
+}
+
+func newTransArgs(global *storage.TransGlobalStore, branches []storage.TransBranchStore) *argList {
 	a := newArgList().
-		AppendGid(global.Gid).
+		AppendGlobal(global).
 		AppendObject(global).
 		AppendRaw(global.NextCronTime.Unix()).
 		AppendRaw(global.Gid).
@@ -162,7 +247,10 @@ func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []sto
 		AppendBranches(branches)
 	global.Steps = nil
 	global.Payloads = nil
-	_, err := callLua(a, `-- MaySaveNewTrans
+	return a
+}
+
+const luaMaySaveNewTrans = `-- MaySaveNewTrans
 local g = redis.call('GET', KEYS[1])
 if g ~= false then
 	return 'UNIQUE_CONFLICT'
@@ -175,76 +263,203 @@ for k = 7, table.getn(ARGV) do
 	redis.call('RPUSH', KEYS[2], ARGV[k])
 end
 redis.call('EXPIRE', KEYS[2], ARGV[2])
-`)
-	return err
-}
+`
 
-// LockGlobalSaveBranches creates branches
-func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) {
+// LockGlobalSaveBranches saves branches. the result of the lua is a flag 1 or 0 for each branch saved or not
+func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) []bool {
 	args := newArgList().
 		AppendGid(gid).
 		AppendRaw(status).
 		AppendRaw(branchStart).
 		AppendBranches(branches)
-	_, err := callLua(args, `-- LockGlobalSaveBranches
+	ret, err := callLua(args, `-- LockGlobalSaveBranches
 local old = redis.call('GET', KEYS[4])
 if old ~= ARGV[3] then
 	return 'NOT_FOUND'
 end
 local start = ARGV[4]
+local saved = {}
+if start == "-1" then
+	for _, v in ipairs(redis.call('LRANGE', KEYS[2], 0, -1)) do
+		local b = cjson.decode(v)
+		saved[tostring(b['branch_id']) .. ' ' .. tostring(b['op'])] = true
+	end
+end
+local flags = ''
 for k = 5, table.getn(ARGV) do
+	local v = ARGV[k]
+	local b = cjson.decode(v)
+	local flag = '1'
 	if start == "-1" then
-		redis.call('RPUSH', KEYS[2], ARGV[k])
+		local key = tostring(b['branch_id']) .. ' ' .. tostring(b['op'])
+		if saved[key] then
+			flag = '0'
+		else
+			saved[key] = true
+			redis.call('RPUSH', KEYS[2], v)
+		end
 	else
-		redis.call('LSET', KEYS[2], start+k-5, ARGV[k])
+		local ov = redis.call('LINDEX', KEYS[2], start+k-5)
+		local o = ov and cjson.decode(ov) or {}
+		if (o['status'] == 'succeed' or o['status'] == 'failed') and o['status'] ~= b['status'] then
+			flag = '0'
+		else
+			if b['create_time'] ~= o['create_time'] then
+				b['create_time'] = o['create_time']
+				v = cjson.encode(b)
+			end
+			redis.call('LSET', KEYS[2], start+k-5, v)
+		end
 	end
+	flags = flags .. flag
 end
 redis.call('EXPIRE', KEYS[2], ARGV[2])
+return flags
 	`)
 	dtmimp.E2P(err)
+	saved := make([]bool, len(branches))
+	for i := range saved {
+		saved[i] = i < len(ret) && ret[i] == '1'
+	}
+	return saved
 }
 
 // ChangeGlobalStatus changes global trans status
-func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) {
-	old := global.Status
-	global.Status = newStatus
+func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) error {
+	old, version := global.Status, global.Version
+	global.Status, global.Version = newStatus, version+1
 	args := newArgList().
-		AppendGid(global.Gid).
+		AppendGlobal(global).
 		AppendObject(global).
 		AppendRaw(old).
 		AppendRaw(finished).
 		AppendRaw(global.Gid).
-		AppendRaw(newStatus)
+		AppendRaw(newStatus).
+		AppendRaw(version)
 	_, err := callLua(args, `-- ChangeGlobalStatus
+`+luaKeepCustomData+luaVersionOf+`
 local old = redis.call('GET', KEYS[4])
-if old ~= ARGV[4] then
+if old ~= ARGV[4] or versionOf(KEYS[1]) ~= tonumber(ARGV[8]) then
   return 'NOT_FOUND'
 end
-redis.call('SET', KEYS[1],  ARGV[3], 'EX', ARGV[2])
+redis.call('SET', KEYS[1],  keepCustomData(KEYS[1], ARGV[3]), 'EX', ARGV[2])
 redis.call('SET', KEYS[4],  ARGV[7], 'EX', ARGV[2])
 if ARGV[5] == '1' then
 	redis.call('ZREM', KEYS[3], ARGV[6])
 end
 `)
+	if err != nil {
+		global.Status, global.Version = old, version
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return storage.GlobalConflict(global, old, s.FindTransGlobalStore(global.Gid))
+	}
+	return err
+}
+
+// FindOldestCronTime finds the earliest next_cron_time of the unfinished trans, by the scores of the first members of the indexes
+func (s *Store) FindOldestCronTime() *time.Time {
+	var oldest *time.Time
+	for _, key := range allCronIndexKeys() {
+		r, err := redisGet().ZRangeWithScores(ctx, key, 0, 0).Result()
+		dtmimp.E2P(err)
+		if len(r) > 0 && (oldest == nil || int64(r[0].Score) < oldest.Unix()) {
+			t := time.Unix(int64(r[0].Score), 0)
+			oldest = &t
+		}
+	}
+	return oldest
+}
+
+// countCronIndexes counts the members of the cron index of each priority, whose scores are in [min, max]
+func countCronIndexes(min string, max string) map[int]int64 {
+	cmds := map[int]*redis.IntCmd{}
+	_, err := redisGet().Pipelined(ctx, func(p redis.Pipeliner) error {
+		for priority := dtmimp.PriorityMin; priority <= dtmimp.PriorityMax; priority++ {
+			cmds[priority] = p.ZCount(ctx, cronIndexKey(priority), min, max)
+		}
+		return nil
+	})
 	dtmimp.E2P(err)
+	counts := map[int]int64{}
+	for priority, cmd := range cmds {
+		if cmd.Val() > 0 {
+			counts[priority] = cmd.Val()
+		}
+	}
+	return counts
+}
+
+func sumCounts(counts map[int]int64) int64 {
+	sum := int64(0)
+	for _, c := range counts {
+		sum += c
+	}
+	return sum
 }
 
-// LockOneGlobalTrans finds GlobalTrans
+// CountCronTimeBefore counts the unfinished trans whose next_cron_time is before the time
+func (s *Store) CountCronTimeBefore(before time.Time) int64 {
+	return sumCounts(s.CountOverdueByPriority(before))
+}
+
+// CountOverdueByPriority counts the unfinished trans whose next_cron_time is before the time by priority
+func (s *Store) CountOverdueByPriority(before time.Time) map[int]int64 {
+	return countCronIndexes("-inf", fmt.Sprintf("(%d", before.Unix()))
+}
+
+// CountCronTimeAfter counts the unfinished trans whose next_cron_time is not before the time, the same as ResetCronTime
+func (s *Store) CountCronTimeAfter(after time.Time) int64 {
+	return sumCounts(countCronIndexes(fmt.Sprintf("%d", after.Unix()), "+inf"))
+}
+
+// the max number of the trans scanned by Stats
+const statsScanLimit = 100000
+
+// Stats computes the stats by scanning the trans. the result is approximate, because a scan may return a trans more than once
+func (s *Store) Stats(cond storage.StatsCondition) *storage.TransStats {
+	c := storage.NewStatsCollector(cond)
+	position := ""
+	for scanned := 0; scanned < statsScanLimit; {
+		globals := s.ScanTransGlobalStores(&position, 1000, storage.TransGlobalScanCondition{})
+		for i := range globals {
+			c.Add(&globals[i])
+		}
+		scanned += len(globals)
+		if position == "" {
+			break
+		}
+	}
+	return c.Result(true)
+}
+
+// LockOneGlobalTrans finds GlobalTrans. the indexes are checked from the highest priority, and the trans overdue for
+// more than PriorityAging is locked as the max priority, the same as the sql store
 func (s *Store) LockOneGlobalTrans(expireIn time.Duration) *storage.TransGlobalStore {
-	expired := time.Now().Add(expireIn).Unix()
-	next := time.Now().Add(time.Duration(conf.RetryInterval) * time.Second).Unix()
-	args := newArgList().AppendGid("").AppendRaw(expired).AppendRaw(next)
+	now := storage.Now() // the scores are compared in the clock of redis, estimated by the skew probed
+	expired := now.Add(expireIn).Unix()
+	next := now.Add(time.Duration(conf.RetryInterval) * time.Second).Unix()
+	aged := int64(0)
+	if conf.PriorityAging > 0 {
+		aged = now.Add(-time.Duration(conf.PriorityAging) * time.Second).Unix()
+	}
+	args := newArgList().AppendRaw(expired).AppendRaw(next).AppendRaw(aged)
+	args.Keys = allCronIndexKeys()
 	lua := `-- LockOneGlobalTrans
-local r = redis.call('ZRANGE', KEYS[3], 0, 0, 'WITHSCORES')
-local gid = r[1]
-if gid == nil then
-	return 'NOT_FOUND'
+local key, gid, score = nil, nil, nil
+for i = 1, table.getn(KEYS) do
+	local r = redis.call('ZRANGE', KEYS[i], 0, 0, 'WITHSCORES')
+	if r[1] ~= nil and tonumber(r[2]) <= tonumber(ARGV[3]) then
+		local s = tonumber(r[2])
+		if key == nil or s <= tonumber(ARGV[5]) and (score > tonumber(ARGV[5]) or s < score) then
+			key, gid, score = KEYS[i], r[1], s
+		end
+	end
 end
-
-if tonumber(r[2]) > tonumber(ARGV[3]) then
+if key == nil then
 	return 'NOT_FOUND'
 end
-redis.call('ZADD', KEYS[3], ARGV[4], gid)
+redis.call('ZADD', key, ARGV[4], gid)
 return gid
 `
 	for {
@@ -263,19 +478,22 @@ return gid
 // ResetCronTime rest nextCronTime
 // Prevent multiple backoff from causing NextCronTime to be too long
 func (s *Store) ResetCronTime(timeout time.Duration, limit int64) (succeedCount int64, hasRemaining bool, err error) {
-	next := time.Now().Unix()
-	timeoutTimestamp := time.Now().Add(timeout).Unix()
-	args := newArgList().AppendGid("").AppendRaw(timeoutTimestamp).AppendRaw(next).AppendRaw(limit)
+	now := storage.Now()
+	next := now.Unix()
+	timeoutTimestamp := now.Add(timeout).Unix()
+	args := newArgList().AppendRaw(timeoutTimestamp).AppendRaw(next).AppendRaw(limit)
+	args.Keys = allCronIndexKeys()
 	lua := `-- ResetCronTime
-local r = redis.call('ZRANGEBYSCORE', KEYS[3], ARGV[3], '+inf', 'LIMIT', 0, ARGV[5]+1)
 local i = 0
-for score,gid in pairs(r) do
-	if i == tonumber(ARGV[5]) then
+for k = 1, table.getn(KEYS) do
+	local r = redis.call('ZRANGEBYSCORE', KEYS[k], ARGV[3], '+inf', 'LIMIT', 0, ARGV[5]+1-i)
+	for score,gid in pairs(r) do
+		if i == tonumber(ARGV[5]) then
+			return tostring(i + 1)
+		end
+		redis.call('ZADD', KEYS[k], ARGV[4], gid)
 		i = i + 1
-		break
 	end
-	redis.call('ZADD', KEYS[3], ARGV[4], gid)
-	i = i + 1
 end
 return tostring(i)
 `
@@ -290,26 +508,269 @@ return tostring(i)
 	return
 }
 
+// luaKeepCustomData defines keepCustomData, which returns the global with the custom data of the saved one, because the
+// custom data may be updated by UpdateGlobalCustomData
+const luaKeepCustomData = `local function keepCustomData(key, global)
+	local saved = redis.call('GET', key)
+	if saved == false then
+		return global
+	end
+	local g = cjson.decode(global)
+	g['custom_data'] = cjson.decode(saved)['custom_data']
+	return cjson.encode(g)
+end`
+
+// luaVersionOf defines versionOf, which returns the version of the saved global, or -1 if it is not found. the version
+// is omitted in the json if it is 0
+const luaVersionOf = `
+local function versionOf(key)
+	local saved = redis.call('GET', key)
+	if saved == false then
+		return -1
+	end
+	return cjson.decode(saved)['version'] or 0
+end`
+
+// UpdateGlobalCustomData updates the custom data of an unfinished trans
+func (s *Store) UpdateGlobalCustomData(global *storage.TransGlobalStore, data string) error {
+	args := newArgList().
+		AppendGid(global.Gid).
+		AppendRaw(data).
+		AppendObject(time.Now()).
+		AppendRaw(global.Version)
+	r, err := callLua(args, `-- UpdateGlobalCustomData
+`+luaVersionOf+`
+local status = redis.call('GET', KEYS[4])
+if status == false or status == 'succeed' or status == 'failed' or versionOf(KEYS[1]) ~= tonumber(ARGV[5]) then
+	return 'CONFLICT'
+end
+local g = cjson.decode(redis.call('GET', KEYS[1]))
+g['custom_data'] = ARGV[3]
+g['update_time'] = cjson.decode(ARGV[4])
+g['version'] = tonumber(ARGV[5]) + 1
+redis.call('SET', KEYS[1], cjson.encode(g), 'EX', ARGV[2])
+`)
+	if err == nil && r == "CONFLICT" {
+		return storage.GlobalConflict(global, storage.StatusUnfinished, s.FindTransGlobalStore(global.Gid))
+	} else if err == nil {
+		global.CustomData = data
+		global.Version++
+	}
+	return err
+}
+
 // TouchCronTime updates cronTime
 func (s *Store) TouchCronTime(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) {
+	_, err := callLua(touchCronTimeArgs(global, nextCronInterval, nextCronTime), luaTouchCronTime)
+	if err == nil {
+		global.Version++
+	} else if err != storage.ErrNotFound { // the status or the version is changed, skipped
+		dtmimp.E2P(err)
+	}
+}
+
+// TouchCronTimes touches the cron times by the lua of TouchCronTime, sent in one pipeline
+func (s *Store) TouchCronTimes(updates []storage.CronTimeUpdate) {
+	cmds := make([]*redis.Cmd, len(updates))
+	_, _ = redisGet().Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, u := range updates {
+			a := touchCronTimeArgs(u.Global, u.NextCronInterval, u.NextCronTime)
+			cmds[i] = p.Eval(ctx, luaTouchCronTime, a.Keys, a.List...)
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		_, err := handleRedisResult(cmd.Result())
+		if err == nil {
+			updates[i].Global.Version++
+		} else if err != storage.ErrNotFound { // the status or the version is changed, skipped
+			dtmimp.E2P(err)
+		}
+	}
+}
+
+// touchCronTimeArgs returns the args of luaTouchCronTime, where the global is saved with the next version
+func touchCronTimeArgs(global *storage.TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) *argList {
 	global.UpdateTime = dtmutil.GetNextTime(0)
 	global.NextCronTime = nextCronTime
 	global.NextCronInterval = nextCronInterval
-	args := newArgList().
-		AppendGid(global.Gid).
-		AppendObject(global).
+	next := *global
+	next.Version++
+	return newArgList().
+		AppendGlobal(global).
+		AppendObject(&next).
 		AppendRaw(global.NextCronTime.Unix()).
 		AppendRaw(global.Status).
-		AppendRaw(global.Gid)
-	_, err := callLua(args, `-- TouchCronTime
+		AppendRaw(global.Gid).
+		AppendRaw(global.Version)
+}
+
+var luaTouchCronTime = `-- TouchCronTime
+` + luaKeepCustomData + luaVersionOf + `
 local old = redis.call('GET', KEYS[4])
-if old ~= ARGV[5] then
+if old ~= ARGV[5] or versionOf(KEYS[1]) ~= tonumber(ARGV[7]) then
 	return 'NOT_FOUND'
 end
 redis.call('ZADD', KEYS[3], ARGV[4], ARGV[6])
-redis.call('SET', KEYS[1], ARGV[3], 'EX', ARGV[2])
-	`)
+redis.call('SET', KEYS[1], keepCustomData(KEYS[1], ARGV[3]), 'EX', ARGV[2])
+`
+
+func kvKey(cat string) string {
+	return conf.Store.RedisPrefix + "_kv_" + cat
+}
+
+// FindKV finds key-value pairs
+func (s *Store) FindKV(cat, key string) []storage.KVStore {
+	var values []string
+	if key == "" {
+		m, err := redisGet().HGetAll(ctx, kvKey(cat)).Result()
+		dtmimp.E2P(err)
+		for _, v := range m {
+			values = append(values, v)
+		}
+	} else {
+		v, err := redisGet().HGet(ctx, kvKey(cat), key).Result()
+		if err != redis.Nil {
+			dtmimp.E2P(err)
+			values = append(values, v)
+		}
+	}
+	kvs := make([]storage.KVStore, len(values))
+	for i, v := range values {
+		dtmimp.MustUnmarshalString(v, &kvs[i])
+	}
+	return kvs
+}
+
+// UpdateKV updates key-value pair with the version as optimistic lock
+func (s *Store) UpdateKV(kv *storage.KVStore) error {
+	oldVersion := kv.Version
+	kv.Version = oldVersion + 1
+	kv.UpdateTime = dtmutil.GetNextTime(0)
+	args := newArgList().AppendRaw(kv.K).AppendRaw(oldVersion).AppendObject(kv)
+	args.Keys = append(args.Keys, kvKey(kv.Cat))
+	_, err := callLua(args, `-- UpdateKV
+local old = redis.call('HGET', KEYS[1], ARGV[3])
+if old == false or cjson.decode(old)['version'] ~= tonumber(ARGV[4]) then
+	return 'NOT_FOUND'
+end
+redis.call('HSET', KEYS[1], ARGV[3], ARGV[5])
+`)
+	return err
+}
+
+// DeleteKV deletes key-value pair
+func (s *Store) DeleteKV(cat, key string) error {
+	n, err := redisGet().HDel(ctx, kvKey(cat), key).Result()
+	if err == nil && n == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
+// CreateKV creates key-value pair
+func (s *Store) CreateKV(cat, key, value string) error {
+	now := time.Now()
+	kv := &storage.KVStore{Cat: cat, K: key, V: value, Version: 1}
+	kv.CreateTime = &now
+	kv.UpdateTime = &now
+	ok, err := redisGet().HSetNX(ctx, kvKey(cat), key, dtmimp.MustMarshalString(kv)).Result()
+	if err == nil && !ok {
+		err = storage.ErrUniqueConflict
+	}
+	return err
+}
+
+// SaveAttempt saves an attempt of calling a branch. the attempts of a trans expire like the trans
+func (s *Store) SaveAttempt(attempt *storage.BranchAttempt) error {
+	now := time.Now()
+	attempt.CreateTime = &now
+	attempt.UpdateTime = &now
+	attempt.Attempt = storage.NextAttempt(s.FindAttempts(attempt.Gid), attempt.BranchID, attempt.Op)
+	key := conf.Store.RedisPrefix + "_a_" + attempt.Gid
+	_, err := redisGet().TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.RPush(ctx, key, dtmimp.MustMarshalString(attempt))
+		p.Expire(ctx, key, time.Duration(conf.Store.DataExpire)*time.Second)
+		return nil
+	})
+	return err
+}
+
+// FindAttempts finds the attempts of calling the branches of the trans
+func (s *Store) FindAttempts(gid string) []storage.BranchAttempt {
+	sa, err := redisGet().LRange(ctx, conf.Store.RedisPrefix+"_a_"+gid, 0, -1).Result()
+	dtmimp.E2P(err)
+	attempts := make([]storage.BranchAttempt, len(sa))
+	for i, v := range sa {
+		dtmimp.MustUnmarshalString(v, &attempts[i])
+	}
+	return attempts
+}
+
+// PurgeAttempts does nothing, because the attempts expire with DataExpire
+func (s *Store) PurgeAttempts(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// eventKeys returns the keys of the seq and the sorted set of the event log, which is scored by the seq
+func eventKeys() []string {
+	return []string{conf.Store.RedisPrefix + "_event_seq", conf.Store.RedisPrefix + "_events"}
+}
+
+// SaveEvent saves an event to the event log. the seq is INCR by the lua, so it is global among the dtm servers sharing
+// the redis. the event log does not expire with DataExpire, it is purged by PurgeEvents
+func (s *Store) SaveEvent(event *storage.EventRecord) error {
+	args := newArgList().AppendObject(event)
+	args.Keys = eventKeys()
+	r, err := callLua(args, `-- SaveEvent
+local seq = redis.call('INCR', KEYS[1])
+local e = cjson.decode(ARGV[3])
+e['seq'] = seq
+redis.call('ZADD', KEYS[2], seq, cjson.encode(e))
+return tostring(seq)
+`)
+	if err == nil {
+		event.Seq, err = strconv.ParseInt(r, 10, 64)
+	}
+	return err
+}
+
+// FindEvents finds the events after the seq in the order of seq
+func (s *Store) FindEvents(afterSeq int64, limit int) []storage.EventRecord {
+	ss, err := redisGet().ZRangeByScore(ctx, eventKeys()[1], &redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", afterSeq),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
 	dtmimp.E2P(err)
+	events := make([]storage.EventRecord, len(ss))
+	for i, v := range ss {
+		dtmimp.MustUnmarshalString(v, &events[i])
+	}
+	return events
+}
+
+// PurgeEvents deletes the events saved before the time, and not after maxSeq. the events are scanned from the oldest,
+// and the purge stops at the first event to keep
+func (s *Store) PurgeEvents(before time.Time, maxSeq int64) (int64, error) {
+	var purged int64
+	for {
+		events := s.FindEvents(0, 100)
+		n := storage.PurgeableEvents(events, before, maxSeq)
+		if n == 0 {
+			return purged, nil
+		}
+		removed, err := redisGet().ZRemRangeByScore(ctx, eventKeys()[1], "-inf", strconv.FormatInt(events[n-1].Seq, 10)).Result()
+		purged += removed
+		if err != nil || n < len(events) {
+			return purged, err
+		}
+	}
+}
+
+// PurgePayloads does nothing, because the payloads are not deduplicated
+func (s *Store) PurgePayloads(before time.Time) (int64, error) {
+	return 0, nil
 }
 
 var (
@@ -0,0 +1,86 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// commandHook counts the commands sent to redis, which are the round trips of the calls not pipelined, and their sizes
+type commandHook struct {
+	commands int64
+	bytes    int64
+}
+
+func (h *commandHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.commands, 1)
+	for _, arg := range cmd.Args() {
+		atomic.AddInt64(&h.bytes, int64(len(fmt.Sprint(arg))))
+	}
+	return ctx, nil
+}
+
+func (h *commandHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error { return nil }
+
+func (h *commandHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *commandHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error { return nil }
+
+// BenchmarkCallLua compares the lua of MaySaveNewTrans called by EVAL, which sends the lua in every call, with the one
+// called by callLua, which sends the sha by EVALSHA. the scripts are flushed first, so the fallback to EVAL is counted.
+// it needs a redis at localhost:6379, such as: go test ./dtmsvr/storage/redis -run None -bench CallLua -benchtime 10000x
+func BenchmarkCallLua(b *testing.B) {
+	conf.Store.Driver, conf.Store.Host, conf.Store.Port = "redis", "localhost", 6379
+	if err := redisGet().Ping(ctx).Err(); err != nil {
+		b.Skipf("redis is not available: %v", err)
+	}
+	hook := &commandHook{}
+	redisGet().AddHook(hook)
+	prefix := fmt.Sprintf("%s-%d-", "BenchmarkCallLua", time.Now().UnixNano())
+	calls := map[string]func(a *argList) (string, error){
+		"eval": func(a *argList) (string, error) {
+			return handleRedisResult(redisGet().Eval(ctx, luaMaySaveNewTrans, a.Keys, a.List...).Result())
+		},
+		"evalsha": func(a *argList) (string, error) {
+			return callLua(a, luaMaySaveNewTrans)
+		},
+	}
+	for _, name := range []string{"eval", "evalsha"} {
+		call := calls[name]
+		b.Run(name, func(b *testing.B) {
+			if err := redisGet().ScriptFlush(ctx).Err(); err != nil {
+				b.Fatal(err)
+			}
+			durations := make([]time.Duration, b.N)
+			atomic.StoreInt64(&hook.commands, 0)
+			atomic.StoreInt64(&hook.bytes, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				gid := prefix + name + "-" + strconv.Itoa(i)
+				next := time.Now().Add(10 * time.Second)
+				a := newTransArgs(&storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &next},
+					[]storage.TransBranchStore{{Gid: gid, BranchID: "01"}, {Gid: gid, BranchID: "02"}})
+				began := time.Now()
+				if _, err := call(a); err != nil {
+					b.Fatal(err)
+				}
+				durations[i] = time.Since(began)
+			}
+			b.StopTimer()
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			b.ReportMetric(float64(durations[b.N*99/100].Microseconds()), "p99-us")
+			b.ReportMetric(float64(atomic.LoadInt64(&hook.commands))/float64(b.N), "round-trips/op")
+			b.ReportMetric(float64(atomic.LoadInt64(&hook.bytes))/float64(b.N), "sent-bytes/op")
+		})
+	}
+}
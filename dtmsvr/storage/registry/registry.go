@@ -6,6 +6,7 @@ import (
 	"github.com/dtm-labs/dtm/dtmsvr/config"
 	"github.com/dtm-labs/dtm/dtmsvr/storage"
 	"github.com/dtm-labs/dtm/dtmsvr/storage/boltdb"
+	"github.com/dtm-labs/dtm/dtmsvr/storage/memory"
 	"github.com/dtm-labs/dtm/dtmsvr/storage/redis"
 	"github.com/dtm-labs/dtm/dtmsvr/storage/sql"
 )
@@ -27,7 +28,17 @@ var sqlFac = &SingletonFactory{
 var storeFactorys = map[string]StorageFactory{
 	"boltdb": &SingletonFactory{
 		creatorFunction: func() storage.Store {
-			return boltdb.NewStore(conf.Store.DataExpire, conf.RetryInterval)
+			s := boltdb.NewStore(conf.Store.DataExpire, conf.RetryInterval)
+			s.SetBatchDelay(time.Duration(conf.Store.BoltBatchDelay) * time.Millisecond)
+			s.SetPriorityAging(time.Duration(conf.PriorityAging) * time.Second)
+			return s
+		},
+	},
+	"memory": &SingletonFactory{
+		creatorFunction: func() storage.Store {
+			s := memory.NewStore(conf.Store.DataExpire, conf.RetryInterval)
+			s.SetPriorityAging(time.Duration(conf.PriorityAging) * time.Second)
+			return s
 		},
 	},
 	"redis": &SingletonFactory{
@@ -39,9 +50,13 @@ var storeFactorys = map[string]StorageFactory{
 	"postgres": sqlFac,
 }
 
-// GetStore returns storage.Store
+// GetStore returns storage.Store. the store is wrapped to encrypt the data at rest, if the encryption is enabled
 func GetStore() storage.Store {
-	return storeFactorys[conf.Store.Driver].GetStorage()
+	s := storeFactorys[conf.Store.Driver].GetStorage()
+	if storage.EncryptionEnabled() {
+		return storage.NewEncryptedStore(s)
+	}
+	return s
 }
 
 // WaitStoreUp wait for db to go up
@@ -50,3 +65,11 @@ func WaitStoreUp() {
 		time.Sleep(3 * time.Second)
 	}
 }
+
+// CheckSchema checks the schema of the sql store, and applies the pending migrations if Store.AutoMigrate is true
+func CheckSchema() error {
+	if !conf.Store.IsDB() {
+		return nil
+	}
+	return sql.Migrate(conf.Store.AutoMigrate)
+}
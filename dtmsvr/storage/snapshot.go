@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+)
+
+// SnapshotSchemaVersion is the schema version of the records written by ExportSnapshot
+const SnapshotSchemaVersion = 1
+
+// snapshotScanLimit is the page size of scanning the trans to export
+const snapshotScanLimit = 100
+
+// SnapshotRecord is a line of a snapshot in ndjson: an unfinished trans and its branches
+type SnapshotRecord struct {
+	SchemaVersion int                `json:"schema_version"`
+	Global        *TransGlobalStore  `json:"global"`
+	Branches      []TransBranchStore `json:"branches"`
+}
+
+// ExportSnapshot writes the unfinished trans of s and their branches to w, a SnapshotRecord per line, and returns the
+// number of trans written. the trans changed while exporting may be exported in either state, so the dtm servers of s
+// should be read-only when exporting for a migration
+func ExportSnapshot(s Store, w io.Writer) (int, error) {
+	count := 0
+	encoder := json.NewEncoder(w)
+	position := ""
+	for {
+		globals := s.ScanTransGlobalStores(&position, snapshotScanLimit, TransGlobalScanCondition{})
+		for i := range globals {
+			g := &globals[i]
+			if g.Status == dtmcli.StatusSucceed || g.Status == dtmcli.StatusFailed {
+				continue
+			}
+			record := SnapshotRecord{SchemaVersion: SnapshotSchemaVersion, Global: g, Branches: s.FindBranches(g.Gid)}
+			if err := encoder.Encode(&record); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if position == "" {
+			return count, nil
+		}
+	}
+}
+
+// ImportIssue is a record of a snapshot not imported
+type ImportIssue struct {
+	Line   int    `json:"line"`
+	Gid    string `json:"gid,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ImportSummary is the result of ImportSnapshot. Skipped are the trans whose gid exists, and Failed are the records
+// not valid or failed to save
+type ImportSummary struct {
+	Imported int           `json:"imported"`
+	Skipped  []ImportIssue `json:"skipped"`
+	Failed   []ImportIssue `json:"failed"`
+}
+
+// checkSnapshotRecord checks the record is an unfinished trans with its branches
+func checkSnapshotRecord(r *SnapshotRecord) error {
+	if r.SchemaVersion != SnapshotSchemaVersion {
+		return fmt.Errorf("schema version %d not supported, expecting %d", r.SchemaVersion, SnapshotSchemaVersion)
+	}
+	g := r.Global
+	if g == nil || g.Gid == "" || g.TransType == "" {
+		return errors.New("gid and trans type of the global should not be empty")
+	}
+	if g.Status != dtmcli.StatusPrepared && g.Status != dtmcli.StatusSubmitted && g.Status != dtmcli.StatusAborting {
+		return fmt.Errorf("status %s is not of an unfinished trans", g.Status)
+	}
+	if g.NextCronTime == nil {
+		return errors.New("next cron time should not be empty")
+	}
+	for _, b := range r.Branches {
+		if b.Gid != g.Gid || b.BranchID == "" || b.Op == "" || b.Status == "" {
+			return fmt.Errorf("branch %s %s is not valid", b.BranchID, b.Op)
+		}
+	}
+	return nil
+}
+
+// ImportSnapshot saves the trans of a snapshot written by ExportSnapshot to s by MaySaveNewTrans, with the gids,
+// statuses, branch results and next cron times kept. the ids of the rows and the owners locking the trans are cleared,
+// so they are processed by the dtm servers of s as usual. a bad line is reported without stopping the import, and
+// an error is returned only if r can not be read
+func ImportSnapshot(s Store, r io.Reader) (*ImportSummary, error) {
+	summary := &ImportSummary{Skipped: []ImportIssue{}, Failed: []ImportIssue{}}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return summary, err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			importSnapshotRecord(s, b, line, summary)
+		}
+		if err == io.EOF {
+			return summary, nil
+		}
+	}
+}
+
+func importSnapshotRecord(s Store, b []byte, line int, summary *ImportSummary) {
+	record := SnapshotRecord{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		summary.Failed = append(summary.Failed, ImportIssue{Line: line, Reason: err.Error()})
+		return
+	}
+	if err := checkSnapshotRecord(&record); err != nil {
+		gid := ""
+		if record.Global != nil {
+			gid = record.Global.Gid
+		}
+		summary.Failed = append(summary.Failed, ImportIssue{Line: line, Gid: gid, Reason: err.Error()})
+		return
+	}
+	g := record.Global
+	g.ID, g.Owner = 0, ""
+	for i := range record.Branches {
+		record.Branches[i].ID = 0
+	}
+	var err error
+	if perr := dtmimp.CatchP(func() { err = s.MaySaveNewTrans(g, record.Branches) }); perr != nil {
+		err = perr
+	}
+	if errors.Is(err, ErrUniqueConflict) {
+		summary.Skipped = append(summary.Skipped, ImportIssue{Line: line, Gid: g.Gid, Reason: err.Error()})
+	} else if err != nil {
+		summary.Failed = append(summary.Failed, ImportIssue{Line: line, Gid: g.Gid, Reason: err.Error()})
+	} else {
+		summary.Imported++
+	}
+}
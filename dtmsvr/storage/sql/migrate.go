@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/sqls"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// migration is a step of the schema of the sql store, applied by the embedded script sqls/dtmsvr.storage.<driver>.<name>.sql
+type migration struct {
+	version int
+	name    string // empty for the first step, which is sqls/dtmsvr.storage.<driver>.sql
+}
+
+// migrations are the ordered steps of the schema. the first step creates the latest schema, and the others add the
+// changes to the schema created by the earlier versions of dtm. every step is idempotent, so a db created by the first
+// step, or migrated before the schema version is recorded, can run all the steps
+var migrations = []migration{
+	{1, ""},
+	{2, "tenant"},
+	{3, "rollback_reason"},
+	{4, "payloads_hash"},
+	{5, "create_time"},
+	{6, "branch_attempt"},
+	{7, "priority"},
+	{8, "payload_dedup"},
+	{9, "global_version"},
+	{10, "event_log"},
+	{11, "branch_ext_data"},
+	{12, "kv"},
+	{13, "global_ext_data"},
+	{14, "event_counter"},
+}
+
+func (m migration) script(driver string) string {
+	if m.name == "" {
+		return fmt.Sprintf("dtmsvr.storage.%s.sql", driver)
+	}
+	return fmt.Sprintf("dtmsvr.storage.%s.%s.sql", driver, m.name)
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%d sqls/%s", m.version, m.script(conf.Store.Driver))
+}
+
+// statements returns the statements of the script. the drop statements are returned if drop is true, or skipped
+func (m migration) statements(driver string, drop bool) ([]string, error) {
+	content, err := sqls.Storage.ReadFile(m.script(driver))
+	if err != nil {
+		return nil, err
+	}
+	stmts := []string{}
+	for _, s := range strings.Split(string(content), ";") {
+		s = strings.TrimSpace(s)
+		if s != "" && strings.HasPrefix(strings.ToLower(s), "drop") == drop {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts, nil
+}
+
+// the key of the advisory lock guarding the migrations, so that the instances starting concurrently migrate one by one
+const (
+	migrationLockName = "dtm_schema_migration"
+	migrationLockKey  = 0x64746d // "dtm"
+)
+
+// migrator applies the migrations by a dedicated connection, which holds the advisory lock
+type migrator struct {
+	driver string
+	conn   *sql.Conn
+}
+
+func (m *migrator) exec(query string, args ...interface{}) error {
+	for i := range args { // the placeholders of the statements with args are ?, which are $n for postgres
+		if m.driver == dtmcli.DBTypePostgres {
+			query = strings.Replace(query, "?", fmt.Sprintf("$%d", i+1), 1)
+		}
+	}
+	_, err := m.conn.ExecContext(context.Background(), query, args...)
+	return err
+}
+
+func (m *migrator) lock() error {
+	if m.driver == dtmcli.DBTypePostgres {
+		return m.exec("select pg_advisory_lock(?)", migrationLockKey)
+	}
+	locked := 0
+	err := m.conn.QueryRowContext(context.Background(), "select get_lock(?, 600)", migrationLockName).Scan(&locked)
+	if err == nil && locked != 1 {
+		err = fmt.Errorf("timeout waiting for the lock of migrations")
+	}
+	return err
+}
+
+func (m *migrator) unlock() {
+	var err error
+	if m.driver == dtmcli.DBTypePostgres {
+		err = m.exec("select pg_advisory_unlock(?)", migrationLockKey)
+	} else {
+		err = m.exec("select release_lock(?)", migrationLockName)
+	}
+	if err != nil {
+		logger.Errorf("releasing the lock of migrations failed: %v", err)
+	}
+}
+
+func (m *migrator) tableExists(table string) bool {
+	rows, err := m.conn.QueryContext(context.Background(), fmt.Sprintf("select 1 from %s where 1=0", table))
+	if err == nil {
+		_ = rows.Close()
+	}
+	return err == nil
+}
+
+// appliedVersions returns the applied versions. the schema created before the versions are recorded is of version 1
+func (m *migrator) appliedVersions() (map[int]bool, error) {
+	applied := map[int]bool{}
+	if !m.tableExists(conf.Store.SchemaVersionTable) {
+		if m.tableExists(conf.Store.TransGlobalTable) {
+			applied[1] = true
+		}
+		return applied, nil
+	}
+	rows, err := m.conn.QueryContext(context.Background(), fmt.Sprintf("select version from %s", conf.Store.SchemaVersionTable))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		version := 0
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// createVersionTable creates the table of the schema versions, and its schema
+func (m *migrator) createVersionTable() error {
+	table := conf.Store.SchemaVersionTable
+	if i := strings.Index(table, "."); i > 0 {
+		create := dtmimp.If(m.driver == dtmcli.DBTypePostgres, "CREATE SCHEMA IF NOT EXISTS ", "CREATE DATABASE IF NOT EXISTS ").(string)
+		if err := m.exec(create + table[:i]); err != nil {
+			return err
+		}
+	}
+	timeType := dtmimp.If(m.driver == dtmcli.DBTypePostgres, "timestamp(0) with time zone", "datetime").(string)
+	return m.exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version int NOT NULL, name varchar(128) NOT NULL, apply_time %s DEFAULT NULL, PRIMARY KEY (version))", table, timeType))
+}
+
+// apply runs the statements of the migration, ignoring the errors of the objects already existing, and records it
+func (m *migrator) apply(mg migration) error {
+	stmts, err := mg.statements(m.driver, false)
+	if err != nil {
+		return err
+	}
+	for _, s := range stmts {
+		if err := m.exec(s); err != nil && !alreadyExists(err) {
+			return fmt.Errorf("migration %s failed: %w", mg, err)
+		}
+	}
+	if err := m.createVersionTable(); err != nil {
+		return err
+	}
+	return m.exec(fmt.Sprintf("INSERT INTO %s (version, name, apply_time) VALUES (?, ?, ?)", conf.Store.SchemaVersionTable),
+		mg.version, dtmimp.OrString(mg.name, "init"), time.Now())
+}
+
+// alreadyExists checks the error is caused by an object already existing, such as adding a column again
+func alreadyExists(err error) bool {
+	var merr *mysqlDriver.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number == 1050 || merr.Number == 1060 || merr.Number == 1061 // table, column, index exists
+	}
+	var perr *pq.Error
+	if errors.As(err, &perr) {
+		return perr.Code == "42P07" || perr.Code == "42701" || perr.Code == "42710" // relation, column, object exists
+	}
+	return false
+}
+
+// pendingMigrations returns the migrations not applied
+func pendingMigrations(applied map[int]bool) []migration {
+	pending := []migration{}
+	for _, mg := range migrations {
+		if !applied[mg.version] {
+			pending = append(pending, mg)
+		}
+	}
+	return pending
+}
+
+// Migrate checks the schema of the sql store, and applies the pending migrations if auto is true, or returns an error
+// listing them. the migrations are guarded by an advisory lock, so that the instances starting concurrently are safe
+func Migrate(auto bool) error {
+	db, err := dtmimp.StandaloneDB(conf.Store.GetDBConf())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	m := &migrator{driver: conf.Store.Driver, conn: conn}
+	if err := m.lock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return err
+	}
+	pending := pendingMigrations(applied)
+	if len(pending) > 0 && !auto {
+		missing := []string{}
+		for _, mg := range pending {
+			missing = append(missing, mg.String())
+		}
+		return fmt.Errorf("the schema of the sql store is not up to date, missing migrations: %s. apply them, or set Store.AutoMigrate to true",
+			strings.Join(missing, ", "))
+	}
+	for _, mg := range pending {
+		if err := m.apply(mg); err != nil {
+			return err
+		}
+		logger.Infof("migration %s applied", mg)
+	}
+	return nil
+}
+
+// dropSchema drops the tables of the sql store, so that the schema is migrated from zero
+func dropSchema() error {
+	db, err := dtmimp.StandaloneDB(conf.Store.GetDBConf())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+	stmts, err := migrations[0].statements(conf.Store.Driver, true)
+	if err != nil {
+		return err
+	}
+	stmts = append(stmts, fmt.Sprintf("drop table IF EXISTS %s", conf.Store.SchemaVersionTable))
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
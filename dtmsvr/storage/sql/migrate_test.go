@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/sqls"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	entries, err := sqls.Storage.ReadDir(".")
+	assert.Nil(t, err)
+	names := map[string]bool{}
+	for _, e := range entries {
+		if m := regexp.MustCompile(`^dtmsvr\.storage\.mysql\.(\w+)\.sql$`).FindStringSubmatch(e.Name()); m != nil {
+			names[m[1]] = true
+		}
+	}
+	for i, mg := range migrations {
+		assert.Equal(t, i+1, mg.version)
+		delete(names, mg.name)
+		for _, driver := range []string{"mysql", "postgres"} {
+			stmts, err := mg.statements(driver, false)
+			assert.Nil(t, err, mg.script(driver))
+			assert.NotEmpty(t, stmts)
+			for _, s := range stmts {
+				assert.NotRegexp(t, "(?i)^drop", s)
+			}
+		}
+	}
+	assert.Empty(t, names, "every migration script should be a step of migrations")
+
+	drops, err := migrations[0].statements("mysql", true)
+	assert.Nil(t, err)
+	assert.Contains(t, drops, "drop table IF EXISTS dtm.trans_global")
+}
+
+func TestPendingMigrations(t *testing.T) {
+	assert.Equal(t, migrations, pendingMigrations(map[int]bool{}))
+	pending := pendingMigrations(map[int]bool{1: true, 2: true})
+	assert.Equal(t, 3, pending[0].version)
+	assert.Equal(t, len(migrations)-2, len(pending))
+	all := map[int]bool{}
+	for _, mg := range migrations {
+		all[mg.version] = true
+	}
+	assert.Empty(t, pendingMigrations(all))
+}
+
+func TestAlreadyExists(t *testing.T) {
+	assert.True(t, alreadyExists(fmt.Errorf("wrapped: %w", &mysqlDriver.MySQLError{Number: 1060})))
+	assert.False(t, alreadyExists(&mysqlDriver.MySQLError{Number: 1146}))
+	assert.True(t, alreadyExists(&pq.Error{Code: "42701"}))
+	assert.False(t, alreadyExists(&pq.Error{Code: "42P01"}))
+	assert.False(t, alreadyExists(errors.New("42701")))
+}
+
+// schemaModel is the columns and the indexes of the tables created by the statements, like "ext_data" and "key tenant_id"
+type schemaModel map[string]map[string]bool
+
+var (
+	createTableRe = regexp.MustCompile(`(?is)^create table (?:if not exists )?([\w.]+) \((.*)\)[^)]*$`)
+	tableKeyRe    = regexp.MustCompile("(?i)^(?:unique )?(?:key|index) `?(\\w+)`?")
+	constraintRe  = regexp.MustCompile(`(?i)^constraint (\w+) unique`)
+	alterTableRe  = regexp.MustCompile("(?i)^alter table ([\\w.]+) add (column|key|index) (?:if not exists )?`?(\\w+)`?")
+	createIndexRe = regexp.MustCompile(`(?i)^create (?:unique )?index (?:if not exists )?(\w+) on ([\w.]+)`)
+)
+
+func (sm schemaModel) apply(t *testing.T, stmt string) {
+	lines := []string{}
+	for _, line := range strings.Split(stmt, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	stmt = strings.TrimSpace(strings.Join(lines, "\n"))
+	if m := createTableRe.FindStringSubmatch(stmt); m != nil {
+		if sm[m[1]] != nil { // if not exists
+			return
+		}
+		sm[m[1]] = map[string]bool{}
+		for _, def := range strings.Split(m[2], "\n") {
+			def = strings.TrimSuffix(def, ",")
+			if km := tableKeyRe.FindStringSubmatch(def); km != nil {
+				sm[m[1]]["key "+km[1]] = true
+			} else if cm := constraintRe.FindStringSubmatch(def); cm != nil {
+				sm[m[1]]["key "+cm[1]] = true
+			} else if def != "" && !regexp.MustCompile(`(?i)^primary key`).MatchString(def) {
+				sm[m[1]][strings.Trim(strings.Fields(def)[0], "`")] = true
+			}
+		}
+	} else if m := alterTableRe.FindStringSubmatch(stmt); m != nil {
+		assert.NotNil(t, sm[m[1]], "altering the table not existing: %s", stmt)
+		sm[m[1]][dtmimp.If(strings.EqualFold(m[2], "column"), "", "key ").(string)+m[3]] = true
+	} else if m := createIndexRe.FindStringSubmatch(stmt); m != nil {
+		assert.NotNil(t, sm[m[2]], "indexing the table not existing: %s", stmt)
+		sm[m[2]]["key "+m[1]] = true
+	} else {
+		assert.NotRegexp(t, "(?i)^(create table|alter|create index)", stmt, "statement not modeled")
+	}
+}
+
+// TestMigrateBaseline checks the migrations upgrade the schema created by the first release of dtm, which is not
+// versioned, so it is stamped as version 1, to the schema created from zero
+func TestMigrateBaseline(t *testing.T) {
+	for _, driver := range []string{"mysql", "postgres", "tdsql"} {
+		baseline, err := ioutil.ReadFile(fmt.Sprintf("testdata/dtmsvr.storage.%s.baseline.sql", driver))
+		assert.Nil(t, err)
+		migrated := schemaModel{}
+		for _, s := range strings.Split(string(baseline), ";") {
+			migrated.apply(t, strings.TrimSpace(s))
+		}
+		for _, mg := range migrations[1:] {
+			stmts, err := mg.statements(driver, false)
+			assert.Nil(t, err, mg.script(driver))
+			for _, s := range stmts {
+				migrated.apply(t, s)
+			}
+		}
+		head := schemaModel{}
+		stmts, err := migrations[0].statements(driver, false)
+		assert.Nil(t, err)
+		for _, s := range stmts {
+			head.apply(t, s)
+		}
+		assert.NotEmpty(t, head["dtm.kv"], driver)
+		assert.Equal(t, head, migrated, driver)
+	}
+
+	// tdsql is the sharded mysql, with the same columns
+	mysql, tdsql := schemaModel{}, schemaModel{}
+	for driver, model := range map[string]schemaModel{"mysql": mysql, "tdsql": tdsql} {
+		stmts, err := migrations[0].statements(driver, false)
+		assert.Nil(t, err)
+		for _, s := range stmts {
+			model.apply(t, s)
+		}
+	}
+	for table, columns := range mysql {
+		for c := range columns {
+			assert.True(t, tdsql[table][c], "%s.%s missing in tdsql", table, c)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"gorm.io/gorm/clause"
+)
+
+// payloadStore is a payload saved once for the branches of a trans carrying it, see Store.DedupPayloadSize.
+// the branches keep the key of the payload instead of the payload
+type payloadStore struct {
+	dtmutil.ModelBase
+	Gid        string
+	PayloadKey string // the sha256 of the data in hex, with a suffix -N for the Nth data colliding with the hash
+	Data       []byte
+}
+
+// TableName TableName
+func (p *payloadStore) TableName() string {
+	return conf.Store.TransPayloadTable
+}
+
+// payloadHash returns the hash of a payload. replaced in tests to make collisions
+var payloadHash = func(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// assignPayloadKeys moves the payloads of the branches at positions out of the branches, leaving the keys of the
+// payloads. the payloads of the same hash are compared by bytes, so a payload colliding with another gets a new key.
+// the payloads not in existing are returned as created, and the keys of the existing ones used are returned as reused
+func assignPayloadKeys(existing []payloadStore, branches []storage.TransBranchStore, positions []int) (created []payloadStore, reused []string) {
+	byHash := map[string][]payloadStore{}
+	for _, p := range existing {
+		hash := strings.SplitN(p.PayloadKey, "-", 2)[0]
+		byHash[hash] = append(byHash[hash], p)
+	}
+	isReused := map[string]bool{}
+	for _, i := range positions {
+		b := &branches[i]
+		hash := payloadHash(b.BinData)
+		var found *payloadStore
+		for j := range byHash[hash] {
+			if bytes.Equal(byHash[hash][j].Data, b.BinData) {
+				found = &byHash[hash][j]
+				break
+			}
+		}
+		if found == nil {
+			p := payloadStore{Gid: b.Gid, PayloadKey: hash, Data: b.BinData}
+			for n := 1; keyTaken(byHash[hash], p.PayloadKey); n++ {
+				p.PayloadKey = fmt.Sprintf("%s-%d", hash, n)
+			}
+			created = append(created, p)
+			byHash[hash] = append(byHash[hash], p)
+			found = &p
+		} else if found.ID != 0 && !isReused[found.PayloadKey] {
+			isReused[found.PayloadKey] = true
+			reused = append(reused, found.PayloadKey)
+		}
+		b.PayloadKey = found.PayloadKey
+		b.BinData = nil
+	}
+	return
+}
+
+func keyTaken(payloads []payloadStore, key string) bool {
+	for _, p := range payloads {
+		if p.PayloadKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// savePayloads saves the payloads of the branches not smaller than Store.DedupPayloadSize to the payload table, where
+// the identical payloads of a trans are saved once. the branches returned are copies carrying the keys of the payloads
+// instead, so the branches passed in are not changed
+func savePayloads(db *dtmutil.DB, branches []storage.TransBranchStore) []storage.TransBranchStore {
+	if conf.Store.DedupPayloadSize <= 0 {
+		return branches
+	}
+	positions := map[string][]int{}
+	gids := []string{}
+	for i, b := range branches {
+		if b.BinData != nil && int64(len(b.BinData)) >= conf.Store.DedupPayloadSize {
+			if positions[b.Gid] == nil {
+				gids = append(gids, b.Gid)
+			}
+			positions[b.Gid] = append(positions[b.Gid], i)
+		}
+	}
+	if len(gids) == 0 {
+		return branches
+	}
+	rows := append([]storage.TransBranchStore{}, branches...)
+	sort.Strings(gids) // the payloads of the trans are locked in the same order
+	for _, gid := range gids {
+		existing := []payloadStore{}
+		// locked, so that the payloads reused are not purged before the branches referencing them are saved
+		db.Must().Clauses(clause.Locking{Strength: "UPDATE"}).Where("gid=?", gid).Order("id asc").Find(&existing)
+		created, reused := assignPayloadKeys(existing, rows, positions[gid])
+		if len(created) > 0 {
+			db.Must().CreateInBatches(created, insertBatchSize)
+		}
+		if len(reused) > 0 {
+			db.Must().Model(&payloadStore{}).Where("gid=? and payload_key in ?", gid, reused).Update("update_time", dtmutil.GetNextTime(0))
+		}
+	}
+	return rows
+}
+
+// copyBranchIDs copies the ids filled by inserting the rows back to the branches
+func copyBranchIDs(branches []storage.TransBranchStore, rows []storage.TransBranchStore) {
+	for i := range branches {
+		branches[i].ID = rows[i].ID
+	}
+}
+
+type payloadID struct {
+	gid string
+	key string
+}
+
+// fillPayloads fills the payloads of the branches by the keys of the payloads. the legacy branches, which carry the
+// payloads inline, are not changed
+func fillPayloads(branches []storage.TransBranchStore, payloads []payloadStore) error {
+	data := map[payloadID][]byte{}
+	for _, p := range payloads {
+		data[payloadID{p.Gid, p.PayloadKey}] = p.Data
+	}
+	for i := range branches {
+		b := &branches[i]
+		if b.PayloadKey == "" {
+			continue
+		}
+		d, ok := data[payloadID{b.Gid, b.PayloadKey}]
+		if !ok {
+			return fmt.Errorf("payload %s of branch %s %s of trans %s not found", b.PayloadKey, b.BranchID, b.Op, b.Gid)
+		}
+		b.BinData = d
+	}
+	return nil
+}
+
+// loadPayloads loads the payloads of the branches saved to the payload table
+func loadPayloads(db *dtmutil.DB, branches []storage.TransBranchStore) {
+	keys := map[string][]string{}
+	gids := []string{}
+	seen := map[payloadID]bool{}
+	for _, b := range branches {
+		if b.PayloadKey == "" || seen[payloadID{b.Gid, b.PayloadKey}] {
+			continue
+		}
+		seen[payloadID{b.Gid, b.PayloadKey}] = true
+		if keys[b.Gid] == nil {
+			gids = append(gids, b.Gid)
+		}
+		keys[b.Gid] = append(keys[b.Gid], b.PayloadKey)
+	}
+	payloads := []payloadStore{}
+	for _, gid := range gids {
+		ps := []payloadStore{}
+		db.Must().Where("gid=? and payload_key in ?", gid, keys[gid]).Find(&ps)
+		payloads = append(payloads, ps...)
+	}
+	dtmimp.E2P(fillPayloads(branches, payloads))
+}
+
+// PurgePayloads deletes the payloads not referenced by any branch, and not used since the time
+func (s *Store) PurgePayloads(before time.Time) (int64, error) {
+	payloads := conf.Store.TransPayloadTable
+	dbr := dbGet().WithOp("PurgePayloads", "").Exec(fmt.Sprintf("delete from %s where update_time<? and not exists "+
+		"(select 1 from %s b where b.gid=%s.gid and b.payload_key=%s.payload_key)", payloads, conf.Store.TransBranchOpTable, payloads, payloads), before)
+	return dbr.RowsAffected, dbr.Error
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func payloadBranches(payloads ...string) []storage.TransBranchStore {
+	branches := []storage.TransBranchStore{}
+	for _, p := range payloads {
+		branches = append(branches, storage.TransBranchStore{Gid: "gid1", BranchID: "01", Op: "action", BinData: []byte(p)})
+	}
+	return branches
+}
+
+func TestAssignPayloadKeys(t *testing.T) {
+	branches := payloadBranches("a", "b", "a")
+	created, reused := assignPayloadKeys(nil, branches, []int{0, 1, 2})
+	assert.Len(t, created, 2)
+	assert.Empty(t, reused)
+	assert.Equal(t, payloadHash([]byte("a")), branches[0].PayloadKey)
+	assert.Equal(t, branches[0].PayloadKey, branches[2].PayloadKey)
+	assert.NotEqual(t, branches[0].PayloadKey, branches[1].PayloadKey)
+	assert.Nil(t, branches[0].BinData)
+
+	existing := created
+	existing[0].ID, existing[1].ID = 1, 2
+	branches = payloadBranches("b", "c", "b")
+	created, reused = assignPayloadKeys(existing, branches, []int{0, 1, 2})
+	assert.Len(t, created, 1)
+	assert.Equal(t, []string{existing[1].PayloadKey}, reused)
+}
+
+func TestAssignPayloadKeysCollision(t *testing.T) {
+	old := payloadHash
+	payloadHash = func(data []byte) string { return "h" }
+	defer func() { payloadHash = old }()
+
+	branches := payloadBranches("a", "b", "a", "c")
+	created, _ := assignPayloadKeys(nil, branches, []int{0, 1, 2, 3})
+	assert.Len(t, created, 3) // the same hash, but not the same bytes
+	assert.Equal(t, "h", branches[0].PayloadKey)
+	assert.Equal(t, "h-1", branches[1].PayloadKey)
+	assert.Equal(t, "h", branches[2].PayloadKey)
+	assert.Equal(t, "h-2", branches[3].PayloadKey)
+
+	// h-1 is purged, so the suffix is reused, but not a suffix taken
+	existing := []payloadStore{created[0], created[2]}
+	existing[0].ID, existing[1].ID = 1, 3
+	branches = payloadBranches("d", "c")
+	created, reused := assignPayloadKeys(existing, branches, []int{0, 1})
+	assert.Equal(t, "h-1", branches[0].PayloadKey)
+	assert.Equal(t, "h-2", branches[1].PayloadKey)
+	assert.Len(t, created, 1)
+	assert.Equal(t, []string{"h-2"}, reused)
+}
+
+func TestFillPayloadsMixed(t *testing.T) {
+	branches := payloadBranches("legacy", "deduplicated", "deduplicated", "small")
+	_, _ = assignPayloadKeys(nil, branches, []int{1, 2})
+	branches[0].PayloadKey = "" // a branch saved before the migration keeps its payload inline
+	payloads := []payloadStore{{Gid: "gid1", PayloadKey: payloadHash([]byte("deduplicated")), Data: []byte("deduplicated")}}
+
+	assert.Nil(t, fillPayloads(branches, payloads))
+	for i, p := range []string{"legacy", "deduplicated", "deduplicated", "small"} {
+		assert.Equal(t, p, string(branches[i].BinData))
+	}
+
+	branches[1].Gid = "gid2" // the payloads of other trans are not used
+	assert.Error(t, fillPayloads(branches, payloads))
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+var (
+	poolInUse = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_db_pool_in_use",
+		Help: "The number of connections in use of the db pool",
+	}, []string{"target"})
+
+	poolIdle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_db_pool_idle",
+		Help: "The number of idle connections of the db pool",
+	}, []string{"target"})
+
+	poolMaxOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_db_pool_max_open_connections",
+		Help: "The max open connections of the db pool",
+	}, []string{"target"})
+
+	poolWaitCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_db_pool_wait_count",
+		Help: "The total number of connections waited for of the db pool",
+	}, []string{"target"})
+
+	poolWaitDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtm_db_pool_wait_duration_seconds",
+		Help: "The total time blocked waiting for a new connection of the db pool",
+	}, []string{"target"})
+
+	statementDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "dtm_db_statement_duration_seconds",
+		Help: "The durations of the statements of the store, including the retries",
+	}, []string{"op", "result"})
+
+	statementRetryTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtm_db_statement_retry_total",
+		Help: "All retries of the statements of the store failed with transient errors",
+	}, []string{"op"})
+)
+
+// PoolStat is the statistics of a db pool, for health check
+type PoolStat struct {
+	Target             string `json:"target"`
+	MaxOpenConnections int    `json:"max_open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDurationMs     int64  `json:"wait_duration_ms"`
+}
+
+var pools sync.Map // target -> *sql.DB
+
+// poolTarget returns the label of the db pool of conf, without the password
+func poolTarget(conf dtmcli.DBConf) string {
+	return fmt.Sprintf("%s://%s@%s:%d", conf.Driver, conf.User, conf.Host, conf.Port)
+}
+
+// watchPool returns a func to register the pool of the target, and to export its statistics periodically
+func watchPool(target string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		sqldb, err := db.DB()
+		if err != nil {
+			return
+		}
+		if _, loaded := pools.LoadOrStore(target, sqldb); !loaded && conf.Store.PoolStatsInterval > 0 {
+			go func() {
+				last := sqldb.Stats()
+				for {
+					time.Sleep(time.Duration(conf.Store.PoolStatsInterval) * time.Second)
+					last = checkPool(target, sqldb.Stats(), last)
+				}
+			}()
+		}
+	}
+}
+
+// checkPool exports the statistics, and warns if the time waiting for connections grows too fast since last check
+func checkPool(target string, stats sql.DBStats, last sql.DBStats) sql.DBStats {
+	poolInUse.WithLabelValues(target).Set(float64(stats.InUse))
+	poolIdle.WithLabelValues(target).Set(float64(stats.Idle))
+	poolMaxOpen.WithLabelValues(target).Set(float64(stats.MaxOpenConnections))
+	poolWaitCount.WithLabelValues(target).Set(float64(stats.WaitCount))
+	poolWaitDuration.WithLabelValues(target).Set(stats.WaitDuration.Seconds())
+	waited := stats.WaitDuration - last.WaitDuration
+	if conf.Store.PoolWaitThreshold > 0 && waited > time.Duration(conf.Store.PoolWaitThreshold)*time.Millisecond {
+		logger.Warnf("db pool %s waited %v for connections in %d waits since last check, %d/%d connections in use. "+
+			"increase Store.MaxOpenConns if the db allows, or reduce the concurrency of cron workers",
+			target, waited, stats.WaitCount-last.WaitCount, stats.InUse, stats.MaxOpenConnections)
+	}
+	return stats
+}
+
+// PoolStats returns the statistics of the db pools, sorted by target
+func PoolStats() []PoolStat {
+	stats := []PoolStat{}
+	pools.Range(func(k, v interface{}) bool {
+		s := v.(*sql.DB).Stats()
+		stats = append(stats, PoolStat{
+			Target:             k.(string),
+			MaxOpenConnections: s.MaxOpenConnections,
+			InUse:              s.InUse,
+			Idle:               s.Idle,
+			WaitCount:          s.WaitCount,
+			WaitDurationMs:     s.WaitDuration.Milliseconds(),
+		})
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Target < stats[j].Target })
+	return stats
+}
+
+// statementHooks retries the statements failed with transient errors, and exports the durations of the statements
+func statementHooks() func(*gorm.DB) {
+	return dtmutil.UseStatementHooks(conf.Store.Driver, dtmutil.StatementHooks{
+		Retries: int(conf.Store.StatementRetries),
+		OnRetry: func(ctx context.Context, err error, attempt int) {
+			op, _ := dtmutil.GetDBOp(ctx)
+			statementRetryTotal.WithLabelValues(op).Inc()
+		},
+		OnStatement: func(st *dtmutil.DBStatement) {
+			statementDuration.WithLabelValues(st.Op, dtmimp.If(st.Err == nil, "ok", "error").(string)).Observe(st.Duration.Seconds())
+		},
+	})
+}
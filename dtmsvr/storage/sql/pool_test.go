@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestCheckPool(t *testing.T) {
+	conf.Store.PoolWaitThreshold = 1000
+	last := sql.DBStats{WaitCount: 10, WaitDuration: time.Second}
+	stats := sql.DBStats{MaxOpenConnections: 5, InUse: 5, WaitCount: 30, WaitDuration: 3 * time.Second}
+	assert.Equal(t, stats, checkPool("TestCheckPool", stats, last))
+}
+
+func TestPoolStats(t *testing.T) {
+	dbConf := dtmcli.DBConf{Driver: "mysql", Host: "127.0.0.1", Port: 3306, User: "root", Password: "secret"}
+	target := poolTarget(dbConf)
+	assert.Equal(t, "mysql://root@127.0.0.1:3306", target)
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "root:secret@tcp(127.0.0.1:3306)/", SkipInitializeWithVersion: true}), &gorm.Config{DisableAutomaticPing: true})
+	assert.Nil(t, err)
+	sqldb, _ := db.DB()
+	sqldb.SetMaxOpenConns(7)
+	watchPool(target)(db)
+	found := false
+	for _, s := range PoolStats() {
+		if s.Target == target {
+			found = true
+			assert.Equal(t, 7, s.MaxOpenConnections)
+		}
+	}
+	assert.True(t, found)
+}
@@ -7,11 +7,14 @@
 package sql
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"time"
 
+	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
 	"github.com/dtm-labs/dtm/dtmsvr/config"
 	"github.com/dtm-labs/dtm/dtmsvr/storage"
 	"github.com/dtm-labs/dtm/dtmutil"
@@ -34,16 +37,31 @@ func (s *Store) Ping() error {
 	return err
 }
 
-// PopulateData populates data to db
+// Now returns the now of the db in unix seconds, so it is free of the time zones of the db and the connection
+func (s *Store) Now() (time.Time, error) {
+	query := "select unix_timestamp(now(6))"
+	if conf.Store.Driver == config.Postgres {
+		query = "select extract(epoch from current_timestamp)"
+	}
+	var seconds float64
+	if err := dbGet().Raw(query).Row().Scan(&seconds); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), nil
+}
+
+// PopulateData populates data to db, by migrating the schema from zero. the tables are dropped first unless skipDrop
 func (s *Store) PopulateData(skipDrop bool) {
-	file := fmt.Sprintf("%s/dtmsvr.storage.%s.sql", dtmutil.GetSQLDir(), conf.Store.Driver)
-	dtmutil.RunSQLScript(conf.Store.GetDBConf(), file, skipDrop)
+	if !skipDrop {
+		logger.FatalIfError(dropSchema())
+	}
+	logger.FatalIfError(Migrate(true))
 }
 
 // FindTransGlobalStore finds GlobalTrans data by gid
 func (s *Store) FindTransGlobalStore(gid string) *storage.TransGlobalStore {
 	trans := &storage.TransGlobalStore{}
-	dbr := dbGet().Model(trans).Where("gid=?", gid).First(trans)
+	dbr := dbGet().WithOp("FindTransGlobalStore", gid).Model(trans).Where("gid=?", gid).First(trans)
 	if dbr.Error == gorm.ErrRecordNotFound {
 		return nil
 	}
@@ -52,13 +70,17 @@ func (s *Store) FindTransGlobalStore(gid string) *storage.TransGlobalStore {
 }
 
 // ScanTransGlobalStores lists GlobalTrans data
-func (s *Store) ScanTransGlobalStores(position *string, limit int64) []storage.TransGlobalStore {
+func (s *Store) ScanTransGlobalStores(position *string, limit int64, condition storage.TransGlobalScanCondition) []storage.TransGlobalStore {
 	globals := []storage.TransGlobalStore{}
 	lid := math.MaxInt64
 	if *position != "" {
 		lid = dtmimp.MustAtoi(*position)
 	}
-	dbr := dbGet().Must().Where("id < ?", lid).Order("id desc").Limit(int(limit)).Find(&globals)
+	db := dbGet().Must().Where("id < ?", lid)
+	if condition.Tenant != "" {
+		db = db.Where("tenant = ?", condition.Tenant)
+	}
+	dbr := db.Order("id desc").Limit(int(limit)).Find(&globals)
 	if dbr.RowsAffected < limit {
 		*position = ""
 	} else {
@@ -70,10 +92,37 @@ func (s *Store) ScanTransGlobalStores(position *string, limit int64) []storage.T
 // FindBranches finds Branch data by gid
 func (s *Store) FindBranches(gid string) []storage.TransBranchStore {
 	branches := []storage.TransBranchStore{}
-	dbGet().Must().Where("gid=?", gid).Order("id asc").Find(&branches)
+	dbGet().WithOp("FindBranches", gid).Must().Where("gid=?", gid).Order("id asc").Find(&branches)
+	loadPayloads(dbGet().WithOp("FindBranches", gid), branches)
+	return branches
+}
+
+// FindBranchesPage finds a page of Branch data by gid
+func (s *Store) FindBranchesPage(gid string, afterBranchID string, limit int) []storage.TransBranchStore {
+	branches := []storage.TransBranchStore{}
+	db := dbGet().Must().Where("gid=?", gid)
+	if afterBranchID != "" {
+		db = db.Where(fmt.Sprintf("id > (select max(id) from %s where gid=? and branch_id=?)", conf.Store.TransBranchOpTable), gid, afterBranchID)
+	}
+	db.Order("id asc").Limit(limit).Find(&branches)
+	if len(branches) == limit { // the branches of the last branch id are not split
+		last := branches[len(branches)-1]
+		rest := []storage.TransBranchStore{}
+		dbGet().Must().Where("gid=? and branch_id=? and id>?", gid, last.BranchID, last.ID).Order("id asc").Find(&rest)
+		branches = append(branches, rest...)
+	}
+	loadPayloads(dbGet(), branches)
 	return branches
 }
 
+// FindBranch finds a branch by the unique key of gid, branch_id and op
+func (s *Store) FindBranch(gid string, branchID string, op string) *storage.TransBranchStore {
+	branches := []storage.TransBranchStore{}
+	dbGet().WithOp("FindBranch", gid).Must().Where("gid=? and branch_id=? and op=?", gid, branchID, op).Limit(1).Find(&branches)
+	loadPayloads(dbGet().WithOp("FindBranch", gid), branches)
+	return storage.FindBranch(branches, branchID, op)
+}
+
 // UpdateBranches update branches info
 func (s *Store) UpdateBranches(branches []storage.TransBranchStore, updates []string) (int, error) {
 	db := dbGet().Clauses(clause.OnConflict{
@@ -83,22 +132,59 @@ func (s *Store) UpdateBranches(branches []storage.TransBranchStore, updates []st
 	return int(db.RowsAffected), db.Error
 }
 
-// LockGlobalSaveBranches creates branches
-func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) {
-	err := dbGet().Transaction(func(tx *gorm.DB) error {
+// LockGlobalSaveBranches saves branches. the branches are matched with the saved ones by branch_id and op, because
+// the branches of sql are not positional
+func (s *Store) LockGlobalSaveBranches(gid string, status string, branches []storage.TransBranchStore, branchStart int) []bool {
+	saved := make([]bool, len(branches))
+	err := dbGet().WithOp("LockGlobalSaveBranches", gid).Transaction(func(tx *gorm.DB) error {
 		g := &storage.TransGlobalStore{}
 		dbr := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Model(g).Where("gid=? and status=?", gid, status).First(g)
-		if dbr.Error == nil {
-			dbr = tx.Save(branches)
+		if dbr.Error != nil {
+			return wrapError(dbr.Error)
+		}
+		db := &dtmutil.DB{DB: tx}
+		branchIDs := []string{}
+		for _, b := range branches {
+			branchIDs = append(branchIDs, b.BranchID)
 		}
-		return wrapError(dbr.Error)
+		existing := []storage.TransBranchStore{}
+		db.Must().Where("gid=? and branch_id in ?", gid, branchIDs).Find(&existing)
+		inserts := []int{}
+		for i := range branches {
+			b := &branches[i]
+			old := storage.FindBranch(existing, b.BranchID, b.Op)
+			if old == nil {
+				inserts = append(inserts, i)
+			} else if branchStart != -1 && !storage.IsBranchDowngrade(old, b) {
+				b.ID = old.ID // the payload of a branch is not changed, and create_time is kept
+				db.Must().Model(&storage.TransBranchStore{}).Select("*").Omit("id", "create_time", "bin_data", "payload_key").
+					Where("id=?", old.ID).Updates(b)
+			} else {
+				b.ID = old.ID
+				continue
+			}
+			saved[i] = true
+		}
+		if len(inserts) > 0 {
+			news := []storage.TransBranchStore{}
+			for _, i := range inserts {
+				news = append(news, branches[i])
+			}
+			rows := savePayloads(db, news)
+			db.Must().Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+			for j, i := range inserts {
+				branches[i].ID = rows[j].ID
+			}
+		}
+		return nil
 	})
 	dtmimp.E2P(err)
+	return saved
 }
 
 // MaySaveNewTrans creates a new trans
 func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []storage.TransBranchStore) error {
-	return dbGet().Transaction(func(db1 *gorm.DB) error {
+	err := dbGet().WithOp("MaySaveNewTrans", global.Gid).Transaction(func(db1 *gorm.DB) error {
 		db := &dtmutil.DB{DB: db1}
 		dbr := db.Must().Clauses(clause.OnConflict{
 			DoNothing: true,
@@ -107,22 +193,112 @@ func (s *Store) MaySaveNewTrans(global *storage.TransGlobalStore, branches []sto
 			return storage.ErrUniqueConflict
 		}
 		if len(branches) > 0 {
+			rows := savePayloads(db, branches)
 			db.Must().Clauses(clause.OnConflict{
 				DoNothing: true,
-			}).Create(&branches)
+			}).Create(&rows)
+			copyBranchIDs(branches, rows)
+		}
+		return nil
+	})
+	if err == storage.ErrUniqueConflict {
+		return storage.DuplicateTrans(global, s.FindTransGlobalStore(global.Gid))
+	}
+	return err
+}
+
+// the rows of a multi-row insert
+const insertBatchSize = 500
+
+var errBatchConflict = errors.New("some trans of the batch are inserted concurrently")
+
+// MaySaveNewTransBatch creates the new trans in one db transaction, with the globals and the branches inserted by multi-row inserts
+func (s *Store) MaySaveNewTransBatch(trans []storage.NewTrans) []error {
+	errs := make([]error, len(trans))
+	gids := make([]string, len(trans))
+	for i, t := range trans {
+		gids[i] = t.Global.Gid
+	}
+	err := dbGet().Transaction(func(db1 *gorm.DB) error {
+		db := &dtmutil.DB{DB: db1}
+		existing := []storage.TransGlobalStore{}
+		db.Must().Where("gid in ?", gids).Find(&existing)
+		saved := map[string]*storage.TransGlobalStore{}
+		for i := range existing {
+			saved[existing[i].Gid] = &existing[i]
+		}
+		globals := []*storage.TransGlobalStore{}
+		branches := []storage.TransBranchStore{}
+		for i, t := range trans {
+			if g := saved[t.Global.Gid]; g != nil {
+				errs[i] = storage.DuplicateTrans(t.Global, g)
+				continue
+			}
+			saved[t.Global.Gid] = t.Global // a gid repeated in the batch is a duplicate of the first one
+			globals = append(globals, t.Global)
+			branches = append(branches, t.Branches...)
+		}
+		if len(globals) == 0 {
+			return nil
+		}
+		dbr := db.Must().Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(globals, insertBatchSize)
+		if dbr.RowsAffected != int64(len(globals)) {
+			return errBatchConflict
+		}
+		if len(branches) > 0 {
+			db.Must().Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(savePayloads(db, branches), insertBatchSize)
 		}
 		return nil
 	})
+	if err == errBatchConflict { // rare, so the trans are saved one by one to tell the duplicated ones
+		for i, t := range trans {
+			t.Global.ID = 0 // the ids filled by the rolled back inserts
+			for j := range t.Branches {
+				t.Branches[j].ID = 0
+			}
+			errs[i] = s.MaySaveNewTrans(t.Global, t.Branches)
+		}
+		return errs
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
 }
 
 // ChangeGlobalStatus changes global trans status
-func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) {
-	old := global.Status
-	global.Status = newStatus
-	dbr := dbGet().Must().Model(global).Where("status=? and gid=?", old, global.Gid).Select(updates).Updates(global)
+func (s *Store) ChangeGlobalStatus(global *storage.TransGlobalStore, newStatus string, updates []string, finished bool) error {
+	old, version := global.Status, global.Version
+	global.Status, global.Version = newStatus, version+1
+	dbr := dbGet().WithOp("ChangeGlobalStatus", global.Gid).Model(global).Where("status=? and gid=? and version=?", old, global.Gid, version).
+		Select(append(updates[:len(updates):len(updates)], "version")).Updates(global)
+	if dbr.Error != nil {
+		global.Status, global.Version = old, version
+		return dbr.Error
+	}
+	if dbr.RowsAffected == 0 {
+		global.Status, global.Version = old, version
+		return storage.GlobalConflict(global, old, s.FindTransGlobalStore(global.Gid))
+	}
+	return nil
+}
+
+// UpdateGlobalCustomData updates the custom data of an unfinished trans
+func (s *Store) UpdateGlobalCustomData(global *storage.TransGlobalStore, data string) error {
+	dbr := dbGet().WithOp("UpdateGlobalCustomData", global.Gid).Model(&storage.TransGlobalStore{}).
+		Where("gid=? and version=? and status not in ?", global.Gid, global.Version, []string{dtmcli.StatusSucceed, dtmcli.StatusFailed}).
+		Updates(map[string]interface{}{"custom_data": data, "update_time": time.Now(), "version": global.Version + 1})
+	if dbr.Error != nil {
+		return dbr.Error
+	}
 	if dbr.RowsAffected == 0 {
-		dtmimp.E2P(storage.ErrNotFound)
+		return storage.GlobalConflict(global, storage.StatusUnfinished, s.FindTransGlobalStore(global.Gid))
 	}
+	global.CustomData = data
+	global.Version++
+	return nil
 }
 
 // TouchCronTime updates cronTime
@@ -130,31 +306,93 @@ func (s *Store) TouchCronTime(global *storage.TransGlobalStore, nextCronInterval
 	global.UpdateTime = dtmutil.GetNextTime(0)
 	global.NextCronTime = nextCronTime
 	global.NextCronInterval = nextCronInterval
-	dbGet().Must().Model(global).Where("status=? and gid=?", global.Status, global.Gid).
-		Select([]string{"next_cron_time", "update_time", "next_cron_interval"}).Updates(global)
+	version := global.Version
+	global.Version++
+	dbr := dbGet().WithOp("TouchCronTime", global.Gid).Must().Model(global).Where("status=? and gid=? and version=?", global.Status, global.Gid, version).
+		Select([]string{"next_cron_time", "update_time", "next_cron_interval", "version"}).Updates(global)
+	if dbr.RowsAffected == 0 { // skipped, the trans is changed
+		global.Version = version
+	}
+}
+
+// the max number of gids in a statement of TouchCronTimes
+const touchGidsLimit = 500
+
+// TouchCronTimes updates the cron times in batches
+func (s *Store) TouchCronTimes(updates []storage.CronTimeUpdate) {
+	touchCronTimes(dbGet().WithOp("TouchCronTimes", ""), updates)
+}
+
+// touchCronTimes updates the trans of the same status, version, next cron interval and next cron time by one statement
+// for every touchGidsLimit gids. the next cron times are stored in seconds, so they are compared in seconds
+func touchCronTimes(db *dtmutil.DB, updates []storage.CronTimeUpdate) {
+	type group struct {
+		status   string
+		version  int64
+		interval int64
+		next     time.Time
+		gids     []string
+	}
+	groups := map[string]*group{}
+	keys := []string{}
+	now := dtmutil.GetNextTime(0)
+	for _, u := range updates {
+		u.Global.UpdateTime = now
+		u.Global.NextCronTime = u.NextCronTime
+		u.Global.NextCronInterval = u.NextCronInterval
+		key := fmt.Sprintf("%s-%d-%d-%d", u.Global.Status, u.Global.Version, u.NextCronInterval, u.NextCronTime.Unix())
+		if groups[key] == nil {
+			groups[key] = &group{status: u.Global.Status, version: u.Global.Version, interval: u.NextCronInterval, next: time.Unix(u.NextCronTime.Unix(), 0)}
+			keys = append(keys, key)
+		}
+		groups[key].gids = append(groups[key].gids, u.Global.Gid)
+	}
+	for _, key := range keys {
+		g := groups[key]
+		for start := 0; start < len(g.gids); start += touchGidsLimit {
+			end := start + touchGidsLimit
+			if end > len(g.gids) {
+				end = len(g.gids)
+			}
+			db.Must().Model(&storage.TransGlobalStore{}).Where("status=? and version=? and gid in (?)", g.status, g.version, g.gids[start:end]).
+				Updates(map[string]interface{}{"next_cron_time": g.next, "update_time": now, "next_cron_interval": g.interval, "version": g.version + 1})
+		}
+	}
+}
+
+// dbTimeExpr is the sql of the time after seconds in the clock of the db. the next cron times set by the db itself are
+// in the clock of the db, so they are compared with now() of the db correctly, whatever the clock of dtm server is
+func dbTimeExpr(driver string, second int64) string {
+	if driver == config.Postgres {
+		return fmt.Sprintf("current_timestamp + interval '%d second'", second)
+	}
+	return fmt.Sprintf("date_add(now(), interval %d second)", second)
 }
 
 // LockOneGlobalTrans finds GlobalTrans
 func (s *Store) LockOneGlobalTrans(expireIn time.Duration) *storage.TransGlobalStore {
-	db := dbGet()
-	getTime := func(second int) string {
-		return map[string]string{
-			"mysql":    fmt.Sprintf("date_add(now(), interval %d second)", second),
-			"postgres": fmt.Sprintf("current_timestamp + interval '%d second'", second),
-		}[conf.Store.Driver]
-	}
-	expire := int(expireIn / time.Second)
-	whereTime := fmt.Sprintf("next_cron_time < %s", getTime(expire))
+	db := dbGet().WithOp("LockOneGlobalTrans", "")
+	expire := int64(expireIn / time.Second)
+	whereTime := fmt.Sprintf("next_cron_time < %s", dbTimeExpr(conf.Store.Driver, expire))
+	where := whereTime + "and status in ('prepared', 'aborting', 'submitted')"
+	// the trans overdue for more than PriorityAging are claimed as the max priority, so that lower priorities make progress
+	order := "priority desc, next_cron_time"
+	if conf.PriorityAging > 0 {
+		order = fmt.Sprintf("case when next_cron_time < %s then %d else priority end desc, next_cron_time",
+			dbTimeExpr(conf.Store.Driver, -conf.PriorityAging), dtmimp.PriorityMax)
+	}
 	owner := shortuuid.New()
 	global := &storage.TransGlobalStore{}
-	dbr := db.Must().Model(global).
-		Where(whereTime + "and status in ('prepared', 'aborting', 'submitted')").
-		Limit(1).
-		Select([]string{"owner", "next_cron_time"}).
-		Updates(&storage.TransGlobalStore{
-			Owner:        owner,
-			NextCronTime: dtmutil.GetNextTime(conf.RetryInterval),
-		})
+	query := db.Must().Model(global)
+	if conf.Store.Driver == config.Postgres { // an update of postgres is neither ordered nor limited, so the trans is chosen by a subquery
+		query = query.Where("id in (?)", dbGet().Model(global).Select("id").Where(where).Order(order).Limit(1))
+	} else {
+		query = query.Where(where).Order(order).Limit(1)
+	}
+	dbr := query.Updates(map[string]interface{}{
+		"owner":          owner,
+		"next_cron_time": gorm.Expr(dbTimeExpr(conf.Store.Driver, conf.RetryInterval)),
+	})
 	if dbr.RowsAffected == 0 {
 		return nil
 	}
@@ -162,25 +400,100 @@ func (s *Store) LockOneGlobalTrans(expireIn time.Duration) *storage.TransGlobalS
 	return global
 }
 
+// FindOldestCronTime finds the earliest next_cron_time of the unfinished trans, by the index status_next_cron_time
+func (s *Store) FindOldestCronTime() *time.Time {
+	var oldest []time.Time
+	dbGet().Must().Model(&storage.TransGlobalStore{}).Where("status in ('prepared', 'aborting', 'submitted') and next_cron_time is not null").
+		Order("next_cron_time").Limit(1).Pluck("next_cron_time", &oldest)
+	if len(oldest) == 0 {
+		return nil
+	}
+	return &oldest[0]
+}
+
+// CountCronTimeBefore counts the unfinished trans whose next_cron_time is before the time
+func (s *Store) CountCronTimeBefore(before time.Time) int64 {
+	var count int64
+	dbGet().Must().Model(&storage.TransGlobalStore{}).Where("status in ('prepared', 'aborting', 'submitted') and next_cron_time < ?", before).
+		Count(&count)
+	return count
+}
+
+// CountOverdueByPriority counts the unfinished trans whose next_cron_time is before the time by priority
+func (s *Store) CountOverdueByPriority(before time.Time) map[int]int64 {
+	var rows []struct {
+		Priority int
+		Count    int64
+	}
+	dbGet().Must().Model(&storage.TransGlobalStore{}).Select("priority, count(*) as count").
+		Where("status in ('prepared', 'aborting', 'submitted') and next_cron_time < ?", before).
+		Group("priority").Scan(&rows)
+	counts := map[int]int64{}
+	for _, r := range rows {
+		counts[r.Priority] = r.Count
+	}
+	return counts
+}
+
+// CountCronTimeAfter counts the unfinished trans whose next_cron_time is after the time
+func (s *Store) CountCronTimeAfter(after time.Time) int64 {
+	var count int64
+	dbGet().Must().Model(&storage.TransGlobalStore{}).Where("status in ('prepared', 'aborting', 'submitted') and next_cron_time > ?", after).
+		Count(&count)
+	return count
+}
+
+// the max number of the finished trans read to compute the percentiles of the completion durations
+const statsSampleSize = 10000
+
+// Stats counts the trans by group by, and computes the completion durations from the latest finished trans
+func (s *Store) Stats(cond storage.StatsCondition) *storage.TransStats {
+	bucketExpr := "floor(timestampdiff(second, ?, create_time) / ?)"
+	if conf.Store.Driver == config.Postgres {
+		bucketExpr = "floor(extract(epoch from (create_time - cast(? as timestamptz))) / ?)"
+	}
+	rows := []struct {
+		Idx       int64
+		TransType string
+		Status    string
+		Count     int64
+	}{}
+	dbGet().Must().Model(&storage.TransGlobalStore{}).
+		Select(bucketExpr+" as idx, trans_type, status, count(*) as count", cond.From, int64(cond.Bucket/time.Second)).
+		Where("create_time >= ? and create_time < ?", cond.From, cond.To).
+		Group("idx, trans_type, status").Scan(&rows)
+
+	sample := []storage.TransGlobalStore{}
+	dbGet().Must().Select("trans_type, create_time, finish_time").
+		Where("create_time >= ? and create_time < ? and status in ? and finish_time is not null", cond.From, cond.To,
+			[]string{dtmcli.StatusSucceed, dtmcli.StatusFailed}).
+		Order("id desc").Limit(statsSampleSize).Find(&sample)
+	c := storage.NewStatsCollector(cond)
+	for _, g := range sample {
+		c.AddDuration(g.TransType, g.FinishTime.Sub(*g.CreateTime).Seconds())
+	}
+	stats := c.Result(len(sample) == statsSampleSize)
+	for _, r := range rows {
+		stats.Counts = append(stats.Counts, storage.TransStatsCount{Bucket: cond.From.Add(time.Duration(r.Idx) * cond.Bucket),
+			TransType: r.TransType, Status: r.Status, Count: r.Count})
+	}
+	storage.SortStatsCounts(stats.Counts)
+	return stats
+}
+
 // ResetCronTime rest nextCronTime
-// Prevent multiple backoff from causing NextCronTime to be too long
+// Prevent multiple backoff from causing NextCronTime to be too long. the owner is cleared, so the trans can be locked at once
 func (s *Store) ResetCronTime(timeout time.Duration, limit int64) (succeedCount int64, hasRemaining bool, err error) {
 	db := dbGet()
-	getTime := func(second int) string {
-		return map[string]string{
-			"mysql":    fmt.Sprintf("date_add(now(), interval %d second)", second),
-			"postgres": fmt.Sprintf("current_timestamp + interval '%d second'", second),
-		}[conf.Store.Driver]
-	}
-	timeoutSecond := int(timeout / time.Second)
-	whereTime := fmt.Sprintf("next_cron_time > %s", getTime(timeoutSecond))
+	timeoutSecond := int64(timeout / time.Second)
+	whereTime := fmt.Sprintf("next_cron_time > %s", dbTimeExpr(conf.Store.Driver, timeoutSecond))
 	global := &storage.TransGlobalStore{}
 	dbr := db.Must().Model(global).
 		Where(whereTime + "and status in ('prepared', 'aborting', 'submitted')").
 		Limit(int(limit)).
-		Select([]string{"next_cron_time"}).
-		Updates(&storage.TransGlobalStore{
-			NextCronTime: dtmutil.GetNextTime(0),
+		Updates(map[string]interface{}{
+			"next_cron_time": gorm.Expr(dbTimeExpr(conf.Store.Driver, 0)),
+			"owner":          "",
 		})
 	succeedCount = dbr.RowsAffected
 	if succeedCount == limit {
@@ -194,6 +507,117 @@ func (s *Store) ResetCronTime(timeout time.Duration, limit int64) (succeedCount
 	return succeedCount, hasRemaining, dbr.Error
 }
 
+// FindKV finds key-value pairs
+func (s *Store) FindKV(cat, key string) []storage.KVStore {
+	kvs := []storage.KVStore{}
+	db := dbGet().Must().Model(&storage.KVStore{}).Where("cat=?", cat)
+	if key != "" {
+		db = db.Where("k=?", key)
+	}
+	db.Order("id asc").Find(&kvs)
+	return kvs
+}
+
+// UpdateKV updates key-value pair with the version as optimistic lock
+func (s *Store) UpdateKV(kv *storage.KVStore) error {
+	oldVersion := kv.Version
+	kv.Version = oldVersion + 1
+	kv.UpdateTime = dtmutil.GetNextTime(0)
+	dbr := dbGet().Must().Model(&storage.KVStore{}).Where("cat=? and k=? and version=?", kv.Cat, kv.K, oldVersion).
+		Select([]string{"v", "version", "update_time"}).Updates(kv)
+	if dbr.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// DeleteKV deletes key-value pair
+func (s *Store) DeleteKV(cat, key string) error {
+	dbr := dbGet().Must().Where("cat=? and k=?", cat, key).Delete(&storage.KVStore{})
+	if dbr.RowsAffected == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// CreateKV creates key-value pair
+func (s *Store) CreateKV(cat, key, value string) error {
+	kv := &storage.KVStore{Cat: cat, K: key, V: value, Version: 1}
+	dbr := dbGet().Must().Clauses(clause.OnConflict{
+		DoNothing: true,
+	}).Create(kv)
+	if dbr.RowsAffected == 0 {
+		return storage.ErrUniqueConflict
+	}
+	return nil
+}
+
+// SaveAttempt saves an attempt of calling a branch
+func (s *Store) SaveAttempt(attempt *storage.BranchAttempt) error {
+	return dbGet().WithOp("SaveAttempt", attempt.Gid).Transaction(func(tx *gorm.DB) error {
+		last := 0
+		err := tx.Model(&storage.BranchAttempt{}).Select("coalesce(max(attempt), 0)").
+			Where("gid=? and branch_id=? and op=?", attempt.Gid, attempt.BranchID, attempt.Op).Scan(&last).Error
+		if err == nil {
+			attempt.Attempt = last + 1
+			err = tx.Create(attempt).Error
+		}
+		return err
+	})
+}
+
+// FindAttempts finds the attempts of calling the branches of the trans
+func (s *Store) FindAttempts(gid string) []storage.BranchAttempt {
+	attempts := []storage.BranchAttempt{}
+	dbGet().WithOp("FindAttempts", gid).Must().Where("gid=?", gid).Order("id asc").Find(&attempts)
+	return attempts
+}
+
+// PurgeAttempts deletes the attempts saved before the time
+func (s *Store) PurgeAttempts(before time.Time) (int64, error) {
+	dbr := dbGet().WithOp("PurgeAttempts", "").Where("create_time<?", before).Delete(&storage.BranchAttempt{})
+	return dbr.RowsAffected, dbr.Error
+}
+
+// SaveEvent saves an event to the event log. the seq is allocated by increasing the row of TransEventCounterTable, which
+// is locked until the commit, so the events are committed in the order of the seqs, and FindEvents never returns a seq
+// before an event of a smaller seq is committed, as an auto increment id does. the seq is global among the dtm servers
+// sharing the db
+func (s *Store) SaveEvent(event *storage.EventRecord) error {
+	saved := *event // the seq of event is set only if committed
+	err := dbGet().WithOp("SaveEvent", event.Gid).Transaction(func(tx *gorm.DB) error {
+		dbr := tx.Exec(fmt.Sprintf("update %s set seq=seq+1 where id=1", conf.Store.TransEventCounterTable))
+		if dbr.Error == nil && dbr.RowsAffected == 0 {
+			return fmt.Errorf("no counter in %s, the schema should be migrated", conf.Store.TransEventCounterTable)
+		}
+		err := dbr.Error
+		if err == nil {
+			err = tx.Raw(fmt.Sprintf("select seq from %s where id=1", conf.Store.TransEventCounterTable)).Scan(&saved.Seq).Error
+		}
+		if err == nil {
+			err = tx.Create(&saved).Error
+		}
+		return err
+	})
+	if err == nil {
+		event.Seq = saved.Seq
+	}
+	return err
+}
+
+// FindEvents finds the events after the seq in the order of seq
+func (s *Store) FindEvents(afterSeq int64, limit int) []storage.EventRecord {
+	events := []storage.EventRecord{}
+	dbGet().WithOp("FindEvents", "").Must().Where("id>?", afterSeq).Order("id asc").Limit(limit).Find(&events)
+	return events
+}
+
+// PurgeEvents deletes the events saved before the time, and not after maxSeq
+func (s *Store) PurgeEvents(before time.Time, maxSeq int64) (int64, error) {
+	dbr := dbGet().WithOp("PurgeEvents", "").Where("event_time<? and id<=?", before, maxSeq).Delete(&storage.EventRecord{})
+	return dbr.RowsAffected, dbr.Error
+}
+
 // SetDBConn sets db conn pool
 func SetDBConn(db *gorm.DB) {
 	sqldb, _ := db.DB()
@@ -203,7 +627,7 @@ func SetDBConn(db *gorm.DB) {
 }
 
 func dbGet() *dtmutil.DB {
-	return dtmutil.DbGet(conf.Store.GetDBConf(), SetDBConn)
+	return dtmutil.DbGet(conf.Store.GetDBConf(), SetDBConn, watchPool(poolTarget(conf.Store.GetDBConf())), statementHooks())
 }
 
 func wrapError(err error) error {
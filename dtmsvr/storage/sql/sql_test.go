@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package sql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// dryRunDB returns a db generating the statements without executing them, and the counter of the update statements
+func dryRunDB(t testing.TB) (*dtmutil.DB, *int) {
+	conf.Store.TransGlobalTable = "dtm.trans_global"
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "root:secret@tcp(127.0.0.1:3306)/", SkipInitializeWithVersion: true}),
+		&gorm.Config{DisableAutomaticPing: true, DryRun: true, SkipDefaultTransaction: true})
+	assert.Nil(t, err)
+	updated := 0
+	_ = db.Callback().Update().After("gorm:update").Register("test:count", func(*gorm.DB) { updated++ })
+	return &dtmutil.DB{DB: db}, &updated
+}
+
+// retryPass returns the touches of a retry pass of n trans, processed in about seconds
+func retryPass(n int, seconds int) []storage.CronTimeUpdate {
+	updates := []storage.CronTimeUpdate{}
+	for i := 0; i < n; i++ {
+		next := time.Now().Add(time.Duration(10+i*seconds/n) * time.Second)
+		global := &storage.TransGlobalStore{Gid: fmt.Sprintf("gid-%d", i), Status: "prepared"}
+		updates = append(updates, storage.CronTimeUpdate{Global: global, NextCronInterval: 10, NextCronTime: &next})
+	}
+	return updates
+}
+
+func TestTouchCronTimes(t *testing.T) {
+	db, updated := dryRunDB(t)
+	updates := retryPass(1200, 0)
+	updates[0].Global.Status = "submitted"
+	updates[1].Global.Version = 2
+	touchCronTimes(db, updates)
+	assert.LessOrEqual(t, *updated, 5) // 1 for the submitted, 1 for the version 2, 3 for the 1198 prepared, unless the second changes
+	assert.Equal(t, int64(10), updates[1].Global.NextCronInterval)
+	assert.Equal(t, updates[1].NextCronTime, updates[1].Global.NextCronTime)
+}
+
+// BenchmarkTouchCronTimes reports the update statements of a retry pass of 5000 trans, which takes 5000 statements
+// if touched one by one
+func BenchmarkTouchCronTimes(b *testing.B) {
+	db, updated := dryRunDB(b)
+	updates := retryPass(5000, 5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		touchCronTimes(db, updates)
+	}
+	b.ReportMetric(float64(*updated)/float64(b.N), "statements/pass")
+	b.ReportMetric(float64(len(updates)), "statements/pass-unbatched")
+}
+
+func TestDBTimeExpr(t *testing.T) {
+	assert.Equal(t, "date_add(now(), interval 10 second)", dbTimeExpr("mysql", 10))
+	assert.Equal(t, "current_timestamp + interval '-60 second'", dbTimeExpr("postgres", -60))
+}
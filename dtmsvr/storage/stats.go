@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+)
+
+// StatsCondition defines the trans counted by Stats: the trans created in [From, To), grouped by the buckets of create time
+type StatsCondition struct {
+	From   time.Time
+	To     time.Time
+	Bucket time.Duration
+}
+
+// BucketStart returns the start of the bucket of the time
+func (c *StatsCondition) BucketStart(t time.Time) time.Time {
+	return c.From.Add(t.Sub(c.From) / c.Bucket * c.Bucket)
+}
+
+// TransStatsCount is the number of the trans of a type and a status, created in a bucket
+type TransStatsCount struct {
+	Bucket    time.Time `json:"bucket"` // the start of the bucket
+	TransType string    `json:"trans_type"`
+	Status    string    `json:"status"`
+	Count     int64     `json:"count"`
+}
+
+// TransDurationStats is the stats of the completion durations in seconds, from create to finish, of the finished trans of a type
+type TransDurationStats struct {
+	TransType string  `json:"trans_type"`
+	Count     int64   `json:"count"`
+	Avg       float64 `json:"avg"`
+	P50       float64 `json:"p50"`
+	P95       float64 `json:"p95"`
+}
+
+// TransStats is the result of Stats
+type TransStats struct {
+	Counts      []TransStatsCount    `json:"counts"`
+	Durations   []TransDurationStats `json:"durations"`
+	Approximate bool                 `json:"approximate"` // the stats are computed from part of the trans, such as a sample or a limited scan
+}
+
+// StatsCollector computes the stats from the trans one by one, for the stores without group by
+type StatsCollector struct {
+	cond      StatsCondition
+	counts    map[TransStatsCount]int64
+	durations map[string][]float64
+}
+
+// NewStatsCollector creates a StatsCollector
+func NewStatsCollector(cond StatsCondition) *StatsCollector {
+	return &StatsCollector{cond: cond, counts: map[TransStatsCount]int64{}, durations: map[string][]float64{}}
+}
+
+// Add counts the trans if it is created in the range of the condition
+func (c *StatsCollector) Add(g *TransGlobalStore) {
+	if g.CreateTime == nil || g.CreateTime.Before(c.cond.From) || !g.CreateTime.Before(c.cond.To) {
+		return
+	}
+	c.counts[TransStatsCount{Bucket: c.cond.BucketStart(*g.CreateTime), TransType: g.TransType, Status: g.Status}]++
+	if g.FinishTime != nil && (g.Status == dtmcli.StatusSucceed || g.Status == dtmcli.StatusFailed) {
+		c.AddDuration(g.TransType, g.FinishTime.Sub(*g.CreateTime).Seconds())
+	}
+}
+
+// AddDuration adds the completion duration of a finished trans
+func (c *StatsCollector) AddDuration(transType string, seconds float64) {
+	c.durations[transType] = append(c.durations[transType], seconds)
+}
+
+// Result returns the stats collected, with the counts ordered by bucket, type and status, and the durations by type
+func (c *StatsCollector) Result(approximate bool) *TransStats {
+	stats := &TransStats{Counts: []TransStatsCount{}, Durations: []TransDurationStats{}, Approximate: approximate}
+	for k, v := range c.counts {
+		k.Count = v
+		stats.Counts = append(stats.Counts, k)
+	}
+	SortStatsCounts(stats.Counts)
+	for transType, durations := range c.durations {
+		stats.Durations = append(stats.Durations, DurationStats(transType, durations))
+	}
+	sort.Slice(stats.Durations, func(i, j int) bool { return stats.Durations[i].TransType < stats.Durations[j].TransType })
+	return stats
+}
+
+// SortStatsCounts sorts the counts by bucket, type and status
+func SortStatsCounts(counts []TransStatsCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if !a.Bucket.Equal(b.Bucket) {
+			return a.Bucket.Before(b.Bucket)
+		}
+		if a.TransType != b.TransType {
+			return a.TransType < b.TransType
+		}
+		return a.Status < b.Status
+	})
+}
+
+// DurationStats computes the stats of the durations in seconds. the percentiles are of the nearest rank
+func DurationStats(transType string, durations []float64) TransDurationStats {
+	sorted := append([]float64{}, durations...)
+	sort.Float64s(sorted)
+	stats := TransDurationStats{TransType: transType, Count: int64(len(sorted))}
+	if len(sorted) == 0 {
+		return stats
+	}
+	sum := 0.0
+	for _, d := range sorted {
+		sum += d
+	}
+	percentile := func(p float64) float64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	stats.Avg, stats.P50, stats.P95 = sum/float64(len(sorted)), percentile(0.5), percentile(0.95)
+	return stats
+}
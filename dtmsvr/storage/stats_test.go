@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsCollector(t *testing.T) {
+	from := time.Unix(1600000000, 0)
+	cond := StatsCondition{From: from, To: from.Add(2 * time.Hour), Bucket: time.Hour}
+	c := NewStatsCollector(cond)
+	add := func(transType, status string, created time.Duration, took time.Duration) {
+		create := from.Add(created)
+		g := &TransGlobalStore{TransType: transType, Status: status}
+		g.CreateTime = &create
+		if took > 0 {
+			finish := create.Add(took)
+			g.FinishTime = &finish
+		}
+		c.Add(g)
+	}
+	add("saga", "succeed", 10*time.Minute, 2*time.Second)
+	add("saga", "succeed", 20*time.Minute, 4*time.Second)
+	add("saga", "failed", 70*time.Minute, 10*time.Second)
+	add("msg", "submitted", 30*time.Minute, 0)
+	add("msg", "succeed", -time.Minute, time.Second) // before the range
+	add("msg", "succeed", 2*time.Hour, time.Second)  // after the range
+
+	stats := c.Result(false)
+	assert.Equal(t, []TransStatsCount{
+		{Bucket: from, TransType: "msg", Status: "submitted", Count: 1},
+		{Bucket: from, TransType: "saga", Status: "succeed", Count: 2},
+		{Bucket: from.Add(time.Hour), TransType: "saga", Status: "failed", Count: 1},
+	}, stats.Counts)
+	assert.Equal(t, []TransDurationStats{{TransType: "saga", Count: 3, Avg: 16.0 / 3, P50: 4, P95: 10}}, stats.Durations)
+	assert.False(t, stats.Approximate)
+}
+
+func TestDurationStats(t *testing.T) {
+	durations := []float64{}
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, float64(i))
+	}
+	assert.Equal(t, TransDurationStats{TransType: "msg", Count: 100, Avg: 50.5, P50: 50, P95: 95}, DurationStats("msg", durations))
+	assert.Equal(t, TransDurationStats{TransType: "msg"}, DurationStats("msg", nil))
+}
@@ -8,7 +8,11 @@ package storage
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
 )
 
 // ErrNotFound defines the query item is not found in storage implement.
@@ -17,18 +21,193 @@ var ErrNotFound = errors.New("storage: NotFound")
 // ErrUniqueConflict defines the item is conflict with unique key in storage implement.
 var ErrUniqueConflict = errors.New("storage: UniqueKeyConflict")
 
+// DuplicateTransError is returned by MaySaveNewTrans if the gid exists. errors.Is(err, ErrUniqueConflict) is true
+type DuplicateTransError struct {
+	Gid        string
+	Mismatches []string // the fields different from the saved trans. empty means the same trans is resubmitted
+	Unhashed   bool     // the saved trans has no payloads hash, such as saved by old versions, so the payloads are not compared
+}
+
+func (e *DuplicateTransError) Error() string {
+	if len(e.Mismatches) == 0 {
+		return fmt.Sprintf("storage: trans %s exists", e.Gid)
+	}
+	return fmt.Sprintf("storage: trans %s exists with different %s", e.Gid, strings.Join(e.Mismatches, ", "))
+}
+
+// Is makes the error an ErrUniqueConflict
+func (e *DuplicateTransError) Is(target error) bool {
+	return target == ErrUniqueConflict
+}
+
+// DuplicateTrans returns the error of saving global whose gid exists. saved is the existing trans, and nil means it is gone
+func DuplicateTrans(global *TransGlobalStore, saved *TransGlobalStore) error {
+	if saved == nil {
+		return ErrUniqueConflict
+	}
+	dup := &DuplicateTransError{Gid: global.Gid, Mismatches: []string{}, Unhashed: saved.PayloadsHash == ""}
+	if saved.TransType != global.TransType {
+		dup.Mismatches = append(dup.Mismatches, "trans_type")
+	}
+	if !dup.Unhashed && saved.BranchCount != global.BranchCount {
+		dup.Mismatches = append(dup.Mismatches, "branch_count")
+	} else if !dup.Unhashed && saved.PayloadsHash != global.PayloadsHash {
+		dup.Mismatches = append(dup.Mismatches, "payloads")
+	}
+	return dup
+}
+
+// StatusConflictError is returned if the status of the trans to change is not the expected one, usually changed by
+// another dtm server instance, such as the trans finished by the other instance
+type StatusConflictError struct {
+	Gid      string
+	Expected string
+	Actual   string
+}
+
+func (e *StatusConflictError) Error() string {
+	return fmt.Sprintf("storage: status of trans %s is %s, expected %s", e.Gid, e.Actual, e.Expected)
+}
+
+// StatusUnfinished is the expected status in StatusConflictError, if the trans should not be finished
+const StatusUnfinished = "unfinished"
+
+// StatusConflict returns the error of a conditional update of the trans matching nothing. current is the trans re-read
+// after the update, and nil means the trans is gone
+func StatusConflict(gid string, expected string, current *TransGlobalStore) error {
+	if current == nil {
+		return ErrNotFound
+	}
+	return &StatusConflictError{Gid: gid, Expected: expected, Actual: current.Status}
+}
+
+// VersionConflictError is returned if the trans to write is changed by others after it is read, while its status is
+// not changed, such as its custom data updated, or its cron time touched by another dtm server instance. the writer
+// should re-read the trans and write again, or skip the write if the race is benign
+type VersionConflictError struct {
+	Gid      string
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("storage: version of trans %s is %d, expected %d", e.Gid, e.Actual, e.Expected)
+}
+
+// GlobalConflict checks the trans current against the status and the version of global, which are expected by a
+// conditional write. expectedStatus can be StatusUnfinished. nil is returned if the write can be done, or ErrNotFound
+// if current is nil, or *StatusConflictError if the status is changed, or *VersionConflictError
+func GlobalConflict(global *TransGlobalStore, expectedStatus string, current *TransGlobalStore) error {
+	if current == nil {
+		return ErrNotFound
+	}
+	finished := current.Status == dtmcli.StatusSucceed || current.Status == dtmcli.StatusFailed
+	if expectedStatus == StatusUnfinished && finished || expectedStatus != StatusUnfinished && current.Status != expectedStatus {
+		return &StatusConflictError{Gid: global.Gid, Expected: expectedStatus, Actual: current.Status}
+	}
+	if current.Version != global.Version {
+		return &VersionConflictError{Gid: global.Gid, Expected: global.Version, Actual: current.Version}
+	}
+	return nil
+}
+
+// TransGlobalScanCondition defines the filters of ScanTransGlobalStores
+type TransGlobalScanCondition struct {
+	Tenant string // only the trans of the tenant are returned if not empty
+}
+
+// Match returns whether the trans matches the condition
+func (c *TransGlobalScanCondition) Match(global *TransGlobalStore) bool {
+	return c.Tenant == "" || c.Tenant == global.Tenant
+}
+
+// NewTrans is a trans to save by MaySaveNewTransBatch
+type NewTrans struct {
+	Global   *TransGlobalStore
+	Branches []TransBranchStore
+}
+
+// CronTimeUpdate is a cron time to touch by TouchCronTimes. it is guarded by the status and the version of Global, like TouchCronTime
+type CronTimeUpdate struct {
+	Global           *TransGlobalStore
+	NextCronInterval int64
+	NextCronTime     *time.Time
+}
+
 // Store defines storage relevant interface
 type Store interface {
 	Ping() error
+	Now() (time.Time, error) // the now of the clock of the store, which next_cron_time is compared against
 	PopulateData(skipDrop bool)
 	FindTransGlobalStore(gid string) *TransGlobalStore
-	ScanTransGlobalStores(position *string, limit int64) []TransGlobalStore
+	ScanTransGlobalStores(position *string, limit int64, condition TransGlobalScanCondition) []TransGlobalStore
 	FindBranches(gid string) []TransBranchStore
+	FindBranchesPage(gid string, afterBranchID string, limit int) []TransBranchStore // see PageBranches
+	FindBranch(gid string, branchID string, op string) *TransBranchStore             // nil is returned if not found
 	UpdateBranches(branches []TransBranchStore, updates []string) (int, error)
-	LockGlobalSaveBranches(gid string, status string, branches []TransBranchStore, branchStart int)
-	MaySaveNewTrans(global *TransGlobalStore, branches []TransBranchStore) error
-	ChangeGlobalStatus(global *TransGlobalStore, newStatus string, updates []string, finished bool)
-	TouchCronTime(global *TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time)
-	LockOneGlobalTrans(expireIn time.Duration) *TransGlobalStore
+	// LockGlobalSaveBranches saves the branches if the trans is of the status, or panics ErrNotFound. the branches are
+	// appended if branchStart is -1, where a branch of the same branch_id and op existing is not inserted again. or they
+	// overwrite the branches from branchStart, where a finished branch is not changed to another status, and create_time
+	// is kept. whether each branch is saved is returned, so a retried registration is told from a new one
+	LockGlobalSaveBranches(gid string, status string, branches []TransBranchStore, branchStart int) []bool
+	MaySaveNewTrans(global *TransGlobalStore, branches []TransBranchStore) error // *DuplicateTransError is returned if the gid exists
+	MaySaveNewTransBatch(trans []NewTrans) []error                               // the result of each trans, the same as MaySaveNewTrans
+	// the writes of the trans below are conditional on the status and the version of global, and increment the version
+	// of global in place if done. see GlobalConflict for the errors
+	ChangeGlobalStatus(global *TransGlobalStore, newStatus string, updates []string, finished bool) error
+	UpdateGlobalCustomData(global *TransGlobalStore, data string) error                      // the trans should be unfinished
+	TouchCronTime(global *TransGlobalStore, nextCronInterval int64, nextCronTime *time.Time) // skipped if the status or the version is changed
+	TouchCronTimes(updates []CronTimeUpdate)                                                 // skipped like TouchCronTime, the versions may not be updated in place
+	LockOneGlobalTrans(expireIn time.Duration) *TransGlobalStore                             // an expired trans of the highest priority, see config.PriorityAging
 	ResetCronTime(timeout time.Duration, limit int64) (succeedCount int64, hasRemaining bool, err error)
+	FindOldestCronTime() *time.Time                        // the earliest next_cron_time of the unfinished trans, nil if there is none
+	CountCronTimeBefore(before time.Time) int64            // the number of the unfinished trans whose next_cron_time is before the time
+	CountCronTimeAfter(after time.Time) int64              // the number of the unfinished trans whose next_cron_time is after the time, which ResetCronTime resets
+	CountOverdueByPriority(before time.Time) map[int]int64 // the numbers of the unfinished trans whose next_cron_time is before the time, by priority
+	Stats(cond StatsCondition) *TransStats                 // the counts and the completion durations of the trans created in the range
+	FindKV(cat, key string) []KVStore                      // all the kv of cat is returned if key is empty
+	UpdateKV(kv *KVStore) error                            // ErrNotFound is returned if the version of kv is changed
+	DeleteKV(cat, key string) error
+	CreateKV(cat, key, value string) error // ErrUniqueConflict is returned if the key exists
+	SaveAttempt(attempt *BranchAttempt) error
+	FindAttempts(gid string) []BranchAttempt                   // in the order saved
+	PurgeAttempts(before time.Time) (int64, error)             // deletes the attempts saved before the time
+	PurgePayloads(before time.Time) (int64, error)             // deletes the deduplicated payloads not referenced, and not used since the time
+	SaveEvent(event *EventRecord) error                        // assigns the seq of the event
+	FindEvents(afterSeq int64, limit int) []EventRecord        // the events after the seq, in the order of seq
+	PurgeEvents(before time.Time, maxSeq int64) (int64, error) // deletes the events saved before the time, and not after maxSeq
+}
+
+// FindBranch returns the branch of branchID and op in branches, nil if not found
+func FindBranch(branches []TransBranchStore, branchID string, op string) *TransBranchStore {
+	for i := range branches {
+		if branches[i].BranchID == branchID && branches[i].Op == op {
+			return &branches[i]
+		}
+	}
+	return nil
+}
+
+// PageBranches returns the page of branches for FindBranchesPage: at most limit branches after the last branch of
+// afterBranchID, in the order of FindBranches. the branches of the same branch id, such as an action and its compensation,
+// are not split, so a page may exceed limit. empty afterBranchID means from the first branch
+func PageBranches(branches []TransBranchStore, afterBranchID string, limit int) []TransBranchStore {
+	start := 0
+	if afterBranchID != "" {
+		start = len(branches)
+		for i := len(branches) - 1; i >= 0; i-- {
+			if branches[i].BranchID == afterBranchID {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := start + limit
+	if end > len(branches) {
+		end = len(branches)
+	}
+	for end > start && end < len(branches) && branches[end].BranchID == branches[end-1].BranchID {
+		end++
+	}
+	return branches[start:end]
 }
@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageBranches(t *testing.T) {
+	branches := []TransBranchStore{{BranchID: "01"}, {BranchID: "01"}, {BranchID: "02"}, {BranchID: "02"}, {BranchID: "03"}}
+	assert.Equal(t, branches[:2], PageBranches(branches, "", 2))
+	assert.Equal(t, branches[:4], PageBranches(branches, "", 3))
+	assert.Equal(t, branches[2:], PageBranches(branches, "01", 10))
+	assert.Equal(t, branches[4:], PageBranches(branches, "02", 1))
+	assert.Empty(t, PageBranches(branches, "03", 1))
+	assert.Empty(t, PageBranches(branches, "04", 1))
+}
+
+func TestPurgeableEvents(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	events := []EventRecord{{Seq: 1, EventTime: &old}, {Seq: 2, EventTime: &old}, {Seq: 3, EventTime: &now}, {Seq: 4, EventTime: &old}}
+	assert.Equal(t, 2, PurgeableEvents(events, now.Add(-time.Minute), 10))
+	assert.Equal(t, 1, PurgeableEvents(events, now.Add(-time.Minute), 1))
+	assert.Equal(t, 0, PurgeableEvents(events, old, 10))
+	assert.Equal(t, 4, PurgeableEvents(events, now.Add(time.Minute), 10))
+	assert.Equal(t, 0, PurgeableEvents(nil, now, 10))
+}
@@ -7,6 +7,11 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
@@ -17,7 +22,25 @@ import (
 
 // TransGlobalExt defines Header info
 type TransGlobalExt struct {
-	Headers map[string]string `json:"headers,omitempty" gorm:"-"`
+	Headers      map[string]string `json:"headers,omitempty" gorm:"-"`
+	EventSeq     int64             `json:"event_seq,omitempty" gorm:"-"`     // seq of the last lifecycle event published
+	ManualReason string            `json:"manual_reason,omitempty" gorm:"-"` // why the trans needs manual attention
+	Panics       int               `json:"panics,omitempty" gorm:"-"`        // the consecutive panics of processing the trans
+	Quarantine   *Quarantine       `json:"quarantine,omitempty" gorm:"-"`    // why the trans is quarantined
+	Template     *TemplateRef      `json:"template,omitempty" gorm:"-"`      // the template the trans is expanded from
+}
+
+// TemplateRef records the template and its version a trans is expanded from
+type TemplateRef struct {
+	Name    string `json:"name"`
+	Version uint64 `json:"version"`
+}
+
+// Quarantine records why a trans is quarantined, and its status before
+type Quarantine struct {
+	Status string     `json:"status"`
+	Reason string     `json:"reason"` // the last panic
+	Time   *time.Time `json:"time"`
 }
 
 // TransGlobalStore defines GlobalStore storage info
@@ -38,6 +61,10 @@ type TransGlobalStore struct {
 	NextCronInterval int64               `json:"next_cron_interval,omitempty"`
 	NextCronTime     *time.Time          `json:"next_cron_time,omitempty"`
 	Owner            string              `json:"owner,omitempty"`
+	RollbackReason   string              `json:"rollback_reason,omitempty"` // why the trans is rolled back, such as the failure of a branch
+	PayloadsHash     string              `json:"payloads_hash,omitempty"`   // hash of the branches submitted, to check a resubmit. see PayloadsHash
+	BranchCount      int                 `json:"branch_count,omitempty"`    // the number of the branches submitted
+	Version          int64               `json:"version,omitempty"`         // incremented by every write of the trans, see VersionConflictError
 	Ext              TransGlobalExt      `json:"-" gorm:"-"`
 	ExtData          string              `json:"ext_data,omitempty"` // storage of ext. a db field to store many values. like Options
 	dtmcli.TransOptions
@@ -49,7 +76,89 @@ func (g *TransGlobalStore) TableName() string {
 }
 
 func (g *TransGlobalStore) String() string {
-	return dtmimp.MustMarshalString(g)
+	return dtmimp.MustMarshalString(g.Masked())
+}
+
+// Masked returns a copy of the trans, with the values of the sensitive headers masked,
+// and the custom data masked if the store is encrypted. for logs and query
+func (g *TransGlobalStore) Masked() *TransGlobalStore {
+	m := *g
+	if g.CustomData != "" && config.Config.ShowDecryptedData != 1 && EncryptionEnabled() {
+		m.CustomData = "******"
+	}
+	if config.Config.ShowSensitiveHeaders == 1 {
+		return &m
+	}
+	m.BranchHeaders = maskHeaders(g.BranchHeaders)
+	if g.ExtData != "" {
+		ext := TransGlobalExt{}
+		dtmimp.MustUnmarshalString(g.ExtData, &ext)
+		ext.Headers = maskHeaders(ext.Headers)
+		m.ExtData = dtmimp.MustMarshalString(ext)
+	}
+	if len(g.Steps) > 0 {
+		m.Steps = make([]map[string]string, len(g.Steps))
+		for i, step := range g.Steps {
+			m.Steps[i] = step
+			if step["headers"] != "" {
+				m.Steps[i] = map[string]string{}
+				for k, v := range step {
+					m.Steps[i][k] = v
+				}
+				m.Steps[i]["headers"] = maskHeadersData(step["headers"])
+			}
+		}
+	}
+	if g.Options != "" {
+		options := dtmcli.TransOptions{}
+		dtmimp.MustUnmarshalString(g.Options, &options)
+		options.BranchHeaders = maskHeaders(options.BranchHeaders)
+		m.Options = dtmimp.MustMarshalString(options)
+	}
+	return &m
+}
+
+// maskHeaders returns a copy of headers, with the values of the sensitive headers masked
+func maskHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return headers
+	}
+	sensitive := map[string]bool{}
+	for _, h := range strings.Split(config.Config.SensitiveHeaders, ",") {
+		sensitive[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	masked := map[string]string{}
+	for k, v := range headers {
+		masked[k] = dtmimp.If(sensitive[strings.ToLower(k)], "******", v).(string)
+	}
+	return masked
+}
+
+// maskHeadersData masks the headers marshaled in data
+func maskHeadersData(data string) string {
+	headers := map[string]string{}
+	if json.Unmarshal([]byte(data), &headers) != nil {
+		return data
+	}
+	return dtmimp.MustMarshalString(maskHeaders(headers))
+}
+
+// TransBranchExt defines the options of a single branch
+type TransBranchExt struct {
+	HTTPProfile    string            `json:"http_profile,omitempty"`
+	RequestTimeout int64             `json:"request_timeout,omitempty"`  // request timeout in seconds for this branch. default to RequestTimeout of trans
+	NotBefore      *time.Time        `json:"not_before,omitempty"`       // the branch will not be executed before this time. for msg
+	KeepResult     bool              `json:"keep_result,omitempty"`      // the result is referred by other branches, so it should be saved. for saga
+	Result         string            `json:"result,omitempty"`           // the response of the succeeded action
+	ParentBranch   string            `json:"parent_branch,omitempty"`    // the branch whose try registered this branch. for nested tcc
+	ContentType    string            `json:"content_type,omitempty"`     // content type of the payload. default to json
+	RetryInterval  int64             `json:"retry_interval,omitempty"`   // retry interval in seconds for this branch. default to RetryInterval of trans
+	FailureReason  string            `json:"failure_reason,omitempty"`   // the response of the failed action, or the code and message for grpc
+	NextInterval   int64             `json:"next_interval,omitempty"`    // the current retry interval of this branch, backed off on errors
+	NextRetryTime  *time.Time        `json:"next_retry_time,omitempty"`  // this branch will not be retried before this time
+	Headers        map[string]string `json:"headers,omitempty"`          // headers of this branch, overriding BranchHeaders of the trans
+	PayloadInQuery bool              `json:"payload_in_query,omitempty"` // the payload is sent as query parameters of a GET request
+	Group          string            `json:"group,omitempty"`            // the branches of a group succeed or fail as one unit. for saga
 }
 
 // TransBranchStore branch transaction
@@ -58,11 +167,33 @@ type TransBranchStore struct {
 	Gid          string `json:"gid,omitempty"`
 	URL          string `json:"url,omitempty"`
 	BinData      []byte
-	BranchID     string     `json:"branch_id,omitempty"`
-	Op           string     `json:"op,omitempty"`
-	Status       string     `json:"status,omitempty"`
-	FinishTime   *time.Time `json:"finish_time,omitempty"`
-	RollbackTime *time.Time `json:"rollback_time,omitempty"`
+	PayloadKey   string         `json:"-"` // the key of the payload saved to the payload table of the sql store, see Store.DedupPayloadSize
+	BranchID     string         `json:"branch_id,omitempty"`
+	Op           string         `json:"op,omitempty"`
+	Status       string         `json:"status,omitempty"`
+	FinishTime   *time.Time     `json:"finish_time,omitempty"`
+	RollbackTime *time.Time     `json:"rollback_time,omitempty"`
+	Ext          TransBranchExt `json:"-" gorm:"-"`
+	ExtData      string         `json:"ext_data,omitempty"` // storage of ext. like TransGlobalStore.ExtData
+	Response     string         `json:"-" gorm:"-"`         // the response of the last call, kept for the audit trail of attempts. not saved
+	ResolvedURL  string         `json:"-" gorm:"-"`         // the url called by the last call, if URL is rewritten or resolved when called. not saved
+}
+
+// IsBranchDowngrade checks whether saving the branch over the saved one changes a finished branch to another status
+func IsBranchDowngrade(saved *TransBranchStore, branch *TransBranchStore) bool {
+	return (saved.Status == dtmcli.StatusSucceed || saved.Status == dtmcli.StatusFailed) && branch.Status != saved.Status
+}
+
+// PayloadsHash returns the hash of the branch ids, ops, urls and payloads of the branches
+func PayloadsHash(branches []TransBranchStore) string {
+	h := sha256.New()
+	for _, b := range branches {
+		for _, field := range [][]byte{[]byte(b.BranchID), []byte(b.Op), []byte(b.URL), b.BinData} {
+			_, _ = h.Write([]byte(fmt.Sprintf("%d:", len(field)))) // length prefixed, so the fields can not be shifted
+			_, _ = h.Write(field)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // TableName TableName
@@ -71,5 +202,19 @@ func (b *TransBranchStore) TableName() string {
 }
 
 func (b *TransBranchStore) String() string {
-	return dtmimp.MustMarshalString(*b)
+	return dtmimp.MustMarshalString(MaskBranches([]TransBranchStore{*b})[0])
+}
+
+// KVStore defines Key-Value storage info
+type KVStore struct {
+	dtmutil.ModelBase
+	Cat     string `json:"cat"`
+	K       string `json:"k"`
+	V       string `json:"v"`
+	Version uint64 `json:"version"` // increase by 1 for every update, used as optimistic lock
+}
+
+// TableName TableName
+func (k *KVStore) TableName() string {
+	return config.Config.Store.KVTable
 }
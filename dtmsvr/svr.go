@@ -18,16 +18,23 @@ import (
 	"github.com/dtm-labs/dtm/dtmcli/logger"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgpb"
+	"github.com/dtm-labs/dtm/dtmsvr/eventpub"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtmdriver"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/keepalive"
 )
 
 // StartSvr StartSvr
 func StartSvr() {
 	logger.Infof("start dtmsvr")
 	setServerInfoMetrics()
+	setReadOnly(conf.ReadOnly)
+	err := eventpub.Start(&conf.EventPublisher)
+	logger.FatalIfError(err)
 
+	branchResults = newBranchResultCache(int(conf.BranchResultCacheSize), time.Duration(conf.BranchResultCacheTTL)*time.Second)
 	dtmcli.GetRestyClient().SetTimeout(time.Duration(conf.RequestTimeout) * time.Second)
 	dtmgrpc.AddUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 		timeout := conf.RequestTimeout
@@ -38,10 +45,18 @@ func StartSvr() {
 		defer cancel()
 		return invoker(ctx2, method, req, reply, cc, opts...)
 	})
+	// a connecting attempt should not last longer than a request, so that unreachable targets fail fast
+	dtmgimp.DialOptions = append(dtmgimp.DialOptions, grpc.WithConnectParams(grpc.ConnectParams{
+		Backoff:           backoff.DefaultConfig,
+		MinConnectTimeout: time.Duration(conf.RequestTimeout) * time.Second,
+	}))
 
 	// start gin server
 	app := dtmutil.GetGinApp()
 	app = httpMetrics(app)
+	accessLogRates, err = conf.Log.GetAccessLogSampling()
+	logger.FatalIfError(err)
+	app = httpAccessLog(app)
 	addRoute(app)
 	addJrpcRouter(app)
 	logger.Infof("dtmsvr http listen at: %d", conf.HTTPPort)
@@ -55,7 +70,9 @@ func StartSvr() {
 	// start grpc server
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.GrpcPort))
 	logger.FatalIfError(err)
-	s := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcMetrics, dtmgimp.GrpcServerLog))
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcMetrics, grpcAccessLog, grpcReadOnly),
+		// allow the keepalive pings of dtmgimp.BalancedDialOptions
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second}))
 	dtmgpb.RegisterDtmServer(s, &dtmServer{})
 	logger.Infof("grpc listening at %v", lis.Addr())
 	go func() {
@@ -66,6 +83,12 @@ func StartSvr() {
 	for i := 0; i < int(conf.UpdateBranchAsyncGoroutineNum); i++ {
 		go updateBranchAsync()
 	}
+	mayProbeClockSkew() // at startup, before the trans are processed
+	go cronProbeClockSkew()
+	go cronSchedulingLag()
+	go cronPurgeAttempts()
+	go cronPurgePayloads()
+	go cronPurgeEvents()
 
 	time.Sleep(100 * time.Millisecond)
 	err = dtmdriver.Use(conf.MicroService.Driver)
@@ -109,6 +132,9 @@ func updateBranchAsync() {
 				time.Sleep(1 * time.Second)
 			} else {
 				logger.Infof("flushed %d branch status to db. affected: %d", len(updates), rowAffected)
+				for _, b := range updates {
+					notifyWatchers(b.Gid, changeBranchStatus)
+				}
 				updates = []TransBranch{}
 			}
 		}
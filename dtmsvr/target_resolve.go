@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+)
+
+// TargetResolver resolves the url of a branch to the url called, such as rm://inventory/cancel to
+// http://10.0.0.8:8081/api/cancel by a service discovery. it is called for every call of the branch, and the url
+// saved in the store is not changed. an error is treated as ONGOING, and the branch is retried later
+type TargetResolver interface {
+	ResolveTarget(ctx context.Context, target string) (string, error)
+}
+
+var targetResolvers sync.Map // scheme -> TargetResolver
+
+// RegisterTargetResolver registers the resolver of the urls of the scheme, such as rm for rm://inventory/cancel. the
+// trans of http can be submitted with the urls of the scheme. It should be called before the server starts
+func RegisterTargetResolver(scheme string, resolver TargetResolver) {
+	targetResolvers.Store(scheme, resolver)
+}
+
+func getTargetResolver(uri string) TargetResolver {
+	if v, ok := targetResolvers.Load(urlScheme(uri)); ok {
+		return v.(TargetResolver)
+	}
+	return nil
+}
+
+// targetRewrites is the []config.TargetRewrite replaced by the admin api at runtime. conf.TargetRewrites is used if
+// not replaced
+var targetRewrites atomic.Value
+
+func getTargetRewrites() []config.TargetRewrite {
+	if rules, ok := targetRewrites.Load().([]config.TargetRewrite); ok {
+		return rules
+	}
+	return conf.TargetRewrites
+}
+
+// setTargetRewrites replaces the rules of this server. the retries of the branches called by the old urls use the
+// new rules, without changing the store
+func setTargetRewrites(rules []config.TargetRewrite) error {
+	if err := config.CheckTargetRewrites(rules); err != nil {
+		return fmt.Errorf("%v. %w", err, dtmcli.ErrInvalidArgument)
+	}
+	targetRewrites.Store(append([]config.TargetRewrite{}, rules...))
+	logger.Infof("target rewrites replaced by %d rules", len(rules))
+	return nil
+}
+
+// rewriteTarget rewrites the url by the first matched rule
+func rewriteTarget(rules []config.TargetRewrite, uri string) string {
+	for _, r := range rules {
+		if r.Prefix != "" && strings.HasPrefix(uri, r.Prefix) {
+			return r.To + uri[len(r.Prefix):]
+		}
+		start := strings.Index(uri, "://") + 3 // the grpc urls may have no scheme, like localhost:58081/busi.Busi/TransIn
+		if start < 3 {
+			start = 0
+		}
+		end := len(uri)
+		if i := strings.IndexAny(uri[start:], "/?#"); i >= 0 {
+			end = start + i
+		}
+		if r.Host != "" && uri[start:end] == r.Host {
+			return uri[:start] + r.To + uri[end:]
+		}
+	}
+	return uri
+}
+
+// resolveTarget returns the url called for the branch, which is rewritten by the rules, and then resolved by the
+// resolver of its scheme
+func (t *TransGlobal) resolveTarget(branch *TransBranch) (string, error) {
+	target := rewriteTarget(getTargetRewrites(), branch.URL)
+	if resolver := getTargetResolver(target); resolver != nil {
+		resolved, err := resolver.ResolveTarget(logger.WithGid(context.Background(), t.Gid), target)
+		if err != nil {
+			return "", fmt.Errorf("resolve target %s error: %v. %w", target, err, dtmcli.ErrOngoing)
+		}
+		target = resolved
+	}
+	return target, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteTarget(t *testing.T) {
+	rules := []config.TargetRewrite{
+		{Host: "old:8080", To: "new:9090"},
+		{Prefix: "http://legacy/api/", To: "rm://inventory/"},
+	}
+	assert.Equal(t, "http://new:9090/api/action?a=1", rewriteTarget(rules, "http://old:8080/api/action?a=1"))
+	assert.Equal(t, "http://new:9090", rewriteTarget(rules, "http://old:8080"))
+	assert.Equal(t, "new:9090/busi.Busi/TransIn", rewriteTarget(rules, "old:8080/busi.Busi/TransIn"))
+	assert.Equal(t, "http://old:80801/api", rewriteTarget(rules, "http://old:80801/api"))
+	assert.Equal(t, "rm://inventory/cancel", rewriteTarget(rules, "http://legacy/api/cancel"))
+	assert.Equal(t, "http://other/api", rewriteTarget(rules, "http://other/api"))
+	assert.Equal(t, "http://other/api", rewriteTarget(nil, "http://other/api"))
+}
+
+type mapResolver map[string]string
+
+func (m mapResolver) ResolveTarget(ctx context.Context, target string) (string, error) {
+	name := strings.SplitN(strings.TrimPrefix(target, "rm://"), "/", 2)
+	if m[name[0]] == "" {
+		return "", errors.New("no instance of " + name[0])
+	}
+	return m[name[0]] + "/" + name[1], nil
+}
+
+func TestTargetResolver(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer svr.Close()
+	resolver := mapResolver{}
+	RegisterTargetResolver("rm", resolver)
+	defer targetResolvers.Delete("rm")
+	branches := []TransBranch{{BranchID: "01", Op: dtmcli.BranchAction, URL: "rm://inventory/cancel"}}
+	assert.Nil(t, checkBranchProtocols("http", branches))
+
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.Protocol = "TestTargetResolver", "saga", "http"
+	err := tg.getURLResult(&branches[0])
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	assert.Contains(t, err.Error(), "no instance of inventory")
+
+	resolver["inventory"] = svr.URL + "/api"
+	assert.Nil(t, tg.getURLResult(&branches[0]))
+	assert.Equal(t, "rm://inventory/cancel", branches[0].URL)
+	assert.Equal(t, svr.URL+"/api/cancel", branches[0].ResolvedURL)
+	assert.Equal(t, svr.URL+"/api/cancel", tg.newAttempt(&branches[0], tg.lastTouched, nil).Target)
+}
+
+func TestTargetRewriteOldHost(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+	defer targetRewrites.Store([]config.TargetRewrite(nil))
+
+	calls := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	defer svr.Close()
+	oldHost := "127.0.0.1:1" // the moved RM, refusing the connections
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.Protocol = "TestTargetRewriteOldHost", "saga", "http"
+	tg.Status = dtmcli.StatusSubmitted
+	tg.Steps = []map[string]string{{dtmcli.BranchAction: "http://" + oldHost + "/api/action", dtmcli.BranchCompensate: "http://" + oldHost + "/api/compensate"}}
+	tg.BinPayloads = [][]byte{[]byte("{}")}
+	_, err := tg.saveNew()
+	assert.Nil(t, err)
+
+	process := func() *TransGlobal {
+		t := &TransGlobal{TransGlobalStore: *GetStore().FindTransGlobalStore(tg.Gid)}
+		t.WaitResult = true
+		_ = t.Process(t.loadBranches())
+		return t
+	}
+	assert.Equal(t, dtmcli.StatusSubmitted, process().Status)
+	assert.Equal(t, 0, calls)
+
+	assert.Nil(t, setTargetRewrites([]config.TargetRewrite{{Host: oldHost, To: strings.TrimPrefix(svr.URL, "http://")}}))
+	assert.Equal(t, dtmcli.StatusSucceed, process().Status)
+	assert.Equal(t, 1, calls)
+	for _, b := range GetStore().FindBranches(tg.Gid) {
+		assert.Contains(t, b.URL, oldHost) // the store is not changed
+	}
+
+	err = setTargetRewrites([]config.TargetRewrite{{Host: oldHost}})
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+}
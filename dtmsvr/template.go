@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// templatesCat is the cat of templates in kv storage
+const templatesCat = "templates"
+
+// TransTemplate is a trans without gid and payloads registered on dtm server, so that the APs submit only the gid and
+// the payloads of the branches by submit_template. it is registered in the same json as the trans it expands to, with
+// a name. Version is the version of the kv, which is increased by every registration of the name
+type TransTemplate struct {
+	Name          string              `json:"name"`
+	Version       uint64              `json:"version,omitempty"`
+	TransType     string              `json:"trans_type"`
+	Steps         []map[string]string `json:"steps"`
+	QueryPrepared string              `json:"query_prepared,omitempty"`
+	Protocol      string              `json:"protocol,omitempty"`
+	CustomData    string              `json:"custom_data,omitempty"`
+	dtmcli.TransOptions
+}
+
+// TemplateSubmit is the request of submit_template. Payloads are the payloads of the steps of the template in order
+type TemplateSubmit struct {
+	Gid      string   `json:"gid"`
+	Template string   `json:"template"`
+	Payloads []string `json:"payloads"`
+}
+
+func findTemplate(name string) (*storage.KVStore, *TransTemplate) {
+	kvs := GetStore().FindKV(templatesCat, name)
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	tpl := TransTemplate{}
+	dtmimp.MustUnmarshalString(kvs[0].V, &tpl)
+	tpl.Name, tpl.Version = kvs[0].K, kvs[0].Version
+	return &kvs[0], &tpl
+}
+
+// expand returns the trans of the template with the gid and the payloads. the steps are copied, so that the trans
+// is not affected by the later versions of the template
+func (tpl *TransTemplate) expand(gid string, payloads []string) (*TransGlobal, error) {
+	if len(payloads) != len(tpl.Steps) {
+		return nil, fmt.Errorf("template %s has %d steps, but %d payloads are submitted. %w", tpl.Name, len(tpl.Steps), len(payloads), dtmcli.ErrInvalidArgument)
+	}
+	t := &TransGlobal{}
+	t.Gid, t.TransType, t.QueryPrepared, t.Protocol, t.CustomData = gid, tpl.TransType, tpl.QueryPrepared, tpl.Protocol, tpl.CustomData
+	t.TransOptions = tpl.TransOptions
+	for _, step := range tpl.Steps {
+		s := map[string]string{}
+		for k, v := range step {
+			s[k] = v
+		}
+		t.Steps = append(t.Steps, s)
+	}
+	t.Payloads = payloads
+	t.Ext.Template = &storage.TemplateRef{Name: tpl.Name, Version: tpl.Version}
+	return t, nil
+}
+
+// checkTemplate checks the template by the checks of a new trans, with empty payloads
+func (tpl *TransTemplate) checkTemplate() (rerr error) {
+	defer dtmimp.P2E(&rerr)
+	if tpl.Name == "" {
+		return fmt.Errorf("name of template should not be empty. %w", dtmcli.ErrInvalidArgument)
+	}
+	if tpl.TransType != "saga" && tpl.TransType != "msg" {
+		return fmt.Errorf("trans type %s is not supported by template, only saga and msg. %w", tpl.TransType, dtmcli.ErrInvalidArgument)
+	}
+	if len(tpl.Steps) == 0 {
+		return fmt.Errorf("template %s has no steps. %w", tpl.Name, dtmcli.ErrInvalidArgument)
+	}
+	for i, step := range tpl.Steps {
+		if step[dtmcli.BranchAction] == "" {
+			return fmt.Errorf("step %d of template %s has no action. %w", i, tpl.Name, dtmcli.ErrInvalidArgument)
+		} else if step["data"] != "" {
+			return fmt.Errorf("step %d of template %s should not have data, which is submitted as a payload. %w", i, tpl.Name, dtmcli.ErrInvalidArgument)
+		}
+	}
+	t, err := tpl.expand("template-"+tpl.Name, make([]string, len(tpl.Steps)))
+	if err == nil {
+		t.setupPayloads()
+		_, err = t.prepareNew()
+	}
+	return err
+}
+
+// svcRegisterTemplate registers a template, or a new version of it if the name exists. the trans submitted by the
+// old versions are not affected
+func svcRegisterTemplate(tpl *TransTemplate) interface{} {
+	if err := tpl.checkTemplate(); err != nil {
+		return err
+	}
+	tpl.Version = 0
+	value := dtmimp.MustMarshalString(tpl)
+	for { // retry if the template is registered concurrently
+		kv, _ := findTemplate(tpl.Name)
+		var err error
+		if kv == nil {
+			kv = &storage.KVStore{Version: 1}
+			err = GetStore().CreateKV(templatesCat, tpl.Name, value)
+		} else {
+			kv.V = value
+			err = GetStore().UpdateKV(kv)
+		}
+		if err == nil {
+			logger.Infof("register template %s version %d", tpl.Name, kv.Version)
+			return map[string]interface{}{"dtm_result": dtmcli.ResultSuccess, "version": kv.Version}
+		} else if err != storage.ErrUniqueConflict && err != storage.ErrNotFound {
+			return err
+		}
+	}
+}
+
+// listTemplates returns the templates. only the specified template is returned if name is not empty
+func listTemplates(name string) []TransTemplate {
+	templates := []TransTemplate{}
+	for _, kv := range GetStore().FindKV(templatesCat, name) {
+		tpl := TransTemplate{}
+		dtmimp.MustUnmarshalString(kv.V, &tpl)
+		tpl.Name, tpl.Version = kv.K, kv.Version
+		templates = append(templates, tpl)
+	}
+	return templates
+}
+
+// expandTemplate returns the trans of the current version of the template in the request
+func expandTemplate(req *TemplateSubmit) (*TransGlobal, error) {
+	if req.Template == "" {
+		return nil, fmt.Errorf("no template specified. %w", dtmcli.ErrInvalidArgument)
+	}
+	_, tpl := findTemplate(req.Template)
+	if tpl == nil {
+		return nil, fmt.Errorf("template %s not found. %w", req.Template, dtmcli.ErrInvalidArgument)
+	}
+	return tpl.expand(req.Gid, req.Payloads)
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateExpand(t *testing.T) {
+	tpl := TransTemplate{Name: "tpl", Version: 3, TransType: "saga", CustomData: `{"concurrent":true}`}
+	tpl.Steps = []map[string]string{{"action": "http://busi/out", "compensate": "http://busi/revert"}}
+	tpl.RetryInterval = 10
+	_, err := tpl.expand("gid1", nil)
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+
+	trans, err := tpl.expand("gid1", []string{`{"amount":30}`})
+	assert.Nil(t, err)
+	assert.Equal(t, "gid1", trans.Gid)
+	assert.Equal(t, int64(10), trans.RetryInterval)
+	assert.Equal(t, tpl.CustomData, trans.CustomData)
+	assert.Equal(t, &storage.TemplateRef{Name: "tpl", Version: 3}, trans.Ext.Template)
+	trans.Steps[0]["action"] = "http://busi/changed" // the template is not changed
+	assert.Equal(t, "http://busi/out", tpl.Steps[0]["action"])
+}
+
+func TestCheckTemplate(t *testing.T) {
+	valid := TransTemplate{Name: "tpl", TransType: "msg", Steps: []map[string]string{{"action": "http://busi/in"}}}
+	assert.Nil(t, valid.checkTemplate())
+	cases := []TransTemplate{
+		{TransType: "msg", Steps: valid.Steps},
+		{Name: "tpl", TransType: "tcc", Steps: valid.Steps},
+		{Name: "tpl", TransType: "saga"},
+		{Name: "tpl", TransType: "saga", Steps: []map[string]string{{"compensate": "http://busi/revert"}}},
+		{Name: "tpl", TransType: "msg", Steps: []map[string]string{{"action": "http://busi/in", "data": "{}"}}},
+		{Name: "tpl", TransType: "msg", Steps: []map[string]string{{"action": "http://busi/in", "headers": "not json"}}},
+	}
+	for i, c := range cases {
+		assert.True(t, errors.Is(c.checkTemplate(), dtmcli.ErrInvalidArgument), i)
+	}
+	over := valid
+	over.TimeoutToFail = 10
+	over.Steps = []map[string]string{{"action": "http://busi/in", "retry_interval": "20"}}
+	over.TransType = "saga"
+	assert.True(t, errors.Is(over.checkTemplate(), dtmcli.ErrFailure)) // by the duration budget
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// topicsCat is the cat of topics in kv storage
+const topicsCat = "topics"
+
+// Subscriber defines a subscriber of a topic
+type Subscriber struct {
+	URL    string `json:"url"`
+	Remark string `json:"remark,omitempty"`
+}
+
+func findSubscribers(topic string) (*storage.KVStore, []Subscriber) {
+	kvs := GetStore().FindKV(topicsCat, topic)
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	subscribers := []Subscriber{}
+	dtmimp.MustUnmarshalString(kvs[0].V, &subscribers)
+	return &kvs[0], subscribers
+}
+
+func svcSubscribe(topic, url, remark string) error {
+	if topic == "" || url == "" {
+		return fmt.Errorf("topic and url should not be empty. %w", dtmcli.ErrFailure)
+	}
+	for { // retry if the topic is updated concurrently
+		kv, subscribers := findSubscribers(topic)
+		for _, s := range subscribers {
+			if s.URL == url {
+				return fmt.Errorf("url %s has already subscribed topic %s. %w", url, topic, dtmcli.ErrFailure)
+			}
+		}
+		subscribers = append(subscribers, Subscriber{URL: url, Remark: remark})
+		var err error
+		if kv == nil {
+			err = GetStore().CreateKV(topicsCat, topic, dtmimp.MustMarshalString(subscribers))
+		} else {
+			kv.V = dtmimp.MustMarshalString(subscribers)
+			err = GetStore().UpdateKV(kv)
+		}
+		if err != storage.ErrUniqueConflict && err != storage.ErrNotFound {
+			logger.Infof("subscribe topic %s url %s result: %v", topic, url, err)
+			return err
+		}
+	}
+}
+
+func svcUnsubscribe(topic, url string) error {
+	for { // retry if the topic is updated concurrently
+		kv, subscribers := findSubscribers(topic)
+		left := []Subscriber{}
+		for _, s := range subscribers {
+			if s.URL != url {
+				left = append(left, s)
+			}
+		}
+		if len(left) == len(subscribers) {
+			return fmt.Errorf("url %s has not subscribed topic %s. %w", url, topic, dtmcli.ErrFailure)
+		}
+		var err error
+		if len(left) == 0 {
+			err = GetStore().DeleteKV(topicsCat, topic)
+		} else {
+			kv.V = dtmimp.MustMarshalString(left)
+			err = GetStore().UpdateKV(kv)
+		}
+		if err != storage.ErrNotFound {
+			logger.Infof("unsubscribe topic %s url %s result: %v", topic, url, err)
+			return err
+		}
+	}
+}
+
+func listTopics(topic string) map[string][]Subscriber {
+	topics := map[string][]Subscriber{}
+	for _, kv := range GetStore().FindKV(topicsCat, topic) {
+		subscribers := []Subscriber{}
+		dtmimp.MustUnmarshalString(kv.V, &subscribers)
+		topics[kv.K] = subscribers
+	}
+	return topics
+}
+
+// checkTopics checks every topic of the msg has subscribers
+func (t *TransGlobal) checkTopics() error {
+	for _, step := range t.Steps {
+		if topic := strings.TrimPrefix(step[dtmcli.BranchAction], dtmimp.MsgTopicPrefix); topic != step[dtmcli.BranchAction] {
+			if t.TransType != "msg" {
+				return fmt.Errorf("topic is only supported by msg. %w", dtmcli.ErrFailure)
+			}
+			if _, subscribers := findSubscribers(topic); len(subscribers) == 0 {
+				return fmt.Errorf("topic %s has no subscribers. %w", topic, dtmcli.ErrFailure)
+			}
+		}
+	}
+	return nil
+}
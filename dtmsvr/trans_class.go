@@ -8,6 +8,10 @@ package dtmsvr
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
@@ -24,12 +28,26 @@ type TransGlobal struct {
 	storage.TransGlobalStore
 	lastTouched      time.Time // record the start time of process
 	updateBranchSync bool
+	touchedCronTime  *time.Time      // the cron time touched in the current process
+	branchRetryTime  *time.Time      // the earliest retry time of the branches with their own retry interval in the current process
+	branchOffset     int             // the position of the first branch loaded, if the branches are loaded by pages
+	partialBranches  bool            // some branches after the loaded ones are not loaded, so the trans should not finish
+	batchTouch       bool            // the cron time touches are collected by cronTouches, instead of written at once
+	invoker          BranchInvoker   // calls the branches instead of their protocols, set by ProcessWith
+	store            ChangePersister // persists the writes instead of the store, set by ProcessWith
+	caller           string          // the token of the caller creating or changing the trans, checked by checkClaim
 }
 
 func (t *TransGlobal) setupPayloads() {
 	// Payloads will be store in BinPayloads, Payloads is only used to Unmarshal
-	for _, p := range t.Payloads {
-		t.BinPayloads = append(t.BinPayloads, []byte(p))
+	for i, p := range t.Payloads {
+		contentType := ""
+		if i < len(t.Steps) {
+			contentType = t.Steps[i]["content_type"]
+		}
+		b, err := dtmimp.DecodeBinPayload(p, contentType)
+		e2p(err)
+		t.BinPayloads = append(t.BinPayloads, b)
 	}
 	for _, d := range t.Steps {
 		if d["data"] != "" {
@@ -45,8 +63,78 @@ func (t *TransGlobal) setupPayloads() {
 // TransBranch branch transaction
 type TransBranch = storage.TransBranchStore
 
+// branchExtFromMap build the Ext of branch from the step or the register data
+func branchExtFromMap(m map[string]string) (storage.TransBranchExt, error) {
+	ext := storage.TransBranchExt{HTTPProfile: m["http_profile"], ParentBranch: m["parent_branch"], ContentType: m["content_type"], Group: m["group"]}
+	var err error
+	if ext.RequestTimeout, err = branchInt(m, "request_timeout"); err != nil {
+		return ext, err
+	}
+	if ext.RetryInterval, err = branchInt(m, "retry_interval"); err != nil {
+		return ext, err
+	}
+	if m["headers"] != "" {
+		dtmimp.MustUnmarshalString(m["headers"], &ext.Headers)
+	}
+	ext.PayloadInQuery = m["payload_in_query"] == "1"
+	return ext, nil
+}
+
+// branchInt parses the integer of the key in the step or the register data. 0 is returned if it is empty
+func branchInt(m map[string]string, key string) (int64, error) {
+	if m[key] == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(m[key])
+	if err != nil {
+		return 0, fmt.Errorf("%s %q of the branch should be an integer. %w", key, m[key], dtmcli.ErrInvalidArgument)
+	}
+	return int64(v), nil
+}
+
+// checkBranchHeaders checks the headers of a branch in the step or the register data, which is a json object
+func checkBranchHeaders(m map[string]string) error {
+	if m["headers"] == "" {
+		return nil
+	}
+	headers := map[string]string{}
+	if err := json.Unmarshal([]byte(m["headers"]), &headers); err != nil {
+		return fmt.Errorf("headers should be a json object of strings: %v. %w", err, dtmcli.ErrInvalidArgument)
+	}
+	size := 0
+	for k, v := range headers {
+		if k == "" || strings.ContainsAny(k, " :\r\n") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid header %q. %w", k, dtmcli.ErrInvalidArgument)
+		}
+		size += len(k) + len(v)
+	}
+	if limit := int(conf.BranchHeadersLimit); limit > 0 && size > limit {
+		return fmt.Errorf("size %d of the headers of a branch exceeds the limit %d. %w", size, limit, dtmcli.ErrInvalidArgument)
+	}
+	return nil
+}
+
+// marshalBranchesExt save the Ext of branches to ExtData
+func marshalBranchesExt(branches []TransBranch) {
+	for i := range branches {
+		branches[i].ExtData = dtmimp.MustMarshalString(branches[i].Ext)
+		if branches[i].ExtData == "{}" {
+			branches[i].ExtData = ""
+		}
+	}
+}
+
+// unmarshalBranchesExt load the Ext of branches from ExtData
+func unmarshalBranchesExt(branches []TransBranch) {
+	for i := range branches {
+		if branches[i].ExtData != "" {
+			dtmimp.MustUnmarshalString(branches[i].ExtData, &branches[i].Ext)
+		}
+	}
+}
+
 type transProcessor interface {
-	GenBranches() []TransBranch
+	GenBranches() ([]TransBranch, error)
 	ProcessOnce(branches []TransBranch) error
 }
 
@@ -77,17 +165,52 @@ func TransFromContext(c *gin.Context) *TransGlobal {
 	m := TransGlobal{}
 	dtmimp.MustUnmarshal(b, &m)
 	logger.Debugf("creating trans in prepare")
+	setupHTTPTrans(c, &m)
+	return &m
+}
+
+// TransBatchFromContext returns the trans of a batch request, whose body is {"trans": [...]}
+func TransBatchFromContext(c *gin.Context) []*TransGlobal {
+	b, err := c.GetRawData()
+	e2p(err)
+	batch := struct {
+		Trans []*TransGlobal `json:"trans"`
+	}{}
+	dtmimp.MustUnmarshal(b, &batch)
+	for i, m := range batch.Trans {
+		if m == nil { // rejected by the gid check
+			batch.Trans[i] = &TransGlobal{}
+		}
+		setupHTTPTrans(c, batch.Trans[i])
+	}
+	return batch.Trans
+}
+
+func setupHTTPTrans(c *gin.Context, m *TransGlobal) {
 	m.setupPayloads()
+	m.caller = callerToken(c)
 	m.Ext.Headers = map[string]string{}
-	if len(m.PassthroughHeaders) > 0 {
-		for _, h := range m.PassthroughHeaders {
-			v := c.GetHeader(h)
-			if v != "" {
-				m.Ext.Headers[h] = v
-			}
+	for _, h := range passthroughHeaders(m.PassthroughHeaders) {
+		v := c.GetHeader(h)
+		if v != "" {
+			m.Ext.Headers[h] = v
 		}
 	}
-	return &m
+}
+
+// passthroughHeaders returns the headers specified by the trans, and the headers configured in dtm server
+func passthroughHeaders(headers []string) []string {
+	result := append([]string{}, headers...)
+	specified := map[string]bool{}
+	for _, h := range headers {
+		specified[strings.ToLower(h)] = true
+	}
+	for _, h := range strings.Split(conf.PassthroughHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" && !specified[strings.ToLower(h)] {
+			result = append(result, h)
+		}
+	}
+	return result
 }
 
 // TransFromDtmRequest TransFromContext
@@ -96,6 +219,9 @@ func TransFromDtmRequest(ctx context.Context, c *dtmgpb.DtmRequest) *TransGlobal
 	if c.TransOptions != nil {
 		o = c.TransOptions
 	}
+	tryTimeout, _ := strconv.ParseInt(dtmgimp.GetMetaFromContext(ctx, "dtm-try_timeout"), 10, 64)
+	quorum, _ := strconv.Atoi(dtmgimp.GetMetaFromContext(ctx, "dtm-query_prepared_quorum"))
+	priority, _ := strconv.Atoi(dtmgimp.GetMetaFromContext(ctx, "dtm-priority"))
 	r := TransGlobal{TransGlobalStore: storage.TransGlobalStore{
 		Gid:           c.Gid,
 		TransType:     c.TransType,
@@ -104,20 +230,31 @@ func TransFromDtmRequest(ctx context.Context, c *dtmgpb.DtmRequest) *TransGlobal
 		BinPayloads:   c.BinPayloads,
 		CustomData:    c.CustomedData,
 		TransOptions: dtmcli.TransOptions{
-			WaitResult:         o.WaitResult,
-			TimeoutToFail:      o.TimeoutToFail,
-			RetryInterval:      o.RetryInterval,
-			PassthroughHeaders: o.PassthroughHeaders,
-			BranchHeaders:      o.BranchHeaders,
-			RequestTimeout:     o.RequestTimeout,
+			WaitResult:          o.WaitResult,
+			TimeoutToFail:       o.TimeoutToFail,
+			RetryInterval:       o.RetryInterval,
+			PassthroughHeaders:  o.PassthroughHeaders,
+			BranchHeaders:       o.BranchHeaders,
+			RequestTimeout:      o.RequestTimeout,
+			Tenant:              dtmgimp.GetMetaFromContext(ctx, "dtm-tenant"),
+			TryTimeout:          tryTimeout,
+			QueryPreparedQuorum: quorum,
+			Priority:            priority,
 		},
 	}}
+	r.caller = grpcCallerToken(ctx)
+	if results := dtmgimp.GetMetaFromContext(ctx, "dtm-grpc_code_results"); results != "" {
+		dtmimp.MustUnmarshalString(results, &r.GrpcCodeResults)
+	}
+	if urls := dtmgimp.GetMetaFromContext(ctx, "dtm-query_prepared_urls"); urls != "" {
+		r.QueryPreparedURLs = strings.Split(urls, ",")
+	}
 	if c.Steps != "" {
 		dtmimp.MustUnmarshalString(c.Steps, &r.Steps)
 	}
-	if len(o.PassthroughHeaders) > 0 {
+	if headers := passthroughHeaders(o.PassthroughHeaders); len(headers) > 0 {
 		r.Ext.Headers = map[string]string{}
-		for _, h := range o.PassthroughHeaders {
+		for _, h := range headers {
 			v := dtmgimp.GetMetaFromContext(ctx, h)
 			if v != "" {
 				r.Ext.Headers[h] = v
@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassthroughHeaders(t *testing.T) {
+	conf.PassthroughHeaders = "x-request-id, Authorization"
+	defer func() { conf.PassthroughHeaders = "" }()
+	assert.Equal(t, []string{"authorization", "x-request-id"}, passthroughHeaders([]string{"authorization"}))
+}
+
+func TestMaskSensitiveHeaders(t *testing.T) {
+	old := conf.SensitiveHeaders
+	conf.SensitiveHeaders = "authorization,cookie"
+	defer func() { conf.SensitiveHeaders = old }()
+	g := storage.TransGlobalStore{}
+	g.ExtData = dtmimp.MustMarshalString(storage.TransGlobalExt{Headers: map[string]string{"Authorization": "Bearer t1", "x-request-id": "r1"}})
+	g.Options = dtmimp.MustMarshalString(map[string]interface{}{"branch_headers": map[string]string{"cookie": "c1"}})
+	g.BranchHeaders = map[string]string{"cookie": "c1"}
+	s := g.String()
+	assert.NotContains(t, s, "Bearer t1")
+	assert.NotContains(t, s, "c1")
+	assert.Contains(t, s, "r1")
+	assert.Equal(t, "c1", g.BranchHeaders["cookie"]) // the trans itself is not changed
+
+	conf.ShowSensitiveHeaders = 1
+	defer func() { conf.ShowSensitiveHeaders = 0 }()
+	assert.Contains(t, g.String(), "Bearer t1")
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/eventpub"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// emitEvent emits the lifecycle event of current status. oldStatus is empty for a new trans
+func (t *TransGlobal) emitEvent(oldStatus string) {
+	if !eventpub.Enabled() {
+		return
+	}
+	now := time.Now()
+	eventpub.Emit(&eventpub.Event{
+		Gid:            t.Gid,
+		TransType:      t.TransType,
+		Seq:            t.Ext.EventSeq,
+		OldStatus:      oldStatus,
+		NewStatus:      t.Status,
+		CreateTime:     t.CreateTime,
+		FinishTime:     t.FinishTime,
+		RollbackTime:   t.RollbackTime,
+		RollbackReason: t.RollbackReason,
+		CustomData:     t.Masked().CustomData,
+		EventTime:      now,
+		LogSeq:         t.logEvent(oldStatus, now),
+	})
+}
+
+// logEvent saves the event to the event log if EventLog is enabled, and returns its seq. an error is logged only, so
+// the event is still published, without a seq
+func (t *TransGlobal) logEvent(oldStatus string, now time.Time) int64 {
+	if conf.EventLog.Enabled != 1 {
+		return 0
+	}
+	record := &storage.EventRecord{
+		Gid:       t.Gid,
+		TransType: t.TransType,
+		EventSeq:  t.Ext.EventSeq,
+		OldStatus: oldStatus,
+		NewStatus: t.Status,
+		EventTime: &now,
+	}
+	err := dtmimp.CatchP(func() { dtmimp.E2P(t.persister().SaveEvent(record)) })
+	if err != nil {
+		logger.Gid(t.Gid).Errorf("saving event %d of status %s to the event log failed: %v", t.Ext.EventSeq, t.Status, err)
+	}
+	return record.Seq
+}
+
+// eventOfRecord returns the event republished from the event log
+func eventOfRecord(r *storage.EventRecord) *eventpub.Event {
+	e := &eventpub.Event{
+		Gid:       r.Gid,
+		TransType: r.TransType,
+		Seq:       r.EventSeq,
+		OldStatus: r.OldStatus,
+		NewStatus: r.NewStatus,
+		LogSeq:    r.Seq,
+		Replay:    true,
+	}
+	if r.EventTime != nil {
+		e.EventTime = *r.EventTime
+	}
+	return e
+}
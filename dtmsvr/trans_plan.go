@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+// the actions of the next processing of a trans
+const (
+	planQueryPrepared   = "query_prepared"   // query the prepared msg, then process it if submitted
+	planExecuteBranches = "execute_branches" // call the branches marked execute
+	planChangeStatus    = "change_status"    // no branch to call, the trans goes to next status
+	planWaitDelay       = "wait_delay"       // the trans or its branches are delayed
+	planNone            = "none"             // nothing to do now
+)
+
+// the skip reasons of the branches which need no execution in this phase
+const (
+	skipNotInPhase   = "not in current phase"
+	skipActionNotRun = "action not executed"
+)
+
+// transPlan is what the cron processor would do next for a trans, returned by the dry run
+type transPlan struct {
+	Gid              string          `json:"gid"`
+	TransType        string          `json:"trans_type"`
+	Status           string          `json:"status"`
+	Action           string          `json:"action"`
+	NextStatus       string          `json:"next_status,omitempty"` // the status changed to before or after the branches are called
+	Reason           string          `json:"reason,omitempty"`
+	Branches         []plannedBranch `json:"branches"`
+	NextCronTime     *time.Time      `json:"next_cron_time"`
+	NextCronInterval int64           `json:"next_cron_interval"`
+	BackoffInterval  int64           `json:"backoff_interval"` // the cron interval if the next processing fails
+	ManualReason     string          `json:"manual_reason,omitempty"`
+	Panics           int             `json:"panics,omitempty"` // the consecutive panics of processing the trans
+}
+
+// plannedBranch is a branch in the plan, with whether it would be called and why not
+type plannedBranch struct {
+	BranchID    string `json:"branch_id"`
+	Op          string `json:"op"`
+	Status      string `json:"status"`
+	URL         string `json:"url"`
+	PayloadSize int    `json:"payload_size"`
+	Execute     bool   `json:"execute"`
+	Order       int    `json:"order,omitempty"` // 1 based order of the calls. concurrent branches are called in this order
+	SkipReason  string `json:"skip_reason,omitempty"`
+}
+
+// planTrans returns the plan of the next processing of the trans, without any side effect
+func planTrans(t *TransGlobal, branches []TransBranch) *transPlan {
+	plan := &transPlan{
+		Gid:              t.Gid,
+		TransType:        t.TransType,
+		Status:           t.Status,
+		Action:           planNone,
+		Branches:         make([]plannedBranch, len(branches)),
+		NextCronTime:     t.NextCronTime,
+		NextCronInterval: t.NextCronInterval,
+		BackoffInterval:  t.getNextCronInterval(cronBackoff),
+		ManualReason:     t.Ext.ManualReason,
+		Panics:           t.Ext.Panics,
+	}
+	for i, b := range branches {
+		plan.Branches[i] = plannedBranch{BranchID: b.BranchID, Op: b.Op, Status: b.Status, URL: b.URL, PayloadSize: len(b.BinData)}
+	}
+	status := t.Status
+	if status == dtmcli.StatusSucceed || status == dtmcli.StatusFailed {
+		plan.Reason = "trans is finished"
+		plan.skipAll(branches, "trans is finished")
+		return plan
+	}
+	if t.TransType == "saga" && status == dtmcli.StatusSubmitted && t.isTimeout() {
+		status = dtmcli.StatusAborting
+		plan.NextStatus, plan.Reason = status, "timeout"
+	} else if reason := t.preparedTimeoutReason(); t.TransType != "saga" && t.TransType != "msg" && status == dtmcli.StatusPrepared && reason != "" {
+		status = dtmcli.StatusAborting
+		plan.NextStatus, plan.Reason = status, reason
+	}
+	switch t.TransType {
+	case "saga":
+		plan.planSaga(t, branches, status)
+	case "tcc", "xa":
+		if status == dtmcli.StatusPrepared {
+			plan.Reason = "waiting for the trans to be submitted or aborted"
+			plan.skipAll(branches, "trans not submitted")
+			return plan
+		}
+		var toRun []int
+		var op string
+		if t.TransType == "tcc" {
+			op = dtmimp.If(status == dtmcli.StatusSubmitted, dtmcli.BranchConfirm, dtmcli.BranchCancel).(string)
+			toRun = tccBranchesToRun(branches, op)
+		} else {
+			op = dtmimp.If(status == dtmcli.StatusSubmitted, dtmcli.BranchCommit, dtmcli.BranchRollback).(string)
+			toRun = xaBranchesToRun(branches, op)
+		}
+		plan.planBranches(branches, toRun, op)
+		plan.mayFinish(dtmimp.If(status == dtmcli.StatusSubmitted, dtmcli.StatusSucceed, dtmcli.StatusFailed).(string))
+	case "msg":
+		plan.planMsg(t, branches, status)
+	}
+	return plan
+}
+
+func (p *transPlan) skipAll(branches []TransBranch, reason string) {
+	for i := range branches {
+		p.Branches[i].SkipReason = reason
+	}
+}
+
+// planBranches marks the branches in toRun to execute by their order, and the skip reasons of the others
+func (p *transPlan) planBranches(branches []TransBranch, toRun []int, op string) {
+	for _, i := range toRun {
+		b := &branches[i]
+		if b.Ext.NextRetryTime != nil && storage.Now().Add(CronForwardDuration).Before(*b.Ext.NextRetryTime) {
+			p.Branches[i].SkipReason = "retry at " + b.Ext.NextRetryTime.Format(time.RFC3339)
+			continue
+		}
+		p.Action = planExecuteBranches
+		p.Branches[i].Execute = true
+		p.Branches[i].Order = len(p.executing())
+	}
+	for i, b := range branches {
+		if p.Branches[i].Execute || p.Branches[i].SkipReason != "" {
+			continue
+		}
+		if b.Op != op {
+			p.Branches[i].SkipReason = skipNotInPhase
+		} else if b.Status == dtmcli.StatusSucceed {
+			p.Branches[i].SkipReason = "already succeeded"
+		} else if b.Status == dtmcli.StatusFailed {
+			p.Branches[i].SkipReason = "already failed"
+		}
+	}
+}
+
+func (p *transPlan) executing() []int {
+	positions := []int{}
+	for i, b := range p.Branches {
+		if b.Execute {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
+
+// mayFinish sets the next status if no branch is left
+func (p *transPlan) mayFinish(status string) {
+	for _, b := range p.Branches {
+		if b.SkipReason != "" && b.Status == dtmcli.StatusPrepared && b.SkipReason != skipNotInPhase && b.SkipReason != skipActionNotRun {
+			return // some branch is waiting
+		}
+	}
+	if p.Action == planExecuteBranches {
+		p.NextStatus = status // after all the branches succeed
+	} else {
+		p.Action, p.NextStatus = planChangeStatus, status
+	}
+}
+
+func (p *transPlan) planSaga(t *TransGlobal, branches []TransBranch, status string) {
+	csc := parseSagaCustom(t.CustomData)
+	results := make([]branchResult, len(branches))
+	failed := false
+	for i, b := range branches {
+		results[i] = branchResult{index: i, status: b.Status, op: b.Op}
+		failed = failed || b.Op == dtmcli.BranchAction && b.Status == dtmcli.StatusFailed
+	}
+	sp := &sagaPlan{csc: csc, results: results, groups: sagaGroups(branches)}
+	if status == dtmcli.StatusSubmitted && failed {
+		status = dtmcli.StatusAborting
+		p.NextStatus, p.Reason = status, "branch action failed"
+	}
+	if status == dtmcli.StatusSubmitted {
+		p.planBranches(branches, sp.pickActions(), dtmcli.BranchAction)
+		for i := 1; i < len(branches); i += 2 {
+			if p.Branches[i].SkipReason == "" && !p.Branches[i].Execute {
+				p.Branches[i].SkipReason = sp.actionBlocker(i)
+			}
+		}
+		p.limitParallel(csc.MaxParallel)
+		p.mayFinish(dtmcli.StatusSucceed)
+		return
+	}
+	sp.markMayRun()
+	p.planBranches(branches, sp.pickCompensates(), dtmcli.BranchCompensate)
+	for i := 0; i < len(branches); i += 2 {
+		if p.Branches[i].SkipReason == "" && !p.Branches[i].Execute {
+			p.Branches[i].SkipReason = sp.compensateBlocker(i)
+		}
+	}
+	p.limitParallel(csc.MaxParallel)
+	p.mayFinish(dtmcli.StatusFailed)
+}
+
+// limitParallel skips the branches beyond max parallel. they are picked when some branch is done
+func (p *transPlan) limitParallel(maxParallel int) {
+	if maxParallel <= 0 {
+		return
+	}
+	executing := p.executing()
+	for _, i := range executing {
+		if p.Branches[i].Order > maxParallel {
+			p.Branches[i].Execute, p.Branches[i].Order = false, 0
+			p.Branches[i].SkipReason = fmt.Sprintf("max parallel %d reached", maxParallel)
+		}
+	}
+}
+
+func (p *transPlan) planMsg(t *TransGlobal, branches []TransBranch, status string) {
+	if status == dtmcli.StatusPrepared {
+		p.skipAll(branches, "msg not submitted")
+		if t.isTimeout() {
+			p.Action, p.Reason = planQueryPrepared, "prepared msg timeout"
+		} else {
+			p.Reason = "waiting for the msg to be submitted"
+		}
+		return
+	}
+	cmc := cMsgCustom{Delay: 0}
+	if t.CustomData != "" {
+		dtmimp.MustUnmarshalString(t.CustomData, &cmc)
+	}
+	if cmc.Delay > 0 && t.needDelay(cmc.Delay) {
+		notBefore := t.CreateTime.Add(time.Duration(cmc.Delay) * time.Second)
+		p.Action, p.Reason = planWaitDelay, "msg delayed until "+notBefore.Format(time.RFC3339)
+		p.skipAll(branches, "msg delayed")
+		return
+	}
+	toRun, notBefore := msgBranchesToRun(branches)
+	p.planBranches(branches, toRun, dtmcli.BranchAction)
+	for i, b := range branches {
+		if p.Branches[i].SkipReason == "" && !p.Branches[i].Execute && b.Ext.NotBefore != nil {
+			p.Branches[i].SkipReason = "delayed until " + b.Ext.NotBefore.Format(time.RFC3339)
+		}
+	}
+	if notBefore != nil && p.Action == planNone {
+		p.Action, p.Reason = planWaitDelay, "branches delayed until "+notBefore.Format(time.RFC3339)
+		return
+	}
+	p.mayFinish(dtmcli.StatusSucceed)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func sagaBranches(statuses ...string) []TransBranch {
+	branches := []TransBranch{}
+	for i := 0; i < len(statuses); i += 2 {
+		id := fmt.Sprintf("%02d", i/2+1)
+		branches = append(branches,
+			TransBranch{BranchID: id, Op: dtmcli.BranchCompensate, Status: statuses[i], URL: "http://busi/" + id + "/compensate"},
+			TransBranch{BranchID: id, Op: dtmcli.BranchAction, Status: statuses[i+1], URL: "http://busi/" + id + "/action", BinData: []byte("{}")})
+	}
+	return branches
+}
+
+func TestPlanSaga(t *testing.T) {
+	now := time.Now()
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.Status, tg.CreateTime, tg.NextCronInterval = "TestPlanSaga", "saga", dtmcli.StatusSubmitted, &now, 10
+	tg.CustomData = dtmimp.MustMarshalString(map[string]interface{}{"orders": map[int][]int{2: {0, 1}}, "concurrent": true, "max_parallel": 1})
+	p, s := dtmcli.StatusPrepared, dtmcli.StatusSucceed
+
+	plan := planTrans(tg, sagaBranches(p, s, p, p, p, p))
+	assert.Equal(t, planExecuteBranches, plan.Action)
+	assert.Equal(t, int64(20), plan.BackoffInterval)
+	assert.Equal(t, "already succeeded", plan.Branches[1].SkipReason)
+	assert.Equal(t, plannedBranch{BranchID: "02", Op: dtmcli.BranchAction, Status: p, URL: "http://busi/02/action", PayloadSize: 2, Execute: true, Order: 1}, plan.Branches[3])
+	assert.Equal(t, "dependency pending: 02", plan.Branches[5].SkipReason)
+	assert.Equal(t, skipNotInPhase, plan.Branches[0].SkipReason)
+	assert.Equal(t, "", plan.NextStatus)
+
+	plan = planTrans(tg, sagaBranches(p, s, p, s, p, s))
+	assert.Equal(t, planChangeStatus, plan.Action)
+	assert.Equal(t, dtmcli.StatusSucceed, plan.NextStatus)
+
+	tg.CustomData = ""
+	plan = planTrans(tg, sagaBranches(p, s, p, dtmcli.StatusFailed, p, p))
+	assert.Equal(t, dtmcli.StatusAborting, plan.NextStatus)
+	assert.Equal(t, "branch action failed", plan.Reason)
+	assert.Equal(t, []int{2}, plan.executing())
+	assert.Equal(t, "waiting for compensation 02", plan.Branches[0].SkipReason)
+	assert.Equal(t, skipActionNotRun, plan.Branches[4].SkipReason)
+
+	tg.Status = dtmcli.StatusSucceed
+	plan = planTrans(tg, sagaBranches(p, s))
+	assert.Equal(t, planNone, plan.Action)
+	assert.Equal(t, "trans is finished", plan.Branches[1].SkipReason)
+}
+
+func TestPlanTccAndMsg(t *testing.T) {
+	now := time.Now()
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.Status, tg.CreateTime = "TestPlanTcc", "tcc", dtmcli.StatusSubmitted, &now
+	branches := []TransBranch{
+		{BranchID: "01", Op: dtmcli.BranchCancel, Status: dtmcli.StatusPrepared},
+		{BranchID: "01", Op: dtmcli.BranchConfirm, Status: dtmcli.StatusPrepared},
+		{BranchID: "02", Op: dtmcli.BranchCancel, Status: dtmcli.StatusPrepared},
+		{BranchID: "02", Op: dtmcli.BranchConfirm, Status: dtmcli.StatusPrepared},
+	}
+	retry := now.Add(time.Minute)
+	branches[1].Ext = storage.TransBranchExt{NextRetryTime: &retry}
+	plan := planTrans(tg, branches)
+	assert.Equal(t, planExecuteBranches, plan.Action)
+	assert.Equal(t, 1, plan.Branches[3].Order)
+	assert.Contains(t, plan.Branches[1].SkipReason, "retry at ")
+	assert.Equal(t, "", plan.NextStatus)
+
+	tg.Status = dtmcli.StatusPrepared
+	plan = planTrans(tg, branches)
+	assert.Equal(t, planNone, plan.Action)
+	assert.Equal(t, "trans not submitted", plan.Branches[1].SkipReason)
+
+	tg.TransType = "msg"
+	tg.Status = dtmcli.StatusSubmitted
+	later := now.Add(time.Minute)
+	branches = []TransBranch{
+		{BranchID: "01", Op: dtmcli.BranchAction, Status: dtmcli.StatusPrepared},
+		{BranchID: "02", Op: dtmcli.BranchAction, Status: dtmcli.StatusPrepared, Ext: storage.TransBranchExt{NotBefore: &later}},
+	}
+	plan = planTrans(tg, branches)
+	assert.Equal(t, planExecuteBranches, plan.Action)
+	assert.True(t, plan.Branches[0].Execute)
+	assert.Contains(t, plan.Branches[1].SkipReason, "delayed until ")
+
+	branches[0].Status = dtmcli.StatusSucceed
+	plan = planTrans(tg, branches)
+	assert.Equal(t, planWaitDelay, plan.Action)
+
+	tg.CustomData = `{"delay":60}`
+	plan = planTrans(tg, branches)
+	assert.Equal(t, planWaitDelay, plan.Action)
+	assert.Equal(t, "msg delayed", plan.Branches[0].SkipReason)
+}
+
+func TestDryRunExt(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+
+	now := time.Now()
+	later := now.Add(time.Minute)
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType, tg.Status, tg.Protocol = "TestDryRunExt", "msg", dtmcli.StatusSubmitted, "http"
+	tg.Steps = []map[string]string{{dtmcli.BranchAction: "http://busi/action"}}
+	tg.BinPayloads = [][]byte{[]byte("{}")}
+	tg.Ext.ManualReason = "result unknown"
+	branches, err := tg.saveNew()
+	assert.Nil(t, err)
+	branches[0].Ext.NotBefore = &later
+	marshalBranchesExt(branches)
+	GetStore().LockGlobalSaveBranches(tg.Gid, tg.Status, branches, 0)
+
+	app := gin.New()
+	app.POST("/dry-run", dtmutil.WrapHandler2(dryRun))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dry-run", strings.NewReader(`{"gid":"TestDryRunExt"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	plan := transPlan{}
+	dtmimp.MustUnmarshalString(w.Body.String(), &plan)
+	assert.Equal(t, "result unknown", plan.ManualReason)
+	assert.Equal(t, planWaitDelay, plan.Action)
+	assert.Equal(t, 1, len(plan.Branches))
+	assert.Contains(t, plan.Branches[0].SkipReason, "delayed until ")
+}
@@ -7,13 +7,16 @@
 package dtmsvr
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
-	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/dtmgrpc"
+	"github.com/dtm-labs/dtm/dtmsvr/eventpub"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 )
 
 // Process process global transaction once
@@ -24,18 +27,13 @@ func (t *TransGlobal) Process(branches []TransBranch) error {
 }
 
 func (t *TransGlobal) process(branches []TransBranch) error {
-	if t.Options != "" {
-		dtmimp.MustUnmarshalString(t.Options, &t.TransOptions)
-	}
-	if t.ExtData != "" {
-		dtmimp.MustUnmarshalString(t.ExtData, &t.Ext)
-	}
+	t.loadProcessExt(branches)
 
 	if !t.WaitResult {
 		go func() {
 			err := t.processInner(branches)
 			if err != nil {
-				logger.Errorf("processInner err: %v", err)
+				logger.Gid(t.Gid).Errorf("processInner err: %v", err)
 			}
 		}()
 		return nil
@@ -51,11 +49,22 @@ func (t *TransGlobal) process(branches []TransBranch) error {
 	return nil
 }
 
+// loadProcessExt loads the options and the ext of the trans and its branches to process
+func (t *TransGlobal) loadProcessExt(branches []TransBranch) {
+	if t.Options != "" {
+		dtmimp.MustUnmarshalString(t.Options, &t.TransOptions)
+	}
+	if t.ExtData != "" {
+		dtmimp.MustUnmarshalString(t.ExtData, &t.Ext)
+	}
+	unmarshalBranchesExt(branches)
+}
+
 func (t *TransGlobal) processInner(branches []TransBranch) (rerr error) {
 	defer handlePanic(&rerr)
 	defer func() {
-		if rerr != nil && rerr != dtmcli.ErrOngoing {
-			logger.Errorf("processInner got error: %s", rerr.Error())
+		if rerr != nil && !errors.Is(rerr, dtmcli.ErrOngoing) {
+			logger.Gid(t.Gid).Errorf("processInner got error: %s", rerr.Error())
 		}
 		if TransProcessedTestChan != nil {
 			logger.Debugf("processed: %s", t.Gid)
@@ -63,19 +72,27 @@ func (t *TransGlobal) processInner(branches []TransBranch) (rerr error) {
 			logger.Debugf("notified: %s", t.Gid)
 		}
 	}()
-	logger.Debugf("processing: %s status: %s", t.Gid, t.Status)
+	logger.Gid(t.Gid).Debugf("processing: %s status: %s", t.Gid, t.Status)
 	t.lastTouched = time.Now()
+	t.touchedCronTime, t.branchRetryTime = nil, nil
 	rerr = t.getProcessor().ProcessOnce(branches)
 	return
 }
 
 func (t *TransGlobal) saveNew() ([]TransBranch, error) {
-	t.NextCronInterval = t.getNextCronInterval(cronReset)
-	t.NextCronTime = dtmutil.GetNextTime(t.NextCronInterval)
-	t.ExtData = dtmimp.MustMarshalString(t.Ext)
-	if t.ExtData == "{}" {
-		t.ExtData = ""
+	branches, err := t.prepareNew()
+	if err != nil {
+		return nil, err
 	}
+	err = GetStore().MaySaveNewTrans(&t.TransGlobalStore, branches)
+	t.afterSaveNew(branches, err)
+	return branches, err
+}
+
+// prepareNew fills the fields of the new trans, and checks and generates its branches to save
+func (t *TransGlobal) prepareNew() ([]TransBranch, error) {
+	t.NextCronInterval = t.getNextCronInterval(cronReset)
+	t.NextCronTime = storage.NextTime(t.NextCronInterval)
 	t.Options = dtmimp.MustMarshalString(t.TransOptions)
 	if t.Options == "{}" {
 		t.Options = ""
@@ -83,13 +100,65 @@ func (t *TransGlobal) saveNew() ([]TransBranch, error) {
 	now := time.Now()
 	t.CreateTime = &now
 	t.UpdateTime = &now
-	branches := t.getProcessor().GenBranches()
+	if eventpub.Enabled() {
+		t.Ext.EventSeq = 1
+	}
+	t.ExtData = dtmimp.MustMarshalString(t.Ext)
+	if t.ExtData == "{}" {
+		t.ExtData = ""
+	}
+	if t.Priority < dtmimp.PriorityMin || t.Priority > dtmimp.PriorityMax {
+		return nil, fmt.Errorf("priority %d should be in [%d, %d]. %w", t.Priority, dtmimp.PriorityMin, dtmimp.PriorityMax, dtmcli.ErrInvalidArgument)
+	}
+	if err := dtmgrpc.CheckGrpcCodeResults(t.GrpcCodeResults); err != nil {
+		return nil, err
+	}
+	if err := t.checkTopics(); err != nil {
+		return nil, err
+	}
+	if err := t.checkBranchOrders(); err != nil {
+		return nil, err
+	}
+	for _, step := range t.Steps {
+		if err := checkBranchHeaders(step); err != nil {
+			return nil, err
+		}
+	}
+	branches, err := t.getProcessor().GenBranches()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkHTTPProfiles(branches); err != nil {
+		return nil, err
+	}
+	if err := checkBrokerURLs(t.TransType, branches); err != nil {
+		return nil, err
+	}
+	if err := checkBranchProtocols(t.Protocol, branches); err != nil {
+		return nil, err
+	}
+	if err := checkPayloadsInQuery(branches); err != nil {
+		return nil, err
+	}
+	if err := t.checkDurationBudget(branches); err != nil {
+		return nil, err
+	}
+	if err := t.checkResultRefs(branches); err != nil {
+		return nil, err
+	}
+	t.PayloadsHash, t.BranchCount = storage.PayloadsHash(branches), len(branches)
+	marshalBranchesExt(branches)
 	for i := range branches {
 		branches[i].CreateTime = &now
 		branches[i].UpdateTime = &now
 	}
-	err := GetStore().MaySaveNewTrans(&t.TransGlobalStore, branches)
-	logger.Infof("MaySaveNewTrans result: %v, global: %v branches: %v",
-		err, t.TransGlobalStore.String(), dtmimp.MustMarshalString(branches))
-	return branches, err
+	return branches, nil
+}
+
+func (t *TransGlobal) afterSaveNew(branches []TransBranch, err error) {
+	logger.Gid(t.Gid).Infof("MaySaveNewTrans result: %v, global: %v branches: %v",
+		err, t.TransGlobalStore.String(), dtmimp.MustMarshalString(storage.MaskBranches(branches)))
+	if err == nil {
+		t.emitEvent("")
+	}
 }
@@ -7,21 +7,28 @@
 package dtmsvr
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
 	"github.com/dtm-labs/dtm/dtmgrpc"
 	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
-	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/dtmsvr/eventpub"
+	"github.com/dtm-labs/dtm/dtmsvr/msgbroker"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 	"github.com/dtm-labs/dtmdriver"
 	"github.com/lithammer/shortuuid/v3"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // touchCronTime Based on ctype or delay set nextCronTime
@@ -33,29 +40,91 @@ func (t *TransGlobal) touchCronTime(ctype cronType, delay uint64) {
 
 	var nextCronTime *time.Time
 	if delay > 0 {
-		nextCronTime = dtmutil.GetNextTime(int64(delay))
+		nextCronTime = storage.NextTime(int64(delay))
 	} else {
-		nextCronTime = dtmutil.GetNextTime(nextCronInterval)
+		nextCronTime = storage.NextTime(nextCronInterval)
 	}
+	if t.branchRetryTime != nil && t.branchRetryTime.Before(*nextCronTime) { // a branch should be retried earlier
+		nextCronTime = t.branchRetryTime
+	}
+	t.touchedCronTime = nextCronTime
 
-	GetStore().TouchCronTime(&t.TransGlobalStore, nextCronInterval, nextCronTime)
-	logger.Infof("TouchCronTime for: %s", t.TransGlobalStore.String())
+	if t.batchTouch {
+		t.NextCronTime = nextCronTime
+		t.NextCronInterval = nextCronInterval
+		cronTouches.add(&t.TransGlobalStore, nextCronInterval, nextCronTime)
+		logger.Gid(t.Gid).Infof("TouchCronTime batched for: %s", t.TransGlobalStore.String())
+		return
+	}
+	t.persister().TouchCronTime(&t.TransGlobalStore, nextCronInterval, nextCronTime)
+	logger.Gid(t.Gid).Infof("TouchCronTime for: %s", t.TransGlobalStore.String())
 }
 
 func (t *TransGlobal) changeStatus(status string) {
 	updates := []string{"status", "update_time"}
-	now := time.Now()
+	old := t.Status
+	if eventpub.Enabled() {
+		updates = append(updates, "ext_data")
+	}
 	if status == dtmcli.StatusSucceed {
-		t.FinishTime = &now
 		updates = append(updates, "finish_time")
 	} else if status == dtmcli.StatusFailed {
-		t.RollbackTime = &now
 		updates = append(updates, "rollback_time")
 	}
-	t.UpdateTime = &now
-	GetStore().ChangeGlobalStatus(&t.TransGlobalStore, status, updates, status == dtmcli.StatusSucceed || status == dtmcli.StatusFailed)
-	logger.Infof("ChangeGlobalStatus to %s ok for %s", status, t.TransGlobalStore.String())
+	if t.RollbackReason != "" && (status == dtmcli.StatusAborting || status == dtmcli.StatusFailed) {
+		updates = append(updates, "rollback_reason")
+	}
+	err := t.saveGlobal(status, updates, func() {
+		if eventpub.Enabled() {
+			t.Ext.EventSeq++
+			t.ExtData = dtmimp.MustMarshalString(t.Ext)
+		}
+		now := time.Now()
+		if status == dtmcli.StatusSucceed {
+			t.FinishTime = &now
+		} else if status == dtmcli.StatusFailed {
+			t.RollbackTime = &now
+		}
+		t.UpdateTime = &now
+	})
+	dtmimp.E2P(err) // a status conflict stops the processing, and is skipped by handlePanic
+	logger.Gid(t.Gid).Infof("ChangeGlobalStatus to %s ok for %s", status, t.TransGlobalStore.String())
 	t.Status = status
+	t.emitEvent(old)
+	notifyWatchers(t.Gid, changeGlobalStatus)
+}
+
+// the max times of re-reading the trans to resolve the version conflicts of a write
+const versionConflictRetries = 3
+
+// saveGlobal changes the status of the trans, with the columns updates changed by apply. if the trans is changed by
+// others while its status is not, such as its custom data updated, the trans is re-read, and apply is called again
+func (t *TransGlobal) saveGlobal(status string, updates []string, apply func()) error {
+	finished := status == dtmcli.StatusSucceed || status == dtmcli.StatusFailed
+	for i := 0; ; i++ {
+		apply()
+		err := t.persister().ChangeGlobalStatus(&t.TransGlobalStore, status, updates, finished)
+		var conflict *storage.VersionConflictError
+		if !errors.As(err, &conflict) || i == versionConflictRetries {
+			return err
+		}
+		logger.Gid(t.Gid).Infof("%v, the trans is re-read", err)
+		g := t.persister().FindTransGlobalStore(t.Gid)
+		if err := storage.GlobalConflict(&t.TransGlobalStore, t.Status, g); err != nil && !errors.As(err, &conflict) {
+			return err
+		}
+		t.reload(g)
+	}
+}
+
+// reload takes the fields of the trans re-read, which can be changed by others while the status is not
+func (t *TransGlobal) reload(g *storage.TransGlobalStore) {
+	t.Version, t.UpdateTime, t.CustomData = g.Version, g.UpdateTime, g.CustomData
+	t.NextCronTime, t.NextCronInterval, t.Owner = g.NextCronTime, g.NextCronInterval, g.Owner
+	t.ExtData, t.Ext = g.ExtData, storage.TransGlobalExt{}
+	if g.ExtData != "" {
+		dtmimp.MustUnmarshalString(g.ExtData, &t.Ext)
+	}
 }
 
 func (t *TransGlobal) changeBranchStatus(b *TransBranch, status string, branchPos int) {
@@ -63,11 +132,19 @@ func (t *TransGlobal) changeBranchStatus(b *TransBranch, status string, branchPo
 	b.Status = status
 	b.FinishTime = &now
 	b.UpdateTime = &now
-	if conf.Store.Driver != dtmimp.DBTypeMysql && conf.Store.Driver != dtmimp.DBTypePostgres || conf.UpdateBranchSync > 0 || t.updateBranchSync {
-		GetStore().LockGlobalSaveBranches(t.Gid, t.Status, []TransBranch{*b}, branchPos)
-		logger.Infof("LockGlobalSaveBranches ok: gid: %s old status: %s branches: %s",
-			b.Gid, dtmcli.StatusPrepared, b.String())
-	} else { // 为了性能优化，把branch的status更新异步化
+	saveExt := b.Ext.Result != "" || b.Ext.FailureReason != ""
+	if saveExt { // the result is referred by later branches, or the failure is kept for diagnosing, so it is saved with the status
+		b.ExtData = dtmimp.MustMarshalString(b.Ext)
+	}
+	if conf.Store.Driver != dtmimp.DBTypeMysql && conf.Store.Driver != dtmimp.DBTypePostgres || conf.UpdateBranchSync > 0 || t.updateBranchSync || saveExt {
+		if saved := t.persister().LockGlobalSaveBranches(t.Gid, t.Status, []TransBranch{*b}, branchPos); !saved[0] {
+			logger.Gid(t.Gid).Warnf("branch %s %s of %s is finished already, the status %s is not saved", b.BranchID, b.Op, t.Gid, status)
+		} else {
+			logger.Gid(t.Gid).Infof("LockGlobalSaveBranches ok: gid: %s old status: %s branches: %s",
+				b.Gid, dtmcli.StatusPrepared, b.String())
+		}
+		notifyWatchers(t.Gid, changeBranchStatus)
+	} else { // 为了性能优化，把branch的status更新异步化. the watchers are notified after the status is flushed
 		updateBranchAsyncChan <- branchStatus{id: b.ID, gid: t.Gid, status: status, finishTime: &now}
 	}
 }
@@ -83,118 +160,324 @@ func (t *TransGlobal) isTimeout() bool {
 	return time.Since(*t.CreateTime)+NowForwardDuration >= time.Duration(timeout)*time.Second
 }
 
+// isTryTimeout checks whether a prepared tcc is not submitted in TryTimeout, which is usually left by a crashed AP
+func (t *TransGlobal) isTryTimeout() bool {
+	return t.TransType == "tcc" && t.Status == dtmcli.StatusPrepared && t.TryTimeout > 0 &&
+		time.Since(*t.CreateTime)+NowForwardDuration >= time.Duration(t.TryTimeout)*time.Second
+}
+
+// preparedTimeoutReason returns the reason to abort a prepared trans, which tells the timeout fired. "" if not timeout
+func (t *TransGlobal) preparedTimeoutReason() string {
+	if t.isTryTimeout() {
+		return "try timeout"
+	} else if t.isTimeout() {
+		return "timeout"
+	}
+	return ""
+}
+
 func (t *TransGlobal) needDelay(delay uint64) bool {
 	return time.Since(*t.CreateTime)+CronForwardDuration < time.Duration(delay)*time.Second
 }
 
 func (t *TransGlobal) needProcess() bool {
-	return t.Status == dtmcli.StatusSubmitted || t.Status == dtmcli.StatusAborting || t.Status == dtmcli.StatusPrepared && t.isTimeout()
+	return t.Status == dtmcli.StatusSubmitted || t.Status == dtmcli.StatusAborting || t.Status == dtmcli.StatusPrepared && t.preparedTimeoutReason() != ""
 }
 
-func (t *TransGlobal) getURLResult(uri string, branchID, op string, branchPayload []byte) error {
+func (t *TransGlobal) getURLResult(branch *TransBranch) error {
+	uri, branchID, op, branchPayload := branch.URL, branch.BranchID, branch.Op, branch.BinData
 	if uri == "" { // empty url is success
 		return nil
 	}
-	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
-		if t.RequestTimeout != 0 {
-			dtmimp.RestyClient.SetTimeout(time.Duration(t.RequestTimeout) * time.Second)
-		}
-		if t.Protocol == "json-rpc" && strings.Contains(uri, "method") {
-			var params map[string]interface{}
-			dtmimp.MustUnmarshal(branchPayload, &params)
-			u, err := url.Parse(uri)
-			dtmimp.E2P(err)
-			params["gid"] = t.Gid
-			params["trans_type"] = t.TransType
-			params["branch_id"] = branchID
-			params["op"] = op
-			resp, err := dtmimp.RestyClient.R().SetBody(map[string]interface{}{
-				"params":  params,
-				"jsonrpc": "2.0",
-				"method":  u.Query().Get("method"),
-				"id":      shortuuid.New(),
-			}).
-				SetHeader("Content-type", "application/json").
-				SetHeaders(t.Ext.Headers).
-				SetHeaders(t.TransOptions.BranchHeaders).
-				Post(uri)
-			if err == nil {
-				err = dtmimp.RespAsErrorCompatible(resp)
-			}
-			var result map[string]interface{}
-			if err == nil {
-				dtmimp.MustUnmarshalString(resp.String(), &result)
-				if result["error"] != nil {
-					rerr := result["error"].(map[string]interface{})
-					if rerr["code"] == dtmimp.JrpcCodeFailure {
-						return dtmcli.ErrFailure
-					} else if rerr["code"] == dtmimp.JrpcCodeOngoing {
-						return dtmcli.ErrOngoing
-					}
-					return errors.New(resp.String())
-				}
-			}
-			return err
-		}
-		resp, err := dtmimp.RestyClient.R().SetBody(string(branchPayload)).
-			SetQueryParams(map[string]string{
+	if msgbroker.IsBrokerURL(uri) {
+		err := msgbroker.Send(uri, &msgbroker.Message{
+			Key:   t.Gid,
+			Value: branchPayload,
+			Headers: map[string]string{
 				"gid":        t.Gid,
 				"trans_type": t.TransType,
 				"branch_id":  branchID,
 				"op":         op,
-			}).
+			},
+		})
+		if err != nil { // broker errors are treated as ongoing, and the branch will be retried
+			return fmt.Errorf("send to broker %s error: %v. %w", uri, err, dtmcli.ErrOngoing)
+		}
+		return nil
+	}
+	branch.ResolvedURL = ""
+	target, err := t.resolveTarget(branch)
+	if err != nil {
+		return err
+	}
+	if target != uri { // the url is only changed during the call, so the url saved is not changed
+		logger.Gid(t.Gid).Infof("branch %s %s calls %s resolved from %s", branchID, op, target, uri)
+		branch.URL, branch.ResolvedURL = target, target
+		defer func(saved string) { branch.URL = saved }(uri)
+		uri = target
+	}
+	release, err := acquireHost(uri)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if invoke := getProtocol(uri); invoke != nil {
+		return invoke(t, branch)
+	}
+	dtmimp.PanicIf(t.Protocol == "http", fmt.Errorf("bad url for http: %s", uri))
+	return t.getGrpcResult(branch)
+}
+
+// getHTTPResult calls the http branch, which is the built-in protocol of http and https
+func (t *TransGlobal) getHTTPResult(branch *TransBranch) error {
+	uri, branchID, op, branchPayload := branch.URL, branch.BranchID, branch.Op, branch.BinData
+	client, err := getHTTPClient(dtmimp.OrString(branch.Ext.HTTPProfile, t.HTTPProfile))
+	if err != nil {
+		return err
+	}
+	ctx := logger.WithGid(context.Background(), t.Gid)
+	timeout := time.Duration(t.getRequestTimeout(branch)) * time.Second
+	if timeout == 0 {
+		timeout = client.GetClient().Timeout // the timeout of the http client profile
+	}
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if t.Protocol == "json-rpc" && strings.Contains(uri, "method") {
+		var params map[string]interface{}
+		dtmimp.MustUnmarshal(branchPayload, &params)
+		u, err := url.Parse(uri)
+		dtmimp.E2P(err)
+		params["gid"] = t.Gid
+		params["trans_type"] = t.TransType
+		params["branch_id"] = branchID
+		params["op"] = op
+		resp, err := client.R().SetContext(ctx).SetDoNotParseResponse(true).SetBody(map[string]interface{}{
+			"params":  params,
+			"jsonrpc": "2.0",
+			"method":  u.Query().Get("method"),
+			"id":      shortuuid.New(),
+		}).
 			SetHeader("Content-type", "application/json").
 			SetHeaders(t.Ext.Headers).
 			SetHeaders(t.TransOptions.BranchHeaders).
-			Execute(dtmimp.If(branchPayload != nil || t.TransType == "xa", "POST", "GET").(string), uri)
+			SetHeaders(branch.Ext.Headers).
+			SetHeaders(deadlineHeaders(ctx)).
+			Post(uri)
+		if err != nil {
+			return err
+		}
+		body, truncated, err := readResponseBody(resp, t, branch)
 		if err != nil {
 			return err
 		}
-		return dtmimp.RespAsErrorCompatible(resp)
+		keepAttemptResponse(branch, body)
+		err = dtmimp.BodyAsErrorCompatible(resp.StatusCode(), resp.Header(), string(body), truncated)
+		if err == nil && truncated { // a json-rpc result can not be parsed from a truncated body
+			return fmt.Errorf("json-rpc response of %s exceeds %d bytes", uri, conf.ResponseBodyLimit)
+		}
+		var result map[string]interface{}
+		if err == nil {
+			dtmimp.MustUnmarshal(body, &result)
+			if jerr, ok := result["error"].(map[string]interface{}); ok {
+				return dtmimp.JrpcErrorAsError(jerr)
+			} else if result["error"] != nil {
+				return errors.New(string(body))
+			}
+			if branch.Ext.KeepResult {
+				branch.Ext.Result = dtmimp.MustMarshalString(result["result"])
+			}
+		}
+		return err
 	}
-	dtmimp.PanicIf(t.Protocol == "http", fmt.Errorf("bad url for http: %s", uri))
-	// grpc handler
+	query := url.Values{}
+	if branch.Ext.PayloadInQuery {
+		if query, err = payloadQuery(branchPayload); err != nil {
+			return err
+		}
+		branchPayload = nil
+	}
+	method := dtmimp.If(branchPayload != nil || t.TransType == "xa", "POST", "GET").(string)
+	headers := map[string]string{"Content-type": dtmimp.OrString(branch.Ext.ContentType, "application/json")}
+	for _, hs := range []map[string]string{t.Ext.Headers, t.TransOptions.BranchHeaders, branch.Ext.Headers} {
+		for k, v := range hs {
+			headers[k] = v
+		}
+	}
+	if branchPayload, err = t.transformPayload(branch, branchPayload, headers); err != nil {
+		return err
+	}
+	resp, err := client.R().SetContext(ctx).SetDoNotParseResponse(true).SetBody(branchPayload).
+		SetQueryParamsFromValues(query).
+		SetQueryParams(map[string]string{
+			"gid":        t.Gid,
+			"trans_type": t.TransType,
+			"branch_id":  branchID,
+			"op":         op,
+		}).
+		SetHeaders(headers).
+		SetHeaders(deadlineHeaders(ctx)).
+		Execute(method, uri)
+	if err != nil {
+		return err
+	}
+	body, truncated, err := readResponseBody(resp, t, branch)
+	if err != nil {
+		return err
+	}
+	keepAttemptResponse(branch, body)
+	err = dtmimp.BodyAsErrorCompatible(resp.StatusCode(), resp.Header(), string(body), truncated)
+	if err == nil && branch.Ext.KeepResult {
+		branch.Ext.Result = string(body)
+	}
+	return err
+}
+
+// getGrpcResult calls the grpc branch, whose url is not of any registered protocol
+func (t *TransGlobal) getGrpcResult(branch *TransBranch) error {
+	uri, branchID, op, branchPayload := strings.TrimPrefix(branch.URL, dtmimp.GrpcURLPrefix), branch.BranchID, branch.Op, branch.BinData
 	server, method, err := dtmdriver.GetDriver().ParseServerMethod(uri)
 	if err != nil {
 		return err
 	}
 
 	conn := dtmgimp.MustGetGrpcConn(server, true)
-	ctx := dtmgimp.TransInfo2Ctx(t.Gid, t.TransType, branchID, op, "")
-	kvs := dtmgimp.Map2Kvs(t.Ext.Headers)
-	kvs = append(kvs, dtmgimp.Map2Kvs(t.BranchHeaders)...)
+	ctx := logger.WithGid(dtmgimp.TransInfo2Ctx(t.Gid, t.TransType, branchID, op, ""), t.Gid)
+	headers := map[string]string{}
+	for k, v := range t.Ext.Headers {
+		headers[strings.ToLower(k)] = v
+	}
+	for k, v := range t.BranchHeaders { // BranchHeaders override the passthrough headers
+		headers[strings.ToLower(k)] = v
+	}
+	for k, v := range branch.Ext.Headers { // the headers of the branch override the ones of the trans
+		headers[strings.ToLower(k)] = v
+	}
+	if branchPayload, err = t.transformPayload(branch, branchPayload, headers); err != nil {
+		return err
+	}
+	kvs := dtmgimp.Map2Kvs(headers)
 	ctx = metadata.AppendToOutgoingContext(ctx, kvs...)
-	ctx = dtmgimp.RequestTimeoutNewContext(ctx, t.RequestTimeout)
+	timeout := t.getRequestTimeout(branch)
+	if timeout == 0 {
+		timeout = conf.RequestTimeout
+	}
+	ctx = dtmgimp.RequestTimeoutNewContext(ctx, timeout)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
 	err = conn.Invoke(ctx, method, branchPayload, &[]byte{})
 	if err == nil {
 		return nil
 	}
-	return dtmgrpc.GrpcError2DtmError(err)
+	code, results := status.Code(err), t.grpcCodeResults()
+	if _, ok := results[code.String()]; !ok && code == codes.DeadlineExceeded { // the branch may still be running, so check it later
+		return fmt.Errorf("grpc call %s timeout: %v. %w", uri, err, dtmcli.ErrOngoing)
+	}
+	if err = dtmgrpc.GrpcError2DtmErrorWith(err, results); err == nil { // a code interpreted as SUCCESS
+		return nil
+	}
+	return fmt.Errorf("grpc code %s: %w", code, err)
+}
+
+// grpcCodeResults returns the results of the grpc codes in the config, overridden by the ones of the trans
+func (t *TransGlobal) grpcCodeResults() map[string]dtmcli.GrpcCodeResult {
+	if len(t.GrpcCodeResults) == 0 {
+		return conf.GrpcCodeResults
+	}
+	results := map[string]dtmcli.GrpcCodeResult{}
+	for k, v := range conf.GrpcCodeResults {
+		results[k] = v
+	}
+	for k, v := range t.GrpcCodeResults {
+		results[k] = v
+	}
+	return results
+}
+
+// suggestedDelay returns the delay suggested by the result of a grpc branch, 0 if none. see dtmgrpc.OngoingDelayError
+func suggestedDelay(err error) uint64 {
+	var delayed *dtmgrpc.OngoingDelayError
+	if errors.As(err, &delayed) && delayed.Delay > 0 {
+		return uint64(delayed.Delay)
+	}
+	return 0
+}
+
+// getRequestTimeout returns the request timeout of the branch. 0 means not specified by branch or trans
+func (t *TransGlobal) getRequestTimeout(branch *TransBranch) int64 {
+	if branch.Ext.RequestTimeout != 0 {
+		return branch.Ext.RequestTimeout
+	}
+	return t.RequestTimeout
+}
+
+// deadlineHeaders returns the header of the deadline of ctx, so that the RM can stop working after dtm server gives up.
+// see dtmcli.BranchContext
+func deadlineHeaders(ctx context.Context) map[string]string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return map[string]string{dtmcli.DeadlineHeader: strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10)}
 }
 
 func (t *TransGlobal) getBranchResult(branch *TransBranch) (string, error) {
-	err := t.getURLResult(branch.URL, branch.BranchID, branch.Op, branch.BinData)
+	began := time.Now()
+	err := t.invokeBranch(branch)
+	t.recordAttempt(branch, began, err)
 	if err == nil {
 		return dtmcli.StatusSucceed, nil
 	} else if t.TransType == "saga" && branch.Op == dtmcli.BranchAction && errors.Is(err, dtmcli.ErrFailure) {
+		branch.Ext.FailureReason = failureReason(err)
 		return dtmcli.StatusFailed, nil
 	} else if errors.Is(err, dtmcli.ErrOngoing) {
-		return "", dtmcli.ErrOngoing
+		return "", err
 	}
 	return "", fmt.Errorf("http/grpc result should be specified as in:\nhttps://dtm.pub/summary/arch.html#http\nunkown result will be retried: %s", err)
 }
 
+// failureReason returns the response of the failed branch, truncated to RollbackReasonLimit at a rune boundary, so that
+// a multi-byte character is not cut
+func failureReason(err error) string {
+	reason := strings.TrimSuffix(err.Error(), ". "+dtmcli.ErrFailure.Error())
+	if limit := int(conf.RollbackReasonLimit); limit > 0 && len(reason) > limit {
+		for limit > 0 && !utf8.RuneStart(reason[limit]) {
+			limit--
+		}
+		reason = reason[:limit] + "...(truncated)"
+	}
+	return reason
+}
+
 func (t *TransGlobal) execBranch(branch *TransBranch, branchPos int) error {
+	branchPos += t.branchOffset // the position in all the branches
+	if branch.Ext.NextRetryTime != nil && storage.Now().Add(CronForwardDuration).Before(*branch.Ext.NextRetryTime) {
+		t.scheduleBranchRetry(*branch.Ext.NextRetryTime)
+		return fmt.Errorf("branch %s %s will be retried at %s. %w", branch.BranchID, branch.Op, branch.Ext.NextRetryTime.Format(time.RFC3339), dtmcli.ErrOngoing)
+	}
+	if t.skipSucceededBranch(branch) {
+		return nil
+	}
 	status, err := t.getBranchResult(branch)
 	if status != "" {
 		t.changeBranchStatus(branch, status, branchPos)
 	}
 	branchMetrics(t, branch, status == dtmcli.StatusSucceed)
+	if delay := suggestedDelay(err); delay > 0 {
+		t.touchCronTime(cronKeep, delay)
+		return err
+	}
+	if err != nil && branch.Ext.RetryInterval > 0 {
+		t.backoffBranch(branch, branchPos, err)
+		return err
+	}
 	// if time pass 1500ms and NextCronInterval is not default, then reset NextCronInterval
 	if err == nil && time.Since(t.lastTouched)+NowForwardDuration >= 1500*time.Millisecond ||
 		t.NextCronInterval > conf.RetryInterval && t.NextCronInterval > t.RetryInterval {
 		t.touchCronTime(cronReset, 0)
-	} else if err == dtmimp.ErrOngoing {
+	} else if errors.Is(err, dtmimp.ErrOngoing) {
 		t.touchCronTime(cronKeep, 0)
 	} else if err != nil {
 		t.touchCronTime(cronBackoff, 0)
@@ -202,16 +485,38 @@ func (t *TransGlobal) execBranch(branch *TransBranch, branchPos int) error {
 	return err
 }
 
+// skipSucceededBranch re-checks the stored status of the branch right before calling it. the branches of this pass are
+// read at its start, and the branch may have succeeded since then, by another pass or the async update of branches.
+// the succeeded branch is not called again, and its stored result is used by the later branches
+func (t *TransGlobal) skipSucceededBranch(branch *TransBranch) bool {
+	stored := t.persister().FindBranch(t.Gid, branch.BranchID, branch.Op)
+	if stored == nil || stored.Status != dtmcli.StatusSucceed {
+		return false
+	}
+	logger.Gid(t.Gid).Infof("branch %s %s is already succeeded, skip calling %s", branch.BranchID, branch.Op, branch.URL)
+	branchSkippedTotal.WithLabelValues(t.TransType, branch.Op).Inc()
+	branch.Status, branch.FinishTime, branch.UpdateTime = stored.Status, stored.FinishTime, stored.UpdateTime
+	if stored.ExtData != "" {
+		branch.ExtData = stored.ExtData
+		dtmimp.MustUnmarshalString(stored.ExtData, &branch.Ext)
+	}
+	return true
+}
+
 func (t *TransGlobal) getNextCronInterval(ctype cronType) int64 {
 	if ctype == cronBackoff {
 		return t.NextCronInterval * 2
 	} else if ctype == cronKeep {
 		return t.NextCronInterval
-	} else if t.RetryInterval != 0 {
-		return t.RetryInterval
+	}
+	interval := conf.RetryInterval
+	if t.RetryInterval != 0 {
+		interval = t.RetryInterval
 	} else if t.TimeoutToFail > 0 && t.TimeoutToFail < conf.RetryInterval {
-		return t.TimeoutToFail
-	} else {
-		return conf.RetryInterval
+		interval = t.TimeoutToFail
+	}
+	if t.TransType == "tcc" && t.Status == dtmcli.StatusPrepared && t.TryTimeout > 0 && t.TryTimeout < interval {
+		return t.TryTimeout // a prepared tcc is checked once its try times out
 	}
+	return interval
 }
@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmsvr/msgbroker"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGrpcBranchRequestTimeout(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		time.Sleep(3 * time.Second) // a slow RM
+		return nil
+	}))
+	go s.Serve(lis)
+	defer s.Stop()
+
+	tg := TransGlobal{}
+	tg.Gid = "TestGrpcBranchRequestTimeout"
+	tg.TransType = "saga"
+	tg.Protocol = "grpc"
+	tg.RequestTimeout = 2
+	branch := TransBranch{URL: lis.Addr().String() + "/busi.Busi/TransOut", BranchID: "01", Op: dtmcli.BranchAction}
+	branch.Ext = storage.TransBranchExt{RequestTimeout: 1}
+	assert.Equal(t, int64(1), tg.getRequestTimeout(&branch))
+
+	begin := time.Now()
+	_, err = tg.getBranchResult(&branch)
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	assert.True(t, time.Since(begin) < 2*time.Second)
+
+	branch.Ext.RequestTimeout = 0
+	assert.Equal(t, int64(2), tg.getRequestTimeout(&branch))
+}
+
+func TestGrpcCodeResults(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method == "/busi.Busi/Reject" {
+			return status.Error(codes.FailedPrecondition, "rejected")
+		}
+		return status.Error(codes.AlreadyExists, "done")
+	}))
+	go s.Serve(lis)
+	defer s.Stop()
+	defer func() { conf.GrpcCodeResults = nil }()
+
+	tg := TransGlobal{}
+	tg.Gid, tg.TransType, tg.Protocol = "TestGrpcCodeResults", "saga", "grpc"
+	tg.RequestTimeout = 2
+	branch := TransBranch{URL: lis.Addr().String() + "/busi.Busi/Reject", BranchID: "01", Op: dtmcli.BranchAction}
+	_, err = tg.getBranchResult(&branch)
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing)) // the default
+
+	conf.GrpcCodeResults = map[string]config.GrpcCodeResult{"FailedPrecondition": {Result: dtmcli.ResultFailure}}
+	result, err := tg.getBranchResult(&branch)
+	assert.Nil(t, err)
+	assert.Equal(t, dtmcli.StatusFailed, result)
+	assert.Equal(t, "grpc code FailedPrecondition: rejected", branch.Ext.FailureReason)
+
+	tg.GrpcCodeResults = map[string]dtmcli.GrpcCodeResult{"FailedPrecondition": {Result: dtmcli.ResultOngoing, Delay: 30}}
+	_, err = tg.getBranchResult(&branch)
+	assert.True(t, errors.Is(err, dtmcli.ErrOngoing))
+	assert.Equal(t, uint64(30), suggestedDelay(err))
+
+	branch.URL = lis.Addr().String() + "/busi.Busi/Done"
+	tg.GrpcCodeResults = map[string]dtmcli.GrpcCodeResult{"AlreadyExists": {Result: dtmcli.ResultSuccess}}
+	result, err = tg.getBranchResult(&branch)
+	assert.Nil(t, err)
+	assert.Equal(t, dtmcli.StatusSucceed, result)
+	assert.Len(t, tg.grpcCodeResults(), 2) // merged with the config
+}
+
+type mockProducer struct {
+	err error
+}
+
+func (m *mockProducer) Send(msg *msgbroker.Message) error {
+	return m.err
+}
+
+func TestBrokerBranch(t *testing.T) {
+	p := &mockProducer{}
+	msgbroker.Register("mockbroker", func(conf *config.MsgBroker) (msgbroker.Producer, error) {
+		return p, nil
+	})
+	conf.MsgBrokers = map[string]config.MsgBroker{"orders": {Driver: "mockbroker"}}
+	branches := []TransBranch{{URL: "mockbroker://orders/topic1", BranchID: "01", Op: dtmcli.BranchAction}}
+	assert.Nil(t, checkBrokerURLs("msg", branches))
+	assert.True(t, errors.Is(checkBrokerURLs("saga", branches), dtmcli.ErrFailure))
+	assert.True(t, errors.Is(checkBrokerURLs("msg", []TransBranch{{URL: "mockbroker://none/topic1"}}), dtmcli.ErrFailure))
+
+	tg := TransGlobal{}
+	tg.Gid = "TestBrokerBranch"
+	tg.TransType = "msg"
+	assert.Nil(t, tg.getURLResult(&branches[0]))
+	p.err = errors.New("broker down")
+	assert.True(t, errors.Is(tg.getURLResult(&branches[0]), dtmcli.ErrOngoing))
+}
+
+func TestCheckBranchDelays(t *testing.T) {
+	now := time.Now()
+	tg := TransGlobal{}
+	tg.CreateTime = &now
+	tg.TimeoutToFail = 60
+	notBefore := now.Add(30 * time.Second)
+	branches := []TransBranch{{BranchID: "01"}, {BranchID: "02", Ext: storage.TransBranchExt{NotBefore: &notBefore}}}
+	assert.Nil(t, tg.checkDurationBudget(branches))
+	tg.TimeoutToFail = 20
+	assert.True(t, errors.Is(tg.checkDurationBudget(branches), dtmcli.ErrFailure))
+}
+
+func TestBinPayloadBranch(t *testing.T) {
+	var contentType string
+	var body []byte
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("dtm-result", dtmcli.ResultSuccess)
+	}))
+	defer svr.Close()
+
+	payload := []byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	tg := TransGlobal{}
+	tg.Gid = "TestBinPayloadBranch"
+	tg.TransType = "saga"
+	tg.Protocol = "http"
+	tg.Steps = []map[string]string{{"action": svr.URL, "content_type": "application/x-protobuf"}}
+	tg.Payloads = []string{dtmimp.EncodeBinPayload(payload)}
+	tg.setupPayloads()
+	assert.Equal(t, payload, tg.BinPayloads[0])
+
+	branch := TransBranch{URL: svr.URL, BranchID: "01", Op: dtmcli.BranchAction, BinData: tg.BinPayloads[0]}
+	var err error
+	branch.Ext, err = branchExtFromMap(tg.Steps[0])
+	assert.Nil(t, err)
+	assert.False(t, tg.hasResultRefs(&branch))
+	assert.Nil(t, tg.getURLResult(&branch))
+	assert.Equal(t, "application/x-protobuf", contentType)
+	assert.Equal(t, payload, body)
+
+	tg.Payloads = []string{"not base64"}
+	tg.BinPayloads = nil
+	assert.True(t, errors.Is(dtmimp.CatchP(tg.setupPayloads), dtmcli.ErrFailure))
+}
+
+func TestBranchRetryIntervals(t *testing.T) {
+	tg := storage.TransGlobalStore{}
+	tg.RetryInterval = 20
+	next := time.Now().Add(time.Minute)
+	branches := []TransBranch{{BranchID: "01", Op: dtmcli.BranchAction}, {BranchID: "02", Op: dtmcli.BranchAction}, {BranchID: "03", Op: dtmcli.BranchAction}}
+	branches[1].ExtData = dtmimp.MustMarshalString(storage.TransBranchExt{RetryInterval: 300})
+	branches[2].ExtData = dtmimp.MustMarshalString(storage.TransBranchExt{RetryInterval: 30, NextInterval: 60, NextRetryTime: &next})
+	intervals := getBranchRetryIntervals(&tg, branches)
+	assert.Equal(t, []int64{20, 300, 60}, []int64{intervals[0].RetryInterval, intervals[1].RetryInterval, intervals[2].RetryInterval})
+	assert.NotNil(t, intervals[2].NextRetryTime)
+
+	ext, err := branchExtFromMap(map[string]string{"retry_interval": "300"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), ext.RetryInterval)
+}
+
+func TestBranchExtFromMapInvalid(t *testing.T) {
+	ext, err := branchExtFromMap(map[string]string{"request_timeout": "15"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), ext.RequestTimeout)
+
+	_, err = branchExtFromMap(map[string]string{"request_timeout": "15s"})
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+	assert.Contains(t, err.Error(), "request_timeout")
+
+	tg := &TransGlobal{}
+	tg.Gid, tg.TransType = "TestBranchExtFromMapInvalid", "saga"
+	tg.Steps = []map[string]string{{dtmcli.BranchAction: "http://localhost/action", "request_timeout": "x"}}
+	tg.BinPayloads = [][]byte{[]byte("{}")}
+	_, err = tg.getProcessor().GenBranches()
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+
+	_, err = branchExtFromMap(map[string]string{"retry_interval": "abc"})
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+	assert.Contains(t, err.Error(), "retry_interval")
+
+	tg.TransType = "msg"
+	tg.Steps = []map[string]string{{dtmcli.BranchAction: "http://localhost/action", "delay": "1m"}}
+	_, err = tg.getProcessor().GenBranches()
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+	assert.Contains(t, err.Error(), "delay")
+	now := time.Now()
+	tg.CreateTime = &now
+	tg.Steps[0]["delay"] = "60"
+	branches, err := tg.getProcessor().GenBranches()
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Minute), *branches[0].Ext.NotBefore)
+}
+
+func TestTryTimeout(t *testing.T) {
+	created := time.Now().Add(-5 * time.Second)
+	tg := TransGlobal{}
+	tg.TransType = "tcc"
+	tg.Status = dtmcli.StatusPrepared
+	tg.CreateTime = &created
+	tg.RetryInterval = 10
+	assert.False(t, tg.isTryTimeout())
+	assert.Equal(t, int64(10), tg.getNextCronInterval(cronReset))
+
+	tg.TryTimeout = 3
+	assert.True(t, tg.isTryTimeout())
+	assert.Equal(t, "try timeout", tg.preparedTimeoutReason())
+	assert.Equal(t, int64(3), tg.getNextCronInterval(cronReset))
+
+	tg.TryTimeout = 8
+	assert.False(t, tg.isTryTimeout())
+	tg.Status = dtmcli.StatusSubmitted
+	assert.Equal(t, int64(10), tg.getNextCronInterval(cronReset))
+	tg.TryTimeout = 3
+	assert.False(t, tg.isTryTimeout())
+}
+
+func TestQueryPreparedQuorum(t *testing.T) {
+	targets := map[int]string{}
+	for _, code := range []int{http.StatusOK, http.StatusConflict, http.StatusTooEarly} {
+		svr := httptest.NewServer(http.HandlerFunc(func(code int) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(code) }
+		}(code)))
+		defer svr.Close()
+		targets[code] = svr.URL
+	}
+	tg := TransGlobal{}
+	tg.Gid = "TestQueryPreparedQuorum"
+	tg.TransType = "msg"
+	tg.QueryPrepared = targets[http.StatusConflict]
+	assert.ErrorIs(t, tg.queryPrepared(), dtmcli.ErrFailure)
+
+	tg.QueryPreparedURLs = []string{targets[http.StatusConflict], targets[http.StatusConflict]}
+	assert.ErrorIs(t, tg.queryPrepared(), dtmcli.ErrFailure)
+	tg.QueryPreparedURLs = []string{targets[http.StatusConflict], targets[http.StatusOK]} // disagreement
+	assert.ErrorIs(t, tg.queryPrepared(), dtmcli.ErrOngoing)
+	tg.QueryPreparedURLs = []string{targets[http.StatusOK], targets[http.StatusOK]}
+	assert.Nil(t, tg.queryPrepared())
+
+	tg.QueryPreparedURLs = []string{targets[http.StatusConflict], targets[http.StatusTooEarly], targets[http.StatusConflict]}
+	assert.ErrorIs(t, tg.queryPrepared(), dtmcli.ErrOngoing)
+	tg.QueryPreparedQuorum = 2
+	assert.ErrorIs(t, tg.queryPrepared(), dtmcli.ErrFailure)
+	assert.Nil(t, tg.checkQueryPreparedTargets())
+	tg.QueryPreparedQuorum = 4
+	assert.ErrorIs(t, tg.checkQueryPreparedTargets(), dtmcli.ErrInvalidArgument)
+}
+
+func TestBranchHeaders(t *testing.T) {
+	received := http.Header{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer svr.Close()
+	tg := TransGlobal{}
+	tg.TransType = "saga"
+	tg.BranchHeaders = map[string]string{"x-api-key": "trans", "x-trans": "1"}
+	step := map[string]string{"headers": `{"x-api-key":"vendor-a"}`}
+	assert.Nil(t, checkBranchHeaders(step))
+	ext, err := branchExtFromMap(step)
+	assert.Nil(t, err)
+	branch := TransBranch{BranchID: "01", Op: dtmcli.BranchAction, URL: svr.URL, Ext: ext}
+	assert.Nil(t, tg.getURLResult(&branch))
+	assert.Equal(t, "vendor-a", received.Get("x-api-key"))
+	assert.Equal(t, "1", received.Get("x-trans"))
+
+	assert.ErrorIs(t, checkBranchHeaders(map[string]string{"headers": `["x-api-key"]`}), dtmcli.ErrInvalidArgument)
+	assert.ErrorIs(t, checkBranchHeaders(map[string]string{"headers": `{"x api":"a"}`}), dtmcli.ErrInvalidArgument)
+	conf.BranchHeadersLimit = 8
+	defer func() { conf.BranchHeadersLimit = 0 }()
+	assert.ErrorIs(t, checkBranchHeaders(step), dtmcli.ErrInvalidArgument)
+}
+
+func TestFailureReason(t *testing.T) {
+	conf.RollbackReasonLimit = 10
+	defer func() { conf.RollbackReasonLimit = 4096 }()
+	assert.Equal(t, "not enough", failureReason(fmt.Errorf("not enough. %w", dtmcli.ErrFailure)))
+	assert.Equal(t, "balance no...(truncated)", failureReason(fmt.Errorf("balance not enough. %w", dtmcli.ErrFailure)))
+	reason := failureReason(fmt.Errorf("余额不足无法转出. %w", dtmcli.ErrFailure)) // 3 bytes a rune, so the 10th byte is in the 4th rune
+	assert.Equal(t, "余额不...(truncated)", reason)
+	assert.True(t, utf8.ValidString(reason))
+
+	branch := TransBranch{BranchID: "01", Op: dtmcli.BranchAction, URL: "http://localhost:1/none"}
+	tg := TransGlobal{}
+	tg.TransType = "saga"
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("no stock"))
+	}))
+	defer svr.Close()
+	branch.URL = svr.URL
+	status, err := tg.getBranchResult(&branch)
+	assert.Nil(t, err)
+	assert.Equal(t, dtmcli.StatusFailed, status)
+	assert.Equal(t, "no stock", branch.Ext.FailureReason)
+}
+
+func TestResponseBodyLimit(t *testing.T) {
+	conf.ResponseBodyLimit = 1024
+	defer func() { conf.ResponseBodyLimit = 0 }()
+	code := http.StatusConflict
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		chunk := bytes.Repeat([]byte("<html>error</html>"), 4096)
+		for i := 0; i < 1000; i++ { // about 70MB
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer svr.Close()
+
+	tg := TransGlobal{}
+	tg.Gid = "TestResponseBodyLimit"
+	tg.TransType = "saga"
+	branch := TransBranch{URL: svr.URL, BranchID: "01", Op: dtmcli.BranchAction}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	status, err := tg.getBranchResult(&branch)
+	runtime.ReadMemStats(&after)
+	assert.Nil(t, err)
+	assert.Equal(t, dtmcli.StatusFailed, status)
+	assert.Equal(t, 1024, len(branch.Ext.FailureReason))
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(16<<20))
+
+	code = http.StatusOK
+	branch.Ext.KeepResult = true
+	status, err = tg.getBranchResult(&branch)
+	assert.Nil(t, err)
+	assert.Equal(t, dtmcli.StatusSucceed, status)
+	assert.Equal(t, 1024, len(branch.Ext.Result))
+}
+
+func TestHandlePanicConflict(t *testing.T) {
+	err := func() (rerr error) {
+		defer handlePanic(&rerr)
+		panic(&storage.StatusConflictError{Gid: "TestHandlePanicConflict", Expected: "submitted", Actual: "succeed"})
+	}()
+	assert.Nil(t, err)
+
+	err = func() (rerr error) {
+		defer handlePanic(&rerr)
+		panic(storage.ErrNotFound)
+	}()
+	assert.Error(t, err)
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	var deadline time.Time
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dtmcli.BranchContext(r.Context(), r.Header)
+		defer cancel()
+		deadline, _ = ctx.Deadline()
+	}))
+	defer svr.Close()
+
+	tg := TransGlobal{}
+	tg.Gid = "TestDeadlineHeader"
+	tg.TransType = "saga"
+	tg.RequestTimeout = 5
+	branch := TransBranch{URL: svr.URL, BranchID: "01", Op: dtmcli.BranchAction}
+	begin := time.Now()
+	assert.Nil(t, tg.getURLResult(&branch))
+	assert.WithinDuration(t, begin.Add(5*time.Second), deadline, time.Second)
+}
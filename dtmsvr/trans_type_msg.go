@@ -9,10 +9,15 @@ package dtmsvr
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/msgbroker"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 )
 
 type transMsgProcessor struct {
@@ -23,43 +28,177 @@ func init() {
 	registorProcessorCreator("msg", func(trans *TransGlobal) transProcessor { return &transMsgProcessor{TransGlobal: trans} })
 }
 
-func (t *transMsgProcessor) GenBranches() []TransBranch {
+func (t *transMsgProcessor) GenBranches() ([]TransBranch, error) {
 	branches := []TransBranch{}
 	for i, step := range t.Steps {
-		b := &TransBranch{
-			Gid:      t.Gid,
-			BranchID: fmt.Sprintf("%02d", i+1),
-			BinData:  t.BinPayloads[i],
-			URL:      step[dtmcli.BranchAction],
-			Op:       dtmcli.BranchAction,
-			Status:   dtmcli.StatusPrepared,
+		ext, err := branchExtFromMap(step)
+		if err != nil {
+			return nil, err
+		}
+		delay, err := branchInt(step, "delay")
+		if err != nil {
+			return nil, err
+		}
+		urls := []string{step[dtmcli.BranchAction]}
+		topic := strings.TrimPrefix(urls[0], dtmimp.MsgTopicPrefix)
+		isTopic := topic != urls[0]
+		if isTopic { // the subscribers are expanded now, so later subscribers will not affect this msg
+			_, subscribers := findSubscribers(topic)
+			urls = []string{}
+			for _, s := range subscribers {
+				urls = append(urls, s.URL)
+			}
+		}
+		for j, url := range urls {
+			b := &TransBranch{
+				Gid:      t.Gid,
+				BranchID: fmt.Sprintf("%02d", i+1),
+				BinData:  t.BinPayloads[i],
+				URL:      url,
+				Op:       dtmcli.BranchAction,
+				Status:   dtmcli.StatusPrepared,
+				Ext:      ext,
+			}
+			if isTopic {
+				b.BranchID = fmt.Sprintf("%02d-%02d", i+1, j+1)
+			}
+			if step["delay"] != "" {
+				notBefore := t.CreateTime.Add(storage.ClockSkew() + time.Duration(delay)*time.Second) // in the clock of the store
+				b.Ext.NotBefore = &notBefore
+			}
+			branches = append(branches, *b)
 		}
-		branches = append(branches, *b)
 	}
-	return branches
+	return branches, nil
+}
+
+// checkBrokerURLs checks the branches targeting message brokers. only msg branches can target brokers
+func checkBrokerURLs(transType string, branches []TransBranch) error {
+	for _, b := range branches {
+		if !msgbroker.IsBrokerURL(b.URL) {
+			continue
+		}
+		if transType != "msg" {
+			return fmt.Errorf("broker url %s is only supported by msg. %w", b.URL, dtmcli.ErrFailure)
+		}
+		if err := msgbroker.CheckURL(b.URL); err != nil {
+			return fmt.Errorf("%v. %w", err, dtmcli.ErrFailure)
+		}
+	}
+	return nil
 }
 
 type cMsgCustom struct {
 	Delay uint64 //delay call branch, unit second
 }
 
+// queryPreparedTargets returns the urls to query the prepared msg
+func (t *TransGlobal) queryPreparedTargets() []string {
+	if len(t.QueryPreparedURLs) > 0 {
+		return t.QueryPreparedURLs
+	}
+	return []string{t.QueryPrepared}
+}
+
+// checkQueryPreparedTargets checks the query prepared targets and the quorum of a msg. the targets are dispatched by
+// their schemes, so a msg of grpc can be queried by http, and a msg of http by grpc:// or a registered protocol
+func (t *TransGlobal) checkQueryPreparedTargets() error {
+	n := len(t.QueryPreparedURLs)
+	if n > 0 && t.TransType != "msg" {
+		return fmt.Errorf("query_prepared_urls is only for msg. %w", dtmcli.ErrInvalidArgument)
+	}
+	if t.QueryPreparedQuorum < 0 || t.QueryPreparedQuorum > n {
+		return fmt.Errorf("query_prepared_quorum %d should be between 0 and %d. %w", t.QueryPreparedQuorum, n, dtmcli.ErrInvalidArgument)
+	}
+	for _, target := range t.queryPreparedTargets() {
+		if target == "" || getProtocol(target) != nil && urlScheme(target) != "grpc" {
+			continue
+		}
+		if err := dtmimp.CheckQueryPrepared(t.Protocol == "grpc", target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryPrepared queries the targets concurrently. the result is success if quorum of them succeed and none fails,
+// failure if quorum of them fail and none succeeds, else ongoing, or the unexpected error of a target
+func (t *TransGlobal) queryPrepared() error {
+	targets := t.queryPreparedTargets()
+	if len(targets) == 1 {
+		return t.invokeBranch(&TransBranch{URL: targets[0], BranchID: "00", Op: "msg"})
+	}
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, url := range targets {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			errs[i] = t.invokeBranch(&TransBranch{URL: url, BranchID: "00", Op: "msg"})
+		}(i, url)
+	}
+	wg.Wait()
+	quorum := dtmimp.If(t.QueryPreparedQuorum > 0, t.QueryPreparedQuorum, len(targets)).(int)
+	succeeded, failed := 0, 0
+	var unexpected error
+	for i, err := range errs {
+		logger.Gid(t.Gid).Infof("query prepared %s result: %v", targets[i], err)
+		if err == nil {
+			succeeded++
+		} else if errors.Is(err, dtmcli.ErrFailure) {
+			failed++
+		} else if !errors.Is(err, dtmcli.ErrOngoing) && unexpected == nil {
+			unexpected = err
+		}
+	}
+	if succeeded >= quorum && failed == 0 {
+		return nil
+	} else if failed >= quorum && succeeded == 0 {
+		return fmt.Errorf("%d of %d query prepared targets failed. %w", failed, len(targets), dtmcli.ErrFailure)
+	} else if unexpected != nil {
+		return unexpected
+	}
+	return fmt.Errorf("%d succeeded and %d failed of %d query prepared targets, quorum %d. %w",
+		succeeded, failed, len(targets), quorum, dtmcli.ErrOngoing)
+}
+
 func (t *TransGlobal) mayQueryPrepared() {
 	if !t.needProcess() || t.Status == dtmcli.StatusSubmitted {
 		return
 	}
-	err := t.getURLResult(t.QueryPrepared, "00", "msg", nil)
+	err := t.queryPrepared()
 	if err == nil {
 		t.changeStatus(dtmcli.StatusSubmitted)
 	} else if errors.Is(err, dtmcli.ErrFailure) {
+		t.RollbackReason = "query prepared failed"
 		t.changeStatus(dtmcli.StatusFailed)
 	} else if errors.Is(err, dtmcli.ErrOngoing) {
-		t.touchCronTime(cronReset, 0)
+		t.touchCronTime(cronReset, suggestedDelay(err))
 	} else {
-		logger.Errorf("getting result failed for %s. error: %v", t.QueryPrepared, err)
+		logger.Gid(t.Gid).Errorf("getting result failed for %s. error: %v", strings.Join(t.queryPreparedTargets(), ","), err)
 		t.touchCronTime(cronBackoff, 0)
 	}
 }
 
+// msgBranchesToRun returns the positions of the prepared actions to run now, and the earliest time of the delayed ones
+func msgBranchesToRun(branches []TransBranch) (toRun []int, notBefore *time.Time) {
+	toRun = []int{}
+	for i := range branches {
+		b := &branches[i]
+		if b.Op != dtmcli.BranchAction || b.Status != dtmcli.StatusPrepared {
+			continue
+		}
+		if b.Ext.NotBefore != nil && storage.Now().Add(CronForwardDuration).Before(*b.Ext.NotBefore) {
+			if notBefore == nil || b.Ext.NotBefore.Before(*notBefore) {
+				notBefore = b.Ext.NotBefore
+			}
+			continue
+		}
+		toRun = append(toRun, i)
+	}
+	return toRun, notBefore
+}
+
 func (t *transMsgProcessor) ProcessOnce(branches []TransBranch) error {
 	t.mayQueryPrepared()
 	if !t.needProcess() || t.Status == dtmcli.StatusPrepared {
@@ -77,11 +216,9 @@ func (t *transMsgProcessor) ProcessOnce(branches []TransBranch) error {
 	var started int
 	resultsChan := make(chan error, len(branches))
 	var err error
-	for i := range branches {
+	toRun, notBefore := msgBranchesToRun(branches)
+	for _, i := range toRun {
 		b := &branches[i]
-		if b.Op != dtmcli.BranchAction || b.Status != dtmcli.StatusPrepared {
-			continue
-		}
 		if t.Concurrent {
 			started++
 			go func(pos int) {
@@ -97,11 +234,19 @@ func (t *transMsgProcessor) ProcessOnce(branches []TransBranch) error {
 	for i := 0; i < started && err == nil; i++ {
 		err = <-resultsChan
 	}
-	if err == dtmcli.ErrOngoing {
+	if errors.Is(err, dtmcli.ErrOngoing) {
 		return nil
 	} else if err != nil {
 		return err
 	}
+	if notBefore != nil { // wait for the delayed branches
+		t.touchCronTime(cronKeep, uint64(notBefore.Sub(storage.Now())/time.Second)+1)
+		return nil
+	}
+	if t.partialBranches { // the actions in the next pages are processed soon
+		t.touchCronTime(cronReset, 1)
+		return nil
+	}
 	t.changeStatus(dtmcli.StatusSucceed)
 	return nil
 }
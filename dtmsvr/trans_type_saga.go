@@ -9,11 +9,13 @@ package dtmsvr
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 )
 
 type transSagaProcessor struct {
@@ -26,10 +28,14 @@ func init() {
 	})
 }
 
-func (t *transSagaProcessor) GenBranches() []TransBranch {
+func (t *transSagaProcessor) GenBranches() ([]TransBranch, error) {
 	branches := []TransBranch{}
 	for i, step := range t.Steps {
 		branch := fmt.Sprintf("%02d", i+1)
+		ext, err := branchExtFromMap(step)
+		if err != nil {
+			return nil, err
+		}
 		for _, op := range []string{dtmcli.BranchCompensate, dtmcli.BranchAction} {
 			branches = append(branches, TransBranch{
 				Gid:      t.Gid,
@@ -38,16 +44,175 @@ func (t *transSagaProcessor) GenBranches() []TransBranch {
 				URL:      step[op],
 				Op:       op,
 				Status:   dtmcli.StatusPrepared,
+				Ext:      ext,
 			})
 		}
 	}
-	return branches
+	return branches, nil
 }
 
 type cSagaCustom struct {
-	Orders     map[int][]int `json:"orders"`
-	Concurrent bool          `json:"concurrent"`
-	cOrders    map[int][]int
+	Orders               map[int][]int `json:"orders"`
+	Concurrent           bool          `json:"concurrent"`
+	CompensatePriorities map[int]int   `json:"compensate_priorities,omitempty"` // compensations are executed by priority desc if specified
+	MaxParallel          int           `json:"max_parallel,omitempty"`          // max branches executed at the same time. 0 means unlimited
+	cOrders              map[int][]int
+}
+
+// parseSagaCustom parses the custom data of saga, and fills the reverse orders used by compensation
+func parseSagaCustom(customData string) cSagaCustom {
+	csc := cSagaCustom{Orders: map[int][]int{}, cOrders: map[int][]int{}}
+	if customData != "" {
+		dtmimp.MustUnmarshalString(customData, &csc)
+		for k, v := range csc.Orders {
+			for _, b := range v {
+				csc.cOrders[b] = append(csc.cOrders[b], k)
+			}
+		}
+	}
+	return csc
+}
+
+// checkBranchOrders checks the custom options of saga: the dependencies of branches form a DAG, and the compensate priorities refer to valid branches
+func (t *TransGlobal) checkBranchOrders() error {
+	if t.TransType != "saga" {
+		return nil
+	}
+	csc := parseSagaCustom(t.CustomData)
+	n := len(t.Steps)
+	for b, pres := range csc.Orders {
+		for _, pre := range pres {
+			if b < 0 || b >= n || pre < 0 || pre >= n {
+				return fmt.Errorf("branch order %d -> %d out of range, %d branches in saga. %w", pre, b, n, dtmcli.ErrFailure)
+			}
+		}
+	}
+	if err := checkBranchGroups(t.Steps, csc); err != nil {
+		return err
+	}
+	if csc.MaxParallel < 0 {
+		return fmt.Errorf("max parallel %d should not be negative. %w", csc.MaxParallel, dtmcli.ErrFailure)
+	}
+	for b := range csc.CompensatePriorities {
+		if b < 0 || b >= n {
+			return fmt.Errorf("compensate priority of branch %d out of range, %d branches in saga. %w", b, n, dtmcli.ErrFailure)
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, n)
+	path := []int{}
+	var visit func(b int) []int
+	visit = func(b int) []int { // returns the cycle found
+		states[b] = visiting
+		path = append(path, b)
+		for _, pre := range csc.Orders[b] {
+			if states[pre] == visiting {
+				for i, p := range path {
+					if p == pre {
+						return append(append([]int{}, path[i:]...), pre)
+					}
+				}
+			} else if states[pre] == unvisited {
+				if cycle := visit(pre); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		states[b] = visited
+		return nil
+	}
+	for b := 0; b < n; b++ {
+		if states[b] == unvisited {
+			if cycle := visit(b); cycle != nil {
+				return fmt.Errorf("branch orders have a cycle: %v (each branch depends on the next). %w", cycle, dtmcli.ErrFailure)
+			}
+		}
+	}
+	return nil
+}
+
+// checkBranchGroups checks the groups of the branches: the groups need a concurrent saga, a branch is not after another
+// branch of its group, and a branch after some branch of a group is after the whole group
+func checkBranchGroups(steps []map[string]string, csc cSagaCustom) error {
+	members := map[string][]int{}
+	for i, step := range steps {
+		if g := step["group"]; g != "" {
+			members[g] = append(members[g], i)
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	} else if !csc.Concurrent {
+		return fmt.Errorf("branch groups need a concurrent saga. %w", dtmcli.ErrFailure)
+	}
+	for b, pres := range csc.Orders {
+		after := map[int]bool{}
+		for _, pre := range pres {
+			after[pre] = true
+		}
+		for _, pre := range pres {
+			g := steps[pre]["group"]
+			if g == "" {
+				continue
+			} else if steps[b]["group"] == g {
+				return fmt.Errorf("branch %d is after branch %d of the same group %s. %w", b, pre, g, dtmcli.ErrFailure)
+			}
+			for _, m := range members[g] {
+				if !after[m] {
+					return fmt.Errorf("branch %d should be after the whole group %s, but not after branch %d. %w", b, g, m, dtmcli.ErrFailure)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// branchDependency is the dependency state of a saga branch, exposed by the query api
+type branchDependency struct {
+	BranchID   string   `json:"branch_id"`
+	Group      string   `json:"group,omitempty"`
+	DependsOn  []string `json:"depends_on"`
+	WaitingFor []string `json:"waiting_for"` // the branches whose action has not succeeded
+}
+
+// getBranchDependencies returns the dependency state of the branches of a concurrent saga
+func getBranchDependencies(trans *storage.TransGlobalStore, branches []TransBranch) []branchDependency {
+	if trans.TransType != "saga" || trans.CustomData == "" {
+		return nil
+	}
+	csc := parseSagaCustom(trans.CustomData)
+	succeeded := map[string]bool{}
+	for _, b := range branches {
+		if b.Op == dtmcli.BranchAction && b.Status == dtmcli.StatusSucceed {
+			succeeded[b.BranchID] = true
+		}
+	}
+	deps := []branchDependency{}
+	for _, b := range branches {
+		if b.Op != dtmcli.BranchAction {
+			continue
+		}
+		dep := branchDependency{BranchID: b.BranchID, DependsOn: []string{}, WaitingFor: []string{}}
+		if b.ExtData != "" {
+			ext := storage.TransBranchExt{}
+			dtmimp.MustUnmarshalString(b.ExtData, &ext)
+			dep.Group = ext.Group
+		}
+		for _, pre := range csc.Orders[dtmimp.MustAtoi(b.BranchID)-1] {
+			preID := fmt.Sprintf("%02d", pre+1)
+			dep.DependsOn = append(dep.DependsOn, preID)
+			if !succeeded[preID] {
+				dep.WaitingFor = append(dep.WaitingFor, preID)
+			}
+		}
+		deps = append(deps, dep)
+	}
+	return deps
 }
 
 type branchResult struct {
@@ -61,25 +226,20 @@ func (t *transSagaProcessor) ProcessOnce(branches []TransBranch) error {
 	// when saga tasks is fetched, it always need to process
 	logger.Debugf("status: %s timeout: %t", t.Status, t.isTimeout())
 	if t.Status == dtmcli.StatusSubmitted && t.isTimeout() {
+		t.RollbackReason = "timeout"
 		t.changeStatus(dtmcli.StatusAborting)
 	}
 	n := len(branches)
 
-	csc := cSagaCustom{Orders: map[int][]int{}, cOrders: map[int][]int{}}
-	if t.CustomData != "" {
-		dtmimp.MustUnmarshalString(t.CustomData, &csc)
-		for k, v := range csc.Orders {
-			for _, b := range v {
-				csc.cOrders[b] = append(csc.cOrders[b], k)
-			}
-		}
-	}
-	if csc.Concurrent || t.TimeoutToFail > 0 { // when saga is not normal, update branch sync
+	csc := parseSagaCustom(t.CustomData)
+	if csc.Concurrent || t.TimeoutToFail > 0 || len(csc.CompensatePriorities) > 0 { // when saga is not normal, update branch sync
 		t.updateBranchSync = true
 	}
 	// resultStats
 	var rsAToStart, rsAStarted, rsADone, rsAFailed, rsASucceed, rsCToStart, rsCDone, rsCSucceed int
+	running := 0                             // branches executing now, limited by csc.MaxParallel
 	branchResults := make([]branchResult, n) // save the branch result
+	failedActions := []int{}                 // the actions failed in this process, in the order of their results
 	for i := 0; i < n; i++ {
 		b := branches[i]
 		if b.Op == dtmcli.BranchAction {
@@ -91,39 +251,7 @@ func (t *transSagaProcessor) ProcessOnce(branches []TransBranch) error {
 		}
 		branchResults[i] = branchResult{index: i, status: branches[i].Status, op: branches[i].Op}
 	}
-	shouldRun := func(current int) bool {
-		// if !csc.Concurrent，then check the branch in previous step is succeed
-		if !csc.Concurrent && current >= 2 && branchResults[current-2].status != dtmcli.StatusSucceed {
-			return false
-		}
-		// if csc.concurrent, then check the Orders. origin one step correspond to 2 step in dtmsvr
-		for _, pre := range csc.Orders[current/2] {
-			if branchResults[pre*2+1].status != dtmcli.StatusSucceed {
-				return false
-			}
-		}
-		return true
-	}
-	shouldRollback := func(current int) bool {
-		rollbacked := func(i int) bool {
-			// current compensate op rollbacked or related action still prepared
-			return branchResults[i].status == dtmcli.StatusSucceed || branchResults[i+1].status == dtmcli.StatusPrepared
-		}
-		if rollbacked(current) {
-			return false
-		}
-		// if !csc.Concurrent，then check the branch in next step is rollbacked
-		if !csc.Concurrent && current < n-2 && !rollbacked(current+2) {
-			return false
-		}
-		// if csc.concurrent, then check the cOrders. origin one step correspond to 2 step in dtmsvr
-		for _, next := range csc.cOrders[current/2] {
-			if !rollbacked(2 * next) {
-				return false
-			}
-		}
-		return true
-	}
+	plan := &sagaPlan{csc: csc, results: branchResults, groups: sagaGroups(branches)}
 	resultChan := make(chan branchResult, n)
 	asyncExecBranch := func(i int) {
 		var err error
@@ -133,51 +261,60 @@ func (t *transSagaProcessor) ProcessOnce(branches []TransBranch) error {
 			}
 			resultChan <- branchResult{index: i, status: branches[i].Status, op: branches[i].Op}
 			if err != nil && !errors.Is(err, dtmcli.ErrOngoing) {
-				logger.Errorf("exec branch error: %v", err)
+				logger.Gid(t.Gid).Errorf("exec branch error: %v", err)
 			}
 		}()
 		err = t.execBranch(&branches[i], i)
 	}
-	pickToRunActions := func() []int {
-		toRun := []int{}
-		for current := 1; current < n; current += 2 {
-			br := &branchResults[current]
-			if !br.started && br.status == dtmcli.StatusPrepared && shouldRun(current) {
-				toRun = append(toRun, current)
+	// resolveBranch replaces the result references in the payload of the branch with the results of the succeeded actions
+	resolveBranch := func(current int) error {
+		results := map[string]string{}
+		for i := 1; i < n; i += 2 {
+			if branchResults[i].status == dtmcli.StatusSucceed && branches[i].Ext.Result != "" {
+				results[branches[i].BranchID] = branches[i].Ext.Result
 			}
 		}
-		logger.Debugf("toRun picked for action is: %v branchResults: %v compensate orders: %v", toRun, branchResults, csc.cOrders)
-		return toRun
-	}
-	pickToRunCompensates := func() []int {
-		toRun := []int{}
-		for current := n - 2; current >= 0; current -= 2 {
-			br := &branchResults[current]
-			if !br.started && br.status == dtmcli.StatusPrepared && shouldRollback(current) {
-				toRun = append(toRun, current)
-			}
+		// the action of a compensation may fail or time out without a result, then the result it refers to is null
+		if _, ok := results[branches[current].BranchID]; !ok && branches[current].Op == dtmcli.BranchCompensate {
+			results[branches[current].BranchID] = "null"
 		}
-		logger.Debugf("toRun picked for compensate is: %v branchResults: %v compensate orders: %v", toRun, branchResults, csc.cOrders)
-		return toRun
+		payload, err := resolveResultRefs(branches[current].BinData, results)
+		if err == nil {
+			branches[current].BinData = payload
+		}
+		return err
 	}
 	runBranches := func(toRun []int) {
 		for _, b := range toRun {
+			if csc.MaxParallel > 0 && running >= csc.MaxParallel { // the rest will be picked when some branch done
+				break
+			}
+			running++
 			branchResults[b].started = true
 			if branchResults[b].op == dtmcli.BranchAction {
 				rsAStarted++
 			}
+			if t.hasResultRefs(&branches[b]) {
+				if err := resolveBranch(b); err != nil { // do not send a broken payload. the branch stays prepared
+					t.markManual(fmt.Sprintf("resolve payload of branch %s %s error: %v", branches[b].BranchID, branches[b].Op, err))
+					resultChan <- branchResult{index: b, status: branches[b].Status, op: branches[b].Op}
+					continue
+				}
+			}
 			go asyncExecBranch(b)
 		}
 	}
 	waitDoneOnce := func() {
 		select {
 		case r := <-resultChan:
+			running--
 			br := &branchResults[r.index]
 			br.status = r.status
 			if r.op == dtmcli.BranchAction {
 				rsADone++
 				if r.status == dtmcli.StatusFailed {
 					rsAFailed++
+					failedActions = append(failedActions, r.index)
 				} else if r.status == dtmcli.StatusSucceed {
 					rsASucceed++
 				}
@@ -193,14 +330,7 @@ func (t *transSagaProcessor) ProcessOnce(branches []TransBranch) error {
 		}
 	}
 	prepareToCompensate := func() {
-		_ = pickToRunActions() // flag started
-		for i := 1; i < len(branchResults); i += 2 {
-			// these branches may have run. so flag them to status succeed, then run the corresponding
-			// compensate
-			if branchResults[i].started && branchResults[i].status == dtmcli.StatusPrepared {
-				branchResults[i].status = dtmcli.StatusSucceed
-			}
-		}
+		plan.markMayRun()
 		for i, b := range branchResults {
 			if b.op == dtmcli.BranchCompensate && b.status != dtmcli.StatusSucceed &&
 				branchResults[i+1].status != dtmcli.StatusPrepared {
@@ -211,25 +341,38 @@ func (t *transSagaProcessor) ProcessOnce(branches []TransBranch) error {
 	}
 	timeLimit := time.Now().Add(time.Duration(conf.RequestTimeout+2) * time.Second)
 	for time.Now().Before(timeLimit) && t.Status == dtmcli.StatusSubmitted && !t.isTimeout() && rsAFailed == 0 {
-		toRun := pickToRunActions()
+		toRun := plan.pickActions()
 		runBranches(toRun)
 		if rsADone == rsAStarted { // no branch is running, so break
 			break
 		}
 		waitDoneOnce()
 	}
-	if t.Status == dtmcli.StatusSubmitted && rsAFailed == 0 && rsAToStart == rsASucceed {
+	if t.Status == dtmcli.StatusSubmitted && rsAFailed == 0 && rsAToStart == rsASucceed && t.partialBranches {
+		t.touchCronTime(cronReset, 1) // the actions in the next pages are processed soon
+		return nil
+	} else if t.Status == dtmcli.StatusSubmitted && rsAFailed == 0 && rsAToStart == rsASucceed {
 		t.changeStatus(dtmcli.StatusSucceed)
 		return nil
 	}
 	if t.Status == dtmcli.StatusSubmitted && (rsAFailed > 0 || t.isTimeout()) {
+		t.RollbackReason = dtmimp.If(rsAFailed > 0, "branch action failed", "timeout").(string)
+		if len(failedActions) > 0 { // keep the first failure, and count the rest
+			b := &branches[failedActions[0]]
+			t.RollbackReason = fmt.Sprintf("branch %s action failed: %s", b.BranchID, b.Ext.FailureReason)
+			if len(failedActions) > 1 {
+				t.RollbackReason += fmt.Sprintf(" (and %d more actions failed)", len(failedActions)-1)
+			}
+		}
 		t.changeStatus(dtmcli.StatusAborting)
 	}
-	if t.Status == dtmcli.StatusAborting {
+	if t.Status == dtmcli.StatusAborting && (t.partialBranches || t.branchOffset > 0) {
+		return nil // compensated with all the branches in the next process
+	} else if t.Status == dtmcli.StatusAborting {
 		prepareToCompensate()
 	}
 	for time.Now().Before(timeLimit) && t.Status == dtmcli.StatusAborting {
-		toRun := pickToRunCompensates()
+		toRun := plan.pickCompensates()
 		runBranches(toRun)
 		if rsCDone == rsCToStart { // no branch is running, so break
 			break
@@ -242,3 +385,131 @@ func (t *transSagaProcessor) ProcessOnce(branches []TransBranch) error {
 	}
 	return nil
 }
+
+// sagaPlan decides which branches of a saga can run, by the results of the branches.
+// it is shared by the processor and the dry run
+type sagaPlan struct {
+	csc     cSagaCustom
+	results []branchResult
+	groups  []string // the group of each step
+}
+
+// sagaGroups returns the group of each step of the saga
+func sagaGroups(branches []TransBranch) []string {
+	groups := make([]string, len(branches)/2)
+	for i := 1; i < len(branches); i += 2 {
+		groups[i/2] = branches[i].Ext.Group
+	}
+	return groups
+}
+
+// failedGroups returns the groups with a failed action
+func (p *sagaPlan) failedGroups() map[string]bool {
+	failed := map[string]bool{}
+	for i := 1; i < len(p.results); i += 2 {
+		if i/2 < len(p.groups) && p.groups[i/2] != "" && p.results[i].status == dtmcli.StatusFailed {
+			failed[p.groups[i/2]] = true
+		}
+	}
+	return failed
+}
+
+// actionBlocker returns why the action can not run now. empty means it can run
+func (p *sagaPlan) actionBlocker(current int) string {
+	// if !csc.Concurrent，then check the branch in previous step is succeed
+	if !p.csc.Concurrent && current >= 2 && p.results[current-2].status != dtmcli.StatusSucceed {
+		return fmt.Sprintf("waiting for action %02d", current/2)
+	}
+	// if csc.concurrent, then check the Orders. origin one step correspond to 2 step in dtmsvr
+	pending := []string{}
+	for _, pre := range p.csc.Orders[current/2] {
+		if p.results[pre*2+1].status != dtmcli.StatusSucceed {
+			pending = append(pending, fmt.Sprintf("%02d", pre+1))
+		}
+	}
+	if len(pending) > 0 {
+		return "dependency pending: " + strings.Join(pending, ",")
+	}
+	return ""
+}
+
+// rollbacked returns whether the compensation needs no more execution
+func (p *sagaPlan) rollbacked(i int) bool {
+	// current compensate op rollbacked or related action still prepared
+	return p.results[i].status == dtmcli.StatusSucceed || p.results[i+1].status == dtmcli.StatusPrepared
+}
+
+// compensateBlocker returns why the compensation can not run now. empty means it can run
+func (p *sagaPlan) compensateBlocker(current int) string {
+	n := len(p.results)
+	if p.results[current].status == dtmcli.StatusSucceed {
+		return "already compensated"
+	} else if p.results[current+1].status == dtmcli.StatusPrepared {
+		return skipActionNotRun
+	}
+	// the branches of a group with a failed action are compensated at once, then the others as the normal rollback
+	if failed := p.failedGroups(); len(failed) > 0 {
+		if failed[p.groups[current/2]] {
+			return ""
+		}
+		for i := 0; i < n; i += 2 {
+			if failed[p.groups[i/2]] && !p.rollbacked(i) {
+				return fmt.Sprintf("waiting for compensation of group %s", p.groups[i/2])
+			}
+		}
+	}
+	// if priorities specified, all the compensations of higher priority should be rollbacked
+	if len(p.csc.CompensatePriorities) > 0 {
+		for i := 0; i < n; i += 2 {
+			if p.csc.CompensatePriorities[i/2] > p.csc.CompensatePriorities[current/2] && !p.rollbacked(i) {
+				return fmt.Sprintf("waiting for compensation %02d of higher priority", i/2+1)
+			}
+		}
+		return ""
+	}
+	// if !csc.Concurrent，then check the branch in next step is rollbacked
+	if !p.csc.Concurrent && current < n-2 && !p.rollbacked(current+2) {
+		return fmt.Sprintf("waiting for compensation %02d", current/2+2)
+	}
+	// if csc.concurrent, then check the cOrders. origin one step correspond to 2 step in dtmsvr
+	for _, next := range p.csc.cOrders[current/2] {
+		if !p.rollbacked(2 * next) {
+			return fmt.Sprintf("waiting for compensation %02d", next+1)
+		}
+	}
+	return ""
+}
+
+func (p *sagaPlan) pickActions() []int {
+	toRun := []int{}
+	for current := 1; current < len(p.results); current += 2 {
+		br := &p.results[current]
+		if !br.started && br.status == dtmcli.StatusPrepared && p.actionBlocker(current) == "" {
+			toRun = append(toRun, current)
+		}
+	}
+	logger.Debugf("toRun picked for action is: %v branchResults: %v compensate orders: %v", toRun, p.results, p.csc.cOrders)
+	return toRun
+}
+
+func (p *sagaPlan) pickCompensates() []int {
+	toRun := []int{}
+	for current := len(p.results) - 2; current >= 0; current -= 2 {
+		br := &p.results[current]
+		if !br.started && br.status == dtmcli.StatusPrepared && p.compensateBlocker(current) == "" {
+			toRun = append(toRun, current)
+		}
+	}
+	logger.Debugf("toRun picked for compensate is: %v branchResults: %v compensate orders: %v", toRun, p.results, p.csc.cOrders)
+	return toRun
+}
+
+// markMayRun flags the actions which may have run as succeeded, so that their compensations will run
+func (p *sagaPlan) markMayRun() {
+	_ = p.pickActions() // flag started
+	for i := 1; i < len(p.results); i += 2 {
+		if p.results[i].started && p.results[i].status == dtmcli.StatusPrepared {
+			p.results[i].status = dtmcli.StatusSucceed
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBranchOrders(t *testing.T) {
+	tg := TransGlobal{}
+	tg.TransType = "saga"
+	tg.Steps = make([]map[string]string, 5)
+	orders := func(o map[int][]int) string {
+		return dtmimp.MustMarshalString(map[string]interface{}{"orders": o, "concurrent": true})
+	}
+	tg.CustomData = orders(map[int][]int{1: {0}, 2: {0}, 3: {1, 2}})
+	assert.Nil(t, tg.checkBranchOrders())
+
+	tg.CustomData = orders(map[int][]int{1: {0}, 2: {3}, 3: {1, 2}})
+	err := tg.checkBranchOrders()
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+	assert.Contains(t, err.Error(), "[2 3 2]")
+
+	tg.CustomData = orders(map[int][]int{1: {1}})
+	assert.True(t, errors.Is(tg.checkBranchOrders(), dtmcli.ErrFailure))
+	tg.CustomData = orders(map[int][]int{1: {5}})
+	assert.True(t, errors.Is(tg.checkBranchOrders(), dtmcli.ErrFailure))
+
+	tg.CustomData = `{"compensate_priorities":{"4":1,"0":2}}`
+	assert.Nil(t, tg.checkBranchOrders())
+	tg.CustomData = `{"compensate_priorities":{"5":1}}`
+	assert.True(t, errors.Is(tg.checkBranchOrders(), dtmcli.ErrFailure))
+	tg.CustomData = `{"max_parallel":-1}`
+	assert.True(t, errors.Is(tg.checkBranchOrders(), dtmcli.ErrFailure))
+}
+
+func TestGetBranchDependencies(t *testing.T) {
+	tg := TransGlobal{}
+	tg.TransType = "saga"
+	assert.Nil(t, getBranchDependencies(&tg.TransGlobalStore, nil))
+
+	tg.CustomData = dtmimp.MustMarshalString(map[string]interface{}{"orders": map[int][]int{2: {0, 1}}, "concurrent": true})
+	branches := []TransBranch{
+		{BranchID: "01", Op: dtmcli.BranchAction, Status: dtmcli.StatusSucceed},
+		{BranchID: "02", Op: dtmcli.BranchAction, Status: dtmcli.StatusPrepared},
+		{BranchID: "03", Op: dtmcli.BranchCompensate, Status: dtmcli.StatusPrepared},
+		{BranchID: "03", Op: dtmcli.BranchAction, Status: dtmcli.StatusPrepared},
+	}
+	deps := getBranchDependencies(&tg.TransGlobalStore, branches)
+	assert.Equal(t, 3, len(deps))
+	assert.Equal(t, branchDependency{BranchID: "03", DependsOn: []string{"01", "02"}, WaitingFor: []string{"02"}}, deps[2])
+}
+
+func TestCheckBranchGroups(t *testing.T) {
+	tg := TransGlobal{}
+	tg.TransType = "saga"
+	tg.Steps = []map[string]string{{"group": "g"}, {"group": "g"}, {}, {"group": "h"}}
+	orders := func(o map[int][]int) string {
+		return dtmimp.MustMarshalString(map[string]interface{}{"orders": o, "concurrent": true})
+	}
+	tg.CustomData = orders(map[int][]int{2: {0, 1}, 3: {2}})
+	assert.Nil(t, tg.checkBranchOrders())
+
+	tg.CustomData = orders(map[int][]int{2: {1}})
+	err := tg.checkBranchOrders()
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+	assert.Contains(t, err.Error(), "whole group g")
+	tg.CustomData = orders(map[int][]int{1: {0}})
+	assert.Contains(t, tg.checkBranchOrders().Error(), "same group g")
+	tg.CustomData = ""
+	assert.Contains(t, tg.checkBranchOrders().Error(), "concurrent saga")
+}
+
+func TestSagaPlanGroupCompensate(t *testing.T) {
+	results := []branchResult{}
+	for _, s := range []string{
+		dtmcli.StatusPrepared, dtmcli.StatusSucceed, // 01 in group g
+		dtmcli.StatusPrepared, dtmcli.StatusFailed, // 02 in group g
+		dtmcli.StatusPrepared, dtmcli.StatusSucceed, // 03 of higher priority
+	} {
+		results = append(results, branchResult{status: s})
+	}
+	plan := &sagaPlan{csc: parseSagaCustom(`{"concurrent":true,"compensate_priorities":{"2":1}}`), results: results, groups: []string{"g", "g", ""}}
+	// the group is compensated first, though 03 has a higher priority
+	assert.Equal(t, []int{2, 0}, plan.pickCompensates())
+	assert.Equal(t, "waiting for compensation of group g", plan.compensateBlocker(4))
+	plan.results[0].status, plan.results[2].status = dtmcli.StatusSucceed, dtmcli.StatusSucceed
+	assert.Equal(t, []int{4}, plan.pickCompensates())
+}
@@ -7,9 +7,13 @@
 package dtmsvr
 
 import (
+	"errors"
+	"sync"
+
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 )
 
 type transTccProcessor struct {
@@ -20,27 +24,167 @@ func init() {
 	registorProcessorCreator("tcc", func(trans *TransGlobal) transProcessor { return &transTccProcessor{TransGlobal: trans} })
 }
 
-func (t *transTccProcessor) GenBranches() []TransBranch {
-	return []TransBranch{}
+func (t *transTccProcessor) GenBranches() ([]TransBranch, error) {
+	return []TransBranch{}, nil
+}
+
+type cTccCustom struct {
+	Concurrent  bool `json:"concurrent"`             // confirm/cancel branches concurrently
+	MaxParallel int  `json:"max_parallel,omitempty"` // max branches executed at the same time. 0 means unlimited
 }
 
 func (t *transTccProcessor) ProcessOnce(branches []TransBranch) error {
 	if !t.needProcess() {
 		return nil
 	}
-	if t.Status == dtmcli.StatusPrepared && t.isTimeout() {
+	if reason := t.preparedTimeoutReason(); t.Status == dtmcli.StatusPrepared && reason != "" {
+		t.RollbackReason = reason // a late submit conflicts with the change, and only one of them wins
 		t.changeStatus(dtmcli.StatusAborting)
 	}
 	op := dtmimp.If(t.Status == dtmcli.StatusSubmitted, dtmcli.BranchConfirm, dtmcli.BranchCancel).(string)
+	ctc := cTccCustom{}
+	if t.CustomData != "" {
+		dtmimp.MustUnmarshalString(t.CustomData, &ctc)
+	}
+	if ctc.Concurrent {
+		t.updateBranchSync = true
+		if err := t.execBranchesConcurrently(branches, op, ctc.MaxParallel); err != nil {
+			return err
+		}
+		t.changeStatus(dtmimp.If(t.Status == dtmcli.StatusSubmitted, dtmcli.StatusSucceed, dtmcli.StatusFailed).(string))
+		return nil
+	}
+	// branches are executed in the reverse order of registration. the branches of a nested tcc are registered
+	// in the try of its parent branch, so children are confirmed/canceled before their parents
+	for _, current := range tccBranchesToRun(branches, op) {
+		logger.Debugf("branch info: current: %d ID: %d", current, branches[current].ID)
+		err := t.execBranch(&branches[current], current)
+		if err != nil {
+			return err
+		}
+	}
+	t.changeStatus(dtmimp.If(t.Status == dtmcli.StatusSubmitted, dtmcli.StatusSucceed, dtmcli.StatusFailed).(string))
+	return nil
+}
+
+// tccBranchesToRun returns the positions of the prepared branches of op, in the reverse order of registration
+func tccBranchesToRun(branches []TransBranch, op string) []int {
+	toRun := []int{}
 	for current := len(branches) - 1; current >= 0; current-- {
 		if branches[current].Op == op && branches[current].Status == dtmcli.StatusPrepared {
-			logger.Debugf("branch info: current: %d ID: %d", current, branches[current].ID)
-			err := t.execBranch(&branches[current], current)
-			if err != nil {
-				return err
+			toRun = append(toRun, current)
+		}
+	}
+	return toRun
+}
+
+// tccBranchWaves splits the branches to run into waves. a branch of a nested tcc is in an earlier wave than its parent,
+// so children are confirmed/canceled before their parents, like the sequential path
+func tccBranchWaves(branches []TransBranch, toRun []int) [][]int {
+	pendingChildren := map[string]int{}
+	for _, current := range toRun {
+		if parent := branches[current].Ext.ParentBranch; parent != "" {
+			pendingChildren[parent]++
+		}
+	}
+	waves := [][]int{}
+	for len(toRun) > 0 {
+		wave, rest := []int{}, []int{}
+		for _, current := range toRun {
+			if pendingChildren[branches[current].BranchID] == 0 {
+				wave = append(wave, current)
+			} else {
+				rest = append(rest, current)
+			}
+		}
+		if len(wave) == 0 { // not expected, because a parent is registered before its children
+			wave, rest = rest, nil
+		}
+		for _, current := range wave {
+			if parent := branches[current].Ext.ParentBranch; parent != "" {
+				pendingChildren[parent]--
 			}
 		}
+		waves = append(waves, wave)
+		toRun = rest
+	}
+	return waves
+}
+
+// execBranchesConcurrently executes the prepared branches of op concurrently, at most maxParallel at the same time.
+// the branches of nested tcc are executed wave by wave, children before parents. if any branch returns error, the error
+// is returned, and the unfinished branches will be executed by next cron
+func (t *transTccProcessor) execBranchesConcurrently(branches []TransBranch, op string, maxParallel int) error {
+	for _, wave := range tccBranchWaves(branches, tccBranchesToRun(branches, op)) {
+		if err := t.execWave(branches, wave, maxParallel); err != nil {
+			return err
+		}
 	}
-	t.changeStatus(dtmimp.If(t.Status == dtmcli.StatusSubmitted, dtmcli.StatusSucceed, dtmcli.StatusFailed).(string))
 	return nil
 }
+
+// execWave executes the branches of a wave concurrently, at most maxParallel at the same time
+func (t *transTccProcessor) execWave(branches []TransBranch, toRun []int, maxParallel int) error {
+	if maxParallel <= 0 || maxParallel > len(toRun) {
+		maxParallel = len(toRun)
+	}
+	var wg sync.WaitGroup
+	sem := make(chan bool, maxParallel)
+	errs := make([]error, len(toRun))
+	for i, current := range toRun {
+		sem <- true
+		wg.Add(1)
+		go func(i int, current int) {
+			defer func() {
+				if x := recover(); x != nil {
+					errs[i] = dtmimp.AsError(x)
+				}
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = t.execBranch(&branches[current], current)
+		}(i, current)
+	}
+	wg.Wait()
+	var rerr error
+	for _, err := range errs { // ongoing is returned only if there is no other error, like the sequential path
+		if err != nil && (rerr == nil || errors.Is(rerr, dtmcli.ErrOngoing)) {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+// branchNode is a node of the branch hierarchy of nested tcc, exposed by the query api
+type branchNode struct {
+	BranchID string            `json:"branch_id"`
+	Status   map[string]string `json:"status"` // status of confirm and cancel
+	Children []*branchNode     `json:"children,omitempty"`
+}
+
+// getBranchHierarchy returns the branches of tcc as trees, according to the parent branch of nested tcc
+func getBranchHierarchy(trans *storage.TransGlobalStore, branches []TransBranch) []*branchNode {
+	if trans.TransType != "tcc" {
+		return nil
+	}
+	roots := []*branchNode{}
+	nodes := map[string]*branchNode{}
+	for _, b := range branches {
+		if node := nodes[b.BranchID]; node != nil {
+			node.Status[b.Op] = b.Status
+			continue
+		}
+		ext := storage.TransBranchExt{}
+		if b.ExtData != "" {
+			dtmimp.MustUnmarshalString(b.ExtData, &ext)
+		}
+		node := &branchNode{BranchID: b.BranchID, Status: map[string]string{b.Op: b.Status}}
+		nodes[b.BranchID] = node
+		if parent := nodes[ext.ParentBranch]; parent != nil { // parent is registered before its children
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBranchHierarchy(t *testing.T) {
+	tg := TransGlobal{}
+	tg.TransType = "tcc"
+	branches := []TransBranch{
+		{BranchID: "01", Op: dtmcli.BranchCancel, Status: dtmcli.StatusPrepared},
+		{BranchID: "01", Op: dtmcli.BranchConfirm, Status: dtmcli.StatusSucceed},
+		{BranchID: "0101", Op: dtmcli.BranchCancel, Status: dtmcli.StatusPrepared, ExtData: `{"parent_branch":"01"}`},
+		{BranchID: "02", Op: dtmcli.BranchCancel, Status: dtmcli.StatusPrepared},
+	}
+	roots := getBranchHierarchy(&tg.TransGlobalStore, branches)
+	assert.Equal(t, 2, len(roots))
+	assert.Equal(t, map[string]string{dtmcli.BranchCancel: dtmcli.StatusPrepared, dtmcli.BranchConfirm: dtmcli.StatusSucceed}, roots[0].Status)
+	assert.Equal(t, "0101", roots[0].Children[0].BranchID)
+	assert.Equal(t, "02", roots[1].BranchID)
+
+	tg.TransType = "saga"
+	assert.Nil(t, getBranchHierarchy(&tg.TransGlobalStore, branches))
+}
+
+func TestRegisterNestedBranch(t *testing.T) {
+	err := svcRegisterBranch("http", "tcc", &TransBranch{Gid: "TestRegisterNestedBranch", BranchID: "0201"}, map[string]string{"parent_branch": "01"})
+	assert.True(t, errors.Is(err, dtmcli.ErrFailure))
+}
+
+func TestTccConcurrentNested(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+
+	var mu sync.Mutex
+	confirmed := []string{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		branchID := r.URL.Query().Get("branch_id")
+		time.Sleep(time.Duration(len(branchID)) * 10 * time.Millisecond) // the deeper branches are slower
+		mu.Lock()
+		confirmed = append(confirmed, branchID)
+		mu.Unlock()
+	}))
+	defer svr.Close()
+
+	gid := "TestTccConcurrentNested"
+	tcc := &dtmcli.Tcc{TransBase: *dtmimp.NewTransBase(gid, "tcc", "", "")}
+	tcc.CustomData = `{"biz":"order"}`
+	tcc.SetConcurrent(0)
+	assert.Equal(t, `{"biz":"order","concurrent":true,"max_parallel":0}`, tcc.CustomData)
+
+	newTrans := func() *TransGlobal {
+		tg := &TransGlobal{}
+		tg.Gid, tg.TransType, tg.Protocol, tg.CustomData, tg.WaitResult = gid, "tcc", "http", tcc.CustomData, true
+		return tg
+	}
+	assert.Nil(t, svcPrepare(newTrans()))
+	for _, b := range []struct{ id, parent string }{{"01", ""}, {"0101", "01"}, {"010101", "0101"}, {"02", ""}} {
+		err := svcRegisterBranch("http", "tcc", &TransBranch{Gid: gid, BranchID: b.id, Status: dtmcli.StatusPrepared},
+			map[string]string{dtmcli.BranchConfirm: svr.URL + "/confirm", dtmcli.BranchCancel: svr.URL + "/cancel", "parent_branch": b.parent})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, svcSubmit(newTrans()))
+	assert.Equal(t, dtmcli.StatusSucceed, GetTransGlobal(gid).Status)
+
+	position := map[string]int{}
+	for i, id := range confirmed {
+		position[id] = i
+	}
+	assert.Equal(t, 4, len(confirmed))
+	assert.Less(t, position["010101"], position["0101"])
+	assert.Less(t, position["0101"], position["01"])
+}
@@ -19,8 +19,8 @@ func init() {
 	registorProcessorCreator("xa", func(trans *TransGlobal) transProcessor { return &transXaProcessor{TransGlobal: trans} })
 }
 
-func (t *transXaProcessor) GenBranches() []TransBranch {
-	return []TransBranch{}
+func (t *transXaProcessor) GenBranches() ([]TransBranch, error) {
+	return []TransBranch{}, nil
 }
 
 func (t *transXaProcessor) ProcessOnce(branches []TransBranch) error {
@@ -28,17 +28,28 @@ func (t *transXaProcessor) ProcessOnce(branches []TransBranch) error {
 		return nil
 	}
 	if t.Status == dtmcli.StatusPrepared && t.isTimeout() {
+		t.RollbackReason = "timeout"
 		t.changeStatus(dtmcli.StatusAborting)
 	}
 	currentType := dtmimp.If(t.Status == dtmcli.StatusSubmitted, dtmcli.BranchCommit, dtmcli.BranchRollback).(string)
-	for i, branch := range branches {
-		if branch.Op == currentType && branch.Status != dtmcli.StatusSucceed {
-			err := t.execBranch(&branch, i)
-			if err != nil {
-				return err
-			}
+	for _, i := range xaBranchesToRun(branches, currentType) {
+		branch := branches[i]
+		err := t.execBranch(&branch, i)
+		if err != nil {
+			return err
 		}
 	}
 	t.changeStatus(dtmimp.If(t.Status == dtmcli.StatusSubmitted, dtmcli.StatusSucceed, dtmcli.StatusFailed).(string))
 	return nil
 }
+
+// xaBranchesToRun returns the positions of the unfinished branches of op, in the order of registration
+func xaBranchesToRun(branches []TransBranch, op string) []int {
+	toRun := []int{}
+	for i, branch := range branches {
+		if branch.Op == op && branch.Status != dtmcli.StatusSucceed {
+			toRun = append(toRun, i)
+		}
+	}
+	return toRun
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+)
+
+const (
+	// SignatureHeader is the header of the hmac signature set by the hmac transformer
+	SignatureHeader = "X-Dtm-Signature"
+	// SignatureTimestampHeader is the header of the unix timestamp signed by the hmac transformer
+	SignatureTimestampHeader = "X-Dtm-Timestamp"
+)
+
+// PayloadTransformer transforms the body and the headers of a request to a branch, before it is sent. rule is the
+// matched entry of PayloadTransforms in the config, carrying the options such as the secret. The headers can be
+// changed in place, but the body should not, since it is the stored payload. The transformation is not stored, and
+// is applied again when the branch is retried
+type PayloadTransformer func(rule *config.PayloadTransform, branch *storage.TransBranchStore, body []byte, headers map[string]string) ([]byte, error)
+
+var transformers sync.Map // name -> PayloadTransformer
+
+func init() {
+	transformers.Store("hmac", PayloadTransformer(hmacTransform))
+	transformers.Store("envelope", PayloadTransformer(envelopeTransform))
+}
+
+// RegisterTransformer registers a transformer, which can be used by PayloadTransforms in the config. It should be
+// called before the server starts. The built-in hmac and envelope can be replaced
+func RegisterTransformer(name string, transformer PayloadTransformer) {
+	transformers.Store(name, transformer)
+}
+
+// SignPayload returns the hex hmac-sha256 signature of the timestamp and the body, as set by the hmac transformer.
+// RMs can call it to verify the signature
+func SignPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hmacTransform signs the body and a timestamp by the secret, and puts them in the headers
+func hmacTransform(rule *config.PayloadTransform, branch *storage.TransBranchStore, body []byte, headers map[string]string) ([]byte, error) {
+	if rule.Secret == "" {
+		return nil, errors.New("secret of hmac is empty")
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	headers[SignatureTimestampHeader] = ts
+	headers[SignatureHeader] = SignPayload(rule.Secret, ts, body)
+	return body, nil
+}
+
+// PayloadEnvelope is the body wrapped by the envelope transformer. Signature is the SignPayload of Timestamp and
+// Payload, empty if no secret is configured
+type PayloadEnvelope struct {
+	Timestamp  int64           `json:"timestamp"`
+	ProducerID string          `json:"producer_id"`
+	Payload    json.RawMessage `json:"payload"`
+	Signature  string          `json:"signature,omitempty"`
+}
+
+// envelopeTransform wraps the json body in a PayloadEnvelope
+func envelopeTransform(rule *config.PayloadTransform, branch *storage.TransBranchStore, body []byte, headers map[string]string) ([]byte, error) {
+	if len(body) == 0 {
+		body = []byte("null")
+	}
+	if !json.Valid(body) {
+		return nil, errors.New("payload of envelope should be json")
+	}
+	env := PayloadEnvelope{Timestamp: time.Now().Unix(), ProducerID: rule.ProducerID, Payload: body}
+	if rule.Secret != "" {
+		env.Signature = SignPayload(rule.Secret, strconv.FormatInt(env.Timestamp, 10), body)
+	}
+	return json.Marshal(&env)
+}
+
+var transformPatterns sync.Map // URLPattern -> *regexp.Regexp
+
+// matchTransform checks whether the rule applies to the branch
+func matchTransform(rule *config.PayloadTransform, url string, headers map[string]string) bool {
+	if rule.URLPattern != "" {
+		re, ok := transformPatterns.Load(rule.URLPattern)
+		if !ok {
+			re = regexp.MustCompile(rule.URLPattern) // validated by checkConfig
+			transformPatterns.Store(rule.URLPattern, re)
+		}
+		if !re.(*regexp.Regexp).MatchString(url) {
+			return false
+		}
+	}
+	if rule.Header == "" {
+		return true
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, rule.Header) {
+			return rule.HeaderValue == "" || v == rule.HeaderValue
+		}
+	}
+	return false
+}
+
+// transformPayload applies the matched PayloadTransforms in order to the request of the branch. An error of a
+// transformer wraps dtmcli.ErrOngoing, so the branch is retried later, instead of being sent untransformed
+func (t *TransGlobal) transformPayload(branch *TransBranch, body []byte, headers map[string]string) ([]byte, error) {
+	for i := range conf.PayloadTransforms {
+		rule := &conf.PayloadTransforms[i]
+		if !matchTransform(rule, branch.URL, headers) {
+			continue
+		}
+		v, ok := transformers.Load(rule.Transformer)
+		var err error
+		if !ok {
+			err = errors.New("transformer not registered")
+		} else {
+			body, err = v.(PayloadTransformer)(rule, branch, body, headers)
+		}
+		if err != nil {
+			logger.Errorf("gid: %s branch %s %s: transformer %s error: %v", t.Gid, branch.BranchID, branch.Op, rule.Transformer, err)
+			return nil, fmt.Errorf("transformer %s of %s error: %v. %w", rule.Transformer, branch.URL, err, dtmcli.ErrOngoing)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// signedRM is a mock RM accepting only the requests signed by the secret
+func signedRM(secret string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts := r.Header.Get(SignatureTimestampHeader)
+		if ts == "" || r.Header.Get(SignatureHeader) != SignPayload(secret, ts, body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+}
+
+func newTransformTrans(url string) (*TransGlobal, *TransBranch) {
+	tg := &TransGlobal{}
+	tg.Gid = "TestTransform"
+	tg.TransType = "saga"
+	return tg, &TransBranch{URL: url, BranchID: "01", Op: dtmcli.BranchAction, BinData: []byte(`{"amount":30}`)}
+}
+
+func TestTransformHmac(t *testing.T) {
+	rm := signedRM("secret1")
+	defer rm.Close()
+	defer func() { conf.PayloadTransforms = nil }()
+	tg, branch := newTransformTrans(rm.URL + "/signed/TransIn")
+
+	assert.Error(t, tg.getHTTPResult(branch)) // not signed
+	conf.PayloadTransforms = []config.PayloadTransform{{URLPattern: "/signed/", Transformer: "hmac", Secret: "secret1"}}
+	assert.Nil(t, tg.getHTTPResult(branch))
+	assert.Equal(t, `{"amount":30}`, string(branch.BinData)) // the stored payload is not changed
+
+	conf.PayloadTransforms[0].Secret = "secret2" // rotated, applied to the next call
+	assert.Error(t, tg.getHTTPResult(branch))
+
+	conf.PayloadTransforms[0].Secret = ""
+	assert.True(t, errors.Is(tg.getHTTPResult(branch), dtmcli.ErrOngoing))
+	conf.PayloadTransforms[0].Transformer = "none"
+	assert.True(t, errors.Is(tg.getHTTPResult(branch), dtmcli.ErrOngoing))
+}
+
+func TestTransformEnvelope(t *testing.T) {
+	var received PayloadEnvelope
+	rm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+	defer rm.Close()
+	defer func() { conf.PayloadTransforms = nil }()
+	tg, branch := newTransformTrans(rm.URL + "/TransIn")
+	branch.Ext.Headers = map[string]string{"X-Tenant": "t1"}
+
+	conf.PayloadTransforms = []config.PayloadTransform{
+		{Header: "x-tenant", HeaderValue: "t2", Transformer: "hmac"}, // not matched
+		{Header: "x-tenant", Transformer: "envelope", Secret: "secret1", ProducerID: "dtm1"},
+	}
+	assert.Nil(t, tg.getHTTPResult(branch))
+	assert.Equal(t, "dtm1", received.ProducerID)
+	assert.Equal(t, `{"amount":30}`, string(received.Payload))
+	assert.Equal(t, SignPayload("secret1", fmt.Sprint(received.Timestamp), received.Payload), received.Signature)
+
+	branch.BinData = []byte("a=1")
+	branch.Ext.ContentType = "application/x-www-form-urlencoded"
+	assert.True(t, errors.Is(tg.getHTTPResult(branch), dtmcli.ErrOngoing))
+}
+
+func TestRegisterTransformer(t *testing.T) {
+	RegisterTransformer("exclaim", func(rule *config.PayloadTransform, branch *storage.TransBranchStore, body []byte, headers map[string]string) ([]byte, error) {
+		headers["X-Producer"] = rule.ProducerID
+		return append(body, '!'), nil
+	})
+	defer func() { conf.PayloadTransforms = nil }()
+	conf.PayloadTransforms = []config.PayloadTransform{{Transformer: "exclaim", ProducerID: "dtm1"}}
+	tg, branch := newTransformTrans("http://localhost/TransIn")
+	headers := map[string]string{}
+	body, err := tg.transformPayload(branch, branch.BinData, headers)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"amount":30}!`, string(body))
+	assert.Equal(t, map[string]string{"X-Producer": "dtm1"}, headers)
+}
@@ -8,6 +8,8 @@ package dtmsvr
 
 import (
 	"fmt"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
@@ -41,11 +43,46 @@ func GenGid() string {
 	return shortuuid.New()
 }
 
+var gidRegexps sync.Map
+
+// checkGid checks that the gid is not empty, not longer than GidMaxLength, and is made of [0-9a-zA-Z_.:-],
+// or matches GidPattern if it is configured
+func checkGid(gid string) error {
+	if conf.DisableGidCheck == 1 {
+		return nil
+	}
+	if gid == "" {
+		return fmt.Errorf("gid should not be empty. %w", dtmimp.ErrInvalidArgument)
+	}
+	if conf.GidMaxLength > 0 && int64(len(gid)) > conf.GidMaxLength {
+		return fmt.Errorf("gid %s is longer than %d. %w", gid, conf.GidMaxLength, dtmimp.ErrInvalidArgument)
+	}
+	if conf.GidPattern != "" {
+		re, ok := gidRegexps.Load(conf.GidPattern)
+		if !ok {
+			re, _ = gidRegexps.LoadOrStore(conf.GidPattern, regexp.MustCompile(conf.GidPattern))
+		}
+		if !re.(*regexp.Regexp).MatchString(gid) {
+			return fmt.Errorf("gid %s does not match %s. %w", gid, conf.GidPattern, dtmimp.ErrInvalidArgument)
+		}
+		return nil
+	}
+	for _, c := range gid {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return fmt.Errorf("gid %s contains invalid char %q. %w", gid, c, dtmimp.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
 // GetTransGlobal construct trans from db
 func GetTransGlobal(gid string) *TransGlobal {
 	trans := GetStore().FindTransGlobalStore(gid)
 	//nolint:staticcheck
 	dtmimp.PanicIf(trans == nil, fmt.Errorf("no TransGlobal with gid: %s found", gid))
+	if trans.ExtData != "" { // Ext may be saved again when status changed
+		dtmimp.MustUnmarshalString(trans.ExtData, &trans.Ext)
+	}
 	//nolint:staticcheck
 	return &TransGlobal{TransGlobalStore: *trans}
 }
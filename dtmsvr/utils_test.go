@@ -7,8 +7,12 @@
 package dtmsvr
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,3 +33,27 @@ func TestSetNextCron(t *testing.T) {
 	tg.TimeoutToFail = 3
 	assert.Equal(t, int64(3), tg.getNextCronInterval(cronReset))
 }
+
+func TestCheckGid(t *testing.T) {
+	oldLength := conf.GidMaxLength
+	defer func() { conf.GidMaxLength, conf.GidPattern, conf.DisableGidCheck = oldLength, "", 0 }()
+	conf.GidMaxLength = 128
+	assert.Nil(t, checkGid(strings.Repeat("a", 128)))
+	assert.True(t, errors.Is(checkGid(strings.Repeat("a", 129)), dtmcli.ErrInvalidArgument))
+	assert.True(t, errors.Is(checkGid(""), dtmcli.ErrInvalidArgument))
+	assert.Nil(t, checkGid("order-1_a.b:c"))
+	assert.Nil(t, checkGid(dtmimp.GidFromKey("订单/10001")))
+	assert.Nil(t, checkGid(GenGid()))
+
+	err := checkGid("order 1")
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+	assert.Contains(t, err.Error(), "' '")
+	assert.Contains(t, checkGid("order/1").Error(), "'/'")
+
+	conf.GidPattern = "^[a-z]+$"
+	assert.Nil(t, checkGid("order"))
+	assert.True(t, errors.Is(checkGid("order-1"), dtmcli.ErrInvalidArgument))
+
+	conf.DisableGidCheck = 1
+	assert.Nil(t, checkGid("order 1"))
+}
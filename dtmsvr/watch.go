@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// the changes of a trans are pushed to the watchers by the dtm instance processing the trans.
+// the watchers connected to other instances find the changes by polling, so they get all the changes with a delay
+
+const (
+	changeInit         = "init"          // the first event of a watch
+	changeGlobalStatus = "global_status" // the status of the trans is changed
+	changeBranchStatus = "branch_status" // the status of a branch is changed
+	changeCustomData   = "custom_data"   // the custom data of the trans is updated
+	changePoll         = "poll"          // a change found by polling, which may be made by other dtm instances
+)
+
+// WatchPollInterval the interval to poll the trans for a watcher
+var WatchPollInterval = 3 * time.Second
+
+// WatchHeartbeatInterval the interval to send heartbeats to a watcher, so that a broken connection is found and cleaned up
+var WatchHeartbeatInterval = 15 * time.Second
+
+var watchers = struct {
+	sync.Mutex
+	m map[string]map[chan string]bool
+}{m: map[string]map[chan string]bool{}}
+
+func addWatcher(gid string) chan string {
+	ch := make(chan string, 16)
+	watchers.Lock()
+	defer watchers.Unlock()
+	if watchers.m[gid] == nil {
+		watchers.m[gid] = map[chan string]bool{}
+	}
+	watchers.m[gid][ch] = true
+	return ch
+}
+
+func removeWatcher(gid string, ch chan string) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	delete(watchers.m[gid], ch)
+	if len(watchers.m[gid]) == 0 {
+		delete(watchers.m, gid)
+	}
+}
+
+// notifyWatchers notifies the watchers of the trans. a slow watcher misses the notification,
+// which is fine because every event carries the current state of the trans
+func notifyWatchers(gid string, change string) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	for ch := range watchers.m[gid] {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// watch streams the changes of a trans as server-sent events. the data of an event is the same as query, plus the change type.
+// the stream is closed after the trans is finished
+func watch(c *gin.Context) {
+	gid := c.Query("gid")
+	if gid == "" {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{"message": "no gid specified"})
+		return
+	}
+	if err := checkQueryClaim(callerToken(c), gid); err != nil {
+		c.JSON(http.StatusForbidden, map[string]interface{}{"code": dtmimp.CodeGidNotOwned, "message": err.Error()})
+		return
+	}
+	ch := addWatcher(gid)
+	defer removeWatcher(gid, ch)
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	last := ""
+	send := func(change string) (finished bool, err error) { // returns finished if the trans is finished
+		result := queryTrans(gid)
+		cont := dtmimp.MustMarshalString(result)
+		if change == changePoll && cont == last {
+			return false, nil
+		}
+		last = cont
+		result["change"] = change
+		if _, err = fmt.Fprintf(c.Writer, "event: change\ndata: %s\n\n", dtmimp.MustMarshalString(result)); err != nil {
+			return false, err
+		}
+		c.Writer.Flush()
+		trans, _ := result["transaction"].(*storage.TransGlobalStore)
+		return trans != nil && (trans.Status == dtmcli.StatusSucceed || trans.Status == dtmcli.StatusFailed), nil
+	}
+	poll := time.NewTicker(WatchPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(WatchHeartbeatInterval)
+	defer heartbeat.Stop()
+	finished, err := send(changeInit)
+	for !finished && err == nil {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case change := <-ch:
+			finished, err = send(change)
+		case <-poll.C:
+			finished, err = send(changePoll)
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(c.Writer, ": heartbeat\n\n"); err == nil {
+				c.Writer.Flush()
+			}
+		}
+	}
+}
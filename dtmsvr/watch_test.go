@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmsvr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchers(t *testing.T) {
+	ch1 := addWatcher("gid1")
+	ch2 := addWatcher("gid1")
+	notifyWatchers("gid1", changeGlobalStatus)
+	notifyWatchers("gid2", changeGlobalStatus)
+	assert.Equal(t, changeGlobalStatus, <-ch1)
+	assert.Equal(t, changeGlobalStatus, <-ch2)
+
+	for i := 0; i < 20; i++ { // a slow watcher does not block the notifier
+		notifyWatchers("gid1", changeBranchStatus)
+	}
+	assert.Equal(t, 16, len(ch1))
+
+	removeWatcher("gid1", ch1)
+	removeWatcher("gid1", ch2)
+	assert.Equal(t, 0, len(watchers.m))
+}
+
+func TestWatchClaim(t *testing.T) {
+	old := conf.Store.Driver
+	defer func() { conf.Store.Driver = old }()
+	conf.Store.Driver = "memory"
+	conf.GidClaims = map[string]config.GidClaim{"order": {Token: "t-order", Prefixes: "order-"}}
+	defer func() { conf.GidClaims = nil }()
+	conf.GidClaimQuery = 1
+	defer func() { conf.GidClaimQuery = 0 }()
+
+	watchGid := func(token string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/dtmsvr/watch?gid=order-1", nil).WithContext(ctx)
+		c.Request.Header.Set(dtmimp.CallerTokenHeader, token)
+		watch(c)
+		return w
+	}
+	w := watchGid("")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "GID_NOT_OWNED")
+	assert.Equal(t, 0, len(watchers.m)) // not subscribed
+
+	w = watchGid("t-order")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "event: change")
+}
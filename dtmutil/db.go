@@ -1,7 +1,9 @@
 package dtmutil
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -10,8 +12,8 @@ import (
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
-	_ "github.com/go-sql-driver/mysql" // register mysql driver
-	_ "github.com/lib/pq"              // register postgres driver
+	mysqlDriver "github.com/go-sql-driver/mysql" // register mysql driver
+	_ "github.com/lib/pq"                        // register postgres driver
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -45,6 +47,15 @@ func (m *DB) Must() *DB {
 	return &DB{DB: db}
 }
 
+// WithOp returns the db with the operation name and the gid in its context, see WithDBOp
+func (m *DB) WithOp(op string, gid string) *DB {
+	ctx := m.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &DB{DB: m.WithContext(WithDBOp(ctx, op, gid))}
+}
+
 // ToSQLDB get the sql.DB
 func (m *DB) ToSQLDB() *sql.DB {
 	d, err := m.DB.DB()
@@ -67,6 +78,9 @@ func (op *tracePlugin) Initialize(db *gorm.DB) (err error) {
 		_ts, _ := db.InstanceGet("ivy.startTime")
 		sql := db.Dialector.Explain(db.Statement.SQL.String(), db.Statement.Vars...)
 		logger.Debugf("used: %d ms affected: %d sql is: %s", time.Since(_ts.(time.Time)).Milliseconds(), db.RowsAffected, sql)
+		if op, gid := GetDBOp(db.Statement.Context); op != "" && db.Error != nil && db.Error != gorm.ErrRecordNotFound {
+			db.Error = fmt.Errorf("%s of gid %s: %w", op, gid, db.Error)
+		}
 		if v, ok := db.InstanceGet("ivy.must"); ok && v.(bool) {
 			if db.Error != nil && db.Error != gorm.ErrRecordNotFound {
 				panic(db.Error)
@@ -116,3 +130,155 @@ func DbGet(conf dtmcli.DBConf, ops ...func(*gorm.DB)) *DB {
 	}
 	return db.(*DB)
 }
+
+type dbOpKey struct{}
+
+type dbOp struct {
+	op  string
+	gid string
+}
+
+// WithDBOp returns a context with the operation name and the gid. the errors of the statements executed with the context
+// are prefixed with them, and they are reported to StatementHooks.OnStatement
+func WithDBOp(ctx context.Context, op string, gid string) context.Context {
+	return context.WithValue(ctx, dbOpKey{}, dbOp{op: op, gid: gid})
+}
+
+// GetDBOp returns the operation name and the gid of WithDBOp
+func GetDBOp(ctx context.Context) (op string, gid string) {
+	if ctx == nil {
+		return "", ""
+	}
+	v, _ := ctx.Value(dbOpKey{}).(dbOp)
+	return v.op, v.gid
+}
+
+// DBStatement is an executed statement, reported to StatementHooks.OnStatement
+type DBStatement struct {
+	Op       string // the operation name of WithDBOp
+	Gid      string
+	SQL      string // the sql without the vars
+	Duration time.Duration
+	Rows     int64
+	Err      error
+}
+
+// DBErrorClassifiers classify the errors of the drivers. true means the error is transient, such as a deadlock, and the
+// statement can be retried
+var DBErrorClassifiers = map[string]func(err error) bool{
+	dtmcli.DBTypeMysql: func(err error) bool {
+		var e *mysqlDriver.MySQLError
+		return errors.As(err, &e) && (e.Number == 1213 || e.Number == 1205) // deadlock, lock wait timeout
+	},
+	dtmcli.DBTypePostgres: func(err error) bool {
+		var e interface{ SQLState() string }
+		return errors.As(err, &e) && (e.SQLState() == "40001" || e.SQLState() == "40P01") // serialization failure, deadlock
+	},
+}
+
+// StatementHooks are the hooks of the statements of a db, see UseStatementHooks
+type StatementHooks struct {
+	Retries     int                                               // the max times to retry a statement failed with a retryable error. 0 means no retry
+	Retryable   func(err error) bool                              // classifies the errors. default is DBErrorClassifiers of the driver
+	OnRetry     func(ctx context.Context, err error, attempt int) // called before each retry
+	OnStatement func(st *DBStatement)                             // called after each statement, with the total duration of the retries
+}
+
+// UseStatementHooks returns an option of DbGet to install the hooks. the statements in transactions are not retried,
+// because a failed statement may abort the transaction
+func UseStatementHooks(driver string, hooks StatementHooks) func(*gorm.DB) {
+	if hooks.Retryable == nil {
+		hooks.Retryable = DBErrorClassifiers[driver]
+	}
+	return func(db *gorm.DB) {
+		if hooks.Retries > 0 && hooks.Retryable != nil {
+			db.ConnPool = &retryConnPool{ConnPool: db.ConnPool, hooks: hooks}
+			db.Statement.ConnPool = db.ConnPool
+		}
+		if hooks.OnStatement != nil {
+			dtmimp.E2P(db.Use(&statementPlugin{onStatement: hooks.OnStatement}))
+		}
+	}
+}
+
+// retryConnPool retries the statements executed out of transactions
+type retryConnPool struct {
+	gorm.ConnPool
+	hooks StatementHooks
+}
+
+func (p *retryConnPool) retry(ctx context.Context, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt <= p.hooks.Retries && err != nil && p.hooks.Retryable(err) && ctx.Err() == nil; attempt++ {
+		op, gid := GetDBOp(ctx)
+		logger.Warnf("retrying statement of %s gid %s for the %d time after: %v", op, gid, attempt, err)
+		if p.hooks.OnRetry != nil {
+			p.hooks.OnRetry(ctx, err, attempt)
+		}
+		time.Sleep(time.Duration(attempt*10) * time.Millisecond)
+		err = fn()
+	}
+	return err
+}
+
+func (p *retryConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	err = p.retry(ctx, func() error {
+		result, err = p.ConnPool.ExecContext(ctx, query, args...)
+		return err
+	})
+	return
+}
+
+func (p *retryConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = p.retry(ctx, func() error {
+		rows, err = p.ConnPool.QueryContext(ctx, query, args...)
+		return err
+	})
+	return
+}
+
+func (p *retryConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return p.ConnPool.(gorm.TxBeginner).BeginTx(ctx, opts)
+}
+
+// GetDBConn returns the sql.DB for gorm.DB.DB
+func (p *retryConnPool) GetDBConn() (*sql.DB, error) {
+	if c, ok := p.ConnPool.(gorm.GetDBConnector); ok {
+		return c.GetDBConn()
+	}
+	if d, ok := p.ConnPool.(*sql.DB); ok {
+		return d, nil
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+type statementPlugin struct {
+	onStatement func(st *DBStatement)
+}
+
+func (op *statementPlugin) Name() string {
+	return "statementPlugin"
+}
+
+func (op *statementPlugin) Initialize(db *gorm.DB) (err error) {
+	report := func(db *gorm.DB) {
+		st := &DBStatement{SQL: db.Statement.SQL.String(), Rows: db.RowsAffected}
+		if ts, ok := db.InstanceGet("ivy.startTime"); ok {
+			st.Duration = time.Since(ts.(time.Time))
+		}
+		if db.Error != gorm.ErrRecordNotFound {
+			st.Err = db.Error
+		}
+		st.Op, st.Gid = GetDBOp(db.Statement.Context)
+		op.onStatement(st)
+	}
+	name := "cb_statement"
+	// report before cb_after, which panics for Must
+	_ = db.Callback().Create().After("gorm:after_create").Before("cb_after").Register(name, report)
+	_ = db.Callback().Query().After("gorm:after_query").Before("cb_after").Register(name, report)
+	_ = db.Callback().Delete().After("gorm:after_delete").Before("cb_after").Register(name, report)
+	_ = db.Callback().Update().After("gorm:after_update").Before("cb_after").Register(name, report)
+	_ = db.Callback().Row().After("gorm:row").Before("cb_after").Register(name, report)
+	_ = db.Callback().Raw().After("gorm:raw").Before("cb_after").Register(name, report)
+	return
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package dtmutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// fakeConn fails the statements with the errors in order, and then succeeds
+type fakeConn struct {
+	errs []error
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeConnector struct {
+	conn *fakeConn
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) { return c.conn, nil }
+func (c *fakeConnector) Driver() driver.Driver                        { return nil }
+
+func newFakeDB(conn *fakeConn, hooks StatementHooks) *DB {
+	sqldb := sql.OpenDB(&fakeConnector{conn: conn})
+	sqldb.SetMaxOpenConns(1)
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sqldb, SkipInitializeWithVersion: true}), &gorm.Config{SkipDefaultTransaction: true})
+	dtmimp.E2P(err)
+	dtmimp.E2P(db.Use(&tracePlugin{}))
+	UseStatementHooks(dtmcli.DBTypeMysql, hooks)(db)
+	return &DB{DB: db}
+}
+
+func TestStatementHooks(t *testing.T) {
+	deadlock := &mysqlDriver.MySQLError{Number: 1213, Message: "Deadlock found"}
+	conn := &fakeConn{errs: []error{deadlock, deadlock}}
+	retries := []int{}
+	statements := []*DBStatement{}
+	db := newFakeDB(conn, StatementHooks{
+		Retries:     2,
+		OnRetry:     func(ctx context.Context, err error, attempt int) { retries = append(retries, attempt) },
+		OnStatement: func(st *DBStatement) { statements = append(statements, st) },
+	})
+
+	dbr := db.WithOp("ChangeGlobalStatus", "gid1").Must().Exec("update trans_global set status='succeed'")
+	assert.Nil(t, dbr.Error)
+	assert.Equal(t, []int{1, 2}, retries)
+	assert.Len(t, statements, 1)
+	assert.Equal(t, "ChangeGlobalStatus", statements[0].Op)
+	assert.Equal(t, "gid1", statements[0].Gid)
+	assert.Nil(t, statements[0].Err)
+
+	// the retries are exhausted
+	conn.errs = []error{deadlock, deadlock, deadlock}
+	err := dtmimp.CatchP(func() {
+		db.WithOp("ChangeGlobalStatus", "gid2").Must().Exec("update trans_global set status='succeed'")
+	})
+	assert.True(t, errors.Is(err, deadlock))
+	assert.Contains(t, err.Error(), "ChangeGlobalStatus of gid gid2")
+	assert.Equal(t, []int{1, 2, 1, 2}, retries)
+	assert.Len(t, statements, 2)
+	assert.Equal(t, deadlock, statements[1].Err)
+
+	// terminal errors are not retried
+	conn.errs = []error{&mysqlDriver.MySQLError{Number: 1062, Message: "Duplicate entry"}}
+	dbr = db.Exec("insert into trans_global(gid) values('gid3')")
+	assert.NotNil(t, dbr.Error)
+	assert.Len(t, retries, 4)
+	assert.Len(t, statements, 3)
+}
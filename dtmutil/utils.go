@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,6 +48,21 @@ func GetGinApp() *gin.Engine {
 	return app
 }
 
+// AccessLogged is set in the gin context by an access log middleware, then the results of the handlers are logged
+// in level debug, so that the access logs control the logs of requests
+const AccessLogged = "dtm_access_logged"
+
+// HandlerLogf returns the log func for the result of a request, with the gid in the context of the request
+func HandlerLogf(c *gin.Context, failed bool) func(format string, args ...interface{}) {
+	l := logger.Ctx(c.Request.Context())
+	if c.GetBool(AccessLogged) {
+		return l.Debugf
+	} else if failed {
+		return l.Errorf
+	}
+	return l.Infof
+}
+
 // WrapHandler2 wrap a function te bo the handler of gin request
 func WrapHandler2(fn func(*gin.Context) interface{}) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -84,10 +100,22 @@ func WrapHandler2(fn func(*gin.Context) interface{}) gin.HandlerFunc {
 			} else if errors.Is(err, dtmcli.ErrOngoing) {
 				status = http.StatusTooEarly
 				result["dtm_result"] = dtmcli.ResultOngoing
+			} else if errors.Is(err, dtmcli.ErrInvalidArgument) {
+				status = http.StatusBadRequest
+			} else if errors.Is(err, dtmcli.ErrReadOnly) {
+				status = http.StatusServiceUnavailable
+				result["code"] = dtmimp.CodeReadOnly
+			} else if errors.Is(err, dtmcli.ErrBusy) {
+				status = http.StatusTooManyRequests
+				result["code"] = dtmimp.CodeBusy
+			} else if errors.Is(err, dtmcli.ErrGidNotOwned) {
+				status = http.StatusForbidden
+				result["code"] = dtmimp.CodeGidNotOwned
 			} else if err != nil {
 				status = http.StatusInternalServerError
 			}
 			result["message"] = err.Error()
+			setRetryAfter(c, err)
 			r = result
 		} else if r == nil {
 			result["dtm_result"] = dtmcli.ResultSuccess
@@ -96,15 +124,48 @@ func WrapHandler2(fn func(*gin.Context) interface{}) gin.HandlerFunc {
 
 		b, _ := json.Marshal(r)
 		cont := string(b)
-		if status == http.StatusOK || status == http.StatusTooEarly {
-			logger.Infof("%2dms %d %s %s %s", time.Since(began).Milliseconds(), status, c.Request.Method, c.Request.RequestURI, cont)
-		} else {
-			logger.Errorf("%2dms %d %s %s %s", time.Since(began).Milliseconds(), status, c.Request.Method, c.Request.RequestURI, cont)
-		}
+		HandlerLogf(c, status != http.StatusOK && status != http.StatusTooEarly)("%2dms %d %s %s %s",
+			time.Since(began).Milliseconds(), status, c.Request.Method, c.Request.RequestURI, cont)
 		c.JSON(status, r)
 	}
 }
 
+// WrapHandlerV2 wraps a function to be the handler of the v2 api. the result is returned in the envelope
+// dtmimp.APIResponse, with the code and the http status of the error, and the result as the data
+func WrapHandlerV2(fn func(*gin.Context) interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		began := time.Now()
+		var err error
+		r := func() interface{} {
+			defer dtmimp.P2E(&err)
+			return fn(c)
+		}()
+		if ne, ok := r.(error); ok && err == nil {
+			err = ne
+		}
+		code, status := dtmimp.ErrorCode(err)
+		resp := map[string]interface{}{"code": code}
+		if err != nil {
+			resp["message"] = err.Error()
+			setRetryAfter(c, err)
+		} else if r != nil {
+			resp["data"] = r
+		}
+		b, _ := json.Marshal(resp)
+		HandlerLogf(c, status != http.StatusOK && status != http.StatusTooEarly)("%2dms %d %s %s %s",
+			time.Since(began).Milliseconds(), status, c.Request.Method, c.Request.RequestURI, b)
+		c.Data(status, "application/json; charset=utf-8", b)
+	}
+}
+
+// setRetryAfter sets the header Retry-After in seconds for a *dtmimp.BusyError
+func setRetryAfter(c *gin.Context, err error) {
+	var busy *dtmimp.BusyError
+	if errors.As(err, &busy) {
+		c.Header("Retry-After", strconv.Itoa(int(busy.RetryAfter/time.Second)))
+	}
+}
+
 // MustGetwd must version of os.Getwd
 func MustGetwd() string {
 	wd, err := os.Getwd()
@@ -14,7 +14,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -27,17 +30,76 @@ func TestGin(t *testing.T) {
 	app.GET("/api/error", WrapHandler2(func(c *gin.Context) interface{} {
 		return errors.New("err1")
 	}))
+	app.GET("/api/failure", WrapHandler2(func(c *gin.Context) interface{} {
+		return fmt.Errorf("transfer: %w", fmt.Errorf("account 1: %w", fmt.Errorf("insufficient balance. %w", dtmcli.ErrFailure)))
+	}))
 	getResultString := func(api string, body io.Reader) string {
 		req, _ := http.NewRequest("GET", api, body)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, req)
 		return w.Body.String()
 	}
+	req, _ := http.NewRequest("GET", "/api/failure", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
 	assert.Equal(t, "{\"msg\":\"pong\"}", getResultString("/api/ping", nil))
 	assert.Equal(t, "1", getResultString("/api/sample", nil))
 	assert.Equal(t, "{\"message\":\"err1\"}", getResultString("/api/error", strings.NewReader("{}")))
 }
 
+func TestGinV2(t *testing.T) {
+	app := GetGinApp()
+	app.GET("/api/v2/sample", WrapHandlerV2(func(c *gin.Context) interface{} {
+		return map[string]string{"gid": "gid1"}
+	}))
+	app.GET("/api/v2/empty", WrapHandlerV2(func(c *gin.Context) interface{} {
+		return nil
+	}))
+	app.GET("/api/v2/not_found", WrapHandlerV2(func(c *gin.Context) interface{} {
+		panic(fmt.Errorf("trans gid1 not found. %w", dtmcli.ErrNotFound))
+	}))
+	app.GET("/api/v2/ongoing", WrapHandlerV2(func(c *gin.Context) interface{} {
+		return dtmcli.ErrOngoing
+	}))
+	get := func(api string) (int, string) {
+		req, _ := http.NewRequest("GET", api, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	code, body := get("/api/v2/sample")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"code":"OK","data":{"gid":"gid1"}}`, body)
+	_, body = get("/api/v2/empty")
+	assert.Equal(t, `{"code":"OK"}`, body)
+	code, body = get("/api/v2/not_found")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, `{"code":"NOT_FOUND","message":"trans gid1 not found. NOT_FOUND"}`, body)
+	code, _ = get("/api/v2/ongoing")
+	assert.Equal(t, http.StatusTooEarly, code)
+}
+
+func TestGinBusy(t *testing.T) {
+	app := GetGinApp()
+	busy := func(c *gin.Context) interface{} {
+		return &dtmimp.BusyError{RetryAfter: 10 * time.Second, Message: "backlog"}
+	}
+	app.POST("/api/busy", WrapHandler2(busy))
+	app.POST("/api/v2/busy", WrapHandlerV2(busy))
+	app.POST("/api/busy_ongoing", WrapHandler2(func(c *gin.Context) interface{} {
+		return &dtmimp.BusyError{RetryAfter: 3 * time.Second, Ongoing: true, Message: "backlog"}
+	}))
+	for api, expect := range map[string]string{"/api/busy": `"code":"BUSY"`, "/api/v2/busy": `"code":"BUSY"`, "/api/busy_ongoing": `"dtm_result":"ONGOING"`} {
+		req, _ := http.NewRequest("POST", api, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, dtmimp.If(api == "/api/busy_ongoing", http.StatusTooEarly, http.StatusTooManyRequests), w.Code, api)
+		assert.Equal(t, dtmimp.If(api == "/api/busy_ongoing", "3", "10"), w.Header().Get("Retry-After"), api)
+		assert.Contains(t, w.Body.String(), expect, api)
+	}
+}
+
 func TestFuncs(t *testing.T) {
 	wd := MustGetwd()
 	assert.NotEqual(t, "", wd)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/logger"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/helper/bench/load"
+)
+
+// runLoad runs the subcommand load, like:
+// bench load -mix saga:2,tcc:1,msg:1 -branches 3 -concurrency 20 -duration 60s -ongoing 0.05
+func runLoad(args []string) {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	opts := load.Options{}
+	mix := fs.String("mix", "saga:1,tcc:1,msg:1", "the weights of the kinds of trans")
+	fs.StringVar(&opts.Server, "server", dtmutil.DefaultHTTPServer, "the url of the target dtm server")
+	fs.IntVar(&opts.Branches, "branches", 2, "the branches of each trans")
+	fs.IntVar(&opts.PayloadSize, "payload", 64, "the bytes of the payload of each branch")
+	fs.IntVar(&opts.Concurrency, "concurrency", 10, "the trans running at the same time")
+	fs.DurationVar(&opts.Duration, "duration", 0, "stop starting trans after the duration")
+	fs.IntVar(&opts.Total, "total", 0, "stop after the number of trans started")
+	fs.DurationVar(&opts.Timeout, "timeout", 30*time.Second, "the max time from submit to the final status of a trans")
+	fs.DurationVar(&opts.PollInterval, "poll", 10*time.Millisecond, "the interval of querying the status of a trans")
+	fs.StringVar(&opts.RMHost, "rm-host", "localhost", "the host of the mock RM, reachable from dtm server")
+	fs.IntVar(&opts.RMPort, "rm-port", 8084, "the port of the mock RM. 0 for a random port")
+	fs.DurationVar(&opts.RM.Latency, "latency", 0, "the latency of every branch call of the mock RM")
+	fs.DurationVar(&opts.RM.Jitter, "jitter", 0, "a random latency up to jitter added to every branch call")
+	fs.Float64Var(&opts.RM.FailureRate, "failure", 0, "the rate of FAILURE of saga actions and tcc tries")
+	fs.Float64Var(&opts.RM.OngoingRate, "ongoing", 0, "the rate of ONGOING of the branches called by dtm server")
+	asJSON := fs.Bool("json", false, "print the report in json")
+	_ = fs.Parse(args)
+
+	logger.InitLog(dtmimp.OrString(os.Getenv("LOG_LEVEL"), "fatal")) // the expected FAILURE and ONGOING of the mock RM are logged as errors
+	var err error
+	opts.Mix, err = load.ParseMix(*mix)
+	logger.FatalIfError(err)
+	report, err := load.Run(opts)
+	logger.FatalIfError(err)
+	if *asJSON {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		report.Print(os.Stdout)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package load
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/go-resty/resty/v2"
+	"github.com/lithammer/shortuuid"
+)
+
+// the kinds of trans driven by Run
+const (
+	KindSaga = "saga"
+	KindTcc  = "tcc"
+	KindMsg  = "msg"
+)
+
+// the final statuses of a trans in Report, besides succeed and failed of dtm server
+const (
+	StatusSubmitError = "submit_error" // the trans is not submitted, see Report.Errors
+	StatusTimeout     = "timeout"      // the trans does not reach succeed or failed in Options.Timeout
+)
+
+// Options are the options of a load test
+type Options struct {
+	Server       string         // the url of the target dtm server, like http://localhost:36789/api/dtmsvr
+	Mix          map[string]int // the weights of the kinds of trans, like {"saga": 2, "tcc": 1}
+	Branches     int            // the branches of each trans
+	PayloadSize  int            // the bytes of the payload of each branch
+	Concurrency  int            // the trans running at the same time
+	Duration     time.Duration  // stop starting trans after Duration. 0 means no limit
+	Total        int            // stop after Total trans started. 0 means no limit
+	Timeout      time.Duration  // the max time from submit to the final status of a trans
+	PollInterval time.Duration  // the interval of querying the status of a trans, which bounds the precision of the latency
+	RMHost       string         // the host of the mock RM, reachable from dtm server
+	RMPort       int            // the port of the mock RM. 0 means a random port
+	RM           RMOptions
+}
+
+// ParseMix parses the mix like saga:2,tcc:1,msg:1. a kind without a weight is of weight 1
+func ParseMix(s string) (map[string]int, error) {
+	mix := map[string]int{}
+	for _, item := range strings.Split(s, ",") {
+		kind, weight := strings.TrimSpace(item), 1
+		if i := strings.Index(kind, ":"); i >= 0 {
+			w, err := strconv.Atoi(kind[i+1:])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight of mix item %s", item)
+			}
+			kind, weight = kind[:i], w
+		}
+		if kind != KindSaga && kind != KindTcc && kind != KindMsg {
+			return nil, fmt.Errorf("unknown kind %s in mix, should be saga, tcc or msg", kind)
+		}
+		mix[kind] += weight
+	}
+	return mix, nil
+}
+
+func (o *Options) check() error {
+	weights := 0
+	for _, w := range o.Mix {
+		weights += w
+	}
+	switch {
+	case o.Server == "":
+		return errors.New("the server of dtm should be specified")
+	case weights <= 0:
+		return errors.New("the mix should have at least one kind of positive weight")
+	case o.Branches <= 0 || o.Concurrency <= 0:
+		return errors.New("branches and concurrency should be positive")
+	case o.Duration <= 0 && o.Total <= 0:
+		return errors.New("one of duration and total should be specified")
+	case o.Timeout <= 0 || o.PollInterval <= 0:
+		return errors.New("timeout and poll interval should be positive")
+	}
+	return nil
+}
+
+// pick picks a kind by the weights of the mix
+func (o *Options) pick() string {
+	kinds := []string{}
+	weights := 0
+	for kind, w := range o.Mix {
+		kinds = append(kinds, kind)
+		weights += w
+	}
+	sort.Strings(kinds)
+	r := rand.Intn(weights)
+	for _, kind := range kinds {
+		if r < o.Mix[kind] {
+			return kind
+		}
+		r -= o.Mix[kind]
+	}
+	return kinds[len(kinds)-1]
+}
+
+// runner runs the trans of a load test
+type runner struct {
+	opts    *Options
+	rm      *MockRM
+	rmURL   string
+	payload map[string]string
+	mu      sync.Mutex
+	report  *Report
+	samples map[string][]time.Duration
+}
+
+// Run starts the mock RM, drives the dtm server with the trans of opts, and reports the results after the trans
+// started are all final or timed out
+func Run(opts Options) (*Report, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	rm := NewMockRM(opts.RM)
+	app := dtmutil.GetGinApp()
+	rm.AddRoute(app)
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", opts.RMPort))
+	if err != nil {
+		return nil, err
+	}
+	svr := &http.Server{Handler: app}
+	go func() {
+		_ = svr.Serve(lis)
+	}()
+	defer svr.Close()
+
+	r := &runner{
+		opts:    &opts,
+		rm:      rm,
+		rmURL:   fmt.Sprintf("http://%s:%d%s", opts.RMHost, lis.Addr().(*net.TCPAddr).Port, rmAPI),
+		payload: map[string]string{"data": strings.Repeat("x", opts.PayloadSize)},
+		report:  newReport(),
+		samples: map[string][]time.Duration{},
+	}
+	began := time.Now()
+	var started int64
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for opts.Duration <= 0 || time.Since(began) < opts.Duration {
+				if n := atomic.AddInt64(&started, 1); opts.Total > 0 && n > int64(opts.Total) {
+					return
+				}
+				r.runOne(opts.pick())
+			}
+		}()
+	}
+	wg.Wait()
+	r.report.finish(time.Since(began), r.samples, rm.Calls())
+	return r.report, nil
+}
+
+// runOne submits a trans of kind, and waits for its final status
+func (r *runner) runOne(kind string) {
+	gid := "bench-" + shortuuid.New()
+	began := time.Now()
+	err := r.submit(kind, gid)
+	if err != nil && !(kind == KindTcc && errors.Is(err, dtmcli.ErrFailure)) { // a failed try aborts the tcc as expected
+		r.record(kind, StatusSubmitError, errorKind("submit", err), 0)
+		return
+	}
+	deadline := began.Add(r.opts.Timeout)
+	for time.Now().Before(deadline) {
+		status, err := dtmimp.QueryTransStatus(r.opts.Server, gid)
+		if err != nil {
+			r.record(kind, "", errorKind("query", err), 0)
+		} else if status == dtmcli.StatusSucceed || status == dtmcli.StatusFailed {
+			r.rm.Forget(gid)
+			r.record(kind, status, "", time.Since(began))
+			return
+		}
+		time.Sleep(r.opts.PollInterval)
+	}
+	r.record(kind, StatusTimeout, "", 0)
+}
+
+func (r *runner) submit(kind string, gid string) error {
+	switch kind {
+	case KindSaga:
+		saga := dtmcli.NewSaga(r.opts.Server, gid)
+		for i := 0; i < r.opts.Branches; i++ {
+			saga.Add(r.rmURL+"/action", r.rmURL+"/compensate", r.payload)
+		}
+		return saga.Submit()
+	case KindTcc:
+		return dtmcli.TccGlobalTransaction(r.opts.Server, gid, func(tcc *dtmcli.Tcc) (*resty.Response, error) {
+			for i := 0; i < r.opts.Branches; i++ {
+				if resp, err := tcc.CallBranch(r.payload, r.rmURL+"/try", r.rmURL+"/confirm", r.rmURL+"/cancel"); err != nil {
+					return resp, err
+				}
+			}
+			return nil, nil
+		})
+	}
+	msg := dtmcli.NewMsg(r.opts.Server, gid)
+	for i := 0; i < r.opts.Branches; i++ {
+		msg.Add(r.rmURL+"/action", r.payload)
+	}
+	return msg.Submit()
+}
+
+// record records the final status and the latency of a trans, or an error if errKind is not empty
+func (r *runner) record(kind string, status string, errKind string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if errKind != "" {
+		r.report.Errors[errKind]++
+	}
+	if status == "" {
+		return
+	}
+	r.report.add(kind, status)
+	if latency > 0 {
+		r.samples[kind] = append(r.samples[kind], latency)
+	}
+}
+
+// errorKind is the error in Report.Errors, such as "submit BUSY" or "query INTERNAL"
+func errorKind(api string, err error) string {
+	code, _ := dtmimp.ErrorCode(err)
+	var apiErr *dtmimp.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.Code
+	}
+	return api + " " + code
+}
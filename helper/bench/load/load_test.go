@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package load
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("saga:2, tcc,msg:0")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"saga": 2, "tcc": 1, "msg": 0}, mix)
+
+	_, err = ParseMix("xa:1")
+	assert.Error(t, err)
+	_, err = ParseMix("saga:-1")
+	assert.Error(t, err)
+}
+
+func TestPercentiles(t *testing.T) {
+	samples := []time.Duration{}
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, Latency{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}, percentiles(samples))
+	assert.Equal(t, Latency{}, percentiles(nil))
+}
+
+func TestMockRMBarrier(t *testing.T) {
+	rm := NewMockRM(RMOptions{})
+	app := dtmutil.GetGinApp()
+	rm.AddRoute(app)
+	call := func(transType string, gid string, op string) int {
+		w := httptest.NewRecorder()
+		url := rmAPI + "/" + op + "?trans_type=" + transType + "&gid=" + gid + "&branch_id=01&op=" + op
+		app.ServeHTTP(w, httptest.NewRequest("POST", url, strings.NewReader("{}")))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, call("saga", "g1", "action"))
+	assert.Equal(t, http.StatusOK, call("saga", "g1", "action"))
+	assert.Equal(t, http.StatusOK, call("saga", "g1", "compensate"))
+	assert.Equal(t, http.StatusOK, call("tcc", "g2", "cancel"))
+	assert.Equal(t, http.StatusOK, call("tcc", "g2", "try"))
+	assert.Equal(t, map[string]int{
+		"action:executed":                  1,
+		"action:duplicate_skipped":         1,
+		"compensate:executed":              1,
+		"cancel:null_compensation_skipped": 1,
+		"try:duplicate_skipped":            1,
+	}, rm.Calls())
+
+	rm.FailureRate = 1
+	assert.Equal(t, http.StatusConflict, call("saga", "g3", "action"))
+	rm.FailureRate = 0
+	assert.Equal(t, http.StatusOK, call("saga", "g3", "compensate"))
+	assert.Equal(t, 1, rm.Calls()["compensate:null_compensation_skipped"]) // the failed action is rolled back
+
+	rm.OngoingRate = 1
+	assert.Equal(t, http.StatusTooEarly, call("msg", "g4", "action"))
+	rm.OngoingRate = 0
+	assert.Equal(t, http.StatusOK, call("msg", "g4", "action"))
+	assert.Equal(t, 1, rm.Calls()["action:ONGOING"])
+	assert.Equal(t, 2, rm.Calls()["action:executed"])
+
+	rm.Forget("g4")
+	assert.Equal(t, http.StatusOK, call("msg", "g4", "action"))
+	assert.Equal(t, 3, rm.Calls()["action:executed"])
+}
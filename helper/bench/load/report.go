@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package load
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Latency is the percentiles of the latencies from submit to the final status, in milliseconds
+type Latency struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// KindReport is the result of the trans of a kind, or of all kinds
+type KindReport struct {
+	Started  int            `json:"started"`
+	Statuses map[string]int `json:"statuses"` // succeed, failed, submit_error or timeout => count
+	Latency  Latency        `json:"latency"`
+}
+
+// Report is the result of a load test. it is marshaled to json to compare the runs
+type Report struct {
+	Elapsed    time.Duration          `json:"elapsed_ns"`
+	Throughput float64                `json:"throughput"` // the trans reaching succeed or failed per second
+	All        *KindReport            `json:"all"`
+	Kinds      map[string]*KindReport `json:"kinds"`
+	Errors     map[string]int         `json:"errors"`   // the errors of submit and query, like "submit BUSY"
+	RMCalls    map[string]int         `json:"rm_calls"` // the calls of the mock RM, like "action:executed"
+}
+
+func newReport() *Report {
+	return &Report{All: &KindReport{Statuses: map[string]int{}}, Kinds: map[string]*KindReport{}, Errors: map[string]int{}}
+}
+
+func (r *Report) add(kind string, status string) {
+	if r.Kinds[kind] == nil {
+		r.Kinds[kind] = &KindReport{Statuses: map[string]int{}}
+	}
+	for _, k := range []*KindReport{r.All, r.Kinds[kind]} {
+		k.Started++
+		k.Statuses[status]++
+	}
+}
+
+func (r *Report) finish(elapsed time.Duration, samples map[string][]time.Duration, rmCalls map[string]int) {
+	r.Elapsed, r.RMCalls = elapsed, rmCalls
+	all := []time.Duration{}
+	for kind, s := range samples {
+		r.Kinds[kind].Latency = percentiles(s)
+		all = append(all, s...)
+	}
+	r.All.Latency = percentiles(all)
+	if elapsed > 0 {
+		r.Throughput = float64(r.All.Latency.Count) / elapsed.Seconds()
+	}
+}
+
+// percentiles sorts samples, and returns the percentiles by the nearest rank
+func percentiles(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	at := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(samples)))) - 1
+		return float64(samples[i]) / float64(time.Millisecond)
+	}
+	return Latency{Count: len(samples), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: at(1)}
+}
+
+// Print prints the report in text
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "elapsed: %v, throughput: %.1f trans/s\n", r.Elapsed.Round(time.Millisecond), r.Throughput)
+	kinds := []string{}
+	for kind := range r.Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range append(kinds, "all") {
+		k := r.All
+		if kind != "all" {
+			k = r.Kinds[kind]
+		}
+		l := k.Latency
+		fmt.Fprintf(w, "%-5s started: %d, statuses: %s, latency(ms): p50 %.1f p90 %.1f p99 %.1f max %.1f\n",
+			kind, k.Started, sortedCounts(k.Statuses), l.P50, l.P90, l.P99, l.Max)
+	}
+	fmt.Fprintf(w, "errors: %s\n", sortedCounts(r.Errors))
+	fmt.Fprintf(w, "rm calls: %s\n", sortedCounts(r.RMCalls))
+}
+
+func sortedCounts(m map[string]int) string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := []string{}
+	for _, k := range keys {
+		items = append(items, fmt.Sprintf("%s=%d", k, m[k]))
+	}
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, " ")
+}
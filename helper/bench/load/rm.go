@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package load
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/gin-gonic/gin"
+)
+
+// rmAPI is the path of the mock RM. the branches are rmAPI/action, rmAPI/compensate, rmAPI/try, rmAPI/confirm and rmAPI/cancel
+const rmAPI = "/api/bench_rm"
+
+// RMOptions controls the behavior of the mock RM
+type RMOptions struct {
+	Latency     time.Duration // the latency of every branch call
+	Jitter      time.Duration // a random latency in [0, Jitter) added to Latency
+	FailureRate float64       // the rate of FAILURE of saga actions and tcc tries
+	OngoingRate float64       // the rate of ONGOING of the branches called by dtm server, which are retried later
+}
+
+// MockRM is a mock RM following the conventions of the branch barrier: every branch is called via a barrier, so the
+// repeated calls, the null compensations and the dangled tries are handled as a real RM does. the barriers are kept
+// in memory instead of a db
+type MockRM struct {
+	RMOptions
+	barriers barrierStore
+	mu       sync.Mutex
+	calls    map[string]int // op:result => count
+}
+
+// NewMockRM creates a MockRM
+func NewMockRM(opts RMOptions) *MockRM {
+	return &MockRM{RMOptions: opts, barriers: barrierStore{gids: map[string]map[string]bool{}}, calls: map[string]int{}}
+}
+
+// AddRoute adds the routes of the mock RM to app
+func (rm *MockRM) AddRoute(app *gin.Engine) {
+	app.POST(rmAPI+"/:op", dtmutil.WrapHandler2(func(c *gin.Context) interface{} {
+		return rm.handle(c.Param("op"), c)
+	}))
+}
+
+func (rm *MockRM) handle(op string, c *gin.Context) error {
+	bb, err := dtmcli.BarrierFromQuery(c.Request.URL.Query())
+	if err != nil {
+		rm.count(op, "invalid")
+		return err
+	}
+	tx := rm.barriers.begin(bb.Gid)
+	result, err := bb.CallInTxWithResult(tx, func() error {
+		return rm.busi(bb.TransType, op)
+	})
+	tx.end(err)
+	switch {
+	case err == dtmcli.ErrFailure || err == dtmcli.ErrOngoing:
+		rm.count(op, err.Error())
+	default:
+		rm.count(op, string(result))
+	}
+	return err
+}
+
+// busi is the business of a branch, which fails or is ongoing by the rates
+func (rm *MockRM) busi(transType string, op string) error {
+	latency := rm.Latency
+	if rm.Jitter > 0 {
+		latency += time.Duration(rand.Int63n(int64(rm.Jitter)))
+	}
+	time.Sleep(latency)
+	if (transType == "saga" && op == dtmcli.BranchAction || op == dtmcli.BranchTry) && rand.Float64() < rm.FailureRate {
+		return dtmcli.ErrFailure
+	}
+	if op != dtmcli.BranchTry && rand.Float64() < rm.OngoingRate { // tries are called by the client, and are not retried
+		return dtmcli.ErrOngoing
+	}
+	return nil
+}
+
+func (rm *MockRM) count(op string, result string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.calls[op+":"+result]++
+}
+
+// Calls returns the number of calls of each op and result, like action:executed or cancel:null_compensation_skipped
+func (rm *MockRM) Calls() map[string]int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	calls := map[string]int{}
+	for k, v := range rm.calls {
+		calls[k] = v
+	}
+	return calls
+}
+
+// Forget drops the barriers of a finished gid, so that a long soak test does not exhaust the memory
+func (rm *MockRM) Forget(gid string) {
+	rm.barriers.forget(gid)
+}
+
+// barrierStore is the barrier table in memory. the barriers of every gid are the keys of trans_type, branch_id and op
+type barrierStore struct {
+	mu   sync.Mutex
+	gids map[string]map[string]bool
+}
+
+func (s *barrierStore) begin(gid string) *barrierTx {
+	return &barrierTx{store: s, gid: gid}
+}
+
+func (s *barrierStore) forget(gid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.gids, gid)
+}
+
+// barrierTx is a local transaction of the barrier. like a db, the inserted barriers are visible to the other
+// transactions at once, as the rows locked, and removed if rolled back
+type barrierTx struct {
+	store    *barrierStore
+	gid      string
+	inserted []string
+}
+
+// Exec executes the insert ignore of the barrier, whose args are trans_type, gid, branch_id, op, barrier_id and reason
+func (tx *barrierTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if len(args) < 4 {
+		return nil, fmt.Errorf("unexpected barrier sql: %s", query)
+	}
+	key := fmt.Sprintf("%v-%v-%v", args[0], args[2], args[3])
+	s := tx.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gids[tx.gid] == nil {
+		s.gids[tx.gid] = map[string]bool{}
+	}
+	if s.gids[tx.gid][key] {
+		return rowsAffected(0), nil
+	}
+	s.gids[tx.gid][key] = true
+	tx.inserted = append(tx.inserted, key)
+	return rowsAffected(1), nil
+}
+
+// QueryRow is not used by the barriers of branches
+func (tx *barrierTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	panic("QueryRow is not supported by the mock RM")
+}
+
+// end commits the transaction if err is nil, or rolls it back
+func (tx *barrierTx) end(err error) {
+	if err == nil {
+		return
+	}
+	s := tx.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range tx.inserted {
+		delete(s.gids[tx.gid], key)
+	}
+}
+
+type rowsAffected int64
+
+func (r rowsAffected) LastInsertId() (int64, error) {
+	return 0, nil
+}
+
+func (r rowsAffected) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
@@ -18,6 +18,7 @@ usage:
     redis   prepare for redis bench test
     db      prepare for mysql|postgres bench test
 		boltdb  prepare for boltdb bench test
+    load    drive a running dtm server with a mock RM, and report the throughput and latencies. see bench load -h
 `
 
 func hintAndExit() {
@@ -31,6 +32,10 @@ func main() {
 	if len(os.Args) <= 1 {
 		hintAndExit()
 	}
+	if os.Args[1] == "load" {
+		runLoad(os.Args[2:])
+		return
+	}
 	logger.Infof("starting bench server")
 	config.MustLoadConfig("")
 	logger.InitLog(conf.LogLevel)
@@ -69,6 +69,7 @@ func main() {
 	}
 	_, _ = maxprocs.Set(maxprocs.Logger(logger.Infof))
 	registry.WaitStoreUp()
+	logger.FatalIfError(registry.CheckSchema())
 	dtmsvr.StartSvr()              // 启动dtmsvr的api服务
 	go dtmsvr.CronExpiredTrans(-1) // 启动dtmsvr的定时过期查询
 	select {}
@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_branch_op table, adding the ext data of the branches, such as the http profile
+alter table dtm.trans_branch_op add column `ext_data` TEXT comment 'branch扩展字段的数据';
@@ -0,0 +1,7 @@
+-- migration for the existing dtm schema, adding the counter of the seqs of the event log, which are allocated in the order of the commits
+CREATE TABLE IF NOT EXISTS dtm.trans_event_counter (
+  `id` int(11) NOT NULL COMMENT '只有id为1的一行',
+  `seq` bigint(22) NOT NULL COMMENT '最后分配的事件日志序号, 在写入事件的事务中加锁递增, 所以序号按提交的顺序可见',
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+INSERT IGNORE INTO dtm.trans_event_counter (id, seq) SELECT 1, COALESCE(MAX(id), 0) FROM dtm.trans_event;
@@ -0,0 +1,14 @@
+-- migration for the existing dtm schema, adding the table of the deduplicated payloads, and the payload_key column of dtm.trans_branch_op
+-- the branches created before the migration keep their payloads in bin_data
+alter table dtm.trans_branch_op add column `payload_key` varchar(80) NOT NULL DEFAULT '' COMMENT '去重后的载荷在dtm.trans_payload中的key，为空则载荷在bin_data中';
+CREATE TABLE IF NOT EXISTS dtm.trans_payload (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT,
+  `gid` varchar(128) NOT NULL COMMENT '事务全局id',
+  `payload_key` varchar(80) NOT NULL COMMENT '载荷的sha256，哈希冲突的载荷加上后缀-N',
+  `data` BLOB COMMENT '载荷数据',
+  `create_time` datetime DEFAULT NULL,
+  `update_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `gid_payload_key` (`gid`, `payload_key`),
+  key `update_time` (`update_time`) comment '这个索引用于清理不再引用的载荷'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
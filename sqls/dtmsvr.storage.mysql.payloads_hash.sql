@@ -0,0 +1,3 @@
+-- migration for the existing dtm.trans_global table, adding the payloads_hash and branch_count columns
+alter table dtm.trans_global add column `payloads_hash` varchar(64) not null default '' comment '提交的分支的哈希，用于检查重复提交';
+alter table dtm.trans_global add column `branch_count` int(11) not null default 0 comment '提交的分支数量';
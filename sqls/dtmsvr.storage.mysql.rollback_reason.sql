@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_global table, adding the rollback_reason column
+alter table dtm.trans_global add column `rollback_reason` TEXT comment '事务回滚的原因';
@@ -20,10 +20,18 @@ CREATE TABLE if not EXISTS dtm.trans_global (
   `next_cron_time` datetime default null comment '下次定时处理的时间',
   `owner` varchar(128) not null default '' comment '正在处理全局事务的锁定者',
   `ext_data` TEXT comment 'global扩展字段的数据',
+  `tenant` varchar(128) not null default '' comment '事务所属的租户',
+  `priority` smallint not null default 0 comment '事务优先级，超时的高优先级事务先处理',
+  `rollback_reason` TEXT comment '事务回滚的原因',
+  `payloads_hash` varchar(64) not null default '' comment '提交的分支的哈希，用于检查重复提交',
+  `branch_count` int(11) not null default 0 comment '提交的分支数量',
+  `version` bigint not null default 0 comment '乐观锁版本，每次写入加一',
   PRIMARY KEY (`id`),
   UNIQUE KEY `gid` (`gid`),
   key `owner`(`owner`),
-  key `status_next_cron_time` (`status`, `next_cron_time`) comment '这个索引用于查询超时的全局事务，能够合理的走索引'
+  key `tenant_id` (`tenant`, `id`),
+  key `status_next_cron_time` (`status`, `next_cron_time`) comment '这个索引用于查询超时的全局事务，能够合理的走索引',
+  key `create_time` (`create_time`) comment '这个索引用于按时间统计事务'
 ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 drop table IF EXISTS dtm.trans_branch_op;
 CREATE TABLE IF NOT EXISTS dtm.trans_branch_op (
@@ -32,9 +40,11 @@ CREATE TABLE IF NOT EXISTS dtm.trans_branch_op (
   `url` varchar(128) NOT NULL COMMENT '动作关联的url',
   `data` TEXT COMMENT '请求所携带的数据',
   `bin_data` BLOB COMMENT 'grpc的二进制数据',
+  `payload_key` varchar(80) NOT NULL DEFAULT '' COMMENT '去重后的载荷在dtm.trans_payload中的key，为空则载荷在bin_data中',
   `branch_id` VARCHAR(128) NOT NULL COMMENT '事务分支ID',
   `op` varchar(45) NOT NULL COMMENT '事务分支类型 saga_action | saga_compensate | xa',
   `status` varchar(45) NOT NULL COMMENT '步骤的状态 submitted | finished | rollbacked',
+  `ext_data` TEXT comment 'branch扩展字段的数据',
   `finish_time` datetime DEFAULT NULL,
   `rollback_time` datetime DEFAULT NULL,
   `create_time` datetime DEFAULT NULL,
@@ -42,3 +52,64 @@ CREATE TABLE IF NOT EXISTS dtm.trans_branch_op (
   PRIMARY KEY (`id`),
   UNIQUE KEY `gid_uniq` (`gid`, `branch_id`, `op`)
 ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+drop table IF EXISTS dtm.kv;
+CREATE TABLE IF NOT EXISTS dtm.kv (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT,
+  `cat` varchar(45) NOT NULL COMMENT '记录的分类',
+  `k` varchar(128) NOT NULL,
+  `v` TEXT,
+  `version` bigint(22) default 1 COMMENT '乐观锁版本号',
+  `create_time` datetime default NULL,
+  `update_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE key `uniq_k`(`cat`, `k`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+drop table IF EXISTS dtm.trans_branch_attempt;
+CREATE TABLE IF NOT EXISTS dtm.trans_branch_attempt (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT,
+  `gid` varchar(128) NOT NULL COMMENT '事务全局id',
+  `branch_id` VARCHAR(128) NOT NULL COMMENT '事务分支ID',
+  `op` varchar(45) NOT NULL COMMENT '事务分支类型',
+  `attempt` int(11) NOT NULL COMMENT '该分支的第几次调用',
+  `target` varchar(1024) NOT NULL COMMENT '调用的url',
+  `start_time` datetime(3) DEFAULT NULL,
+  `duration` bigint(22) NOT NULL default 0 COMMENT '调用耗时，毫秒',
+  `result` varchar(45) NOT NULL COMMENT '调用结果 succeed | failure | ongoing | error',
+  `response` TEXT COMMENT '截断的响应或错误',
+  `create_time` datetime DEFAULT NULL,
+  `update_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  key `gid_branch` (`gid`, `branch_id`, `op`),
+  key `create_time` (`create_time`) comment '这个索引用于清理过期的调用记录'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+drop table IF EXISTS dtm.trans_payload;
+CREATE TABLE IF NOT EXISTS dtm.trans_payload (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT,
+  `gid` varchar(128) NOT NULL COMMENT '事务全局id',
+  `payload_key` varchar(80) NOT NULL COMMENT '载荷的sha256，哈希冲突的载荷加上后缀-N',
+  `data` BLOB COMMENT '载荷数据',
+  `create_time` datetime DEFAULT NULL,
+  `update_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `gid_payload_key` (`gid`, `payload_key`),
+  key `update_time` (`update_time`) comment '这个索引用于清理不再引用的载荷'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+drop table IF EXISTS dtm.trans_event;
+CREATE TABLE IF NOT EXISTS dtm.trans_event (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT COMMENT '事件日志的序号',
+  `gid` varchar(128) NOT NULL COMMENT '事务全局id',
+  `trans_type` varchar(45) NOT NULL COMMENT '事务类型',
+  `event_seq` bigint(22) NOT NULL default 0 COMMENT '该事务的第几个事件',
+  `old_status` varchar(12) NOT NULL default '' COMMENT '原状态',
+  `new_status` varchar(12) NOT NULL COMMENT '新状态',
+  `event_time` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  key `event_time` (`event_time`) comment '这个索引用于清理过期的事件'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+drop table IF EXISTS dtm.trans_event_counter;
+CREATE TABLE IF NOT EXISTS dtm.trans_event_counter (
+  `id` int(11) NOT NULL COMMENT '只有id为1的一行',
+  `seq` bigint(22) NOT NULL COMMENT '最后分配的事件日志序号, 在写入事件的事务中加锁递增, 所以序号按提交的顺序可见',
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+INSERT IGNORE INTO dtm.trans_event_counter (id, seq) SELECT 1, COALESCE(MAX(id), 0) FROM dtm.trans_event;
@@ -0,0 +1,4 @@
+-- migration for the existing dtm.trans_global table, adding the tenant column
+-- the trans created before the migration belong to the empty tenant
+alter table dtm.trans_global add column `tenant` varchar(128) not null default '' comment '事务所属的租户';
+alter table dtm.trans_global add key `tenant_id` (`tenant`, `id`);
@@ -0,0 +1,20 @@
+-- migration for the existing dtm schema, adding the table of the audit trail of branch attempts
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.trans_branch_attempt_seq;
+CREATE TABLE IF NOT EXISTS dtm.trans_branch_attempt (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.trans_branch_attempt_seq'),
+  gid varchar(128) NOT NULL,
+  branch_id VARCHAR(128) NOT NULL,
+  op varchar(45) NOT NULL,
+  attempt int NOT NULL,
+  target varchar(1024) NOT NULL,
+  start_time timestamp(3) with time zone DEFAULT NULL,
+  duration bigint NOT NULL default 0,
+  result varchar(45) NOT NULL,
+  response text,
+  create_time timestamp(0) with time zone DEFAULT NULL,
+  update_time timestamp(0) with time zone DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+create index if not EXISTS gid_branch on dtm.trans_branch_attempt (gid, branch_id, op);
+create index if not EXISTS attempt_create_time on dtm.trans_branch_attempt (create_time);
@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_branch_op table, adding the ext data of the branches, such as the http profile
+alter table dtm.trans_branch_op add column if not EXISTS ext_data text;
@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_global table, adding the index used by /api/dtmsvr/admin/stats
+create index if not EXISTS create_time on dtm.trans_global (create_time);
@@ -0,0 +1,7 @@
+-- migration for the existing dtm schema, adding the counter of the seqs of the event log, which are allocated in the order of the commits
+CREATE TABLE IF NOT EXISTS dtm.trans_event_counter (
+  id int NOT NULL,
+  seq bigint NOT NULL,
+  PRIMARY KEY (id)
+);
+INSERT INTO dtm.trans_event_counter (id, seq) SELECT 1, COALESCE(MAX(id), 0) FROM dtm.trans_event ON CONFLICT (id) DO NOTHING;
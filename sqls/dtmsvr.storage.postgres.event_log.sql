@@ -0,0 +1,14 @@
+-- migration for the existing dtm schema, adding the table of the event log of the lifecycle events
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.trans_event_seq;
+CREATE TABLE IF NOT EXISTS dtm.trans_event (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.trans_event_seq'),
+  gid varchar(128) NOT NULL,
+  trans_type varchar(45) NOT NULL,
+  event_seq bigint NOT NULL default 0,
+  old_status varchar(12) NOT NULL default '',
+  new_status varchar(12) NOT NULL,
+  event_time timestamp(3) with time zone DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+create index if not EXISTS event_time on dtm.trans_event (event_time);
@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_global table, adding the ext data of the globals, which is missing in the schema of tdsql
+alter table dtm.trans_global add column if not EXISTS ext_data text;
@@ -0,0 +1,3 @@
+-- migration for the existing dtm.trans_global table, adding the version column
+-- the version of the existing trans starts from 0
+alter table dtm.trans_global add column if not EXISTS version bigint not null default 0;
@@ -0,0 +1,14 @@
+-- migration for the existing dtm schema, adding the table of the key-values, such as the topics, the templates and the offsets of the event consumers
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.kv_seq;
+CREATE TABLE IF NOT EXISTS dtm.kv (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.kv_seq'),
+  cat varchar(45) NOT NULL,
+  k varchar(128) NOT NULL,
+  v TEXT,
+  version bigint default 1,
+  create_time timestamp(0) with time zone DEFAULT NULL,
+  update_time timestamp(0) with time zone DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT uniq_k UNIQUE (cat, k)
+);
@@ -0,0 +1,16 @@
+-- migration for the existing dtm schema, adding the table of the deduplicated payloads, and the payload_key column of dtm.trans_branch_op
+-- the branches created before the migration keep their payloads in bin_data
+alter table dtm.trans_branch_op add column if not EXISTS payload_key varchar(80) NOT NULL DEFAULT '';
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.trans_payload_seq;
+CREATE TABLE IF NOT EXISTS dtm.trans_payload (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.trans_payload_seq'),
+  gid varchar(128) NOT NULL,
+  payload_key varchar(80) NOT NULL,
+  data bytea,
+  create_time timestamp(0) with time zone DEFAULT NULL,
+  update_time timestamp(0) with time zone DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT gid_payload_key UNIQUE (gid, payload_key)
+);
+create index if not EXISTS payload_update_time on dtm.trans_payload (update_time);
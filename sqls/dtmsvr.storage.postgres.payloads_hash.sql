@@ -0,0 +1,3 @@
+-- migration for the existing dtm.trans_global table, adding the payloads_hash and branch_count columns
+alter table dtm.trans_global add column if not EXISTS payloads_hash varchar(64) not null default '';
+alter table dtm.trans_global add column if not EXISTS branch_count int not null default 0;
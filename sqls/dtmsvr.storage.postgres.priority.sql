@@ -0,0 +1,3 @@
+-- migration for the existing dtm.trans_global table, adding the priority column
+-- the trans created before the migration are of the normal priority 0
+alter table dtm.trans_global add column if not EXISTS priority smallint not null default 0;
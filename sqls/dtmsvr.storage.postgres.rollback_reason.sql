@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_global table, adding the rollback_reason column
+alter table dtm.trans_global add column if not EXISTS rollback_reason text;
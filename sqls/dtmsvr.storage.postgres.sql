@@ -21,11 +21,19 @@ CREATE TABLE if not EXISTS dtm.trans_global (
   next_cron_time timestamp(0) with time zone default null,
   owner varchar(128) not null default '',
   ext_data text,
+  tenant varchar(128) not null default '',
+  priority smallint not null default 0,
+  rollback_reason text,
+  payloads_hash varchar(64) not null default '',
+  branch_count int not null default 0,
+  version bigint not null default 0,
   PRIMARY KEY (id),
   CONSTRAINT gid UNIQUE (gid)
 );
 create index if not EXISTS owner on dtm.trans_global(owner);
+create index if not EXISTS tenant_id on dtm.trans_global (tenant, id);
 create index if not EXISTS status_next_cron_time on dtm.trans_global (status, next_cron_time);
+create index if not EXISTS create_time on dtm.trans_global (create_time);
 drop table IF EXISTS dtm.trans_branch_op;
 -- SQLINES LICENSE FOR EVALUATION USE ONLY
 CREATE SEQUENCE if not EXISTS dtm.trans_branch_op_seq;
@@ -35,13 +43,84 @@ CREATE TABLE IF NOT EXISTS dtm.trans_branch_op (
   url varchar(128) NOT NULL,
   data TEXT,
   bin_data bytea,
+  payload_key varchar(80) NOT NULL DEFAULT '',
   branch_id VARCHAR(128) NOT NULL,
   op varchar(45) NOT NULL,
   status varchar(45) NOT NULL,
+  ext_data text,
   finish_time timestamp(0) with time zone DEFAULT NULL,
   rollback_time timestamp(0) with time zone DEFAULT NULL,
   create_time timestamp(0) with time zone DEFAULT NULL,
   update_time timestamp(0) with time zone DEFAULT NULL,
   PRIMARY KEY (id),
   CONSTRAINT gid_branch_uniq UNIQUE (gid, branch_id, op)
-);
\ No newline at end of file
+);
+drop table IF EXISTS dtm.kv;
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.kv_seq;
+CREATE TABLE IF NOT EXISTS dtm.kv (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.kv_seq'),
+  cat varchar(45) NOT NULL,
+  k varchar(128) NOT NULL,
+  v TEXT,
+  version bigint default 1,
+  create_time timestamp(0) with time zone DEFAULT NULL,
+  update_time timestamp(0) with time zone DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT uniq_k UNIQUE (cat, k)
+);
+drop table IF EXISTS dtm.trans_branch_attempt;
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.trans_branch_attempt_seq;
+CREATE TABLE IF NOT EXISTS dtm.trans_branch_attempt (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.trans_branch_attempt_seq'),
+  gid varchar(128) NOT NULL,
+  branch_id VARCHAR(128) NOT NULL,
+  op varchar(45) NOT NULL,
+  attempt int NOT NULL,
+  target varchar(1024) NOT NULL,
+  start_time timestamp(3) with time zone DEFAULT NULL,
+  duration bigint NOT NULL default 0,
+  result varchar(45) NOT NULL,
+  response text,
+  create_time timestamp(0) with time zone DEFAULT NULL,
+  update_time timestamp(0) with time zone DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+create index if not EXISTS gid_branch on dtm.trans_branch_attempt (gid, branch_id, op);
+create index if not EXISTS attempt_create_time on dtm.trans_branch_attempt (create_time);
+drop table IF EXISTS dtm.trans_payload;
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.trans_payload_seq;
+CREATE TABLE IF NOT EXISTS dtm.trans_payload (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.trans_payload_seq'),
+  gid varchar(128) NOT NULL,
+  payload_key varchar(80) NOT NULL,
+  data bytea,
+  create_time timestamp(0) with time zone DEFAULT NULL,
+  update_time timestamp(0) with time zone DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT gid_payload_key UNIQUE (gid, payload_key)
+);
+create index if not EXISTS payload_update_time on dtm.trans_payload (update_time);
+drop table IF EXISTS dtm.trans_event;
+-- SQLINES LICENSE FOR EVALUATION USE ONLY
+CREATE SEQUENCE if not EXISTS dtm.trans_event_seq;
+CREATE TABLE IF NOT EXISTS dtm.trans_event (
+  id bigint NOT NULL DEFAULT NEXTVAL ('dtm.trans_event_seq'),
+  gid varchar(128) NOT NULL,
+  trans_type varchar(45) NOT NULL,
+  event_seq bigint NOT NULL default 0,
+  old_status varchar(12) NOT NULL default '',
+  new_status varchar(12) NOT NULL,
+  event_time timestamp(3) with time zone DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+create index if not EXISTS event_time on dtm.trans_event (event_time);
+drop table IF EXISTS dtm.trans_event_counter;
+CREATE TABLE IF NOT EXISTS dtm.trans_event_counter (
+  id int NOT NULL,
+  seq bigint NOT NULL,
+  PRIMARY KEY (id)
+);
+INSERT INTO dtm.trans_event_counter (id, seq) SELECT 1, COALESCE(MAX(id), 0) FROM dtm.trans_event ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,4 @@
+-- migration for the existing dtm.trans_global table, adding the tenant column
+-- the trans created before the migration belong to the empty tenant
+alter table dtm.trans_global add column if not EXISTS tenant varchar(128) not null default '';
+create index if not EXISTS tenant_id on dtm.trans_global (tenant, id);
@@ -0,0 +1,18 @@
+-- migration for the existing dtm schema, adding the table of the audit trail of branch attempts
+CREATE TABLE IF NOT EXISTS dtm.trans_branch_attempt (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT,
+  `gid` varchar(128) NOT NULL COMMENT '事务全局id',
+  `branch_id` VARCHAR(128) NOT NULL COMMENT '事务分支ID',
+  `op` varchar(45) NOT NULL COMMENT '事务分支类型',
+  `attempt` int(11) NOT NULL COMMENT '该分支的第几次调用',
+  `target` varchar(1024) NOT NULL COMMENT '调用的url',
+  `start_time` datetime(3) DEFAULT NULL,
+  `duration` bigint(22) NOT NULL default 0 COMMENT '调用耗时，毫秒',
+  `result` varchar(45) NOT NULL COMMENT '调用结果 succeed | failure | ongoing | error',
+  `response` TEXT COMMENT '截断的响应或错误',
+  `create_time` datetime DEFAULT NULL,
+  `update_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`,`gid`),
+  key `gid_branch` (`gid`, `branch_id`, `op`),
+  key `create_time` (`create_time`) comment '这个索引用于清理过期的调用记录'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 shardkey=gid;
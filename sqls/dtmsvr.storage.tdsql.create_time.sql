@@ -0,0 +1,2 @@
+-- migration for the existing dtm.trans_global table, adding the index used by /api/dtmsvr/admin/stats
+alter table dtm.trans_global add key `create_time` (`create_time`);
@@ -0,0 +1,12 @@
+-- migration for the existing dtm schema, adding the table of the event log of the lifecycle events
+CREATE TABLE IF NOT EXISTS dtm.trans_event (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT COMMENT '事件日志的序号',
+  `gid` varchar(128) NOT NULL COMMENT '事务全局id',
+  `trans_type` varchar(45) NOT NULL COMMENT '事务类型',
+  `event_seq` bigint(22) NOT NULL default 0 COMMENT '该事务的第几个事件',
+  `old_status` varchar(12) NOT NULL default '' COMMENT '原状态',
+  `new_status` varchar(12) NOT NULL COMMENT '新状态',
+  `event_time` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`,`gid`),
+  key `event_time` (`event_time`) comment '这个索引用于清理过期的事件'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 shardkey=gid;
@@ -0,0 +1,13 @@
+-- migration for the existing dtm schema, adding the table of the key-values, such as the topics, the templates and the offsets of the event consumers
+CREATE TABLE IF NOT EXISTS dtm.kv (
+  `id` bigint(22) NOT NULL AUTO_INCREMENT,
+  `cat` varchar(45) NOT NULL COMMENT '记录的分类',
+  `k` varchar(128) NOT NULL,
+  `v` TEXT,
+  `version` bigint(22) default 1 COMMENT '乐观锁版本号',
+  `create_time` datetime default NULL,
+  `update_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`,`cat`),
+  UNIQUE KEY `id` (`id`,`cat`),
+  UNIQUE key `uniq_k`(`cat`, `k`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 shardkey=cat;
@@ -0,0 +1,15 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+// Package sqls embeds the sql scripts of the dtm server, which are the migrations of the sql store
+package sqls
+
+import "embed"
+
+// Storage contains the scripts dtmsvr.storage.<driver>[.<migration>].sql
+//
+//go:embed dtmsvr.storage.*.sql
+var Storage embed.FS
@@ -7,12 +7,24 @@
 package test
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/dtmsvr/storage/registry"
 	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,6 +39,7 @@ func TestAPIQuery(t *testing.T) {
 	assert.Equal(t, resp.StatusCode(), 200)
 	dtmimp.MustUnmarshalString(resp.String(), &m)
 	assert.NotEqual(t, nil, m["transaction"])
+	assert.Equal(t, float64(conf.RequestTimeout), m["transaction"].(map[string]interface{})["requestTimeout"])
 	assert.Equal(t, 2, len(m["branches"].([]interface{})))
 
 	resp, err = dtmimp.RestyClient.R().SetQueryParam("gid", "").Get(dtmutil.DefaultHTTPServer + "/query")
@@ -41,6 +54,44 @@ func TestAPIQuery(t *testing.T) {
 	assert.Equal(t, 0, len(m["branches"].([]interface{})))
 }
 
+func TestAPIQueryTimeFormat(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	err := genMsg(gid).Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	query := func(format string) map[string]interface{} {
+		resp, err := dtmimp.RestyClient.R().SetQueryParams(map[string]string{"gid": gid, "time_format": format}).Get(dtmutil.DefaultHTTPServer + "/query")
+		assert.Nil(t, err)
+		m := map[string]interface{}{}
+		dtmimp.MustUnmarshalString(resp.String(), &m)
+		return m["transaction"].(map[string]interface{})
+	}
+	rendered := query("")["create_time"].(string)
+	assert.True(t, strings.HasSuffix(rendered, "Z"), rendered) // in UTC whatever the store and the time zone
+	create, err := time.Parse(time.RFC3339Nano, rendered)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(create.UnixNano()/int64(time.Millisecond)), query("unix_ms")["create_time"])
+}
+
+func TestAPIQueryBranchPage(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	err := genMsg(gid).Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	m := map[string]interface{}{}
+	resp, err := dtmimp.RestyClient.R().SetQueryParams(map[string]string{"gid": gid, "branch_limit": "1"}).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	dtmimp.MustUnmarshalString(resp.String(), &m)
+	assert.Equal(t, 1, len(m["branches"].([]interface{})))
+	assert.Equal(t, "01", m["next_branch_position"])
+
+	resp, err = dtmimp.RestyClient.R().SetQueryParams(map[string]string{"gid": gid, "branch_limit": "1", "branch_position": "01"}).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	dtmimp.MustUnmarshalString(resp.String(), &m)
+	assert.Equal(t, 1, len(m["branches"].([]interface{})))
+	assert.Equal(t, "02", m["next_branch_position"])
+}
+
 func TestAPIAll(t *testing.T) {
 	for i := 0; i < 3; i++ { // add three
 		gid := dtmimp.GetFuncName() + fmt.Sprintf("%d", i)
@@ -100,3 +151,326 @@ func TestAPIResetCronTime(t *testing.T) {
 		return int64(succeedCount), hasRemaining, err
 	})
 }
+
+func TestAPIWatch(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSaga(gid, false, false)
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing)
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+
+	resp, err := http.Get(dtmutil.DefaultHTTPServer + "/watch?gid=" + gid)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	events := []map[string]interface{}{}
+	go cronTransOnce(t, gid)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() { // the stream is closed after the trans is finished
+		if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+			m := map[string]interface{}{}
+			dtmimp.MustUnmarshalString(data, &m)
+			events = append(events, m)
+		}
+	}
+	assert.Equal(t, "init", events[0]["change"])
+	assert.Equal(t, StatusSubmitted, events[0]["transaction"].(map[string]interface{})["status"])
+	last := events[len(events)-1]
+	assert.Equal(t, "global_status", last["change"])
+	assert.Equal(t, StatusSucceed, last["transaction"].(map[string]interface{})["status"])
+}
+
+func TestAPIQueryDecodedPayloads(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	err := genMsg(gid).Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	resp, err := dtmimp.RestyClient.R().SetQueryParam("gid", gid).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	assert.NotContains(t, resp.String(), "branch_details") // unchanged by default
+
+	resp, err = dtmimp.RestyClient.R().SetQueryParams(map[string]string{"gid": gid, "payloads": "decoded"}).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	m := map[string]interface{}{}
+	dtmimp.MustUnmarshalString(resp.String(), &m)
+	details := m["branch_details"].([]interface{})
+	assert.Equal(t, 2, len(details))
+	assert.Equal(t, float64(30), details[0].(map[string]interface{})["payload"].(map[string]interface{})["amount"])
+}
+
+func TestAPIInvalidGid(t *testing.T) {
+	gid := dtmimp.GetFuncName() + " 1"
+	resp, err := dtmimp.RestyClient.R().SetBody(map[string]interface{}{"gid": gid, "trans_type": "msg"}).
+		Post(dtmutil.DefaultHTTPServer + "/submit")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Contains(t, resp.String(), "invalid char ' '")
+
+	err = genGrpcMsg(gid).Submit()
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+	assert.Nil(t, dtmsvr.GetStore().FindTransGlobalStore(gid))
+}
+
+func TestAPIAllTenant(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid)
+	msg.Tenant = "tenant-a"
+	err := msg.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, "tenant-a", dtmsvr.GetStore().FindTransGlobalStore(gid).Tenant)
+
+	resp, err := dtmimp.RestyClient.R().SetQueryParams(map[string]string{"limit": "1000", "tenant": "tenant-a"}).
+		Get(dtmutil.DefaultHTTPServer + "/all")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.String(), gid)
+
+	resp, err = dtmimp.RestyClient.R().SetQueryParams(map[string]string{"limit": "1000", "tenant": "tenant-b"}).
+		Get(dtmutil.DefaultHTTPServer + "/all")
+	assert.Nil(t, err)
+	assert.NotContains(t, resp.String(), gid)
+
+	gid2 := dtmimp.GetFuncName() + "Grpc"
+	gmsg := genGrpcMsg(gid2)
+	gmsg.Tenant = "tenant-a"
+	err = gmsg.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid2)
+	assert.Equal(t, "tenant-a", dtmsvr.GetStore().FindTransGlobalStore(gid2).Tenant)
+}
+
+func TestAPIPriority(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid)
+	msg.Priority = dtmcli.PriorityMax + 1
+	assert.Error(t, msg.Submit())
+	assert.Nil(t, dtmsvr.GetStore().FindTransGlobalStore(gid))
+
+	msg.Priority = 3
+	assert.Nil(t, msg.Submit())
+	waitTransProcessed(gid)
+	assert.Equal(t, 3, dtmsvr.GetStore().FindTransGlobalStore(gid).Priority)
+	resp, err := dtmimp.RestyClient.R().SetQueryParams(map[string]string{"limit": "1000"}).Get(dtmutil.DefaultHTTPServer + "/all")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.String(), `"priority":3`)
+
+	gid2 := dtmimp.GetFuncName() + "Grpc"
+	gmsg := genGrpcMsg(gid2)
+	gmsg.Priority = -2
+	assert.Nil(t, gmsg.Submit())
+	waitTransProcessed(gid2)
+	assert.Equal(t, -2, dtmsvr.GetStore().FindTransGlobalStore(gid2).Priority)
+}
+
+func TestAPIQuarantine(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	old, oldForward := conf.PoisonThreshold, dtmsvr.CronForwardDuration
+	defer func() { conf.PoisonThreshold, dtmsvr.CronForwardDuration = old, oldForward }()
+	conf.PoisonThreshold = 2
+	s := registry.GetStore()
+	now := time.Now()
+	g := &storage.TransGlobalStore{Gid: gid, TransType: "msg", Status: StatusSubmitted, Protocol: "http", NextCronTime: &now, Options: "{malformed"}
+	e2p(s.MaySaveNewTrans(g, []storage.TransBranchStore{{Gid: gid, BranchID: "01", Op: dtmcli.BranchAction, URL: busi.Busi + "/TransIn", BinData: []byte("{}"), Status: StatusPrepared}}))
+	unquarantine := func() (int, string) {
+		resp, err := dtmimp.RestyClient.R().SetBody(map[string]string{"gid": gid}).Post(dtmutil.DefaultHTTPServer + "/admin/unquarantine")
+		assert.Nil(t, err)
+		return resp.StatusCode(), resp.String()
+	}
+
+	assert.Equal(t, gid, dtmsvr.CronTransOnce()) // processing the malformed options panics
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid))
+	code, _ := unquarantine()
+	assert.Equal(t, http.StatusConflict, code)
+	dtmsvr.CronForwardDuration = time.Duration(conf.RetryInterval+10) * time.Second
+	assert.Equal(t, gid, dtmsvr.CronTransOnce())
+	dtmsvr.CronForwardDuration = oldForward
+	assert.Equal(t, dtmcli.StatusQuarantined, getTransStatus(gid))
+	assert.Contains(t, s.FindTransGlobalStore(gid).ExtData, "dtm panic")
+
+	g = s.FindTransGlobalStore(gid) // fixed
+	g.Options = ""
+	e2p(s.ChangeGlobalStatus(g, g.Status, []string{"options"}, true))
+	code, body := unquarantine()
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid))
+	cronTransOnce(t, gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+}
+
+func TestAPIDryRun(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSaga(gid, false, false)
+	saga.WaitResult = true
+	err := saga.Submit()
+	assert.Nil(t, err)
+
+	conf.AdminToken = "admin-secret"
+	defer func() { conf.AdminToken = "" }()
+	resp, err := dtmimp.RestyClient.R().SetBody(map[string]string{"gid": gid}).Post(dtmutil.DefaultHTTPServer + "/admin/dry-run")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	resp, err = dtmimp.RestyClient.R().SetAuthToken("admin-secret").SetBody(map[string]string{"gid": gid}).
+		Post(dtmutil.DefaultHTTPServer + "/admin/dry-run")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	plan := map[string]interface{}{}
+	dtmimp.MustUnmarshalString(resp.String(), &plan)
+	assert.Equal(t, "none", plan["action"])
+	assert.Equal(t, "trans is finished", plan["reason"])
+	assert.Equal(t, 4, len(plan["branches"].([]interface{})))
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+
+	resp, err = dtmimp.RestyClient.R().SetAuthToken("admin-secret").SetBody(map[string]string{"gid": gid + "-none"}).
+		Post(dtmutil.DefaultHTTPServer + "/admin/dry-run")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+}
+
+func TestAPIHealth(t *testing.T) {
+	resp, err := dtmimp.RestyClient.R().Get(dtmutil.DefaultHTTPServer + "/health")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, resp.String(), `"status":"ok"`)
+	if conf.Store.IsDB() {
+		assert.Contains(t, resp.String(), `"max_open_connections"`)
+	}
+}
+
+func TestAPIUpdateCustomData(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid)
+	err := msg.Prepare("")
+	assert.Nil(t, err)
+	update := func(data string) *resty.Response {
+		resp, err := dtmimp.RestyClient.R().SetBody(map[string]string{"gid": gid, "custom_data": data}).
+			Post(dtmutil.DefaultHTTPServer + "/trans/custom_data")
+		assert.Nil(t, err)
+		return resp
+	}
+	assert.Equal(t, http.StatusOK, update(`{"ref":"R1"}`).StatusCode())
+	assert.Equal(t, http.StatusOK, update(`{"ref":"R2"}`).StatusCode()) // the last update wins
+	assert.Equal(t, `{"ref":"R2"}`, dtmsvr.GetTransGlobal(gid).CustomData)
+	assert.Equal(t, http.StatusBadRequest, update(`{"delay":10}`).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, update(strings.Repeat("a", 300)).StatusCode())
+
+	err = msg.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	resp := update(`{"ref":"R3"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode())
+	assert.Contains(t, resp.String(), "is succeed")
+}
+
+func TestAPISubmitBatch(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	prepared := genMsg(gid + "-prepared")
+	assert.Nil(t, prepared.Prepare(""))
+	saga := genMsg(gid + "-saga")
+	saga.TransType = "saga"
+	changed := genMsg(gid + "-1")
+	changed.Payloads[0] = `{"amount":40}`
+
+	results, err := dtmcli.SubmitBatch([]*dtmcli.Msg{genMsg(gid + "-1"), genMsg(gid + "-2"), prepared, saga, genMsg("")})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(results))
+	assert.Nil(t, results[0].Err())
+	assert.Nil(t, results[1].Err())
+	assert.Equal(t, dtmcli.MsgBatchResult{Gid: gid + "-prepared", Result: dtmcli.ResultSuccess, Duplicated: true, Status: StatusSubmitted}, results[2])
+	assert.True(t, errors.Is(results[3].Err(), dtmcli.ErrFailure))
+	assert.Equal(t, dtmcli.ResultFailure, results[4].Result)
+	for _, g := range []string{gid + "-1", gid + "-2", gid + "-prepared"} {
+		waitTransProcessed(g)
+		assert.Equal(t, StatusSucceed, getTransStatus(g))
+	}
+
+	results, err = dtmcli.SubmitBatch([]*dtmcli.Msg{genMsg(gid + "-2"), changed})
+	assert.Nil(t, err)
+	assert.Equal(t, dtmcli.MsgBatchResult{Gid: gid + "-2", Result: dtmcli.ResultSuccess, Duplicated: true, Status: StatusSucceed}, results[0])
+	assert.Equal(t, dtmcli.ResultFailure, results[1].Result)
+	assert.Contains(t, results[1].Message, "different payloads")
+}
+
+func TestAPIStats(t *testing.T) {
+	msg := genMsg(dtmimp.GetFuncName())
+	assert.Nil(t, msg.Submit())
+	waitTransProcessed(msg.Gid)
+
+	resp, err := dtmimp.RestyClient.R().Get(dtmutil.DefaultHTTPServer + "/admin/stats")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	result := map[string]interface{}{}
+	dtmimp.MustUnmarshal(resp.Body(), &result)
+	assert.Equal(t, float64(3600), result["bucket"])
+	assert.NotEmpty(t, result["counts"])
+	assert.Contains(t, result, "backlog")
+
+	resp, err = dtmimp.RestyClient.R().SetQueryParams(map[string]string{"from": "0", "bucket": "1"}).Get(dtmutil.DefaultHTTPServer + "/admin/stats")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	resp, err = dtmimp.RestyClient.R().SetQueryParam("bucket", "x").Get(dtmutil.DefaultHTTPServer + "/admin/stats")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+}
+
+func TestAPIAdminResetCron(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	_, _ = initTransGlobalByNextCronTime(gid, time.Now().Add(1000*time.Second))
+	resetCron := func(body map[string]interface{}) (int, map[string]interface{}) {
+		resp, err := dtmimp.RestyClient.R().SetBody(body).Post(dtmutil.DefaultHTTPServer + "/admin/reset-cron")
+		assert.Nil(t, err)
+		m := map[string]interface{}{}
+		dtmimp.MustUnmarshal(resp.Body(), &m)
+		return resp.StatusCode(), m
+	}
+
+	code, m := resetCron(map[string]interface{}{"timeout": 900, "dry_run": true})
+	assert.Equal(t, http.StatusOK, code)
+	assert.GreaterOrEqual(t, m["count"], float64(1))
+
+	code, m = resetCron(map[string]interface{}{"timeout": 900, "limit": 1})
+	assert.Equal(t, http.StatusOK, code)
+	assert.GreaterOrEqual(t, m["succeed_count"], float64(1))
+	assert.Equal(t, false, m["has_remaining"])
+	g := registry.GetStore().FindTransGlobalStore(gid)
+	assert.True(t, g.NextCronTime.Before(time.Now().Add(time.Second)))
+	assert.Equal(t, "", g.Owner)
+
+	code, m = resetCron(map[string]interface{}{"timeout": 900, "dry_run": true})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(0), m["count"])
+	registry.GetStore().ChangeGlobalStatus(g, dtmcli.StatusSucceed, []string{}, true)
+
+	code, _ = resetCron(map[string]interface{}{"limit": -1})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAPIV2(t *testing.T) {
+	server := dtmutil.DefaultHTTPServer + "/v2"
+	gid, err := dtmcli.GenGidCtx(context.Background(), server)
+	assert.Nil(t, err)
+	req := busi.GenTransReq(30, false, false)
+	msg := dtmcli.NewMsg(server, gid).Add(busi.Busi+"/TransOut", &req).Add(busi.Busi+"/TransIn", &req)
+	assert.Nil(t, msg.Submit())
+	waitTransProcessed(gid)
+
+	msg = dtmcli.NewMsg(server, gid).Add(busi.Busi+"/TransOut", &req)
+	err = msg.Submit()
+	assert.True(t, errors.Is(err, dtmcli.ErrDuplicated))
+
+	resp, err := dtmimp.RestyClient.R().SetQueryParam("gid", gid).Get(server + "/query")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, resp.String(), `"code":"OK"`)
+	assert.NotContains(t, resp.String(), "dtm_result")
+
+	resp, err = dtmimp.RestyClient.R().SetQueryParam("gid", gid+"-none").Get(server + "/query")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+	assert.True(t, errors.Is(dtmimp.ParseDtmResp(server, resp, nil), dtmcli.ErrNotFound))
+
+	resp, err = dtmimp.RestyClient.R().Get(server + "/openapi.json")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.String(), "/api/dtmsvr/v2/submit")
+}
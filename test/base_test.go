@@ -10,13 +10,18 @@ import (
 	"database/sql"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmgorm"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmcli/dtmsqlx"
 	"github.com/dtm-labs/dtm/dtmcli/logger"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 )
 
 // BarrierModel barrier model for gorm
@@ -60,6 +65,75 @@ func TestBaseSqlDB(t *testing.T) {
 	asserts.Equal(dbr.RowsAffected, int64(1))
 }
 
+func TestBaseGormDB(t *testing.T) {
+	db := dtmutil.DbGet(busi.BusiConf)
+	gid := dtmimp.GetFuncName()
+	called := false
+	busiCall := func(tx *gorm.DB) error {
+		called = true
+		return nil
+	}
+	// the compensation is called before the action, so it is a null compensation
+	bb := &dtmcli.BranchBarrier{TransType: "saga", Gid: gid, BranchID: "01", Op: dtmcli.BranchCompensate}
+	err := dtmgorm.CallWithGormDB(bb, db.DB, busiCall)
+	assert.Nil(t, err)
+	assert.False(t, called)
+	// the dangled action is not called
+	bb = &dtmcli.BranchBarrier{TransType: "saga", Gid: gid, BranchID: "01", Op: dtmcli.BranchAction}
+	err = dtmgorm.CallWithGormDB(bb, db.DB, busiCall)
+	assert.Nil(t, err)
+	assert.False(t, called)
+
+	bb = &dtmcli.BranchBarrier{TransType: "saga", Gid: gid, BranchID: "02", Op: dtmcli.BranchAction}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return dtmgorm.CallWithGormDB(bb, tx, busiCall)
+	})
+	assert.Nil(t, err)
+	assert.True(t, called)
+	dbr := db.Model(&BarrierModel{}).Where("gid=? and branch_id=?", gid, "02").Find(&[]BarrierModel{})
+	assert.Equal(t, int64(1), dbr.RowsAffected)
+}
+
+func TestBaseSqlxTx(t *testing.T) {
+	db := sqlx.NewDb(dtmutil.DbGet(busi.BusiConf).ToSQLDB(), busi.BusiConf.Driver)
+	gid := dtmimp.GetFuncName()
+	called := false
+	busiCall := func(tx *sqlx.Tx) error {
+		called = true
+		return nil
+	}
+	for _, op := range []string{dtmcli.BranchCancel, dtmcli.BranchTry} { // null compensation, and then the dangled try
+		bb := &dtmcli.BranchBarrier{TransType: "tcc", Gid: gid, BranchID: "01", Op: op}
+		tx := db.MustBegin()
+		err := dtmsqlx.CallWithSqlxTx(bb, tx, busiCall)
+		assert.Nil(t, err)
+		assert.Nil(t, tx.Commit())
+		assert.False(t, called)
+	}
+
+	bb := &dtmcli.BranchBarrier{TransType: "tcc", Gid: gid, BranchID: "02", Op: dtmcli.BranchTry}
+	tx := db.MustBegin()
+	err := dtmsqlx.CallWithSqlxTx(bb, tx, busiCall)
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	assert.True(t, called)
+}
+
+func TestBaseBarrierGC(t *testing.T) {
+	db := dtmutil.DbGet(busi.BusiConf)
+	gid := dtmimp.GetFuncName()
+	old := time.Now().Add(-dtmcli.MinBarrierRetention - time.Hour)
+	for i, createTime := range []time.Time{old, old, time.Now()} {
+		dtmimp.DBExec(db.ToSQLDB(), "insert into dtm_barrier.barrier(trans_type, gid, branch_id, op, barrier_id, reason, create_time) values(?,?,?,?,?,?,?)",
+			"saga", gid, fmt.Sprintf("%02d", i+1), dtmcli.BranchAction, "01", dtmcli.BranchAction, createTime)
+	}
+	deleted, err := dtmcli.BarrierGC(db.ToSQLDB(), dtmcli.MinBarrierRetention, 1)
+	assert.Nil(t, err)
+	assert.True(t, deleted >= 2)
+	dbr := db.Model(&BarrierModel{}).Where("gid=?", gid).Find(&[]BarrierModel{})
+	assert.Equal(t, int64(1), dbr.RowsAffected) // the fresh one is kept
+}
+
 func TestBaseHttp(t *testing.T) {
 	resp, err := dtmimp.RestyClient.R().SetQueryParam("panic_string", "1").Post(busi.Busi + "/TestPanic")
 	assert.Nil(t, err)
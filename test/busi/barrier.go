@@ -203,32 +203,22 @@ func TccBarrierTransOutCancel(c *gin.Context) interface{} {
 	})
 }
 
+// the BSaga branches are called in the barrier by dtmgrpc.BarrierInterceptor, see GrpcStartup
+
 func (s *busiServer) TransInBSaga(ctx context.Context, in *BusiReq) (*emptypb.Empty, error) {
-	barrier := MustBarrierFromGrpc(ctx)
-	return &emptypb.Empty{}, barrier.Call(txGet(), func(tx *sql.Tx) error {
-		return sagaGrpcAdjustBalance(tx, TransInUID, in.Amount, in.TransInResult)
-	})
+	return &emptypb.Empty{}, sagaGrpcAdjustBalance(dtmgrpc.BarrierTxFromGrpc(ctx), TransInUID, in.Amount, in.TransInResult)
 }
 
 func (s *busiServer) TransOutBSaga(ctx context.Context, in *BusiReq) (*emptypb.Empty, error) {
-	barrier := MustBarrierFromGrpc(ctx)
-	return &emptypb.Empty{}, barrier.Call(txGet(), func(tx *sql.Tx) error {
-		return sagaGrpcAdjustBalance(tx, TransOutUID, -in.Amount, in.TransOutResult)
-	})
+	return &emptypb.Empty{}, sagaGrpcAdjustBalance(dtmgrpc.BarrierTxFromGrpc(ctx), TransOutUID, -in.Amount, in.TransOutResult)
 }
 
 func (s *busiServer) TransInRevertBSaga(ctx context.Context, in *BusiReq) (*emptypb.Empty, error) {
-	barrier := MustBarrierFromGrpc(ctx)
-	return &emptypb.Empty{}, barrier.Call(txGet(), func(tx *sql.Tx) error {
-		return sagaGrpcAdjustBalance(tx, TransInUID, -in.Amount, "")
-	})
+	return &emptypb.Empty{}, sagaGrpcAdjustBalance(dtmgrpc.BarrierTxFromGrpc(ctx), TransInUID, -in.Amount, "")
 }
 
 func (s *busiServer) TransOutRevertBSaga(ctx context.Context, in *BusiReq) (*emptypb.Empty, error) {
-	barrier := MustBarrierFromGrpc(ctx)
-	return &emptypb.Empty{}, barrier.Call(txGet(), func(tx *sql.Tx) error {
-		return sagaGrpcAdjustBalance(tx, TransOutUID, in.Amount, "")
-	})
+	return &emptypb.Empty{}, sagaGrpcAdjustBalance(dtmgrpc.BarrierTxFromGrpc(ctx), TransOutUID, in.Amount, "")
 }
 
 func (s *busiServer) TransInRedis(ctx context.Context, in *BusiReq) (*emptypb.Empty, error) {
@@ -50,7 +50,10 @@ func GrpcStartup() {
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", BusiGrpcPort))
 	logger.FatalIfError(err)
-	s := grpc.NewServer(grpc.UnaryInterceptor(dtmgimp.GrpcServerLog))
+	barrierInterceptor := dtmgrpc.BarrierInterceptor(func(ctx context.Context) *sql.DB {
+		return pdbGet()
+	}, "/busi.Busi/TransInBSaga", "/busi.Busi/TransOutBSaga", "/busi.Busi/TransInRevertBSaga", "/busi.Busi/TransOutRevertBSaga")
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(dtmgimp.GrpcServerLog, barrierInterceptor))
 	RegisterBusiServer(s, &busiServer{})
 	go func() {
 		logger.Debugf("busi grpc listening at %v", lis.Addr())
@@ -7,7 +7,10 @@
 package busi
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 
@@ -30,6 +33,9 @@ const (
 	BusiGrpcPort = 58081
 )
 
+// SignSecret is the secret of the signature verified by TransInSigned
+const SignSecret = "busi-secret"
+
 type setupFunc func(*gin.Engine)
 
 var setupFuncs = map[string]setupFunc{}
@@ -211,4 +217,21 @@ func BaseAddRoute(app *gin.Engine) {
 		}
 		return nil
 	}))
+	app.POST(BusiAPI+"/TransInSigned", dtmutil.WrapHandler2(func(c *gin.Context) interface{} {
+		body, err := c.GetRawData()
+		if err != nil {
+			return err
+		}
+		ts := c.GetHeader("X-Dtm-Timestamp")
+		mac := hmac.New(sha256.New, []byte(SignSecret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		if ts == "" || c.GetHeader("X-Dtm-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			return fmt.Errorf("signature not valid. %w", dtmcli.ErrFailure)
+		}
+		req := TransReq{}
+		dtmimp.MustUnmarshal(body, &req)
+		c.Set("trans_req", &req)
+		return handleGeneralBusiness(c, MainSwitch.TransInResult.Fetch(), req.TransInResult, "transIn")
+	}))
 }
@@ -43,6 +43,8 @@ func TestMain(m *testing.M) {
 	tenv := os.Getenv("TEST_STORE")
 	if tenv == "boltdb" {
 		conf.Store.Driver = "boltdb"
+	} else if tenv == "memory" {
+		conf.Store.Driver = "memory"
 	} else if tenv == "mysql" {
 		conf.Store.Driver = "mysql"
 		conf.Store.Host = "localhost"
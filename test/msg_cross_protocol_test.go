@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgGrpcQueryPreparedHTTP(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genGrpcMsg(gid)
+	assert.Nil(t, msg.Prepare(busi.Busi+"/QueryPrepared"))
+	busi.MainSwitch.QueryPreparedResult.SetOnce(dtmcli.ResultOngoing)
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusPrepared, getTransStatus(gid))
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed}, getBranchesStatus(gid))
+}
+
+func TestMsgGrpcDoAndSubmitHTTP(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genGrpcMsg(gid)
+	busiErr := errors.New("connection lost")
+	err := msg.DoAndSubmit(busi.Busi+"/QueryPrepared", func(bb *dtmcli.BranchBarrier) error {
+		return busiErr
+	})
+	assert.Equal(t, busiErr, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid)) // submitted as the http query says success
+
+	gid = gid + "-failed"
+	msg = genGrpcMsg(gid)
+	busi.MainSwitch.QueryPreparedResult.SetOnce(dtmcli.ResultFailure)
+	err = msg.DoAndSubmit(busi.Busi+"/QueryPrepared", func(bb *dtmcli.BranchBarrier) error {
+		return busiErr
+	})
+	assert.Equal(t, busiErr, err)
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+}
+
+func TestMsgQueryPreparedGrpc(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid)
+	assert.Nil(t, msg.Prepare(dtmimp.GrpcURLPrefix+busi.BusiGrpc+"/busi.Busi/QueryPrepared"))
+	busi.MainSwitch.QueryPreparedResult.SetOnce(dtmcli.ResultOngoing)
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusPrepared, getTransStatus(gid))
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed}, getBranchesStatus(gid))
+
+	gid = gid + "-failed"
+	msg = genMsg(gid)
+	assert.Nil(t, msg.Prepare(dtmimp.GrpcURLPrefix+busi.BusiGrpc+"/busi.Busi/QueryPrepared"))
+	busi.MainSwitch.QueryPreparedResult.SetOnce(dtmcli.ResultFailure)
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+}
+
+func TestMsgDoAndSubmitGrpc(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid)
+	busiErr := errors.New("connection lost")
+	err := msg.DoAndSubmit(dtmimp.GrpcURLPrefix+busi.BusiGrpc+"/busi.Busi/QueryPrepared", func(bb *dtmcli.BranchBarrier) error {
+		return busiErr
+	})
+	assert.Equal(t, busiErr, err)
+	assert.Equal(t, StatusPrepared, getTransStatus(gid)) // left to dtm server to query
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+}
+
+func TestMsgQueryPreparedInvalid(t *testing.T) {
+	msg := genMsg(dtmimp.GetFuncName())
+	err := msg.Prepare(busi.BusiGrpc + "/busi.Busi/QueryPrepared") // a grpc url without grpc://
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument))
+	msg.QueryPrepared = "thrift://localhost:9090/Busi/QueryPrepared" // no protocol registered
+	assert.Error(t, dtmimp.TransCallDtm(&msg.TransBase, msg, "prepare"))
+
+	grpcMsg := genGrpcMsg(dtmimp.GetFuncName() + "-grpc")
+	assert.True(t, errors.Is(grpcMsg.Prepare("grpc://localhost:58081"), dtmcli.ErrInvalidArgument))
+}
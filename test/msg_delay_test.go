@@ -37,3 +37,25 @@ func TestMsgDelayNormal(t *testing.T) {
 	assert.Equal(t, []string{StatusSucceed, StatusSucceed}, getBranchesStatus(msg.Gid))
 	assert.Equal(t, StatusSucceed, getTransStatus(msg.Gid))
 }
+
+func TestMsgBranchDelay(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid).SetBranchDelay(1, 10)
+	submitForwardCron(0, func() {
+		msg.Submit()
+		waitTransProcessed(msg.Gid)
+	})
+
+	assert.Equal(t, []string{StatusSucceed, StatusPrepared}, getBranchesStatus(msg.Gid))
+	assert.Equal(t, StatusSubmitted, getTransStatus(msg.Gid))
+	cronTransOnceForwardCron(t, "", 8)
+	cronTransOnceForwardCron(t, gid, 12)
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed}, getBranchesStatus(msg.Gid))
+	assert.Equal(t, StatusSucceed, getTransStatus(msg.Gid))
+}
+
+func TestMsgBranchDelayExceedTimeout(t *testing.T) {
+	msg := genMsg(dtmimp.GetFuncName()).SetBranchDelay(1, 3600)
+	err := msg.Submit()
+	assert.Error(t, err)
+}
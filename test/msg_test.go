@@ -55,6 +55,19 @@ func TestMsgTimeoutFailed(t *testing.T) {
 	assert.Equal(t, StatusFailed, getTransStatus(msg.Gid))
 }
 
+func TestMsgQueryPreparedQuorum(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	msg := genMsg(gid)
+	msg.SetQueryPreparedTargets(0, busi.Busi+"/QueryPrepared", busi.Busi+"/QueryPrepared")
+	msg.Prepare("")
+	busi.MainSwitch.QueryPreparedResult.SetOnce(dtmcli.ResultFailure) // one target fails, the other succeeds
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusPrepared, getTransStatus(msg.Gid))
+	cronTransOnceForwardNow(t, gid, 180)
+	assert.Equal(t, StatusSucceed, getTransStatus(msg.Gid))
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed}, getBranchesStatus(msg.Gid))
+}
+
 func TestMsgAbnormal(t *testing.T) {
 	msg := genMsg(dtmimp.GetFuncName())
 	msg.Prepare("")
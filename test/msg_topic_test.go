@@ -0,0 +1,51 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+)
+
+func subscribe(topic string, url string) error {
+	resp, err := dtmimp.RestyClient.R().SetBody(map[string]string{"topic": topic, "url": url}).
+		Post(dtmutil.DefaultHTTPServer + "/subscribe")
+	if err != nil {
+		return err
+	}
+	return dtmimp.RespAsErrorCompatible(resp)
+}
+
+func unsubscribe(topic string, url string) error {
+	resp, err := dtmimp.RestyClient.R().SetBody(map[string]string{"topic": topic, "url": url}).
+		Post(dtmutil.DefaultHTTPServer + "/unsubscribe")
+	if err != nil {
+		return err
+	}
+	return dtmimp.RespAsErrorCompatible(resp)
+}
+
+func TestMsgTopic(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	topic := gid
+	assert.Nil(t, subscribe(topic, busi.Busi+"/TransOut"))
+	assert.Nil(t, subscribe(topic, busi.Busi+"/TransIn"))
+	assert.Error(t, subscribe(topic, busi.Busi+"/TransIn"))
+
+	req := busi.GenTransReq(30, false, false)
+	msg := dtmcli.NewMsg(dtmutil.DefaultHTTPServer, gid).AddTopic(topic, &req)
+	err := msg.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(msg.Gid)
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed}, getBranchesStatus(msg.Gid))
+	assert.Equal(t, StatusSucceed, getTransStatus(msg.Gid))
+
+	assert.Nil(t, unsubscribe(topic, busi.Busi+"/TransOut"))
+	assert.Nil(t, unsubscribe(topic, busi.Busi+"/TransIn"))
+	assert.Error(t, unsubscribe(topic, busi.Busi+"/TransIn"))
+	err = dtmcli.NewMsg(dtmutil.DefaultHTTPServer, gid+"-2").AddTopic(topic, &req).Submit()
+	assert.Error(t, err) // no subscribers
+}
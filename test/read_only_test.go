@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setReadOnly(t *testing.T, on bool) {
+	resp, err := dtmcli.GetRestyClient().R().SetBody(map[string]interface{}{"read_only": on}).Post(DtmServer + "/admin/read-only")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+}
+
+func TestReadOnlyCron(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	req := busi.GenTransReq(30, false, false)
+	calls := 0
+	processing, finish := make(chan bool, 1), make(chan bool)
+	busi.SetSleepCancelHandler(func(c *gin.Context) interface{} {
+		if calls++; calls == 1 { // left to the cron
+			return dtmcli.ErrOngoing
+		}
+		processing <- true
+		<-finish
+		return nil
+	})
+	saga := dtmcli.NewSaga(DtmServer, gid).Add(busi.Busi+"/TccBSleepCancel", busi.Busi+"/TransOutRevert", &req)
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(gid)
+
+	old := dtmsvr.CronForwardDuration
+	dtmsvr.CronForwardDuration = 300 * time.Second
+	defer func() { dtmsvr.CronForwardDuration = old }()
+	claimed := make(chan string, 1)
+	go func() { claimed <- dtmsvr.CronTransOnce() }()
+	<-processing
+	setReadOnly(t, true)
+	defer setReadOnly(t, false)
+
+	err := genSaga(gid+"-new", false, false).Submit()
+	assert.Contains(t, err.Error(), dtmimp.CodeReadOnly)
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid)) // the queries work
+
+	finish <- true // the trans in processing is finished
+	assert.Equal(t, gid, <-claimed)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+
+	setReadOnly(t, false)
+	gid2 := gid + "-2"
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing)
+	assert.Nil(t, genSaga(gid2, false, false).Submit())
+	waitTransProcessed(gid2)
+	setReadOnly(t, true)
+	assert.Equal(t, "", dtmsvr.CronTransOnce()) // no new trans is claimed
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid2))
+
+	setReadOnly(t, false)
+	cronTransOnce(t, gid2)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid2))
+}
@@ -7,10 +7,15 @@
 package test
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
 	"github.com/stretchr/testify/assert"
 )
@@ -73,3 +78,66 @@ func TestSagaConCommittedOngoing(t *testing.T) {
 	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(sagaCon.Gid))
 	assert.Equal(t, StatusSucceed, getTransStatus(sagaCon.Gid))
 }
+
+func TestSagaConDAG(t *testing.T) {
+	req := busi.GenTransReq(30, false, false)
+	gid := dtmimp.GetFuncName()
+	saga := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gid).
+		Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		AddWithDeps(busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", &req, []int{0}).
+		AddWithDeps(busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", &req, []int{0}).
+		AddWithDeps(busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", &req, []int{1, 2})
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing)
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid))
+
+	resp, err := dtmimp.RestyClient.R().SetQueryParam("gid", gid).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.String(), `{"branch_id":"04","depends_on":["02","03"],"waiting_for":["02","03"]}`)
+
+	cronTransOnce(t, gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+}
+
+func TestSagaConDAGCycle(t *testing.T) {
+	req := busi.GenTransReq(30, false, false)
+	err := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, dtmimp.GetFuncName()).
+		AddWithDeps(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req, []int{1}).
+		AddWithDeps(busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", &req, []int{0}).
+		Submit()
+	assert.Error(t, err)
+}
+
+func TestSagaConMaxParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+	defer svr.Close()
+
+	req := busi.GenTransReq(30, false, false)
+	saga := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, dtmimp.GetFuncName()).SetConcurrent().SetMaxParallel(3)
+	for i := 0; i < 10; i++ {
+		saga.Add(svr.URL+"/TransIn", svr.URL+"/TransInRevert", &req)
+	}
+	saga.WaitResult = true
+	err := saga.Submit()
+	assert.Nil(t, err)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, maxRunning)
+}
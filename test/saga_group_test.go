@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package test
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+)
+
+// genSagaGroup generates a saga of a group trip of two branches, and a branch after the group
+func genSagaGroup(gid string, inFailed bool) *dtmcli.Saga {
+	req := busi.GenTransReq(30, false, false)
+	inReq := busi.GenTransReq(30, false, inFailed)
+	return dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gid).
+		AddInGroup("trip", busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		AddInGroup("trip", busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", &inReq).
+		Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		AddBranchGroupOrder(2, []string{"trip"})
+}
+
+func TestSagaGroupNormal(t *testing.T) {
+	saga := genSagaGroup(dtmimp.GetFuncName(), false).SetMaxParallel(1)
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(saga.Gid))
+
+	resp, err := dtmimp.RestyClient.R().SetQueryParam("gid", saga.Gid).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.String(), `{"branch_id":"02","group":"trip","depends_on":[],"waiting_for":[]}`)
+	assert.Contains(t, resp.String(), `{"branch_id":"03","depends_on":["01","02"],"waiting_for":[]}`)
+}
+
+func TestSagaGroupRollback(t *testing.T) {
+	saga := genSagaGroup(dtmimp.GetFuncName(), true)
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusFailed, getTransStatus(saga.Gid))
+	statuses := getBranchesStatus(saga.Gid)
+	// the whole group is compensated, and the branch after the group is not run
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed, StatusFailed, StatusPrepared, StatusPrepared}, []string{statuses[0], statuses[2], statuses[3], statuses[4], statuses[5]})
+}
+
+func TestSagaGroupRetryInterval(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSagaGroup(gid, false).SetBranchRetryInterval(1, 5)
+	busi.MainSwitch.TransInResult.SetOnce(dtmcli.ResultOngoing)
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(gid)
+	// the group is pending while its branch waits for the retry, so the branch after the group is not run
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusPrepared, StatusPrepared, StatusPrepared}, getBranchesStatus(gid))
+	cronTransOnce(t, gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+}
+
+func TestSagaGroupInvalid(t *testing.T) {
+	req := busi.GenTransReq(30, false, false)
+	saga := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, dtmimp.GetFuncName()).
+		AddInGroup("trip", busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		AddInGroup("trip", busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", &req).
+		Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		AddBranchOrder(2, []int{1}) // after a part of the group
+	assert.Error(t, saga.Submit())
+}
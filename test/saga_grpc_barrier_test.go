@@ -9,11 +9,15 @@ package test
 import (
 	"testing"
 
+	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmgrpc"
+	"github.com/dtm-labs/dtm/dtmgrpc/dtmgimp"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestSagaGrpcBarrierNormal(t *testing.T) {
@@ -41,3 +45,43 @@ func genSagaGrpcBarrier(gid string, outFailed bool, inFailed bool) *dtmgrpc.Saga
 	saga.Add(busi.BusiGrpc+"/busi.Busi/TransInBSaga", busi.BusiGrpc+"/busi.Busi/TransInRevertBSaga", req)
 	return saga
 }
+
+func TestSagaGrpcBarrierInterceptorDuplicated(t *testing.T) {
+	before := getBeforeBalances("mysql")
+	gid := dtmimp.GetFuncName()
+	client := busi.NewBusiClient(dtmgimp.MustGetGrpcConn(busi.BusiGrpc, false))
+	req := busi.GenBusiReq(30, false, false)
+	ctx := dtmgimp.TransInfo2Ctx(gid, "saga", "01", dtmcli.BranchAction, dtmutil.DefaultGrpcServer)
+	_, err := client.TransOutBSaga(ctx, req)
+	assert.Nil(t, err)
+	_, err = client.TransOutBSaga(ctx, req) // duplicated action is skipped
+	assert.Nil(t, err)
+	assertNotSameBalance(t, before, "mysql")
+	assert.Equal(t, before[0]-30, busi.GetBalanceByUID(busi.TransOutUID, "mysql"))
+
+	ctx = dtmgimp.TransInfo2Ctx(gid, "saga", "01", dtmcli.BranchCompensate, dtmutil.DefaultGrpcServer)
+	_, err = client.TransOutRevertBSaga(ctx, req)
+	assert.Nil(t, err)
+	_, err = client.TransOutRevertBSaga(ctx, req)
+	assert.Nil(t, err)
+	assertSameBalance(t, before, "mysql")
+}
+
+func TestSagaGrpcBarrierInterceptorDisorder(t *testing.T) {
+	before := getBeforeBalances("mysql")
+	gid := dtmimp.GetFuncName()
+	client := busi.NewBusiClient(dtmgimp.MustGetGrpcConn(busi.BusiGrpc, false))
+	req := busi.GenBusiReq(30, false, false)
+	// the compensation arrives before the action, it is a null compensation, and the action is skipped later
+	_, err := client.TransOutRevertBSaga(dtmgimp.TransInfo2Ctx(gid, "saga", "01", dtmcli.BranchCompensate, dtmutil.DefaultGrpcServer), req)
+	assert.Nil(t, err)
+	_, err = client.TransOutBSaga(dtmgimp.TransInfo2Ctx(gid, "saga", "01", dtmcli.BranchAction, dtmutil.DefaultGrpcServer), req)
+	assert.Nil(t, err)
+	assertSameBalance(t, before, "mysql")
+
+	// a failed action is mapped to codes.Aborted, and the barrier is rolled back
+	req = busi.GenBusiReq(30, true, false)
+	_, err = client.TransOutBSaga(dtmgimp.TransInfo2Ctx(gid, "saga", "02", dtmcli.BranchAction, dtmutil.DefaultGrpcServer), req)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assertSameBalance(t, before, "mysql")
+}
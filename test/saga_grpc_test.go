@@ -8,10 +8,12 @@ package test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmgrpc"
+	"github.com/dtm-labs/dtm/dtmsvr"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
 	"github.com/stretchr/testify/assert"
@@ -35,6 +37,7 @@ func TestSagaGrpcRollback(t *testing.T) {
 	cronTransOnce(t, gid)
 	assert.Equal(t, StatusFailed, getTransStatus(saga.Gid))
 	assert.Equal(t, []string{StatusSucceed, StatusSucceed, StatusSucceed, StatusFailed}, getBranchesStatus(saga.Gid))
+	assert.Equal(t, "branch 02 action failed: grpc code Aborted: FAILURE", dtmsvr.GetStore().FindTransGlobalStore(gid).RollbackReason)
 }
 
 func TestSagaGrpcCurrent(t *testing.T) {
@@ -173,3 +176,32 @@ func TestSagaGrpcCronHeaders(t *testing.T) {
 	cronTransOnce(t, gidYes)
 	assert.Equal(t, StatusSucceed, getTransStatus(gidYes))
 }
+
+func TestSagaGrpcCodeResults(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSagaGrpc(gid, false, false)
+	saga.GrpcCodeResults = map[string]dtmcli.GrpcCodeResult{"FailedPrecondition": {Result: dtmcli.ResultFailure}}
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing) // returned as FailedPrecondition
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusSucceed, StatusFailed, StatusPrepared, StatusPrepared}, getBranchesStatus(gid))
+}
+
+func TestSagaGrpcCodeResultsDelay(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSagaGrpc(gid, false, false)
+	saga.GrpcCodeResults = map[string]dtmcli.GrpcCodeResult{"FailedPrecondition": {Result: dtmcli.ResultOngoing, Delay: 100}}
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing)
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid))
+	g := dtmsvr.GetStore().FindTransGlobalStore(gid)
+	assert.True(t, g.NextCronTime.After(time.Now().Add(90*time.Second))) // retried after the suggested delay
+	cronTransOnce(t, gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+
+	saga = genSagaGrpc(gid+"-invalid", false, false)
+	saga.GrpcCodeResults = map[string]dtmcli.GrpcCodeResult{"NotACode": {Result: dtmcli.ResultFailure}}
+	assert.Error(t, saga.Submit())
+}
@@ -103,6 +103,15 @@ func TestSagaOptionsRollbackWait(t *testing.T) {
 	assert.Equal(t, []string{StatusSucceed, StatusSucceed, StatusSucceed, StatusFailed}, getBranchesStatus(saga.Gid))
 }
 
+func TestSagaOptionsPayloadInQueryNested(t *testing.T) {
+	saga := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, dtmimp.GetFuncName())
+	saga.Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", map[string]interface{}{"req": busi.GenTransReq(30, false, false)})
+	saga.SetBranchPayloadInQuery(0)
+	err := saga.Submit()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "nested")
+}
+
 func TestSagaPassthroughHeadersYes(t *testing.T) {
 	gidYes := dtmimp.GetFuncName()
 	sagaYes := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gidYes)
@@ -166,3 +175,40 @@ func TestSagaHeadersYes1(t *testing.T) {
 	cronTransOnce(t, gidYes)
 	assert.Equal(t, StatusSucceed, getTransStatus(gidYes))
 }
+
+func TestSagaOptionsHTTPProfileNotFound(t *testing.T) {
+	saga := genSaga(dtmimp.GetFuncName(), false, false)
+	saga.SetBranchHTTPProfile(0, "not-exists")
+	err := saga.Submit()
+	assert.Error(t, err)
+}
+
+func TestSagaOptionsBranchRetryInterval(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSaga1(dtmimp.GetFuncName(), false, false)
+	saga.SetBranchRetryInterval(0, 300)
+	busi.MainSwitch.TransOutResult.SetOnce("ERROR")
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusSubmitted, getTransStatus(saga.Gid))
+	cronTransOnceForwardCron(t, "", 60) // the trans is not retried by the default RetryInterval
+	cronTransOnceForwardCron(t, gid, 360)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed}, getBranchesStatus(saga.Gid))
+}
+
+func TestSagaConfPassthroughHeadersYes(t *testing.T) {
+	conf.PassthroughHeaders = "test_header"
+	defer func() { conf.PassthroughHeaders = "" }()
+	gidYes := dtmimp.GetFuncName()
+	sagaYes := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gidYes)
+	sagaYes.Add(busi.Busi+"/TransOutHeaderYes", "", nil)
+	busi.MainSwitch.TransOutResult.SetOnce("ONGOING")
+	err := sagaYes.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gidYes)
+	assert.Equal(t, StatusSubmitted, getTransStatus(gidYes))
+	cronTransOnce(t, gidYes) // the captured header is persisted for the retries
+	assert.Equal(t, StatusSucceed, getTransStatus(gidYes))
+}
@@ -0,0 +1,45 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+)
+
+func genSagaResultRef(gid string, ref string) *dtmcli.Saga {
+	req := busi.GenTransReq(30, false, false)
+	return dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gid).
+		Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		Add(busi.Busi+"/TransIn", busi.Busi+"/TransInRevert", map[string]interface{}{
+			"amount":          30,
+			"trans_in_result": ref,
+		})
+}
+
+func TestSagaResultRef(t *testing.T) {
+	saga := genSagaResultRef(dtmimp.GetFuncName(), "{{result:branch-01.dtm_result}}")
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(saga.Gid))
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+}
+
+func TestSagaResultRefNotFound(t *testing.T) {
+	saga := genSagaResultRef(dtmimp.GetFuncName(), "{{result:branch-01.order_no}}")
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusPrepared}, getBranchesStatus(saga.Gid))
+	assert.Equal(t, StatusSubmitted, getTransStatus(saga.Gid))
+}
+
+func TestSagaResultRefInvalid(t *testing.T) {
+	saga := genSagaResultRef(dtmimp.GetFuncName(), "{{result:branch-02.dtm_result}}")
+	err := saga.Submit()
+	assert.Error(t, err)
+}
@@ -11,6 +11,8 @@ import (
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
 	"github.com/stretchr/testify/assert"
@@ -31,6 +33,9 @@ func TestSagaRollback(t *testing.T) {
 	waitTransProcessed(saga.Gid)
 	assert.Equal(t, []string{StatusSucceed, StatusSucceed, StatusSucceed, StatusFailed}, getBranchesStatus(saga.Gid))
 	assert.Equal(t, StatusFailed, getTransStatus(saga.Gid))
+	// the reason is read from the store, so it survives a restart of dtm server
+	reason := dtmsvr.GetStore().FindTransGlobalStore(saga.Gid).RollbackReason
+	assert.Regexp(t, `^branch 02 action failed: .*FAILURE`, reason)
 }
 
 func TestSagaOngoingSucceed(t *testing.T) {
@@ -46,6 +51,23 @@ func TestSagaOngoingSucceed(t *testing.T) {
 	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
 }
 
+func TestSagaAttempts(t *testing.T) {
+	conf.BranchAttempts.Enabled = 1
+	defer func() { conf.BranchAttempts.Enabled = 0 }()
+	gid := dtmimp.GetFuncName()
+	saga := genSaga(gid, false, false)
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing)
+	saga.Submit()
+	waitTransProcessed(saga.Gid)
+	cronTransOnce(t, gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+	attempts := dtmsvr.GetStore().FindAttempts(gid)
+	assert.Equal(t, 3, len(attempts))
+	assert.Equal(t, storage.AttemptOngoing, attempts[0].Result)
+	assert.Equal(t, 2, attempts[1].Attempt)
+	assert.Equal(t, storage.AttemptSucceed, attempts[1].Result)
+}
+
 func TestSagaFailed(t *testing.T) {
 	gid := dtmimp.GetFuncName()
 	saga := genSaga(dtmimp.GetFuncName(), false, true)
@@ -69,7 +91,9 @@ func TestSagaAbnormal(t *testing.T) {
 	assert.Nil(t, err)
 	waitTransProcessed(saga.Gid)
 	err = saga.Submit()
-	assert.Error(t, err) // a succeed trans can't accept submit
+	assert.Nil(t, err) // a succeed trans accepts the same submit, and returns its status
+	err = genSaga(saga.Gid, false, true).Submit()
+	assert.Error(t, err) // but not a different submit
 }
 
 func TestSagaEmptyUrl(t *testing.T) {
@@ -83,6 +107,31 @@ func TestSagaEmptyUrl(t *testing.T) {
 	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
 }
 
+func TestSagaSkipSucceededBranch(t *testing.T) {
+	saga := genSaga(dtmimp.GetFuncName(), false, false)
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultOngoing)
+	saga.Submit()
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, []string{StatusPrepared, StatusPrepared, StatusPrepared, StatusPrepared}, getBranchesStatus(saga.Gid))
+
+	// a pass reads the branches, then the TransOut action is succeeded by another pass
+	trans := dtmsvr.GetTransGlobal(saga.Gid)
+	branches := dtmsvr.GetStore().FindBranches(saga.Gid)
+	succeeded := branches[1]
+	succeeded.Status = StatusSucceed
+	dtmsvr.GetStore().LockGlobalSaveBranches(saga.Gid, StatusSubmitted, []storage.TransBranchStore{succeeded}, 1)
+
+	// the TransOut action is not called again, or it fails and the saga is rolled back
+	busi.MainSwitch.TransOutResult.SetOnce(dtmcli.ResultFailure)
+	defer busi.MainSwitch.TransOutResult.SetOnce("")
+	trans.WaitResult = true
+	assert.Nil(t, trans.Process(branches))
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(saga.Gid))
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+	assert.Equal(t, dtmcli.ResultFailure, busi.MainSwitch.TransOutResult.Fetch())
+}
+
 func genSaga(gid string, outFailed bool, inFailed bool) *dtmcli.Saga {
 	saga := dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gid)
 	req := busi.GenTransReq(30, outFailed, inFailed)
@@ -97,3 +146,43 @@ func genSaga1(gid string, outFailed bool, inFailed bool) *dtmcli.Saga {
 	saga.Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req)
 	return saga
 }
+
+func TestSagaCompensatePriority(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	saga := genSaga(gid, false, true).SetCompensatePriority(0, 1)
+	busi.MainSwitch.TransOutRevertResult.SetOnce(dtmcli.ResultOngoing)
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	// compensation of branch 0 runs first, so compensation of branch 1 waits
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusFailed}, getBranchesStatus(gid))
+	assert.Equal(t, StatusAborting, getTransStatus(gid))
+	cronTransOnce(t, gid)
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed, StatusSucceed, StatusFailed}, getBranchesStatus(gid))
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+}
+
+func TestSagaCompensatePriorityInvalid(t *testing.T) {
+	saga := genSaga(dtmimp.GetFuncName(), false, false).SetCompensatePriority(2, 1)
+	assert.Error(t, saga.Submit())
+}
+
+func TestSagaResubmit(t *testing.T) {
+	gid := dtmcli.GenGidFromKey(dtmimp.GetFuncName())
+	saga := genSaga(gid, false, false)
+	err := saga.Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+
+	err = genSaga(gid, false, false).Submit() // a retried business request
+	assert.Nil(t, err)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+
+	err = genSaga(gid, false, true).Submit()
+	assert.ErrorIs(t, err, dtmcli.ErrFailure)
+	assert.Contains(t, err.Error(), "different payload")
+	err = dtmcli.NewSaga(DtmServer, gid).Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", busi.GenTransReq(30, false, false)).Submit()
+	assert.ErrorIs(t, err, dtmcli.ErrFailure)
+	assert.Contains(t, err.Error(), "different branch_count")
+}
@@ -1,13 +1,19 @@
 package test
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
 	"github.com/dtm-labs/dtm/dtmsvr/storage"
 	"github.com/dtm-labs/dtm/dtmsvr/storage/registry"
+	"github.com/dtm-labs/dtm/dtmsvr/storage/sql"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/stretchr/testify/assert"
 )
@@ -57,17 +63,51 @@ func TestStoreSave(t *testing.T) {
 	s.ChangeGlobalStatus(g, "succeed", []string{}, true)
 }
 
+func TestStoreSaveBranchesIdempotent(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	next := time.Now().Add(10 * time.Second)
+	s := registry.GetStore()
+	g := &storage.TransGlobalStore{Gid: gid, Status: "prepared", NextCronTime: &next}
+	assert.Nil(t, s.MaySaveNewTrans(g, nil))
+	created := time.Now().Add(-time.Minute).Round(time.Second)
+	register := func() []storage.TransBranchStore {
+		return []storage.TransBranchStore{
+			{ModelBase: dtmutil.ModelBase{CreateTime: &created}, Gid: gid, BranchID: "01", Op: "cancel", Status: "prepared"},
+			{ModelBase: dtmutil.ModelBase{CreateTime: &created}, Gid: gid, BranchID: "01", Op: "confirm", Status: "prepared"},
+		}
+	}
+	assert.Equal(t, []bool{true, true}, s.LockGlobalSaveBranches(gid, g.Status, register(), -1))
+
+	confirm := *s.FindBranch(gid, "01", "confirm")
+	confirm.Status = "succeed"
+	confirm.CreateTime = nil
+	assert.Equal(t, []bool{true}, s.LockGlobalSaveBranches(gid, g.Status, []storage.TransBranchStore{confirm}, 1))
+
+	// the registration retried after a timeout arrives late, and the stale status is not saved
+	assert.Equal(t, []bool{false, false}, s.LockGlobalSaveBranches(gid, g.Status, register(), -1))
+	confirm.Status = "prepared"
+	assert.Equal(t, []bool{false}, s.LockGlobalSaveBranches(gid, g.Status, []storage.TransBranchStore{confirm}, 1))
+
+	branches := s.FindBranches(gid)
+	assert.Equal(t, 2, len(branches))
+	assert.Equal(t, "succeed", branches[1].Status)
+	assert.True(t, created.Equal(*branches[1].CreateTime))
+	assert.Nil(t, s.ChangeGlobalStatus(g, "succeed", []string{"status"}, true))
+}
+
 func TestStoreChangeStatus(t *testing.T) {
 	gid := dtmimp.GetFuncName()
 	g, s := initTransGlobal(gid)
 	g.Status = "no"
-	err := dtmimp.CatchP(func() {
-		s.ChangeGlobalStatus(g, "submitted", []string{}, false)
-	})
-	assert.Equal(t, storage.ErrNotFound, err)
+	err := s.ChangeGlobalStatus(g, "submitted", []string{}, false)
+	assert.Equal(t, &storage.StatusConflictError{Gid: gid, Expected: "no", Actual: "prepared"}, err)
+	assert.Equal(t, "no", g.Status)
 	g.Status = "prepared"
-	s.ChangeGlobalStatus(g, "submitted", []string{}, false)
-	s.ChangeGlobalStatus(g, "succeed", []string{}, true)
+	assert.Nil(t, s.ChangeGlobalStatus(g, "submitted", []string{}, false))
+	assert.Nil(t, s.ChangeGlobalStatus(g, "succeed", []string{}, true))
+
+	g2 := &storage.TransGlobalStore{Gid: gid + "-none", Status: "prepared"}
+	assert.Equal(t, storage.ErrNotFound, s.ChangeGlobalStatus(g2, "submitted", []string{}, false))
 }
 
 func TestStoreLockTrans(t *testing.T) {
@@ -93,6 +133,132 @@ func TestStoreLockTrans(t *testing.T) {
 	assert.Nil(t, g2)
 }
 
+func TestStoreLockTransPriority(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	s := registry.GetStore()
+	save := func(suffix string, priority int, next time.Time) *storage.TransGlobalStore {
+		g := &storage.TransGlobalStore{Gid: gid + suffix, Status: "prepared", NextCronTime: &next}
+		g.Priority = priority
+		dtmimp.E2P(s.MaySaveNewTrans(g, []storage.TransBranchStore{{Gid: g.Gid, BranchID: "01"}}))
+		return g
+	}
+	aged := time.Now().Add(-time.Duration(conf.PriorityAging+10) * time.Second)
+	gs := []*storage.TransGlobalStore{
+		save("-low", -1, time.Now().Add(time.Second)),
+		save("-high", 5, time.Now().Add(2*time.Second)),
+		save("-normal", 0, time.Now().Add(time.Second)),
+		save("-aged", -1, aged),
+	}
+	assert.Equal(t, map[int]int64{-1: 1}, s.CountOverdueByPriority(time.Now()))
+	for _, suffix := range []string{"-aged", "-high", "-normal", "-low"} {
+		g := s.LockOneGlobalTrans(5 * time.Second)
+		assert.NotNil(t, g)
+		assert.Equal(t, gid+suffix, g.Gid)
+	}
+	assert.Nil(t, s.LockOneGlobalTrans(5*time.Second))
+	for _, g := range gs {
+		s.ChangeGlobalStatus(g, "succeed", []string{}, true)
+	}
+}
+
+func TestStoreTouchCronTimes(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	s := registry.GetStore()
+	now := time.Now()
+	gs := []*storage.TransGlobalStore{}
+	updates := []storage.CronTimeUpdate{}
+	for _, suffix := range []string{"-1", "-2"} {
+		g := &storage.TransGlobalStore{Gid: gid + suffix, Status: "prepared", NextCronTime: &now}
+		dtmimp.E2P(s.MaySaveNewTrans(g, []storage.TransBranchStore{{Gid: g.Gid, BranchID: "01"}}))
+		gs = append(gs, g)
+		snapshot := *g
+		next := now.Add(time.Hour)
+		updates = append(updates, storage.CronTimeUpdate{Global: &snapshot, NextCronInterval: 20, NextCronTime: &next})
+	}
+	assert.Nil(t, s.ChangeGlobalStatus(gs[1], "submitted", []string{"status"}, false)) // the touch of the changed status is skipped
+	s.TouchCronTimes(updates)
+	assert.Equal(t, int64(20), s.FindTransGlobalStore(gid+"-1").NextCronInterval)
+	assert.Equal(t, "submitted", s.FindTransGlobalStore(gid+"-2").Status)
+	assert.NotEqual(t, int64(20), s.FindTransGlobalStore(gid+"-2").NextCronInterval)
+	for _, g := range gs {
+		s.ChangeGlobalStatus(s.FindTransGlobalStore(g.Gid), "succeed", []string{"status"}, true) // the versions are changed by the touches
+	}
+}
+
+func TestStoreSchemaUpToDate(t *testing.T) {
+	assert.Nil(t, registry.CheckSchema()) // the schema is migrated from zero by PopulateDB
+}
+
+// TestStoreMigrateBaseline migrates the schema created by the first release of dtm, which is not versioned, to the latest
+func TestStoreMigrateBaseline(t *testing.T) {
+	if !conf.Store.IsDB() {
+		return
+	}
+	db, err := dtmimp.StandaloneDB(conf.Store.GetDBConf())
+	assert.Nil(t, err)
+	defer func() { _ = db.Close() }()
+	for _, table := range []string{"dtm.kv", "dtm.trans_branch_attempt", "dtm.trans_payload", "dtm.trans_event", "dtm.trans_event_counter", conf.Store.SchemaVersionTable} {
+		_, err := db.Exec("drop table IF EXISTS " + table)
+		assert.Nil(t, err)
+	}
+	baseline, err := ioutil.ReadFile(fmt.Sprintf("../dtmsvr/storage/sql/testdata/dtmsvr.storage.%s.baseline.sql", conf.Store.Driver))
+	assert.Nil(t, err)
+	for _, stmt := range strings.Split(string(baseline), ";") {
+		if strings.TrimSpace(stmt) != "" {
+			_, err := db.Exec(stmt)
+			assert.Nil(t, err)
+		}
+	}
+	assert.NotNil(t, sql.Migrate(false)) // stamped as version 1
+	assert.Nil(t, sql.Migrate(true))
+	assert.Nil(t, sql.Migrate(false))
+
+	gid := dtmimp.GetFuncName()
+	s := registry.GetStore()
+	err = s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: gid, Status: "prepared", ExtData: `{"g":1}`},
+		[]storage.TransBranchStore{{Gid: gid, BranchID: "01", ExtData: `{"b":1}`}})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"g":1}`, s.FindTransGlobalStore(gid).ExtData)
+	assert.Equal(t, `{"b":1}`, s.FindBranches(gid)[0].ExtData)
+	assert.Nil(t, s.CreateKV("test", gid, "v"))
+	assert.Equal(t, "v", s.FindKV("test", gid)[0].V)
+}
+
+// TestStoreEventsConcurrent saves the events concurrently, while reading them as a consumer of the event log does. the
+// seqs read are contiguous, so no event is skipped by committing after an event of a larger seq is read
+func TestStoreEventsConcurrent(t *testing.T) {
+	s := registry.GetStore()
+	gid := dtmimp.GetFuncName()
+	now := time.Now()
+	first := &storage.EventRecord{Gid: gid, TransType: "msg", NewStatus: "submitted", EventTime: &now}
+	assert.Nil(t, s.SaveEvent(first))
+
+	writers, perWriter := 8, 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				e := &storage.EventRecord{Gid: fmt.Sprintf("%s-%d", gid, i), TransType: "msg", EventSeq: int64(j), NewStatus: "submitted", EventTime: &now}
+				assert.Nil(t, s.SaveEvent(e))
+			}
+		}(i)
+	}
+	last, read := first.Seq, 0
+	deadline := time.Now().Add(time.Minute)
+	for read < writers*perWriter && time.Now().Before(deadline) {
+		for _, e := range s.FindEvents(last, 100) {
+			assert.Equal(t, last+1, e.Seq, "an event is skipped")
+			last = e.Seq
+			read++
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, writers*perWriter, read)
+	assert.Empty(t, s.FindEvents(last, 100))
+}
+
 func TestStoreResetCronTime(t *testing.T) {
 	s := registry.GetStore()
 	testStoreResetCronTime(t, dtmimp.GetFuncName(), func(timeout int64, limit int64) (int64, bool, error) {
@@ -178,3 +344,221 @@ func TestUpdateBranches(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestStoreDuplicateTrans(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	next := time.Now().Add(10 * time.Second)
+	bs := []storage.TransBranchStore{{Gid: gid, BranchID: "01", Op: "action", URL: "http://busi/TransIn", BinData: []byte(`{"amount":30}`)}}
+	newGlobal := func() *storage.TransGlobalStore {
+		return &storage.TransGlobalStore{Gid: gid, TransType: "saga", Status: "submitted", NextCronTime: &next,
+			PayloadsHash: storage.PayloadsHash(bs), BranchCount: len(bs)}
+	}
+	s := registry.GetStore()
+	assert.Nil(t, s.MaySaveNewTrans(newGlobal(), bs))
+
+	err := s.MaySaveNewTrans(newGlobal(), bs) // a retried submit
+	assert.ErrorIs(t, err, storage.ErrUniqueConflict)
+	assert.Equal(t, &storage.DuplicateTransError{Gid: gid, Mismatches: []string{}}, err)
+
+	g := newGlobal()
+	g.TransType = "msg"
+	g.PayloadsHash = storage.PayloadsHash([]storage.TransBranchStore{{BranchID: "01", Op: "action", URL: "http://busi/TransOut"}})
+	err = s.MaySaveNewTrans(g, bs)
+	assert.Equal(t, &storage.DuplicateTransError{Gid: gid, Mismatches: []string{"trans_type", "payloads"}}, err)
+	assert.Equal(t, 1, len(s.FindBranches(gid)))
+}
+
+func TestStoreFindBranchesPage(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	next := time.Now().Add(10 * time.Second)
+	bs := []storage.TransBranchStore{}
+	for _, id := range []string{"01", "02", "03"} {
+		bs = append(bs, storage.TransBranchStore{Gid: gid, BranchID: id, Op: "compensate"}, storage.TransBranchStore{Gid: gid, BranchID: id, Op: "action"})
+	}
+	s := registry.GetStore()
+	assert.Nil(t, s.MaySaveNewTrans(&storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &next}, bs))
+
+	page := s.FindBranchesPage(gid, "", 3)
+	assert.Equal(t, []string{"01", "01", "02", "02"}, []string{page[0].BranchID, page[1].BranchID, page[2].BranchID, page[3].BranchID})
+	page = s.FindBranchesPage(gid, "02", 3)
+	assert.Equal(t, 2, len(page))
+	assert.Equal(t, "03", page[0].BranchID)
+	assert.Empty(t, s.FindBranchesPage(gid, "03", 3))
+}
+
+func TestStoreDedupPayloads(t *testing.T) {
+	if !conf.Store.IsDB() {
+		return
+	}
+	old := conf.Store.DedupPayloadSize
+	conf.Store.DedupPayloadSize = 16
+	defer func() { conf.Store.DedupPayloadSize = old }()
+	gid := dtmimp.GetFuncName()
+	next := time.Now().Add(10 * time.Second)
+	large := []byte(`{"amount":30,"note":"a payload of the fan-out"}`)
+	bs := []storage.TransBranchStore{
+		{Gid: gid, BranchID: "01", Op: "action", URL: "http://busi/TransIn1", BinData: large},
+		{Gid: gid, BranchID: "02", Op: "action", URL: "http://busi/TransIn2", BinData: large},
+		{Gid: gid, BranchID: "03", Op: "action", URL: "http://busi/TransIn3", BinData: []byte(`{}`)},
+	}
+	s := registry.GetStore()
+	g := &storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &next}
+	assert.Nil(t, s.MaySaveNewTrans(g, bs))
+	assert.NotZero(t, bs[1].ID)
+	assert.Equal(t, large, bs[1].BinData) // the branches passed in are not changed
+	s.LockGlobalSaveBranches(gid, g.Status, []storage.TransBranchStore{{Gid: gid, BranchID: "04", Op: "action", BinData: large}}, -1)
+
+	purged, err := s.PurgePayloads(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, purged, int64(0))
+	branches := s.FindBranches(gid)
+	assert.Equal(t, 4, len(branches))
+	for i, b := range branches {
+		assert.Equal(t, dtmimp.If(i == 2, []byte(`{}`), large), b.BinData)
+	}
+	assert.Equal(t, large, s.FindBranch(gid, "04", "action").BinData)
+	assert.Nil(t, s.ChangeGlobalStatus(g, "succeed", []string{"status"}, true))
+}
+
+func TestStoreUpdateCustomData(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	g, s := initTransGlobal(gid)
+	assert.Nil(t, s.UpdateGlobalCustomData(g, `{"ref":"R1"}`))
+	assert.Nil(t, s.UpdateGlobalCustomData(g, `{"ref":"R1"}`)) // unchanged
+	assert.Equal(t, `{"ref":"R1"}`, s.FindTransGlobalStore(gid).CustomData)
+
+	assert.Nil(t, s.ChangeGlobalStatus(g, "failed", []string{"status"}, true))
+	assert.Equal(t, `{"ref":"R1"}`, s.FindTransGlobalStore(gid).CustomData)
+	err := s.UpdateGlobalCustomData(g, `{"ref":"R2"}`)
+	assert.Equal(t, &storage.StatusConflictError{Gid: gid, Expected: storage.StatusUnfinished, Actual: "failed"}, err)
+	assert.Equal(t, storage.ErrNotFound, s.UpdateGlobalCustomData(&storage.TransGlobalStore{Gid: gid + "-none"}, ""))
+}
+
+func TestStoreGlobalVersion(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	_, s := initTransGlobal(gid)
+	a, b := s.FindTransGlobalStore(gid), s.FindTransGlobalStore(gid) // read by two writers
+	assert.Nil(t, s.UpdateGlobalCustomData(a, `{"ref":"R1"}`))
+	assert.Equal(t, int64(1), a.Version)
+
+	err := s.ChangeGlobalStatus(b, "submitted", []string{"status", "update_time"}, false)
+	assert.Equal(t, &storage.VersionConflictError{Gid: gid, Expected: 0, Actual: 1}, err)
+	assert.Equal(t, "prepared", b.Status)
+	assert.Equal(t, int64(0), b.Version)
+	next := time.Now().Add(time.Hour)
+	s.TouchCronTime(b, 20, &next) // skipped
+	assert.NotEqual(t, int64(20), s.FindTransGlobalStore(gid).NextCronInterval)
+	err = s.UpdateGlobalCustomData(b, `{"ref":"R2"}`)
+	assert.Equal(t, &storage.VersionConflictError{Gid: gid, Expected: 0, Actual: 1}, err)
+
+	s.TouchCronTime(a, 20, &next)
+	assert.Nil(t, s.ChangeGlobalStatus(a, "submitted", []string{"status", "update_time"}, false))
+	saved := s.FindTransGlobalStore(gid)
+	assert.Equal(t, int64(3), saved.Version)
+	assert.Equal(t, int64(20), saved.NextCronInterval)
+	assert.Equal(t, `{"ref":"R1"}`, saved.CustomData)
+	assert.Nil(t, s.ChangeGlobalStatus(saved, "succeed", []string{"status"}, true))
+}
+
+func TestStoreConcurrentWriters(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	_, s := initTransGlobal(gid)
+	const writers = 5
+	start := make(chan struct{})
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		g := s.FindTransGlobalStore(gid)
+		go func(i int) {
+			<-start
+			g.ExtData = fmt.Sprintf(`{"manual_reason":"writer %d"}`, i)
+			errs <- s.ChangeGlobalStatus(g, g.Status, []string{"ext_data", "update_time"}, false)
+		}(i)
+	}
+	close(start)
+	succeeded := 0
+	for i := 0; i < writers; i++ {
+		var conflict *storage.VersionConflictError
+		if err := <-errs; err == nil {
+			succeeded++
+		} else {
+			assert.True(t, errors.As(err, &conflict), err)
+		}
+	}
+	assert.Equal(t, 1, succeeded) // the writers of the same version do not overwrite each other
+	saved := s.FindTransGlobalStore(gid)
+	assert.Equal(t, int64(1), saved.Version)
+	assert.Nil(t, s.ChangeGlobalStatus(saved, "succeed", []string{"status"}, true))
+}
+
+func TestStoreSaveBatch(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	_, s := initTransGlobal(gid)
+	next := time.Now().Add(10 * time.Second)
+	newTrans := func(gid string) storage.NewTrans {
+		return storage.NewTrans{Global: &storage.TransGlobalStore{Gid: gid, TransType: "msg", Status: "submitted", NextCronTime: &next},
+			Branches: []storage.TransBranchStore{{Gid: gid, BranchID: "01", Op: "action", Status: "prepared"}}}
+	}
+	errs := s.MaySaveNewTransBatch([]storage.NewTrans{newTrans(gid + "-1"), newTrans(gid), newTrans(gid + "-2")})
+	assert.Nil(t, errs[0])
+	assert.True(t, errors.Is(errs[1], storage.ErrUniqueConflict))
+	assert.Nil(t, errs[2])
+	assert.Equal(t, "submitted", s.FindTransGlobalStore(gid+"-2").Status)
+	assert.Equal(t, 1, len(s.FindBranches(gid+"-2")))
+}
+
+func TestStoreStats(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	s := registry.GetStore()
+	now := time.Now().Truncate(time.Second)
+	create, finish := now.Add(-2*time.Minute), now.Add(-time.Minute)
+	g := &storage.TransGlobalStore{Gid: gid, TransType: "stats_test", Status: "succeed", NextCronTime: &now, FinishTime: &finish}
+	g.CreateTime = &create
+	assert.Nil(t, s.MaySaveNewTrans(g, nil))
+
+	cond := storage.StatsCondition{From: now.Add(-3 * time.Minute), To: now, Bucket: time.Minute}
+	stats := s.Stats(cond)
+	found := false
+	for _, c := range stats.Counts {
+		if c.TransType == "stats_test" {
+			found = true
+			assert.True(t, c.Bucket.Equal(now.Add(-3*time.Minute).Add(time.Minute)))
+			assert.Equal(t, "succeed", c.Status)
+			assert.GreaterOrEqual(t, c.Count, int64(1))
+		}
+	}
+	assert.True(t, found)
+	for _, d := range stats.Durations {
+		if d.TransType == "stats_test" {
+			assert.Equal(t, 60.0, d.P50)
+		}
+	}
+}
+
+func TestStoreCronTimeLag(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	now := time.Now()
+	g, s := initTransGlobalByNextCronTime(gid, now.Add(-time.Hour))
+	assert.False(t, s.FindOldestCronTime().After(now.Add(-time.Hour)))
+	count := s.CountCronTimeBefore(now.Add(-30 * time.Minute))
+	assert.GreaterOrEqual(t, count, int64(1))
+
+	assert.Nil(t, s.ChangeGlobalStatus(g, "failed", []string{"status"}, true))
+	assert.Equal(t, count-1, s.CountCronTimeBefore(now.Add(-30*time.Minute)))
+}
+
+// BenchmarkStoreSubmit saves and finishes a trans of 2 branches, the store operations of a submit.
+// run it with the store config of test, such as TEST_STORE=redis
+func BenchmarkStoreSubmit(b *testing.B) {
+	s := registry.GetStore()
+	prefix := fmt.Sprintf("%s-%d-", dtmimp.GetFuncName(), time.Now().UnixNano())
+	for i := 0; i < b.N; i++ {
+		gid := prefix + strconv.Itoa(i)
+		next := time.Now().Add(10 * time.Second)
+		g := &storage.TransGlobalStore{Gid: gid, Status: "submitted", NextCronTime: &next}
+		bs := []storage.TransBranchStore{{Gid: gid, BranchID: "01"}, {Gid: gid, BranchID: "02"}}
+		dtmimp.E2P(s.MaySaveNewTrans(g, bs))
+		s.LockGlobalSaveBranches(gid, "submitted", []storage.TransBranchStore{{Gid: gid, BranchID: "03"}}, -1)
+		s.TouchCronTime(g, 10, &next)
+		dtmimp.E2P(s.ChangeGlobalStatus(g, "succeed", []string{"status"}, true))
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestTccBarrierMongoCancelBeforeTry(t *testing.T) {
+	mc := busi.MongoGet()
+	assert.Nil(t, dtmcli.MongoCreateBarrierIndex(mc))
+	gid := dtmimp.GetFuncName()
+	called := false
+	mongoCall := func(branchID string, op string, busiCall func(mongo.SessionContext) error) error {
+		bb := &dtmcli.BranchBarrier{TransType: "tcc", Gid: gid, BranchID: branchID, Op: op}
+		return mc.UseSession(context.Background(), func(sc mongo.SessionContext) error {
+			return bb.MongoCallWithSession(sc, busiCall)
+		})
+	}
+	succeed := func(sc mongo.SessionContext) error {
+		called = true
+		return nil
+	}
+
+	// the cancel arrives before the try: null compensation, and then the try is dangled
+	for _, op := range []string{dtmcli.BranchCancel, dtmcli.BranchTry} {
+		assert.Nil(t, mongoCall("01", op, succeed))
+		assert.False(t, called)
+	}
+
+	// the failed business aborts the transaction, so the barrier is not saved, and the retried try is called
+	err := mongoCall("02", dtmcli.BranchTry, func(sc mongo.SessionContext) error {
+		return dtmcli.ErrFailure
+	})
+	assert.ErrorIs(t, err, dtmcli.ErrFailure)
+	assert.Nil(t, mongoCall("02", dtmcli.BranchTry, succeed))
+	assert.True(t, called)
+}
@@ -43,4 +43,8 @@ func TestTccNested(t *testing.T) {
 	waitTransProcessed(gid)
 	assert.Equal(t, StatusSucceed, getTransStatus(gid))
 	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(gid))
+
+	resp, err := dtmimp.RestyClient.R().SetQueryParam("gid", gid).Get(dtmutil.DefaultHTTPServer + "/query")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.String(), `"children":[{"branch_id":"0201"`)
 }
@@ -7,10 +7,16 @@
 package test
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr"
 	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
 	"github.com/go-resty/resty/v2"
@@ -70,6 +76,23 @@ func TestTccTimeout(t *testing.T) {
 	assert.Equal(t, []string{StatusSucceed, StatusPrepared}, getBranchesStatus(gid))
 }
 
+func TestTccTryTimeout(t *testing.T) {
+	req := busi.GenTransReq(30, false, false)
+	gid := dtmimp.GetFuncName()
+	err := dtmcli.TccGlobalTransaction2(dtmutil.DefaultHTTPServer, gid, func(tcc *dtmcli.Tcc) {
+		tcc.SetTryTimeout(10)
+	}, func(tcc *dtmcli.Tcc) (*resty.Response, error) {
+		_, err := tcc.CallBranch(req, Busi+"/TransOut", Busi+"/TransOutConfirm", Busi+"/TransOutRevert")
+		assert.Nil(t, err)
+		cronTransOnceForwardNow(t, gid, 11) // the AP hangs in the try phase
+		return nil, nil
+	})
+	assert.ErrorIs(t, err, dtmcli.ErrFailure) // the submit is too late
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+	assert.Equal(t, "try timeout", dtmsvr.GetStore().FindTransGlobalStore(gid).RollbackReason)
+	assert.Equal(t, []string{StatusSucceed, StatusPrepared}, getBranchesStatus(gid))
+}
+
 func TestTccCompatible(t *testing.T) {
 	req := busi.GenTransReq(30, false, false)
 	gid := dtmimp.GetFuncName()
@@ -100,3 +123,79 @@ func TestTccHeaders(t *testing.T) {
 	assert.Equal(t, StatusSucceed, getTransStatus(gid))
 	assert.Equal(t, []string{StatusPrepared, StatusSucceed}, getBranchesStatus(gid))
 }
+
+func TestTccConcurrent(t *testing.T) {
+	req := busi.GenTransReq(30, false, false)
+	gid := dtmimp.GetFuncName()
+	err := dtmcli.TccGlobalTransaction2(dtmutil.DefaultHTTPServer, gid, func(tcc *dtmcli.Tcc) {
+		tcc.SetConcurrent(1)
+	}, func(tcc *dtmcli.Tcc) (*resty.Response, error) {
+		_, err := tcc.CallBranch(req, Busi+"/TransOut", Busi+"/TransOutConfirm", Busi+"/TransOutRevert")
+		assert.Nil(t, err)
+		busi.MainSwitch.TransInConfirmResult.SetOnce(dtmcli.ResultOngoing)
+		return tcc.CallBranch(req, Busi+"/TransIn", Busi+"/TransInConfirm", Busi+"/TransInRevert")
+	})
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	// the ongoing confirm is left to cron, the other is confirmed
+	assert.Equal(t, StatusSubmitted, getTransStatus(gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusPrepared}, getBranchesStatus(gid))
+	cronTransOnce(t, gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(gid))
+}
+
+func BenchmarkTccConfirm(b *testing.B) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "Confirm") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.Write([]byte(`{"dtm_result":"SUCCESS"}`))
+	}))
+	defer svr.Close()
+	for _, parallel := range []int{-1, 0, 10} { // -1 means sequential
+		b.Run(fmt.Sprintf("parallel-%d", parallel), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := dtmcli.TccGlobalTransaction2(dtmutil.DefaultHTTPServer, dtmimp.GetFuncName()+dtmcli.MustGenGid(dtmutil.DefaultHTTPServer), func(tcc *dtmcli.Tcc) {
+					tcc.WaitResult = true
+					if parallel >= 0 {
+						tcc.SetConcurrent(parallel)
+					}
+				}, func(tcc *dtmcli.Tcc) (*resty.Response, error) {
+					for j := 0; j < 30; j++ {
+						if _, err := tcc.CallBranch(&busi.TransReq{}, svr.URL+"/Try", svr.URL+"/Confirm", svr.URL+"/Cancel"); err != nil {
+							return nil, err
+						}
+					}
+					return nil, nil
+				})
+				assert.Nil(b, err)
+			}
+		})
+	}
+}
+
+func TestTccRegisterTwice(t *testing.T) {
+	req := busi.GenTransReq(30, false, false)
+	gid := dtmimp.GetFuncName()
+	err := dtmcli.TccGlobalTransaction(dtmutil.DefaultHTTPServer, gid, func(tcc *dtmcli.Tcc) (*resty.Response, error) {
+		register := func(confirmURL string) error {
+			return dtmimp.TransRegisterBranch(&tcc.TransBase, map[string]string{
+				"data":               dtmimp.MustMarshalString(req),
+				"branch_id":          "01",
+				dtmcli.BranchConfirm: confirmURL,
+				dtmcli.BranchCancel:  Busi + "/TransOutRevert",
+			}, "registerBranch")
+		}
+		assert.Nil(t, register(Busi+"/TransOutConfirm"))
+		assert.Nil(t, register(Busi+"/TransOutConfirm")) // a retried registration is accepted
+		assert.Nil(t, register(Busi+"/TransOutConfirm")) // and acknowledged by the cache of results
+		err := register(Busi + "/TransInConfirm")        // but not a different branch of the same id
+		assert.ErrorIs(t, err, dtmcli.ErrFailure)
+		return dtmimp.TransRequestBranch(&tcc.TransBase, "POST", req, "01", dtmcli.BranchTry, Busi+"/TransOut")
+	})
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed}, getBranchesStatus(gid))
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr"
+	"github.com/dtm-labs/dtm/dtmsvr/storage"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+)
+
+// registerTemplate registers the saga without payloads as a template, and returns the response
+func registerTemplate(t *testing.T, name string, saga *dtmcli.Saga) map[string]interface{} {
+	saga.BuildCustomOptions()
+	tpl := map[string]interface{}{}
+	dtmimp.MustUnmarshalString(dtmimp.MustMarshalString(saga), &tpl)
+	tpl["name"] = name
+	delete(tpl, "gid")
+	delete(tpl, "payloads")
+	res := map[string]interface{}{}
+	_, err := dtmcli.GetRestyClient().R().SetBody(tpl).SetResult(&res).SetError(&res).Post(DtmServer + "/admin/templates")
+	assert.Nil(t, err)
+	return res
+}
+
+func getTransTemplate(gid string) *storage.TemplateRef {
+	ext := storage.TransGlobalExt{}
+	dtmimp.MustUnmarshalString(dtmsvr.GetStore().FindTransGlobalStore(gid).ExtData, &ext)
+	return ext.Template
+}
+
+func TestTemplateSubmit(t *testing.T) {
+	name := dtmimp.GetFuncName()
+	res := registerTemplate(t, name, genSaga("", false, false))
+	assert.Equal(t, float64(1), res["version"])
+
+	gid := name + "-v1"
+	req := busi.GenTransReq(30, false, false)
+	err := dtmcli.NewTemplateTrans(DtmServer, gid, name).Add(&req).Add(&req).Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(gid))
+	assert.Equal(t, &storage.TemplateRef{Name: name, Version: 1}, getTransTemplate(gid))
+
+	res = registerTemplate(t, name, genSaga1("", false, false).SetBranchRetryInterval(0, 10))
+	assert.Equal(t, float64(2), res["version"])
+	gid2 := name + "-v2"
+	assert.Nil(t, dtmcli.NewTemplateTrans(DtmServer, gid2, name).Add(&req).Submit())
+	waitTransProcessed(gid2)
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed}, getBranchesStatus(gid2))
+	assert.Equal(t, uint64(2), getTransTemplate(gid2).Version)
+	assert.Equal(t, uint64(1), getTransTemplate(gid).Version) // not affected by the new version
+	assert.Len(t, dtmsvr.GetStore().FindBranches(gid), 4)
+}
+
+func TestTemplateRollback(t *testing.T) {
+	name := dtmimp.GetFuncName()
+	registerTemplate(t, name, genSaga("", false, false))
+	gid := name
+	err := dtmcli.NewTemplateTrans(DtmServer, gid, name).Add(busi.GenTransReq(30, false, false)).Add(busi.GenTransReq(30, false, true)).Submit()
+	assert.Nil(t, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+	assert.Equal(t, []string{StatusSucceed, StatusSucceed, StatusSucceed, StatusFailed}, getBranchesStatus(gid))
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	name := dtmimp.GetFuncName()
+	req := busi.GenTransReq(30, false, false)
+	err := dtmcli.NewTemplateTrans(DtmServer, name, name).Add(&req).Submit()
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument)) // not registered
+
+	registerTemplate(t, name, genSaga("", false, false))
+	err = dtmcli.NewTemplateTrans(DtmServer, name, name).Add(&req).Submit()
+	assert.True(t, errors.Is(err, dtmcli.ErrInvalidArgument)) // 1 payload for 2 steps
+
+	saga := dtmcli.NewSaga(DtmServer, "").Add("", busi.Busi+"/TransOutRevert", nil)
+	res := registerTemplate(t, name+"-no-action", saga)
+	assert.Contains(t, res["message"], "has no action")
+	res = registerTemplate(t, name+"-xa", &dtmcli.Saga{TransBase: *dtmimp.NewTransBase("", "xa", DtmServer, "")})
+	assert.Contains(t, res["message"], "not supported by template")
+
+	resp, err := dtmcli.GetRestyClient().R().SetQueryParam("name", name).Get(DtmServer + "/admin/templates")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, resp.String(), busi.Busi+"/TransIn")
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021 yedf. All rights reserved.
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file.
+ */
+
+package test
+
+import (
+	"testing"
+
+	"github.com/dtm-labs/dtm/dtmcli"
+	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmsvr/config"
+	"github.com/dtm-labs/dtm/dtmutil"
+	"github.com/dtm-labs/dtm/test/busi"
+	"github.com/stretchr/testify/assert"
+)
+
+func genSagaSigned(gid string) *dtmcli.Saga {
+	req := busi.GenTransReq(30, false, false)
+	return dtmcli.NewSaga(dtmutil.DefaultHTTPServer, gid).
+		Add(busi.Busi+"/TransOut", busi.Busi+"/TransOutRevert", &req).
+		Add(busi.Busi+"/TransInSigned", busi.Busi+"/TransInRevert", &req)
+}
+
+func TestTransformHmacSigned(t *testing.T) {
+	conf.PayloadTransforms = []config.PayloadTransform{{URLPattern: "/TransInSigned$", Transformer: "hmac", Secret: busi.SignSecret}}
+	defer func() { conf.PayloadTransforms = nil }()
+	saga := genSagaSigned(dtmimp.GetFuncName())
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+	assert.Equal(t, []string{StatusPrepared, StatusSucceed, StatusPrepared, StatusSucceed}, getBranchesStatus(saga.Gid))
+}
+
+func TestTransformWrongSecret(t *testing.T) {
+	conf.PayloadTransforms = []config.PayloadTransform{{URLPattern: "/TransInSigned$", Transformer: "hmac", Secret: "wrong"}}
+	defer func() { conf.PayloadTransforms = nil }()
+	saga := genSagaSigned(dtmimp.GetFuncName())
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusFailed, getTransStatus(saga.Gid))
+}
+
+func TestTransformError(t *testing.T) {
+	conf.PayloadTransforms = []config.PayloadTransform{{URLPattern: "/TransInSigned$", Transformer: "hmac"}} // no secret
+	defer func() { conf.PayloadTransforms = nil }()
+	saga := genSagaSigned(dtmimp.GetFuncName())
+	assert.Nil(t, saga.Submit())
+	waitTransProcessed(saga.Gid)
+	assert.Equal(t, StatusSubmitted, getTransStatus(saga.Gid)) // retried later, instead of sent unsigned
+
+	conf.PayloadTransforms[0].Secret = busi.SignSecret
+	cronTransOnce(t, saga.Gid)
+	assert.Equal(t, StatusSucceed, getTransStatus(saga.Gid))
+}
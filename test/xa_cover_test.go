@@ -50,5 +50,59 @@ func TestXaCoverGidError(t *testing.T) {
 		return nil, err
 	})
 	assert.Error(t, err)
-	waitTransProcessed(gid)
+	assert.Contains(t, err.Error(), "invalid char")
+}
+
+// xaPrepared checks the xa of the gtrid is prepared, and not committed/rolled back
+func xaPrepared(t *testing.T, gtrid string) bool {
+	db, err := dtmimp.StandaloneDB(busi.BusiConf)
+	assert.Nil(t, err)
+	defer db.Close()
+	if busi.BusiConf.Driver == dtmcli.DBTypePostgres {
+		rows, err := db.Query("select gid from pg_prepared_xacts where gid=$1", gtrid)
+		assert.Nil(t, err)
+		defer rows.Close()
+		return rows.Next()
+	}
+	rows, err := db.Query("xa recover")
+	assert.Nil(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var formatID, gtridLength, bqualLength int64
+		var data []byte
+		assert.Nil(t, rows.Scan(&formatID, &gtridLength, &bqualLength, &data))
+		if string(data) == gtrid {
+			return true
+		}
+	}
+	return false
+}
+
+// TestXaCallbackOtherProcess commits a xa prepared by a session held by another process of the RM, so the callback
+// arrives at a process without the session
+func TestXaCallbackOtherProcess(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	xid := dtmimp.DefaultXidFormatter{}.FormatXid(gid, "01")
+	held, err := dtmimp.StandaloneDB(busi.BusiConf) // the session of the other process
+	assert.Nil(t, err)
+	defer held.Close()
+	held.SetMaxOpenConns(1)
+	for _, cmd := range []string{"start", "end", "prepare"} {
+		_, err := dtmimp.DBExec(held, dtmimp.GetDBSpecial().GetXaSQL(cmd, xid.Gtrid))
+		assert.Nil(t, err)
+	}
+	assert.True(t, xaPrepared(t, xid.Gtrid))
+
+	xc := &dtmimp.XaClientBase{Conf: busi.BusiConf} // the process receiving the callback
+	err = xc.HandleCallback(gid, "01", "commit")
+	if err != nil { // mysql can not commit the xa in other sessions, until the session preparing it is closed
+		assert.Equal(t, dtmcli.DBTypeMysql, busi.BusiConf.Driver)
+		assert.True(t, xaPrepared(t, xid.Gtrid))
+		assert.Nil(t, held.Close())
+		err = xc.HandleCallback(gid, "01", "commit")
+	}
+	assert.Nil(t, err)
+	assert.False(t, xaPrepared(t, xid.Gtrid))
+	assert.Nil(t, xc.HandleCallback(gid, "01", "commit"))   // a repeated callback
+	assert.Nil(t, xc.HandleCallback(gid, "02", "rollback")) // a branch not prepared
 }
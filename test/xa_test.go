@@ -9,9 +9,11 @@ package test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/dtm-labs/dtm/dtmcli"
 	"github.com/dtm-labs/dtm/dtmcli/dtmimp"
+	"github.com/dtm-labs/dtm/dtmutil"
 	"github.com/dtm-labs/dtm/test/busi"
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
@@ -122,3 +124,84 @@ func TestXaNotTimeout(t *testing.T) {
 	assert.Equal(t, StatusSucceed, getTransStatus(gid))
 	assert.Equal(t, []string{StatusPrepared, StatusSucceed}, getBranchesStatus(gid))
 }
+
+func TestXaConnPool(t *testing.T) {
+	getXc().ConnPoolSize = 2
+	getXc().ConnIdleTimeout = 10 * time.Second
+	defer func() { getXc().ConnPoolSize = 0 }()
+	for _, inFailed := range []bool{false, true, false} { // connections are reused after commit/rollback
+		gid := dtmimp.GetFuncName() + fmt.Sprintf("-%t-%d", inFailed, time.Now().UnixNano())
+		err := getXc().XaGlobalTransaction(gid, func(xa *dtmcli.Xa) (*resty.Response, error) {
+			req := busi.GenTransReq(30, false, inFailed)
+			resp, err := xa.CallBranch(req, busi.Busi+"/TransOutXa")
+			if err != nil {
+				return resp, err
+			}
+			return xa.CallBranch(req, busi.Busi+"/TransInXa")
+		})
+		waitTransProcessed(gid)
+		if inFailed {
+			assert.Error(t, err)
+			assert.Equal(t, StatusFailed, getTransStatus(gid))
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, StatusSucceed, getTransStatus(gid))
+		}
+	}
+}
+
+func listPreparedXids(t *testing.T) []string {
+	db, err := dtmimp.StandaloneDB(busi.BusiConf)
+	assert.Nil(t, err)
+	defer db.Close()
+	mysql := dtmcli.GetCurrentDBType() == dtmcli.DBTypeMysql
+	rows, err := db.Query(dtmimp.If(mysql, "xa recover", "select gid from pg_prepared_xacts where database = current_database()").(string))
+	assert.Nil(t, err)
+	defer rows.Close()
+	xids := []string{}
+	for rows.Next() {
+		var xid string
+		if mysql { // formatID, gtrid_length, bqual_length, data
+			var formatID, gtridLength, bqualLength int64
+			err = rows.Scan(&formatID, &gtridLength, &bqualLength, &xid)
+		} else {
+			err = rows.Scan(&xid)
+		}
+		assert.Nil(t, err)
+		xids = append(xids, xid)
+	}
+	return xids
+}
+
+// prepareOrphanXa simulates a RM crashed after xa prepare
+func prepareOrphanXa(t *testing.T, xid string) {
+	db, err := dtmimp.StandaloneDB(busi.BusiConf)
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, cmd := range []string{"start", "end", "prepare"} {
+		_, err = dtmimp.DBExec(db, dtmimp.GetDBSpecial().GetXaSQL(cmd, xid))
+		assert.Nil(t, err)
+	}
+}
+
+func TestXaRecoverOrphans(t *testing.T) {
+	gid := dtmimp.GetFuncName()
+	err := getXc().XaGlobalTransaction(gid, func(xa *dtmcli.Xa) (*resty.Response, error) {
+		return nil, fmt.Errorf("busi failed. %w", dtmcli.ErrFailure)
+	})
+	assert.Error(t, err)
+	waitTransProcessed(gid)
+	assert.Equal(t, StatusFailed, getTransStatus(gid))
+
+	unknownGid := gid + "-unknown"
+	prepareOrphanXa(t, gid+"-01")
+	prepareOrphanXa(t, unknownGid+"-01")
+	err = getXc().RecoverOrphans(func(gid string) (string, error) {
+		return dtmimp.QueryTransStatus(dtmutil.DefaultHTTPServer, gid)
+	})
+	assert.Nil(t, err)
+	xids := listPreparedXids(t)
+	assert.NotContains(t, xids, gid+"-01")     // rolled back according to the failed status
+	assert.Contains(t, xids, unknownGid+"-01") // left alone
+	assert.Nil(t, getXc().HandleCallback(unknownGid, "01", "rollback"))
+}